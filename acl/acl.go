@@ -0,0 +1,180 @@
+// Package acl provides an access control list, of allowed and denied peers and
+// IP addresses, that restricts which clients a publisher serves.
+package acl
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// List is an access control list of peers, by peer ID, and of IP addresses. A
+// denied peer or address is never allowed. If any peers are on the allow list,
+// then only those peers are allowed, and likewise for addresses. Peers and
+// addresses are checked separately, so a peer allow list does not affect which
+// addresses are allowed.
+//
+// A List is safe for concurrent use, and can be changed while a publisher is
+// using it. A nil List allows everything.
+type List struct {
+	allowPeers map[peer.ID]struct{}
+	denyPeers  map[peer.ID]struct{}
+	// allowNets and denyNets are keyed by the CIDR string of each network.
+	allowNets map[string]*net.IPNet
+	denyNets  map[string]*net.IPNet
+	mutex     sync.RWMutex
+}
+
+// New creates an empty List, which allows everything.
+func New() *List {
+	return &List{
+		allowPeers: make(map[peer.ID]struct{}),
+		denyPeers:  make(map[peer.ID]struct{}),
+		allowNets:  make(map[string]*net.IPNet),
+		denyNets:   make(map[string]*net.IPNet),
+	}
+}
+
+// AllowPeer adds peers to the allow list.
+func (l *List) AllowPeer(peerIDs ...peer.ID) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, peerID := range peerIDs {
+		l.allowPeers[peerID] = struct{}{}
+	}
+}
+
+// DenyPeer adds peers to the deny list.
+func (l *List) DenyPeer(peerIDs ...peer.ID) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, peerID := range peerIDs {
+		l.denyPeers[peerID] = struct{}{}
+	}
+}
+
+// RemovePeer removes peers from both the allow and deny lists.
+func (l *List) RemovePeer(peerIDs ...peer.ID) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, peerID := range peerIDs {
+		delete(l.allowPeers, peerID)
+		delete(l.denyPeers, peerID)
+	}
+}
+
+// PeerAllowed returns true if the peer is allowed.
+func (l *List) PeerAllowed(peerID peer.ID) bool {
+	if l == nil {
+		return true
+	}
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if _, ok := l.denyPeers[peerID]; ok {
+		return false
+	}
+	if len(l.allowPeers) == 0 {
+		return true
+	}
+	_, ok := l.allowPeers[peerID]
+	return ok
+}
+
+// AllowIP adds addresses to the allow list. Each address is an IP address,
+// such as "192.0.2.1", or a network in CIDR notation, such as "192.0.2.0/24".
+// Returns an error, without changing the list, if any address is invalid.
+func (l *List) AllowIP(addrs ...string) error {
+	nets, err := parseNets(addrs)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, ipNet := range nets {
+		l.allowNets[ipNet.String()] = ipNet
+	}
+	return nil
+}
+
+// DenyIP adds addresses to the deny list. Addresses are given as for AllowIP.
+func (l *List) DenyIP(addrs ...string) error {
+	nets, err := parseNets(addrs)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, ipNet := range nets {
+		l.denyNets[ipNet.String()] = ipNet
+	}
+	return nil
+}
+
+// RemoveIP removes addresses from both the allow and deny lists. An address
+// is only removed if it is given as it was added, as the same IP address or
+// network.
+func (l *List) RemoveIP(addrs ...string) error {
+	nets, err := parseNets(addrs)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, ipNet := range nets {
+		delete(l.allowNets, ipNet.String())
+		delete(l.denyNets, ipNet.String())
+	}
+	return nil
+}
+
+// IPAllowed returns true if the IP address is allowed.
+func (l *List) IPAllowed(ip net.IP) bool {
+	if l == nil {
+		return true
+	}
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if containsIP(l.denyNets, ip) {
+		return false
+	}
+	return len(l.allowNets) == 0 || containsIP(l.allowNets, ip)
+}
+
+func containsIP(nets map[string]*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNets parses IP addresses and CIDR networks. An IP address is parsed as
+// the network that contains only that address.
+func parseNets(addrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(addrs))
+	for _, addr := range addrs {
+		if strings.Contains(addr, "/") {
+			_, ipNet, err := net.ParseCIDR(addr)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, ipNet)
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %s", addr)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
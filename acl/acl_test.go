@@ -0,0 +1,56 @@
+package acl
+
+import (
+	"net"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNilList(t *testing.T) {
+	var l *List
+	require.True(t, l.PeerAllowed(peer.ID("a")))
+	require.True(t, l.IPAllowed(net.ParseIP("192.0.2.1")))
+}
+
+func TestPeers(t *testing.T) {
+	a, b, c := peer.ID("a"), peer.ID("b"), peer.ID("c")
+	l := New()
+	require.True(t, l.PeerAllowed(a))
+
+	l.DenyPeer(a)
+	require.False(t, l.PeerAllowed(a))
+	require.True(t, l.PeerAllowed(b))
+
+	// Only allowed peers are allowed, and deny takes precedence.
+	l.AllowPeer(a, b)
+	require.False(t, l.PeerAllowed(a))
+	require.True(t, l.PeerAllowed(b))
+	require.False(t, l.PeerAllowed(c))
+
+	l.RemovePeer(a, b)
+	require.True(t, l.PeerAllowed(a))
+	require.True(t, l.PeerAllowed(c))
+}
+
+func TestIPs(t *testing.T) {
+	l := New()
+	require.Error(t, l.AllowIP("192.0.2.1", "fish"))
+	require.True(t, l.IPAllowed(net.ParseIP("198.51.100.1")))
+
+	require.NoError(t, l.AllowIP("192.0.2.0/24", "2001:db8::1"))
+	require.True(t, l.IPAllowed(net.ParseIP("192.0.2.7")))
+	require.True(t, l.IPAllowed(net.ParseIP("::ffff:192.0.2.7")))
+	require.True(t, l.IPAllowed(net.ParseIP("2001:db8::1")))
+	require.False(t, l.IPAllowed(net.ParseIP("2001:db8::2")))
+	require.False(t, l.IPAllowed(net.ParseIP("198.51.100.1")))
+
+	require.NoError(t, l.DenyIP("192.0.2.7"))
+	require.False(t, l.IPAllowed(net.ParseIP("192.0.2.7")))
+	require.True(t, l.IPAllowed(net.ParseIP("192.0.2.8")))
+
+	require.NoError(t, l.RemoveIP("192.0.2.7", "192.0.2.0/24", "2001:db8::1"))
+	require.True(t, l.IPAllowed(net.ParseIP("192.0.2.7")))
+	require.True(t, l.IPAllowed(net.ParseIP("198.51.100.1")))
+}
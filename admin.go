@@ -0,0 +1,277 @@
+package legs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/filecoin-project/go-legs/acl"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// AllowPolicy is the policy of which publishers a Subscriber accepts
+// announcements from, as set through the admin handler. A denied publisher is
+// never allowed. If Allow is not empty, then only the publishers in it are
+// allowed. An empty policy allows all publishers.
+type AllowPolicy struct {
+	// Allow lists the allowed publishers.
+	Allow []peer.ID `json:"allow,omitempty"`
+	// Deny lists the denied publishers.
+	Deny []peer.ID `json:"deny,omitempty"`
+}
+
+// adminHandler serves the admin API of a Subscriber.
+type adminHandler struct {
+	sub *Subscriber
+	mux *http.ServeMux
+
+	// policy is the allow policy last set through the handler.
+	policy      AllowPolicy
+	policyMutex sync.Mutex
+}
+
+// syncFailureJSON is the JSON encoding of SyncFailure, with the error encoded
+// as its message.
+type syncFailureJSON struct {
+	SyncFailure
+	Err string `json:"error"`
+}
+
+// statusJSON is the JSON encoding of SubscriberStatus.
+type statusJSON struct {
+	SubscriberStatus
+	Failures []syncFailureJSON `json:"failures"`
+	Paused   bool              `json:"paused"`
+}
+
+// adminSyncRequest is the body of a request to sync with a publisher. The
+// Cid and Addr are optional, and the CID is given as a string.
+type adminSyncRequest struct {
+	PeerID peer.ID `json:"peerID"`
+	Cid    string  `json:"cid,omitempty"`
+	Addr   string  `json:"addr,omitempty"`
+}
+
+// adminLatestSyncRequest is the body of a request to set the latest sync of
+// a publisher, with the CID given as a string.
+type adminLatestSyncRequest struct {
+	PeerID peer.ID `json:"peerID"`
+	Cid    string  `json:"cid"`
+}
+
+// adminLatestSyncResponse is the latest sync of a publisher, and the response
+// to a sync request.
+type adminLatestSyncResponse struct {
+	PeerID peer.ID `json:"peerID"`
+	Cid    cid.Cid `json:"cid"`
+}
+
+// AdminHandler returns an http.Handler that serves an HTTP+JSON API to operate
+// the Subscriber while it is running. The API has these endpoints:
+//
+//   - GET /status returns the Subscriber's Status, and whether syncing is
+//     paused.
+//   - POST /sync syncs with a publisher, given as {"peerID", "cid", "addr"},
+//     where the CID and address are optional. The sync runs until it
+//     completes, or until the request is canceled, and the synced CID is
+//     returned.
+//   - GET /latestsync?peer=<peerID> returns the latest sync of a publisher,
+//     and PUT /latestsync sets it, given as {"peerID", "cid"}.
+//   - POST /pause pauses syncing of announcements, and POST /resume resumes
+//     it. See: Pause.
+//   - GET /allow returns the AllowPolicy last set through the handler, and
+//     PUT /allow sets it, replacing any AllowPeerFunc.
+//
+// The handler does not authenticate requests, so it must only be served where
+// operators can reach it, or be wrapped in a handler that authenticates them.
+// Mount it under a path prefix with http.StripPrefix.
+func (s *Subscriber) AdminHandler() http.Handler {
+	h := &adminHandler{
+		sub: s,
+		mux: http.NewServeMux(),
+	}
+	h.mux.HandleFunc("/status", h.serveStatus)
+	h.mux.HandleFunc("/sync", h.serveSync)
+	h.mux.HandleFunc("/latestsync", h.serveLatestSync)
+	h.mux.HandleFunc("/pause", h.servePause)
+	h.mux.HandleFunc("/resume", h.servePause)
+	h.mux.HandleFunc("/allow", h.serveAllow)
+	return h
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *adminHandler) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	status := h.sub.Status()
+	resp := statusJSON{
+		SubscriberStatus: status,
+		Failures:         make([]syncFailureJSON, len(status.Failures)),
+		Paused:           h.sub.Paused(),
+	}
+	for i, failure := range status.Failures {
+		resp.Failures[i] = syncFailureJSON{
+			SyncFailure: failure,
+			Err:         failure.Err.Error(),
+		}
+	}
+	writeJSON(w, resp)
+}
+
+func (h *adminHandler) serveSync(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var req adminSyncRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.PeerID == "" {
+		http.Error(w, "invalid request: no peer id", http.StatusBadRequest)
+		return
+	}
+	var c cid.Cid
+	if req.Cid != "" {
+		var err error
+		if c, err = cid.Decode(req.Cid); err != nil {
+			http.Error(w, "invalid request: not a cid", http.StatusBadRequest)
+			return
+		}
+	}
+	var addr multiaddr.Multiaddr
+	if req.Addr != "" {
+		var err error
+		if addr, err = multiaddr.NewMultiaddr(req.Addr); err != nil {
+			http.Error(w, "invalid request: not a multiaddr", http.StatusBadRequest)
+			return
+		}
+	}
+
+	log.Infow("Admin sync requested", "peer", req.PeerID, "cid", c, "addr", addr)
+	synced, err := h.sub.Sync(r.Context(), req.PeerID, c, nil, addr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("sync failed: %s", err), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, adminLatestSyncResponse{PeerID: req.PeerID, Cid: synced})
+}
+
+func (h *adminHandler) serveLatestSync(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		peerID, err := peer.Decode(r.URL.Query().Get("peer"))
+		if err != nil {
+			http.Error(w, "invalid request: not a peer id", http.StatusBadRequest)
+			return
+		}
+		latestSync, ok := h.sub.getLatestSync(peerID)
+		if !ok || latestSync == cid.Undef {
+			http.Error(w, "no latest sync", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, adminLatestSyncResponse{PeerID: peerID, Cid: latestSync})
+		return
+	}
+
+	var req adminLatestSyncRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.PeerID == "" {
+		http.Error(w, "invalid request: no peer id", http.StatusBadRequest)
+		return
+	}
+	c, err := cid.Decode(req.Cid)
+	if err != nil {
+		http.Error(w, "invalid request: not a cid", http.StatusBadRequest)
+		return
+	}
+	if err = h.sub.SetLatestSync(req.PeerID, c); err != nil {
+		http.Error(w, fmt.Sprintf("cannot set latest sync: %s", err), http.StatusInternalServerError)
+		return
+	}
+	log.Infow("Admin set latest sync", "peer", req.PeerID, "cid", c)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *adminHandler) servePause(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	if r.URL.Path == "/pause" {
+		h.sub.Pause()
+	} else {
+		h.sub.Resume()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *adminHandler) serveAllow(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	h.policyMutex.Lock()
+	defer h.policyMutex.Unlock()
+	if r.Method == http.MethodGet {
+		writeJSON(w, h.policy)
+		return
+	}
+
+	var policy AllowPolicy
+	if !readJSON(w, r, &policy) {
+		return
+	}
+	if len(policy.Allow) == 0 && len(policy.Deny) == 0 {
+		h.sub.SetAllowPeer(nil)
+	} else {
+		list := acl.New()
+		list.AllowPeer(policy.Allow...)
+		list.DenyPeer(policy.Deny...)
+		h.sub.SetAllowPeer(list.PeerAllowed)
+	}
+	h.policy = policy
+	log.Infow("Admin set allow policy", "allow", len(policy.Allow), "deny", len(policy.Deny))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowMethods checks that the request uses one of the methods, and otherwise
+// responds with http.StatusMethodNotAllowed and returns false.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	for _, method := range methods {
+		w.Header().Add("Allow", method)
+	}
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// readJSON decodes the request body into v, and otherwise responds with
+// http.StatusBadRequest and returns false.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %s", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// writeJSON responds with v encoded as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorw("Cannot write admin response", "err", err)
+	}
+}
@@ -0,0 +1,144 @@
+package legs_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminHandler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	te := setupPublisherSubscriber(t, nil)
+	pubID := te.srcHost.ID()
+	head := test.MkChain(te.srcLinkSys, true)[0].(cidlink.Link).Cid
+	require.NoError(t, te.pub.SetRoot(ctx, head))
+
+	server := httptest.NewServer(te.sub.AdminHandler())
+	defer server.Close()
+
+	do := func(method, path string, body interface{}) *http.Response {
+		var reqBody bytes.Buffer
+		if body != nil {
+			require.NoError(t, json.NewEncoder(&reqBody).Encode(body))
+		}
+		req, err := http.NewRequestWithContext(ctx, method, server.URL+path, &reqBody)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	// Trigger a sync of the publisher's head.
+	resp := do(http.MethodPost, "/sync", map[string]string{
+		"peerID": pubID.String(),
+		"addr":   te.pubAddr.String(),
+	})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var synced struct {
+		PeerID peer.ID `json:"peerID"`
+		Cid    cid.Cid `json:"cid"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&synced))
+	require.Equal(t, pubID, synced.PeerID)
+	require.Equal(t, head, synced.Cid)
+
+	resp = do(http.MethodGet, "/latestsync?peer="+pubID.String(), nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&synced))
+	require.Equal(t, head, synced.Cid)
+
+	// Set the latest sync back to an older CID.
+	older := test.MkChain(te.srcLinkSys, true)[0].(cidlink.Link).Cid
+	resp = do(http.MethodPut, "/latestsync", map[string]string{
+		"peerID": pubID.String(),
+		"cid":    older.String(),
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, cidlink.Link{Cid: older}, te.sub.GetLatestSync(pubID))
+
+	resp = do(http.MethodPut, "/latestsync", map[string]string{
+		"peerID": pubID.String(),
+		"cid":    "not-a-cid",
+	})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Pause and resume syncing.
+	resp = do(http.MethodPost, "/pause", nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.True(t, te.sub.Paused())
+
+	resp = do(http.MethodGet, "/status", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var status struct {
+		Paused   bool              `json:"paused"`
+		Active   []legs.ActiveSync `json:"active"`
+		Failures []struct {
+			PeerID peer.ID `json:"peerID"`
+			Reason string  `json:"reason"`
+			Err    string  `json:"error"`
+		} `json:"failures"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	require.True(t, status.Paused)
+	require.Empty(t, status.Active)
+	require.Empty(t, status.Failures)
+
+	resp = do(http.MethodPost, "/resume", nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.False(t, te.sub.Paused())
+
+	resp = do(http.MethodGet, "/pause", nil)
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	// Change the allow policy.
+	other := test.MkTestHost()
+	defer other.Close()
+	policy := legs.AllowPolicy{
+		Allow: []peer.ID{pubID},
+		Deny:  []peer.ID{other.ID()},
+	}
+	resp = do(http.MethodPut, "/allow", policy)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = do(http.MethodGet, "/allow", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var gotPolicy legs.AllowPolicy
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&gotPolicy))
+	require.Equal(t, policy, gotPolicy)
+
+	// A failed sync is reported in the status with its error.
+	resp = do(http.MethodPost, "/sync", map[string]string{
+		"peerID": pubID.String(),
+		"cid":    older.String() + "x",
+	})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	cids, err := test.RandomCids(1)
+	require.NoError(t, err)
+	resp = do(http.MethodPost, "/sync", map[string]string{
+		"peerID": pubID.String(),
+		"cid":    cids[0].String(),
+		"addr":   te.pubAddr.String(),
+	})
+	require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	resp = do(http.MethodGet, "/status", nil)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	require.Len(t, status.Failures, 1)
+	require.Equal(t, pubID, status.Failures[0].PeerID)
+	require.NotEmpty(t, status.Failures[0].Reason)
+	require.NotEmpty(t, status.Failures[0].Err)
+}
@@ -1,5 +1,6 @@
 // Code adapted from original generated by github.com/whyrusleeping/cbor-gen.
-// This adapted code allows for an optional OrigPeer field.
+// This adapted code allows for optional OrigPeer, IsRecord, and Metadata
+// fields.
 //
 // TODO: Convert Message into IPLD schema and use bindnode for serialization.
 
@@ -21,7 +22,11 @@ func (m *Message) MarshalCBOR(w io.Writer) error {
 	}
 
 	var lengthBufMessage []byte
-	if m.OrigPeer == "" {
+	if len(m.Metadata) != 0 {
+		lengthBufMessage = []byte{134}
+	} else if m.IsRecord {
+		lengthBufMessage = []byte{133}
+	} else if m.OrigPeer == "" {
 		lengthBufMessage = []byte{131}
 	} else {
 		lengthBufMessage = []byte{132}
@@ -71,8 +76,9 @@ func (m *Message) MarshalCBOR(w io.Writer) error {
 		return err
 	}
 
-	// OrigPeer is empty so do not encode it.
-	if len(m.OrigPeer) == 0 {
+	// OrigPeer is empty and is not followed by IsRecord or Metadata, so do not
+	// encode it.
+	if len(m.OrigPeer) == 0 && !m.IsRecord && len(m.Metadata) == 0 {
 		return nil
 	}
 
@@ -88,6 +94,34 @@ func (m *Message) MarshalCBOR(w io.Writer) error {
 		return err
 	}
 
+	// IsRecord is false and is not followed by Metadata, so do not encode it.
+	if !m.IsRecord && len(m.Metadata) == 0 {
+		return nil
+	}
+
+	// Encode m.IsRecord.
+	if err = cbg.WriteBool(w, m.IsRecord); err != nil {
+		return err
+	}
+
+	// Metadata is empty so do not encode it.
+	if len(m.Metadata) == 0 {
+		return nil
+	}
+
+	// Encode m.Metadata.
+	if len(m.Metadata) > cbg.ByteArrayMaxLen {
+		return fmt.Errorf("byte array in field m.Metadata was too long")
+	}
+
+	if err = cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajByteString, uint64(len(m.Metadata))); err != nil {
+		return err
+	}
+
+	if _, err = w.Write(m.Metadata[:]); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -105,16 +139,15 @@ func (m *Message) UnmarshalCBOR(r io.Reader) error {
 		return fmt.Errorf("cbor input should be of type array")
 	}
 
-	if extra > 4 {
+	if extra > 6 {
 		return fmt.Errorf("cbor input had too many fields")
 	}
 	if extra < 3 {
 		return fmt.Errorf("cbor input had too few fields")
 	}
-	var hasOrigPeer bool
-	if extra == 4 {
-		hasOrigPeer = true
-	}
+	hasOrigPeer := extra >= 4
+	hasIsRecord := extra >= 5
+	hasMetadata := extra == 6
 
 	// Decode m.Cid.
 	m.Cid, err = cbg.ReadCid(br)
@@ -195,5 +228,53 @@ func (m *Message) UnmarshalCBOR(r io.Reader) error {
 	}
 	m.OrigPeer = string(sval)
 
+	// IsRecord field does not exist, so nothing more to do.
+	if !hasIsRecord {
+		return nil
+	}
+
+	// Decode m.IsRecord.
+	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajOther {
+		return fmt.Errorf("booleans must be major type 7")
+	}
+	switch extra {
+	case 20:
+		m.IsRecord = false
+	case 21:
+		m.IsRecord = true
+	default:
+		return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
+	}
+
+	// Metadata field does not exist, so nothing more to do.
+	if !hasMetadata {
+		return nil
+	}
+
+	// Decode m.Metadata.
+	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+
+	if extra > cbg.ByteArrayMaxLen {
+		return fmt.Errorf("byte array too large (%d) for Metadata", extra)
+	}
+	if maj != cbg.MajByteString {
+		return fmt.Errorf("expected byte array")
+	}
+
+	if extra > 0 {
+		m.Metadata = make([]uint8, extra)
+	}
+
+	if _, err = io.ReadFull(br, m.Metadata[:]); err != nil {
+		return err
+	}
+
 	return nil
 }
@@ -1,9 +1,14 @@
 package gossiptopic
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 
 	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
 	"github.com/multiformats/go-multiaddr"
 )
 
@@ -19,6 +24,16 @@ type Message struct {
 	// that are re-published by an indexer, for consumption by othen indexers,
 	// contain this field.
 	OrigPeer string
+	// IsRecord indicates that Cid identifies an announcement record instead of
+	// the announced content. The record holds the announced CID along with the
+	// addresses, extra data, and metadata, and is fetched from the publisher.
+	// This keeps the gossip message small when the extra data or metadata is
+	// large.
+	IsRecord bool
+	// Metadata is a small IPLD node, encoded as dag-cbor, that the publisher
+	// attaches to the announcement. It is not part of the announced DAG. The
+	// Metadata field is only present in the serialized data if it is set.
+	Metadata []byte
 }
 
 // SetAddrs writes a slice of Multiaddr into the Message as a slice of []byte.
@@ -42,3 +57,31 @@ func (m *Message) GetAddrs() ([]multiaddr.Multiaddr, error) {
 	}
 	return addrs, nil
 }
+
+// SetMetadata writes an IPLD node into the Message as dag-cbor. A nil node
+// removes the metadata from the Message.
+func (m *Message) SetMetadata(n ipld.Node) error {
+	if n == nil {
+		m.Metadata = nil
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := dagcbor.Encode(n, &buf); err != nil {
+		return fmt.Errorf("cannot encode metadata: %w", err)
+	}
+	m.Metadata = buf.Bytes()
+	return nil
+}
+
+// GetMetadata reads the IPLD node that is stored in the Message as dag-cbor.
+// Returns nil if the Message has no metadata.
+func (m *Message) GetMetadata() (ipld.Node, error) {
+	if len(m.Metadata) == 0 {
+		return nil, nil
+	}
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := dagcbor.Decode(nb, bytes.NewReader(m.Metadata)); err != nil {
+		return nil, fmt.Errorf("%w: cannot decode metadata: %s", ErrBadEncoding, err)
+	}
+	return nb.Build(), nil
+}
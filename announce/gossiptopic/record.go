@@ -0,0 +1,106 @@
+package gossiptopic
+
+import (
+	"fmt"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+// Field names of an announcement record node.
+const (
+	recordCidField       = "Cid"
+	recordAddrsField     = "Addrs"
+	recordExtraDataField = "ExtraData"
+	recordMetadataField  = "Metadata"
+)
+
+// RecordNode returns the announcement record for the message as an IPLD node.
+// The record can be stored by a publisher, and its CID announced in place of
+// the message itself, when the message is too large to send over gossip pubsub.
+// The record only has a metadata entry if the message has metadata.
+func (m *Message) RecordNode() ipld.Node {
+	size := int64(3)
+	if len(m.Metadata) != 0 {
+		size++
+	}
+	return fluent.MustBuildMap(basicnode.Prototype.Map, size, func(na fluent.MapAssembler) {
+		na.AssembleEntry(recordCidField).AssignLink(cidlink.Link{Cid: m.Cid})
+		na.AssembleEntry(recordAddrsField).CreateList(int64(len(m.Addrs)), func(la fluent.ListAssembler) {
+			for _, addr := range m.Addrs {
+				la.AssembleValue().AssignBytes(addr)
+			}
+		})
+		na.AssembleEntry(recordExtraDataField).AssignBytes(m.ExtraData)
+		if len(m.Metadata) != 0 {
+			na.AssembleEntry(recordMetadataField).AssignBytes(m.Metadata)
+		}
+	})
+}
+
+// MessageFromRecord reads a Message from an announcement record node.
+func MessageFromRecord(n ipld.Node) (Message, error) {
+	var m Message
+
+	cidNode, err := n.LookupByString(recordCidField)
+	if err != nil {
+		return m, fmt.Errorf("%w: missing %s: %s", ErrBadEncoding, recordCidField, err)
+	}
+	lnk, err := cidNode.AsLink()
+	if err != nil {
+		return m, fmt.Errorf("%w: %s is not a link: %s", ErrBadEncoding, recordCidField, err)
+	}
+	clnk, ok := lnk.(cidlink.Link)
+	if !ok {
+		return m, fmt.Errorf("%w: %s is not a cid link", ErrBadEncoding, recordCidField)
+	}
+	m.Cid = clnk.Cid
+
+	addrsNode, err := n.LookupByString(recordAddrsField)
+	if err != nil {
+		return m, fmt.Errorf("%w: missing %s: %s", ErrBadEncoding, recordAddrsField, err)
+	}
+	if addrsNode.Length() > 0 {
+		m.Addrs = make([][]byte, 0, addrsNode.Length())
+	}
+	iter := addrsNode.ListIterator()
+	if iter == nil {
+		return m, fmt.Errorf("%w: %s is not a list", ErrBadEncoding, recordAddrsField)
+	}
+	for !iter.Done() {
+		_, addrNode, err := iter.Next()
+		if err != nil {
+			return m, err
+		}
+		addr, err := addrNode.AsBytes()
+		if err != nil {
+			return m, fmt.Errorf("%w: bad address in %s: %s", ErrBadEncoding, recordAddrsField, err)
+		}
+		m.Addrs = append(m.Addrs, addr)
+	}
+
+	extraNode, err := n.LookupByString(recordExtraDataField)
+	if err != nil {
+		return m, fmt.Errorf("%w: missing %s: %s", ErrBadEncoding, recordExtraDataField, err)
+	}
+	m.ExtraData, err = extraNode.AsBytes()
+	if err != nil {
+		return m, fmt.Errorf("%w: %s is not bytes: %s", ErrBadEncoding, recordExtraDataField, err)
+	}
+	if len(m.ExtraData) == 0 {
+		m.ExtraData = nil
+	}
+
+	// Metadata is optional.
+	mdNode, err := n.LookupByString(recordMetadataField)
+	if err == nil {
+		m.Metadata, err = mdNode.AsBytes()
+		if err != nil {
+			return m, fmt.Errorf("%w: %s is not bytes: %s", ErrBadEncoding, recordMetadataField, err)
+		}
+	}
+
+	return m, nil
+}
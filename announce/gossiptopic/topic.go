@@ -16,10 +16,10 @@ var log = logging.Logger("gossiptopic")
 // directConnectTicks makes pubsub check connections to peers every N seconds.
 const directConnectTicks uint64 = 30
 
-func makePubsub(h host.Host, topicName string) (*pubsub.PubSub, context.CancelFunc, error) {
+func makePubsub(h host.Host, topicName string, opts ...pubsub.Option) (*pubsub.PubSub, context.CancelFunc, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	gossipSub, err := pubsub.NewGossipSub(ctx, h,
+	opts = append([]pubsub.Option{
 		pubsub.WithPeerExchange(true),
 		pubsub.WithMessageIdFn(func(pmsg *pubsubpb.Message) string {
 			h, _ := blake2b.New256(nil)
@@ -29,7 +29,8 @@ func makePubsub(h host.Host, topicName string) (*pubsub.PubSub, context.CancelFu
 		pubsub.WithFloodPublish(true),
 		pubsub.WithDirectConnectTicks(directConnectTicks),
 		pubsub.WithRawTracer(&loggingTracer{log}),
-	)
+	}, opts...)
+	gossipSub, err := pubsub.NewGossipSub(ctx, h, opts...)
 	if err != nil {
 		cancel()
 		return nil, nil, err
@@ -41,13 +42,29 @@ func makePubsub(h host.Host, topicName string) (*pubsub.PubSub, context.CancelFu
 // the router, and then joins the named topic. Returns a Topic handle for the
 // joined topic and a CancelFunc to shutdown the PubSub object. Only one Topic
 // handle should exist per topic, and MakeTopic will error if the Topic handle
-// already exists.
-func MakeTopic(h host.Host, topicName string) (*pubsub.Topic, context.CancelFunc, error) {
-	gossipSub, cancel, err := makePubsub(h, topicName)
+// already exists. Any opts are applied to the PubSub object after the default
+// options, such as pubsub.WithDiscovery to discover peers on the topic.
+func MakeTopic(h host.Host, topicName string, opts ...pubsub.Option) (*pubsub.Topic, context.CancelFunc, error) {
+	return MakeValidatedTopic(h, topicName, nil, opts...)
+}
+
+// MakeValidatedTopic creates a topic the same as MakeTopic, and registers
+// validator, if it is not nil, as the topic validator before joining the
+// topic. Pubsub drops messages that do not pass the validator, instead of
+// delivering and propagating them.
+func MakeValidatedTopic(h host.Host, topicName string, validator pubsub.ValidatorEx, opts ...pubsub.Option) (*pubsub.Topic, context.CancelFunc, error) {
+	gossipSub, cancel, err := makePubsub(h, topicName, opts...)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create gossip pubsub: %w", err)
 	}
 
+	if validator != nil {
+		if err = gossipSub.RegisterTopicValidator(topicName, validator); err != nil {
+			cancel()
+			return nil, nil, fmt.Errorf("failed to register validator for topic %s: %w", topicName, err)
+		}
+	}
+
 	topic, err := gossipSub.Join(topicName)
 	if err != nil {
 		cancel()
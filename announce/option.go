@@ -2,16 +2,22 @@ package announce
 
 import (
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 type Option func(*config) error
 
 // config contains all options for configuring Subscriber.
 type config struct {
-	allowPeer AllowPeerFunc
-	filterIPs bool
-	resend    bool
-	topic     *pubsub.Topic
+	allowPeer     AllowPeerFunc
+	discovery     discovery.Discovery
+	filterIPs     bool
+	handleStreams bool
+	resend        bool
+	topic         *pubsub.Topic
+	trustedRelays []peer.ID
+	validate      bool
 }
 
 // WithAllowPeer sets the function that determines whether to allow or reject
@@ -23,6 +29,19 @@ func WithAllowPeer(allowPeer AllowPeerFunc) Option {
 	}
 }
 
+// WithDiscovery sets the discovery service that pubsub uses to advertise the
+// Receiver's host on the topic and to find and connect to other peers on the
+// topic. This lets announcements reach the Receiver without manual peering of
+// the host. This requires that the Receiver creates its pubsub topic, so it
+// cannot be used with WithTopic. Instead, create the topic's pubsub with
+// pubsub.WithDiscovery.
+func WithDiscovery(d discovery.Discovery) Option {
+	return func(c *config) error {
+		c.discovery = d
+		return nil
+	}
+}
+
 // WithFilterIPs sets whether or not IP filtering is enabled. When enabled it
 // removes any private, loopback, or unspecified IP multiaddrs from addresses
 // supplied in announce messages.
@@ -33,6 +52,17 @@ func WithFilterIPs(enable bool) Option {
 	}
 }
 
+// WithStreamAnnounce sets whether the Receiver handles announce messages sent
+// directly to its host over ProtocolID streams. These are handled the same as
+// messages received over pubsub, and allow publishers to reach a subscriber
+// that is not reachable over gossip pubsub. See Send.
+func WithStreamAnnounce(enable bool) Option {
+	return func(c *config) error {
+		c.handleStreams = enable
+		return nil
+	}
+}
+
 // WithResend determines whether to resend direct announce mesages (those that
 // are not received via pubsub) over pubsub.
 func WithResend(enable bool) Option {
@@ -49,3 +79,26 @@ func WithTopic(topic *pubsub.Topic) Option {
 		return nil
 	}
 }
+
+// WithTrustedRelays sets the peers that are trusted to send announce messages
+// over ProtocolID streams on behalf of other publishers, such as an
+// announce-only publisher that announces for a separate data server. A stream
+// announce message from any other peer is ignored unless it is from the
+// publisher that it announces.
+func WithTrustedRelays(relays ...peer.ID) Option {
+	return func(c *config) error {
+		c.trustedRelays = relays
+		return nil
+	}
+}
+
+// WithValidator sets whether announce messages are validated by pubsub before
+// they are delivered or propagated to other peers. See NewValidator. This
+// requires that the Receiver creates its pubsub topic, so it cannot be used
+// with WithTopic. Instead, register NewValidator for the given topic.
+func WithValidator(enable bool) Option {
+	return func(c *config) error {
+		c.validate = enable
+		return nil
+	}
+}
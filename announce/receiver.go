@@ -11,6 +11,7 @@ import (
 	"github.com/filecoin-project/go-legs/mautil"
 	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipld/go-ipld-prime"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -37,16 +38,20 @@ var (
 	// errAlreadySeenCid is the error returned when an announce message is for a
 	// CID has already been announced by a previous announce message.
 	errAlreadySeenCid = errors.New("announcement for already seen CID")
+	// errRepublishedBySelf is the error returned when an announce message was
+	// republished by this host.
+	errRepublishedBySelf = errors.New("announce republished by self")
 )
 
 // Receiver receives announce messages via gossip pubsub and HTTP. Receiver
 // creates a single pubsub subscriber that receives messages from a gossip
 // pubsub topic. Direct messages are received when the Receiver's Direct method
-// is called.
+// is called, and, if enabled, over ProtocolID streams.
 type Receiver struct {
 	allowPeer AllowPeerFunc
 	filterIPs bool
 	resend    bool
+	host      host.Host
 	hostID    peer.ID
 
 	announceCache *stringLRU
@@ -56,6 +61,14 @@ type Receiver struct {
 	closed bool
 	// cancelWatch stops the pubsub watcher
 	cancelWatch context.CancelFunc
+	// streamCtx is canceled when the Receiver is closed, to stop handling
+	// announce messages received over streams.
+	streamCtx context.Context
+	// handleStreams is true if the Receiver handles ProtocolID streams.
+	handleStreams bool
+	// trustedRelays are the peers that may send announce messages over
+	// streams on behalf of other publishers.
+	trustedRelays map[peer.ID]struct{}
 	// watchDone signals that the pubsub watch function exited.
 	watchDone chan struct{}
 	// does tells Next to stop waiting on the out channel.
@@ -68,6 +81,22 @@ type Receiver struct {
 	outChan chan Announce
 }
 
+// Source identifies the path by which an announcement arrived at the
+// Receiver.
+type Source string
+
+const (
+	// SourceGossip is an announcement received over gossip pubsub, including
+	// one re-published by another peer.
+	SourceGossip Source = "gossip"
+	// SourceDirect is an announcement passed to Receiver.Direct, such as one
+	// received by an HTTP announce endpoint.
+	SourceDirect Source = "direct"
+	// SourceStream is an announcement sent directly to this host over
+	// ProtocolID.
+	SourceStream Source = "stream"
+)
+
 // Announce contains information about the announcement of an index
 // advertisement.
 type Announce struct {
@@ -77,6 +106,14 @@ type Announce struct {
 	PeerID peer.ID
 	// Addrs is the network location(s) hosting the announced advertisement.
 	Addrs []multiaddr.Multiaddr
+	// IsRecord is true if Cid identifies an announcement record, that must be
+	// fetched from the publisher to get the announced advertisement CID.
+	IsRecord bool
+	// Metadata is the IPLD metadata node that the publisher attached to the
+	// announcement, or nil if there is none.
+	Metadata ipld.Node
+	// Source is the path by which the announcement arrived.
+	Source Source
 }
 
 // NewReceiver creates a new Receiver that subscribes to the named pubsub topic
@@ -89,50 +126,73 @@ func NewReceiver(host host.Host, topicName string, options ...Option) (*Receiver
 		}
 	}
 
-	var cancelPubsub context.CancelFunc
-	var err error
-
-	pubsubTopic := cfg.topic
-	if pubsubTopic == nil {
-		pubsubTopic, cancelPubsub, err = gossiptopic.MakeTopic(host, topicName)
-		if err != nil {
-			return nil, err
-		}
-		log.Infow("Created gossip pubsub and joined topic", "topic", topicName, "hostID", host.ID())
+	if cfg.validate && cfg.topic != nil {
+		return nil, errors.New("cannot register validator for existing topic; register NewValidator with its pubsub instead")
 	}
-
-	topicSub, err := pubsubTopic.Subscribe()
-	if err != nil {
-		if cancelPubsub != nil {
-			cancelPubsub()
-		}
-		return nil, err
+	if cfg.discovery != nil && cfg.topic != nil {
+		return nil, errors.New("cannot use discovery for existing topic; give discovery to its pubsub instead")
 	}
 
-	watchCtx, cancelWatch := context.WithCancel(context.Background())
-
 	r := &Receiver{
 		allowPeer: cfg.allowPeer,
 		filterIPs: cfg.filterIPs,
 		resend:    cfg.resend,
+		host:      host,
 		hostID:    host.ID(),
 
 		announceCache: newStringLRU(announceCacheSize),
 
-		cancelWatch: cancelWatch,
-		done:        make(chan struct{}),
-		watchDone:   make(chan struct{}),
-
-		cancelPubsub: cancelPubsub,
-		topic:        pubsubTopic,
-		topicSub:     topicSub,
+		done:      make(chan struct{}),
+		watchDone: make(chan struct{}),
 
 		outChan: make(chan Announce, 1),
 	}
+	if len(cfg.trustedRelays) != 0 {
+		r.trustedRelays = make(map[peer.ID]struct{}, len(cfg.trustedRelays))
+		for _, peerID := range cfg.trustedRelays {
+			r.trustedRelays[peerID] = struct{}{}
+		}
+	}
+
+	var err error
+	pubsubTopic := cfg.topic
+	if pubsubTopic == nil {
+		var validator pubsub.ValidatorEx
+		if cfg.validate {
+			validator = r.validate
+		}
+		var psOpts []pubsub.Option
+		if cfg.discovery != nil {
+			psOpts = append(psOpts, pubsub.WithDiscovery(cfg.discovery))
+		}
+		pubsubTopic, r.cancelPubsub, err = gossiptopic.MakeValidatedTopic(host, topicName, validator, psOpts...)
+		if err != nil {
+			return nil, err
+		}
+		log.Infow("Created gossip pubsub and joined topic", "topic", topicName, "hostID", host.ID())
+	}
+	r.topic = pubsubTopic
+
+	r.topicSub, err = pubsubTopic.Subscribe()
+	if err != nil {
+		if r.cancelPubsub != nil {
+			r.cancelPubsub()
+		}
+		return nil, err
+	}
+
+	var watchCtx context.Context
+	watchCtx, r.cancelWatch = context.WithCancel(context.Background())
 
 	// Start watcher to read pubsub messages.
 	go r.watch(watchCtx)
 
+	if cfg.handleStreams {
+		r.streamCtx = watchCtx
+		r.handleStreams = true
+		host.SetStreamHandler(ProtocolID(r.TopicName()), r.handleStream)
+	}
+
 	return r, nil
 }
 
@@ -164,6 +224,10 @@ func (r *Receiver) Close() error {
 
 	r.announceMutex.Unlock()
 
+	if r.handleStreams {
+		r.host.RemoveStreamHandler(ProtocolID(r.TopicName()))
+	}
+
 	// Tell Next to stop waiting.
 	close(r.done)
 
@@ -236,47 +300,14 @@ func (r *Receiver) watch(ctx context.Context) {
 			continue
 		}
 
-		// Decode CID and originator addresses from message.
-		m := gossiptopic.Message{}
-		if err = m.UnmarshalCBOR(bytes.NewBuffer(msg.Data)); err != nil {
-			log.Errorw("Could not decode pubsub message", "err", err)
-			continue
-		}
-
-		// Read publisher addresses from message.
-		var addrs []multiaddr.Multiaddr
-		if len(m.Addrs) != 0 {
-			addrs, err = m.GetAddrs()
-			if err != nil {
-				log.Errorw("Could not decode pubsub message", "err", err)
-				continue
-			}
-		}
-
-		// If message has original peer set, then this is a republished message.
-		if m.OrigPeer != "" {
-			// Ignore re-published announce from this host.
-			if srcPeer == r.hostID {
+		amsg, err := r.decodeMessage(srcPeer, msg.Data, SourceGossip)
+		if err != nil {
+			if errors.Is(err, errRepublishedBySelf) {
 				log.Debug("Ignored rebuplished announce from self")
-				continue
-			}
-
-			// Read the original publisher.
-			relayPeer := srcPeer
-			srcPeer, err = peer.Decode(m.OrigPeer)
-			if err != nil {
-				log.Errorw("Cannot read peerID from republished announce", "err", err)
-				continue
+			} else {
+				log.Errorw("Could not decode pubsub message", "err", err)
 			}
-			log.Infow("Handling re-published pubsub announce", "originPeer", srcPeer, "relayPeer", relayPeer)
-		} else {
-			log.Infow("Handling pubsub announce", "peer", srcPeer)
-		}
-
-		amsg := Announce{
-			Cid:    m.Cid,
-			PeerID: srcPeer,
-			Addrs:  addrs,
+			continue
 		}
 		err = r.handleAnnounce(ctx, amsg, false)
 		if err != nil {
@@ -296,6 +327,7 @@ func (r *Receiver) Direct(ctx context.Context, nextCid cid.Cid, peerID peer.ID,
 		Cid:    nextCid,
 		PeerID: peerID,
 		Addrs:  addrs,
+		Source: SourceDirect,
 	}
 	return r.handleAnnounce(ctx, amsg, true)
 }
@@ -362,6 +394,9 @@ func (r *Receiver) republish(ctx context.Context, amsg Announce) error {
 		OrigPeer: amsg.PeerID.String(),
 	}
 	msg.SetAddrs(amsg.Addrs)
+	if err := msg.SetMetadata(amsg.Metadata); err != nil {
+		return err
+	}
 	msgBuf := bytes.NewBuffer(nil)
 	if err := msg.MarshalCBOR(msgBuf); err != nil {
 		return err
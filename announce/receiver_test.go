@@ -1,13 +1,19 @@
 package announce_test
 
 import (
+	"bytes"
 	"context"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/filecoin-project/go-legs/announce"
+	"github.com/filecoin-project/go-legs/announce/gossiptopic"
 	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/stretchr/testify/require"
@@ -62,6 +68,7 @@ func TestReceiverBasic(t *testing.T) {
 	amsg, err := rcvr.Next(context.Background())
 	require.NoError(t, err)
 	require.Equal(t, testPeerID, amsg.PeerID)
+	require.Equal(t, announce.SourceDirect, amsg.Source)
 
 	require.NoError(t, rcvr.Close())
 }
@@ -143,3 +150,93 @@ func TestReceiverCidCache(t *testing.T) {
 
 	require.NoError(t, rcvr.Close())
 }
+
+func TestReceiverDiscovery(t *testing.T) {
+	disc := newMockDiscovery()
+
+	rcvrHost, err := libp2p.New()
+	require.NoError(t, err)
+	defer rcvrHost.Close()
+	rcvr, err := announce.NewReceiver(rcvrHost, testTopic, announce.WithDiscovery(disc.forHost(rcvrHost)))
+	require.NoError(t, err)
+	defer rcvr.Close()
+
+	// The publisher host is not connected to the receiver host, so the
+	// receiver is only reachable once the publisher discovers it.
+	pubHost, err := libp2p.New()
+	require.NoError(t, err)
+	defer pubHost.Close()
+	topic, cancelPubsub, err := gossiptopic.MakeTopic(pubHost, testTopic, pubsub.WithDiscovery(disc.forHost(pubHost)))
+	require.NoError(t, err)
+	defer cancelPubsub()
+
+	require.Eventually(t, func() bool {
+		for _, p := range topic.ListPeers() {
+			if p == rcvrHost.ID() {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 100*time.Millisecond, "publisher did not discover receiver")
+
+	msg := gossiptopic.Message{Cid: testCid}
+	msg.SetAddrs(pubHost.Addrs())
+	var buf bytes.Buffer
+	require.NoError(t, msg.MarshalCBOR(&buf))
+	require.NoError(t, topic.Publish(context.Background(), buf.Bytes()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	amsg, err := rcvr.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, testCid, amsg.Cid)
+	require.Equal(t, pubHost.ID(), amsg.PeerID)
+
+	// Discovery cannot be used with an existing topic.
+	_, err = announce.NewReceiver(rcvrHost, testTopic, announce.WithTopic(topic), announce.WithDiscovery(disc.forHost(rcvrHost)))
+	require.Error(t, err)
+}
+
+// mockDiscovery is an in-memory rendezvous point that hosts advertise
+// themselves to and find each other at.
+type mockDiscovery struct {
+	mutex sync.Mutex
+	peers map[string]map[peer.ID]peer.AddrInfo
+}
+
+func newMockDiscovery() *mockDiscovery {
+	return &mockDiscovery{
+		peers: make(map[string]map[peer.ID]peer.AddrInfo),
+	}
+}
+
+// forHost returns the discovery service used by h.
+func (d *mockDiscovery) forHost(h host.Host) discovery.Discovery {
+	return &hostDiscovery{d, h}
+}
+
+type hostDiscovery struct {
+	*mockDiscovery
+	host host.Host
+}
+
+func (d *hostDiscovery) Advertise(_ context.Context, ns string, _ ...discovery.Option) (time.Duration, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.peers[ns] == nil {
+		d.peers[ns] = make(map[peer.ID]peer.AddrInfo)
+	}
+	d.peers[ns][d.host.ID()] = peer.AddrInfo{ID: d.host.ID(), Addrs: d.host.Addrs()}
+	return time.Hour, nil
+}
+
+func (d *hostDiscovery) FindPeers(_ context.Context, ns string, _ ...discovery.Option) (<-chan peer.AddrInfo, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	ch := make(chan peer.AddrInfo, len(d.peers[ns]))
+	for _, pi := range d.peers[ns] {
+		ch <- pi
+	}
+	close(ch)
+	return ch, nil
+}
@@ -0,0 +1,184 @@
+package announce
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/filecoin-project/go-legs/announce/gossiptopic"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// ProtocolPrefix is the prefix of the protocol ID used to send announce
+	// messages for a topic directly to a subscriber.
+	ProtocolPrefix = "/legs/announce"
+	// ProtocolVersion is the version of the protocol used to send announce
+	// messages for a topic directly to a subscriber.
+	ProtocolVersion = "0.0.1"
+
+	// maxStreamMessageSize is the largest announce message read from a stream.
+	maxStreamMessageSize = 1 << 20
+	// streamReadTimeout is the time allowed to read a message from a stream.
+	streamReadTimeout = 10 * time.Second
+)
+
+// ProtocolID returns the libp2p protocol ID that announce messages for topic
+// are sent directly to a subscriber over, bypassing gossip pubsub. Each stream
+// carries a single CBOR encoded gossiptopic.Message, the same as a pubsub
+// announce message.
+func ProtocolID(topic string) protocol.ID {
+	return protocol.ID(path.Join(ProtocolPrefix, topic, ProtocolVersion))
+}
+
+// Send sends an announce message for topic directly to a subscriber over
+// ProtocolID, and waits for the subscriber to receive it. The subscriber's
+// addresses, if any, are used to connect to it.
+//
+// A message that names an original peer other than h is only accepted by
+// subscribers that trust h as a relay. See WithTrustedRelays.
+func Send(ctx context.Context, h host.Host, topic string, to peer.AddrInfo, msg gossiptopic.Message) error {
+	buf := bytes.NewBuffer(nil)
+	if err := msg.MarshalCBOR(buf); err != nil {
+		return err
+	}
+	if buf.Len() > maxStreamMessageSize {
+		return fmt.Errorf("announce message too large: %d bytes", buf.Len())
+	}
+	if len(to.Addrs) != 0 {
+		if err := h.Connect(ctx, to); err != nil {
+			return fmt.Errorf("cannot connect to subscriber %s: %w", to.ID, err)
+		}
+	}
+
+	s, err := h.NewStream(ctx, to.ID, ProtocolID(topic))
+	if err != nil {
+		return fmt.Errorf("cannot open announce stream to %s: %w", to.ID, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+	if _, err = s.Write(buf.Bytes()); err != nil {
+		s.Reset()
+		return fmt.Errorf("cannot send announce message to %s: %w", to.ID, err)
+	}
+	if err = s.CloseWrite(); err != nil {
+		s.Reset()
+		return err
+	}
+	// Wait for the subscriber to close the stream after reading the message,
+	// so that a subscriber that does not handle the protocol is reported.
+	if _, err = io.Copy(io.Discard, s); err != nil {
+		s.Reset()
+		return fmt.Errorf("announce message not received by %s: %w", to.ID, err)
+	}
+	return s.Close()
+}
+
+// handleStream reads an announce message sent directly to this host, and
+// handles it the same as a message received over pubsub. A message that names
+// an original peer other than the sender is ignored, unless the sender is a
+// trusted relay.
+func (r *Receiver) handleStream(s network.Stream) {
+	srcPeer := s.Conn().RemotePeer()
+	s.SetReadDeadline(time.Now().Add(streamReadTimeout))
+	data, err := io.ReadAll(io.LimitReader(s, maxStreamMessageSize+1))
+	if err != nil {
+		log.Errorw("Cannot read announce stream", "err", err, "peer", srcPeer)
+		s.Reset()
+		return
+	}
+	if len(data) > maxStreamMessageSize {
+		log.Errorw("Announce message from stream too large", "peer", srcPeer)
+		s.Reset()
+		return
+	}
+	// Close the stream before handling the message, which may wait for Next.
+	s.Close()
+
+	amsg, err := r.decodeMessage(srcPeer, data, SourceStream)
+	if err != nil {
+		log.Errorw("Could not decode stream announce message", "err", err, "peer", srcPeer)
+		return
+	}
+	if !amsg.Cid.Defined() {
+		log.Errorw("Ignored stream announce message with undefined cid", "peer", srcPeer)
+		return
+	}
+	if amsg.PeerID != srcPeer && !r.trustedRelay(srcPeer) {
+		log.Warnw("Ignored stream announce message relayed by untrusted peer", "peer", srcPeer, "originPeer", amsg.PeerID)
+		return
+	}
+	if err = r.handleAnnounce(r.streamCtx, amsg, false); err != nil && !errors.Is(err, ErrClosed) {
+		log.Errorw("Cannot process message", "err", err)
+	}
+}
+
+// trustedRelay returns true if the peer is trusted to relay announce messages
+// on behalf of other publishers.
+func (r *Receiver) trustedRelay(peerID peer.ID) bool {
+	_, ok := r.trustedRelays[peerID]
+	return ok
+}
+
+// decodeMessage decodes an announce message received from srcPeer. If the
+// message names an original peer, then srcPeer relayed the message on behalf
+// of that peer, and the original peer is the announcing publisher.
+func (r *Receiver) decodeMessage(srcPeer peer.ID, data []byte, source Source) (Announce, error) {
+	// Decode CID and originator addresses from message.
+	m := gossiptopic.Message{}
+	if err := m.UnmarshalCBOR(bytes.NewBuffer(data)); err != nil {
+		return Announce{}, err
+	}
+
+	// Read publisher addresses from message.
+	var addrs []multiaddr.Multiaddr
+	if len(m.Addrs) != 0 {
+		var err error
+		addrs, err = m.GetAddrs()
+		if err != nil {
+			return Announce{}, err
+		}
+	}
+
+	// Read publisher metadata from message.
+	metadata, err := m.GetMetadata()
+	if err != nil {
+		return Announce{}, err
+	}
+
+	// If message has original peer set, then this is a republished message.
+	if m.OrigPeer != "" {
+		// Ignore re-published announce from this host.
+		if srcPeer == r.hostID {
+			return Announce{}, errRepublishedBySelf
+		}
+
+		// Read the original publisher.
+		relayPeer := srcPeer
+		srcPeer, err = peer.Decode(m.OrigPeer)
+		if err != nil {
+			return Announce{}, fmt.Errorf("cannot read peerID from republished announce: %w", err)
+		}
+		log.Infow("Handling re-published announce", "source", source, "originPeer", srcPeer, "relayPeer", relayPeer)
+	} else {
+		log.Infow("Handling announce", "source", source, "peer", srcPeer)
+	}
+
+	return Announce{
+		Cid:      m.Cid,
+		PeerID:   srcPeer,
+		Addrs:    addrs,
+		IsRecord: m.IsRecord,
+		Metadata: metadata,
+		Source:   source,
+	}, nil
+}
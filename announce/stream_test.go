@@ -0,0 +1,92 @@
+package announce_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs/announce"
+	"github.com/filecoin-project/go-legs/announce/gossiptopic"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReceiverStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rcvHost, err := libp2p.New()
+	require.NoError(t, err)
+	rcvr, err := announce.NewReceiver(rcvHost, testTopic, announce.WithStreamAnnounce(true))
+	require.NoError(t, err)
+	rcvInfo := peer.AddrInfo{ID: rcvHost.ID(), Addrs: rcvHost.Addrs()}
+
+	pubHost, err := libp2p.New()
+	require.NoError(t, err)
+	msg := gossiptopic.Message{Cid: testCid}
+	msg.SetAddrs(testAddrs)
+	require.NoError(t, announce.Send(ctx, pubHost, testTopic, rcvInfo, msg))
+
+	amsg, err := rcvr.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, testCid, amsg.Cid)
+	require.Equal(t, pubHost.ID(), amsg.PeerID)
+	require.Equal(t, testAddrs, amsg.Addrs)
+	require.Equal(t, announce.SourceStream, amsg.Source)
+
+	// A message for another topic is not handled.
+	require.Error(t, announce.Send(ctx, pubHost, "other-topic", rcvInfo, msg))
+
+	// A message relayed on behalf of another publisher is ignored, since the
+	// sender is not a trusted relay.
+	msg = gossiptopic.Message{Cid: testCid2, OrigPeer: testPeerID.String()}
+	require.NoError(t, announce.Send(ctx, pubHost, testTopic, rcvInfo, msg))
+	nextCtx, nextCancel := context.WithTimeout(ctx, time.Second)
+	_, err = rcvr.Next(nextCtx)
+	nextCancel()
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// After closing, the receiver no longer handles the protocol.
+	require.NoError(t, rcvr.Close())
+	require.Error(t, announce.Send(ctx, pubHost, testTopic, rcvInfo, gossiptopic.Message{Cid: testCid}))
+}
+
+func TestReceiverStreamTrustedRelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	relayHost, err := libp2p.New()
+	require.NoError(t, err)
+	rcvHost, err := libp2p.New()
+	require.NoError(t, err)
+	rcvr, err := announce.NewReceiver(rcvHost, testTopic, announce.WithStreamAnnounce(true),
+		announce.WithTrustedRelays(relayHost.ID()))
+	require.NoError(t, err)
+	defer rcvr.Close()
+	rcvInfo := peer.AddrInfo{ID: rcvHost.ID(), Addrs: rcvHost.Addrs()}
+
+	// A message relayed by a trusted relay is from the original publisher.
+	msg := gossiptopic.Message{Cid: testCid2, OrigPeer: testPeerID.String()}
+	require.NoError(t, announce.Send(ctx, relayHost, testTopic, rcvInfo, msg))
+	amsg, err := rcvr.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, testCid2, amsg.Cid)
+	require.Equal(t, testPeerID, amsg.PeerID)
+}
+
+func TestReceiverStreamDisabled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rcvHost, err := libp2p.New()
+	require.NoError(t, err)
+	rcvr, err := announce.NewReceiver(rcvHost, testTopic)
+	require.NoError(t, err)
+	defer rcvr.Close()
+
+	pubHost, err := libp2p.New()
+	require.NoError(t, err)
+	rcvInfo := peer.AddrInfo{ID: rcvHost.ID(), Addrs: rcvHost.Addrs()}
+	require.Error(t, announce.Send(ctx, pubHost, testTopic, rcvInfo, gossiptopic.Message{Cid: testCid}))
+}
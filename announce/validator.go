@@ -0,0 +1,74 @@
+package announce
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/filecoin-project/go-legs/announce/gossiptopic"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// NewValidator returns a pubsub validator for announce messages, to register
+// with pubsub.RegisterTopicValidator for a topic that is given to the Receiver
+// with WithTopic. The Receiver registers the validator itself, with
+// WithValidator, when it creates the topic.
+//
+// The validator rejects messages that cannot be decoded, that announce an
+// undefined CID, or that have bad addresses or an original peer that is not a
+// peer ID. It ignores messages from publishers that allowPeer does not allow.
+// Messages that are rejected or ignored are dropped by pubsub, and are not
+// propagated to other peers. Only rejected messages penalize the peer they are
+// received from, since another host's allow policy may allow the publisher.
+func NewValidator(allowPeer AllowPeerFunc) pubsub.ValidatorEx {
+	return func(_ context.Context, _ peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		return validateMessage(msg, allowPeer)
+	}
+}
+
+// validate is the validator that the Receiver registers for its topic. It uses
+// the Receiver's current allow policy.
+func (r *Receiver) validate(_ context.Context, _ peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	r.announceMutex.Lock()
+	allowPeer := r.allowPeer
+	r.announceMutex.Unlock()
+	return validateMessage(msg, allowPeer)
+}
+
+// validateMessage checks an announce message received over pubsub.
+func validateMessage(msg *pubsub.Message, allowPeer AllowPeerFunc) pubsub.ValidationResult {
+	srcPeer, err := peer.IDFromBytes(msg.From)
+	if err != nil {
+		log.Debugw("Rejected pubsub message with bad sender", "err", err)
+		return pubsub.ValidationReject
+	}
+
+	m := gossiptopic.Message{}
+	if err = m.UnmarshalCBOR(bytes.NewBuffer(msg.Data)); err != nil {
+		log.Debugw("Rejected undecodable pubsub message", "err", err, "peer", srcPeer)
+		return pubsub.ValidationReject
+	}
+	if !m.Cid.Defined() {
+		log.Debugw("Rejected pubsub message with undefined cid", "peer", srcPeer)
+		return pubsub.ValidationReject
+	}
+	if len(m.Addrs) != 0 {
+		if _, err = m.GetAddrs(); err != nil {
+			log.Debugw("Rejected pubsub message with bad addresses", "err", err, "peer", srcPeer)
+			return pubsub.ValidationReject
+		}
+	}
+	if m.OrigPeer != "" {
+		srcPeer, err = peer.Decode(m.OrigPeer)
+		if err != nil {
+			log.Debugw("Rejected pubsub message with bad original peer", "err", err)
+			return pubsub.ValidationReject
+		}
+	}
+
+	if allowPeer != nil && !allowPeer(srcPeer) {
+		log.Debugw("Ignored pubsub message from peer that is not allowed", "peer", srcPeer)
+		return pubsub.ValidationIgnore
+	}
+	return pubsub.ValidationAccept
+}
@@ -0,0 +1,74 @@
+package announce_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-legs/announce"
+	"github.com/filecoin-project/go-legs/announce/gossiptopic"
+	"github.com/libp2p/go-libp2p"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidator(t *testing.T) {
+	otherHost, err := libp2p.New()
+	require.NoError(t, err)
+	otherPeer := otherHost.ID()
+	otherHost.Close()
+
+	validator := announce.NewValidator(func(p peer.ID) bool {
+		return p == testPeerID
+	})
+	validate := func(from peer.ID, data []byte) pubsub.ValidationResult {
+		msg := &pubsub.Message{
+			Message: &pb.Message{
+				From: []byte(from),
+				Data: data,
+			},
+		}
+		return validator(context.Background(), from, msg)
+	}
+	encode := func(m gossiptopic.Message) []byte {
+		var buf bytes.Buffer
+		require.NoError(t, m.MarshalCBOR(&buf))
+		return buf.Bytes()
+	}
+
+	msg := gossiptopic.Message{Cid: testCid}
+	msg.SetAddrs(testAddrs)
+	require.Equal(t, pubsub.ValidationAccept, validate(testPeerID, encode(msg)))
+
+	// Messages from publishers that are not allowed are ignored.
+	require.Equal(t, pubsub.ValidationIgnore, validate(otherPeer, encode(msg)))
+
+	// A re-published message is checked against the original publisher.
+	msg.OrigPeer = testPeerID.String()
+	require.Equal(t, pubsub.ValidationAccept, validate(otherPeer, encode(msg)))
+	msg.OrigPeer = "not a peer id"
+	require.Equal(t, pubsub.ValidationReject, validate(otherPeer, encode(msg)))
+
+	// Malformed messages are rejected.
+	require.Equal(t, pubsub.ValidationReject, validate(testPeerID, []byte("not an announcement")))
+	require.Equal(t, pubsub.ValidationReject, validate(testPeerID, encode(gossiptopic.Message{Cid: testCid, Addrs: [][]byte{{0xff}}})))
+}
+
+func TestReceiverValidatorRequiresOwnTopic(t *testing.T) {
+	srcHost, err := libp2p.New()
+	require.NoError(t, err)
+	topic, cancel, err := gossiptopic.MakeTopic(srcHost, testTopic)
+	require.NoError(t, err)
+	defer cancel()
+
+	_, err = announce.NewReceiver(srcHost, testTopic, announce.WithTopic(topic), announce.WithValidator(true))
+	require.Error(t, err)
+
+	otherHost, err := libp2p.New()
+	require.NoError(t, err)
+	rcvr, err := announce.NewReceiver(otherHost, testTopic, announce.WithValidator(true))
+	require.NoError(t, err)
+	require.NoError(t, rcvr.Close())
+}
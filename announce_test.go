@@ -2,6 +2,7 @@ package legs
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 
@@ -15,6 +16,7 @@ import (
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/stretchr/testify/require"
 )
@@ -281,3 +283,101 @@ func TestAnnounceRepublish(t *testing.T) {
 		t.Log("Received sync notification for first CID:", firstCid)
 	}
 }
+
+func TestOnAnnouncement(t *testing.T) {
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	srcHost := test.MkTestHost()
+	defer srcHost.Close()
+
+	sub, err := NewSubscriber(dstHost, dstStore, test.MkLinkSystem(dstStore), testTopic, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	announced, cncl := sub.OnAnnouncement()
+	defer cncl()
+
+	cids, err := test.RandomCids(1)
+	require.NoError(t, err)
+	addrs := srcHost.Addrs()
+	err = sub.Announce(context.Background(), cids[0], srcHost.ID(), addrs)
+	require.NoError(t, err)
+
+	select {
+	case event := <-announced:
+		require.Equal(t, cids[0], event.Cid)
+		require.Equal(t, srcHost.ID(), event.PeerID)
+		require.Equal(t, addrs, event.Addrs)
+		require.Equal(t, testTopic, event.Topic)
+		require.Equal(t, SyncSourceDirect, event.Source)
+		require.False(t, event.IsRecord)
+	case <-time.After(updateTimeout):
+		t.Fatal("timed out waiting for announcement event")
+	}
+
+	// Canceling closes the channel.
+	cncl()
+	_, open := <-announced
+	require.False(t, open)
+}
+
+func TestShouldSync(t *testing.T) {
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	defer srcHost.Close()
+	srcLnkS := test.MkLinkSystem(srcStore)
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+
+	srcHost.Peerstore().AddAddrs(dstHost.ID(), dstHost.Addrs(), time.Hour)
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	chainLnks := test.MkChain(srcLnkS, true)
+	skipCid := chainLnks[1].(cidlink.Link).Cid
+	syncCid := chainLnks[0].(cidlink.Link).Cid
+
+	var asked []cid.Cid
+	var askedMutex sync.Mutex
+	sub, err := NewSubscriber(dstHost, dstStore, test.MkLinkSystem(dstStore), testTopic, nil,
+		ShouldSync(func(p peer.ID, c cid.Cid) bool {
+			askedMutex.Lock()
+			asked = append(asked, c)
+			askedMutex.Unlock()
+			return p != srcHost.ID() || c != skipCid
+		}))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	watcher, cncl := sub.OnSyncFinished()
+	defer cncl()
+
+	// The sync of the first announcement is skipped.
+	require.NoError(t, pub.SetRoot(context.Background(), skipCid))
+	require.NoError(t, sub.Announce(context.Background(), skipCid, srcHost.ID(), srcHost.Addrs()))
+	select {
+	case event := <-watcher:
+		t.Fatalf("sync of %s should have been skipped", event.Cid)
+	case <-time.After(updateTimeout):
+	}
+	require.Nil(t, sub.GetLatestSync(srcHost.ID()))
+
+	// The sync of the next announcement is allowed.
+	require.NoError(t, pub.SetRoot(context.Background(), syncCid))
+	require.NoError(t, sub.Announce(context.Background(), syncCid, srcHost.ID(), srcHost.Addrs()))
+	select {
+	case event := <-watcher:
+		require.Equal(t, syncCid, event.Cid)
+	case <-time.After(updateTimeout):
+		t.Fatal("timed out waiting for sync")
+	}
+
+	askedMutex.Lock()
+	defer askedMutex.Unlock()
+	require.Equal(t, []cid.Cid{skipCid, syncCid}, asked)
+}
@@ -0,0 +1,113 @@
+package announceonly
+
+import (
+	"fmt"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// config contains all options for configuring Publisher.
+type config struct {
+	announcePeers     []peer.AddrInfo
+	directTopic       string
+	discovery         discovery.Discovery
+	extraData         []byte
+	republishInterval time.Duration
+	topic             *pubsub.Topic
+}
+
+type Option func(*config) error
+
+// apply applies the given options to this config.
+func (c *config) apply(opts []Option) error {
+	for i, opt := range opts {
+		if err := opt(c); err != nil {
+			return fmt.Errorf("option %d failed: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// pubsubOpts returns the options for the pubsub that the publisher creates for
+// its topic.
+func (c *config) pubsubOpts() []pubsub.Option {
+	if c.discovery == nil {
+		return nil
+	}
+	return []pubsub.Option{pubsub.WithDiscovery(c.discovery)}
+}
+
+// WithDirectAnnounce sets subscribers that the publisher sends each
+// announcement to directly, over the announce.ProtocolID stream protocol, in
+// addition to publishing it on the pubsub topic, if any. The protocol is that
+// of the pubsub topic, or of the topic given by WithDirectTopic if there is no
+// pubsub topic. Subscribers must enable handling of these streams. A failure
+// to send to a subscriber is logged, and does not fail the announcement.
+func WithDirectAnnounce(peers ...peer.AddrInfo) Option {
+	return func(c *config) error {
+		for _, pi := range peers {
+			if err := pi.ID.Validate(); err != nil {
+				return fmt.Errorf("bad direct announce peer: %w", err)
+			}
+		}
+		c.announcePeers = peers
+		return nil
+	}
+}
+
+// WithDirectTopic sets the topic that announcements are sent directly for, when
+// the publisher does not publish on a pubsub topic. See WithDirectAnnounce.
+func WithDirectTopic(topic string) Option {
+	return func(c *config) error {
+		c.directTopic = topic
+		return nil
+	}
+}
+
+// WithExtraData sets the extra data to include in each announcement.
+func WithExtraData(data []byte) Option {
+	return func(c *config) error {
+		if len(data) != 0 {
+			c.extraData = data
+		}
+		return nil
+	}
+}
+
+// WithRepublishInterval sets how often the publisher re-announces its current
+// root, so that subscribers that missed an announcement still learn the root.
+// Pubsub drops messages identical to one published within its seen-messages
+// TTL, so re-announcements are at least that far apart. A value of zero, the
+// default, disables periodic re-announcement.
+func WithRepublishInterval(interval time.Duration) Option {
+	return func(c *config) error {
+		if interval < 0 {
+			return fmt.Errorf("republish interval cannot be negative: %s", interval)
+		}
+		c.republishInterval = interval
+		return nil
+	}
+}
+
+// WithTopic provides an existing pubsub topic to publish announcements on,
+// instead of joining the named topic.
+func WithTopic(topic *pubsub.Topic) Option {
+	return func(c *config) error {
+		c.topic = topic
+		return nil
+	}
+}
+
+// WithTopicDiscovery sets the discovery service that the publisher's pubsub
+// uses to advertise the publisher on the topic, and to find and connect to
+// subscribers on the topic. This cannot be used with WithTopic, since the
+// publisher must create the topic's pubsub.
+func WithTopicDiscovery(d discovery.Discovery) Option {
+	return func(c *config) error {
+		c.discovery = d
+		return nil
+	}
+}
@@ -0,0 +1,254 @@
+// Package announceonly provides a publisher that announces the root of a DAG
+// without serving the DAG. It is for setups where the DAG, and its head, are
+// served by separate data servers, such as a dedicated graphsync or HTTP
+// server cluster, and announcements are published from another process.
+package announceonly
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-legs/announce"
+	"github.com/filecoin-project/go-legs/announce/gossiptopic"
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+var log = logging.Logger("go-legs-announceonly")
+
+// shutdownTime is the time that closing a publisher waits for its pubsub topic
+// to close before shutting down pubsub.
+const shutdownTime = 5 * time.Second
+
+// Publisher announces the root of a DAG that is served by a data server, with
+// the data server's addresses, over pubsub and directly to subscribers. It
+// does not serve the DAG or its head.
+type Publisher struct {
+	cancelPubSub context.CancelFunc
+	closeOnce    sync.Once
+	host         host.Host
+	topic        *pubsub.Topic
+
+	// dataServer is the peer that serves the DAG, which is announced as the
+	// publisher.
+	dataServer    peer.AddrInfo
+	announcePeers []peer.AddrInfo
+	extraData     []byte
+	// directTopic is the topic that announcements are sent directly for.
+	directTopic string
+
+	// addrs are the addresses included in the most recent announcement.
+	addrs []multiaddr.Multiaddr
+	root  cid.Cid
+	rl    sync.RWMutex
+
+	cancelRepublish context.CancelFunc
+	republishDone   chan struct{}
+}
+
+// NewPublisher creates a publisher that announces, from host, the root of the
+// DAG served by dataServer, with the data server's addresses. Subscribers sync
+// the announced root from the data server. If the data server has a different
+// peer ID than host, then each announcement names the data server as its
+// original publisher, so that subscribers sync from, and verify the head
+// against, the data server.
+//
+// Announcements are published on the named pubsub topic, or on the topic given
+// by WithTopic, and sent directly to the subscribers given by
+// WithDirectAnnounce. If topicName is empty and WithTopic is not given, then
+// announcements are only sent directly, for the topic given by
+// WithDirectTopic.
+//
+// Subscribers only accept announcements that are sent directly from a host
+// other than the data server if they trust the host as a relay. See
+// announce.WithTrustedRelays.
+func NewPublisher(host host.Host, topicName string, dataServer peer.AddrInfo, options ...Option) (*Publisher, error) {
+	var cfg config
+	if err := cfg.apply(options); err != nil {
+		return nil, err
+	}
+	if err := dataServer.ID.Validate(); err != nil {
+		return nil, fmt.Errorf("bad data server peer: %w", err)
+	}
+	if len(dataServer.Addrs) == 0 {
+		return nil, errors.New("data server has no addresses")
+	}
+
+	var cancelPubsub context.CancelFunc
+	t := cfg.topic
+	if t == nil && topicName != "" {
+		var err error
+		t, cancelPubsub, err = gossiptopic.MakeTopic(host, topicName, cfg.pubsubOpts()...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t == nil && len(cfg.announcePeers) == 0 {
+		return nil, errors.New("no pubsub topic or direct announce peers to announce to")
+	}
+	directTopic := cfg.directTopic
+	if t != nil {
+		directTopic = t.String()
+	}
+	if directTopic == "" && len(cfg.announcePeers) != 0 {
+		return nil, errors.New("no topic to send direct announcements for")
+	}
+
+	p := &Publisher{
+		cancelPubSub: cancelPubsub,
+		host:         host,
+		topic:        t,
+
+		dataServer:    dataServer,
+		announcePeers: cfg.announcePeers,
+		directTopic:   directTopic,
+		extraData:     cfg.extraData,
+	}
+	if cfg.republishInterval != 0 {
+		var ctx context.Context
+		ctx, p.cancelRepublish = context.WithCancel(context.Background())
+		p.republishDone = make(chan struct{})
+		go p.republish(ctx, cfg.republishInterval)
+	}
+	return p, nil
+}
+
+// SetRoot sets the root CID without announcing it. It is re-announced
+// periodically if the WithRepublishInterval option is given.
+func (p *Publisher) SetRoot(_ context.Context, c cid.Cid) error {
+	if c == cid.Undef {
+		return errors.New("cannot update to an undefined cid")
+	}
+	p.rl.Lock()
+	p.root = c
+	p.rl.Unlock()
+	return nil
+}
+
+// Root returns the root CID that was last set, or cid.Undef if no root is set.
+func (p *Publisher) Root() cid.Cid {
+	p.rl.RLock()
+	defer p.rl.RUnlock()
+	return p.root
+}
+
+// UpdateRoot sets the root CID and announces it with the data server's
+// addresses.
+func (p *Publisher) UpdateRoot(ctx context.Context, c cid.Cid) error {
+	return p.UpdateRootWithAddrs(ctx, c, p.dataServer.Addrs)
+}
+
+// UpdateRootWithAddrs sets the root CID and announces it with the given
+// addresses of the data server.
+func (p *Publisher) UpdateRootWithAddrs(ctx context.Context, c cid.Cid, addrs []multiaddr.Multiaddr) error {
+	if err := p.SetRoot(ctx, c); err != nil {
+		return err
+	}
+	p.rl.Lock()
+	p.addrs = addrs
+	p.rl.Unlock()
+	return p.publish(ctx, c, addrs)
+}
+
+// republish re-announces the current root every interval, until ctx is
+// canceled.
+func (p *Publisher) republish(ctx context.Context, interval time.Duration) {
+	defer close(p.republishDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		p.rl.RLock()
+		root := p.root
+		addrs := p.addrs
+		p.rl.RUnlock()
+		if root == cid.Undef {
+			continue
+		}
+		if addrs == nil {
+			addrs = p.dataServer.Addrs
+		}
+		log.Debugw("Re-announcing root", "cid", root)
+		if err := p.publish(ctx, root, addrs); err != nil && ctx.Err() == nil {
+			log.Errorw("Failed to re-announce root", "err", err)
+		}
+	}
+}
+
+// publish announces c with addrs on the pubsub topic, if any, and directly to
+// each of the configured subscribers.
+func (p *Publisher) publish(ctx context.Context, c cid.Cid, addrs []multiaddr.Multiaddr) error {
+	log.Debugw("Announcing CID and data server addresses", "cid", c, "addrs", addrs)
+	msg := gossiptopic.Message{
+		Cid:       c,
+		ExtraData: p.extraData,
+	}
+	if p.dataServer.ID != p.host.ID() {
+		msg.OrigPeer = p.dataServer.ID.String()
+	}
+	msg.SetAddrs(addrs)
+
+	if p.topic != nil {
+		var buf bytes.Buffer
+		if err := msg.MarshalCBOR(&buf); err != nil {
+			return err
+		}
+		if err := p.topic.Publish(ctx, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	p.sendDirect(ctx, msg)
+	return nil
+}
+
+// sendDirect sends the announce message directly to each of the configured
+// subscribers, and waits for all sends to finish. Failures are only logged.
+func (p *Publisher) sendDirect(ctx context.Context, msg gossiptopic.Message) {
+	var wg sync.WaitGroup
+	for _, pi := range p.announcePeers {
+		wg.Add(1)
+		go func(pi peer.AddrInfo) {
+			defer wg.Done()
+			if err := announce.Send(ctx, p.host, p.directTopic, pi, msg); err != nil {
+				log.Errorw("Failed to send announcement directly to subscriber", "err", err, "peer", pi.ID)
+			}
+		}(pi)
+	}
+	wg.Wait()
+}
+
+// Close stops re-announcing the root. If the publisher joined a pubsub topic,
+// then it leaves the topic.
+func (p *Publisher) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		if p.cancelRepublish != nil {
+			p.cancelRepublish()
+			<-p.republishDone
+		}
+
+		// If publisher owns the pubsub Topic, then leave topic and shutdown Pubsub.
+		if p.cancelPubSub != nil {
+			t := time.AfterFunc(shutdownTime, p.cancelPubSub)
+			if err = p.topic.Close(); err != nil {
+				log.Errorw("Failed to close pubsub topic", "err", err)
+			}
+			if t.Stop() {
+				p.cancelPubSub()
+			}
+		}
+	})
+	return err
+}
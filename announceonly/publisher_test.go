@@ -0,0 +1,120 @@
+package announceonly_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/announce"
+	"github.com/filecoin-project/go-legs/announceonly"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+const testTopic = "/legs/testtopic"
+
+var (
+	_ legs.Publisher     = (*announceonly.Publisher)(nil)
+	_ legs.HeadPublisher = (*announceonly.Publisher)(nil)
+)
+
+var (
+	testCid  = cid.MustParse("bafyreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku")
+	testCid2 = cid.MustParse("bafyreibjo4xmgaevkgud7mbifn3dzp4v4lyaui4yvqp3f2bqwtxcjrdqg4")
+)
+
+func TestPublisherPubsub(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pubHost := test.MkTestHost()
+	rcvHost := test.MkTestHost()
+	defer pubHost.Close()
+	defer rcvHost.Close()
+	topics := test.WaitForMeshWithMessage(t, testTopic, pubHost, rcvHost)
+
+	rcvr, err := announce.NewReceiver(rcvHost, testTopic, announce.WithTopic(topics[1]))
+	require.NoError(t, err)
+	defer rcvr.Close()
+
+	// The data server has a different peer ID than the announcing host.
+	dataServer := peer.AddrInfo{
+		ID:    test.MkTestHost().ID(),
+		Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/dns4/data.example.com/tcp/443/https")},
+	}
+	pub, err := announceonly.NewPublisher(pubHost, "", dataServer,
+		announceonly.WithTopic(topics[0]), announceonly.WithExtraData([]byte("t01000")))
+	require.NoError(t, err)
+	defer pub.Close()
+
+	// Setting the root does not announce it.
+	require.NoError(t, pub.SetRoot(ctx, testCid2))
+	require.Equal(t, testCid2, pub.Root())
+
+	require.NoError(t, pub.UpdateRoot(ctx, testCid))
+	require.Equal(t, testCid, pub.Root())
+	amsg, err := rcvr.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, testCid, amsg.Cid)
+	require.Equal(t, dataServer.ID, amsg.PeerID)
+	require.Equal(t, dataServer.Addrs, amsg.Addrs)
+	require.Equal(t, announce.SourceGossip, amsg.Source)
+}
+
+func TestPublisherDirect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pubHost := test.MkTestHost()
+	rcvHost := test.MkTestHost()
+	defer pubHost.Close()
+	defer rcvHost.Close()
+
+	rcvr, err := announce.NewReceiver(rcvHost, testTopic, announce.WithStreamAnnounce(true))
+	require.NoError(t, err)
+	defer rcvr.Close()
+	rcvInfo := peer.AddrInfo{ID: rcvHost.ID(), Addrs: rcvHost.Addrs()}
+
+	// The announcing host is itself the data server.
+	dataServer := peer.AddrInfo{
+		ID:    pubHost.ID(),
+		Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/192.0.2.1/tcp/3104")},
+	}
+
+	// There must be somewhere to announce to.
+	_, err = announceonly.NewPublisher(pubHost, "", dataServer)
+	require.Error(t, err)
+	_, err = announceonly.NewPublisher(pubHost, "", peer.AddrInfo{ID: pubHost.ID()},
+		announceonly.WithDirectAnnounce(rcvInfo))
+	require.Error(t, err)
+
+	// Direct announcements must be for a topic.
+	_, err = announceonly.NewPublisher(pubHost, "", dataServer, announceonly.WithDirectAnnounce(rcvInfo))
+	require.Error(t, err)
+
+	pub, err := announceonly.NewPublisher(pubHost, "", dataServer, announceonly.WithDirectAnnounce(rcvInfo),
+		announceonly.WithDirectTopic(testTopic), announceonly.WithRepublishInterval(100*time.Millisecond))
+	require.NoError(t, err)
+	defer pub.Close()
+
+	addrs := []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/192.0.2.2/tcp/3104")}
+	require.NoError(t, pub.UpdateRootWithAddrs(ctx, testCid, addrs))
+	amsg, err := rcvr.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, testCid, amsg.Cid)
+	require.Equal(t, pubHost.ID(), amsg.PeerID)
+	require.Equal(t, addrs, amsg.Addrs)
+	require.Equal(t, announce.SourceStream, amsg.Source)
+
+	// A root that is set without announcing it is re-announced with the
+	// addresses of the last announcement.
+	require.NoError(t, pub.SetRoot(ctx, testCid2))
+	amsg, err = rcvr.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, testCid2, amsg.Cid)
+	require.Equal(t, addrs, amsg.Addrs)
+}
@@ -0,0 +1,50 @@
+// Package bsutil provides a link system that stores blocks in a blockstore,
+// for syncing with a blockstore instead of a link system.
+package bsutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	blocks "github.com/ipfs/go-block-format"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+// LinkSystem returns a link system that reads blocks from, and writes blocks
+// to, bs. Blocks are stored by the blockstore, which keys them by multihash,
+// instead of by the CID string keys used by simple datastore link systems.
+//
+// The data of each block written is buffered in memory until the block is
+// committed, and is then put in bs as a single block.
+func LinkSystem(bs blockstore.Blockstore) ipld.LinkSystem {
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		ctx := lctx.Ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		blk, err := bs.Get(ctx, lnk.(cidlink.Link).Cid)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(blk.RawData()), nil
+	}
+	lsys.StorageWriteOpener = func(lctx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		ctx := lctx.Ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		buf := bytes.NewBuffer(nil)
+		return buf, func(lnk ipld.Link) error {
+			blk, err := blocks.NewBlockWithCid(buf.Bytes(), lnk.(cidlink.Link).Cid)
+			if err != nil {
+				return err
+			}
+			return bs.Put(ctx, blk)
+		}, nil
+	}
+	return lsys
+}
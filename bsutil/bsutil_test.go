@@ -0,0 +1,53 @@
+package bsutil_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-legs/bsutil"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-ipld-prime"
+	_ "github.com/ipld/go-ipld-prime/codec/dagjson"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/multiformats/go-multicodec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkSystem(t *testing.T) {
+	ctx := context.Background()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	bs := blockstore.NewBlockstore(ds)
+	lsys := bsutil.LinkSystem(bs)
+
+	lp := cidlink.LinkPrototype{Prefix: cid.Prefix{
+		Version:  1,
+		Codec:    uint64(multicodec.DagJson),
+		MhType:   uint64(multicodec.Sha2_256),
+		MhLength: -1,
+	}}
+	lnk, err := lsys.Store(ipld.LinkContext{Ctx: ctx}, lp, basicnode.NewString("hello"))
+	require.NoError(t, err)
+	c := lnk.(cidlink.Link).Cid
+
+	// The block is in the blockstore, and is not keyed by its CID string.
+	has, err := bs.Has(ctx, c)
+	require.NoError(t, err)
+	require.True(t, has)
+	has, err = ds.Has(ctx, datastore.NewKey(c.String()))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	n, err := lsys.Load(ipld.LinkContext{Ctx: ctx}, lnk, basicnode.Prototype.Any)
+	require.NoError(t, err)
+	s, err := n.AsString()
+	require.NoError(t, err)
+	require.Equal(t, "hello", s)
+
+	require.NoError(t, bs.DeleteBlock(ctx, c))
+	_, err = lsys.Load(ipld.LinkContext{Ctx: ctx}, lnk, basicnode.Prototype.Any)
+	require.Error(t, err)
+}
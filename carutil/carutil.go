@@ -0,0 +1,400 @@
+// Package carutil provides functions for exporting synced DAGs as CAR files,
+// and for importing CAR files into a link system.
+package carutil
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+// pragmaV2 is the fixed CARv2 pragma: a CARv1 header with version 2.
+var pragmaV2 = []byte{0x0a, 0xa1, 0x67, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x02}
+
+const (
+	// headerV2Size is the size of the CARv2 header that follows the pragma.
+	headerV2Size = 40
+	// dataOffsetV2 is the offset of the CARv1 data payload in a CARv2 file
+	// written without padding, after the 11 byte pragma and the header.
+	dataOffsetV2 = 11 + headerV2Size
+	// maxSectionSize is the maximum size of a CARv1 header or section that is
+	// read.
+	maxSectionSize = 32 << 20
+)
+
+// WriteV2 writes the blocks identified by cids from lsys to w, as a CARv2
+// file with the given roots. Blocks are written in the order given, and a
+// block that appears more than once is only written the first time. The CARv2
+// file is written without an index.
+//
+// Each block is read from lsys twice: once to calculate the size of the data
+// payload, which is written in the CARv2 header, and once to write it.
+func WriteV2(ctx context.Context, lsys ipld.LinkSystem, w io.Writer, roots []cid.Cid, cids []cid.Cid) error {
+	cids = dedup(cids)
+
+	v1Header, err := encodeHeaderV1(roots)
+	if err != nil {
+		return err
+	}
+
+	v1HeaderSize := uint64(uvarintSize(uint64(len(v1Header)))) + uint64(len(v1Header))
+	dataSize := v1HeaderSize
+	err = forEachBlock(ctx, lsys, cids, func(c cid.Cid, data []byte) error {
+		dataSize += sectionSize(c, data)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Write pragma and CARv2 header.
+	header := make([]byte, headerV2Size)
+	// The first 16 bytes are characteristics, which are all zero.
+	binary.LittleEndian.PutUint64(header[16:], dataOffsetV2)
+	binary.LittleEndian.PutUint64(header[24:], dataSize)
+	// Index offset of zero means there is no index.
+	binary.LittleEndian.PutUint64(header[32:], 0)
+	if _, err = w.Write(pragmaV2); err != nil {
+		return err
+	}
+	if _, err = w.Write(header); err != nil {
+		return err
+	}
+
+	// Write CARv1 data payload.
+	written, err := writeDataV1(ctx, lsys, w, v1Header, cids)
+	if err != nil {
+		return err
+	}
+	if written != dataSize {
+		return fmt.Errorf("blocks changed while writing car")
+	}
+	return nil
+}
+
+// WriteV1 writes the blocks identified by cids from lsys to w, as a CARv1
+// file with the given roots. Blocks are written in the order given, and a
+// block that appears more than once is only written the first time. Unlike
+// WriteV2, each block is read from lsys only once, so blocks are streamed to
+// w as they are read.
+func WriteV1(ctx context.Context, lsys ipld.LinkSystem, w io.Writer, roots []cid.Cid, cids []cid.Cid) error {
+	v1Header, err := encodeHeaderV1(roots)
+	if err != nil {
+		return err
+	}
+	_, err = writeDataV1(ctx, lsys, w, v1Header, dedup(cids))
+	return err
+}
+
+// writeDataV1 writes the CARv1 header and a section for each block to w.
+// Returns the number of bytes written.
+func writeDataV1(ctx context.Context, lsys ipld.LinkSystem, w io.Writer, v1Header []byte, cids []cid.Cid) (uint64, error) {
+	cw, err := newWriterV1(w, v1Header)
+	if err != nil {
+		return 0, err
+	}
+	err = forEachBlock(ctx, lsys, cids, cw.Put)
+	if err != nil {
+		return 0, err
+	}
+	return cw.written, nil
+}
+
+// WriterV1 writes a CARv1 stream one block at a time, so that blocks can be
+// written as they are traversed instead of being collected first.
+type WriterV1 struct {
+	w       io.Writer
+	written uint64
+}
+
+// NewWriterV1 creates a WriterV1 that writes to w, and writes the CARv1 header
+// with the given roots.
+func NewWriterV1(w io.Writer, roots []cid.Cid) (*WriterV1, error) {
+	v1Header, err := encodeHeaderV1(roots)
+	if err != nil {
+		return nil, err
+	}
+	return newWriterV1(w, v1Header)
+}
+
+func newWriterV1(w io.Writer, v1Header []byte) (*WriterV1, error) {
+	if _, err := w.Write(toUvarint(uint64(len(v1Header)))); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(v1Header); err != nil {
+		return nil, err
+	}
+	return &WriterV1{
+		w:       w,
+		written: uint64(uvarintSize(uint64(len(v1Header)))) + uint64(len(v1Header)),
+	}, nil
+}
+
+// Put writes a section for the block identified by c, with the given data.
+// The caller must not put the same block more than once.
+func (cw *WriterV1) Put(c cid.Cid, data []byte) error {
+	cw.written += sectionSize(c, data)
+	if _, err := cw.w.Write(toUvarint(uint64(c.ByteLen() + len(data)))); err != nil {
+		return err
+	}
+	if _, err := cw.w.Write(c.Bytes()); err != nil {
+		return err
+	}
+	_, err := cw.w.Write(data)
+	return err
+}
+
+// Read reads a CARv1 or CARv2 file from r, and stores each of its blocks in
+// lsys. The data of each block is checked to match its CID before it is
+// stored. Returns the roots of the CAR file.
+func Read(ctx context.Context, lsys ipld.LinkSystem, r io.Reader) ([]cid.Cid, error) {
+	cr, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	if err = cr.Store(ctx, lsys); err != nil {
+		return nil, err
+	}
+	return cr.Roots(), nil
+}
+
+// Reader reads a CARv1 or CARv2 file. The header is read when the Reader is
+// created, so that the roots can be checked before any blocks are stored.
+type Reader struct {
+	br    *bufio.Reader
+	roots []cid.Cid
+}
+
+// NewReader creates a Reader that reads a CARv1 or CARv2 file from r, and
+// reads the header of the file.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	roots, version, err := readHeaderV1(br)
+	if err != nil {
+		return nil, err
+	}
+	switch version {
+	case 1:
+	case 2:
+		header := make([]byte, headerV2Size)
+		if _, err = io.ReadFull(br, header); err != nil {
+			return nil, fmt.Errorf("cannot read carv2 header: %w", err)
+		}
+		dataOffset := binary.LittleEndian.Uint64(header[16:])
+		dataSize := binary.LittleEndian.Uint64(header[24:])
+		if dataOffset < dataOffsetV2 {
+			return nil, fmt.Errorf("invalid carv2 data offset: %d", dataOffset)
+		}
+		if _, err = io.CopyN(io.Discard, br, int64(dataOffset-dataOffsetV2)); err != nil {
+			return nil, fmt.Errorf("cannot read carv2 padding: %w", err)
+		}
+		br = bufio.NewReader(io.LimitReader(br, int64(dataSize)))
+		roots, version, err = readHeaderV1(br)
+		if err != nil {
+			return nil, err
+		}
+		if version != 1 {
+			return nil, fmt.Errorf("unsupported car data payload version: %d", version)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported car version: %d", version)
+	}
+	return &Reader{
+		br:    br,
+		roots: roots,
+	}, nil
+}
+
+// Roots returns the roots of the CAR file.
+func (cr *Reader) Roots() []cid.Cid {
+	return cr.roots
+}
+
+// Store reads the blocks of the CAR file, and stores each of them in lsys. The
+// data of each block is checked to match its CID before it is stored.
+func (cr *Reader) Store(ctx context.Context, lsys ipld.LinkSystem) error {
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		section, err := readSection(cr.br)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		n, c, err := cid.CidFromBytes(section)
+		if err != nil {
+			return fmt.Errorf("cannot read block cid: %w", err)
+		}
+		data := section[n:]
+		sum, err := c.Prefix().Sum(data)
+		if err != nil {
+			return err
+		}
+		if !sum.Equals(c) {
+			return fmt.Errorf("block data does not match cid %s", c)
+		}
+		w, commit, err := lsys.StorageWriteOpener(ipld.LinkContext{Ctx: ctx})
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(data); err != nil {
+			return fmt.Errorf("cannot write block %s: %w", c, err)
+		}
+		if err = commit(cidlink.Link{Cid: c}); err != nil {
+			return fmt.Errorf("cannot write block %s: %w", c, err)
+		}
+	}
+}
+
+// readHeaderV1 reads a CARv1 header, and returns its roots and version.
+func readHeaderV1(r *bufio.Reader) ([]cid.Cid, int64, error) {
+	data, err := readSection(r)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, fmt.Errorf("cannot read car header: %w", err)
+	}
+	nb := basicnode.Prototype.Map.NewBuilder()
+	if err = dagcbor.Decode(nb, bytes.NewReader(data)); err != nil {
+		return nil, 0, fmt.Errorf("cannot decode car header: %w", err)
+	}
+	header := nb.Build()
+
+	n, err := header.LookupByString("version")
+	if err != nil {
+		return nil, 0, fmt.Errorf("car header has no version: %w", err)
+	}
+	version, err := n.AsInt()
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid car version: %w", err)
+	}
+	if version == 2 {
+		// CARv2 pragma has no roots.
+		return nil, version, nil
+	}
+
+	n, err = header.LookupByString("roots")
+	if err != nil {
+		return nil, 0, fmt.Errorf("car header has no roots: %w", err)
+	}
+	roots := make([]cid.Cid, 0, n.Length())
+	iter := n.ListIterator()
+	if iter == nil {
+		return nil, 0, errors.New("car header roots is not a list")
+	}
+	for !iter.Done() {
+		_, v, err := iter.Next()
+		if err != nil {
+			return nil, 0, err
+		}
+		lnk, err := v.AsLink()
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid car root: %w", err)
+		}
+		roots = append(roots, lnk.(cidlink.Link).Cid)
+	}
+	return roots, version, nil
+}
+
+// readSection reads a length-prefixed CARv1 section. Returns io.EOF if there
+// are no more sections.
+func readSection(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("cannot read car section size: %w", err)
+	}
+	if size == 0 || size > maxSectionSize {
+		return nil, fmt.Errorf("invalid car section size: %d", size)
+	}
+	section := make([]byte, size)
+	if _, err = io.ReadFull(r, section); err != nil {
+		return nil, fmt.Errorf("cannot read car section: %w", err)
+	}
+	return section, nil
+}
+
+// encodeHeaderV1 encodes the CARv1 header, containing the roots and version.
+func encodeHeaderV1(roots []cid.Cid) ([]byte, error) {
+	n := fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(na fluent.MapAssembler) {
+		na.AssembleEntry("roots").CreateList(int64(len(roots)), func(la fluent.ListAssembler) {
+			for _, root := range roots {
+				la.AssembleValue().AssignLink(cidlink.Link{Cid: root})
+			}
+		})
+		na.AssembleEntry("version").AssignInt(1)
+	})
+	var buf bytes.Buffer
+	if err := dagcbor.Encode(n, &buf); err != nil {
+		return nil, fmt.Errorf("cannot encode car header: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// sectionSize returns the size of the CARv1 section for a block.
+func sectionSize(c cid.Cid, data []byte) uint64 {
+	size := uint64(c.ByteLen() + len(data))
+	return uint64(uvarintSize(size)) + size
+}
+
+func uvarintSize(n uint64) int {
+	return len(toUvarint(n))
+}
+
+func toUvarint(n uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutUvarint(buf, n)]
+}
+
+// forEachBlock reads each block from lsys and calls fn with its data.
+func forEachBlock(ctx context.Context, lsys ipld.LinkSystem, cids []cid.Cid, fn func(cid.Cid, []byte) error) error {
+	for _, c := range cids {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		r, err := lsys.StorageReadOpener(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c})
+		if err != nil {
+			return fmt.Errorf("cannot read block %s: %w", c, err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("cannot read block %s: %w", c, err)
+		}
+		if err = fn(c, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dedup returns cids with any repeated CID removed, keeping the first
+// occurrence.
+func dedup(cids []cid.Cid) []cid.Cid {
+	seen := make(map[cid.Cid]struct{}, len(cids))
+	out := make([]cid.Cid, 0, len(cids))
+	for _, c := range cids {
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		seen[c] = struct{}{}
+		out = append(out, c)
+	}
+	return out
+}
@@ -0,0 +1,200 @@
+package carutil_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/filecoin-project/go-legs/carutil"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	_ "github.com/ipld/go-ipld-prime/codec/dagjson"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/multiformats/go-multicodec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteV2(t *testing.T) {
+	ctx := context.Background()
+	lsys := cidlink.DefaultLinkSystem()
+	store := &memstore.Store{}
+	lsys.SetReadStorage(store)
+	lsys.SetWriteStorage(store)
+	lp := cidlink.LinkPrototype{
+		Prefix: cid.Prefix{
+			Version:  1,
+			Codec:    uint64(multicodec.DagJson),
+			MhType:   uint64(multicodec.Sha2_256),
+			MhLength: -1,
+		},
+	}
+
+	var cids []cid.Cid
+	for _, v := range []string{"lobster", "barreleye", "dasea"} {
+		lnk, err := lsys.Store(ipld.LinkContext{Ctx: ctx}, lp, fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+			na.AssembleEntry("fish").AssignString(v)
+		}))
+		require.NoError(t, err)
+		cids = append(cids, lnk.(cidlink.Link).Cid)
+	}
+
+	var buf bytes.Buffer
+	// Repeated CIDs are only written once.
+	err := carutil.WriteV2(ctx, lsys, &buf, cids[:1], append(cids, cids[0]))
+	require.NoError(t, err)
+
+	data := buf.Bytes()
+	require.Equal(t, []byte{0x0a, 0xa1, 0x67, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x02}, data[:11])
+	header := data[11:51]
+	require.Equal(t, make([]byte, 16), header[:16], "characteristics should be zero")
+	require.Equal(t, uint64(51), binary.LittleEndian.Uint64(header[16:]))
+	require.Equal(t, uint64(len(data)-51), binary.LittleEndian.Uint64(header[24:]))
+	require.Zero(t, binary.LittleEndian.Uint64(header[32:]), "index offset should be zero")
+
+	r := bufio.NewReader(bytes.NewReader(data[51:]))
+	readSection := func() []byte {
+		size, err := binary.ReadUvarint(r)
+		require.NoError(t, err)
+		section := make([]byte, size)
+		_, err = io.ReadFull(r, section)
+		require.NoError(t, err)
+		return section
+	}
+
+	nb := basicnode.Prototype.Any.NewBuilder()
+	require.NoError(t, dagcbor.Decode(nb, bytes.NewReader(readSection())))
+	v1Header := nb.Build()
+	version, err := v1Header.LookupByString("version")
+	require.NoError(t, err)
+	v, err := version.AsInt()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), v)
+	roots, err := v1Header.LookupByString("roots")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), roots.Length())
+	root, err := roots.LookupByIndex(0)
+	require.NoError(t, err)
+	rootLnk, err := root.AsLink()
+	require.NoError(t, err)
+	require.Equal(t, cids[0], rootLnk.(cidlink.Link).Cid)
+
+	for _, want := range cids {
+		section := readSection()
+		n, c, err := cid.CidFromBytes(section)
+		require.NoError(t, err)
+		require.Equal(t, want, c)
+		blockData, err := store.Get(ctx, cidlink.Link{Cid: want}.Binary())
+		require.NoError(t, err)
+		require.Equal(t, blockData, section[n:])
+	}
+	_, err = r.ReadByte()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestRead(t *testing.T) {
+	ctx := context.Background()
+	lsys := cidlink.DefaultLinkSystem()
+	store := &memstore.Store{}
+	lsys.SetReadStorage(store)
+	lsys.SetWriteStorage(store)
+	lp := cidlink.LinkPrototype{
+		Prefix: cid.Prefix{
+			Version:  1,
+			Codec:    uint64(multicodec.DagJson),
+			MhType:   uint64(multicodec.Sha2_256),
+			MhLength: -1,
+		},
+	}
+
+	var cids []cid.Cid
+	for _, v := range []string{"lobster", "barreleye", "dasea"} {
+		lnk, err := lsys.Store(ipld.LinkContext{Ctx: ctx}, lp, fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+			na.AssembleEntry("fish").AssignString(v)
+		}))
+		require.NoError(t, err)
+		cids = append(cids, lnk.(cidlink.Link).Cid)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, carutil.WriteV2(ctx, lsys, &buf, cids[:1], cids))
+	data := buf.Bytes()
+
+	dstLsys := cidlink.DefaultLinkSystem()
+	dstStore := &memstore.Store{}
+	dstLsys.SetReadStorage(dstStore)
+	dstLsys.SetWriteStorage(dstStore)
+
+	roots, err := carutil.Read(ctx, dstLsys, bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, cids[:1], roots)
+	for _, c := range cids {
+		want, err := store.Get(ctx, cidlink.Link{Cid: c}.Binary())
+		require.NoError(t, err)
+		got, err := dstStore.Get(ctx, cidlink.Link{Cid: c}.Binary())
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+
+	// The CARv1 data payload can be read on its own.
+	dstStore = &memstore.Store{}
+	dstLsys.SetWriteStorage(dstStore)
+	roots, err = carutil.Read(ctx, dstLsys, bytes.NewReader(data[51:]))
+	require.NoError(t, err)
+	require.Equal(t, cids[:1], roots)
+	require.Len(t, dstStore.Bag, len(cids))
+
+	// Block data that does not match its CID is rejected.
+	corrupt := append([]byte{}, data...)
+	corrupt[len(corrupt)-2] ^= 0xff
+	_, err = carutil.Read(ctx, dstLsys, bytes.NewReader(corrupt))
+	require.ErrorContains(t, err, "does not match")
+}
+
+func TestWriteV1(t *testing.T) {
+	ctx := context.Background()
+	lsys := cidlink.DefaultLinkSystem()
+	store := &memstore.Store{}
+	lsys.SetReadStorage(store)
+	lsys.SetWriteStorage(store)
+	lp := cidlink.LinkPrototype{
+		Prefix: cid.Prefix{
+			Version:  1,
+			Codec:    uint64(multicodec.DagJson),
+			MhType:   uint64(multicodec.Sha2_256),
+			MhLength: -1,
+		},
+	}
+
+	var cids []cid.Cid
+	for _, v := range []string{"lobster", "barreleye", "dasea"} {
+		lnk, err := lsys.Store(ipld.LinkContext{Ctx: ctx}, lp, fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+			na.AssembleEntry("fish").AssignString(v)
+		}))
+		require.NoError(t, err)
+		cids = append(cids, lnk.(cidlink.Link).Cid)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, carutil.WriteV1(ctx, lsys, &buf, cids[:1], append(cids, cids[0])))
+
+	// The CARv1 file is the same as the data payload of a CARv2 file.
+	var v2Buf bytes.Buffer
+	require.NoError(t, carutil.WriteV2(ctx, lsys, &v2Buf, cids[:1], cids))
+	require.Equal(t, v2Buf.Bytes()[51:], buf.Bytes())
+
+	dstLsys := cidlink.DefaultLinkSystem()
+	dstStore := &memstore.Store{}
+	dstLsys.SetReadStorage(dstStore)
+	dstLsys.SetWriteStorage(dstStore)
+	roots, err := carutil.Read(ctx, dstLsys, &buf)
+	require.NoError(t, err)
+	require.Equal(t, cids[:1], roots)
+	require.Len(t, dstStore.Bag, len(cids))
+}
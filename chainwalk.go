@@ -0,0 +1,112 @@
+package legs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ChainNodeFunc is the signature of a function that is called by the chain
+// walker for each new node of a publisher's chain. It is called with the peer
+// that the chain was synced from, and the CID and the node of the chain entry.
+// Returning an error stops the delivery of the remaining new nodes of the
+// sync. See: ChainWalker.
+type ChainNodeFunc func(peer.ID, cid.Cid, ipld.Node) error
+
+// chainWalker walks the new part of a publisher's chain after each sync that
+// updates the latest sync with the publisher.
+type chainWalker struct {
+	prevPath datamodel.Path
+	fn       ChainNodeFunc
+}
+
+// newChainWalker creates a chainWalker that follows the link at prevPath in
+// each chain node, and calls fn for each new node. Returns nil if fn is nil.
+func newChainWalker(prevPath string, fn ChainNodeFunc) *chainWalker {
+	if fn == nil {
+		return nil
+	}
+	return &chainWalker{
+		prevPath: datamodel.ParsePath(prevPath),
+		fn:       fn,
+	}
+}
+
+// advanceLatestSync sets the latest sync with the publisher to head, and, if
+// there is a chain walker, calls it for each chain node from the previous
+// latest sync to head.
+func (s *Subscriber) advanceLatestSync(ctx context.Context, peerID peer.ID, head cid.Cid) {
+	if s.chainWalker == nil {
+		s.setLatestSync(peerID, head)
+		return
+	}
+	prev, _ := s.getLatestSync(peerID)
+	s.setLatestSync(peerID, head)
+	s.chainWalker.deliver(ctx, s.linkSystemFor(peerID), peerID, head, prev)
+}
+
+// deliver walks the chain from head back to stop, and calls the walker's
+// function for each node walked, in order from the oldest to head. The walk
+// also ends at the end of the chain, or at a node that cannot be loaded, such
+// as one in the skip list.
+func (w *chainWalker) deliver(ctx context.Context, lsys ipld.LinkSystem, peerID peer.ID, head, stop cid.Cid) {
+	type chainNode struct {
+		cid  cid.Cid
+		node ipld.Node
+	}
+	var nodes []chainNode
+	for c := head; c != cid.Undef && c != stop; {
+		node, err := lsys.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c}, basicnode.Prototype.Any)
+		if err != nil {
+			log.Errorw("Chain walk cannot load node, ending walk", "err", err, "cid", c, "peer", peerID)
+			break
+		}
+		nodes = append(nodes, chainNode{c, node})
+		c, err = w.prev(node)
+		if err != nil {
+			log.Errorw("Chain walk cannot get previous node, ending walk", "err", err, "cid", nodes[len(nodes)-1].cid, "peer", peerID)
+			break
+		}
+	}
+
+	for i := len(nodes) - 1; i >= 0; i-- {
+		if err := w.fn(peerID, nodes[i].cid, nodes[i].node); err != nil {
+			log.Errorw("Chain walker failed, not delivering remaining nodes", "err", err, "cid", nodes[i].cid, "peer", peerID, "remaining", i)
+			return
+		}
+	}
+	log.Debugw("Delivered new chain nodes", "count", len(nodes), "head", head, "peer", peerID)
+}
+
+// prev returns the CID of the node that node links to at the walker's
+// previous node path, or cid.Undef if node is the first node of the chain.
+// The path is followed within node, without loading any links.
+func (w *chainWalker) prev(node ipld.Node) (cid.Cid, error) {
+	n := node
+	for _, seg := range w.prevPath.Segments() {
+		next, err := n.LookupBySegment(seg)
+		if err != nil {
+			var notExists datamodel.ErrNotExists
+			if errors.As(err, &notExists) {
+				return cid.Undef, nil
+			}
+			return cid.Undef, fmt.Errorf("cannot get previous node path %s: %w", w.prevPath, err)
+		}
+		n = next
+	}
+	if n.IsNull() || n.IsAbsent() {
+		return cid.Undef, nil
+	}
+	lnk, err := n.AsLink()
+	if err != nil {
+		return cid.Undef, fmt.Errorf("previous node path %s is not a link: %w", w.prevPath, err)
+	}
+	return lnk.(cidlink.Link).Cid, nil
+}
@@ -0,0 +1,82 @@
+// Command legs-crawler joins a topic, records the announcements published on
+// it for a period of time, queries each publisher's head, and prints a report
+// of the publishers.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-legs/crawler"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+func main() {
+	topic := flag.String("topic", "", "name of the topic to crawl (required)")
+	duration := flag.Duration("duration", time.Minute, "how long to record announcements")
+	queryTimeout := flag.Duration("query-timeout", 10*time.Second, "maximum time to wait for a publisher's head")
+	peers := flag.String("peers", "", "comma-separated p2p multiaddrs of peers to connect to, to join the topic mesh")
+	jsonOut := flag.Bool("json", false, "write the report as JSON")
+	flag.Parse()
+
+	if *topic == "" {
+		fmt.Fprintln(os.Stderr, "-topic is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(*topic, *duration, *queryTimeout, *peers, *jsonOut); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(topic string, duration, queryTimeout time.Duration, peers string, jsonOut bool) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	h, err := libp2p.New()
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	if peers != "" {
+		var addrs []multiaddr.Multiaddr
+		for _, s := range strings.Split(peers, ",") {
+			addr, err := multiaddr.NewMultiaddr(strings.TrimSpace(s))
+			if err != nil {
+				return fmt.Errorf("bad peer address %q: %w", s, err)
+			}
+			addrs = append(addrs, addr)
+		}
+		addrInfos, err := peer.AddrInfosFromP2pAddrs(addrs...)
+		if err != nil {
+			return err
+		}
+		for _, ai := range addrInfos {
+			if err = h.Connect(ctx, ai); err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot connect to peer %s: %s\n", ai.ID, err)
+			}
+		}
+	}
+
+	report, err := crawler.Crawl(ctx, h, topic, duration, crawler.WithQueryTimeout(queryTimeout))
+	if err != nil {
+		return err
+	}
+
+	if jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	return report.WriteText(os.Stdout)
+}
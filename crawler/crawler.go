@@ -0,0 +1,256 @@
+// Package crawler observes the announcements published on a topic, and reports
+// on the publishers that sent them. This helps to diagnose why subscribers
+// disagree about the state of the network.
+package crawler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/filecoin-project/go-legs/announce"
+	"github.com/filecoin-project/go-legs/httpsync"
+	"github.com/filecoin-project/go-legs/p2p/protocol/head"
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/multiformats/go-multiaddr"
+)
+
+var log = logging.Logger("go-legs-crawler")
+
+// Report describes the publishers that announced on a topic during a crawl.
+type Report struct {
+	// Topic is the name of the topic that was crawled.
+	Topic string
+	// Start is when the crawl started receiving announcements.
+	Start time.Time
+	// End is when the crawl stopped receiving announcements.
+	End time.Time
+	// Publishers are the publishers that announced during the crawl, ordered
+	// by peer ID.
+	Publishers []PublisherReport
+}
+
+// PublisherReport describes a publisher that announced on a topic.
+type PublisherReport struct {
+	// PeerID identifies the publisher.
+	PeerID peer.ID
+	// Addrs are all the addresses the publisher announced.
+	Addrs []multiaddr.Multiaddr
+	// Announcements is the number of announcements received from the
+	// publisher. The announce receiver drops any announcement of a CID that
+	// was already announced during the crawl, by this or another publisher, so
+	// repeated announcements of the same CID are only counted once.
+	Announcements int
+	// FirstSeen is when the first announcement was received.
+	FirstSeen time.Time
+	// LastSeen is when the last announcement was received.
+	LastSeen time.Time
+	// LastCid is the CID in the last announcement received.
+	LastCid cid.Cid
+	// IsRecord is true if LastCid identifies an announcement record instead
+	// of the announced head.
+	IsRecord bool
+	// Head is the head CID returned when the publisher was queried after the
+	// crawl. This is cid.Undef if the publisher has no head or was not
+	// reachable.
+	Head cid.Cid
+	// QueryTime is how long it took to query the publisher's head.
+	QueryTime time.Duration
+	// Reachable is true if the publisher's head was successfully queried.
+	Reachable bool
+	// Error describes why the head query failed, if it did.
+	Error string
+}
+
+// HeadCurrent returns true if the publisher's head is the CID that it last
+// announced. This is always false if the publisher was not reachable or
+// announced a record.
+func (p PublisherReport) HeadCurrent() bool {
+	return p.Reachable && !p.IsRecord && p.Head == p.LastCid
+}
+
+// Crawl joins the named topic on h and records every announcement that is
+// received for the specified duration. Then each publisher that announced is
+// queried for its head, using its http address if it announced one, or the
+// libp2p head protocol otherwise. Returns a Report of the publishers. If ctx is
+// canceled, then the crawl stops without querying any publisher, and ctx.Err()
+// is returned.
+func Crawl(ctx context.Context, h host.Host, topic string, duration time.Duration, options ...Option) (*Report, error) {
+	cfg, err := getOpts(options)
+	if err != nil {
+		return nil, err
+	}
+
+	var rcvrOpts []announce.Option
+	if cfg.topic != nil {
+		rcvrOpts = append(rcvrOpts, announce.WithTopic(cfg.topic))
+	}
+	rcvr, err := announce.NewReceiver(h, topic, rcvrOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot receive announcements: %w", err)
+	}
+	defer rcvr.Close()
+
+	report := &Report{
+		Topic: topic,
+		Start: time.Now(),
+	}
+	publishers := make(map[peer.ID]*PublisherReport)
+
+	log.Infow("Receiving announcements", "topic", topic, "duration", duration)
+	recvCtx, cancel := context.WithTimeout(ctx, duration)
+	for {
+		amsg, err := rcvr.Next(recvCtx)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+				break
+			}
+			cancel()
+			return nil, err
+		}
+		now := time.Now()
+		pub, ok := publishers[amsg.PeerID]
+		if !ok {
+			pub = &PublisherReport{
+				PeerID:    amsg.PeerID,
+				FirstSeen: now,
+			}
+			publishers[amsg.PeerID] = pub
+		}
+		pub.Announcements++
+		pub.LastSeen = now
+		pub.LastCid = amsg.Cid
+		pub.IsRecord = amsg.IsRecord
+		pub.Addrs = addAddrs(pub.Addrs, amsg.Addrs)
+		log.Debugw("Received announcement", "peer", amsg.PeerID, "cid", amsg.Cid)
+	}
+	cancel()
+	report.End = time.Now()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	report.Publishers = make([]PublisherReport, 0, len(publishers))
+	for _, pub := range publishers {
+		report.Publishers = append(report.Publishers, *pub)
+	}
+	sort.Slice(report.Publishers, func(i, j int) bool {
+		return report.Publishers[i].PeerID < report.Publishers[j].PeerID
+	})
+
+	log.Infow("Querying publishers", "count", len(report.Publishers))
+	client := cfg.httpClient
+	if client == nil {
+		client = &http.Client{
+			Timeout: cfg.queryTimeout,
+		}
+	}
+	httpSync := httpsync.NewSync(cidlink.DefaultLinkSystem(), client, nil)
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentQueries)
+	for i := range report.Publishers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(pub *PublisherReport) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			queryHead(ctx, h, httpSync, topic, cfg.queryTimeout, pub)
+		}(&report.Publishers[i])
+	}
+	wg.Wait()
+
+	return report, nil
+}
+
+// queryHead queries the publisher's head and records the result in pub.
+func queryHead(ctx context.Context, h host.Host, httpSync *httpsync.Sync, topic string, timeout time.Duration, pub *PublisherReport) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	var headCid cid.Cid
+	var err error
+	if httpAddr := firstHTTPAddr(pub.Addrs); httpAddr != nil {
+		var syncer *httpsync.Syncer
+		syncer, err = httpSync.NewSyncer(pub.PeerID, httpAddr, nil)
+		if err == nil {
+			headCid, err = syncer.GetHead(ctx)
+		}
+	} else {
+		if len(pub.Addrs) != 0 {
+			h.Peerstore().AddAddrs(pub.PeerID, pub.Addrs, peerstore.TempAddrTTL)
+		}
+		headCid, err = head.QueryRootCid(ctx, h, topic, pub.PeerID)
+	}
+	pub.QueryTime = time.Since(start)
+	if err != nil {
+		pub.Error = err.Error()
+		log.Infow("Cannot query publisher head", "err", err, "peer", pub.PeerID)
+		return
+	}
+	pub.Head = headCid
+	pub.Reachable = true
+}
+
+// WriteText writes the report to w as a human-readable table.
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Topic: %s\n", r.Topic)
+	fmt.Fprintf(tw, "Crawled: %s to %s (%s)\n", r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339), r.End.Sub(r.Start).Round(time.Second))
+	fmt.Fprintf(tw, "Publishers: %d\n\n", len(r.Publishers))
+	fmt.Fprintln(tw, "PEER\tANNOUNCEMENTS\tLAST SEEN\tLAST CID\tHEAD\tCURRENT\tQUERY TIME\tERROR")
+	for _, pub := range r.Publishers {
+		lastCid := pub.LastCid.String()
+		if pub.IsRecord {
+			lastCid += " (record)"
+		}
+		headCid := "-"
+		if pub.Head != cid.Undef {
+			headCid = pub.Head.String()
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%t\t%s\t%s\n", pub.PeerID, pub.Announcements,
+			pub.LastSeen.Format(time.RFC3339), lastCid, headCid, pub.HeadCurrent(),
+			pub.QueryTime.Round(time.Millisecond), pub.Error)
+	}
+	return tw.Flush()
+}
+
+// addAddrs adds the addresses in newAddrs that are not already in addrs.
+func addAddrs(addrs, newAddrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	for _, addr := range newAddrs {
+		var found bool
+		for _, existing := range addrs {
+			if existing.Equal(addr) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func firstHTTPAddr(addrs []multiaddr.Multiaddr) multiaddr.Multiaddr {
+	for _, addr := range addrs {
+		for _, p := range addr.Protocols() {
+			if p.Code == multiaddr.P_HTTP || p.Code == multiaddr.P_HTTPS {
+				return addr
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package crawler_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs/crawler"
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+)
+
+const testTopic = "/legs/testtopic"
+
+func TestCrawl(t *testing.T) {
+	ctx := context.Background()
+
+	pubHost := test.MkTestHost()
+	crawlHost := test.MkTestHost()
+	defer pubHost.Close()
+	defer crawlHost.Close()
+	topics := test.WaitForMeshWithMessage(t, testTopic, pubHost, crawlHost)
+
+	pubStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	pub, err := dtsync.NewPublisher(pubHost, pubStore, test.MkLinkSystem(pubStore), testTopic, dtsync.Topic(topics[0]))
+	require.NoError(t, err)
+	defer pub.Close()
+
+	cids, err := test.RandomCids(2)
+	require.NoError(t, err)
+
+	type crawlResult struct {
+		report *crawler.Report
+		err    error
+	}
+	done := make(chan crawlResult, 1)
+	go func() {
+		report, err := crawler.Crawl(ctx, crawlHost, testTopic, 2*time.Second, crawler.WithTopic(topics[1]))
+		done <- crawlResult{report, err}
+	}()
+
+	// Announce a CID twice, and then update the head without announcing it, so
+	// that the publisher's head differs from what it announced.
+	time.Sleep(500 * time.Millisecond)
+	require.NoError(t, pub.UpdateRoot(ctx, cids[0]))
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, pub.UpdateRoot(ctx, cids[0]))
+	time.Sleep(200 * time.Millisecond)
+	require.NoError(t, pub.SetRoot(ctx, cids[1]))
+
+	res := <-done
+	require.NoError(t, res.err)
+	report := res.report
+	require.Equal(t, testTopic, report.Topic)
+	require.Len(t, report.Publishers, 1)
+
+	pubReport := report.Publishers[0]
+	require.Equal(t, pubHost.ID(), pubReport.PeerID)
+	// The repeated announcement of the same CID is only counted once.
+	require.Equal(t, 1, pubReport.Announcements)
+	require.Equal(t, cids[0], pubReport.LastCid)
+	require.NotEmpty(t, pubReport.Addrs)
+	require.True(t, pubReport.Reachable, pubReport.Error)
+	require.Equal(t, cids[1], pubReport.Head)
+	require.False(t, pubReport.HeadCurrent())
+
+	var buf bytes.Buffer
+	require.NoError(t, report.WriteText(&buf))
+	require.Contains(t, buf.String(), pubHost.ID().String())
+	require.Contains(t, buf.String(), cids[1].String())
+}
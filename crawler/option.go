@@ -0,0 +1,68 @@
+package crawler
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+const (
+	defaultQueryTimeout = 10 * time.Second
+	// maxConcurrentQueries is the maximum number of publishers that are
+	// queried for their head at the same time.
+	maxConcurrentQueries = 16
+)
+
+type Option func(*config) error
+
+// config contains all options for configuring a crawl.
+type config struct {
+	httpClient   *http.Client
+	queryTimeout time.Duration
+	topic        *pubsub.Topic
+}
+
+// getOpts creates a config and applies Options to it.
+func getOpts(opts []Option) (config, error) {
+	cfg := config{
+		queryTimeout: defaultQueryTimeout,
+	}
+	for i, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return config{}, fmt.Errorf("option %d failed: %s", i, err)
+		}
+	}
+	return cfg, nil
+}
+
+// WithHTTPClient sets the http client used to query the head of publishers
+// that have an http address.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *config) error {
+		c.httpClient = client
+		return nil
+	}
+}
+
+// WithQueryTimeout sets the maximum time to wait for a publisher to respond to
+// a query for its head. A publisher that does not respond in this time is
+// reported as unreachable.
+func WithQueryTimeout(timeout time.Duration) Option {
+	return func(c *config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("query timeout must be positive: %s", timeout)
+		}
+		c.queryTimeout = timeout
+		return nil
+	}
+}
+
+// WithTopic provides an existing pubsub topic to receive announcements on.
+func WithTopic(topic *pubsub.Topic) Option {
+	return func(c *config) error {
+		c.topic = topic
+		return nil
+	}
+}
@@ -0,0 +1,120 @@
+package legs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+)
+
+const (
+	// legsKeyPrefix is the prefix of the keys that go-legs itself writes to
+	// the datastores it is given.
+	legsKeyPrefix = "/legs"
+	// migrateBatchSize is the number of keys that MigrateDatastorePrefix
+	// moves in each batch.
+	migrateBatchSize = 1024
+)
+
+// MigrateDatastorePrefix moves the keys that go-legs wrote to ds without a
+// prefix, before the DatastorePrefix option was used, under prefix. It returns
+// the number of keys moved. Call this once, before creating a Subscriber or
+// publisher that uses ds with the prefix. The moved keys are those starting
+// with /legs, so the prefix cannot be under /legs, since its keys would then be
+// moved again. The keys are moved in batches, so if moving fails, then the keys
+// already moved stay under prefix, and calling this again moves the rest.
+//
+// The channel state that datatransfer keeps under /2 and /versions is not
+// moved, since other users of datatransfer may share these keys. Channels
+// recorded there before the migration are not restarted by the Subscriber or
+// publisher that uses the prefix.
+func MigrateDatastorePrefix(ctx context.Context, ds datastore.Batching, prefix string) (int, error) {
+	if prefix == "" {
+		return 0, errors.New("datastore prefix cannot be empty")
+	}
+	prefixKey := datastore.NewKey(prefix)
+	legsKey := datastore.NewKey(legsKeyPrefix)
+	if prefixKey.Equal(legsKey) || prefixKey.IsDescendantOf(legsKey) {
+		return 0, fmt.Errorf("datastore prefix %s is under migrated prefix %s", prefixKey, legsKey)
+	}
+
+	results, err := ds.Query(ctx, query.Query{Prefix: legsKeyPrefix})
+	if err != nil {
+		return 0, err
+	}
+	defer results.Close()
+
+	var moved, batched int
+	var batch datastore.Batch
+	commit := func() error {
+		if batched == 0 {
+			return nil
+		}
+		if err := batch.Commit(ctx); err != nil {
+			return err
+		}
+		moved += batched
+		batch, batched = nil, 0
+		return nil
+	}
+	for r := range results.Next() {
+		if r.Error != nil {
+			return moved, r.Error
+		}
+		if batch == nil {
+			if batch, err = ds.Batch(ctx); err != nil {
+				return moved, err
+			}
+		}
+		key := datastore.NewKey(r.Key)
+		if err = batch.Put(ctx, prefixKey.Child(key), r.Value); err != nil {
+			return moved, err
+		}
+		if err = batch.Delete(ctx, key); err != nil {
+			return moved, err
+		}
+		if batched++; batched == migrateBatchSize {
+			if err = commit(); err != nil {
+				return moved, err
+			}
+		}
+	}
+	if err = commit(); err != nil {
+		return moved, err
+	}
+	if moved != 0 {
+		log.Infow("Moved datastore keys under prefix", "prefix", prefixKey, "count", moved)
+	}
+	return moved, nil
+}
+
+// applyDatastorePrefix puts the keys of ds, and of each of the datastores given
+// by options, under the DatastorePrefix, if one is set, and returns ds.
+func (c *config) applyDatastorePrefix(ds datastore.Batching) datastore.Batching {
+	if c.dsPrefix == "" {
+		return ds
+	}
+	prefix := datastore.NewKey(c.dsPrefix)
+	if c.skipListDS != nil {
+		c.skipListDS = namespace.Wrap(c.skipListDS, prefix)
+	}
+	if c.journalDS != nil {
+		c.journalDS = namespace.Wrap(c.journalDS, prefix)
+	}
+	if c.quotaDS != nil {
+		c.quotaDS = namespace.Wrap(c.quotaDS, prefix)
+	}
+	if c.stagingDS != nil {
+		c.stagingDS = namespace.Wrap(c.stagingDS, prefix)
+	}
+	if c.syncStateDS != nil {
+		c.syncStateDS = namespace.Wrap(c.syncStateDS, prefix)
+	}
+	if ds != nil {
+		ds = namespace.Wrap(ds, prefix)
+	}
+	return ds
+}
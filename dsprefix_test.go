@@ -0,0 +1,117 @@
+package legs_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatastorePrefix(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pubSys := newHostSystem(t)
+	defer pubSys.close()
+	subSys := newHostSystem(t)
+	defer subSys.close()
+
+	pub, err := dtsync.NewPublisher(pubSys.host, pubSys.ds, pubSys.lsys, testTopic, dtsync.WithDatastorePrefix("/go-legs"))
+	require.NoError(t, err)
+	defer pub.Close()
+	chainLnks := test.MkChain(pubSys.lsys, true)
+	root := chainLnks[0].(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(ctx, root))
+
+	// The subscriber's link system shares its datastore with datatransfer,
+	// the skip list, and the sync state.
+	sub, err := legs.NewSubscriber(subSys.host, subSys.ds, subSys.lsys, testTopic, nil,
+		legs.DatastorePrefix("/go-legs"),
+		legs.SkipListDatastore(subSys.ds),
+		legs.SyncStateDatastore(subSys.ds))
+	require.NoError(t, err)
+	defer sub.Close()
+	require.NoError(t, sub.SkipCids(ctx, chainLnks[3].(cidlink.Link).Cid))
+
+	_, err = sub.Sync(ctx, pubSys.host.ID(), root, nil, pubSys.host.Addrs()[0])
+	require.NoError(t, err)
+
+	// Only synced blocks are outside of the prefix.
+	for _, sys := range []hostSystem{pubSys, subSys} {
+		keys := datastoreKeys(t, sys.ds)
+		var prefixed int
+		for _, key := range keys {
+			if strings.HasPrefix(key, "/go-legs/") {
+				prefixed++
+				continue
+			}
+			require.NotContains(t, []string{"legs", "versions", "2"}, datastore.NewKey(key).List()[0])
+		}
+		require.NotZero(t, prefixed)
+	}
+	_, err = legs.NewSubscriber(subSys.host, nil, subSys.lsys, testTopic, nil, legs.DatastorePrefix(""))
+	require.Error(t, err)
+}
+
+func TestMigrateDatastorePrefix(t *testing.T) {
+	ctx := context.Background()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	for _, key := range []string{"/legs/skiplist/a", "/versions/current", "/2/channel", "/app/data", "/20"} {
+		require.NoError(t, ds.Put(ctx, datastore.NewKey(key), []byte(key)))
+	}
+
+	_, err := legs.MigrateDatastorePrefix(ctx, ds, "")
+	require.Error(t, err)
+	_, err = legs.MigrateDatastorePrefix(ctx, ds, "/legs/prefixed")
+	require.Error(t, err)
+
+	// Datatransfer keys, which may be shared, are not moved.
+	moved, err := legs.MigrateDatastorePrefix(ctx, ds, "/go-legs")
+	require.NoError(t, err)
+	require.Equal(t, 1, moved)
+	require.ElementsMatch(t, []string{"/go-legs/legs/skiplist/a", "/versions/current", "/2/channel", "/app/data", "/20"}, datastoreKeys(t, ds))
+	value, err := ds.Get(ctx, datastore.NewKey("/go-legs/legs/skiplist/a"))
+	require.NoError(t, err)
+	require.Equal(t, "/legs/skiplist/a", string(value))
+
+	// Running again moves nothing.
+	moved, err = legs.MigrateDatastorePrefix(ctx, ds, "/go-legs")
+	require.NoError(t, err)
+	require.Zero(t, moved)
+
+	// Keys are moved in more than one batch.
+	const count = 3000
+	for i := 0; i < count; i++ {
+		require.NoError(t, ds.Put(ctx, datastore.NewKey(fmt.Sprintf("/legs/skip/%d", i)), []byte{}))
+	}
+	moved, err = legs.MigrateDatastorePrefix(ctx, ds, "/go-legs")
+	require.NoError(t, err)
+	require.Equal(t, count, moved)
+	results, err := ds.Query(ctx, query.Query{Prefix: "/legs", KeysOnly: true})
+	require.NoError(t, err)
+	entries, err := results.Rest()
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func datastoreKeys(t *testing.T, ds datastore.Datastore) []string {
+	results, err := ds.Query(context.Background(), query.Query{KeysOnly: true})
+	require.NoError(t, err)
+	entries, err := results.Rest()
+	require.NoError(t, err)
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	return keys
+}
@@ -2,9 +2,18 @@ package dtsync
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/filecoin-project/go-legs/acl"
+	"github.com/filecoin-project/go-legs/headregistry"
+	"github.com/filecoin-project/go-legs/metrics"
+	"github.com/filecoin-project/go-legs/throttle"
+	"github.com/ipfs/go-cid"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/discovery"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
 // config contains all options for configuring dtsync.publisher.
@@ -12,10 +21,71 @@ type config struct {
 	extraData []byte
 	topic     *pubsub.Topic
 	allowPeer func(peer.ID) bool
+	acl       *acl.List
+	discovery discovery.Discovery
+
+	validateRequest RequestValidatorFunc
+	throttle        throttle.Config
+
+	announceOnJoin    bool
+	announcePeers     []peer.AddrInfo
+	maxAnnounceSize   int
+	republishInterval time.Duration
+	serveHead         bool
+	headRegistry      *headregistry.Registry
+
+	allowRelay bool
+	dsPrefix   string
 }
 
 type Option func(*config) error
 
+// syncConfig contains all options for configuring a Sync.
+type syncConfig struct {
+	localBlockHook func(peer.ID, cid.Cid)
+	localCheck     LocalCheck
+	metrics        *metrics.Metrics
+
+	pauseOnRateLimit bool
+	pauseHook        PauseHookFunc
+
+	allowRelay bool
+
+	tracerProvider trace.TracerProvider
+}
+
+// LocalCheck is how a sync checks whether the DAG to sync is already stored
+// locally, in which case the sync completes without a data transfer.
+type LocalCheck int
+
+const (
+	// LocalCheckScope completes a sync without a data transfer if every
+	// block that the sync's selector reaches is stored locally. This is the
+	// default.
+	LocalCheckScope LocalCheck = iota
+	// LocalCheckHead completes a sync without a data transfer if the CID to
+	// sync is stored locally, without checking the blocks it links to. Only
+	// the CID to sync is passed to the block hook.
+	LocalCheckHead
+	// LocalCheckNone always transfers the DAG to sync from the publisher,
+	// for example to verify that the publisher serves it. Every block is
+	// fetched, even if it is stored locally, unless the datatransfer manager
+	// is shared with another Sync that stores syncs in separate link systems.
+	LocalCheckNone
+)
+
+// SyncOption is a function that sets a value in a syncConfig.
+type SyncOption func(*syncConfig)
+
+// getSyncOpts creates a syncConfig and applies SyncOptions to it.
+func getSyncOpts(opts []SyncOption) syncConfig {
+	var cfg syncConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
 // apply applies the given options to this config.
 func (c *config) apply(opts []Option) error {
 	for i, opt := range opts {
@@ -26,6 +96,27 @@ func (c *config) apply(opts []Option) error {
 	return nil
 }
 
+// validator returns the validator of the sync requests that the publisher of
+// the topic serves.
+func (c *config) validator(topic string, transfers *servedTransfers) *legsValidator {
+	return &legsValidator{
+		allowPeer:       c.allowPeer,
+		acl:             c.acl,
+		topic:           topic,
+		validateRequest: c.validateRequest,
+		transfers:       transfers,
+	}
+}
+
+// pubsubOpts returns the options for the pubsub that the publisher creates for
+// its topic.
+func (c *config) pubsubOpts() []pubsub.Option {
+	if c.discovery == nil {
+		return nil
+	}
+	return []pubsub.Option{pubsub.WithDiscovery(c.discovery)}
+}
+
 // WithExtraData sets the extra data to include in the pubsub message.
 func WithExtraData(data []byte) Option {
 	return func(c *config) error {
@@ -52,3 +143,278 @@ func AllowPeer(allowPeer func(peer.ID) bool) Option {
 		return nil
 	}
 }
+
+// WithACL sets the access control list of the peers that the publisher serves.
+// A peer is only served if it is allowed by both the list and AllowPeer. The
+// list can be changed while the publisher is running, and the changes apply
+// to the next requests.
+func WithACL(l *acl.List) Option {
+	return func(c *config) error {
+		c.acl = l
+		return nil
+	}
+}
+
+// WithAnnounceOnPeerJoin sets whether the publisher re-announces its current
+// root each time a peer joins the pubsub topic. This lets subscribers that
+// join after the last UpdateRoot learn the current head without waiting for
+// the next update.
+//
+// Pubsub suppresses messages identical to one published within its
+// seen-messages TTL, so a peer that joins soon after a previous re-announcement
+// receives the re-announcement once that TTL has expired.
+func WithAnnounceOnPeerJoin(enable bool) Option {
+	return func(c *config) error {
+		c.announceOnJoin = enable
+		return nil
+	}
+}
+
+// WithTopicDiscovery sets the discovery service that the publisher's pubsub
+// uses to advertise the publisher on the topic, and to find and connect to
+// subscribers on the topic. This cannot be used with Topic, since the publisher
+// must create the topic's pubsub.
+func WithTopicDiscovery(d discovery.Discovery) Option {
+	return func(c *config) error {
+		c.discovery = d
+		return nil
+	}
+}
+
+// WithDirectAnnounce sets subscribers that the publisher sends each
+// announcement to directly, over the announce.ProtocolID stream protocol for
+// the topic, in addition to publishing it on the pubsub topic. This reaches
+// subscribers that are not reachable over gossip pubsub. Subscribers must
+// enable handling of these streams. A failure to send to a subscriber is
+// logged, and does not fail the announcement.
+func WithDirectAnnounce(peers ...peer.AddrInfo) Option {
+	return func(c *config) error {
+		for _, pi := range peers {
+			if err := pi.ID.Validate(); err != nil {
+				return fmt.Errorf("bad direct announce peer: %w", err)
+			}
+		}
+		c.announcePeers = peers
+		return nil
+	}
+}
+
+// WithMaxAnnounceSize sets the largest pubsub message, in bytes, that the
+// publisher sends as an announcement. When an announcement would be larger,
+// the publisher stores an announcement record holding the announced CID,
+// addresses, extra data, and metadata, and announces the record's CID instead.
+// Subscribers fetch the record from the publisher. A value of zero, the
+// default, means announcements are always sent in full.
+func WithMaxAnnounceSize(size int) Option {
+	return func(c *config) error {
+		if size < 0 {
+			return fmt.Errorf("max announce size cannot be negative: %d", size)
+		}
+		c.maxAnnounceSize = size
+		return nil
+	}
+}
+
+// WithRepublishInterval sets how often the publisher re-announces its current
+// root on the pubsub topic, so that subscribers that joined late or missed an
+// announcement converge on the root without a manual sync. Pubsub drops
+// messages identical to one published within its seen-messages TTL, so
+// re-announcements are at least that far apart. A value of zero, the default,
+// disables periodic re-announcement.
+func WithRepublishInterval(interval time.Duration) Option {
+	return func(c *config) error {
+		if interval < 0 {
+			return fmt.Errorf("republish interval cannot be negative: %s", interval)
+		}
+		c.republishInterval = interval
+		return nil
+	}
+}
+
+// WithServeHead sets whether the publisher serves its head CID on its topic,
+// with the head protocol, so that subscribers can query the head with
+// head.QueryRootCid. The served head is updated with each SetRoot and
+// UpdateRoot, so it always agrees with what was last announced. This is
+// enabled by default. Disable it if the head is served separately.
+func WithServeHead(enable bool) Option {
+	return func(c *config) error {
+		c.serveHead = enable
+		return nil
+	}
+}
+
+// WithHeadRegistry registers the publisher with a registry that is shared by
+// publishers of the same DAG over other transports, such as an httpsync
+// publisher. Setting the root of any registered publisher then sets it on all
+// of them, so that each serves the same head. If the registry already has a
+// root, then the publisher starts with it. The publisher is removed from the
+// registry when it is closed.
+func WithHeadRegistry(r *headregistry.Registry) Option {
+	return func(c *config) error {
+		c.headRegistry = r
+		return nil
+	}
+}
+
+// WithRelay sets whether the publisher serves subscribers that it is only
+// connected to through a circuit relay. Graphsync and datatransfer open
+// streams to the subscriber to send responses, which libp2p does not allow
+// over a relayed connection unless this is enabled. Relays limit the time and
+// data of relayed connections, so a large sync may not complete over a relay.
+// This has no effect with NewPublisherFromExisting, since the datatransfer
+// manager is given. Disabled by default.
+func WithRelay(allow bool) Option {
+	return func(c *config) error {
+		c.allowRelay = allow
+		return nil
+	}
+}
+
+// WithDatastorePrefix puts the keys that datatransfer writes to the datastore
+// given to NewPublisher, to keep the state of its channels, under prefix, so
+// that they do not collide with application data in a shared datastore.
+func WithDatastorePrefix(prefix string) Option {
+	return func(c *config) error {
+		if prefix == "" {
+			return fmt.Errorf("datastore prefix cannot be empty")
+		}
+		c.dsPrefix = prefix
+		return nil
+	}
+}
+
+// WithRequestValidator sets a function that decides which sync requests the
+// publisher serves, by the requested root CID and selector. By default, the
+// publisher serves a request for any CID that it has, from any allowed peer.
+// Use this to keep the publisher from being used as a generic block server,
+// for example by only serving CIDs that are part of its own published chain.
+// Requests from peers rejected by AllowPeer are rejected before this is
+// called.
+func WithRequestValidator(validate RequestValidatorFunc) Option {
+	return func(c *config) error {
+		c.validateRequest = validate
+		return nil
+	}
+}
+
+// WithRequestRateLimit limits the rate of sync requests that the publisher
+// serves from each peer to limit requests per second, with bursts of up to
+// burst requests. A request over the limit is rejected. By default, the request
+// rate is not limited.
+func WithRequestRateLimit(limit rate.Limit, burst int) Option {
+	return func(c *config) error {
+		c.throttle.RequestRate = limit
+		c.throttle.RequestBurst = burst
+		return nil
+	}
+}
+
+// WithMaxConcurrentTransfers sets the maximum number of data transfers that
+// the publisher serves at a time, to all peers. A request received while that
+// many transfers are in progress is rejected. Zero, the default, is no limit.
+func WithMaxConcurrentTransfers(n int) Option {
+	return func(c *config) error {
+		if n < 0 {
+			return fmt.Errorf("max concurrent transfers cannot be negative: %d", n)
+		}
+		c.throttle.MaxConcurrent = n
+		return nil
+	}
+}
+
+// WithMaxBytesPerHour sets the maximum number of bytes that the publisher
+// sends to each peer in an hour. A transfer in progress is not stopped when a
+// peer reaches the limit, but the peer's requests are rejected until enough of
+// the hour has passed. Zero, the default, is no limit.
+func WithMaxBytesPerHour(n int64) Option {
+	return func(c *config) error {
+		if n < 0 {
+			return fmt.Errorf("max bytes per hour cannot be negative: %d", n)
+		}
+		c.throttle.MaxBytesPerHour = n
+		return nil
+	}
+}
+
+// WithThrottleHook sets a function that is called with the peer and the
+// reason each time the publisher rejects a request because of its request
+// rate, concurrency, or byte limits.
+func WithThrottleHook(hook func(peer.ID, throttle.Reason)) Option {
+	return func(c *config) error {
+		if hook == nil {
+			c.throttle.Hook = nil
+			return nil
+		}
+		c.throttle.Hook = func(client string, reason throttle.Reason) {
+			hook(peer.ID(client), reason)
+		}
+		return nil
+	}
+}
+
+// WithLocalBlockHook sets a function that is called, instead of the block
+// hook, for each block that a sync finds in the local link system rather than
+// transferring it from the publisher. If not set, the block hook is called for
+// those blocks.
+func WithLocalBlockHook(hook func(peer.ID, cid.Cid)) SyncOption {
+	return func(c *syncConfig) {
+		c.localBlockHook = hook
+	}
+}
+
+// WithLocalCheck sets how a sync checks whether the DAG to sync is already
+// stored locally. The default is LocalCheckScope.
+func WithLocalCheck(check LocalCheck) SyncOption {
+	return func(c *syncConfig) {
+		c.localCheck = check
+	}
+}
+
+// WithSyncMetrics sets the metrics that record the blocks and bytes that each
+// data transfer of a sync receives, and the syncs held back by rate limiting.
+func WithSyncMetrics(m *metrics.Metrics) SyncOption {
+	return func(c *syncConfig) {
+		c.metrics = m
+	}
+}
+
+// WithSyncRelay sets whether a sync is done with a publisher that the host is
+// only connected to through a circuit relay, which libp2p does not otherwise
+// allow. The publisher must also allow it, with WithRelay. With NewSyncWithDT,
+// this only applies to querying the publisher's head, since the datatransfer
+// manager is given. Disabled by default.
+func WithSyncRelay(allow bool) SyncOption {
+	return func(c *syncConfig) {
+		c.allowRelay = allow
+	}
+}
+
+// WithSyncTracerProvider sets the OpenTelemetry tracer provider that creates
+// the spans tracing each sync. The default is the global tracer provider.
+func WithSyncTracerProvider(tp trace.TracerProvider) SyncOption {
+	return func(c *syncConfig) {
+		c.tracerProvider = tp
+	}
+}
+
+// WithPauseOnRateLimit sets whether a sync that hits its rate limit pauses its
+// data transfer, instead of stopping the transfer and opening a new one from
+// the block that it stopped at. A paused transfer keeps its data channel open,
+// and is resumed once the rate limiter has a full burst of tokens, so no
+// blocks are sent again. If the publisher finishes sending while the transfer
+// is paused, then the sync is restarted, and the blocks already received are
+// found locally. Disabled by default.
+func WithPauseOnRateLimit(enable bool) SyncOption {
+	return func(c *syncConfig) {
+		c.pauseOnRateLimit = enable
+	}
+}
+
+// WithPauseHook sets a function that is called each time the data transfer of
+// a sync is paused or resumed, whether by the rate limiter or with
+// Sync.PauseTransfer and Sync.ResumeTransfer.
+func WithPauseHook(hook PauseHookFunc) SyncOption {
+	return func(c *syncConfig) {
+		c.pauseHook = hook
+	}
+}
@@ -5,20 +5,28 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net/http"
 	"sync"
 	"time"
 
 	dt "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-legs/announce"
 	"github.com/filecoin-project/go-legs/announce/gossiptopic"
+	"github.com/filecoin-project/go-legs/bsutil"
+	"github.com/filecoin-project/go-legs/headregistry"
 	"github.com/filecoin-project/go-legs/p2p/protocol/head"
+	"github.com/filecoin-project/go-legs/throttle"
 	"github.com/hashicorp/go-multierror"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
 	ma "github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
 )
 
 type publisher struct {
@@ -29,14 +37,60 @@ type publisher struct {
 	headPublisher *head.Publisher
 	host          host.Host
 	extraData     []byte
+	lsys          ipld.LinkSystem
 	topic         *pubsub.Topic
+
+	// unsubTransfers stops the tracking of the transfers counted by the
+	// publisher's throttle.
+	unsubTransfers dt.Unsubscribe
+
+	// announcePeers are the subscribers that announcements are sent to
+	// directly, in addition to the pubsub topic.
+	announcePeers []peer.AddrInfo
+	// maxAnnounceSize is the size above which an announcement record is
+	// announced in place of the full message.
+	maxAnnounceSize int
+
+	// addrs are the addresses included in the most recent announcement.
+	addrs []ma.Multiaddr
+	// metadata is the metadata included in the most recent announcement.
+	metadata ipld.Node
+	// lastReannounce is when the most recent re-announcement was published.
+	lastReannounce time.Time
+	// reannounceTimer is set when a re-announcement is scheduled.
+	reannounceTimer *time.Timer
+	// announceMutex protects addrs, lastReannounce, and reannounceTimer.
+	announceMutex sync.Mutex
+
+	// cancelReannounce stops the goroutines that re-announce the root when
+	// peers join the topic and periodically.
+	cancelReannounce context.CancelFunc
+	reannounceCtx    context.Context
+	reannounceWG     sync.WaitGroup
+
+	// registry, if not nil, sets the root on this and every other publisher
+	// registered with it. unregister removes this publisher from it.
+	registry   *headregistry.Registry
+	unregister func()
 }
 
 const shutdownTime = 5 * time.Second
 
+// recordLinkProto is the link prototype used to store announcement records.
+var recordLinkProto = cidlink.LinkPrototype{
+	Prefix: cid.Prefix{
+		Version:  1,
+		Codec:    uint64(multicodec.DagCbor),
+		MhType:   uint64(multicodec.Sha2_256),
+		MhLength: -1,
+	},
+}
+
 // NewPublisher creates a new legs publisher
 func NewPublisher(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem, topic string, options ...Option) (*publisher, error) {
-	cfg := config{}
+	cfg := config{
+		serveHead: true,
+	}
 	err := cfg.apply(options)
 	if err != nil {
 		return nil, err
@@ -45,53 +99,99 @@ func NewPublisher(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem, t
 	var cancelPubsub context.CancelFunc
 	t := cfg.topic
 	if t == nil {
-		t, cancelPubsub, err = gossiptopic.MakeTopic(host, topic)
+		t, cancelPubsub, err = gossiptopic.MakeTopic(host, topic, cfg.pubsubOpts()...)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	dtManager, _, dtClose, err := makeDataTransfer(host, ds, lsys, cfg.allowPeer)
+	if cfg.dsPrefix != "" {
+		ds = namespace.Wrap(ds, datastore.NewKey(cfg.dsPrefix))
+	}
+	transfers := newServedTransfers(throttle.New(cfg.throttle))
+	dtHost := relayableHost(host, cfg.allowRelay)
+	dtManager, _, dtClose, err := makeDataTransfer(dtHost, ds, lsys, cfg.validator(topic, transfers))
 	if err != nil {
 		if cancelPubsub != nil {
 			cancelPubsub()
 		}
 		return nil, err
 	}
+	var unsubTransfers dt.Unsubscribe
+	if transfers != nil {
+		unsubTransfers = dtManager.SubscribeToEvents(transfers.onEvent)
+	}
 
-	headPublisher := head.NewPublisher()
-	startHeadPublisher(host, topic, headPublisher)
+	headPublisher, err := startHeadPublisher(host, topic, cfg.serveHead)
+	if err != nil {
+		dtClose()
+		if cancelPubsub != nil {
+			cancelPubsub()
+		}
+		return nil, err
+	}
 
 	p := &publisher{
-		cancelPubSub:  cancelPubsub,
-		dtManager:     dtManager,
-		dtClose:       dtClose,
-		headPublisher: headPublisher,
-		host:          host,
-		topic:         t,
+		cancelPubSub:   cancelPubsub,
+		dtManager:      dtManager,
+		dtClose:        dtClose,
+		headPublisher:  headPublisher,
+		host:           host,
+		lsys:           lsys,
+		topic:          t,
+		unsubTransfers: unsubTransfers,
+
+		announcePeers:   cfg.announcePeers,
+		maxAnnounceSize: cfg.maxAnnounceSize,
 	}
 
 	if len(cfg.extraData) != 0 {
 		p.extraData = cfg.extraData
 	}
+
+	if err = p.register(cfg.headRegistry); err != nil {
+		p.Close()
+		return nil, err
+	}
+	if err = p.startReannounce(cfg.announceOnJoin, cfg.republishInterval); err != nil {
+		p.Close()
+		return nil, err
+	}
 	return p, nil
 }
 
-func startHeadPublisher(host host.Host, topic string, headPublisher *head.Publisher) {
-	go func() {
-		log.Infow("Starting head publisher for topic", "topic", topic, "host", host.ID())
-		err := headPublisher.Serve(host, topic)
-		if err != http.ErrServerClosed {
-			log.Errorw("Head publisher stopped serving on topic on host", "topic", topic, "host", host.ID(), "err", err)
-		}
-		log.Infow("Stopped head publisher", "host", host.ID(), "topic", topic)
-	}()
+// startHeadPublisher creates a head publisher that reports graphsync as its
+// sync protocol, and signs the head with the host's key. If serve is true, then
+// the head is served on topic before this returns, so that it can be queried as
+// soon as it is announced. The head publisher is used to track the root even
+// when it is not served.
+func startHeadPublisher(host host.Host, topic string, serve bool) (*head.Publisher, error) {
+	headPublisher := head.NewPublisher(
+		head.WithProtocols(head.ProtocolGraphsync),
+		head.WithSigningKey(host.Peerstore().PrivKey(host.ID())))
+	if !serve {
+		return headPublisher, nil
+	}
+	log.Infow("Starting head publisher for topic", "topic", topic, "host", host.ID())
+	if err := headPublisher.Start(host, topic); err != nil {
+		return nil, fmt.Errorf("cannot serve head: %w", err)
+	}
+	return headPublisher, nil
+}
+
+// NewPublisherWithBlockstore creates a new legs publisher, the same as
+// NewPublisher, that publishes blocks from the blockstore bs instead of from a
+// link system.
+func NewPublisherWithBlockstore(host host.Host, ds datastore.Batching, bs blockstore.Blockstore, topic string, options ...Option) (*publisher, error) {
+	return NewPublisher(host, ds, bsutil.LinkSystem(bs), topic, options...)
 }
 
 // NewPublisherFromExisting instantiates go-legs publishing on an existing
 // data transfer instance
 func NewPublisherFromExisting(dtManager dt.Manager, host host.Host, topic string, lsys ipld.LinkSystem, options ...Option) (*publisher, error) {
-	cfg := config{}
+	cfg := config{
+		serveHead: true,
+	}
 	err := cfg.apply(options)
 	if err != nil {
 		return nil, err
@@ -100,41 +200,214 @@ func NewPublisherFromExisting(dtManager dt.Manager, host host.Host, topic string
 	var cancelPubsub context.CancelFunc
 	t := cfg.topic
 	if t == nil {
-		t, cancelPubsub, err = gossiptopic.MakeTopic(host, topic)
+		t, cancelPubsub, err = gossiptopic.MakeTopic(host, topic, cfg.pubsubOpts()...)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	err = configureDataTransferForLegs(context.Background(), dtManager, lsys, cfg.allowPeer)
+	// Transfers are tracked before the validator is registered, so that
+	// every transfer that it allows is released when it ends.
+	transfers := newServedTransfers(throttle.New(cfg.throttle))
+	var unsubTransfers dt.Unsubscribe
+	if transfers != nil {
+		unsubTransfers = dtManager.SubscribeToEvents(transfers.onEvent)
+	}
+	err = configureDataTransferForLegs(context.Background(), dtManager, lsys, cfg.validator(topic, transfers))
 	if err != nil {
+		if unsubTransfers != nil {
+			unsubTransfers()
+		}
 		if cancelPubsub != nil {
 			cancelPubsub()
 		}
 		return nil, fmt.Errorf("cannot configure datatransfer: %w", err)
 	}
-	headPublisher := head.NewPublisher()
-	startHeadPublisher(host, topic, headPublisher)
+	headPublisher, err := startHeadPublisher(host, topic, cfg.serveHead)
+	if err != nil {
+		if unsubTransfers != nil {
+			unsubTransfers()
+		}
+		if cancelPubsub != nil {
+			cancelPubsub()
+		}
+		return nil, err
+	}
 
 	p := &publisher{
-		cancelPubSub:  cancelPubsub,
-		headPublisher: headPublisher,
-		host:          host,
-		topic:         t,
+		cancelPubSub:   cancelPubsub,
+		headPublisher:  headPublisher,
+		host:           host,
+		lsys:           lsys,
+		topic:          t,
+		unsubTransfers: unsubTransfers,
+
+		announcePeers:   cfg.announcePeers,
+		maxAnnounceSize: cfg.maxAnnounceSize,
 	}
 
 	if len(cfg.extraData) != 0 {
 		p.extraData = cfg.extraData
 	}
+
+	if err = p.register(cfg.headRegistry); err != nil {
+		p.Close()
+		return nil, err
+	}
+	if err = p.startReannounce(cfg.announceOnJoin, cfg.republishInterval); err != nil {
+		p.Close()
+		return nil, err
+	}
 	return p, nil
 }
 
+// startReannounce starts the goroutines that re-announce the current root
+// when a peer joins the topic, if onJoin is true, and every interval, if
+// interval is not zero.
+func (p *publisher) startReannounce(onJoin bool, interval time.Duration) error {
+	if !onJoin && interval == 0 {
+		return nil
+	}
+	p.reannounceCtx, p.cancelReannounce = context.WithCancel(context.Background())
+	if onJoin {
+		if err := p.watchPeerJoin(); err != nil {
+			return err
+		}
+	}
+	if interval != 0 {
+		p.reannounceWG.Add(1)
+		go p.republish(interval)
+	}
+	return nil
+}
+
+// republish schedules a re-announcement of the current root every interval,
+// so that subscribers that missed an announcement still learn the root.
+func (p *publisher) republish(interval time.Duration) {
+	defer p.reannounceWG.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.scheduleReannounce()
+		case <-p.reannounceCtx.Done():
+			return
+		}
+	}
+}
+
+// watchPeerJoin starts a goroutine that schedules a re-announcement of the
+// current root each time a peer joins the pubsub topic.
+func (p *publisher) watchPeerJoin() error {
+	evtHandler, err := p.topic.EventHandler()
+	if err != nil {
+		return fmt.Errorf("cannot get pubsub topic event handler: %w", err)
+	}
+
+	p.reannounceWG.Add(1)
+	go func() {
+		defer p.reannounceWG.Done()
+		defer evtHandler.Cancel()
+
+		for {
+			evt, err := evtHandler.NextPeerEvent(p.reannounceCtx)
+			if err != nil {
+				return
+			}
+			if evt.Type == pubsub.PeerJoin {
+				log.Debugw("Peer joined topic", "peer", evt.Peer)
+				p.scheduleReannounce()
+			}
+		}
+	}()
+	return nil
+}
+
+// scheduleReannounce schedules a re-announcement of the current root, unless
+// one is already scheduled. Pubsub drops messages identical to one published
+// within its seen-messages TTL, so if the root was re-announced more recently
+// than that the re-announcement is delayed until the TTL expires.
+func (p *publisher) scheduleReannounce() {
+	p.announceMutex.Lock()
+	defer p.announceMutex.Unlock()
+
+	if p.reannounceTimer != nil || p.reannounceCtx.Err() != nil {
+		return
+	}
+	delay := time.Until(p.lastReannounce.Add(pubsub.TimeCacheDuration))
+	if delay < 0 {
+		delay = 0
+	}
+	p.reannounceTimer = time.AfterFunc(delay, p.reannounce)
+}
+
+func (p *publisher) reannounce() {
+	p.announceMutex.Lock()
+	p.reannounceTimer = nil
+	addrs := p.addrs
+	metadata := p.metadata
+	p.announceMutex.Unlock()
+
+	root := p.headPublisher.Root()
+	if root == cid.Undef {
+		return
+	}
+	if addrs == nil {
+		addrs = p.host.Addrs()
+	}
+	log.Debugw("Re-announcing root to joined peers", "cid", root)
+	// The re-announcement names this host as the original publisher, so that
+	// it is not identical to, and dropped as a duplicate of, the announcement
+	// published by UpdateRoot.
+	if err := p.publish(p.reannounceCtx, root, addrs, metadata, p.host.ID().String()); err != nil {
+		log.Errorw("Failed to re-announce root", "err", err)
+		return
+	}
+	p.announceMutex.Lock()
+	p.lastReannounce = time.Now()
+	p.announceMutex.Unlock()
+}
+
+// register registers the publisher with the head registry, if not nil.
+func (p *publisher) register(registry *headregistry.Registry) error {
+	if registry == nil {
+		return nil
+	}
+	unregister, err := registry.Register(context.Background(), p.headPublisher.Root(), p.setRoot)
+	if err != nil {
+		return fmt.Errorf("cannot register with head registry: %w", err)
+	}
+	p.registry = registry
+	p.unregister = unregister
+	return nil
+}
+
+// SetRoot sets the root CID without publishing it. If the publisher is
+// registered with a head registry, then the root is set on every publisher in
+// the registry.
 func (p *publisher) SetRoot(ctx context.Context, c cid.Cid) error {
+	if c == cid.Undef {
+		return errors.New("cannot update to an undefined cid")
+	}
+	if p.registry != nil {
+		return p.registry.SetRoot(ctx, c)
+	}
+	return p.setRoot(ctx, c)
+}
+
+// setRoot sets the root CID of this publisher only.
+func (p *publisher) setRoot(ctx context.Context, c cid.Cid) error {
 	if c == cid.Undef {
 		return errors.New("cannot update to an undefined cid")
 	}
 	log.Debugf("Setting root CID: %s", c)
-	return p.headPublisher.UpdateRoot(ctx, c)
+	return p.headPublisher.SetRoot(ctx, c)
+}
+
+// Root returns the root CID that was last set, or cid.Undef if no root is set.
+func (p *publisher) Root() cid.Cid {
+	return p.headPublisher.Root()
 }
 
 func (p *publisher) UpdateRoot(ctx context.Context, c cid.Cid) error {
@@ -142,31 +415,124 @@ func (p *publisher) UpdateRoot(ctx context.Context, c cid.Cid) error {
 }
 
 func (p *publisher) UpdateRootWithAddrs(ctx context.Context, c cid.Cid, addrs []ma.Multiaddr) error {
+	return p.UpdateRootWithMetadata(ctx, c, addrs, nil)
+}
+
+// UpdateRootWithMetadata publishes an update for the DAG in the pubsub channel
+// using custom multiaddrs, and attaches the metadata node to the announcement.
+// The metadata, such as the chain height or content type, is delivered to
+// subscribers with the announcement, and is not part of the synced DAG. If the
+// announcement is larger than the max announce size, then the metadata is held
+// in the announcement record. It is also attached to re-announcements of the
+// root, until the next update. A nil metadata attaches none.
+func (p *publisher) UpdateRootWithMetadata(ctx context.Context, c cid.Cid, addrs []ma.Multiaddr, metadata ipld.Node) error {
 	err := p.SetRoot(ctx, c)
 	if err != nil {
 		return err
 	}
+	p.announceMutex.Lock()
+	p.addrs = addrs
+	p.metadata = metadata
+	p.announceMutex.Unlock()
+	return p.publish(ctx, c, addrs, metadata, "")
+}
+
+func (p *publisher) publish(ctx context.Context, c cid.Cid, addrs []ma.Multiaddr, metadata ipld.Node, origPeer string) error {
 	log.Debugf("Publishing CID and addresses in pubsub channel: %s", c)
 	msg := gossiptopic.Message{
 		Cid:       c,
 		ExtraData: p.extraData,
+		OrigPeer:  origPeer,
 	}
 	msg.SetAddrs(addrs)
+	if err := msg.SetMetadata(metadata); err != nil {
+		return err
+	}
 	buf := bytes.NewBuffer(nil)
 	if err := msg.MarshalCBOR(buf); err != nil {
 		return err
 	}
-	return p.topic.Publish(ctx, buf.Bytes())
+	if p.maxAnnounceSize != 0 && buf.Len() > p.maxAnnounceSize {
+		recMsg, err := p.storeRecord(ctx, msg)
+		if err != nil {
+			return err
+		}
+		buf.Reset()
+		if err = recMsg.MarshalCBOR(buf); err != nil {
+			return err
+		}
+		msg = recMsg
+	}
+	if err := p.topic.Publish(ctx, buf.Bytes()); err != nil {
+		return err
+	}
+	p.sendDirect(ctx, msg)
+	return nil
+}
+
+// sendDirect sends the announce message directly to each of the configured
+// subscribers, and waits for all sends to finish. Failures are only logged,
+// since the message was also published on the pubsub topic.
+func (p *publisher) sendDirect(ctx context.Context, msg gossiptopic.Message) {
+	var wg sync.WaitGroup
+	for _, pi := range p.announcePeers {
+		wg.Add(1)
+		go func(pi peer.AddrInfo) {
+			defer wg.Done()
+			if err := announce.Send(ctx, p.host, p.topic.String(), pi, msg); err != nil {
+				log.Errorw("Failed to send announcement directly to subscriber", "err", err, "peer", pi.ID)
+			}
+		}(pi)
+	}
+	wg.Wait()
+}
+
+// storeRecord stores the announcement record for msg, and returns a message
+// that announces the record in place of msg. The returned message keeps the
+// addresses so that subscribers can reach the publisher to fetch the record.
+// The metadata is only held in the record, since it may be what makes msg too
+// large.
+func (p *publisher) storeRecord(ctx context.Context, msg gossiptopic.Message) (gossiptopic.Message, error) {
+	lnk, err := p.lsys.Store(ipld.LinkContext{Ctx: ctx}, recordLinkProto, msg.RecordNode())
+	if err != nil {
+		return gossiptopic.Message{}, fmt.Errorf("cannot store announcement record: %w", err)
+	}
+	recCid := lnk.(cidlink.Link).Cid
+	log.Debugw("Announcing record in place of large announcement", "cid", msg.Cid, "record", recCid)
+	return gossiptopic.Message{
+		Cid:      recCid,
+		Addrs:    msg.Addrs,
+		OrigPeer: msg.OrigPeer,
+		IsRecord: true,
+	}, nil
 }
 
 func (p *publisher) Close() error {
 	var errs error
 	p.closeOnce.Do(func() {
+		if p.unregister != nil {
+			p.unregister()
+		}
+
+		if p.cancelReannounce != nil {
+			p.announceMutex.Lock()
+			p.cancelReannounce()
+			if p.reannounceTimer != nil {
+				p.reannounceTimer.Stop()
+			}
+			p.announceMutex.Unlock()
+			p.reannounceWG.Wait()
+		}
+
 		err := p.headPublisher.Close()
 		if err != nil {
 			errs = multierror.Append(errs, err)
 		}
 
+		if p.unsubTransfers != nil {
+			p.unsubTransfers()
+		}
+
 		if p.dtClose != nil {
 			err = p.dtClose()
 			if err != nil {
@@ -0,0 +1,507 @@
+package dtsync_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs/acl"
+	"github.com/filecoin-project/go-legs/announce"
+	"github.com/filecoin-project/go-legs/announce/gossiptopic"
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/p2p/protocol/head"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/filecoin-project/go-legs/throttle"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multicodec"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestPublisher_AnnouncesOnPeerJoin(t *testing.T) {
+	const topic = "fish"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rootCids, err := test.RandomCids(1)
+	require.NoError(t, err)
+	root := rootCids[0]
+
+	pubh, err := libp2p.New()
+	require.NoError(t, err)
+	pub, err := dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), cidlink.DefaultLinkSystem(), topic,
+		dtsync.WithAnnounceOnPeerJoin(true))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, pub.Close()) })
+
+	// Publish the root before any subscriber is listening.
+	require.NoError(t, pub.UpdateRoot(ctx, root))
+
+	subh, err := libp2p.New()
+	require.NoError(t, err)
+	subTopic, cancelPubsub, err := gossiptopic.MakeTopic(subh, topic)
+	require.NoError(t, err)
+	t.Cleanup(cancelPubsub)
+	sub, err := subTopic.Subscribe()
+	require.NoError(t, err)
+	t.Cleanup(sub.Cancel)
+
+	require.NoError(t, subh.Connect(ctx, peer.AddrInfo{ID: pubh.ID(), Addrs: pubh.Addrs()}))
+
+	// The publisher should re-announce its root once the subscriber joins.
+	msg, err := sub.Next(ctx)
+	require.NoError(t, err)
+	var m gossiptopic.Message
+	require.NoError(t, m.UnmarshalCBOR(bytes.NewBuffer(msg.Data)))
+	require.Equal(t, root, m.Cid)
+	require.Equal(t, pubh.ID().String(), m.OrigPeer)
+}
+
+func TestPublisher_ServesHead(t *testing.T) {
+	const topic = "fish"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rootCids, err := test.RandomCids(2)
+	require.NoError(t, err)
+
+	pubh, err := libp2p.New()
+	require.NoError(t, err)
+	subh, err := libp2p.New()
+	require.NoError(t, err)
+	subh.Peerstore().AddAddrs(pubh.ID(), pubh.Addrs(), time.Hour)
+
+	pub, err := dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), cidlink.DefaultLinkSystem(), topic)
+	require.NoError(t, err)
+
+	// The head is served as soon as the publisher is created, and agrees with
+	// each announcement.
+	for _, root := range rootCids {
+		require.NoError(t, pub.UpdateRoot(ctx, root))
+		got, err := head.QueryRootCid(ctx, subh, topic, pubh.ID())
+		require.NoError(t, err)
+		require.Equal(t, root, got)
+	}
+
+	md, err := head.QueryMetadata(ctx, subh, topic, pubh.ID())
+	require.NoError(t, err)
+	require.Equal(t, rootCids[1], md.Head)
+	require.Equal(t, []string{head.ProtocolGraphsync}, md.Protocols)
+	require.NotEmpty(t, md.Signature)
+	require.NoError(t, pub.Close())
+
+	// The head is not served when disabled.
+	pub, err = dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), cidlink.DefaultLinkSystem(), topic,
+		dtsync.WithServeHead(false))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, pub.Close()) })
+	require.NoError(t, pub.SetRoot(ctx, rootCids[0]))
+	_, err = head.QueryRootCid(ctx, subh, topic, pubh.ID())
+	require.Error(t, err)
+}
+
+func TestPublisher_Republishes(t *testing.T) {
+	const topic = "fish"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rootCids, err := test.RandomCids(1)
+	require.NoError(t, err)
+	root := rootCids[0]
+
+	pubh, err := libp2p.New()
+	require.NoError(t, err)
+	subh, err := libp2p.New()
+	require.NoError(t, err)
+
+	// Join the subscriber to the topic mesh before anything is announced, so
+	// that the first re-announcement is delivered rather than suppressing the
+	// next one for the pubsub seen-cache duration.
+	topics := test.WaitForMeshWithMessage(t, topic, pubh, subh)
+	sub, err := topics[1].Subscribe()
+	require.NoError(t, err)
+	t.Cleanup(sub.Cancel)
+
+	pub, err := dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), cidlink.DefaultLinkSystem(), topic,
+		dtsync.Topic(topics[0]), dtsync.WithRepublishInterval(100*time.Millisecond))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, pub.Close()) })
+
+	require.NoError(t, pub.UpdateRoot(ctx, root))
+
+	// The publisher periodically re-announces its root, naming itself as the
+	// original publisher.
+	for {
+		msg, err := sub.Next(ctx)
+		require.NoError(t, err)
+		var m gossiptopic.Message
+		require.NoError(t, m.UnmarshalCBOR(bytes.NewBuffer(msg.Data)))
+		require.Equal(t, root, m.Cid)
+		if m.OrigPeer == pubh.ID().String() {
+			break
+		}
+	}
+
+	_, err = dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), cidlink.DefaultLinkSystem(), topic,
+		dtsync.WithRepublishInterval(-time.Second))
+	require.Error(t, err)
+}
+
+func TestPublisher_DirectAnnounce(t *testing.T) {
+	const topic = "fish"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rootCids, err := test.RandomCids(1)
+	require.NoError(t, err)
+	root := rootCids[0]
+
+	// The subscriber is not connected to the publisher when the announcement
+	// is published, so receives it when it is sent directly.
+	subh, err := libp2p.New()
+	require.NoError(t, err)
+	rcvr, err := announce.NewReceiver(subh, topic, announce.WithStreamAnnounce(true))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, rcvr.Close()) })
+
+	pubh, err := libp2p.New()
+	require.NoError(t, err)
+	pub, err := dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), cidlink.DefaultLinkSystem(), topic,
+		dtsync.WithDirectAnnounce(peer.AddrInfo{ID: subh.ID(), Addrs: subh.Addrs()}))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, pub.Close()) })
+
+	require.NoError(t, pub.UpdateRoot(ctx, root))
+
+	amsg, err := rcvr.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, root, amsg.Cid)
+	require.Equal(t, pubh.ID(), amsg.PeerID)
+	require.Equal(t, announce.SourceStream, amsg.Source)
+
+	_, err = dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), cidlink.DefaultLinkSystem(), topic,
+		dtsync.WithDirectAnnounce(peer.AddrInfo{}))
+	require.Error(t, err)
+}
+
+func TestPublisher_AnnounceMetadata(t *testing.T) {
+	const topic = "fish"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rootCids, err := test.RandomCids(2)
+	require.NoError(t, err)
+
+	subh, err := libp2p.New()
+	require.NoError(t, err)
+	rcvr, err := announce.NewReceiver(subh, topic, announce.WithStreamAnnounce(true))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, rcvr.Close()) })
+
+	pubh, err := libp2p.New()
+	require.NoError(t, err)
+	pub, err := dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), cidlink.DefaultLinkSystem(), topic,
+		dtsync.WithDirectAnnounce(peer.AddrInfo{ID: subh.ID(), Addrs: subh.Addrs()}))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, pub.Close()) })
+
+	metadata := fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(na fluent.MapAssembler) {
+		na.AssembleEntry("height").AssignInt(42)
+		na.AssembleEntry("contentType").AssignString("application/json")
+	})
+	require.NoError(t, pub.UpdateRootWithMetadata(ctx, rootCids[0], pubh.Addrs(), metadata))
+
+	amsg, err := rcvr.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, rootCids[0], amsg.Cid)
+	require.True(t, ipld.DeepEqual(metadata, amsg.Metadata))
+
+	// An update without metadata announces none.
+	require.NoError(t, pub.UpdateRoot(ctx, rootCids[1]))
+	amsg, err = rcvr.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, rootCids[1], amsg.Cid)
+	require.Nil(t, amsg.Metadata)
+}
+
+func TestPublisher_AnnounceLargeMetadata(t *testing.T) {
+	const topic = "fish"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rootCids, err := test.RandomCids(1)
+	require.NoError(t, err)
+
+	subh, err := libp2p.New()
+	require.NoError(t, err)
+	rcvr, err := announce.NewReceiver(subh, topic, announce.WithStreamAnnounce(true))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, rcvr.Close()) })
+
+	pubLs := cidlink.DefaultLinkSystem()
+	pubStore := &memstore.Store{}
+	pubLs.SetReadStorage(pubStore)
+	pubLs.SetWriteStorage(pubStore)
+	pubh, err := libp2p.New()
+	require.NoError(t, err)
+	pub, err := dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), pubLs, topic,
+		dtsync.WithDirectAnnounce(peer.AddrInfo{ID: subh.ID(), Addrs: subh.Addrs()}),
+		dtsync.WithMaxAnnounceSize(256))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, pub.Close()) })
+
+	// Metadata that is larger than the max announce size is held in the
+	// announcement record, and not sent with the announcement.
+	metadata := fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("padding").AssignBytes(make([]byte, 1024))
+	})
+	require.NoError(t, pub.UpdateRootWithMetadata(ctx, rootCids[0], pubh.Addrs(), metadata))
+
+	amsg, err := rcvr.Next(ctx)
+	require.NoError(t, err)
+	require.True(t, amsg.IsRecord)
+	require.Nil(t, amsg.Metadata)
+
+	n, err := pubLs.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: amsg.Cid}, basicnode.Prototype.Any)
+	require.NoError(t, err)
+	msg, err := gossiptopic.MessageFromRecord(n)
+	require.NoError(t, err)
+	require.Equal(t, rootCids[0], msg.Cid)
+	recMetadata, err := msg.GetMetadata()
+	require.NoError(t, err)
+	require.True(t, ipld.DeepEqual(metadata, recMetadata))
+}
+
+func TestPublisher_RequestValidator(t *testing.T) {
+	const topic = "fish"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pubLs := cidlink.DefaultLinkSystem()
+	pubStore := &memstore.Store{}
+	pubLs.SetReadStorage(pubStore)
+	pubLs.SetWriteStorage(pubStore)
+	lp := cidlink.LinkPrototype{
+		Prefix: cid.Prefix{
+			Version:  1,
+			Codec:    uint64(multicodec.DagJson),
+			MhType:   uint64(multicodec.Sha2_256),
+			MhLength: -1,
+		},
+	}
+	var served, other cid.Cid
+	for i, c := range []*cid.Cid{&served, &other} {
+		lnk, err := pubLs.Store(ipld.LinkContext{Ctx: ctx}, lp, fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+			na.AssembleEntry("fish").AssignInt(int64(i))
+		}))
+		require.NoError(t, err)
+		*c = lnk.(cidlink.Link).Cid
+	}
+
+	subh, err := libp2p.New()
+	require.NoError(t, err)
+	var requester peer.ID
+	var mutex sync.Mutex
+	validate := func(peerID peer.ID, root cid.Cid, selector ipld.Node) error {
+		mutex.Lock()
+		requester = peerID
+		mutex.Unlock()
+		require.NotNil(t, selector)
+		if root != served {
+			return errors.New("not published")
+		}
+		return nil
+	}
+
+	// Only serve the published CID.
+	pubh, err := libp2p.New()
+	require.NoError(t, err)
+	pub, err := dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), pubLs, topic,
+		dtsync.WithRequestValidator(validate))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, pub.Close()) })
+
+	subLs := cidlink.DefaultLinkSystem()
+	subStore := &memstore.Store{}
+	subLs.SetReadStorage(subStore)
+	subLs.SetWriteStorage(subStore)
+	subject, err := dtsync.NewSync(subh, dssync.MutexWrap(datastore.NewMapDatastore()), subLs, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+	syncer := subject.NewSyncerWithAddrs(pubh.ID(), topic, nil, pubh.Addrs())
+
+	require.Error(t, syncer.Sync(ctx, other, selectorparse.CommonSelector_ExploreAllRecursively))
+	mutex.Lock()
+	require.Equal(t, subh.ID(), requester)
+	mutex.Unlock()
+	has, err := subStore.Has(ctx, cidlink.Link{Cid: other}.Binary())
+	require.NoError(t, err)
+	require.False(t, has)
+
+	require.NoError(t, syncer.Sync(ctx, served, selectorparse.CommonSelector_ExploreAllRecursively))
+	has, err = subStore.Has(ctx, cidlink.Link{Cid: served}.Binary())
+	require.NoError(t, err)
+	require.True(t, has)
+}
+
+func TestPublisher_Throttle(t *testing.T) {
+	const topic = "fish"
+
+	tests := []struct {
+		name string
+		opts []dtsync.Option
+		// throttled is the reason that a repeated sync is rejected, or empty
+		// if repeated syncs are served.
+		throttled throttle.Reason
+	}{
+		{
+			name:      "request rate",
+			opts:      []dtsync.Option{dtsync.WithRequestRateLimit(rate.Every(time.Hour), 1)},
+			throttled: throttle.RequestRate,
+		},
+		{
+			name:      "bytes per hour",
+			opts:      []dtsync.Option{dtsync.WithMaxBytesPerHour(1)},
+			throttled: throttle.Bytes,
+		},
+		{
+			name: "concurrent transfers",
+			opts: []dtsync.Option{dtsync.WithMaxConcurrentTransfers(1)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			pubLs := cidlink.DefaultLinkSystem()
+			pubStore := &memstore.Store{}
+			pubLs.SetReadStorage(pubStore)
+			pubLs.SetWriteStorage(pubStore)
+			lnk, err := pubLs.Store(ipld.LinkContext{Ctx: ctx}, cidlink.LinkPrototype{
+				Prefix: cid.Prefix{
+					Version:  1,
+					Codec:    uint64(multicodec.DagJson),
+					MhType:   uint64(multicodec.Sha2_256),
+					MhLength: -1,
+				},
+			}, basicnode.NewString("fish"))
+			require.NoError(t, err)
+			c := lnk.(cidlink.Link).Cid
+
+			subh, err := libp2p.New()
+			require.NoError(t, err)
+			var reasons []throttle.Reason
+			var mutex sync.Mutex
+			hook := func(peerID peer.ID, reason throttle.Reason) {
+				require.Equal(t, subh.ID(), peerID)
+				mutex.Lock()
+				reasons = append(reasons, reason)
+				mutex.Unlock()
+			}
+
+			pubh, err := libp2p.New()
+			require.NoError(t, err)
+			pub, err := dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), pubLs, topic,
+				append(tt.opts, dtsync.WithThrottleHook(hook))...)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, pub.Close()) })
+
+			// Always fetch from the publisher, so that every sync is a request.
+			subLs := cidlink.DefaultLinkSystem()
+			subStore := &memstore.Store{}
+			subLs.SetReadStorage(subStore)
+			subLs.SetWriteStorage(subStore)
+			subject, err := dtsync.NewSync(subh, dssync.MutexWrap(datastore.NewMapDatastore()), subLs, nil,
+				dtsync.WithLocalCheck(dtsync.LocalCheckNone))
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, subject.Close()) })
+			syncer := subject.NewSyncerWithAddrs(pubh.ID(), topic, nil, pubh.Addrs())
+
+			require.NoError(t, syncer.Sync(ctx, c, selectorparse.CommonSelector_ExploreAllRecursively))
+
+			// The publisher counts a transfer until it has seen it end, which
+			// can be after the sync has finished.
+			if tt.throttled == "" {
+				for i := 0; i < 3; i++ {
+					require.Eventually(t, func() bool {
+						return syncer.Sync(ctx, c, selectorparse.CommonSelector_ExploreAllRecursively) == nil
+					}, 5*time.Second, 50*time.Millisecond)
+				}
+				mutex.Lock()
+				defer mutex.Unlock()
+				require.Empty(t, reasons)
+				return
+			}
+			require.Eventually(t, func() bool {
+				return syncer.Sync(ctx, c, selectorparse.CommonSelector_ExploreAllRecursively) != nil
+			}, 5*time.Second, 50*time.Millisecond)
+			mutex.Lock()
+			defer mutex.Unlock()
+			require.Contains(t, reasons, tt.throttled)
+		})
+	}
+}
+
+func TestPublisher_ACL(t *testing.T) {
+	const topic = "fish"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pubLs := cidlink.DefaultLinkSystem()
+	pubStore := &memstore.Store{}
+	pubLs.SetReadStorage(pubStore)
+	pubLs.SetWriteStorage(pubStore)
+	lnk, err := pubLs.Store(ipld.LinkContext{Ctx: ctx}, cidlink.LinkPrototype{
+		Prefix: cid.Prefix{
+			Version:  1,
+			Codec:    uint64(multicodec.DagJson),
+			MhType:   uint64(multicodec.Sha2_256),
+			MhLength: -1,
+		},
+	}, basicnode.NewString("fish"))
+	require.NoError(t, err)
+	c := lnk.(cidlink.Link).Cid
+
+	subh, err := libp2p.New()
+	require.NoError(t, err)
+	list := acl.New()
+	list.DenyPeer(subh.ID())
+
+	pubh, err := libp2p.New()
+	require.NoError(t, err)
+	pub, err := dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), pubLs, topic, dtsync.WithACL(list))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, pub.Close()) })
+
+	subLs := cidlink.DefaultLinkSystem()
+	subStore := &memstore.Store{}
+	subLs.SetReadStorage(subStore)
+	subLs.SetWriteStorage(subStore)
+	subject, err := dtsync.NewSync(subh, dssync.MutexWrap(datastore.NewMapDatastore()), subLs, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+	syncer := subject.NewSyncerWithAddrs(pubh.ID(), topic, nil, pubh.Addrs())
+
+	require.Error(t, syncer.Sync(ctx, c, selectorparse.CommonSelector_ExploreAllRecursively))
+
+	// The list applies to requests made after it is changed.
+	list.RemovePeer(subh.ID())
+	require.NoError(t, syncer.Sync(ctx, c, selectorparse.CommonSelector_ExploreAllRecursively))
+	has, err := subStore.Has(ctx, lnk.Binary())
+	require.NoError(t, err)
+	require.True(t, has)
+}
@@ -0,0 +1,37 @@
+package dtsync
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitDelay returns how long a sync that hit the rate limit must wait
+// before resuming its transfer. The token for the block that hit the limit is
+// reserved, since that block was still fetched. The wait lasts until the
+// limiter holds a full burst of tokens. See: burstDelay.
+func rateLimitDelay(limiter *rate.Limiter, now time.Time) (time.Duration, error) {
+	r := limiter.ReserveN(now, 1)
+	if !r.OK() {
+		return 0, errors.New("rate limiter does not allow any blocks")
+	}
+	delay := r.DelayFrom(now)
+	if d := burstDelay(limiter, now); d > delay {
+		delay = d
+	}
+	return delay, nil
+}
+
+// burstDelay returns how long until the limiter holds a full burst of tokens,
+// without consuming them. Waiting for a full burst keeps a resumed transfer
+// from being stopped by the limiter again right away, which would restart or
+// pause the transfer for every block.
+func burstDelay(limiter *rate.Limiter, now time.Time) time.Duration {
+	r := limiter.ReserveN(now, limiter.Burst())
+	if !r.OK() {
+		return 0
+	}
+	defer r.CancelAt(now)
+	return r.DelayFrom(now)
+}
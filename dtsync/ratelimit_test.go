@@ -0,0 +1,37 @@
+package dtsync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestRateLimitDelay(t *testing.T) {
+	now := time.Now()
+	limiter := rate.NewLimiter(rate.Every(100*time.Millisecond), 5)
+	require.True(t, limiter.AllowN(now, 5))
+
+	// With an empty bucket, the wait is until a full burst is refilled after
+	// the token of the limited block is taken.
+	delay, err := rateLimitDelay(limiter, now)
+	require.NoError(t, err)
+	require.Equal(t, 600*time.Millisecond, delay)
+
+	// The full burst is not consumed, only the limited block's token.
+	later := now.Add(delay)
+	require.False(t, limiter.AllowN(later.Add(-time.Millisecond), 5))
+	require.True(t, limiter.AllowN(later, 5))
+
+	// A bucket with tokens left only waits for the tokens it is missing.
+	limiter = rate.NewLimiter(rate.Every(100*time.Millisecond), 5)
+	require.True(t, limiter.AllowN(now, 3))
+	delay, err = rateLimitDelay(limiter, now)
+	require.NoError(t, err)
+	require.Equal(t, 400*time.Millisecond, delay)
+
+	// A limiter that allows no blocks cannot be waited on.
+	_, err = rateLimitDelay(rate.NewLimiter(0, 0), now)
+	require.Error(t, err)
+}
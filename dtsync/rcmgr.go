@@ -0,0 +1,127 @@
+package dtsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+)
+
+// ResourceService is the name of the libp2p resource manager service that the
+// graphsync and datatransfer streams of dtsync are scoped under. Limits for the
+// service are set in the host's resource manager. See: AddServiceLimit.
+const ResourceService = "legs"
+
+var (
+	// DefaultServiceBaseLimit is a base limit for ResourceService, suitable
+	// for use with AddServiceLimit.
+	DefaultServiceBaseLimit = rcmgr.BaseLimit{
+		Streams:         256,
+		StreamsInbound:  128,
+		StreamsOutbound: 128,
+		Memory:          64 << 20,
+	}
+	// DefaultServiceLimitIncrease is the increase of the limit for
+	// ResourceService, per GiB of memory allowed to the resource manager,
+	// suitable for use with AddServiceLimit.
+	DefaultServiceLimitIncrease = rcmgr.BaseLimitIncrease{
+		Streams:         256,
+		StreamsInbound:  128,
+		StreamsOutbound: 128,
+		Memory:          64 << 20,
+	}
+)
+
+// AddServiceLimit sets the limits of ResourceService in the scaling limit
+// configuration of a resource manager. The configuration is used when creating
+// the resource manager for a host.
+func AddServiceLimit(cfg *rcmgr.ScalingLimitConfig, base rcmgr.BaseLimit, inc rcmgr.BaseLimitIncrease) {
+	cfg.AddServiceLimit(ResourceService, base, inc)
+}
+
+// ResourceLimitError is returned when a sync fails because a libp2p resource
+// limit was exceeded, either by this host or by the publisher. The sync may
+// succeed if retried once resources are released.
+type ResourceLimitError struct {
+	msg string
+}
+
+func (e ResourceLimitError) Error() string { return e.msg }
+
+// Unwrap returns network.ErrResourceLimitExceeded.
+func (e ResourceLimitError) Unwrap() error { return network.ErrResourceLimitExceeded }
+
+// Temporary returns true, since the sync can be retried.
+func (e ResourceLimitError) Temporary() bool { return true }
+
+// isResourceLimitMsg returns true if the message of a data transfer event or
+// failed channel is due to exceeding a resource limit. Data transfer reports
+// these errors only as messages, so they cannot be matched with errors.Is.
+func isResourceLimitMsg(msg string) bool {
+	return strings.Contains(msg, network.ErrResourceLimitExceeded.Error())
+}
+
+// resourceLimitErr returns a ResourceLimitError if err wraps
+// network.ErrResourceLimitExceeded, otherwise it returns err.
+func resourceLimitErr(err error) error {
+	if errors.Is(err, network.ErrResourceLimitExceeded) {
+		return ResourceLimitError{err.Error()}
+	}
+	return err
+}
+
+// scopedHost is a host that scopes all streams under ResourceService, so that
+// the streams opened and handled by graphsync and datatransfer are subject to
+// the limits of that service.
+type scopedHost struct {
+	host.Host
+}
+
+// scopeHost returns a host that scopes streams under ResourceService, or
+// returns h unchanged if it does not have a resource manager.
+func scopeHost(h host.Host) host.Host {
+	if h.Network().ResourceManager() == network.NullResourceManager {
+		return h
+	}
+	return &scopedHost{h}
+}
+
+func (h *scopedHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	s, err := h.Host.NewStream(ctx, p, pids...)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.Scope().SetService(ResourceService); err != nil {
+		s.Reset()
+		return nil, fmt.Errorf("cannot attach stream to %s service: %w", ResourceService, err)
+	}
+	return s, nil
+}
+
+func (h *scopedHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	h.Host.SetStreamHandler(pid, scopeHandler(handler))
+}
+
+func (h *scopedHost) SetStreamHandlerMatch(pid protocol.ID, match func(string) bool, handler network.StreamHandler) {
+	h.Host.SetStreamHandlerMatch(pid, match, scopeHandler(handler))
+}
+
+// scopeHandler returns a stream handler that attaches each incoming stream to
+// ResourceService before passing it to handler. Streams that would exceed the
+// service's limits are reset.
+func scopeHandler(handler network.StreamHandler) network.StreamHandler {
+	return func(s network.Stream) {
+		if err := s.Scope().SetService(ResourceService); err != nil {
+			log.Warnw("Resetting incoming stream", "err", err, "service", ResourceService, "peer", s.Conn().RemotePeer())
+			s.Reset()
+			return
+		}
+		handler(s)
+	}
+}
@@ -0,0 +1,40 @@
+package dtsync
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// relayReason is the reason given to libp2p for using a transient connection,
+// such as a connection through a circuit relay.
+const relayReason = "go-legs dtsync"
+
+// relayHost is a host that opens streams over transient connections, so that
+// graphsync and datatransfer can exchange messages with a peer that the host
+// is only connected to through a circuit relay. Graphsync and datatransfer
+// open streams in both directions, so both the publisher and the subscriber
+// must allow this.
+type relayHost struct {
+	host.Host
+}
+
+func (h *relayHost) Connect(ctx context.Context, pi peer.AddrInfo) error {
+	return h.Host.Connect(network.WithUseTransient(ctx, relayReason), pi)
+}
+
+func (h *relayHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	return h.Host.NewStream(network.WithUseTransient(ctx, relayReason), p, pids...)
+}
+
+// relayableHost returns h as a relayHost if allow is true, and otherwise
+// returns h unchanged.
+func relayableHost(h host.Host, allow bool) host.Host {
+	if !allow {
+		return h
+	}
+	return &relayHost{h}
+}
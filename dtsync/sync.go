@@ -1,27 +1,43 @@
 package dtsync
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
 	"sync"
 
 	dt "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-legs/bsutil"
+	"github.com/filecoin-project/go-legs/internal/tracing"
+	"github.com/filecoin-project/go-legs/metrics"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-graphsync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/time/rate"
 )
 
 var log = logging.Logger("go-legs-dtsync")
 
+// tracerName names the tracer that creates the spans that trace syncs. The
+// data transfer started by a sync is traced in a child span, by data transfer
+// and graphsync.
+const tracerName = "go-legs-dtsync"
+
 const hitRateLimitErrStr = "hitRateLimit"
 
+// ErrContentNotFound is returned, wrapped, when a sync fails because the
+// publisher does not have the requested content.
+var ErrContentNotFound = errors.New("content not found")
+
 type inProgressSyncKey struct {
 	c    cid.Cid
 	peer peer.ID
@@ -41,41 +57,102 @@ type Sync struct {
 	// 1. via graphsync hook registered here for blocks that are not found locally.
 	// 2. via Syncer.signalLocallyFoundCids for blockhooks thar are found locally.
 	blockHook func(peer.ID, cid.Cid)
+	// localBlockHook, if not nil, is called instead of blockHook for blocks
+	// that are found locally.
+	localBlockHook func(peer.ID, cid.Cid)
+	// localCheck is how a sync checks whether the DAG to sync is already
+	// stored locally.
+	localCheck LocalCheck
+
+	metrics *metrics.Metrics
+	tracer  trace.Tracer
 
 	// Map of CID of in-progress sync to sync done channel.
 	syncDoneChans map[inProgressSyncKey]chan<- error
 	syncDoneMutex sync.Mutex
 
 	rateLimiters map[peer.ID]*rate.Limiter
-	rateMutex    sync.Mutex
+	// transfers maps each peer to the data transfer of its sync in progress.
+	transfers map[peer.ID]*transfer
+	rateMutex sync.Mutex
+	// pauseOnRateLimit is true if a rate limited transfer is paused, instead
+	// of stopped and restarted.
+	pauseOnRateLimit bool
+	// pauseHook is called when a transfer is paused or resumed.
+	pauseHook PauseHookFunc
+
+	// stores maps the voucher of a sync to the link system that the sync
+	// stores blocks in, for syncs that do not use the Sync's link system.
+	stores sync.Map
+	// storesEnabled is true if the transport can be configured to store the
+	// blocks of a sync in a separate link system.
+	storesEnabled bool
+
+	// peerVersions maps each publisher to the ProtocolVersion that it reported
+	// in its latest sync.
+	peerVersions sync.Map
+
+	// closeWG tracks the closing of the data channels of syncs that were
+	// canceled or failed, so that Close waits for them. No more channels are
+	// closed once closed is set.
+	closeWG    sync.WaitGroup
+	closed     bool
+	closeMutex sync.Mutex
+}
+
+// storeConfigurable is a datatransfer transport that can store the blocks of
+// a data channel in a separate link system.
+type storeConfigurable interface {
+	UseStore(dt.ChannelID, ipld.LinkSystem) error
 }
 
 // NewSyncWithDT creates a new Sync with a datatransfer.Manager provided by the
 // caller.
-func NewSyncWithDT(host host.Host, dtManager dt.Manager, gs graphsync.GraphExchange, ls *ipld.LinkSystem, blockHook func(peer.ID, cid.Cid)) (*Sync, error) {
+func NewSyncWithDT(host host.Host, dtManager dt.Manager, gs graphsync.GraphExchange, ls *ipld.LinkSystem, blockHook func(peer.ID, cid.Cid), options ...SyncOption) (*Sync, error) {
+	cfg := getSyncOpts(options)
+
 	err := registerVoucher(dtManager, &Voucher{}, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	s := &Sync{
-		host:         host,
+		host:         relayableHost(host, cfg.allowRelay),
 		dtManager:    dtManager,
 		ls:           ls,
 		rateLimiters: map[peer.ID]*rate.Limiter{},
+		transfers:    make(map[peer.ID]*transfer),
 		blockHook:    blockHook,
+		metrics:      cfg.metrics,
+		tracer:       tracing.Tracer(cfg.tracerProvider, tracerName),
+
+		localBlockHook: cfg.localBlockHook,
+		localCheck:     cfg.localCheck,
+
+		pauseOnRateLimit: cfg.pauseOnRateLimit,
+		pauseHook:        cfg.pauseHook,
 	}
 
 	if blockHook != nil {
-		s.unregHook = gs.RegisterIncomingBlockHook(s.addRateLimiting(addIncomingBlockHook(nil, blockHook), s.getRateLimiter, gs))
+		s.unregHook = gs.RegisterIncomingBlockHook(s.addRateLimiting(addIncomingBlockHook(nil, blockHook, cfg.localBlockHook), s.getRateLimiter, gs))
 	}
 
+	s.registerStoreConfigurer()
 	s.unsubEvents = dtManager.SubscribeToEvents(s.onEvent)
 	return s, nil
 }
 
+// NewSyncWithBlockstore creates a new Sync, the same as NewSync, that stores
+// synced blocks in the blockstore bs instead of in a link system.
+func NewSyncWithBlockstore(host host.Host, ds datastore.Batching, bs blockstore.Blockstore, blockHook func(peer.ID, cid.Cid), options ...SyncOption) (*Sync, error) {
+	return NewSync(host, ds, bsutil.LinkSystem(bs), blockHook, options...)
+}
+
 // NewSync creates a new Sync with its own datatransfer.Manager.
-func NewSync(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem, blockHook func(peer.ID, cid.Cid)) (*Sync, error) {
+func NewSync(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem, blockHook func(peer.ID, cid.Cid), options ...SyncOption) (*Sync, error) {
+	cfg := getSyncOpts(options)
+
+	host = relayableHost(host, cfg.allowRelay)
 	dtManager, gs, dtClose, err := makeDataTransfer(host, ds, lsys, nil)
 	if err != nil {
 		return nil, err
@@ -87,17 +164,61 @@ func NewSync(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem, blockH
 		ls:           &lsys,
 		dtClose:      dtClose,
 		rateLimiters: make(map[peer.ID]*rate.Limiter),
+		transfers:    make(map[peer.ID]*transfer),
 		blockHook:    blockHook,
+		metrics:      cfg.metrics,
+		tracer:       tracing.Tracer(cfg.tracerProvider, tracerName),
+
+		localBlockHook: cfg.localBlockHook,
+		localCheck:     cfg.localCheck,
+
+		pauseOnRateLimit: cfg.pauseOnRateLimit,
+		pauseHook:        cfg.pauseHook,
 	}
 
 	if blockHook != nil {
-		s.unregHook = gs.RegisterIncomingBlockHook(s.addRateLimiting(addIncomingBlockHook(nil, blockHook), s.getRateLimiter, gs))
+		s.unregHook = gs.RegisterIncomingBlockHook(s.addRateLimiting(addIncomingBlockHook(nil, blockHook, cfg.localBlockHook), s.getRateLimiter, gs))
 	}
 
+	s.registerStoreConfigurer()
 	s.unsubEvents = dtManager.SubscribeToEvents(s.onEvent)
 	return s, nil
 }
 
+// registerStoreConfigurer registers a transport configurer that makes the data
+// channel of a sync store blocks in the sync's own link system. This fails if
+// another Sync using the same datatransfer.Manager registered one first, in
+// which case syncs to a separate link system are not supported.
+func (s *Sync) registerStoreConfigurer() {
+	err := s.dtManager.RegisterTransportConfigurer(&Voucher{}, s.configureStore)
+	if err != nil {
+		log.Warnw("Cannot register transport configurer; syncing to a separate link system is not supported", "err", err)
+		return
+	}
+	s.storesEnabled = true
+}
+
+// configureStore configures the transport of a data channel to store blocks
+// in a separate link system, if one is set for the channel's voucher.
+func (s *Sync) configureStore(chid dt.ChannelID, voucher dt.Voucher, transport dt.Transport) {
+	v, ok := voucher.(*Voucher)
+	if !ok {
+		return
+	}
+	lsys, ok := s.stores.Load(v)
+	if !ok {
+		return
+	}
+	sc, ok := transport.(storeConfigurable)
+	if !ok {
+		log.Errorw("Datatransfer transport cannot store blocks in a separate link system", "channel", chid)
+		return
+	}
+	if err := sc.UseStore(chid, lsys.(ipld.LinkSystem)); err != nil {
+		log.Errorw("Cannot store blocks in a separate link system", "err", err, "channel", chid)
+	}
+}
+
 func (s *Sync) clearRateLimiter(peerID peer.ID) {
 	s.rateMutex.Lock()
 	delete(s.rateLimiters, peerID)
@@ -124,6 +245,30 @@ func (s *Sync) addRateLimiting(bFn graphsync.OnIncomingBlockHook, rateLimiter fu
 		if !isLocalBlock {
 			limiter := rateLimiter(p)
 			if limiter != nil && !limiter.Allow() {
+				if t := s.getTransfer(p); t != nil && s.pauseOnRateLimit {
+					// Keep the block, and pause the transfer until the rate
+					// limiter has tokens again. The block still takes a
+					// token. A transfer whose response is complete is not
+					// paused, since the responder has no more blocks to send
+					// and cannot resume it.
+					//
+					// The transfer is paused before this hook returns, so
+					// that the pause takes effect at this block. A pause
+					// that is still pending when the transfer is resumed
+					// would stop the transfer for good.
+					limiter.Reserve()
+					if !responseData.Status().IsTerminal() {
+						if err := t.setRateLimited(context.Background(), true); err != nil {
+							log.Warnw("Cannot pause rate limited transfer", "err", err, "peer", p)
+						} else {
+							t.signalLimited()
+						}
+					}
+					if bFn != nil {
+						bFn(p, responseData, blockData, hookActions)
+					}
+					return
+				}
 				// We've hit a rate limit. We'll terminate this sync with a rate limit
 				// err along with the cid of the block that we didn't process. When we
 				// restart the sync after the rate limit we should continue from this
@@ -139,9 +284,14 @@ func (s *Sync) addRateLimiting(bFn graphsync.OnIncomingBlockHook, rateLimiter fu
 	}
 }
 
-func addIncomingBlockHook(bFn graphsync.OnIncomingBlockHook, blockHook func(peer.ID, cid.Cid)) graphsync.OnIncomingBlockHook {
+func addIncomingBlockHook(bFn graphsync.OnIncomingBlockHook, blockHook, localBlockHook func(peer.ID, cid.Cid)) graphsync.OnIncomingBlockHook {
 	return func(p peer.ID, responseData graphsync.ResponseData, blockData graphsync.BlockData, hookActions graphsync.IncomingBlockHookActions) {
-		blockHook(peer.ID(p), blockData.Link().(cidlink.Link).Cid)
+		// A block that is not sent over the wire was found locally.
+		if localBlockHook != nil && blockData.BlockSizeOnWire() == 0 {
+			localBlockHook(peer.ID(p), blockData.Link().(cidlink.Link).Cid)
+		} else {
+			blockHook(peer.ID(p), blockData.Link().(cidlink.Link).Cid)
+		}
 		if bFn != nil {
 			bFn(p, responseData, blockData, hookActions)
 		}
@@ -151,6 +301,12 @@ func addIncomingBlockHook(bFn graphsync.OnIncomingBlockHook, blockHook func(peer
 // Close unregisters datatransfer event notification. If this Sync owns the
 // datatransfer.Manager then the Manager is stopped.
 func (s *Sync) Close() error {
+	// Finish closing data channels before the Manager is stopped.
+	s.closeMutex.Lock()
+	s.closed = true
+	s.closeMutex.Unlock()
+	s.closeWG.Wait()
+
 	s.unsubEvents()
 	if s.unregHook != nil {
 		s.unregHook()
@@ -187,6 +343,30 @@ func (s *Sync) NewSyncer(peerID peer.ID, topicName string, rateLimiter *rate.Lim
 	}
 }
 
+// NewSyncerWithLinkSystem creates a new Syncer, like NewSyncerWithAddrs, that
+// stores synced blocks in lsys instead of in the Sync's link system. Returns
+// an error if the Sync's datatransfer.Manager is shared with another Sync that
+// already supports this.
+func (s *Sync) NewSyncerWithLinkSystem(peerID peer.ID, topicName string, rateLimiter *rate.Limiter, addrs []multiaddr.Multiaddr, lsys ipld.LinkSystem) (*Syncer, error) {
+	if !s.storesEnabled {
+		return nil, errors.New("syncing to a separate link system is not supported by datatransfer manager")
+	}
+	syncer := s.NewSyncerWithAddrs(peerID, topicName, rateLimiter, addrs)
+	syncer.ls = &lsys
+	syncer.separateStore = true
+	return syncer, nil
+}
+
+// NewSyncerWithAddrs creates a new Syncer, like NewSyncer, that dials the
+// peer at the given addresses. The addresses are added to the host's peerstore
+// with a bounded TTL when the Syncer is used, so the caller does not need to
+// populate the peerstore for addresses learned out-of-band.
+func (s *Sync) NewSyncerWithAddrs(peerID peer.ID, topicName string, rateLimiter *rate.Limiter, addrs []multiaddr.Multiaddr) *Syncer {
+	syncer := s.NewSyncer(peerID, topicName, rateLimiter)
+	syncer.addrs = addrs
+	return syncer
+}
+
 // notifyOnSyncDone returns a channel that sync done notification is sent on.
 func (s *Sync) notifyOnSyncDone(k inProgressSyncKey) <-chan error {
 	syncDone := make(chan error, 1)
@@ -229,8 +409,12 @@ func (s *Sync) signalSyncDone(k inProgressSyncKey, err error) bool {
 // traversed during a sync but not transported using graphsync exchange.
 func (s *Sync) signalLocallyFoundCids(id peer.ID, cids []cid.Cid) {
 	if s.blockHook != nil {
+		hook := s.blockHook
+		if s.localBlockHook != nil {
+			hook = s.localBlockHook
+		}
 		for _, c := range cids {
-			s.blockHook(id, c)
+			hook(id, c)
 		}
 	}
 }
@@ -242,10 +426,42 @@ type rateLimitErr struct {
 
 func (e rateLimitErr) Error() string { return e.msg }
 
+// PeerProtocolVersion returns the ProtocolVersion that the publisher reported
+// in its latest sync. Version 0 means that the publisher predates protocol
+// versioning. Returns false if there has been no sync with the publisher.
+func (s *Sync) PeerProtocolVersion(peerID peer.ID) (uint64, bool) {
+	version, ok := s.peerVersions.Load(peerID)
+	if !ok {
+		return 0, false
+	}
+	return version.(uint64), true
+}
+
 // onEvent is called by the datatransfer manager to send events.
 func (s *Sync) onEvent(event dt.Event, channelState dt.ChannelState) {
+	if event.Code == dt.DataReceivedProgress {
+		if t := s.getTransfer(channelState.OtherPeer()); t != nil {
+			t.blockReceived(channelState.ChannelID())
+		}
+	}
+	if event.Code == dt.NewVoucherResult && channelState.Recipient() == channelState.SelfPeer() {
+		// The publisher accepted a sync, and reported its protocol version.
+		if vr, ok := channelState.LastVoucherResult().(*VoucherResult); ok {
+			s.peerVersions.Store(channelState.OtherPeer(), vr.Version)
+		}
+	}
+
 	var err error
 	switch channelState.Status() {
+	case dt.Requested:
+		if event.Code != dt.SendDataError || !isResourceLimitMsg(event.Message) {
+			return
+		}
+		// The request could not be sent because of a resource limit, so the
+		// transfer would only fail once it times out. Fail the sync now so
+		// that it can be retried.
+		err = ResourceLimitError{"datatransfer failed: " + event.Message}
+		log.Warnw(err.Error(), "cid", channelState.BaseCID(), "peer", channelState.OtherPeer())
 	case dt.Completed:
 		// Tell the waiting handler that the sync has finished successfully.
 		log.Debugw("datatransfer completed successfully", "cid", channelState.BaseCID(), "peer", channelState.OtherPeer())
@@ -268,14 +484,16 @@ func (s *Sync) onEvent(event dt.Event, channelState dt.ChannelState) {
 			if err == nil {
 				err = rateLimitErr{msg, stoppedAtCid}
 			}
+		} else if isResourceLimitMsg(msg) {
+			err = ResourceLimitError{"datatransfer failed: " + msg}
 		} else {
 			err = fmt.Errorf("datatransfer failed: %s", msg)
 		}
 
 		log.Errorw(err.Error(), "cid", channelState.BaseCID(), "peer", channelState.OtherPeer(), "message", msg)
 
-		if strings.HasSuffix(msg, "content not found") {
-			err = errors.New(err.Error() + ": content not found")
+		if strings.HasSuffix(msg, ErrContentNotFound.Error()) {
+			err = fmt.Errorf("%s: %w", err, ErrContentNotFound)
 		}
 	default:
 		// Ignore non-terminal channel states.
@@ -292,4 +510,7 @@ func (s *Sync) onEvent(event dt.Event, channelState dt.ChannelState) {
 		log.Errorw("Could not find channel for completed transfer notice", "cid", channelState.BaseCID())
 		return
 	}
+	if err == nil {
+		s.metrics.Transferred("dtsync", int(channelState.ReceivedCidsTotal()), int64(channelState.Received()))
+	}
 }
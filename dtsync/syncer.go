@@ -2,10 +2,15 @@ package dtsync
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
+	dt "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-legs/carutil"
+	"github.com/filecoin-project/go-legs/internal/tracing"
 	"github.com/filecoin-project/go-legs/p2p/protocol/head"
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
@@ -15,9 +20,20 @@ import (
 	"github.com/ipld/go-ipld-prime/traversal"
 	"github.com/ipld/go-ipld-prime/traversal/selector"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/time/rate"
 )
 
+// closeChannelTimeout is the time allowed for closing the data transfer
+// channel of a canceled sync.
+const closeChannelTimeout = 10 * time.Second
+
+// dialAddrTTL is how long addresses given to a Syncer are kept in the
+// peerstore. This only needs to be long enough to connect to the peer.
+const dialAddrTTL = 10 * time.Minute
+
 // Syncer handles a single sync with a provider.
 type Syncer struct {
 	peerID      peer.ID
@@ -25,16 +41,60 @@ type Syncer struct {
 	sync        *Sync
 	ls          *ipld.LinkSystem
 	topicName   string
+	// addrs are additional addresses to dial the peer at.
+	addrs []multiaddr.Multiaddr
+	// separateStore is true if ls is not the Sync's link system.
+	separateStore bool
+}
+
+// addDialAddrs adds the Syncer's addresses to the peerstore, so that they can
+// be used to connect to the peer.
+func (s *Syncer) addDialAddrs() {
+	if len(s.addrs) == 0 {
+		return
+	}
+	if ps := s.sync.host.Peerstore(); ps != nil {
+		ps.AddAddrs(s.peerID, s.addrs, dialAddrTTL)
+	}
 }
 
 // GetHead queries a provider for the latest CID.
 func (s *Syncer) GetHead(ctx context.Context) (cid.Cid, error) {
-	return head.QueryRootCid(ctx, s.sync.host, s.topicName, s.peerID)
+	ctx, span := s.sync.tracer.Start(ctx, "getHead", trace.WithAttributes(
+		attribute.String("peer", s.peerID.String())))
+	s.addDialAddrs()
+	c, err := head.QueryRootCid(ctx, s.sync.host, s.topicName, s.peerID)
+	tracing.EndSpan(span, err)
+	return c, err
 }
 
 // Sync opens a datatransfer data channel and uses the selector to pull data
 // from the provider.
 func (s *Syncer) Sync(ctx context.Context, nextCid cid.Cid, sel ipld.Node) error {
+	ctx, span := s.sync.tracer.Start(ctx, "sync", trace.WithAttributes(
+		attribute.String("peer", s.peerID.String()),
+		attribute.String("cid", nextCid.String())))
+	err := s.doSync(ctx, nextCid, sel)
+	tracing.EndSpan(span, err)
+	return err
+}
+
+// WriteCAR writes the blocks traversed from root by sel to w as a CARv2 file,
+// with root as its root. Blocks are written in the order in which they are
+// traversed, and are read from the local link system, so they must already
+// have been synced, such as by calling Sync with the same CID and selector.
+// The Syncer does not record its syncs, so the root and selector must be
+// given. To export the last completed sync with a publisher, use
+// legs.Subscriber.WriteLastSyncCAR.
+func (s *Syncer) WriteCAR(ctx context.Context, w io.Writer, root cid.Cid, sel ipld.Node) error {
+	cids, ok := s.has(ctx, root, sel)
+	if !ok {
+		return errors.New("blocks to write not available locally")
+	}
+	return carutil.WriteV2(ctx, *s.ls, w, []cid.Cid{root}, cids)
+}
+
+func (s *Syncer) doSync(ctx context.Context, nextCid cid.Cid, sel ipld.Node) error {
 	if s.rateLimiter != nil {
 		// Set the rate limiter to use for this sync of the peer. This limiter
 		// is retrieved by getRateLimiter, called from wrapped block hook.
@@ -52,13 +112,19 @@ func (s *Syncer) Sync(ctx context.Context, nextCid cid.Cid, sel ipld.Node) error
 	//             given selector is after. We could accept arguments that ask the user to
 	//             help with determining what the "next" CID would be if a DAG is partially
 	//             present. Similar to what SegmentSyncActions does.
-	if cids, ok := s.has(ctx, nextCid, sel); ok {
+	if cids, ok := s.hasLocal(ctx, nextCid, sel); ok {
+		log.Debugw("Found data to sync locally", "cid", nextCid, "source_peer", s.peerID)
 		s.sync.signalLocallyFoundCids(s.peerID, cids)
 		inProgressSyncK := inProgressSyncKey{nextCid, s.peerID}
 		s.sync.signalSyncDone(inProgressSyncK, nil)
 		return nil
 	}
 
+	s.addDialAddrs()
+
+	t := s.sync.startTransfer(s.peerID, nextCid)
+	defer s.sync.endTransfer(s.peerID)
+
 	for {
 		inProgressSyncK := inProgressSyncKey{nextCid, s.peerID}
 		// For loop to retry if we get rate limited.
@@ -66,53 +132,184 @@ func (s *Syncer) Sync(ctx context.Context, nextCid cid.Cid, sel ipld.Node) error
 
 		log.Debugw("Starting data channel for message source", "cid", nextCid, "source_peer", s.peerID)
 
-		v := Voucher{&nextCid}
-		_, err := s.sync.dtManager.OpenPullDataChannel(ctx, s.peerID, &v, nextCid, sel)
+		v := Voucher{
+			Head:    &nextCid,
+			Topic:   s.topicName,
+			Version: ProtocolVersion,
+		}
+		if s.separateStore {
+			// Store blocks in the Syncer's link system. See: configureStore.
+			s.sync.stores.Store(&v, *s.ls)
+		} else if s.sync.localCheck == LocalCheckNone && s.sync.storesEnabled {
+			// Fetch every block from the publisher, even if it is stored.
+			s.sync.stores.Store(&v, fetchOnlyLinkSystem(*s.ls))
+		}
+		chid, err := s.sync.dtManager.OpenPullDataChannel(ctx, s.peerID, &v, nextCid, sel)
+		s.sync.stores.Delete(&v)
 		if err != nil {
 			s.sync.signalSyncDone(inProgressSyncK, nil)
-			return fmt.Errorf("cannot open data channel: %w", err)
+			return resourceLimitErr(fmt.Errorf("cannot open data channel: %w", err))
 		}
 
-		// Wait for transfer finished signal.
-		select {
-		case err = <-syncDone:
-		case <-ctx.Done():
-			s.sync.signalSyncDone(inProgressSyncK, ctx.Err())
-			err = <-syncDone
+		if perr := t.setChannel(ctx, chid); perr != nil {
+			log.Warnw("Cannot pause transfer", "err", perr, "cid", nextCid, "source_peer", s.peerID)
+		}
+
+		// Wait for transfer finished signal, pausing the transfer while it is
+		// rate limited.
+		var resume <-chan time.Time
+		var resumeTimer *time.Timer
+	waitLoop:
+		for {
+			select {
+			case err = <-syncDone:
+				if _, ok := err.(ResourceLimitError); ok {
+					// Close the data channel instead of leaving it to time out,
+					// since the transfer cannot continue.
+					s.closeChannel(chid)
+				}
+				break waitLoop
+			case <-t.limited:
+				if resume != nil {
+					// Already paused.
+					continue
+				}
+				// The block hook has paused the transfer.
+				s.sync.metrics.RateLimited("dtsync")
+				delay := burstDelay(s.rateLimiter, time.Now())
+				log.Infow("Hit rate limit. Paused transfer and will resume later", "cid", nextCid, "source_peer", s.peerID, "delay", delay.String())
+				resumeTimer = time.NewTimer(delay)
+				resume = resumeTimer.C
+			case <-resume:
+				resume = nil
+				if perr := t.setRateLimited(ctx, false); perr != nil {
+					log.Warnw("Cannot resume rate limited transfer", "err", perr, "cid", nextCid, "source_peer", s.peerID)
+				}
+			case <-ctx.Done():
+				s.sync.signalSyncDone(inProgressSyncK, ctx.Err())
+				err = <-syncDone
+				// Close the data channel so that the transfer does not continue
+				// in the background after the sync is canceled.
+				s.closeChannel(chid)
+				break waitLoop
+			}
+		}
+		if resumeTimer != nil {
+			resumeTimer.Stop()
 		}
 		if err, ok := err.(rateLimitErr); ok {
-			// Wait until the rate limit bucket is fully refilled since this is
-			// a relatively heavy operation (essentially restarting the sync).
-			// Note, cannot use s.rateLimiter.WaitN here because that waits,
-			// but also consumes n tokens.
-			waitMsec := 1000.0 * float64(s.rateLimiter.Burst()) / float64(s.rateLimiter.Limit())
-			var waitTime time.Duration
-			waitTime = time.Duration(waitMsec) * time.Millisecond
-			if waitTime == 0 {
-				waitTime = time.Duration(1000*waitMsec) * time.Microsecond
+			s.sync.metrics.RateLimited("dtsync")
+			// Wait until the rate limiter has tokens for the transfer to make
+			// progress, since restarting the sync is a relatively heavy
+			// operation. The block that the sync stopped at was still
+			// downloaded, so it takes a token even though it did not consume
+			// one when it triggered rate limiting. At next restart the
+			// stopped at block will be local and will not count toward rate
+			// limiting.
+			waitTime, rerr := rateLimitDelay(s.rateLimiter, time.Now())
+			if rerr != nil {
+				return rerr
 			}
 			log.Infow("Hit rate limit. Waiting and will retry later", "cid", nextCid, "source_peer", s.peerID, "delay", waitTime.String())
-			select {
-			case <-time.After(waitTime):
-			case <-ctx.Done():
-				return ctx.Err()
+			if waitTime > 0 {
+				timer := time.NewTimer(waitTime)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				}
 			}
-			// Need to consume one token, since the stopped to make up for the
-			// previous Allow that did not consume a token and triggered rate
-			// limiting, even though the block was still downloaded. At next
-			// restart the stopped at block will be local and will not count
-			// toward rate limiting.
-			s.rateLimiter.Allow()
 
 			// Set the nextCid to be the cid that we stopped at because of rate
 			// limiting. This lets us pick up where we left off
 			nextCid = err.stoppedAtCid
 			continue
 		}
+		if _, ok := err.(ResourceLimitError); !ok && err != nil && ctx.Err() == nil && t.pausedWithProgress() {
+			// A paused transfer cannot be resumed if the publisher finished
+			// sending blocks while it was paused. Restart the sync, which does
+			// not fetch the blocks that were already received and stored. Each
+			// restart follows a channel that received blocks, so the restarts
+			// end once the publisher has sent every block.
+			log.Infow("Paused transfer failed. Restarting sync", "err", err, "cid", nextCid, "source_peer", s.peerID)
+			continue
+		}
 		return err
 	}
 }
 
+// closeChannel closes the data transfer channel of a canceled sync in the
+// background, so that the sync returns without waiting for the transfer to
+// stop. Sync.Close waits for the channel to be closed.
+func (s *Syncer) closeChannel(chid dt.ChannelID) {
+	s.sync.closeMutex.Lock()
+	defer s.sync.closeMutex.Unlock()
+	if s.sync.closed {
+		// The Manager is being stopped, which ends the transfer.
+		return
+	}
+	s.sync.closeWG.Add(1)
+	go func() {
+		defer s.sync.closeWG.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), closeChannelTimeout)
+		defer cancel()
+		if err := s.sync.dtManager.CloseDataTransferChannel(ctx, chid); err != nil {
+			log.Warnw("Failed to close data channel of canceled sync", "err", err, "channel", chid, "source_peer", s.peerID)
+		}
+	}()
+}
+
+// fetchOnlyLinkSystem returns a link system that stores blocks in lsys, but
+// only reads the blocks that it has stored, so that a sync using it fetches
+// every block from the publisher even if the block is already in lsys.
+func fetchOnlyLinkSystem(lsys ipld.LinkSystem) ipld.LinkSystem {
+	var fetched sync.Map
+	readOpener := lsys.StorageReadOpener
+	writeOpener := lsys.StorageWriteOpener
+	lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		if _, ok := fetched.Load(lnk.(cidlink.Link).Cid); !ok {
+			return nil, fmt.Errorf("block %s not fetched", lnk)
+		}
+		return readOpener(lctx, lnk)
+	}
+	lsys.StorageWriteOpener = func(lctx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		w, commit, err := writeOpener(lctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return w, func(lnk ipld.Link) error {
+			if err := commit(lnk); err != nil {
+				return err
+			}
+			fetched.Store(lnk.(cidlink.Link).Cid, struct{}{})
+			return nil
+		}, nil
+	}
+	return lsys
+}
+
+// hasLocal determines, according to the Sync's LocalCheck, whether the data to
+// sync is stored locally, so that the sync does not need to transfer it. If
+// so, returns true along with the CIDs that are considered synced.
+func (s *Syncer) hasLocal(ctx context.Context, nextCid cid.Cid, sel ipld.Node) ([]cid.Cid, bool) {
+	switch s.sync.localCheck {
+	case LocalCheckHead:
+		r, err := s.ls.StorageReadOpener(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: nextCid})
+		if err != nil {
+			return nil, false
+		}
+		if cl, ok := r.(io.Closer); ok {
+			cl.Close()
+		}
+		return []cid.Cid{nextCid}, true
+	case LocalCheckNone:
+		return nil, false
+	default:
+		return s.has(ctx, nextCid, sel)
+	}
+}
+
 // has determines if a given CID and selector is stored in the linksystem for a syncer already.
 //
 // If stored, returns true along with the list of CIDs that were encountered during traversal
@@ -1,10 +1,16 @@
 package dtsync_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/test"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	dssync "github.com/ipfs/go-datastore/sync"
@@ -16,10 +22,13 @@ import (
 	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/peerstore"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
 	"github.com/multiformats/go-multicodec"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
 )
 
 func TestDTSync_CallsBlockHookWhenCIDsAreFullyFoundLocally(t *testing.T) {
@@ -189,3 +198,596 @@ func TestDTSync_CallsBlockHookWhenCIDsArePartiallyFoundLocally(t *testing.T) {
 	require.Equal(t, l2.(cidlink.Link).Cid, gotCids[1])
 	require.Equal(t, l1.(cidlink.Link).Cid, gotCids[2])
 }
+
+func TestDTSync_LocalCheck(t *testing.T) {
+	const topic = "fish"
+	ctx := context.Background()
+
+	// Create a publisher that stores 3 nodes.
+	publs := cidlink.DefaultLinkSystem()
+	pubstore := &memstore.Store{}
+	publs.SetReadStorage(pubstore)
+	publs.SetWriteStorage(pubstore)
+	lp := cidlink.LinkPrototype{
+		Prefix: cid.Prefix{
+			Version:  1,
+			Codec:    uint64(multicodec.DagJson),
+			MhType:   uint64(multicodec.Sha2_256),
+			MhLength: -1,
+		},
+	}
+	l1, err := publs.Store(ipld.LinkContext{Ctx: ctx}, lp, fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("fish").AssignString("lobster")
+	}))
+	require.NoError(t, err)
+	l2, err := publs.Store(ipld.LinkContext{Ctx: ctx}, lp, fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(na fluent.MapAssembler) {
+		na.AssembleEntry("gogo").AssignString("barreleye")
+		na.AssembleEntry("next").AssignLink(l1)
+	}))
+	require.NoError(t, err)
+	l3, err := publs.Store(ipld.LinkContext{Ctx: ctx}, lp, fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(na fluent.MapAssembler) {
+		na.AssembleEntry("unda").AssignString("dasea")
+		na.AssembleEntry("next").AssignLink(l2)
+	}))
+	require.NoError(t, err)
+
+	pubh, err := libp2p.New()
+	require.NoError(t, err)
+	pub, err := dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), publs, topic)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, pub.Close()) })
+	require.NoError(t, pub.SetRoot(ctx, l3.(cidlink.Link).Cid))
+
+	// unpublished is stored by the subscriber but not by the publisher.
+	unpublishedStore := &memstore.Store{}
+	unpublishedLs := cidlink.DefaultLinkSystem()
+	unpublishedLs.SetWriteStorage(unpublishedStore)
+	unpublished, err := unpublishedLs.Store(ipld.LinkContext{Ctx: ctx}, lp, fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("cod").AssignString("haddock")
+	}))
+	require.NoError(t, err)
+
+	// sync syncs root into a store that has the blocks in have, and returns
+	// the CIDs passed to the block hook and the local block hook.
+	sync := func(t *testing.T, check dtsync.LocalCheck, root ipld.Link, have ...ipld.Link) (*memstore.Store, []cid.Cid, []cid.Cid, error) {
+		substore := &memstore.Store{}
+		for _, l := range have {
+			data, ok := pubstore.Bag[l.Binary()]
+			if !ok {
+				data = unpublishedStore.Bag[l.Binary()]
+			}
+			require.NoError(t, substore.Put(ctx, l.Binary(), data))
+		}
+		subls := cidlink.DefaultLinkSystem()
+		subls.SetReadStorage(substore)
+		subls.SetWriteStorage(substore)
+
+		subh, err := libp2p.New()
+		require.NoError(t, err)
+		t.Cleanup(func() { subh.Close() })
+		subh.Peerstore().AddAddrs(pubh.ID(), pubh.Addrs(), peerstore.PermanentAddrTTL)
+
+		var gotCids, gotLocalCids []cid.Cid
+		testHook := func(id peer.ID, c cid.Cid) {
+			gotCids = append(gotCids, c)
+		}
+		localHook := func(id peer.ID, c cid.Cid) {
+			gotLocalCids = append(gotLocalCids, c)
+		}
+		subject, err := dtsync.NewSync(subh, dssync.MutexWrap(datastore.NewMapDatastore()), subls, testHook,
+			dtsync.WithLocalBlockHook(localHook), dtsync.WithLocalCheck(check))
+		require.NoError(t, err)
+		t.Cleanup(func() { require.NoError(t, subject.Close()) })
+
+		syncer := subject.NewSyncer(pubh.ID(), topic, nil)
+		err = syncer.Sync(ctx, root.(cidlink.Link).Cid, selectorparse.CommonSelector_ExploreAllRecursively)
+		return substore, gotCids, gotLocalCids, err
+	}
+
+	t.Run("head", func(t *testing.T) {
+		// Only the head is stored, and the rest of the DAG is not fetched.
+		substore, gotCids, gotLocalCids, err := sync(t, dtsync.LocalCheckHead, l3, l3)
+		require.NoError(t, err)
+		require.Empty(t, gotCids)
+		require.Equal(t, []cid.Cid{l3.(cidlink.Link).Cid}, gotLocalCids)
+		has, err := substore.Has(ctx, l2.Binary())
+		require.NoError(t, err)
+		require.False(t, has)
+	})
+
+	t.Run("scope", func(t *testing.T) {
+		// Only the head is stored, so the rest of the DAG is fetched.
+		substore, gotCids, gotLocalCids, err := sync(t, dtsync.LocalCheckScope, l3, l3)
+		require.NoError(t, err)
+		require.Len(t, append(gotCids, gotLocalCids...), 3)
+		has, err := substore.Has(ctx, l2.Binary())
+		require.NoError(t, err)
+		require.True(t, has)
+
+		// The whole DAG is stored, so nothing is fetched.
+		_, gotCids, gotLocalCids, err = sync(t, dtsync.LocalCheckScope, l3, l1, l2, l3)
+		require.NoError(t, err)
+		require.Empty(t, gotCids)
+		require.Len(t, gotLocalCids, 3)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		// A stored DAG that the publisher does not have is synced without
+		// the publisher, unless the publisher is always fetched from.
+		_, _, _, err := sync(t, dtsync.LocalCheckScope, unpublished, unpublished)
+		require.NoError(t, err)
+		_, _, _, err = sync(t, dtsync.LocalCheckNone, unpublished, unpublished)
+		require.Error(t, err)
+
+		// The whole DAG is stored, but is fetched from the publisher.
+		_, gotCids, gotLocalCids, err := sync(t, dtsync.LocalCheckNone, l3, l1, l2, l3)
+		require.NoError(t, err)
+		require.Len(t, gotCids, 3)
+		require.Empty(t, gotLocalCids)
+	})
+}
+
+func TestDTSync_SyncsWithDialAddrs(t *testing.T) {
+	const topic = "fish"
+	ctx := context.Background()
+
+	pubLs := cidlink.DefaultLinkSystem()
+	pubStore := &memstore.Store{}
+	pubLs.SetReadStorage(pubStore)
+	pubLs.SetWriteStorage(pubStore)
+	lp := cidlink.LinkPrototype{
+		Prefix: cid.Prefix{
+			Version:  1,
+			Codec:    uint64(multicodec.DagJson),
+			MhType:   uint64(multicodec.Sha2_256),
+			MhLength: -1,
+		},
+	}
+	l1, err := pubLs.Store(ipld.LinkContext{Ctx: ctx}, lp, fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("fish").AssignString("lobster")
+	}))
+	require.NoError(t, err)
+
+	pubh, err := libp2p.New()
+	require.NoError(t, err)
+	pub, err := dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), pubLs, topic)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, pub.Close()) })
+
+	// Do not add the publisher's addresses to the syncer's peerstore.
+	subh, err := libp2p.New()
+	require.NoError(t, err)
+	subLs := cidlink.DefaultLinkSystem()
+	subStore := &memstore.Store{}
+	subLs.SetReadStorage(subStore)
+	subLs.SetWriteStorage(subStore)
+	subject, err := dtsync.NewSync(subh, dssync.MutexWrap(datastore.NewMapDatastore()), subLs, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+
+	syncer := subject.NewSyncerWithAddrs(pubh.ID(), topic, nil, pubh.Addrs())
+	require.NoError(t, syncer.Sync(ctx, l1.(cidlink.Link).Cid, selectorparse.CommonSelector_ExploreAllRecursively))
+
+	has, err := subStore.Has(ctx, l1.Binary())
+	require.NoError(t, err)
+	require.True(t, has)
+	require.NotEmpty(t, subh.Peerstore().Addrs(pubh.ID()))
+}
+
+func TestDTSync_WriteCAR(t *testing.T) {
+	const topic = "fish"
+	ctx := context.Background()
+
+	pubLs := cidlink.DefaultLinkSystem()
+	pubStore := &memstore.Store{}
+	pubLs.SetReadStorage(pubStore)
+	pubLs.SetWriteStorage(pubStore)
+	lp := cidlink.LinkPrototype{
+		Prefix: cid.Prefix{
+			Version:  1,
+			Codec:    uint64(multicodec.DagJson),
+			MhType:   uint64(multicodec.Sha2_256),
+			MhLength: -1,
+		},
+	}
+	l1, err := pubLs.Store(ipld.LinkContext{Ctx: ctx}, lp, fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("fish").AssignString("lobster")
+	}))
+	require.NoError(t, err)
+	l2, err := pubLs.Store(ipld.LinkContext{Ctx: ctx}, lp, fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(na fluent.MapAssembler) {
+		na.AssembleEntry("gogo").AssignString("barreleye")
+		na.AssembleEntry("next").AssignLink(l1)
+	}))
+	require.NoError(t, err)
+
+	pubh, err := libp2p.New()
+	require.NoError(t, err)
+	pub, err := dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), pubLs, topic)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, pub.Close()) })
+
+	subh, err := libp2p.New()
+	require.NoError(t, err)
+	subh.Peerstore().AddAddrs(pubh.ID(), pubh.Addrs(), peerstore.PermanentAddrTTL)
+	subLs := cidlink.DefaultLinkSystem()
+	subStore := &memstore.Store{}
+	subLs.SetReadStorage(subStore)
+	subLs.SetWriteStorage(subStore)
+	subject, err := dtsync.NewSync(subh, dssync.MutexWrap(datastore.NewMapDatastore()), subLs, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+
+	syncer := subject.NewSyncer(pubh.ID(), topic, nil)
+	var buf bytes.Buffer
+	root := l2.(cidlink.Link).Cid
+	sel := selectorparse.CommonSelector_ExploreAllRecursively
+	require.Error(t, syncer.WriteCAR(ctx, &buf, root, sel), "expected error before sync")
+	require.NoError(t, syncer.Sync(ctx, root, sel))
+	require.NoError(t, syncer.WriteCAR(ctx, &buf, root, sel))
+
+	// The CAR data payload contains the blocks in traversal order.
+	car := buf.Bytes()
+	l2Data, err := subStore.Get(ctx, l2.Binary())
+	require.NoError(t, err)
+	l1Data, err := subStore.Get(ctx, l1.Binary())
+	require.NoError(t, err)
+	i2 := bytes.Index(car, l2Data)
+	i1 := bytes.Index(car, l1Data)
+	require.Positive(t, i2)
+	require.Greater(t, i1, i2)
+}
+
+func TestDTSync_ResourceLimitError(t *testing.T) {
+	const topic = "fish"
+	ctx := context.Background()
+
+	pubLs := cidlink.DefaultLinkSystem()
+	pubStore := &memstore.Store{}
+	pubLs.SetReadStorage(pubStore)
+	pubLs.SetWriteStorage(pubStore)
+	lp := cidlink.LinkPrototype{
+		Prefix: cid.Prefix{
+			Version:  1,
+			Codec:    uint64(multicodec.DagJson),
+			MhType:   uint64(multicodec.Sha2_256),
+			MhLength: -1,
+		},
+	}
+	l1, err := pubLs.Store(ipld.LinkContext{Ctx: ctx}, lp, fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("fish").AssignString("lobster")
+	}))
+	require.NoError(t, err)
+
+	pubh, err := libp2p.New()
+	require.NoError(t, err)
+	pub, err := dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), pubLs, topic)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, pub.Close()) })
+
+	// Allow no streams for the legs service on the syncing host.
+	limits := rcmgr.DefaultLimits
+	dtsync.AddServiceLimit(&limits, rcmgr.BaseLimit{}, rcmgr.BaseLimitIncrease{})
+	rm, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(limits.AutoScale()))
+	require.NoError(t, err)
+	subh, err := libp2p.New(libp2p.ResourceManager(rm))
+	require.NoError(t, err)
+	subh.Peerstore().AddAddrs(pubh.ID(), pubh.Addrs(), peerstore.PermanentAddrTTL)
+	subLs := cidlink.DefaultLinkSystem()
+	subStore := &memstore.Store{}
+	subLs.SetReadStorage(subStore)
+	subLs.SetWriteStorage(subStore)
+	subject, err := dtsync.NewSync(subh, dssync.MutexWrap(datastore.NewMapDatastore()), subLs, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+
+	syncer := subject.NewSyncer(pubh.ID(), topic, nil)
+	err = syncer.Sync(ctx, l1.(cidlink.Link).Cid, selectorparse.CommonSelector_ExploreAllRecursively)
+	var rlErr dtsync.ResourceLimitError
+	require.ErrorAs(t, err, &rlErr)
+	require.ErrorIs(t, err, network.ErrResourceLimitExceeded)
+}
+
+func TestDTSync_PauseOnRateLimit(t *testing.T) {
+	const topic = "fish"
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// Create a publisher that stores a chain of 30 nodes, large enough that
+	// the chain is sent in many graphsync messages. A transfer is not paused
+	// once its last message is received.
+	publs := cidlink.DefaultLinkSystem()
+	pubstore := &memstore.Store{}
+	publs.SetReadStorage(pubstore)
+	publs.SetWriteStorage(pubstore)
+	lp := cidlink.LinkPrototype{
+		Prefix: cid.Prefix{
+			Version:  1,
+			Codec:    uint64(multicodec.DagJson),
+			MhType:   uint64(multicodec.Sha2_256),
+			MhLength: -1,
+		},
+	}
+	const chainLen = 30
+	var head ipld.Link
+	for i := 0; i < chainLen; i++ {
+		prev := head
+		var err error
+		head, err = publs.Store(ipld.LinkContext{Ctx: ctx}, lp, fluent.MustBuildMap(basicnode.Prototype.Map, 3, func(na fluent.MapAssembler) {
+			na.AssembleEntry("value").AssignInt(int64(i))
+			na.AssembleEntry("data").AssignBytes(bytes.Repeat([]byte{byte(i)}, 128*1024))
+			if prev != nil {
+				na.AssembleEntry("next").AssignLink(prev)
+			} else {
+				na.AssembleEntry("next").AssignNull()
+			}
+		}))
+		require.NoError(t, err)
+	}
+
+	pubh, err := libp2p.New()
+	require.NoError(t, err)
+	pub, err := dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), publs, topic)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, pub.Close()) })
+
+	subh, err := libp2p.New()
+	require.NoError(t, err)
+	t.Cleanup(func() { subh.Close() })
+	subh.Peerstore().AddAddrs(pubh.ID(), pubh.Addrs(), peerstore.PermanentAddrTTL)
+	substore := &memstore.Store{}
+	subls := cidlink.DefaultLinkSystem()
+	subls.SetReadStorage(substore)
+	subls.SetWriteStorage(substore)
+
+	// The limiter allows a burst of blocks and then limits every block, so
+	// that the transfer is always paused. The pause hook lifts the limit, so
+	// that the transfer resumes without waiting and is paused only once.
+	const burst = 5
+	limiter := rate.NewLimiter(rate.Every(time.Hour), burst)
+
+	var gotCids, localCids []cid.Cid
+	var pauses []bool
+	var mutex sync.Mutex
+	blockHook := func(_ peer.ID, c cid.Cid) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		gotCids = append(gotCids, c)
+	}
+	localBlockHook := func(_ peer.ID, c cid.Cid) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		localCids = append(localCids, c)
+	}
+	pauseHook := func(_ peer.ID, c cid.Cid, paused, rateLimited bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		require.Equal(t, head.(cidlink.Link).Cid, c)
+		require.True(t, rateLimited)
+		pauses = append(pauses, paused)
+		if paused {
+			limiter.SetLimit(rate.Inf)
+		}
+	}
+	subject, err := dtsync.NewSync(subh, dssync.MutexWrap(datastore.NewMapDatastore()), subls, blockHook,
+		dtsync.WithLocalBlockHook(localBlockHook), dtsync.WithPauseOnRateLimit(true), dtsync.WithPauseHook(pauseHook))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+
+	// No transfer is in progress to pause.
+	require.Error(t, subject.PauseTransfer(ctx, pubh.ID()))
+
+	syncer := subject.NewSyncer(pubh.ID(), topic, limiter)
+	require.NoError(t, syncer.Sync(ctx, head.(cidlink.Link).Cid, selectorparse.CommonSelector_ExploreAllRecursively))
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	// No block is received more than once, since the transfer is paused
+	// instead of restarted. A transfer that is restarted, because the
+	// publisher finished sending while it was paused, finds the blocks it
+	// already received stored locally.
+	seen := make(map[cid.Cid]struct{})
+	for _, c := range gotCids {
+		_, ok := seen[c]
+		require.False(t, ok, "block received more than once")
+		seen[c] = struct{}{}
+	}
+	for _, c := range localCids {
+		seen[c] = struct{}{}
+	}
+	require.Len(t, seen, chainLen)
+	require.NotEmpty(t, pauses)
+	for i, paused := range pauses {
+		require.Equal(t, i%2 == 0, paused)
+	}
+}
+
+func TestDTSync_PausedSyncRejected(t *testing.T) {
+	const topic = "fish"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pubLs := cidlink.DefaultLinkSystem()
+	pubStore := &memstore.Store{}
+	pubLs.SetReadStorage(pubStore)
+	pubLs.SetWriteStorage(pubStore)
+	lp := cidlink.LinkPrototype{
+		Prefix: cid.Prefix{
+			Version:  1,
+			Codec:    uint64(multicodec.DagJson),
+			MhType:   uint64(multicodec.Sha2_256),
+			MhLength: -1,
+		},
+	}
+	l1, err := pubLs.Store(ipld.LinkContext{Ctx: ctx}, lp, fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("fish").AssignString("lobster")
+	}))
+	require.NoError(t, err)
+
+	// The publisher rejects every request, once the sync has been paused.
+	paused := make(chan struct{})
+	var requests int32
+	validate := func(peer.ID, cid.Cid, ipld.Node) error {
+		atomic.AddInt32(&requests, 1)
+		select {
+		case <-paused:
+		case <-ctx.Done():
+		}
+		return errors.New("not served")
+	}
+	pubh, err := libp2p.New()
+	require.NoError(t, err)
+	pub, err := dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), pubLs, topic,
+		dtsync.WithRequestValidator(validate))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, pub.Close()) })
+
+	subh, err := libp2p.New()
+	require.NoError(t, err)
+	subLs := cidlink.DefaultLinkSystem()
+	subStore := &memstore.Store{}
+	subLs.SetReadStorage(subStore)
+	subLs.SetWriteStorage(subStore)
+	subject, err := dtsync.NewSync(subh, dssync.MutexWrap(datastore.NewMapDatastore()), subLs, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+
+	syncer := subject.NewSyncerWithAddrs(pubh.ID(), topic, nil, pubh.Addrs())
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- syncer.Sync(ctx, l1.(cidlink.Link).Cid, selectorparse.CommonSelector_ExploreAllRecursively)
+	}()
+	require.Eventually(t, func() bool {
+		return subject.PauseTransfer(ctx, pubh.ID()) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	close(paused)
+
+	// The rejected sync fails instead of being restarted while it is paused.
+	select {
+	case err = <-errChan:
+		require.Error(t, err)
+		require.NotErrorIs(t, err, context.DeadlineExceeded)
+	case <-ctx.Done():
+		t.Fatal("paused sync was not rejected")
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestDTSync_CancelMidTransfer(t *testing.T) {
+	const topic = "fish"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pubh := test.MkTestHost()
+	pubLs := test.MkLinkSystem(dssync.MutexWrap(datastore.NewMapDatastore()))
+	pub, err := dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), pubLs, topic)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, pub.Close()) })
+	chainLnks := test.MkChain(pubLs, true)
+	headCid := chainLnks[0].(cidlink.Link).Cid
+
+	// The sync is canceled when its first block arrives, and the transfer is
+	// held until the canceled sync returns.
+	syncCtx, syncCancel := context.WithCancel(ctx)
+	defer syncCancel()
+	syncReturned := make(chan struct{})
+	var once sync.Once
+	blockHook := func(peer.ID, cid.Cid) {
+		once.Do(func() {
+			syncCancel()
+			select {
+			case <-syncReturned:
+			case <-ctx.Done():
+			}
+		})
+	}
+
+	subh := test.MkTestHost()
+	subLs := test.MkLinkSystem(dssync.MutexWrap(datastore.NewMapDatastore()))
+	subject, err := dtsync.NewSync(subh, dssync.MutexWrap(datastore.NewMapDatastore()), subLs, blockHook)
+	require.NoError(t, err)
+
+	syncer := subject.NewSyncerWithAddrs(pubh.ID(), topic, nil, pubh.Addrs())
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- syncer.Sync(syncCtx, headCid, selectorparse.CommonSelector_ExploreAllRecursively)
+		close(syncReturned)
+	}()
+	select {
+	case err = <-errChan:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("canceled sync did not return")
+	}
+
+	// Closing the Sync does not wait for the data channel of the canceled sync
+	// to time out.
+	closed := make(chan error, 1)
+	go func() {
+		closed <- subject.Close()
+	}()
+	select {
+	case err = <-closed:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked after canceled sync")
+	}
+}
+
+func TestDTSync_ProtocolVersionAndTopic(t *testing.T) {
+	const topic = "fish"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pubLs := cidlink.DefaultLinkSystem()
+	pubStore := &memstore.Store{}
+	pubLs.SetReadStorage(pubStore)
+	pubLs.SetWriteStorage(pubStore)
+	lp := cidlink.LinkPrototype{
+		Prefix: cid.Prefix{
+			Version:  1,
+			Codec:    uint64(multicodec.DagJson),
+			MhType:   uint64(multicodec.Sha2_256),
+			MhLength: -1,
+		},
+	}
+	l1, err := pubLs.Store(ipld.LinkContext{Ctx: ctx}, lp, fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("fish").AssignString("lobster")
+	}))
+	require.NoError(t, err)
+
+	pubh, err := libp2p.New()
+	require.NoError(t, err)
+	pub, err := dtsync.NewPublisher(pubh, dssync.MutexWrap(datastore.NewMapDatastore()), pubLs, topic)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, pub.Close()) })
+
+	subh, err := libp2p.New()
+	require.NoError(t, err)
+	subLs := cidlink.DefaultLinkSystem()
+	subStore := &memstore.Store{}
+	subLs.SetReadStorage(subStore)
+	subLs.SetWriteStorage(subStore)
+	subject, err := dtsync.NewSync(subh, dssync.MutexWrap(datastore.NewMapDatastore()), subLs, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+
+	_, ok := subject.PeerProtocolVersion(pubh.ID())
+	require.False(t, ok)
+
+	// The publisher rejects a request for a topic that it does not serve.
+	syncer := subject.NewSyncerWithAddrs(pubh.ID(), "shark", nil, pubh.Addrs())
+	require.Error(t, syncer.Sync(ctx, l1.(cidlink.Link).Cid, selectorparse.CommonSelector_ExploreAllRecursively))
+	has, err := subStore.Has(ctx, l1.Binary())
+	require.NoError(t, err)
+	require.False(t, has)
+
+	syncer = subject.NewSyncerWithAddrs(pubh.ID(), topic, nil, pubh.Addrs())
+	require.NoError(t, syncer.Sync(ctx, l1.(cidlink.Link).Cid, selectorparse.CommonSelector_ExploreAllRecursively))
+	has, err = subStore.Has(ctx, l1.Binary())
+	require.NoError(t, err)
+	require.True(t, has)
+
+	version, ok := subject.PeerProtocolVersion(pubh.ID())
+	require.True(t, ok)
+	require.Equal(t, dtsync.ProtocolVersion, version)
+}
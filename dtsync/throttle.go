@@ -0,0 +1,70 @@
+package dtsync
+
+import (
+	"sync"
+
+	dt "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-data-transfer/channels"
+	"github.com/filecoin-project/go-legs/throttle"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// servedTransfers counts the data transfers that a publisher serves against
+// its throttle, from when a request is accepted until its channel ends.
+type servedTransfers struct {
+	throttle *throttle.Throttle
+	// sent is the number of bytes sent so far on each channel in progress.
+	sent  map[dt.ChannelID]uint64
+	mutex sync.Mutex
+}
+
+// newServedTransfers returns nil if th is nil, so that no transfers are
+// tracked when the publisher is not throttled.
+func newServedTransfers(th *throttle.Throttle) *servedTransfers {
+	if th == nil {
+		return nil
+	}
+	return &servedTransfers{
+		throttle: th,
+		sent:     make(map[dt.ChannelID]uint64),
+	}
+}
+
+// start checks whether the throttle allows a request from the peer, and if
+// so, counts the request's channel as a transfer in progress. A restarted
+// channel that is already in progress is not counted again.
+func (st *servedTransfers) start(chid dt.ChannelID, peerID peer.ID) error {
+	if st == nil {
+		return nil
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if _, ok := st.sent[chid]; ok {
+		return nil
+	}
+	if err := st.throttle.Acquire(string(peerID)); err != nil {
+		return err
+	}
+	st.sent[chid] = 0
+	return nil
+}
+
+// onEvent counts the bytes sent on each channel in progress, and releases the
+// channel from the throttle when it ends.
+func (st *servedTransfers) onEvent(event dt.Event, channelState dt.ChannelState) {
+	chid := channelState.ChannelID()
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	sent, ok := st.sent[chid]
+	if !ok {
+		return
+	}
+	if event.Code == dt.DataSent && channelState.Sent() > sent {
+		st.throttle.AddBytes(string(channelState.OtherPeer()), int64(channelState.Sent()-sent))
+		st.sent[chid] = channelState.Sent()
+	}
+	if channels.IsChannelTerminated(channelState.Status()) {
+		delete(st.sent, chid)
+		st.throttle.Release()
+	}
+}
@@ -0,0 +1,185 @@
+package dtsync
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	dt "github.com/filecoin-project/go-data-transfer"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// PauseHookFunc is called when the data transfer of a sync is paused or
+// resumed. The CID is the one that the transfer was opened for. rateLimited
+// is true if the transfer was paused or resumed because of the sync's rate
+// limiter, and false if it was paused or resumed with PauseTransfer or
+// ResumeTransfer. See: WithPauseOnRateLimit.
+type PauseHookFunc func(peerID peer.ID, c cid.Cid, paused, rateLimited bool)
+
+// transfer is the data transfer of a sync in progress. A transfer is paused
+// while either its rate limiter or the user has paused it.
+type transfer struct {
+	peerID    peer.ID
+	c         cid.Cid
+	dtManager dt.Manager
+	hook      PauseHookFunc
+
+	// limited receives a signal when the rate limiter pauses the transfer.
+	limited chan struct{}
+
+	// chid is the data channel of the transfer. It is not set until the
+	// channel is opened.
+	chid        dt.ChannelID
+	opened      bool
+	rateLimited bool
+	userPaused  bool
+	// paused is true if the data channel is paused.
+	paused bool
+	// wasPaused is true if the data channel has been paused since it was
+	// opened.
+	wasPaused bool
+	// received is true if a block has been received on the data channel.
+	received bool
+	mutex    sync.Mutex
+}
+
+// startTransfer records the transfer of a sync with the peer, so that it can
+// be paused. Only one transfer with a peer is in progress at a time.
+func (s *Sync) startTransfer(peerID peer.ID, c cid.Cid) *transfer {
+	t := &transfer{
+		peerID:    peerID,
+		c:         c,
+		dtManager: s.dtManager,
+		hook:      s.pauseHook,
+		limited:   make(chan struct{}, 1),
+	}
+	s.rateMutex.Lock()
+	s.transfers[peerID] = t
+	s.rateMutex.Unlock()
+	return t
+}
+
+// endTransfer removes the transfer of a sync with the peer.
+func (s *Sync) endTransfer(peerID peer.ID) {
+	s.rateMutex.Lock()
+	delete(s.transfers, peerID)
+	s.rateMutex.Unlock()
+}
+
+func (s *Sync) getTransfer(peerID peer.ID) *transfer {
+	s.rateMutex.Lock()
+	defer s.rateMutex.Unlock()
+	return s.transfers[peerID]
+}
+
+// PauseTransfer pauses the data transfer of the sync in progress with the
+// peer. The data channel stays open, and no blocks are sent again when the
+// transfer is resumed with ResumeTransfer. Returns an error if no data
+// transfer with the peer is in progress.
+func (s *Sync) PauseTransfer(ctx context.Context, peerID peer.ID) error {
+	t := s.getTransfer(peerID)
+	if t == nil {
+		return fmt.Errorf("no transfer in progress with peer %s", peerID)
+	}
+	return t.setUserPaused(ctx, true)
+}
+
+// ResumeTransfer resumes the data transfer of the sync in progress with the
+// peer, that was paused by PauseTransfer. A transfer that is also paused by
+// its rate limiter stays paused until the rate limiter allows it to resume.
+//
+// A pause takes effect when the block being transferred has been received, so
+// a transfer must not be resumed before it has had time to pause.
+func (s *Sync) ResumeTransfer(ctx context.Context, peerID peer.ID) error {
+	t := s.getTransfer(peerID)
+	if t == nil {
+		return fmt.Errorf("no transfer in progress with peer %s", peerID)
+	}
+	return t.setUserPaused(ctx, false)
+}
+
+// signalLimited tells the sync that its rate limiter paused the transfer, so
+// that the sync resumes it when the rate limiter has tokens again.
+func (t *transfer) signalLimited() {
+	select {
+	case t.limited <- struct{}{}:
+	default:
+	}
+}
+
+// setChannel sets the data channel of the transfer, and pauses it if the
+// transfer was paused before the channel was opened.
+func (t *transfer) setChannel(ctx context.Context, chid dt.ChannelID) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.chid = chid
+	t.opened = true
+	// A new data channel is not paused.
+	t.paused = false
+	t.wasPaused = false
+	t.received = false
+	t.rateLimited = false
+	return t.update(ctx, false)
+}
+
+// blockReceived records that a block was received on the data channel.
+func (t *transfer) blockReceived(chid dt.ChannelID) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.opened && t.chid == chid {
+		t.received = true
+	}
+}
+
+// pausedWithProgress returns true if the data channel has been paused since it
+// was opened, and the publisher sent blocks on it. A failure of such a channel
+// is from the publisher finishing while the channel was paused, after which
+// the transfer cannot be resumed. A channel that received no blocks, such as
+// one for a request that the publisher rejected, did not fail from pausing.
+func (t *transfer) pausedWithProgress() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.wasPaused && t.received
+}
+
+func (t *transfer) setRateLimited(ctx context.Context, limited bool) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.rateLimited = limited
+	return t.update(ctx, true)
+}
+
+func (t *transfer) setUserPaused(ctx context.Context, paused bool) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.userPaused = paused
+	return t.update(ctx, false)
+}
+
+// update pauses or resumes the data channel, if it is open, to match the
+// paused state of the transfer. The mutex must be held.
+func (t *transfer) update(ctx context.Context, rateLimited bool) error {
+	pause := t.rateLimited || t.userPaused
+	if !t.opened || pause == t.paused {
+		return nil
+	}
+	var err error
+	if pause {
+		err = t.dtManager.PauseDataTransferChannel(ctx, t.chid)
+	} else {
+		err = t.dtManager.ResumeDataTransferChannel(ctx, t.chid)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot update paused state of data channel: %w", err)
+	}
+	t.paused = pause
+	if pause {
+		t.wasPaused = true
+	}
+	log.Infow("Updated paused state of transfer", "paused", pause, "rateLimited", rateLimited, "cid", t.c, "source_peer", t.peerID)
+	if t.hook != nil {
+		t.hook(t.peerID, t.c, pause, rateLimited)
+	}
+	return nil
+}
@@ -18,16 +18,15 @@ import (
 	gsnet "github.com/ipfs/go-graphsync/network"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/libp2p/go-libp2p/core/host"
-	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 type dtCloseFunc func() error
 
 // configureDataTransferForLegs configures an existing data transfer instance to serve go-legs requests
-// from given linksystem (publisher only)
-func configureDataTransferForLegs(ctx context.Context, dtManager dt.Manager, lsys ipld.LinkSystem, allowPeer func(peer.ID) bool) error {
+// that pass val from given linksystem (publisher only)
+func configureDataTransferForLegs(ctx context.Context, dtManager dt.Manager, lsys ipld.LinkSystem, val *legsValidator) error {
 	v := &Voucher{}
-	err := registerVoucher(dtManager, v, allowPeer)
+	err := registerVoucher(dtManager, v, val)
 	if err != nil {
 		return err
 	}
@@ -57,9 +56,11 @@ func (lsc legStorageConfiguration) configureTransport(chid dt.ChannelID, voucher
 	}
 }
 
-func registerVoucher(dtManager dt.Manager, v *Voucher, allowPeer func(peer.ID) bool) error {
-	val := &legsValidator{
-		allowPeer: allowPeer,
+// registerVoucher registers the legs voucher type, validated by val. Any
+// request is allowed if val is nil.
+func registerVoucher(dtManager dt.Manager, v *Voucher, val *legsValidator) error {
+	if val == nil {
+		val = &legsValidator{}
 	}
 	err := dtManager.RegisterVoucherType(v, val)
 	if err != nil {
@@ -79,7 +80,10 @@ func registerVoucher(dtManager dt.Manager, v *Voucher, allowPeer func(peer.ID) b
 	return nil
 }
 
-func makeDataTransfer(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem, allowPeer func(peer.ID) bool) (dt.Manager, graphsync.GraphExchange, dtCloseFunc, error) {
+func makeDataTransfer(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem, val *legsValidator) (dt.Manager, graphsync.GraphExchange, dtCloseFunc, error) {
+	// Scope graphsync and datatransfer streams under the legs service of the
+	// host's resource manager.
+	host = scopeHost(host)
 	gsNet := gsnet.NewFromLibp2pHost(host)
 	ctx, cancel := context.WithCancel(context.Background())
 	gs := gsimpl.New(ctx, gsNet, lsys)
@@ -106,7 +110,7 @@ func makeDataTransfer(host host.Host, ds datastore.Batching, lsys ipld.LinkSyste
 		return nil, nil, nil, fmt.Errorf("failed to instantiate datatransfer: %w", err)
 	}
 
-	err = registerVoucher(dtManager, &Voucher{}, allowPeer)
+	err = registerVoucher(dtManager, &Voucher{}, val)
 	if err != nil {
 		cancel()
 		return nil, nil, nil, fmt.Errorf("failed to register voucher: %w", err)
@@ -2,8 +2,10 @@ package dtsync
 
 import (
 	"errors"
+	"fmt"
 
 	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-legs/acl"
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -12,6 +14,20 @@ import (
 
 //go:generate go run -tags cbg ../tools
 
+const (
+	// ProtocolVersion is the version of the go-legs data transfer protocol
+	// spoken by this package. It is sent in each Voucher and VoucherResult, so
+	// that peers can tell which protocol features the other side supports. A
+	// peer that reports version 0 predates protocol versioning.
+	ProtocolVersion uint64 = 1
+
+	// VoucherType is the go-data-transfer type identifier of Voucher.
+	VoucherType datatransfer.TypeIdentifier = "LegsVoucher"
+	// VoucherResultType is the go-data-transfer type identifier of
+	// VoucherResult.
+	VoucherResultType datatransfer.TypeIdentifier = "LegsVoucherResult"
+)
+
 var (
 	_ datatransfer.RequestValidator = (*legsValidator)(nil)
 
@@ -27,27 +43,51 @@ var (
 // A Voucher is used to communicate a new DAG head
 type Voucher struct {
 	Head *cid.Cid
+	// Topic is the topic that the requested DAG is published on. A publisher
+	// rejects a request for a topic that it does not serve. Empty if the
+	// requester does not report a topic.
+	Topic string
+	// Version is the ProtocolVersion of the requester.
+	Version uint64
 }
 
 // Type provides an identifier for the voucher to go-data-transfer
 func (v *Voucher) Type() datatransfer.TypeIdentifier {
-	return "LegsVoucher"
+	return VoucherType
 }
 
 // A VoucherResult responds to a voucher
 type VoucherResult struct {
 	Code uint64
+	// Version is the ProtocolVersion of the publisher.
+	Version uint64
 }
 
 // Type provides an identifier for the voucher result to go-data-transfer
 func (v *VoucherResult) Type() datatransfer.TypeIdentifier {
-	return "LegsVoucherResult"
+	return VoucherResultType
 }
 
+// RequestValidatorFunc decides whether a publisher serves a sync request from
+// the peer for the DAG at root, traversed with the selector. It returns an
+// error to reject the request. See: WithRequestValidator.
+type RequestValidatorFunc func(peerID peer.ID, root cid.Cid, selector ipld.Node) error
+
 type legsValidator struct {
 	//ctx context.Context
 	//ValidationsReceived chan receivedValidation
 	allowPeer func(peer.ID) bool
+	// acl, if not nil, is the access control list of the peers served.
+	acl *acl.List
+	// topic is the topic served by the publisher. Requests for other topics
+	// are rejected. Any topic is allowed if empty.
+	topic string
+	// validateRequest, if not nil, rejects the requests that the publisher
+	// does not serve.
+	validateRequest RequestValidatorFunc
+	// transfers, if not nil, throttles the requests that the publisher
+	// serves.
+	transfers *servedTransfers
 }
 
 func (vl *legsValidator) ValidatePush(
@@ -64,20 +104,35 @@ func (vl *legsValidator) ValidatePush(
 
 func (vl *legsValidator) ValidatePull(
 	_ bool,
-	_ datatransfer.ChannelID,
+	chid datatransfer.ChannelID,
 	peerID peer.ID,
 	voucher datatransfer.Voucher,
-	_ cid.Cid,
-	_ ipld.Node) (datatransfer.VoucherResult, error) {
+	baseCid cid.Cid,
+	selector ipld.Node) (datatransfer.VoucherResult, error) {
 
 	v := voucher.(*Voucher)
 	if v.Head == nil {
 		return nil, errors.New("invalid")
 	}
 
-	if vl.allowPeer != nil && !vl.allowPeer(peerID) {
+	if (vl.allowPeer != nil && !vl.allowPeer(peerID)) || !vl.acl.PeerAllowed(peerID) {
 		return nil, errors.New("peer not allowed")
 	}
 
-	return &VoucherResult{}, nil
+	// Requesters that predate protocol versioning do not send a topic.
+	if vl.topic != "" && v.Topic != "" && v.Topic != vl.topic {
+		return nil, fmt.Errorf("topic not served: %s", v.Topic)
+	}
+
+	if vl.validateRequest != nil {
+		if err := vl.validateRequest(peerID, baseCid, selector); err != nil {
+			return nil, fmt.Errorf("request not served: %w", err)
+		}
+	}
+
+	if err := vl.transfers.start(chid, peerID); err != nil {
+		return nil, err
+	}
+
+	return &VoucherResult{Version: ProtocolVersion}, nil
 }
@@ -23,18 +23,19 @@ func (t *Voucher) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write([]byte{161}); err != nil {
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write([]byte{163}); err != nil {
 		return err
 	}
 
-	scratch := make([]byte, 9)
-
 	// t.Head (cid.Cid) (struct)
 	if len("Head") > cbg.MaxLength {
 		return xerrors.Errorf("Value in field \"Head\" was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Head"))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Head"))); err != nil {
 		return err
 	}
 	if _, err := io.WriteString(w, string("Head")); err != nil {
@@ -42,28 +43,72 @@ func (t *Voucher) MarshalCBOR(w io.Writer) error {
 	}
 
 	if t.Head == nil {
-		if _, err := w.Write(cbg.CborNull); err != nil {
+		if _, err := cw.Write(cbg.CborNull); err != nil {
 			return err
 		}
 	} else {
-		if err := cbg.WriteCidBuf(scratch, w, *t.Head); err != nil {
+		if err := cbg.WriteCid(cw, *t.Head); err != nil {
 			return xerrors.Errorf("failed to write cid field t.Head: %w", err)
 		}
 	}
 
+	// t.Topic (string) (string)
+	if len("Topic") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Topic\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Topic"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Topic")); err != nil {
+		return err
+	}
+
+	if len(t.Topic) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.Topic was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Topic))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string(t.Topic)); err != nil {
+		return err
+	}
+
+	// t.Version (uint64) (uint64)
+	if len("Version") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Version\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Version"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Version")); err != nil {
+		return err
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Version)); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-func (t *Voucher) UnmarshalCBOR(r io.Reader) error {
+func (t *Voucher) UnmarshalCBOR(r io.Reader) (err error) {
 	*t = Voucher{}
 
-	br := cbg.GetPeeker(r)
-	scratch := make([]byte, 8)
+	cr := cbg.NewCborReader(r)
 
-	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err := cr.ReadHeader()
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
 	if maj != cbg.MajMap {
 		return fmt.Errorf("cbor input should be of type map")
 	}
@@ -78,7 +123,7 @@ func (t *Voucher) UnmarshalCBOR(r io.Reader) error {
 	for i := uint64(0); i < n; i++ {
 
 		{
-			sval, err := cbg.ReadString(br)
+			sval, err := cbg.ReadString(cr)
 			if err != nil {
 				return err
 			}
@@ -92,16 +137,16 @@ func (t *Voucher) UnmarshalCBOR(r io.Reader) error {
 
 			{
 
-				b, err := br.ReadByte()
+				b, err := cr.ReadByte()
 				if err != nil {
 					return err
 				}
 				if b != cbg.CborNull[0] {
-					if err := br.UnreadByte(); err != nil {
+					if err := cr.UnreadByte(); err != nil {
 						return err
 					}
 
-					c, err := cbg.ReadCid(br)
+					c, err := cbg.ReadCid(cr)
 					if err != nil {
 						return xerrors.Errorf("failed to read cid field t.Head: %w", err)
 					}
@@ -110,6 +155,32 @@ func (t *Voucher) UnmarshalCBOR(r io.Reader) error {
 				}
 
 			}
+			// t.Topic (string) (string)
+		case "Topic":
+
+			{
+				sval, err := cbg.ReadString(cr)
+				if err != nil {
+					return err
+				}
+
+				t.Topic = string(sval)
+			}
+			// t.Version (uint64) (uint64)
+		case "Version":
+
+			{
+
+				maj, extra, err = cr.ReadHeader()
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.Version = uint64(extra)
+
+			}
 
 		default:
 			// Field doesn't exist on this type, so ignore it
@@ -124,41 +195,63 @@ func (t *VoucherResult) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write([]byte{161}); err != nil {
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write([]byte{162}); err != nil {
 		return err
 	}
 
-	scratch := make([]byte, 9)
-
 	// t.Code (uint64) (uint64)
 	if len("Code") > cbg.MaxLength {
 		return xerrors.Errorf("Value in field \"Code\" was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Code"))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Code"))); err != nil {
 		return err
 	}
 	if _, err := io.WriteString(w, string("Code")); err != nil {
 		return err
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Code)); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Code)); err != nil {
+		return err
+	}
+
+	// t.Version (uint64) (uint64)
+	if len("Version") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Version\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Version"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Version")); err != nil {
+		return err
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Version)); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (t *VoucherResult) UnmarshalCBOR(r io.Reader) error {
+func (t *VoucherResult) UnmarshalCBOR(r io.Reader) (err error) {
 	*t = VoucherResult{}
 
-	br := cbg.GetPeeker(r)
-	scratch := make([]byte, 8)
+	cr := cbg.NewCborReader(r)
 
-	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err := cr.ReadHeader()
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
 	if maj != cbg.MajMap {
 		return fmt.Errorf("cbor input should be of type map")
 	}
@@ -173,7 +266,7 @@ func (t *VoucherResult) UnmarshalCBOR(r io.Reader) error {
 	for i := uint64(0); i < n; i++ {
 
 		{
-			sval, err := cbg.ReadString(br)
+			sval, err := cbg.ReadString(cr)
 			if err != nil {
 				return err
 			}
@@ -187,7 +280,7 @@ func (t *VoucherResult) UnmarshalCBOR(r io.Reader) error {
 
 			{
 
-				maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+				maj, extra, err = cr.ReadHeader()
 				if err != nil {
 					return err
 				}
@@ -197,6 +290,21 @@ func (t *VoucherResult) UnmarshalCBOR(r io.Reader) error {
 				t.Code = uint64(extra)
 
 			}
+			// t.Version (uint64) (uint64)
+		case "Version":
+
+			{
+
+				maj, extra, err = cr.ReadHeader()
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.Version = uint64(extra)
+
+			}
 
 		default:
 			// Field doesn't exist on this type, so ignore it
@@ -0,0 +1,180 @@
+package legs
+
+import (
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// EvtAnnouncementReceived is emitted on the host's event bus when an
+// announcement is received. See: HostEvents.
+type EvtAnnouncementReceived struct {
+	AnnouncementReceived
+}
+
+// EvtSyncStarted is emitted on the host's event bus when a sync starts. See:
+// HostEvents.
+type EvtSyncStarted struct {
+	SyncStarted
+}
+
+// EvtSyncFinished is emitted on the host's event bus when a sync succeeds.
+// See: HostEvents.
+type EvtSyncFinished struct {
+	SyncEnded
+}
+
+// EvtSyncFailed is emitted on the host's event bus when a sync fails. See:
+// HostEvents.
+type EvtSyncFailed struct {
+	SyncEnded
+	// Reason is the metrics reason of the failure, such as "timeout". See:
+	// metrics.ReasonError.
+	Reason string
+}
+
+// EvtPublisherAdded is emitted on the host's event bus when the Subscriber
+// starts tracking a publisher, because of an announcement or a sync. See:
+// HostEvents.
+type EvtPublisherAdded struct {
+	// PeerID identifies the publisher.
+	PeerID peer.ID
+}
+
+// EvtPublisherEvicted is emitted on the host's event bus when the Subscriber
+// stops tracking a publisher. See: HostEvents.
+type EvtPublisherEvicted struct {
+	// PeerID identifies the publisher.
+	PeerID peer.ID
+	// Idle is true if the publisher was evicted because it was idle, and false
+	// if it was removed by Subscriber.RemoveHandler.
+	Idle bool
+}
+
+// hostEvents emits the events of a Subscriber on the host's event bus. It is
+// an EventSink for the announcement and sync events. A nil hostEvents emits
+// nothing.
+type hostEvents struct {
+	announce     event.Emitter
+	syncStarted  event.Emitter
+	syncFinished event.Emitter
+	syncFailed   event.Emitter
+	pubAdded     event.Emitter
+	pubEvicted   event.Emitter
+}
+
+// newHostEvents creates a hostEvents that emits events on bus.
+func newHostEvents(bus event.Bus) (*hostEvents, error) {
+	e := &hostEvents{}
+	emitters := []struct {
+		em  *event.Emitter
+		evt interface{}
+	}{
+		{&e.announce, new(EvtAnnouncementReceived)},
+		{&e.syncStarted, new(EvtSyncStarted)},
+		{&e.syncFinished, new(EvtSyncFinished)},
+		{&e.syncFailed, new(EvtSyncFailed)},
+		{&e.pubAdded, new(EvtPublisherAdded)},
+		{&e.pubEvicted, new(EvtPublisherEvicted)},
+	}
+	for _, em := range emitters {
+		var err error
+		if *em.em, err = bus.Emitter(em.evt); err != nil {
+			e.close()
+			return nil, fmt.Errorf("cannot create event bus emitter: %w", err)
+		}
+	}
+	return e, nil
+}
+
+// close closes the emitters.
+func (e *hostEvents) close() {
+	if e == nil {
+		return
+	}
+	for _, em := range []event.Emitter{e.announce, e.syncStarted, e.syncFinished, e.syncFailed, e.pubAdded, e.pubEvicted} {
+		if em != nil {
+			em.Close()
+		}
+	}
+}
+
+// emit emits evt, logging any error, such as from an emitter that was closed
+// by Subscriber.Close.
+func emit(em event.Emitter, evt interface{}) {
+	if err := em.Emit(evt); err != nil {
+		log.Debugw("Cannot emit event on host event bus", "err", err)
+	}
+}
+
+func (e *hostEvents) OnAnnounce(evt AnnouncementReceived) {
+	emit(e.announce, EvtAnnouncementReceived{evt})
+}
+
+func (e *hostEvents) OnSyncStart(evt SyncStarted) {
+	emit(e.syncStarted, EvtSyncStarted{evt})
+}
+
+func (e *hostEvents) OnBlock(peer.ID, cid.Cid) {}
+
+func (e *hostEvents) OnSyncEnd(evt SyncEnded) {
+	if evt.Err != nil {
+		emit(e.syncFailed, EvtSyncFailed{
+			SyncEnded: evt,
+			Reason:    syncFailReason(evt.Err),
+		})
+		return
+	}
+	emit(e.syncFinished, EvtSyncFinished{evt})
+}
+
+func (e *hostEvents) OnVerifyFailed(VerifyFailed) {}
+
+// publisherAdded emits an EvtPublisherAdded.
+func (e *hostEvents) publisherAdded(peerID peer.ID) {
+	if e != nil {
+		emit(e.pubAdded, EvtPublisherAdded{PeerID: peerID})
+	}
+}
+
+// publisherEvicted emits an EvtPublisherEvicted.
+func (e *hostEvents) publisherEvicted(peerID peer.ID, idle bool) {
+	if e != nil {
+		emit(e.pubEvicted, EvtPublisherEvicted{PeerID: peerID, Idle: idle})
+	}
+}
+
+// eventSinks is an EventSink that passes each event to every sink.
+type eventSinks []EventSink
+
+func (sinks eventSinks) OnAnnounce(event AnnouncementReceived) {
+	for _, sink := range sinks {
+		sink.OnAnnounce(event)
+	}
+}
+
+func (sinks eventSinks) OnSyncStart(event SyncStarted) {
+	for _, sink := range sinks {
+		sink.OnSyncStart(event)
+	}
+}
+
+func (sinks eventSinks) OnBlock(peerID peer.ID, c cid.Cid) {
+	for _, sink := range sinks {
+		sink.OnBlock(peerID, c)
+	}
+}
+
+func (sinks eventSinks) OnSyncEnd(event SyncEnded) {
+	for _, sink := range sinks {
+		sink.OnSyncEnd(event)
+	}
+}
+
+func (sinks eventSinks) OnVerifyFailed(event VerifyFailed) {
+	for _, sink := range sinks {
+		sink.OnVerifyFailed(event)
+	}
+}
@@ -0,0 +1,71 @@
+package legs_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/metrics"
+	"github.com/filecoin-project/go-legs/test"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	te := setupPublisherSubscriber(t, []legs.Option{legs.HostEvents(true)})
+	pubID := te.srcHost.ID()
+
+	sub, err := te.dstHost.EventBus().Subscribe([]interface{}{
+		new(legs.EvtPublisherAdded),
+		new(legs.EvtSyncStarted),
+		new(legs.EvtSyncFinished),
+		new(legs.EvtSyncFailed),
+		new(legs.EvtPublisherEvicted),
+	}, eventbus.BufSize(16))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	next := func() interface{} {
+		select {
+		case evt := <-sub.Out():
+			return evt
+		case <-ctx.Done():
+			t.Fatal("event not received")
+		}
+		return nil
+	}
+
+	head := test.MkChain(te.srcLinkSys, true)[0].(cidlink.Link).Cid
+	require.NoError(t, te.pub.SetRoot(ctx, head))
+	_, err = te.sub.Sync(ctx, pubID, head, nil, te.pubAddr)
+	require.NoError(t, err)
+
+	require.Equal(t, legs.EvtPublisherAdded{PeerID: pubID}, next())
+	started := next().(legs.EvtSyncStarted)
+	require.Equal(t, pubID, started.PeerID)
+	require.Equal(t, head, started.Cid)
+	finished := next().(legs.EvtSyncFinished)
+	require.Equal(t, pubID, finished.PeerID)
+	require.Equal(t, head, finished.Cid)
+	require.NotEmpty(t, finished.SyncedCids)
+
+	cids, err := test.RandomCids(1)
+	require.NoError(t, err)
+	_, err = te.sub.Sync(ctx, pubID, cids[0], nil, te.pubAddr)
+	require.Error(t, err)
+
+	require.IsType(t, legs.EvtSyncStarted{}, next())
+	failed := next().(legs.EvtSyncFailed)
+	require.Equal(t, pubID, failed.PeerID)
+	require.Equal(t, cids[0], failed.Cid)
+	require.Error(t, failed.Err)
+	require.Equal(t, metrics.ReasonNotFound, failed.Reason)
+
+	require.True(t, te.sub.RemoveHandler(pubID))
+	require.Equal(t, legs.EvtPublisherEvicted{PeerID: pubID}, next())
+}
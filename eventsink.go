@@ -0,0 +1,112 @@
+package legs
+
+import (
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// EventSink receives structured events of the announcements and syncs of a
+// Subscriber, so that they can be shipped to a logging or analytics system.
+// See: SyncEventSink.
+//
+// The methods are called synchronously from the sync paths of the Subscriber,
+// and may be called concurrently for different publishers. They must return
+// quickly, and must not call the Subscriber.
+type EventSink interface {
+	// OnAnnounce is called when an announcement is received, before any sync
+	// of the announced CID starts.
+	OnAnnounce(AnnouncementReceived)
+	// OnSyncStart is called when a sync starts.
+	OnSyncStart(SyncStarted)
+	// OnBlock is called for each block that a sync reaches, whether it was
+	// transferred or already stored. Blocks in the skip list are not
+	// reported.
+	OnBlock(peerID peer.ID, c cid.Cid)
+	// OnSyncEnd is called when a sync that was started ends, whether it
+	// succeeded or failed.
+	OnSyncEnd(SyncEnded)
+	// OnVerifyFailed is called for each synced block that fails periodic
+	// verification. See: VerifyInterval.
+	OnVerifyFailed(VerifyFailed)
+}
+
+// SyncStarted is the event of a sync starting. See: EventSink.
+type SyncStarted struct {
+	// PeerID identifies the publisher that is synced with.
+	PeerID peer.ID
+	// Cid is the CID that is synced.
+	Cid cid.Cid
+	// Source is what caused the sync.
+	Source SyncSource
+	// Started is when the sync started.
+	Started time.Time
+}
+
+// SyncEnded is the event of a sync ending. See: EventSink.
+type SyncEnded struct {
+	// PeerID identifies the publisher that was synced with.
+	PeerID peer.ID
+	// Cid is the CID that was synced.
+	Cid cid.Cid
+	// Source is what caused the sync.
+	Source SyncSource
+	// Duration is the time that the sync took.
+	Duration time.Duration
+	// SyncedCids lists the CIDs that the sync acquired. It is empty if the
+	// sync failed.
+	SyncedCids []cid.Cid
+	// Err is the error that the sync failed with, or nil if it succeeded.
+	Err error
+}
+
+// VerifyFailed is the event of a synced block failing periodic verification.
+// See: EventSink.
+type VerifyFailed struct {
+	// PeerID identifies the publisher that the block was synced from.
+	PeerID peer.ID
+	// Cid is the CID of the block that failed verification.
+	Cid cid.Cid
+	// Root is the CID of the sync that the block is part of.
+	Root cid.Cid
+	// Err is why the block failed verification, such as an error wrapping
+	// ErrBlockCorrupt.
+	Err error
+}
+
+// startSync reports the start of a sync to the Subscriber's metrics, event
+// sink, and status, and returns the sync's status and a function that reports
+// the end of the sync.
+func (s *Subscriber) startSync(peerID peer.ID, c cid.Cid, source SyncSource) (*activeSync, func(syncedCids []cid.Cid, err error)) {
+	start := time.Now()
+	s.metrics.SyncStarted()
+	active := s.syncStatus.start(peerID, c, source, start)
+	if s.eventSink != nil {
+		s.eventSink.OnSyncStart(SyncStarted{
+			PeerID:  peerID,
+			Cid:     c,
+			Source:  source,
+			Started: start,
+		})
+	}
+	return active, func(syncedCids []cid.Cid, err error) {
+		duration := time.Since(start)
+		s.syncStatus.end(active, err)
+		s.metrics.SyncFinished(duration, syncFailReason(err))
+		if s.eventSink == nil {
+			return
+		}
+		if err != nil {
+			syncedCids = nil
+		}
+		s.eventSink.OnSyncEnd(SyncEnded{
+			PeerID:     peerID,
+			Cid:        c,
+			Source:     source,
+			Duration:   duration,
+			SyncedCids: syncedCids,
+			Err:        err,
+		})
+	}
+}
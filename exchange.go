@@ -0,0 +1,93 @@
+package legs
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// PublishersProtocolPrefix is the prefix of the protocol ID that a
+	// Subscriber serves its known publishers on.
+	PublishersProtocolPrefix = "/legs/publishers"
+	// PublishersProtocolVersion is the version of the protocol that a
+	// Subscriber serves its known publishers on.
+	PublishersProtocolVersion = "0.0.1"
+
+	// publishersStreamTimeout is the time allowed to write or read the known
+	// publishers over a stream.
+	publishersStreamTimeout = 30 * time.Second
+)
+
+// PublishersProtocolID returns the libp2p protocol ID that a Subscriber serves
+// the publishers it knows on topic on. See: ServePublishers.
+func PublishersProtocolID(topic string) protocol.ID {
+	return protocol.ID(path.Join(PublishersProtocolPrefix, topic, PublishersProtocolVersion))
+}
+
+// BootstrapPublishers fetches the publishers known to the Subscriber on the
+// specified peer, which must serve them with the ServePublishers option on the
+// same topic. The latest sync and addresses of each fetched publisher are
+// imported the same as with ImportState, except that the latest sync of a
+// publisher that already has one is kept. This lets a new Subscriber start from
+// the publisher set and latest heads of an existing one.
+//
+// Returns the number of publishers whose latest sync was set.
+func (s *Subscriber) BootstrapPublishers(ctx context.Context, peerID peer.ID) (int, error) {
+	topic := s.receiver.TopicName()
+	stream, err := s.host.NewStream(ctx, peerID, PublishersProtocolID(topic))
+	if err != nil {
+		return 0, fmt.Errorf("cannot open publishers stream to %s: %w", peerID, err)
+	}
+	defer stream.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetReadDeadline(deadline)
+	} else {
+		stream.SetReadDeadline(time.Now().Add(publishersStreamTimeout))
+	}
+	stream.CloseWrite()
+
+	state, err := readState(stream)
+	if err != nil {
+		stream.Reset()
+		return 0, fmt.Errorf("cannot read publishers from %s: %w", peerID, err)
+	}
+	if state.Topic != topic {
+		return 0, fmt.Errorf("publishers from %s are for topic %s", peerID, state.Topic)
+	}
+
+	// Do not import this host as a publisher.
+	pubs := state.Publishers[:0]
+	for _, pub := range state.Publishers {
+		if pub.PeerID != s.host.ID() {
+			pubs = append(pubs, pub)
+		}
+	}
+	state.Publishers = pubs
+
+	n, err := s.importState(state, true)
+	if err != nil {
+		return n, err
+	}
+	log.Infow("Bootstrapped publishers", "new", n, "fetched", len(state.Publishers), "peer", peerID, "topic", topic)
+	return n, nil
+}
+
+// handlePublishersStream writes the state of the Subscriber, the same as
+// ExportState, to a stream opened by the BootstrapPublishers of another
+// Subscriber.
+func (s *Subscriber) handlePublishersStream(stream network.Stream) {
+	defer stream.Close()
+	stream.SetWriteDeadline(time.Now().Add(publishersStreamTimeout))
+	if err := s.ExportState(stream); err != nil {
+		log.Errorw("Cannot send publishers", "err", err, "peer", stream.Conn().RemotePeer())
+		stream.Reset()
+		return
+	}
+	log.Debugw("Sent publishers", "peer", stream.Conn().RemotePeer())
+}
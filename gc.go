@@ -0,0 +1,209 @@
+package legs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// DeleteBlockFunc is the signature of a function that deletes the block
+// identified by a CID from the local store. It is used by CollectGarbage,
+// since a link system has no way to delete blocks.
+type DeleteBlockFunc func(context.Context, cid.Cid) error
+
+// DatastoreBlockDeleter returns a DeleteBlockFunc that deletes blocks from ds,
+// for a link system that stores each block in ds with the CID string as its
+// key.
+func DatastoreBlockDeleter(ds datastore.Datastore) DeleteBlockFunc {
+	return func(ctx context.Context, c cid.Cid) error {
+		return ds.Delete(ctx, datastore.NewKey(c.String()))
+	}
+}
+
+// BlockstoreBlockDeleter returns a DeleteBlockFunc that deletes blocks from bs,
+// for a Subscriber created by NewSubscriberWithBlockstore.
+func BlockstoreBlockDeleter(bs blockstore.Blockstore) DeleteBlockFunc {
+	return bs.DeleteBlock
+}
+
+// CollectGarbage deletes the stored blocks of publishers' chains that are
+// older than the retention horizon, so that the local store of a long-running
+// Subscriber does not grow without bound. latest maps each publisher to the
+// head of its chain, usually the latest sync with the publisher. See:
+// GetLatestSync.
+//
+// The chain of each publisher is walked from its head with the default
+// selector sequence. Blocks that are reached with a recursion limit of depth
+// are kept, and all other blocks of the chain that are stored are deleted by
+// deleteBlock. With the default selector sequence, this keeps the depth most
+// recent entries of the chain, starting with the head. A block that is kept
+// for any publisher is not deleted. Blocks that are not stored, such as those
+// deleted by a previous collection, end the walk of that part of the chain.
+//
+// If publishers have their own link systems, set by PublisherLinkSystems, then
+// each chain is walked in its publisher's link system. Collect the garbage of
+// each publisher separately, with latest holding only that publisher and
+// deleteBlock deleting from its store.
+//
+// Returns the number of blocks deleted. The sync lock of each publisher is
+// held while its chain is collected, so that blocks are not deleted while they
+// are being synced.
+func (s *Subscriber) CollectGarbage(ctx context.Context, latest map[peer.ID]cid.Cid, depth int64, deleteBlock DeleteBlockFunc) (int, error) {
+	if depth < 1 {
+		return 0, errors.New("retention depth must be at least 1")
+	}
+	if deleteBlock == nil {
+		return 0, errors.New("nil block deleter")
+	}
+
+	keep := make(map[cid.Cid]struct{})
+	for peerID, head := range latest {
+		if head == cid.Undef {
+			continue
+		}
+		keepSel := ExploreRecursiveWithStopNode(selector.RecursionLimitDepth(depth), s.selectorSequenceFor(peerID), nil)
+		err := s.walkStored(ctx, peerID, head, keepSel, func(c cid.Cid) {
+			keep[c] = struct{}{}
+		})
+		if err != nil {
+			return 0, fmt.Errorf("cannot walk retained chain of peer %s: %w", peerID, err)
+		}
+	}
+
+	var deleted int
+	for peerID, head := range latest {
+		if head == cid.Undef {
+			continue
+		}
+		allSel := ExploreRecursiveWithStopNode(selector.RecursionLimitNone(), s.selectorSequenceFor(peerID), nil)
+		n, err := s.collectChain(ctx, peerID, head, allSel, keep, deleteBlock)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+		log.Infow("Collected garbage of chain", "head", head, "peer", peerID, "deleted", n)
+	}
+	return deleted, nil
+}
+
+// collectChain deletes the stored blocks of the chain with the given head that
+// are not in keep.
+func (s *Subscriber) collectChain(ctx context.Context, peerID peer.ID, head cid.Cid, sel ipld.Node, keep map[cid.Cid]struct{}, deleteBlock DeleteBlockFunc) (int, error) {
+	s.handlersMutex.Lock()
+	hnd, ok := s.handlers[peerID]
+	s.handlersMutex.Unlock()
+	if ok {
+		hnd.syncMutex.Lock()
+		defer hnd.syncMutex.Unlock()
+	}
+
+	var garbage []cid.Cid
+	err := s.walkStored(ctx, peerID, head, sel, func(c cid.Cid) {
+		if _, ok := keep[c]; !ok {
+			garbage = append(garbage, c)
+		}
+	})
+	if err != nil {
+		return 0, fmt.Errorf("cannot walk chain of peer %s: %w", peerID, err)
+	}
+
+	lsys := s.linkSystemFor(peerID)
+	for i, c := range garbage {
+		// Deleted blocks no longer count against the publisher's storage
+		// quota.
+		var size int64
+		if s.quotas != nil {
+			if size, err = storedSize(ctx, lsys, c); err != nil {
+				return i, fmt.Errorf("cannot read size of block %s: %w", c, err)
+			}
+		}
+		if err = deleteBlock(ctx, c); err != nil {
+			return i, fmt.Errorf("cannot delete block %s: %w", c, err)
+		}
+		s.quotas.release(ctx, peerID, size)
+		// Do not delete the block again if it is linked from another chain.
+		keep[c] = struct{}{}
+	}
+	return len(garbage), nil
+}
+
+// storedSize returns the size of the block c stored in lsys.
+func storedSize(ctx context.Context, lsys ipld.LinkSystem, c cid.Cid) (int64, error) {
+	r, err := lsys.StorageReadOpener(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c})
+	if err != nil {
+		return 0, err
+	}
+	if cl, ok := r.(io.Closer); ok {
+		defer cl.Close()
+	}
+	return io.Copy(io.Discard, r)
+}
+
+// walkStored traverses the blocks stored in the publisher's link system that
+// are reached from root by sel, and calls visit once for each. Blocks that are
+// not stored, or are in the skip list, are not traversed.
+func (s *Subscriber) walkStored(ctx context.Context, peerID peer.ID, root cid.Cid, sel ipld.Node, visit func(cid.Cid)) error {
+	return s.walkLinkSystem(ctx, s.linkSystemFor(peerID), root, sel, visit)
+}
+
+// walkLinkSystem is the same as walkStored, but traverses the blocks stored in
+// storeLsys, such as the link system of a staging area.
+func (s *Subscriber) walkLinkSystem(ctx context.Context, storeLsys ipld.LinkSystem, root cid.Cid, sel ipld.Node, visit func(cid.Cid)) error {
+	visited := s.syncState.newSet()
+	defer visited.discard(context.Background())
+	lsys := storeLsys
+	lsys.StorageReadOpener = func(lc ipld.LinkContext, l ipld.Link) (io.Reader, error) {
+		c := l.(cidlink.Link).Cid
+		if s.skipList.has(c) {
+			return nil, traversal.SkipMe{}
+		}
+		r, err := storeLsys.StorageReadOpener(lc, l)
+		if err != nil {
+			return nil, traversal.SkipMe{}
+		}
+		added, err := visited.add(ctx, c)
+		if err != nil {
+			return nil, fmt.Errorf("cannot record visited block: %w", err)
+		}
+		if added {
+			visit(c)
+		}
+		return r, nil
+	}
+
+	csel, err := selector.CompileSelector(sel)
+	if err != nil {
+		return fmt.Errorf("cannot compile selector: %w", err)
+	}
+	progress := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     lsys,
+			LinkTargetNodePrototypeChooser: basicnode.Chooser,
+		},
+		Path: datamodel.NewPath([]datamodel.PathSegment{}),
+	}
+	rootNode, err := lsys.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: root}, basicnode.Prototype.Any)
+	if err != nil {
+		if errors.Is(err, traversal.SkipMe{}) {
+			// The root is not stored, so there is nothing to walk.
+			return nil
+		}
+		return err
+	}
+	return progress.WalkMatching(rootNode, csel, func(traversal.Progress, datamodel.Node) error {
+		return nil
+	})
+}
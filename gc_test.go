@@ -0,0 +1,57 @@
+package legs_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	pubSys := newHostSystem(t)
+	subSys := newHostSystem(t)
+	defer pubSys.close()
+	defer subSys.close()
+
+	pubAddr, pub, sub := legsPubSubBuilder{}.Build(t, testTopic, pubSys, subSys, nil)
+	defer pub.Close()
+	defer sub.Close()
+
+	ctx := context.Background()
+	head := llBuilder{Length: 5, Seed: 1}.Build(t, pubSys.lsys)
+	headCid := head.(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(ctx, headCid))
+
+	var syncedCids []cid.Cid
+	blockHook := func(_ peer.ID, c cid.Cid, _ legs.SegmentSyncActions) {
+		syncedCids = append(syncedCids, c)
+	}
+	_, err := sub.Sync(ctx, pubSys.host.ID(), headCid, nil, pubAddr, legs.ScopedBlockHook(blockHook))
+	require.NoError(t, err)
+	require.Len(t, syncedCids, 5)
+
+	latest := map[peer.ID]cid.Cid{pubSys.host.ID(): headCid}
+	deleteBlock := legs.DatastoreBlockDeleter(subSys.ds)
+	deleted, err := sub.CollectGarbage(ctx, latest, 3, deleteBlock)
+	require.NoError(t, err)
+	require.Equal(t, 2, deleted)
+
+	for i, c := range syncedCids {
+		has, err := subSys.ds.Has(ctx, datastore.NewKey(c.String()))
+		require.NoError(t, err)
+		require.Equal(t, i < 3, has, "block %d of chain", i)
+	}
+
+	// Nothing more is deleted, since the older blocks are already gone.
+	deleted, err = sub.CollectGarbage(ctx, latest, 3, deleteBlock)
+	require.NoError(t, err)
+	require.Zero(t, deleted)
+
+	_, err = sub.CollectGarbage(ctx, latest, 0, deleteBlock)
+	require.Error(t, err)
+}
@@ -0,0 +1,96 @@
+// Package headregistry keeps the roots of publishers that publish the same DAG
+// over different transports consistent, so that a process that publishes with
+// both a dtsync and an httpsync publisher always reports the same root on each.
+package headregistry
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/ipfs/go-cid"
+)
+
+// SetRootFunc sets the root of one publisher, without setting it on any other.
+type SetRootFunc func(context.Context, cid.Cid) error
+
+// Registry sets a root on all of the publishers registered with it. Roots are
+// set one at a time, so that concurrent updates cannot leave publishers with
+// different roots. A Registry is safe for concurrent use.
+type Registry struct {
+	members map[*member]struct{}
+	root    cid.Cid
+	mutex   sync.Mutex
+}
+
+// member is a registered publisher.
+type member struct {
+	setRoot SetRootFunc
+}
+
+// New creates a Registry that has no publishers and no root.
+func New() *Registry {
+	return &Registry{
+		members: make(map[*member]struct{}),
+	}
+}
+
+// Register adds a publisher, whose root is set with setRoot, and returns a
+// function that removes it. The publisher's current root is given as root, or
+// cid.Undef if it has none. If the registry already has a root, then it is set
+// on the publisher. Otherwise, the registry adopts the publisher's root, and
+// sets it on the other publishers.
+func (r *Registry) Register(ctx context.Context, root cid.Cid, setRoot SetRootFunc) (func(), error) {
+	m := &member{
+		setRoot: setRoot,
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var err error
+	if r.root != cid.Undef {
+		if r.root != root {
+			err = setRoot(ctx, r.root)
+		}
+	} else if root != cid.Undef {
+		err = r.setRoot(ctx, root)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.members[m] = struct{}{}
+
+	return func() {
+		r.mutex.Lock()
+		delete(r.members, m)
+		r.mutex.Unlock()
+	}, nil
+}
+
+// SetRoot sets the root on every registered publisher. The registry's root is
+// updated even if some publishers fail to set it, and their errors are
+// returned together.
+func (r *Registry) SetRoot(ctx context.Context, c cid.Cid) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.setRoot(ctx, c)
+}
+
+func (r *Registry) setRoot(ctx context.Context, c cid.Cid) error {
+	r.root = c
+	var errs error
+	for m := range r.members {
+		if err := m.setRoot(ctx, c); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Root returns the root most recently set, or cid.Undef if no root is set.
+func (r *Registry) Root() cid.Cid {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.root
+}
@@ -0,0 +1,107 @@
+package headregistry
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	cidA = cid.MustParse("bafyreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku")
+	cidB = cid.MustParse("bafyreibjo4xmgaevkgud7mbifn3dzp4v4lyaui4yvqp3f2bqwtxcjrdqg4")
+)
+
+// testMember is a publisher that records the roots set on it.
+type testMember struct {
+	root cid.Cid
+	sets int
+	err  error
+}
+
+func (m *testMember) setRoot(_ context.Context, c cid.Cid) error {
+	m.sets++
+	if m.err != nil {
+		return m.err
+	}
+	m.root = c
+	return nil
+}
+
+func TestSetRoot(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+	var a, b testMember
+	unregisterA, err := r.Register(ctx, cid.Undef, a.setRoot)
+	require.NoError(t, err)
+	_, err = r.Register(ctx, cid.Undef, b.setRoot)
+	require.NoError(t, err)
+	require.Zero(t, a.sets)
+	require.Equal(t, cid.Undef, r.Root())
+
+	require.NoError(t, r.SetRoot(ctx, cidA))
+	require.Equal(t, cidA, a.root)
+	require.Equal(t, cidA, b.root)
+	require.Equal(t, cidA, r.Root())
+
+	// An unregistered publisher is no longer set.
+	unregisterA()
+	require.NoError(t, r.SetRoot(ctx, cidB))
+	require.Equal(t, cidA, a.root)
+	require.Equal(t, cidB, b.root)
+}
+
+func TestRegisterRoot(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+
+	// The registry adopts the root of the first publisher that has one, and
+	// sets it on the others.
+	var a, b, c testMember
+	_, err := r.Register(ctx, cid.Undef, a.setRoot)
+	require.NoError(t, err)
+	_, err = r.Register(ctx, cidA, b.setRoot)
+	require.NoError(t, err)
+	require.Equal(t, cidA, r.Root())
+	require.Equal(t, cidA, a.root)
+	require.Zero(t, b.sets)
+
+	// A publisher that registers later is given the registry's root, and is
+	// not set again if it already has it.
+	_, err = r.Register(ctx, cidB, c.setRoot)
+	require.NoError(t, err)
+	require.Equal(t, cidA, c.root)
+	require.Equal(t, cidA, r.Root())
+
+	var d testMember
+	_, err = r.Register(ctx, cidA, d.setRoot)
+	require.NoError(t, err)
+	require.Zero(t, d.sets)
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+	require.NoError(t, r.SetRoot(ctx, cidA))
+
+	// A publisher that cannot be given the registry's root is not registered.
+	failed := testMember{err: errors.New("failed")}
+	_, err := r.Register(ctx, cid.Undef, failed.setRoot)
+	require.ErrorIs(t, err, failed.err)
+	require.NoError(t, r.SetRoot(ctx, cidB))
+	require.Equal(t, 1, failed.sets)
+
+	// The root is set on the other publishers when one fails.
+	var a testMember
+	b := testMember{err: errors.New("b failed")}
+	_, err = r.Register(ctx, cid.Undef, a.setRoot)
+	require.NoError(t, err)
+	_, err = r.Register(ctx, cidB, b.setRoot)
+	require.NoError(t, err)
+	err = r.SetRoot(ctx, cidA)
+	require.ErrorIs(t, err, b.err)
+	require.Equal(t, cidA, a.root)
+	require.Equal(t, cidA, r.Root())
+}
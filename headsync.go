@@ -0,0 +1,58 @@
+package legs
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+)
+
+// headSyncs tracks the heads that are being synced, so that a sync of a head
+// that another publisher's sync is already syncing can wait for that sync and
+// then complete from the stored blocks. A nil headSyncs tracks nothing.
+type headSyncs struct {
+	inFlight map[cid.Cid]chan struct{}
+	mutex    sync.Mutex
+}
+
+// newHeadSyncs creates a headSyncs if enable is true, and otherwise returns
+// nil.
+func newHeadSyncs(enable bool) *headSyncs {
+	if !enable {
+		return nil
+	}
+	return &headSyncs{
+		inFlight: make(map[cid.Cid]chan struct{}),
+	}
+}
+
+// start waits until no other sync of the head c is in flight, and then
+// records a sync of c as in flight. The returned function must be called when
+// the sync is finished. Returns an error if ctx is canceled while waiting.
+func (hs *headSyncs) start(ctx context.Context, c cid.Cid) (func(), error) {
+	if hs == nil {
+		return func() {}, nil
+	}
+	for {
+		hs.mutex.Lock()
+		done, ok := hs.inFlight[c]
+		if !ok {
+			done = make(chan struct{})
+			hs.inFlight[c] = done
+			hs.mutex.Unlock()
+			return func() {
+				hs.mutex.Lock()
+				delete(hs.inFlight, c)
+				hs.mutex.Unlock()
+				close(done)
+			}, nil
+		}
+		hs.mutex.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package legs_test
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"strings"
@@ -8,7 +9,11 @@ import (
 	"time"
 
 	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/announce/gossiptopic"
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/headregistry"
 	"github.com/filecoin-project/go-legs/httpsync"
+	"github.com/filecoin-project/go-legs/p2p/protocol/head"
 	"github.com/filecoin-project/go-legs/test"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
@@ -250,3 +255,292 @@ func TestSyncFnHttp(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestHttpPublisherPubsubAnnounce(t *testing.T) {
+	srcPrivKey, _, err := ic.GenerateECDSAKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal("Err generating private key", err)
+	}
+	srcHost := test.MkTestHost(libp2p.Identity(srcPrivKey))
+	dstHost := test.MkTestHost()
+	defer srcHost.Close()
+	defer dstHost.Close()
+
+	topics := test.WaitForMeshWithMessage(t, testTopic, srcHost, dstHost)
+
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcLinkSys := test.MkLinkSystem(srcStore)
+	pub, err := httpsync.NewPublisherServer("127.0.0.1:0", srcLinkSys, srcHost.ID(), srcPrivKey,
+		httpsync.WithAnnounceTopic(topics[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstLinkSys := test.MkLinkSystem(dstStore)
+	sub, err := legs.NewSubscriber(dstHost, dstStore, dstLinkSys, testTopic, nil, legs.Topic(topics[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	watcher, cncl := sub.OnSyncFinished()
+	defer cncl()
+
+	// Updates are announced over pubsub and synced over HTTP.
+	chainLnks := test.MkChain(srcLinkSys, true)
+	err = newUpdateTest(pub, sub, dstStore, watcher, srcHost.ID(), chainLnks[2], false, chainLnks[2].(cidlink.Link).Cid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = newUpdateTest(pub, sub, dstStore, watcher, srcHost.ID(), chainLnks[0], false, chainLnks[0].(cidlink.Link).Cid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs := sub.HttpPeerStore().Addrs(srcHost.ID()); len(addrs) == 0 || !addrs[0].Equal(pub.Address()) {
+		t.Fatalf("expected http address %s in peerstore, got %v", pub.Address(), addrs)
+	}
+
+	// The announce host must have the publisher's peer ID.
+	_, err = httpsync.NewPublisherServer("127.0.0.1:0", srcLinkSys, srcHost.ID(), srcPrivKey,
+		httpsync.WithAnnounceHost(dstHost, testTopic))
+	if err == nil {
+		t.Fatal("expected error when announce host does not match peer id")
+	}
+}
+
+func TestHttpPublisherRepublish(t *testing.T) {
+	srcPrivKey, _, err := ic.GenerateECDSAKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal("Err generating private key", err)
+	}
+	srcHost := test.MkTestHost(libp2p.Identity(srcPrivKey))
+	dstHost := test.MkTestHost()
+	defer srcHost.Close()
+	defer dstHost.Close()
+
+	topics := test.WaitForMeshWithMessage(t, testTopic, srcHost, dstHost)
+
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcLinkSys := test.MkLinkSystem(srcStore)
+	pub, err := httpsync.NewPublisherServer("127.0.0.1:0", srcLinkSys, srcHost.ID(), srcPrivKey,
+		httpsync.WithAnnounceTopic(topics[0]), httpsync.WithRepublishInterval(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	sub, err := topics[1].Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Cancel()
+
+	// The root is set without announcing it, and is re-announced periodically.
+	chainLnks := test.MkChain(srcLinkSys, true)
+	root := chainLnks[0].(cidlink.Link).Cid
+	ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+	defer cancel()
+	if err = pub.SetRoot(ctx, root); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := sub.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m gossiptopic.Message
+	if err = m.UnmarshalCBOR(bytes.NewBuffer(msg.Data)); err != nil {
+		t.Fatal(err)
+	}
+	if m.Cid != root {
+		t.Fatalf("expected re-announced root %s, got %s", root, m.Cid)
+	}
+}
+
+func TestHeadRegistry(t *testing.T) {
+	srcPrivKey, _, err := ic.GenerateECDSAKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal("Err generating private key", err)
+	}
+	srcHost := test.MkTestHost(libp2p.Identity(srcPrivKey))
+	dstHost := test.MkTestHost()
+	defer srcHost.Close()
+	defer dstHost.Close()
+	srcHost.Peerstore().AddAddrs(dstHost.ID(), dstHost.Addrs(), time.Hour)
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcLinkSys := test.MkLinkSystem(srcStore)
+	chainLnks := test.MkChain(srcLinkSys, true)
+	ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+	defer cancel()
+
+	// Persist a root that the HTTP publisher restores.
+	httpStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	pub, err := httpsync.NewPublisherServer("127.0.0.1:0", srcLinkSys, srcHost.ID(), srcPrivKey,
+		httpsync.WithDatastore(httpStore))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := chainLnks[2].(cidlink.Link).Cid
+	if err = pub.SetRoot(ctx, restored); err != nil {
+		t.Fatal(err)
+	}
+	pub.Close()
+
+	registry := headregistry.New()
+	httpPub, err := httpsync.NewPublisherServer("127.0.0.1:0", srcLinkSys, srcHost.ID(), srcPrivKey,
+		httpsync.WithDatastore(httpStore), httpsync.WithHeadRegistry(registry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpPub.Close()
+	dtPub, err := dtsync.NewPublisher(srcHost, dssync.MutexWrap(datastore.NewMapDatastore()), srcLinkSys, testTopic,
+		dtsync.WithHeadRegistry(registry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dtPub.Close()
+
+	var _ legs.HeadPublisher = head.NewPublisher()
+	headPubs := []legs.HeadPublisher{httpPub, dtPub}
+	checkHeads := func(want cid.Cid) {
+		t.Helper()
+		for _, hp := range headPubs {
+			if got := hp.Root(); got != want {
+				t.Fatalf("expected root %s, got %s", want, got)
+			}
+		}
+		// Syncers over both transports get the same head.
+		got, err := head.QueryRootCid(ctx, dstHost, testTopic, srcHost.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("expected dtsync head %s, got %s", want, got)
+		}
+		syncer, err := httpsync.NewSync(srcLinkSys, nil, nil).NewSyncer(srcHost.ID(), httpPub.Address(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err = syncer.GetHead(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("expected httpsync head %s, got %s", want, got)
+		}
+	}
+
+	// The dtsync publisher starts with the root restored by the HTTP
+	// publisher, and setting the root on either sets it on both.
+	checkHeads(restored)
+	root := chainLnks[1].(cidlink.Link).Cid
+	if err = dtPub.UpdateRoot(ctx, root); err != nil {
+		t.Fatal(err)
+	}
+	checkHeads(root)
+	root = chainLnks[0].(cidlink.Link).Cid
+	if err = httpPub.SetRoot(ctx, root); err != nil {
+		t.Fatal(err)
+	}
+	checkHeads(root)
+	if registry.Root() != root {
+		t.Fatalf("expected registry root %s, got %s", root, registry.Root())
+	}
+}
+
+func TestHttpAnnouncedAddrs(t *testing.T) {
+	srcPrivKey, _, err := ic.GenerateECDSAKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal("Err generating private key", err)
+	}
+	srcHost := test.MkTestHost(libp2p.Identity(srcPrivKey))
+	dstHost := test.MkTestHost()
+	defer srcHost.Close()
+	defer dstHost.Close()
+
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcLinkSys := test.MkLinkSystem(srcStore)
+	chainLnks := test.MkChain(srcLinkSys, true)
+	pubA, err := httpsync.NewPublisherServer("127.0.0.1:0", srcLinkSys, srcHost.ID(), srcPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pubA.Close()
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstLinkSys := test.MkLinkSystem(dstStore)
+	sub, err := legs.NewSubscriber(dstHost, dstStore, dstLinkSys, testTopic, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	watcher, cncl := sub.OnSyncFinished()
+	defer cncl()
+
+	ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+	defer cancel()
+	announce := func(c cid.Cid, addrs ...multiaddr.Multiaddr) {
+		t.Helper()
+		if err := sub.Announce(ctx, c, srcHost.ID(), addrs); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case event := <-watcher:
+			if event.Cid != c {
+				t.Fatalf("expected sync of %s, got %s", c, event.Cid)
+			}
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for sync")
+		}
+	}
+
+	root := chainLnks[2].(cidlink.Link).Cid
+	if err = pubA.SetRoot(ctx, root); err != nil {
+		t.Fatal(err)
+	}
+	announce(root, pubA.Address())
+
+	// The publisher moves to another address, and announces it together with
+	// a libp2p address.
+	pubB, err := httpsync.NewPublisherServer("127.0.0.1:0", srcLinkSys, srcHost.ID(), srcPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pubB.Close()
+	pubA.Close()
+	root = chainLnks[1].(cidlink.Link).Cid
+	if err = pubB.SetRoot(ctx, root); err != nil {
+		t.Fatal(err)
+	}
+	p2pAddr := multiaddr.StringCast("/ip4/192.0.2.1/tcp/3104")
+	announce(root, p2pAddr, pubB.Address())
+
+	// The address that is no longer announced is expired, and each announced
+	// address is stored in its peerstore.
+	httpAddrs := sub.HttpPeerStore().Addrs(srcHost.ID())
+	if len(httpAddrs) != 1 || !httpAddrs[0].Equal(pubB.Address()) {
+		t.Fatalf("expected only http address %s in peerstore, got %v", pubB.Address(), httpAddrs)
+	}
+	var found bool
+	for _, addr := range dstHost.Peerstore().Addrs(srcHost.ID()) {
+		found = found || addr.Equal(p2pAddr)
+	}
+	if !found {
+		t.Fatalf("expected announced address %s in libp2p peerstore", p2pAddr)
+	}
+
+	// A sync without an address uses the announced address.
+	root = chainLnks[0].(cidlink.Link).Cid
+	if err = pubB.SetRoot(ctx, root); err != nil {
+		t.Fatal(err)
+	}
+	synced, err := sub.Sync(ctx, srcHost.ID(), cid.Undef, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if synced != root {
+		t.Fatalf("expected sync of %s, got %s", root, synced)
+	}
+}
@@ -0,0 +1,50 @@
+package httpsync
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/filecoin-project/go-legs/acl"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// restrictRequests returns a handler that serves the requests from IP
+// addresses, or peers for requests over libp2p streams, allowed by l with
+// next, and responds to the others with http.StatusForbidden. Returns next if
+// l is nil.
+func restrictRequests(next http.Handler, l *acl.List) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowed(l, remoteHost(r)) {
+			log.Infow("Rejected request from address not allowed", "remote", r.RemoteAddr)
+			http.Error(w, "address not allowed", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowed returns true if l allows the remote host, which is an IP address,
+// or a peer ID for requests over libp2p streams.
+func allowed(l *acl.List, remote string) bool {
+	if ip := net.ParseIP(remote); ip != nil {
+		return l.IPAllowed(ip)
+	}
+	if peerID, err := peer.Decode(remote); err == nil {
+		return l.PeerAllowed(peerID)
+	}
+	return false
+}
+
+// remoteHost returns the host, without the port, of the client that sent the
+// request. For a request over a libp2p stream, this is the peer ID of the
+// client.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,296 @@
+package httpsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"sync"
+
+	"github.com/filecoin-project/go-legs/carutil"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagjson"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// carSuffix is appended to a CID in the request path to request the DAG
+	// selected from the CID as a CAR stream.
+	carSuffix = ".car"
+	// carSelectorParam is the query parameter that holds the selector of a CAR
+	// stream request.
+	carSelectorParam = "selector"
+	// carSupportHeader is set in the head and block responses of a publisher
+	// that serves CAR streams.
+	carSupportHeader = "X-Legs-Car-Stream"
+	// carContentType is the content type of a CAR stream response.
+	carContentType = "application/vnd.ipld.car; version=1"
+
+	// maxCarSelectorSize is the maximum size of the encoded selector of a CAR
+	// stream request.
+	maxCarSelectorSize = 4 << 10
+	// maxCarSelectorDepth is the maximum nesting depth of the selector of a
+	// CAR stream request.
+	maxCarSelectorDepth = 32
+	// maxCarBlocks is the maximum number of blocks loaded to serve a CAR
+	// stream. The stream ends once that many are loaded, and the syncer
+	// fetches any remaining blocks individually.
+	maxCarBlocks = 10000
+	// maxCarBuffer is the maximum number of bytes of a CAR stream that a
+	// syncer holds until its traversal reaches them. Any blocks after that
+	// are fetched individually.
+	maxCarBuffer = 64 << 20
+)
+
+// errCarBufferFull is returned when a CAR stream holds more blocks than fit in
+// the syncer's buffer.
+var errCarBufferFull = errors.New("car stream exceeds buffer size")
+
+// carSupport records which publishers are known to serve CAR streams.
+type carSupport struct {
+	peers map[peer.ID]bool
+	mutex sync.Mutex
+}
+
+// get returns whether the publisher serves CAR streams, and whether that is
+// known.
+func (cs *carSupport) get(peerID peer.ID) (bool, bool) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	supported, known := cs.peers[peerID]
+	return supported, known
+}
+
+func (cs *carSupport) set(peerID peer.ID, supported bool) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if cs.peers == nil {
+		cs.peers = make(map[peer.ID]bool)
+	}
+	cs.peers[peerID] = supported
+}
+
+// encodeSelector encodes a selector as dag-json with unpadded base64url, for
+// use in a URL query.
+func encodeSelector(sel ipld.Node) (string, error) {
+	var buf bytes.Buffer
+	if err := dagjson.Encode(sel, &buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decodeSelector decodes a selector encoded by encodeSelector. Returns an
+// error if the encoded selector is larger than maxCarSelectorSize, or is
+// nested deeper than maxCarSelectorDepth.
+func decodeSelector(encSel string) (ipld.Node, error) {
+	if len(encSel) > maxCarSelectorSize {
+		return nil, fmt.Errorf("selector larger than %d bytes", maxCarSelectorSize)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encSel)
+	if err != nil {
+		return nil, err
+	}
+	sel, err := ipld.DecodeUsingPrototype(data, dagjson.Decode, basicnode.Prototype.Any)
+	if err != nil {
+		return nil, err
+	}
+	if nodeDepth(sel, maxCarSelectorDepth+1) > maxCarSelectorDepth {
+		return nil, fmt.Errorf("selector nested deeper than %d", maxCarSelectorDepth)
+	}
+	return sel, nil
+}
+
+// nodeDepth returns the nesting depth of maps and lists in n, counting no
+// further than limit.
+func nodeDepth(n ipld.Node, limit int) int {
+	if limit == 0 {
+		return 0
+	}
+	var depth int
+	switch n.Kind() {
+	case datamodel.Kind_Map:
+		iter := n.MapIterator()
+		for !iter.Done() {
+			_, v, err := iter.Next()
+			if err != nil {
+				break
+			}
+			if d := nodeDepth(v, limit-1); d > depth {
+				depth = d
+			}
+		}
+	case datamodel.Kind_List:
+		iter := n.ListIterator()
+		for !iter.Done() {
+			_, v, err := iter.Next()
+			if err != nil {
+				break
+			}
+			if d := nodeDepth(v, limit-1); d > depth {
+				depth = d
+			}
+		}
+	default:
+		return 0
+	}
+	return depth + 1
+}
+
+// writeCar traverses the DAG selected from root by sel, and writes each block
+// to cw as the traversal loads it. Each block is loaded once, and written the
+// first time it is loaded. The traversal stops without error once
+// maxCarBlocks blocks are loaded.
+func writeCar(ctx context.Context, lsys ipld.LinkSystem, cw *carutil.WriterV1, rootNode ipld.Node, sel selector.Selector) error {
+	written := make(map[cid.Cid]struct{})
+	tlsys := lsys
+	tlsys.StorageReadOpener = func(lc ipld.LinkContext, l ipld.Link) (io.Reader, error) {
+		c := l.(cidlink.Link).Cid
+		data, err := lsys.LoadRaw(lc, l)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := written[c]; !ok {
+			written[c] = struct{}{}
+			if err = cw.Put(c, data); err != nil {
+				return nil, err
+			}
+		}
+		return bytes.NewReader(data), nil
+	}
+	progress := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     tlsys,
+			LinkTargetNodePrototypeChooser: basicnode.Chooser,
+		},
+		Path: datamodel.NewPath([]datamodel.PathSegment{}),
+		Budget: &traversal.Budget{
+			NodeBudget: math.MaxInt64,
+			// The root block is already loaded.
+			LinkBudget: maxCarBlocks - 1,
+		},
+	}
+	err := progress.WalkMatching(rootNode, sel, func(traversal.Progress, datamodel.Node) error {
+		return nil
+	})
+	var budgetErr *traversal.ErrBudgetExceeded
+	if errors.As(err, &budgetErr) {
+		return nil
+	}
+	return err
+}
+
+// decodeBlock decodes the data of the block identified by c, with the decoder
+// that lsys chooses for c.
+func decodeBlock(lsys ipld.LinkSystem, c cid.Cid, data []byte) (ipld.Node, error) {
+	decoder, err := lsys.DecoderChooser(cidlink.Link{Cid: c})
+	if err != nil {
+		return nil, err
+	}
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err = decoder(nb, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return nb.Build(), nil
+}
+
+// carBuffer holds the verified blocks of a CAR stream until the traversal of
+// the sync reaches them, so that only blocks selected by the sync are stored.
+type carBuffer struct {
+	blocks map[cid.Cid][]byte
+	size   int
+}
+
+// linkSystem returns a link system that stores blocks in the buffer, until
+// the buffer holds maxCarBuffer bytes.
+func (b *carBuffer) linkSystem() ipld.LinkSystem {
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageWriteOpener = func(ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		buf := bytes.NewBuffer(nil)
+		return buf, func(lnk ipld.Link) error {
+			if b.size+buf.Len() > maxCarBuffer {
+				return errCarBufferFull
+			}
+			b.blocks[lnk.(cidlink.Link).Cid] = buf.Bytes()
+			b.size += buf.Len()
+			return nil
+		}, nil
+	}
+	return lsys
+}
+
+// take removes the block identified by c from the buffer and returns its
+// data, or returns false if the buffer does not have the block.
+func (b *carBuffer) take(c cid.Cid) ([]byte, bool) {
+	if b == nil {
+		return nil, false
+	}
+	data, ok := b.blocks[c]
+	if ok {
+		delete(b.blocks, c)
+		b.size -= len(data)
+	}
+	return data, ok
+}
+
+// fetchCar fetches the DAG selected from nextCid by sel as a CAR stream, if
+// the publisher is known to serve CAR streams, and returns a carBuffer that
+// holds its blocks. Returns nil if no CAR stream was fetched.
+//
+// The blocks are verified against their CIDs as they are read, and those read
+// before any error are kept. The blocks are not stored until the traversal of
+// the sync reaches them, so that blocks outside of the selected DAG are never
+// stored. The traversal fetches any blocks that are missing individually.
+func (s *Syncer) fetchCar(ctx context.Context, nextCid cid.Cid, sel ipld.Node) *carBuffer {
+	if supported, _ := s.sync.carSupport.get(s.peerID); !supported {
+		return nil
+	}
+	encSel, err := encodeSelector(sel)
+	if err != nil {
+		log.Errorw("Failed to encode selector for car stream", "err", err)
+		return nil
+	}
+	buf := &carBuffer{
+		blocks: make(map[cid.Cid][]byte),
+	}
+	query := url.Values{carSelectorParam: []string{encSel}}
+	err = s.fetchQuery(ctx, nextCid.String()+carSuffix, query, func(r io.Reader) error {
+		_, err := carutil.Read(ctx, buf.linkSystem(), r)
+		return err
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Warnw("Failed to fetch car stream; fetching remaining blocks individually", "err", err, "peer", s.peerID)
+	}
+	return buf
+}
+
+// storeBuffered stores the block identified by c in the Syncer's link system
+// if it is held by buf. Returns false if buf does not hold the block.
+func (s *Syncer) storeBuffered(ctx context.Context, buf *carBuffer, c cid.Cid) (bool, error) {
+	data, ok := buf.take(c)
+	if !ok {
+		return false, nil
+	}
+	w, commit, err := s.lsys.StorageWriteOpener(ipld.LinkContext{Ctx: ctx})
+	if err != nil {
+		return false, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return false, err
+	}
+	if err = commit(cidlink.Link{Cid: c}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,194 @@
+package httpsync
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// acceptEncoding is the Accept-Encoding header that syncers send, listing the
+// content encodings that they decode.
+const acceptEncoding = "gzip, deflate"
+
+// compressResponses returns a handler that serves requests with next, and
+// compresses the responses with the content encoding preferred by the client,
+// of gzip and deflate. Range requests and WebSocket upgrades are not
+// compressed, and neither are responses with a status other than OK.
+func compressResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" || websocket.IsWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       encoding,
+		}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding returns the content encoding to use for a response, given
+// the request's Accept-Encoding header, or "" if the response is not to be
+// compressed. Of gzip and deflate, the one with the highest q-value is used,
+// preferring gzip if their q-values are equal. The response is not compressed
+// if neither is acceptable, or if identity has a higher q-value.
+func negotiateEncoding(accept string) string {
+	qvalues := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.TrimSpace(name) != "q" {
+				continue
+			}
+			if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				q = v
+			}
+		}
+		qvalues[coding] = q
+	}
+	qvalue := func(coding string) float64 {
+		if q, ok := qvalues[coding]; ok {
+			return q
+		}
+		return qvalues["*"]
+	}
+
+	encoding, best := "", 0.0
+	for _, coding := range []string{"gzip", "deflate"} {
+		if q := qvalue(coding); q > best {
+			encoding, best = coding, q
+		}
+	}
+	if q, ok := qvalues["identity"]; ok && q > best {
+		return ""
+	}
+	return encoding
+}
+
+// compressWriter compresses the body of an OK response.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	wroteHeader bool
+	// cw compresses the body. It is nil if the response is not compressed.
+	cw io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if status == http.StatusOK && h.Get("Content-Encoding") == "" {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.encoding)
+		// The compressed data differs from the data that a strong ETag
+		// identifies.
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		if w.encoding == "gzip" {
+			w.cw = gzip.NewWriter(w.ResponseWriter)
+		} else {
+			w.cw = zlib.NewWriter(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.cw == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.cw.Write(b)
+}
+
+// Hijack lets the handler take over the connection, if the underlying
+// ResponseWriter supports it.
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return hj.Hijack()
+}
+
+// close writes the end of the compressed body.
+func (w *compressWriter) close() {
+	if w.cw == nil {
+		return
+	}
+	if err := w.cw.Close(); err != nil {
+		log.Debugw("Failed to finish compressed response", "err", err)
+	}
+}
+
+// decodeContent replaces the body of the response with one that decodes the
+// body's content encoding.
+func decodeContent(resp *http.Response) error {
+	var decoder io.ReadCloser
+	var err error
+	switch encoding := strings.ToLower(resp.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+		return nil
+	case "gzip":
+		decoder, err = gzip.NewReader(resp.Body)
+	case "deflate":
+		decoder, err = zlib.NewReader(resp.Body)
+	default:
+		return fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot decode %s content: %w", resp.Header.Get("Content-Encoding"), err)
+	}
+	resp.Body = &decodedBody{
+		ReadCloser: decoder,
+		body:       resp.Body,
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return nil
+}
+
+// decodedBody reads the decoded content of a response body, and closes both
+// the decoder and the body when closed.
+type decodedBody struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	err := b.ReadCloser.Close()
+	if berr := b.body.Close(); berr != nil {
+		return berr
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+package httpsync
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// headETag returns the ETag of the head response for the root c. It is weak,
+// since a signature is not necessarily the same each time the head is signed.
+func headETag(c cid.Cid) string {
+	return `W/"` + c.String() + `"`
+}
+
+// etagMatch returns true if the If-None-Match header value, ifNoneMatch,
+// matches etag using weak comparison.
+func etagMatch(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedHead is a verified head and the ETag of the response it was in.
+type cachedHead struct {
+	etag string
+	head cid.Cid
+}
+
+// headCache records the latest head fetched from each publisher, so that the
+// head is fetched with a conditional request, and a publisher that responds
+// with http.StatusNotModified need not send and sign the head again.
+type headCache struct {
+	heads map[peer.ID]cachedHead
+	mutex sync.Mutex
+}
+
+func (hc *headCache) get(peerID peer.ID) (cachedHead, bool) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	ch, ok := hc.heads[peerID]
+	return ch, ok
+}
+
+// set records the head fetched from the publisher. The head is forgotten if the
+// response had no ETag.
+func (hc *headCache) set(peerID peer.ID, etag string, head cid.Cid) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	if etag == "" {
+		delete(hc.heads, peerID)
+		return
+	}
+	if hc.heads == nil {
+		hc.heads = make(map[peer.ID]cachedHead)
+	}
+	hc.heads[peerID] = cachedHead{
+		etag: etag,
+		head: head,
+	}
+}
@@ -0,0 +1,120 @@
+package httpsync
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// headLongPollHeader is set in the head responses of a publisher that
+	// long-polls its head.
+	headLongPollHeader = "X-Legs-Head-Long-Poll"
+	// headSinceParam is the query parameter of a long-poll of the head that
+	// holds the head that the syncer last saw. It is empty if the syncer has
+	// not seen a head.
+	headSinceParam = "since"
+	// headWaitParam is the query parameter of a long-poll of the head that
+	// holds the number of seconds that the syncer waits for a response.
+	headWaitParam = "wait"
+	// headLongPollWait is the longest time that a syncer asks the publisher to
+	// hold a long-poll of the head.
+	headLongPollWait = 30 * time.Second
+)
+
+// waitHead waits, if the request is a long-poll of the head, until the head is
+// not the one that the request gives, the wait elapses, the request is
+// canceled, or the publisher is closed. Returns false if the request is a
+// long-poll and the publisher still has no head.
+func (p *publisher) waitHead(r *http.Request) bool {
+	query := r.URL.Query()
+	if !query.Has(headSinceParam) {
+		return true
+	}
+	since := cid.Undef
+	if s := query.Get(headSinceParam); s != "" {
+		var err error
+		if since, err = cid.Parse(s); err != nil {
+			return true
+		}
+	}
+	wait := p.longPollWait
+	if secs, err := strconv.Atoi(query.Get(headWaitParam)); err == nil && secs >= 0 {
+		if d := time.Duration(secs) * time.Second; d < wait {
+			wait = d
+		}
+	}
+
+	p.rl.RLock()
+	root := p.root
+	changed := p.headChanged
+	p.rl.RUnlock()
+	if root == since && changed != nil {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+		p.rl.RLock()
+		root = p.root
+		p.rl.RUnlock()
+	}
+	return root != cid.Undef
+}
+
+// pollHeads long-polls the publisher's head, and sends each new head that is
+// signed by the publisher on heads, until ctx is canceled or a poll fails.
+// Then heads is closed.
+func (s *Syncer) pollHeads(ctx context.Context, heads chan<- cid.Cid) {
+	defer close(heads)
+
+	// Ask for a response before the client times out.
+	wait := headLongPollWait
+	if timeout := s.client.Timeout; timeout > 0 && timeout/2 < wait {
+		wait = timeout / 2
+	}
+	if wait < time.Second {
+		wait = time.Second
+	}
+
+	var latest cid.Cid
+	for {
+		var since string
+		if latest != cid.Undef {
+			since = latest.String()
+		}
+		query := url.Values{
+			headSinceParam: {since},
+			headWaitParam:  {strconv.Itoa(int(wait.Seconds()))},
+		}
+
+		head, err := s.getHead(ctx, query)
+		if err != nil {
+			var serr statusError
+			if errors.As(err, &serr) && serr.status == http.StatusNoContent {
+				// The publisher has no head yet.
+				continue
+			}
+			if ctx.Err() == nil {
+				log.Infow("Stopped watching head", "err", err, "peer", s.peerID)
+			}
+			return
+		}
+		if head == latest {
+			continue
+		}
+		select {
+		case heads <- head:
+			latest = head
+		case <-ctx.Done():
+			return
+		}
+	}
+}
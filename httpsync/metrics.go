@@ -0,0 +1,185 @@
+package httpsync
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RequestInfo describes a request that the publisher served. See:
+// WithRequestHook.
+type RequestInfo struct {
+	// Method is the HTTP method of the request.
+	Method string
+	// Resource is the requested resource: "head", a CID, or a CID with the
+	// ".car" suffix for a CAR stream.
+	Resource string
+	// Cid is the requested CID. It is undefined for head requests, and for
+	// requests that do not name a valid CID.
+	Cid cid.Cid
+	// Status is the HTTP status code of the response.
+	Status int
+	// Bytes is the number of bytes written in the response body.
+	Bytes int64
+	// Duration is the time taken to serve the request.
+	Duration time.Duration
+}
+
+// RequestHookFunc is the signature of a function that is called after each
+// request that the publisher serves.
+type RequestHookFunc func(RequestInfo)
+
+// publisherMetrics are the Prometheus counters of a publisher.
+type publisherMetrics struct {
+	blocksServed  prometheus.Counter
+	blockMisses   prometheus.Counter
+	requestErrors prometheus.Counter
+}
+
+// newPublisherMetrics creates the publisher counters and registers them with
+// reg. Counters that are already registered, such as by another publisher, are
+// shared.
+func newPublisherMetrics(reg prometheus.Registerer) (*publisherMetrics, error) {
+	m := &publisherMetrics{
+		blocksServed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "legs",
+			Subsystem: "httpsync_publisher",
+			Name:      "blocks_served_total",
+			Help:      "Number of blocks served by the HTTP publisher.",
+		}),
+		blockMisses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "legs",
+			Subsystem: "httpsync_publisher",
+			Name:      "block_misses_total",
+			Help:      "Number of requests for blocks that the HTTP publisher does not have.",
+		}),
+		requestErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "legs",
+			Subsystem: "httpsync_publisher",
+			Name:      "request_errors_total",
+			Help:      "Number of requests that the HTTP publisher failed or rejected, other than block misses.",
+		}),
+	}
+	var err error
+	if m.blocksServed, err = registerCounter(reg, m.blocksServed); err != nil {
+		return nil, err
+	}
+	if m.blockMisses, err = registerCounter(reg, m.blockMisses); err != nil {
+		return nil, err
+	}
+	if m.requestErrors, err = registerCounter(reg, m.requestErrors); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// registerCounter registers c with reg, and returns c, or the counter that is
+// already registered in its place.
+func registerCounter(reg prometheus.Registerer, c prometheus.Counter) (prometheus.Counter, error) {
+	err := reg.Register(c)
+	if err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(prometheus.Counter); ok {
+				return existing, nil
+			}
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// observe counts a served request.
+func (m *publisherMetrics) observe(info RequestInfo) {
+	switch {
+	case info.Status == http.StatusOK:
+		if info.Cid != cid.Undef && info.Resource == info.Cid.String() {
+			m.blocksServed.Inc()
+		}
+	case info.Status == http.StatusNotFound:
+		m.blockMisses.Inc()
+	case info.Status >= http.StatusBadRequest:
+		m.requestErrors.Inc()
+	}
+}
+
+// statusWriter records the status and body size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Hijack lets the handler take over the connection, such as to serve a
+// WebSocket, if the underlying ResponseWriter supports it. The response is
+// then recorded as switching protocols.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// observeRequests returns a handler that serves requests with next, and then
+// logs each request, counts it in metrics if not nil, and reports it to hook if
+// not nil.
+func observeRequests(next http.Handler, metrics *publisherMetrics, hook RequestHookFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+
+		resource := path.Base(r.URL.Path)
+		info := RequestInfo{
+			Method:   r.Method,
+			Resource: resource,
+			Status:   sw.status,
+			Bytes:    sw.bytes,
+			Duration: time.Since(start),
+		}
+		if resource != "head" {
+			if c, err := cid.Parse(strings.TrimSuffix(resource, carSuffix)); err == nil {
+				info.Cid = c
+			}
+		}
+		log.Debugw("Served request", "method", info.Method, "resource", info.Resource, "status", info.Status, "bytes", info.Bytes, "duration", info.Duration)
+
+		if metrics != nil {
+			metrics.observe(info)
+		}
+		if hook != nil {
+			hook(info)
+		}
+	})
+}
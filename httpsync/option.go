@@ -0,0 +1,457 @@
+package httpsync
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"github.com/filecoin-project/go-legs/acl"
+	"github.com/filecoin-project/go-legs/headregistry"
+	"github.com/filecoin-project/go-legs/metrics"
+	"github.com/filecoin-project/go-legs/throttle"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// defaultShutdownTimeout is the default time that closing a publisher waits
+// for in-progress requests to finish.
+const defaultShutdownTimeout = 5 * time.Second
+
+// syncConfig contains all options for configuring Sync.
+type syncConfig struct {
+	authHeader   AuthHeaderFunc
+	clientHost   host.Host
+	clientRelay  bool
+	cooldown     time.Duration
+	dedupFetches bool
+	localHook    func(peer.ID, cid.Cid)
+	maxAttempts  int
+	maxBackoff   time.Duration
+	maxFailures  int
+	minBackoff   time.Duration
+	metrics      *metrics.Metrics
+	skipCid      func(peer.ID, cid.Cid) bool
+	tlsConfig    *tls.Config
+	tracerProv   trace.TracerProvider
+}
+
+// AuthHeaderFunc returns the value of the Authorization header to send in
+// requests to the specified publisher, such as "Bearer <token>". If it returns
+// an empty string, then no Authorization header is sent.
+type AuthHeaderFunc func(ctx context.Context, peerID peer.ID) (string, error)
+
+// SyncOption is a function that sets a value in a syncConfig.
+type SyncOption func(*syncConfig)
+
+// getSyncOpts creates a syncConfig and applies SyncOptions to it.
+func getSyncOpts(opts []SyncOption) syncConfig {
+	var cfg syncConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// WithAuthHeader sets a function that provides the Authorization header of
+// each request to a publisher, for publishers that require authentication. The
+// function is called for every request, so that it can supply a refreshed
+// token. A sync fails if the function returns an error.
+func WithAuthHeader(authHeader AuthHeaderFunc) SyncOption {
+	return func(c *syncConfig) {
+		c.authHeader = authHeader
+	}
+}
+
+// WithCircuitBreaker sets the number of consecutive fetches from a publisher
+// that can fail, with a server error or a connection failure, before the
+// publisher is considered unhealthy. Syncs with an unhealthy publisher then
+// fail with PublisherUnhealthyError, without making any requests, until the
+// cooldown has passed. After the cooldown, a single failed fetch makes the
+// publisher unhealthy again, and a successful fetch makes it healthy. A
+// maxFailures of zero disables the circuit breaker.
+func WithCircuitBreaker(maxFailures int, cooldown time.Duration) SyncOption {
+	return func(c *syncConfig) {
+		c.maxFailures = maxFailures
+		c.cooldown = cooldown
+	}
+}
+
+// WithClientHost sets the libp2p host that syncers use to send HTTP requests
+// over libp2p streams, to publishers that are given by a /p2p address, such as
+// returned by StreamAddr. This allows syncing over HTTP with publishers that
+// are only reachable by their peer ID.
+func WithClientHost(h host.Host) SyncOption {
+	return func(c *syncConfig) {
+		c.clientHost = h
+	}
+}
+
+// WithClientRelay sets whether requests over libp2p streams, to publishers
+// given by a /p2p address, are sent to publishers that the client host is only
+// connected to through a circuit relay, which libp2p does not otherwise allow.
+// Relays limit the time and data of relayed connections, so a large sync may
+// not complete over a relay. Disabled by default.
+func WithClientRelay(allow bool) SyncOption {
+	return func(c *syncConfig) {
+		c.clientRelay = allow
+	}
+}
+
+// WithClientTLSConfig sets the TLS configuration used to connect to
+// publishers over HTTPS, such as to present a client certificate to
+// publishers that require mutual TLS, or to trust a private certificate
+// authority. It is ignored if an http.Client is given to NewSync, since the
+// client's transport is then used as is.
+func WithClientTLSConfig(tlsConfig *tls.Config) SyncOption {
+	return func(c *syncConfig) {
+		c.tlsConfig = tlsConfig
+	}
+}
+
+// WithDedupFetches sets whether concurrent syncs, with the same or different
+// publishers, share the fetch of a block that they are all missing. When
+// enabled, a block that is being fetched by one sync is not fetched again by
+// another. The waiting sync uses the block only if it was successfully fetched
+// and verified against its CID, otherwise it fetches the block from its own
+// publisher.
+func WithDedupFetches(enable bool) SyncOption {
+	return func(c *syncConfig) {
+		c.dedupFetches = enable
+	}
+}
+
+// WithLocalBlockHook sets a function that is called, instead of the block
+// hook, for each block that a sync finds in the local link system rather than
+// fetching it from the publisher. If not set, the block hook is called for
+// those blocks.
+func WithLocalBlockHook(hook func(peer.ID, cid.Cid)) SyncOption {
+	return func(c *syncConfig) {
+		c.localHook = hook
+	}
+}
+
+// WithRetry sets the number of times that a block fetch is attempted, when it
+// fails with a server error, a too many requests response, a network timeout,
+// a refused or reset connection, or a response that ends early. Other errors
+// are not retried. The delay before each retry starts at minBackoff and
+// doubles after each attempt, up to maxBackoff. A longer delay requested by
+// the publisher with a Retry-After header is honored, up to maxBackoff. A
+// maxAttempts of one or less disables retries.
+func WithRetry(maxAttempts int, minBackoff, maxBackoff time.Duration) SyncOption {
+	return func(c *syncConfig) {
+		c.maxAttempts = maxAttempts
+		c.minBackoff = minBackoff
+		c.maxBackoff = maxBackoff
+	}
+}
+
+// WithSkipCid sets a function that is called with the publisher and the CID of
+// each block that a sync traverses, and returns true if the block is to be
+// skipped. A skipped block is neither fetched nor traversed, so the blocks
+// that it links to are only synced if they are linked from another block. If
+// the CID to sync is skipped, then nothing is synced.
+func WithSkipCid(skipCid func(peer.ID, cid.Cid) bool) SyncOption {
+	return func(c *syncConfig) {
+		c.skipCid = skipCid
+	}
+}
+
+// WithSyncMetrics sets the metrics that record the blocks and bytes that each
+// sync transfers, and the fetches held back by rate limiting.
+func WithSyncMetrics(m *metrics.Metrics) SyncOption {
+	return func(c *syncConfig) {
+		c.metrics = m
+	}
+}
+
+// WithSyncTracerProvider sets the OpenTelemetry tracer provider that creates
+// the spans tracing each sync and block fetch. The default is the global
+// tracer provider.
+func WithSyncTracerProvider(tp trace.TracerProvider) SyncOption {
+	return func(c *syncConfig) {
+		c.tracerProv = tp
+	}
+}
+
+// publisherConfig contains all options for configuring a publisher server.
+type publisherConfig struct {
+	acl               *acl.List
+	announceHost      host.Host
+	announceTopic     *pubsub.Topic
+	compress          bool
+	discovery         discovery.Discovery
+	ds                datastore.Datastore
+	dsPrefix          string
+	headLongPoll      time.Duration
+	headRegistry      *headregistry.Registry
+	headWebSocket     bool
+	metricsReg        prometheus.Registerer
+	middleware        func(http.Handler) http.Handler
+	republishInterval time.Duration
+	requestHook       RequestHookFunc
+	serveCar          bool
+	shutdownTimeout   time.Duration
+	streamHost        host.Host
+	throttle          throttle.Config
+	tlsConfig         *tls.Config
+	topicName         string
+}
+
+// PublisherOption is a function that sets a value in a publisherConfig.
+type PublisherOption func(*publisherConfig)
+
+// getPublisherOpts creates a publisherConfig and applies PublisherOptions to
+// it.
+func getPublisherOpts(opts []PublisherOption) publisherConfig {
+	cfg := publisherConfig{
+		shutdownTimeout: defaultShutdownTimeout,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// WithACL sets the access control list of the IP addresses that the publisher
+// serves, and of the peers that it serves over libp2p streams. A request from
+// an address or peer that is not allowed is answered with
+// http.StatusForbidden. The list can be changed while the publisher is
+// running, and the changes apply to the next requests.
+func WithACL(l *acl.List) PublisherOption {
+	return func(c *publisherConfig) {
+		c.acl = l
+	}
+}
+
+// WithAnnounceHost makes the publisher join the named pubsub topic on the
+// given libp2p host, and publish an announcement of the new root, with the
+// publisher's HTTP address, each time UpdateRoot is called. Subscribers on the
+// topic are then notified of updates, and sync them over HTTP. The host must
+// have the same peer ID as the publisher, since subscribers verify the head
+// against the peer that announced it.
+func WithAnnounceHost(h host.Host, topicName string) PublisherOption {
+	return func(c *publisherConfig) {
+		c.announceHost = h
+		c.topicName = topicName
+	}
+}
+
+// WithAnnounceDiscovery sets the discovery service that the pubsub of the
+// topic joined with WithAnnounceHost uses to advertise the publisher on the
+// topic, and to find and connect to subscribers on the topic.
+func WithAnnounceDiscovery(d discovery.Discovery) PublisherOption {
+	return func(c *publisherConfig) {
+		c.discovery = d
+	}
+}
+
+// WithAnnounceTopic provides an existing pubsub topic to publish announcements
+// on, instead of joining a topic with WithAnnounceHost. The topic must belong
+// to a pubsub instance of a host with the same peer ID as the publisher.
+func WithAnnounceTopic(topic *pubsub.Topic) PublisherOption {
+	return func(c *publisherConfig) {
+		c.announceTopic = topic
+	}
+}
+
+// WithCompression sets whether the publisher compresses its responses with
+// gzip or deflate, as negotiated with each client's Accept-Encoding header.
+// Dag-json blocks compress well, so this saves bandwidth at the cost of the
+// CPU time spent compressing. Syncers decode the compressed responses, and
+// verify blocks against their CIDs after decoding. Range requests are not
+// compressed, and the ETag of a compressed response is weak.
+func WithCompression(enable bool) PublisherOption {
+	return func(c *publisherConfig) {
+		c.compress = enable
+	}
+}
+
+// WithDatastore sets the datastore that the publisher persists its root in.
+// The persisted root is restored when the publisher is created, so that a
+// restarted publisher continues to serve the same head. If not set, the root
+// is only kept in memory.
+func WithDatastore(ds datastore.Datastore) PublisherOption {
+	return func(c *publisherConfig) {
+		c.ds = ds
+	}
+}
+
+// WithDatastorePrefix puts the key that the publisher persists its root at,
+// in the datastore given by WithDatastore, under prefix, so that it does not
+// collide with application data in a shared datastore.
+func WithDatastorePrefix(prefix string) PublisherOption {
+	return func(c *publisherConfig) {
+		c.dsPrefix = prefix
+	}
+}
+
+// WithHeadLongPoll makes the publisher hold a request for its head, which
+// gives the head that the syncer last saw, until the head changes, and for at
+// most maxWait. Syncers then see head updates right away without polling the
+// head repeatedly. Syncer.WatchHead long-polls the head of a publisher that
+// does not push head updates over a WebSocket. A held request counts toward
+// the WithMaxConcurrentRequests limit while it waits. A maxWait of zero, the
+// default, disables long-polling.
+func WithHeadLongPoll(maxWait time.Duration) PublisherOption {
+	return func(c *publisherConfig) {
+		c.headLongPoll = maxWait
+	}
+}
+
+// WithHeadRegistry registers the publisher with a registry that is shared by
+// publishers of the same DAG over other transports, such as a dtsync
+// publisher. Setting the root of any registered publisher then sets it on all
+// of them, so that each reports the same head. If the registry already has a
+// root, then the publisher serves it, in place of any root restored from the
+// datastore. The publisher is removed from the registry when it is closed.
+func WithHeadRegistry(r *headregistry.Registry) PublisherOption {
+	return func(c *publisherConfig) {
+		c.headRegistry = r
+	}
+}
+
+// WithHeadWebSocket sets whether the publisher pushes its head to syncers
+// over a WebSocket. When enabled, a WebSocket upgrade request for the head is
+// answered with a connection that is sent the signed head when it is opened,
+// and again each time the root is set. Syncers watch the head with
+// Syncer.WatchHead, instead of polling it, so that updates are seen right away
+// without pubsub.
+func WithHeadWebSocket(enable bool) PublisherOption {
+	return func(c *publisherConfig) {
+		c.headWebSocket = enable
+	}
+}
+
+// WithMaxBytesPerHour sets the maximum number of bytes that the publisher
+// sends to each client, by IP address, in an hour. A response in progress is
+// not stopped when a client reaches the limit, but the client's requests are
+// then answered with http.StatusTooManyRequests until enough of the hour has
+// passed. Zero, the default, is no limit.
+func WithMaxBytesPerHour(n int64) PublisherOption {
+	return func(c *publisherConfig) {
+		c.throttle.MaxBytesPerHour = n
+	}
+}
+
+// WithMaxConcurrentRequests sets the maximum number of requests that the
+// publisher serves at a time, to all clients. A request received while that
+// many are in progress is answered with http.StatusTooManyRequests. Zero, the
+// default, is no limit.
+func WithMaxConcurrentRequests(n int) PublisherOption {
+	return func(c *publisherConfig) {
+		c.throttle.MaxConcurrent = n
+	}
+}
+
+// WithMetrics registers Prometheus counters of the blocks served, the
+// requests for blocks that are not found, and the requests that fail or are
+// rejected, with reg. Publishers that register with the same registerer share
+// the counters.
+func WithMetrics(reg prometheus.Registerer) PublisherOption {
+	return func(c *publisherConfig) {
+		c.metricsReg = reg
+	}
+}
+
+// WithMiddleware sets a function that wraps the publisher's handler in the
+// handler that the server serves. This allows requests to be validated, such
+// as by checking a bearer token in the Authorization header, before they are
+// served. The middleware must respond to rejected requests itself, such as
+// with http.StatusUnauthorized, and not call the publisher's handler. For
+// mutual TLS, use WithTLSConfig with a config that requires client
+// certificates.
+func WithMiddleware(middleware func(http.Handler) http.Handler) PublisherOption {
+	return func(c *publisherConfig) {
+		c.middleware = middleware
+	}
+}
+
+// WithRepublishInterval sets how often the publisher re-announces its current
+// root over pubsub, so that subscribers that joined late or missed an
+// announcement converge on the root without a manual sync. It applies only if
+// the WithAnnounceHost or WithAnnounceTopic option is given. A value of zero,
+// the default, disables periodic re-announcement.
+func WithRepublishInterval(interval time.Duration) PublisherOption {
+	return func(c *publisherConfig) {
+		c.republishInterval = interval
+	}
+}
+
+// WithRequestHook sets a function that is called after each request that the
+// publisher serves, with the method, requested CID, response status, bytes
+// written, and time taken. This includes requests rejected by the
+// WithMiddleware middleware.
+func WithRequestHook(hook RequestHookFunc) PublisherOption {
+	return func(c *publisherConfig) {
+		c.requestHook = hook
+	}
+}
+
+// WithRequestRateLimit limits the rate of requests that the publisher serves
+// from each client, by IP address, to limit requests per second, with bursts
+// of up to burst requests. A request over the limit is answered with
+// http.StatusTooManyRequests and a Retry-After header. By default, the request
+// rate is not limited.
+func WithRequestRateLimit(limit rate.Limit, burst int) PublisherOption {
+	return func(c *publisherConfig) {
+		c.throttle.RequestRate = limit
+		c.throttle.RequestBurst = burst
+	}
+}
+
+// WithServeCar sets whether the publisher serves the DAG selected from a CID as
+// a single CARv1 stream, in addition to serving individual blocks. When
+// enabled, the publisher advertises support in its head and block responses,
+// and syncers fetch the DAG in one request instead of one request per block.
+func WithServeCar(enable bool) PublisherOption {
+	return func(c *publisherConfig) {
+		c.serveCar = enable
+	}
+}
+
+// WithShutdownTimeout sets the time that closing the publisher waits for
+// in-progress requests to finish, before their connections are closed.
+func WithShutdownTimeout(timeout time.Duration) PublisherOption {
+	return func(c *publisherConfig) {
+		c.shutdownTimeout = timeout
+	}
+}
+
+// WithStreamHost makes the publisher also serve HTTP over libp2p streams on the
+// given host, with ProtocolID, so that syncers that can only reach the
+// publisher by its peer ID sync over HTTP at the publisher's StreamAddr. The
+// host must have the same peer ID as the publisher. Requests over libp2p
+// streams are throttled by peer ID, and the access control list applies to
+// their peer ID instead of an IP address.
+func WithStreamHost(h host.Host) PublisherOption {
+	return func(c *publisherConfig) {
+		c.streamHost = h
+	}
+}
+
+// WithThrottleHook sets a function that is called with the client IP address,
+// or peer ID for requests over libp2p streams, and the reason each time the
+// publisher rejects a request because of its request rate, concurrency, or
+// byte limits.
+func WithThrottleHook(hook throttle.HookFunc) PublisherOption {
+	return func(c *publisherConfig) {
+		c.throttle.Hook = hook
+	}
+}
+
+// WithTLSConfig makes the publisher serve HTTPS using the given TLS
+// configuration, which must contain a certificate. The publisher's address is
+// then an https multiaddr.
+func WithTLSConfig(tlsConfig *tls.Config) PublisherOption {
+	return func(c *publisherConfig) {
+		c.tlsConfig = tlsConfig
+	}
+}
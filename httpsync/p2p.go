@@ -0,0 +1,89 @@
+package httpsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	gostream "github.com/libp2p/go-libp2p-gostream"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// ProtocolID is the libp2p protocol ID that a publisher serves HTTP on, over
+// libp2p streams.
+const ProtocolID = protocol.ID("/legs/httpsync/0.0.1")
+
+// errNoClientHost is returned when a syncer for a /p2p address is created by a
+// Sync that has no libp2p host to dial the publisher with.
+var errNoClientHost = errors.New("cannot sync over libp2p streams without a client host")
+
+// StreamAddr returns the multiaddr, /p2p/<peerID>/http, that a syncer syncs
+// from over HTTP on libp2p streams to the peer.
+func StreamAddr(peerID peer.ID) (multiaddr.Multiaddr, error) {
+	return multiaddr.NewMultiaddr("/p2p/" + peerID.String() + "/http")
+}
+
+// isStreamAddr returns true if addr is the address of a publisher that serves
+// HTTP over libp2p streams.
+func isStreamAddr(addr multiaddr.Multiaddr) bool {
+	_, err := addr.ValueForProtocol(multiaddr.P_P2P)
+	return err == nil
+}
+
+// streamURL returns the root URL of the publisher at addr, which serves HTTP
+// over libp2p streams. The URL's host is the publisher's peer ID. Any transport
+// addresses of the publisher that addr starts with are added to the peerstore
+// of h.
+func streamURL(h host.Host, addr multiaddr.Multiaddr) (*url.URL, error) {
+	if rest, last := multiaddr.SplitLast(addr); last != nil && last.Protocol().Code == multiaddr.P_HTTP {
+		addr = rest
+	}
+	transport, peerID := peer.SplitAddr(addr)
+	if peerID == "" {
+		return nil, fmt.Errorf("no peer id in address %s", addr)
+	}
+	if transport != nil {
+		h.Peerstore().AddAddr(peerID, transport, peerstore.TempAddrTTL)
+	}
+	return &url.URL{
+		Scheme: "http",
+		Host:   peerID.String(),
+	}, nil
+}
+
+// newStreamClient returns an HTTP client that sends each request over a libp2p
+// stream from h to the peer whose ID is the host of the request's URL. If
+// allowRelay is true, then the stream may be over a connection through a
+// circuit relay.
+func newStreamClient(h host.Host, allowRelay bool) *http.Client {
+	return &http.Client{
+		Timeout: defaultHttpTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				hostPart, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				peerID, err := peer.Decode(hostPart)
+				if err != nil {
+					return nil, err
+				}
+				if allowRelay {
+					ctx = network.WithUseTransient(ctx, "go-legs httpsync")
+				}
+				if err = h.Connect(ctx, peer.AddrInfo{ID: peerID}); err != nil {
+					return nil, err
+				}
+				return gostream.Dial(ctx, h, peerID, ProtocolID)
+			},
+		},
+	}
+}
@@ -1,43 +1,135 @@
 package httpsync
 
 import (
+	"bytes"
 	"context"
 	"errors"
-	"io"
+	"fmt"
 	"net"
 	"net/http"
 	"path"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/filecoin-project/go-legs/announce/gossiptopic"
+	"github.com/filecoin-project/go-legs/carutil"
+	"github.com/filecoin-project/go-legs/headregistry"
+	"github.com/filecoin-project/go-legs/throttle"
+	"github.com/gorilla/websocket"
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
 	"github.com/ipld/go-ipld-prime"
-	"github.com/ipld/go-ipld-prime/codec/dagjson"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
-	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	gostream "github.com/libp2p/go-libp2p-gostream"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	ic "github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/multiformats/go-multicodec"
 )
 
+// rootKey is the datastore key that the publisher's root is persisted at.
+var rootKey = datastore.NewKey("/legs/httpsync/root")
+
+// pubsubShutdownTime is the time that closing a publisher waits for its
+// pubsub topic to close before shutting down pubsub.
+const pubsubShutdownTime = 5 * time.Second
+
 type publisher struct {
-	addr    multiaddr.Multiaddr
-	closer  io.Closer
-	lsys    ipld.LinkSystem
-	peerID  peer.ID
-	privKey ic.PrivKey
-	rl      sync.RWMutex
-	root    cid.Cid
+	addr            multiaddr.Multiaddr
+	cancelPubSub    context.CancelFunc
+	ds              datastore.Datastore
+	lsys            ipld.LinkSystem
+	peerID          peer.ID
+	privKey         ic.PrivKey
+	rl              sync.RWMutex
+	root            cid.Cid
+	serveCar        bool
+	server          *http.Server
+	shutdownTimeout time.Duration
+	topic           *pubsub.Topic
+
+	// announceAddrs are the addresses included in the most recent
+	// announcement, which are re-announced with the root.
+	announceAddrs []multiaddr.Multiaddr
+	// cancelRepublish stops periodic re-announcement of the root.
+	cancelRepublish context.CancelFunc
+	republishDone   chan struct{}
+
+	// watchers are the syncers that the head is pushed to over WebSockets.
+	// This is nil unless the publisher serves head updates.
+	watchers *headWatchers
+	// longPollWait is the longest time that a long-poll of the head is held,
+	// or zero if the head is not long-polled.
+	longPollWait time.Duration
+	// headChanged is closed, and replaced, each time the root is set, to end
+	// the long-polls of the head. It is nil if the head is not long-polled,
+	// and after the publisher is closed.
+	headChanged chan struct{}
+
+	// registry, if not nil, sets the root on this and every other publisher
+	// registered with it. unregister removes this publisher from it.
+	registry   *headregistry.Registry
+	unregister func()
 }
 
 var _ http.Handler = (*publisher)(nil)
 
 // NewPublisher creates a new http publisher, listening on the specified
-// address.
+// address. The head is signed with privKey, which must be the private key of
+// peerID, so that syncers can verify the head against the publisher's peer ID.
+// This is the same as NewPublisherServer with no options.
 func NewPublisher(address string, lsys ipld.LinkSystem, peerID peer.ID, privKey ic.PrivKey) (*publisher, error) {
+	return NewPublisherServer(address, lsys, peerID, privKey)
+}
+
+// NewPublisherServer creates a new http publisher, and starts an HTTP server
+// for it that listens on the specified address. The address that the server
+// is bound to, which is what to announce, is returned by the publisher's
+// Address method. Closing the publisher shuts down the server, waiting for
+// in-progress requests to finish. The server serves HTTPS if the
+// WithTLSConfig option is given. If the WithDatastore option is given, then
+// the root persisted in the datastore is restored. If the WithAnnounceHost or
+// WithAnnounceTopic option is given, then UpdateRoot also announces the new
+// root over pubsub. Requests are passed through the WithMiddleware option's
+// middleware, if given, which can reject unauthorized requests. If the
+// WithStreamHost option is given, then the server also serves HTTP over libp2p
+// streams on the host.
+func NewPublisherServer(address string, lsys ipld.LinkSystem, peerID peer.ID, privKey ic.PrivKey, options ...PublisherOption) (*publisher, error) {
+	cfg := getPublisherOpts(options)
+
 	if privKey == nil {
 		return nil, errors.New("private key required to sign head requests")
 	}
+	privKeyID, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not get peer id from private key: %w", err)
+	}
+	if peerID != privKeyID {
+		return nil, errors.New("peer id does not match private key")
+	}
+	if cfg.announceHost != nil && cfg.announceHost.ID() != peerID {
+		return nil, errors.New("announce host id does not match peer id")
+	}
+	if cfg.streamHost != nil && cfg.streamHost.ID() != peerID {
+		return nil, errors.New("stream host id does not match peer id")
+	}
+
+	if cfg.ds != nil && cfg.dsPrefix != "" {
+		cfg.ds = namespace.Wrap(cfg.ds, datastore.NewKey(cfg.dsPrefix))
+	}
+	root := cid.Undef
+	if cfg.ds != nil {
+		root, err = loadRoot(cfg.ds)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	l, err := net.Listen("tcp", address)
 	if err != nil {
@@ -49,22 +141,115 @@ func NewPublisher(address string, lsys ipld.LinkSystem, peerID peer.ID, privKey
 		l.Close()
 		return nil, err
 	}
-	proto, _ := multiaddr.NewMultiaddr("/http")
+	scheme := "/http"
+	if cfg.tlsConfig != nil {
+		scheme = "/https"
+	}
+	proto, _ := multiaddr.NewMultiaddr(scheme)
+
+	var cancelPubsub context.CancelFunc
+	topic := cfg.announceTopic
+	if topic == nil && cfg.announceHost != nil {
+		var psOpts []pubsub.Option
+		if cfg.discovery != nil {
+			psOpts = append(psOpts, pubsub.WithDiscovery(cfg.discovery))
+		}
+		topic, cancelPubsub, err = gossiptopic.MakeTopic(cfg.announceHost, cfg.topicName, psOpts...)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
 
 	pub := &publisher{
-		addr:    multiaddr.Join(maddr, proto),
-		closer:  l,
-		lsys:    lsys,
-		peerID:  peerID,
-		privKey: privKey,
+		addr:            multiaddr.Join(maddr, proto),
+		cancelPubSub:    cancelPubsub,
+		ds:              cfg.ds,
+		lsys:            lsys,
+		peerID:          peerID,
+		privKey:         privKey,
+		root:            root,
+		serveCar:        cfg.serveCar,
+		shutdownTimeout: cfg.shutdownTimeout,
+		topic:           topic,
+	}
+	if cfg.headWebSocket {
+		pub.watchers = newHeadWatchers()
+	}
+	if cfg.headLongPoll > 0 {
+		pub.longPollWait = cfg.headLongPoll
+		pub.headChanged = make(chan struct{})
 	}
 
+	var handler http.Handler = pub
+	if cfg.compress {
+		handler = compressResponses(handler)
+	}
+	if cfg.middleware != nil {
+		handler = cfg.middleware(handler)
+	}
+	var metrics *publisherMetrics
+	if cfg.metricsReg != nil {
+		metrics, err = newPublisherMetrics(cfg.metricsReg)
+		if err != nil {
+			l.Close()
+			if cancelPubsub != nil {
+				cancelPubsub()
+			}
+			return nil, fmt.Errorf("cannot register metrics: %w", err)
+		}
+	}
+	handler = throttleRequests(handler, throttle.New(cfg.throttle))
+	handler = restrictRequests(handler, cfg.acl)
+	handler = observeRequests(handler, metrics, cfg.requestHook)
+
 	// Run service on configured port.
-	server := &http.Server{
-		Handler: pub,
-		Addr:    l.Addr().String(),
+	pub.server = &http.Server{
+		Handler:   handler,
+		Addr:      l.Addr().String(),
+		TLSConfig: cfg.tlsConfig,
+	}
+	if topic != nil && cfg.republishInterval > 0 {
+		var ctx context.Context
+		ctx, pub.cancelRepublish = context.WithCancel(context.Background())
+		pub.republishDone = make(chan struct{})
+		go pub.republish(ctx, cfg.republishInterval)
+	}
+
+	go func() {
+		var err error
+		if cfg.tlsConfig != nil {
+			err = pub.server.ServeTLS(l, "", "")
+		} else {
+			err = pub.server.Serve(l)
+		}
+		if err != http.ErrServerClosed {
+			log.Errorw("Publisher server stopped", "err", err)
+		}
+	}()
+
+	if cfg.streamHost != nil {
+		// Streams are secured by libp2p, so HTTP is served without TLS.
+		sl, err := gostream.Listen(cfg.streamHost, ProtocolID)
+		if err != nil {
+			pub.Close()
+			return nil, fmt.Errorf("cannot listen for libp2p streams: %w", err)
+		}
+		go func() {
+			if err := pub.server.Serve(sl); err != http.ErrServerClosed {
+				log.Errorw("Publisher stopped serving libp2p streams", "err", err)
+			}
+		}()
+	}
+
+	if cfg.headRegistry != nil {
+		pub.unregister, err = cfg.headRegistry.Register(context.Background(), root, pub.setRoot)
+		if err != nil {
+			pub.Close()
+			return nil, fmt.Errorf("cannot register with head registry: %w", err)
+		}
+		pub.registry = cfg.headRegistry
 	}
-	go server.Serve(l)
 
 	return pub, nil
 }
@@ -75,39 +260,190 @@ func (p *publisher) Address() multiaddr.Multiaddr {
 	return p.addr
 }
 
+// SetRoot sets the root CID that the publisher serves as its head. If the
+// publisher has a datastore, then the root is persisted in it first. If the
+// publisher is registered with a head registry, then the root is set on every
+// publisher in the registry.
 func (p *publisher) SetRoot(ctx context.Context, c cid.Cid) error {
+	if p.registry != nil {
+		return p.registry.SetRoot(ctx, c)
+	}
+	return p.setRoot(ctx, c)
+}
+
+// setRoot sets the root CID of this publisher only.
+func (p *publisher) setRoot(ctx context.Context, c cid.Cid) error {
 	p.rl.Lock()
 	defer p.rl.Unlock()
+	if p.ds != nil {
+		// An undefined root is persisted as no root.
+		var err error
+		if c == cid.Undef {
+			err = p.ds.Delete(ctx, rootKey)
+		} else {
+			err = p.ds.Put(ctx, rootKey, c.Bytes())
+		}
+		if err != nil {
+			return fmt.Errorf("cannot persist root: %w", err)
+		}
+	}
 	p.root = c
+	p.watchers.notify()
+	if p.headChanged != nil {
+		close(p.headChanged)
+		p.headChanged = make(chan struct{})
+	}
 	return nil
 }
 
+// Root returns the root CID that the publisher serves as its head, or cid.Undef
+// if no root is set.
+func (p *publisher) Root() cid.Cid {
+	p.rl.RLock()
+	defer p.rl.RUnlock()
+	return p.root
+}
+
+// loadRoot returns the root persisted in ds, or cid.Undef if there is none.
+func loadRoot(ds datastore.Datastore) (cid.Cid, error) {
+	data, err := ds.Get(context.Background(), rootKey)
+	if err != nil {
+		if err == datastore.ErrNotFound {
+			return cid.Undef, nil
+		}
+		return cid.Undef, fmt.Errorf("cannot load persisted root: %w", err)
+	}
+	_, c, err := cid.CidFromBytes(data)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("cannot decode persisted root: %w", err)
+	}
+	return c, nil
+}
+
+// UpdateRoot sets the root CID, and announces it with the publisher's address
+// if the publisher announces over pubsub.
 func (p *publisher) UpdateRoot(ctx context.Context, c cid.Cid) error {
-	return p.SetRoot(ctx, c)
+	return p.UpdateRootWithAddrs(ctx, c, []multiaddr.Multiaddr{p.addr})
+}
+
+// UpdateRootWithAddrs sets the root CID, and announces it with the given
+// addresses if the publisher announces over pubsub.
+func (p *publisher) UpdateRootWithAddrs(ctx context.Context, c cid.Cid, addrs []multiaddr.Multiaddr) error {
+	if err := p.SetRoot(ctx, c); err != nil {
+		return err
+	}
+	if p.topic == nil {
+		return nil
+	}
+	p.rl.Lock()
+	p.announceAddrs = addrs
+	p.rl.Unlock()
+	return p.publish(ctx, c, addrs)
+}
+
+// republish re-announces the current root every interval, so that subscribers
+// that missed an announcement still learn the root, until ctx is canceled.
+func (p *publisher) republish(ctx context.Context, interval time.Duration) {
+	defer close(p.republishDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		p.rl.RLock()
+		root := p.root
+		addrs := p.announceAddrs
+		p.rl.RUnlock()
+		if root == cid.Undef {
+			continue
+		}
+		if addrs == nil {
+			addrs = []multiaddr.Multiaddr{p.addr}
+		}
+		log.Debugw("Re-announcing root", "cid", root)
+		if err := p.publish(ctx, root, addrs); err != nil && ctx.Err() == nil {
+			log.Errorw("Failed to re-announce root", "err", err)
+		}
+	}
 }
 
-func (p *publisher) UpdateRootWithAddrs(ctx context.Context, c cid.Cid, _ []multiaddr.Multiaddr) error {
-	return p.UpdateRoot(ctx, c)
+// publish publishes an announcement of c with addrs on the pubsub topic.
+func (p *publisher) publish(ctx context.Context, c cid.Cid, addrs []multiaddr.Multiaddr) error {
+	log.Debugw("Publishing CID and addresses in pubsub channel", "cid", c, "addrs", addrs)
+	msg := gossiptopic.Message{
+		Cid: c,
+	}
+	msg.SetAddrs(addrs)
+	var buf bytes.Buffer
+	if err := msg.MarshalCBOR(&buf); err != nil {
+		return err
+	}
+	return p.topic.Publish(ctx, buf.Bytes())
 }
 
+// Close shuts down the publisher's server. In-progress requests are given
+// until the shutdown timeout to finish, after which their connections are
+// closed. The WebSockets of syncers watching the head are closed right away.
+// If the publisher joined a pubsub topic, then it leaves the topic. If the
+// publisher is registered with a head registry, then it is removed from it.
 func (p *publisher) Close() error {
-	return p.closer.Close()
+	if p.unregister != nil {
+		p.unregister()
+	}
+	if p.cancelRepublish != nil {
+		p.cancelRepublish()
+		<-p.republishDone
+	}
+
+	// Shutting down the server does not close hijacked connections, so close
+	// the head watchers first. Long-polls of the head are ended, so that
+	// shutdown does not wait for them.
+	p.watchers.close()
+	p.rl.Lock()
+	if p.headChanged != nil {
+		close(p.headChanged)
+		p.headChanged = nil
+	}
+	p.rl.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.shutdownTimeout)
+	defer cancel()
+	err := p.server.Shutdown(ctx)
+	if err != nil {
+		p.server.Close()
+	}
+
+	// If publisher owns the pubsub Topic, then leave topic and shutdown Pubsub.
+	if p.cancelPubSub != nil {
+		t := time.AfterFunc(pubsubShutdownTime, p.cancelPubSub)
+		if terr := p.topic.Close(); terr != nil {
+			log.Errorw("Failed to close pubsub topic", "err", terr)
+			if err == nil {
+				err = terr
+			}
+		}
+		if t.Stop() {
+			p.cancelPubSub()
+		}
+	}
+	return err
 }
 
 func (p *publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ask := path.Base(r.URL.Path)
 	if ask == "head" {
-		// serve the
-		p.rl.RLock()
-		defer p.rl.RUnlock()
-
-		marshalledMsg, err := newEncodedSignedHead(p.root, p.privKey)
-		if err != nil {
-			http.Error(w, "Failed to encode", http.StatusInternalServerError)
-			log.Errorw("Failed to serve root", "err", err)
-		} else {
-			_, _ = w.Write(marshalledMsg)
+		if p.watchers != nil && websocket.IsWebSocketUpgrade(r) {
+			p.serveHeadUpdates(w, r)
+			return
 		}
+		p.serveHead(w, r)
+		return
+	}
+	if p.serveCar && strings.HasSuffix(ask, carSuffix) {
+		p.serveCarStream(w, r, strings.TrimSuffix(ask, carSuffix))
 		return
 	}
 	// interpret `ask` as a CID to serve.
@@ -116,9 +452,12 @@ func (p *publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid request: not a cid", http.StatusBadRequest)
 		return
 	}
-	item, err := p.lsys.Load(ipld.LinkContext{}, cidlink.Link{Cid: c}, basicnode.Prototype.Any)
+	// Serve the block as stored, so that its data matches its CID regardless
+	// of codec. LoadRaw checks the data against the CID unless the link system
+	// uses trusted storage.
+	data, err := p.lsys.LoadRaw(ipld.LinkContext{Ctx: r.Context()}, cidlink.Link{Cid: c})
 	if err != nil {
-		if errors.Is(err, ipld.ErrNotExists{}) {
+		if isNotFound(err) {
 			http.Error(w, "cid not found", http.StatusNotFound)
 			return
 		}
@@ -126,8 +465,142 @@ func (p *publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		log.Errorw("Failed to load requested block", "err", err, "cid", c)
 		return
 	}
-	// marshal to json and serve.
-	_ = dagjson.Encode(item, w)
+	w.Header().Set("Content-Type", contentType(c))
+	if p.serveCar {
+		w.Header().Set(carSupportHeader, "true")
+	}
+	// Serve range requests, so that a syncer can resume fetching a large
+	// block. The block data never changes, so its CID is a strong ETag.
+	w.Header().Set("ETag", `"`+c.String()+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
 
 	// TODO: Sign message using publisher's private key.
 }
+
+// serveHead serves the signed head, with an ETag derived from the root. A
+// conditional request for the head that the client already has is answered
+// with http.StatusNotModified. A long-poll of the head is held until the head
+// changes before it is served.
+func (p *publisher) serveHead(w http.ResponseWriter, r *http.Request) {
+	if p.longPollWait > 0 {
+		w.Header().Set(headLongPollHeader, "true")
+		if !p.waitHead(r) {
+			// The head was not set before the long-poll ended.
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	p.rl.RLock()
+	defer p.rl.RUnlock()
+
+	if p.serveCar {
+		w.Header().Set(carSupportHeader, "true")
+	}
+	if p.root != cid.Undef {
+		// Caches must check that the head is still current before using it.
+		etag := headETag(p.root)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+		if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatch(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	marshalledMsg, err := newEncodedSignedHead(p.root, p.privKey)
+	if err != nil {
+		w.Header().Del("ETag")
+		w.Header().Del("Cache-Control")
+		http.Error(w, "Failed to encode", http.StatusInternalServerError)
+		log.Errorw("Failed to serve root", "err", err)
+		return
+	}
+	_, _ = w.Write(marshalledMsg)
+}
+
+// serveCarStream serves the blocks selected from the CID, ask, as a CARv1
+// stream with the CID as its root. The selector is given as dag-json, encoded
+// with unpadded base64url, in the selector query parameter. If there is no
+// selector, then the entire DAG is served.
+//
+// Blocks are written as the selector is traversed, so a block that cannot be
+// loaded after the root ends the stream early, and the syncer fetches the
+// rest individually. The size and depth of the selector, and the number of
+// blocks served, are limited.
+func (p *publisher) serveCarStream(w http.ResponseWriter, r *http.Request, ask string) {
+	c, err := cid.Parse(ask)
+	if err != nil {
+		http.Error(w, "invalid request: not a cid", http.StatusBadRequest)
+		return
+	}
+	sel := selectorparse.CommonSelector_ExploreAllRecursively
+	if encSel := r.URL.Query().Get(carSelectorParam); encSel != "" {
+		sel, err = decodeSelector(encSel)
+		if err != nil {
+			http.Error(w, "invalid request: bad selector", http.StatusBadRequest)
+			return
+		}
+	}
+	csel, err := selector.CompileSelector(sel)
+	if err != nil {
+		http.Error(w, "invalid request: bad selector", http.StatusBadRequest)
+		return
+	}
+
+	// Load the root before writing anything, so that a missing root is
+	// reported with an error status.
+	rootData, err := p.lsys.LoadRaw(ipld.LinkContext{Ctx: r.Context()}, cidlink.Link{Cid: c})
+	if err != nil {
+		if isNotFound(err) {
+			http.Error(w, "cid not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "unable to load data for cid", http.StatusInternalServerError)
+		log.Errorw("Failed to load requested block", "err", err, "cid", c)
+		return
+	}
+	rootNode, err := decodeBlock(p.lsys, c, rootData)
+	if err != nil {
+		http.Error(w, "unable to decode root", http.StatusInternalServerError)
+		log.Errorw("Failed to decode requested block", "err", err, "cid", c)
+		return
+	}
+
+	w.Header().Set("Content-Type", carContentType)
+	cw, err := carutil.NewWriterV1(w, []cid.Cid{c})
+	if err == nil {
+		err = cw.Put(c, rootData)
+	}
+	if err == nil {
+		err = writeCar(r.Context(), p.lsys, cw, rootNode, csel)
+	}
+	if err != nil {
+		log.Errorw("Failed to write car stream", "err", err, "cid", c)
+	}
+}
+
+// isNotFound returns true if err is returned by the link system for a block
+// that it does not have.
+func isNotFound(err error) bool {
+	return errors.Is(err, ipld.ErrNotExists{}) || errors.Is(err, datastore.ErrNotFound)
+}
+
+// contentType returns the HTTP content type for the codec of the block
+// identified by c.
+func contentType(c cid.Cid) string {
+	switch multicodec.Code(c.Prefix().Codec) {
+	case multicodec.DagJson:
+		return "application/vnd.ipld.dag-json"
+	case multicodec.DagCbor:
+		return "application/vnd.ipld.dag-cbor"
+	case multicodec.Raw:
+		return "application/vnd.ipld.raw"
+	case multicodec.Json:
+		return "application/json"
+	case multicodec.Cbor:
+		return "application/cbor"
+	default:
+		return "application/octet-stream"
+	}
+}
@@ -0,0 +1,200 @@
+package httpsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// statusError is returned when a publisher responds with an unsuccessful
+// status code.
+type statusError struct {
+	url        string
+	status     int
+	retryAfter time.Duration
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("non success http code at %s: %d", e.url, e.status)
+}
+
+// Is returns true for ErrContentNotFound if the publisher responded with
+// http.StatusNotFound.
+func (e statusError) Is(target error) bool {
+	return target == ErrContentNotFound && e.status == http.StatusNotFound
+}
+
+// newStatusError returns a statusError for the response, with the delay
+// requested by its Retry-After header, if any.
+func newStatusError(reqURL string, resp *http.Response) statusError {
+	err := statusError{
+		url:    reqURL,
+		status: resp.StatusCode,
+	}
+	if ra := resp.Header.Get("Retry-After"); ra != "" {
+		if secs, perr := strconv.Atoi(ra); perr == nil && secs > 0 {
+			err.retryAfter = time.Duration(secs) * time.Second
+		} else if t, perr := http.ParseTime(ra); perr == nil {
+			err.retryAfter = time.Until(t)
+		}
+	}
+	return err
+}
+
+// PublisherUnhealthyError is returned when a fetch from a publisher is not
+// attempted, because too many consecutive fetches from the publisher failed.
+// Fetches are attempted again once Until has passed.
+type PublisherUnhealthyError struct {
+	// PeerID is the unhealthy publisher.
+	PeerID peer.ID
+	// Failures is the number of consecutive failed fetches.
+	Failures int
+	// Until is when fetches from the publisher are attempted again.
+	Until time.Time
+}
+
+func (e PublisherUnhealthyError) Error() string {
+	return fmt.Sprintf("publisher %s is unhealthy after %d failed fetches; retry after %s", e.PeerID, e.Failures, e.Until.Format(time.RFC3339))
+}
+
+// Temporary returns true, since the fetch can be retried after Until.
+func (e PublisherUnhealthyError) Temporary() bool { return true }
+
+// transient returns true if err is a failure that may not recur, so that the
+// fetch can be retried. These are server errors, too many requests, network
+// timeouts, refused or reset connections, and responses that end early. Any
+// other error, such as a failed TLS handshake or a malformed URL, fails the
+// fetch immediately.
+func transient(err error) bool {
+	var serr statusError
+	if errors.As(err, &serr) {
+		return serr.status >= http.StatusInternalServerError || serr.status == http.StatusTooManyRequests
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// retryDelay returns how long to wait before retrying a fetch that failed with
+// err, after the given number of attempts. The delay requested by the
+// publisher is honored, up to maxBackoff.
+func (s *Sync) retryDelay(err error, attempts int) time.Duration {
+	delay := s.minBackoff << (attempts - 1)
+	if delay <= 0 || delay > s.maxBackoff {
+		delay = s.maxBackoff
+	}
+	var serr statusError
+	if errors.As(err, &serr) && serr.retryAfter > delay {
+		delay = serr.retryAfter
+		if delay > s.maxBackoff {
+			delay = s.maxBackoff
+		}
+	}
+	return delay
+}
+
+// fetchBlockDataRetry fetches the data of the block c, retrying a fetch that
+// fails with a transient error, with exponential backoff, up to the maximum
+// number of attempts.
+func (s *Syncer) fetchBlockDataRetry(ctx context.Context, c cid.Cid) ([]byte, error) {
+	for attempts := 1; ; attempts++ {
+		data, err := s.fetchBlockData(ctx, c)
+		if err == nil || attempts >= s.sync.maxAttempts || !transient(err) || ctx.Err() != nil {
+			return data, err
+		}
+		delay := s.sync.retryDelay(err, attempts)
+		log.Warnw("Retrying failed block fetch", "err", err, "cid", c, "peer", s.peerID, "attempt", attempts, "delay", delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// circuitBreaker stops fetches from a publisher after too many consecutive
+// fetches from it fail, so that syncs with an unhealthy publisher fail fast
+// instead of waiting for each request to fail.
+type circuitBreaker struct {
+	maxFailures int
+	cooldown    time.Duration
+
+	peers map[peer.ID]*peerHealth
+	mutex sync.Mutex
+}
+
+// peerHealth is the health of a publisher.
+type peerHealth struct {
+	failures  int
+	openUntil time.Time
+}
+
+// allow returns a PublisherUnhealthyError if fetches from the publisher are
+// stopped.
+func (cb *circuitBreaker) allow(peerID peer.ID) error {
+	if cb.maxFailures == 0 {
+		return nil
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	ph, ok := cb.peers[peerID]
+	if !ok || !time.Now().Before(ph.openUntil) {
+		return nil
+	}
+	return PublisherUnhealthyError{
+		PeerID:   peerID,
+		Failures: ph.failures,
+		Until:    ph.openUntil,
+	}
+}
+
+// record records the result of a fetch from the publisher. Only transient
+// errors count as failures, since other errors are not due to the health of
+// the publisher.
+func (cb *circuitBreaker) record(peerID peer.ID, err error) {
+	if cb.maxFailures == 0 {
+		return
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if err == nil {
+		delete(cb.peers, peerID)
+		return
+	}
+	if !transient(err) {
+		return
+	}
+	if cb.peers == nil {
+		cb.peers = make(map[peer.ID]*peerHealth)
+	}
+	ph, ok := cb.peers[peerID]
+	if !ok {
+		ph = &peerHealth{}
+		cb.peers[peerID] = ph
+	}
+	ph.failures++
+	if ph.failures >= cb.maxFailures {
+		// After the cooldown, a single failure stops fetches again.
+		ph.openUntil = time.Now().Add(cb.cooldown)
+		log.Warnw("Stopping fetches from unhealthy publisher", "peer", peerID, "failures", ph.failures, "until", ph.openUntil)
+	}
+}
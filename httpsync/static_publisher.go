@@ -0,0 +1,148 @@
+package httpsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal"
+	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// staticPublisher writes the signed head and chain blocks to a directory, in
+// the same layout that is served by the http publisher. The directory can be
+// hosted by any static file server, such as S3 or GitHub Pages, and synced
+// from using an httpsync Syncer with the URL of the hosted directory.
+type staticPublisher struct {
+	dir     string
+	lsys    ipld.LinkSystem
+	privKey ic.PrivKey
+	// mutex serializes updates to the directory.
+	mutex sync.Mutex
+}
+
+// NewStaticPublisher creates a new publisher that writes the signed head to
+// the file "head", and each block of the published DAG to a file named by the
+// block's CID, in the directory dir. Blocks are written as stored in lsys,
+// without re-encoding, so that their digests can be verified by subscribers.
+func NewStaticPublisher(dir string, lsys ipld.LinkSystem, privKey ic.PrivKey) (*staticPublisher, error) {
+	if privKey == nil {
+		return nil, errors.New("private key required to sign head")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create publish directory: %w", err)
+	}
+	return &staticPublisher{
+		dir:     dir,
+		lsys:    lsys,
+		privKey: privKey,
+	}, nil
+}
+
+// SetRoot writes the blocks of the DAG rooted at c, and then the signed head
+// for c, to the publish directory. Blocks that already have a file are not
+// written again, nor are the blocks they link to.
+func (p *staticPublisher) SetRoot(ctx context.Context, c cid.Cid) error {
+	if c == cid.Undef {
+		return errors.New("cannot update to an undefined cid")
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err := p.writeDag(ctx, c); err != nil {
+		return err
+	}
+
+	signedHead, err := newEncodedSignedHead(c, p.privKey)
+	if err != nil {
+		return fmt.Errorf("cannot encode signed head: %w", err)
+	}
+	return p.writeFile("head", signedHead)
+}
+
+func (p *staticPublisher) UpdateRoot(ctx context.Context, c cid.Cid) error {
+	return p.SetRoot(ctx, c)
+}
+
+func (p *staticPublisher) UpdateRootWithAddrs(ctx context.Context, c cid.Cid, _ []multiaddr.Multiaddr) error {
+	return p.SetRoot(ctx, c)
+}
+
+func (p *staticPublisher) Close() error {
+	return nil
+}
+
+// writeDag writes the block c and all blocks linked from it. Linked blocks are
+// written first, so that an existing block file means that all the blocks it
+// links to also exist.
+func (p *staticPublisher) writeDag(ctx context.Context, c cid.Cid) error {
+	blockPath := filepath.Join(p.dir, c.String())
+	if _, err := os.Stat(blockPath); err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	lctx := ipld.LinkContext{Ctx: ctx}
+	lnk := cidlink.Link{Cid: c}
+	n, err := p.lsys.Load(lctx, lnk, basicnode.Prototype.Any)
+	if err != nil {
+		return fmt.Errorf("cannot load block %s: %w", c, err)
+	}
+	links, err := traversal.SelectLinks(n)
+	if err != nil {
+		return fmt.Errorf("cannot get links from block %s: %w", c, err)
+	}
+	for _, l := range links {
+		if err = p.writeDag(ctx, l.(cidlink.Link).Cid); err != nil {
+			return err
+		}
+	}
+
+	r, err := p.lsys.StorageReadOpener(lctx, lnk)
+	if err != nil {
+		return fmt.Errorf("cannot read block %s: %w", c, err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("cannot read block %s: %w", c, err)
+	}
+	log.Debugw("Writing block to publish directory", "cid", c)
+	return p.writeFile(c.String(), data)
+}
+
+// writeFile atomically writes data to the named file in the publish
+// directory, so that a partially written file is never served.
+func (p *staticPublisher) writeFile(name string, data []byte) error {
+	tmp, err := os.CreateTemp(p.dir, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		// Make the file readable by the server that hosts the directory.
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(p.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("cannot write %s to publish directory: %w", name, err)
+	}
+	return nil
+}
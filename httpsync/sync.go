@@ -9,9 +9,14 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	maurl "github.com/filecoin-project/go-legs/httpsync/multiaddr"
+	"github.com/filecoin-project/go-legs/internal/tracing"
+	"github.com/filecoin-project/go-legs/metrics"
 	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipld/go-ipld-prime"
@@ -21,90 +26,270 @@ import (
 	"github.com/ipld/go-ipld-prime/traversal"
 	"github.com/ipld/go-ipld-prime/traversal/selector"
 	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/multiformats/go-multihash"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/time/rate"
 )
 
-const defaultHttpTimeout = 10 * time.Second
+const (
+	defaultHttpTimeout = 10 * time.Second
+	// maxBlockResumes is the number of times that an interrupted block fetch
+	// is resumed with a range request.
+	maxBlockResumes = 3
+)
 
 var log = logging.Logger("go-legs-httpsync")
 
+// tracerName names the tracer that creates the spans that trace syncs and
+// block fetches.
+const tracerName = "go-legs-httpsync"
+
 // Sync provides sync functionality for use with all http syncs.
 type Sync struct {
-	blockHook func(peer.ID, cid.Cid)
-	client    *http.Client
-	lsys      ipld.LinkSystem
+	authHeader AuthHeaderFunc
+	blockHook  func(peer.ID, cid.Cid)
+	localHook  func(peer.ID, cid.Cid)
+	client     *http.Client
+	lsys       ipld.LinkSystem
+	metrics    *metrics.Metrics
+	skipCid    func(peer.ID, cid.Cid) bool
+	tracer     trace.Tracer
+
+	// clientHost dials publishers that serve HTTP over libp2p streams, with
+	// streamClient. It is nil if not set.
+	clientHost   host.Host
+	streamClient *http.Client
+
+	// maxAttempts is the number of times a block fetch is attempted.
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	// breaker stops fetches from publishers that are failing.
+	breaker circuitBreaker
+
+	// carSupport records which publishers serve CAR streams.
+	carSupport carSupport
+	// heads records the latest head fetched from each publisher.
+	heads headCache
+
+	// fetches maps the CID of each block being fetched to the in-progress
+	// fetch. This is nil unless fetch deduplication is enabled.
+	fetches      map[cid.Cid]*blockFetch
+	fetchesMutex sync.Mutex
 }
 
-func NewSync(lsys ipld.LinkSystem, client *http.Client, blockHook func(peer.ID, cid.Cid)) *Sync {
+// blockFetch is an in-progress fetch of a block that other syncs can wait on.
+type blockFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func NewSync(lsys ipld.LinkSystem, client *http.Client, blockHook func(peer.ID, cid.Cid), options ...SyncOption) *Sync {
+	cfg := getSyncOpts(options)
+
 	if client == nil {
 		client = &http.Client{
 			Timeout: defaultHttpTimeout,
 		}
+		if cfg.tlsConfig != nil {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = cfg.tlsConfig
+			client.Transport = transport
+		}
+	} else if cfg.tlsConfig != nil {
+		log.Warn("Ignoring client TLS config since http client is given")
+	}
+	s := &Sync{
+		authHeader: cfg.authHeader,
+		blockHook:  blockHook,
+		localHook:  cfg.localHook,
+		client:     client,
+		lsys:       lsys,
+		metrics:    cfg.metrics,
+		skipCid:    cfg.skipCid,
+		tracer:     tracing.Tracer(cfg.tracerProv, tracerName),
+
+		maxAttempts: cfg.maxAttempts,
+		minBackoff:  cfg.minBackoff,
+		maxBackoff:  cfg.maxBackoff,
+		breaker: circuitBreaker{
+			maxFailures: cfg.maxFailures,
+			cooldown:    cfg.cooldown,
+		},
 	}
-	return &Sync{
-		blockHook: blockHook,
-		client:    client,
-		lsys:      lsys,
+	if cfg.dedupFetches {
+		s.fetches = make(map[cid.Cid]*blockFetch)
 	}
+	if cfg.clientHost != nil {
+		s.clientHost = cfg.clientHost
+		s.streamClient = newStreamClient(cfg.clientHost, cfg.clientRelay)
+	}
+	return s
 }
 
-// NewSyncer creates a new Syncer to use for a single sync operation against a peer.
+// NewSyncer creates a new Syncer to use for a single sync operation against a
+// peer. If peerAddr is a /p2p address, such as returned by StreamAddr, then the
+// Syncer sends its requests over libp2p streams from the host given by the
+// WithClientHost option.
 func (s *Sync) NewSyncer(peerID peer.ID, peerAddr multiaddr.Multiaddr, rateLimiter *rate.Limiter) (*Syncer, error) {
-	rootURL, err := maurl.ToURL(peerAddr)
+	client := s.client
+	var rootURL *url.URL
+	var err error
+	if isStreamAddr(peerAddr) {
+		if s.clientHost == nil {
+			return nil, errNoClientHost
+		}
+		client = s.streamClient
+		rootURL, err = streamURL(s.clientHost, peerAddr)
+	} else {
+		rootURL, err = maurl.ToURL(peerAddr)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	return &Syncer{
+		client:      client,
+		lsys:        s.lsys,
 		peerID:      peerID,
 		rateLimiter: rateLimiter,
 		rootURL:     *rootURL,
 		sync:        s,
+		overStreams: isStreamAddr(peerAddr),
 	}, nil
 }
 
+// NewSyncerWithLinkSystem creates a new Syncer, like NewSyncer, that stores
+// synced blocks in lsys instead of in the Sync's link system. Blocks are only
+// read from lsys, so blocks that are in the Sync's link system are fetched
+// again. Fetches by the Syncer are not shared with other syncs.
+func (s *Sync) NewSyncerWithLinkSystem(peerID peer.ID, peerAddr multiaddr.Multiaddr, rateLimiter *rate.Limiter, lsys ipld.LinkSystem) (*Syncer, error) {
+	syncer, err := s.NewSyncer(peerID, peerAddr, rateLimiter)
+	if err != nil {
+		return nil, err
+	}
+	syncer.lsys = lsys
+	syncer.separateStore = true
+	return syncer, nil
+}
+
 func (s *Sync) Close() {
 	s.client.CloseIdleConnections()
+	if s.streamClient != nil {
+		s.streamClient.CloseIdleConnections()
+	}
 }
 
 var errHeadFromUnexpectedPeer = errors.New("found head signed from an unexpected peer")
 
+// ErrContentNotFound is returned, wrapped, when a sync fails because the
+// publisher responded that it does not have the requested content.
+var ErrContentNotFound = errors.New("content not found")
+
 type Syncer struct {
+	// client sends requests to the publisher.
+	client      *http.Client
+	lsys        ipld.LinkSystem
 	peerID      peer.ID
 	rateLimiter *rate.Limiter
 	rootURL     url.URL
 	sync        *Sync
+	// overStreams is true if client sends requests over libp2p streams.
+	overStreams bool
+	// separateStore is true if lsys is not the Sync's link system.
+	separateStore bool
+	// fetchedBytes is the number of response body bytes read by the Syncer.
+	fetchedBytes int64
+	// fetched is the set of blocks fetched from the publisher by the current
+	// sync, as opposed to found in the link system.
+	fetched map[cid.Cid]struct{}
+}
+
+// OverStreams returns true if the Syncer sends its requests over libp2p
+// streams, because it was created for a /p2p address of the publisher.
+func (s *Syncer) OverStreams() bool {
+	return s.overStreams
 }
 
 func (s *Syncer) GetHead(ctx context.Context) (cid.Cid, error) {
+	ctx, span := s.sync.tracer.Start(ctx, "getHead", trace.WithAttributes(
+		attribute.String("peer", s.peerID.String())))
+	c, err := s.getHead(ctx, nil)
+	tracing.EndSpan(span, err)
+	return c, err
+}
+
+// getHead fetches the head, with the given query parameters, and verifies that
+// it is signed by the publisher. If the head was fetched from the publisher
+// before, then the request is conditional on the head having changed.
+func (s *Syncer) getHead(ctx context.Context, query url.Values) (cid.Cid, error) {
+	var header http.Header
+	cached, ok := s.sync.heads.get(s.peerID)
+	if ok {
+		header = http.Header{}
+		header.Set("If-None-Match", cached.etag)
+	}
+
 	var head cid.Cid
 	var pubKey ic.PubKey
-	err := s.fetch(ctx, "head", func(msg io.Reader) error {
+	var etag string
+	var notModified bool
+	err := s.fetchRequest(ctx, "head", query, header, func(resp *http.Response) error {
+		if resp.StatusCode == http.StatusNotModified {
+			notModified = true
+			return nil
+		}
+		etag = resp.Header.Get("ETag")
 		var err error
-		pubKey, head, err = openSignedHeadWithIncludedPubKey(msg)
+		pubKey, head, err = openSignedHeadWithIncludedPubKey(resp.Body)
 		return err
 	})
-
 	if err != nil {
 		return cid.Undef, err
 	}
+	if notModified {
+		// The cached head was verified when it was fetched.
+		return cached.head, nil
+	}
+
+	if err = s.checkSigner(pubKey); err != nil {
+		return cid.Undef, err
+	}
+
+	s.sync.heads.set(s.peerID, etag, head)
+	return head, nil
+}
 
+// checkSigner returns an error if pubKey, which signed a head, is not the
+// publisher's key.
+func (s *Syncer) checkSigner(pubKey ic.PubKey) error {
 	peerIDFromSig, err := peer.IDFromPublicKey(pubKey)
 	if err != nil {
-		return cid.Undef, err
+		return err
 	}
 
 	if peerIDFromSig != s.peerID {
-		return cid.Undef, errHeadFromUnexpectedPeer
+		return errHeadFromUnexpectedPeer
 	}
-
-	return head, nil
+	return nil
 }
 
 func (s *Syncer) Sync(ctx context.Context, nextCid cid.Cid, sel ipld.Node) error {
+	ctx, span := s.sync.tracer.Start(ctx, "sync", trace.WithAttributes(
+		attribute.String("peer", s.peerID.String()),
+		attribute.String("cid", nextCid.String())))
+	err := s.doSync(ctx, nextCid, sel)
+	tracing.EndSpan(span, err)
+	return err
+}
+
+func (s *Syncer) doSync(ctx context.Context, nextCid cid.Cid, sel ipld.Node) error {
+	startBytes := atomic.LoadInt64(&s.fetchedBytes)
+	s.fetched = make(map[cid.Cid]struct{})
 	xsel, err := selector.CompileSelector(sel)
 	if err != nil {
 		msg := "failed to compile selector"
@@ -112,7 +297,25 @@ func (s *Syncer) Sync(ctx context.Context, nextCid cid.Cid, sel ipld.Node) error
 		return errors.New(msg)
 	}
 
-	cids, err := s.walkFetch(ctx, nextCid, xsel)
+	// Fetch the selected DAG in a single request, if the publisher serves CAR
+	// streams and the DAG is not already stored. The traversal then stores
+	// the blocks of the CAR stream that it reaches, and fetches any missing
+	// blocks individually. Blocks of the CAR stream that the traversal does
+	// not reach, such as blocks below a skipped block, are discarded.
+	var carBuf *carBuffer
+	if !s.stored(ctx, nextCid) {
+		if _, known := s.sync.carSupport.get(s.peerID); !known {
+			// Fetch the root block first, since the publisher's response
+			// tells whether it serves CAR streams. Any error is reported by
+			// the traversal.
+			if s.fetchBlock(ctx, nextCid) == nil {
+				s.fetched[nextCid] = struct{}{}
+			}
+		}
+		carBuf = s.fetchCar(ctx, nextCid, sel)
+	}
+
+	cids, err := s.walkFetch(ctx, nextCid, xsel, carBuf)
 	if err != nil {
 		log.Errorw("failed to traverse requested dag", "err", err, "root", nextCid)
 		return fmt.Errorf("failed to traverse requested dag: %w", err)
@@ -129,11 +332,17 @@ func (s *Syncer) Sync(ctx context.Context, nextCid cid.Cid, sel ipld.Node) error
 	// end when we no longer care what it does with the blocks.
 	if s.sync.blockHook != nil {
 		for _, c := range cids {
+			if _, ok := s.fetched[c]; !ok && s.sync.localHook != nil {
+				s.sync.localHook(s.peerID, c)
+				continue
+			}
 			s.sync.blockHook(s.peerID, c)
 		}
 	}
 
-	s.sync.client.CloseIdleConnections()
+	s.sync.metrics.Transferred("httpsync", len(cids), atomic.LoadInt64(&s.fetchedBytes)-startBytes)
+
+	s.client.CloseIdleConnections()
 	return nil
 }
 
@@ -141,8 +350,9 @@ func (s *Syncer) Sync(ctx context.Context, nextCid cid.Cid, sel ipld.Node) error
 // selector walks over, walkFetch will look to see if it can find it in the
 // local data store. If it cannot, it will then go and get it over HTTP.  This
 // emulates way libp2p/graphsync fetches data, but the actual fetch of data is
-// done over HTTP.
-func (s *Syncer) walkFetch(ctx context.Context, rootCid cid.Cid, sel selector.Selector) ([]cid.Cid, error) {
+// done over HTTP. Blocks held by carBuf, which may be nil, are stored instead
+// of being fetched.
+func (s *Syncer) walkFetch(ctx context.Context, rootCid cid.Cid, sel selector.Selector, carBuf *carBuffer) ([]cid.Cid, error) {
 	// Track the order of cids we've seen during our traversal so we can call the
 	// block hook function in the same order. We emulate the behavior of
 	// graphsync's `OnIncomingBlockHook`, this means we call the blockhook even if
@@ -153,16 +363,25 @@ func (s *Syncer) walkFetch(ctx context.Context, rootCid cid.Cid, sel selector.Se
 	getMissingLs.TrustedStorage = true
 	getMissingLs.StorageReadOpener = func(lc ipld.LinkContext, l ipld.Link) (io.Reader, error) {
 		c := l.(cidlink.Link).Cid
-		r, err := s.sync.lsys.StorageReadOpener(lc, l)
+		if s.skip(c) {
+			return nil, traversal.SkipMe{}
+		}
+		r, err := s.lsys.StorageReadOpener(lc, l)
 		if err == nil {
 			// Found block read opener, so return it.
 			traversalOrder = append(traversalOrder, c)
 			return r, nil
 		}
 
+		// Store the block from the car stream if it has the block.
+		buffered, err := s.storeBuffered(ctx, carBuf, c)
+		if err != nil {
+			return nil, err
+		}
+
 		// Did not find block read opener, so fetch block via HTTP with re-try in case rate limit is
 		// reached.
-		for {
+		for !buffered {
 			if err = s.fetchBlock(ctx, c); err != nil {
 				log.Errorw("Failed to fetch block", "err", err, "cid", c)
 				if _, ok := err.(rateLimitErr); ok {
@@ -173,8 +392,9 @@ func (s *Syncer) walkFetch(ctx context.Context, rootCid cid.Cid, sel selector.Se
 			}
 			break
 		}
+		s.fetched[c] = struct{}{}
 
-		r, err = s.sync.lsys.StorageReadOpener(lc, l)
+		r, err = s.lsys.StorageReadOpener(lc, l)
 		if err == nil {
 			traversalOrder = append(traversalOrder, c)
 		}
@@ -189,6 +409,9 @@ func (s *Syncer) walkFetch(ctx context.Context, rootCid cid.Cid, sel selector.Se
 		},
 		Path: datamodel.NewPath([]datamodel.PathSegment{}),
 	}
+	if s.skip(rootCid) {
+		return nil, nil
+	}
 	// get the direct node.
 	rootNode, err := getMissingLs.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: rootCid}, basicnode.Prototype.Any)
 	if err != nil {
@@ -203,6 +426,25 @@ func (s *Syncer) walkFetch(ctx context.Context, rootCid cid.Cid, sel selector.Se
 	return traversalOrder, nil
 }
 
+// stored returns true if the block identified by c is in the Syncer's link
+// system.
+func (s *Syncer) stored(ctx context.Context, c cid.Cid) bool {
+	r, err := s.lsys.StorageReadOpener(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c})
+	if err != nil {
+		return false
+	}
+	if cl, ok := r.(io.Closer); ok {
+		cl.Close()
+	}
+	return true
+}
+
+// skip returns true if the block identified by c is not to be fetched or
+// traversed.
+func (s *Syncer) skip(c cid.Cid) bool {
+	return s.sync.skipCid != nil && s.sync.skipCid(s.peerID, c)
+}
+
 type rateLimitErr struct {
 	resource string
 	rootURL  url.URL
@@ -213,11 +455,56 @@ func (r rateLimitErr) Error() string {
 	return fmt.Sprintf("rate limit reached when fetching %s from %s at %s", r.resource, r.source, r.rootURL.String())
 }
 
-func (s *Syncer) fetch(ctx context.Context, rsrc string, cb func(io.Reader) error) error {
+// BlockHashMismatchError is returned when the data that a publisher sends for
+// a block does not match the block's CID. The data is not stored.
+type BlockHashMismatchError struct {
+	// Cid is the CID of the requested block.
+	Cid cid.Cid
+	// Sum is the digest of the received data.
+	Sum multihash.Multihash
+	// Source is the peer the block was requested from.
+	Source peer.ID
+}
+
+func (e BlockHashMismatchError) Error() string {
+	return fmt.Sprintf("hash digest mismatch; expected %s but got %s", e.Cid.Hash().B58String(), e.Sum.B58String())
+}
+
+// fetchQuery fetches rsrc from the publisher, with the given query parameters,
+// and calls cb with the response body.
+func (s *Syncer) fetchQuery(ctx context.Context, rsrc string, query url.Values, cb func(io.Reader) error) error {
+	return s.fetchRequest(ctx, rsrc, query, nil, func(resp *http.Response) error {
+		return cb(resp.Body)
+	})
+}
+
+// fetchRequest fetches rsrc from the publisher, with the given query
+// parameters and request headers, and calls cb with the response. The response
+// must have status OK, partial content if a range is requested, or not
+// modified if the request is conditional. The result is recorded in the
+// circuit breaker, and the request is not made if the publisher is unhealthy.
+func (s *Syncer) fetchRequest(ctx context.Context, rsrc string, query url.Values, header http.Header, cb func(*http.Response) error) error {
+	if err := s.sync.breaker.allow(s.peerID); err != nil {
+		return err
+	}
+	err := s.doFetchRequest(ctx, rsrc, query, header, cb)
+	if ctx.Err() == nil {
+		s.sync.breaker.record(s.peerID, err)
+	}
+	return err
+}
+
+func (s *Syncer) doFetchRequest(ctx context.Context, rsrc string, query url.Values, header http.Header, cb func(*http.Response) error) error {
 	localURL := s.rootURL
 	localURL.Path = path.Join(s.rootURL.Path, rsrc)
+	if query != nil {
+		localURL.RawQuery = query.Encode()
+	}
 
-	if s.rateLimiter != nil {
+	// Allow does not consume a token when the rate limit is reached, so that
+	// Wait then consumes the token the fetch waits for.
+	if s.rateLimiter != nil && !s.rateLimiter.Allow() {
+		s.sync.metrics.RateLimited("httpsync")
 		err := s.rateLimiter.Wait(ctx)
 		if err != nil {
 			return &rateLimitErr{
@@ -232,50 +519,212 @@ func (s *Syncer) fetch(ctx context.Context, rsrc string, cb func(io.Reader) erro
 	if err != nil {
 		return err
 	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	if s.sync.authHeader != nil {
+		auth, err := s.sync.authHeader(ctx, s.peerID)
+		if err != nil {
+			return fmt.Errorf("cannot get authorization header: %w", err)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+	}
 
-	resp, err := s.sync.client.Do(req)
+	resp, err := s.client.Do(req)
 	if err != nil {
 		log.Errorw("Failed to execute fetch request", "err", err)
 		return err
 	}
-	if resp.StatusCode != http.StatusOK {
-		err := fmt.Errorf("non success http code at %s: %d", localURL.String(), resp.StatusCode)
+	defer resp.Body.Close()
+
+	if !successStatus(req, resp) {
+		err := newStatusError(localURL.String(), resp)
 		log.Errorw("Fetch was not successful", "err", err)
 		return err
 	}
 
-	defer resp.Body.Close()
-	return cb(resp.Body)
+	if !strings.HasSuffix(rsrc, carSuffix) {
+		// The head and block responses advertise whether the publisher
+		// serves CAR streams.
+		s.sync.carSupport.set(s.peerID, resp.Header.Get(carSupportHeader) == "true")
+	}
+	// Count the bytes received, before they are decoded. Block data is
+	// verified against its CID after it is decoded.
+	resp.Body = &countingReader{ReadCloser: resp.Body, count: &s.fetchedBytes}
+	if err = decodeContent(resp); err != nil {
+		return err
+	}
+	return cb(resp)
 }
 
-// fetchBlock fetches an item into the datastore at c if not locally available.
-func (s *Syncer) fetchBlock(ctx context.Context, c cid.Cid) error {
-	n, err := s.sync.lsys.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c}, basicnode.Prototype.Any)
-	// node is already present.
-	if n != nil && err == nil {
-		return nil
+// successStatus returns true if the response has status OK, partial content
+// for a range request, or not modified for a conditional request.
+func successStatus(req *http.Request, resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true
+	case http.StatusPartialContent:
+		return req.Header.Get("Range") != ""
+	case http.StatusNotModified:
+		return req.Header.Get("If-None-Match") != ""
 	}
+	return false
+}
 
-	return s.fetch(ctx, c.String(), func(data io.Reader) error {
-		writer, committer, err := s.sync.lsys.StorageWriteOpener(ipld.LinkContext{Ctx: ctx})
-		if err != nil {
-			log.Errorw("Failed to get write opener", "err", err)
-			return err
+// countingReader adds the number of bytes read to count.
+type countingReader struct {
+	io.ReadCloser
+	count *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+	return n, err
+}
+
+// fetchBlockData fetches the data of the block c. If the response is cut off
+// while its body is read, and the publisher supports range requests, then the
+// rest of the data is requested starting where the previous response ended,
+// instead of starting over. This is done up to maxBlockResumes times. The data
+// is not verified against c.
+func (s *Syncer) fetchBlockData(ctx context.Context, c cid.Cid) ([]byte, error) {
+	var data []byte
+	var etag string
+	for resumes := 0; ; resumes++ {
+		var header http.Header
+		if len(data) != 0 {
+			header = http.Header{}
+			header.Set("Range", fmt.Sprintf("bytes=%d-", len(data)))
+			if etag != "" {
+				// Only get the rest of the same block data.
+				header.Set("If-Range", etag)
+			}
 		}
-		tee := io.TeeReader(data, writer)
-		sum, err := multihash.SumStream(tee, c.Prefix().MhType, c.Prefix().MhLength)
-		if err != nil {
+
+		var resumable bool
+		err := s.fetchRequest(ctx, c.String(), nil, header, func(resp *http.Response) error {
+			if resp.StatusCode == http.StatusPartialContent {
+				wantRange := fmt.Sprintf("bytes %d-", len(data))
+				if !strings.HasPrefix(resp.Header.Get("Content-Range"), wantRange) {
+					return fmt.Errorf("unexpected content range: %s", resp.Header.Get("Content-Range"))
+				}
+			} else {
+				// The response has all the data.
+				data = data[:0]
+			}
+			etag = resp.Header.Get("ETag")
+
+			buf := bytes.NewBuffer(data)
+			_, err := buf.ReadFrom(resp.Body)
+			data = buf.Bytes()
+			if err != nil {
+				resumable = len(data) != 0 && resp.Header.Get("Accept-Ranges") == "bytes"
+			}
 			return err
+		})
+		if err == nil {
+			return data, nil
 		}
-		if !bytes.Equal(c.Hash(), sum) {
-			err := fmt.Errorf("hash digest mismatch; expected %s but got %s", c.Hash().B58String(), sum.B58String())
-			log.Errorw("Failed to persist fetched block with mismatching digest", "cid", c, "err", err)
-			return err
+		if !resumable || resumes == maxBlockResumes || ctx.Err() != nil {
+			return nil, err
 		}
-		if err = committer(cidlink.Link{Cid: c}); err != nil {
-			log.Errorw("Failed to commit", "err", err)
-			return err
+		log.Warnw("Resuming interrupted block fetch", "err", err, "cid", c, "offset", len(data), "peer", s.peerID)
+	}
+}
+
+// fetchBlock fetches an item into the datastore at c if not locally available.
+// If fetch deduplication is enabled and another sync is already fetching the
+// item, then wait for that fetch instead of fetching the item again.
+func (s *Syncer) fetchBlock(ctx context.Context, c cid.Cid) error {
+	if s.sync.fetches == nil || s.separateStore {
+		return s.doFetchBlock(ctx, c)
+	}
+
+	s.sync.fetchesMutex.Lock()
+	bf, ok := s.sync.fetches[c]
+	if !ok {
+		bf = &blockFetch{
+			done: make(chan struct{}),
 		}
+		s.sync.fetches[c] = bf
+		s.sync.fetchesMutex.Unlock()
+
+		bf.err = s.doFetchBlock(ctx, c)
+
+		s.sync.fetchesMutex.Lock()
+		delete(s.sync.fetches, c)
+		s.sync.fetchesMutex.Unlock()
+		close(bf.done)
+		return bf.err
+	}
+	s.sync.fetchesMutex.Unlock()
+
+	log.Debugw("Waiting for block being fetched by another sync", "cid", c, "peer", s.peerID)
+	select {
+	case <-bf.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if bf.err == nil {
+		// The block was fetched, and its digest verified, by the other sync.
 		return nil
-	})
+	}
+	// The other sync failed to fetch the block, so fetch it from this
+	// syncer's publisher.
+	return s.doFetchBlock(ctx, c)
+}
+
+func (s *Syncer) doFetchBlock(ctx context.Context, c cid.Cid) error {
+	ctx, span := s.sync.tracer.Start(ctx, "fetchBlock", trace.WithAttributes(
+		attribute.String("cid", c.String())))
+	err := s.fetchAndStoreBlock(ctx, c)
+	tracing.EndSpan(span, err)
+	return err
+}
+
+func (s *Syncer) fetchAndStoreBlock(ctx context.Context, c cid.Cid) error {
+	n, err := s.lsys.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c}, basicnode.Prototype.Any)
+	// node is already present.
+	if n != nil && err == nil {
+		return nil
+	}
+
+	// Verify the received data before writing any of it to the link system,
+	// so that a misbehaving publisher cannot store data that does not match
+	// its CID.
+	data, err := s.fetchBlockDataRetry(ctx, c)
+	if err != nil {
+		return err
+	}
+	sum, err := multihash.Sum(data, c.Prefix().MhType, c.Prefix().MhLength)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(c.Hash(), sum) {
+		err := BlockHashMismatchError{
+			Cid:    c,
+			Sum:    sum,
+			Source: s.peerID,
+		}
+		log.Errorw("Failed to persist fetched block with mismatching digest", "cid", c, "err", err)
+		return err
+	}
+
+	writer, committer, err := s.lsys.StorageWriteOpener(ipld.LinkContext{Ctx: ctx})
+	if err != nil {
+		log.Errorw("Failed to get write opener", "err", err)
+		return err
+	}
+	if _, err = writer.Write(data); err != nil {
+		return err
+	}
+	if err = committer(cidlink.Link{Cid: c}); err != nil {
+		log.Errorw("Failed to commit", "err", err)
+		return err
+	}
+	return nil
 }
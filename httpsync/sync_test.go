@@ -1,30 +1,52 @@
 package httpsync_test
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/acl"
 	"github.com/filecoin-project/go-legs/httpsync"
 	lma "github.com/filecoin-project/go-legs/httpsync/multiaddr"
+	"github.com/filecoin-project/go-legs/metrics"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/filecoin-project/go-legs/throttle"
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
 	"github.com/ipld/go-ipld-prime"
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
 	_ "github.com/ipld/go-ipld-prime/codec/dagjson"
 	_ "github.com/ipld/go-ipld-prime/codec/raw"
 	"github.com/ipld/go-ipld-prime/fluent"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
 	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/multiformats/go-multicodec"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -93,6 +115,10 @@ func TestHttpSync_NFTStorage_DigestCheck(t *testing.T) {
 
 			if test.wantErr != "" {
 				require.ErrorContains(t, err, test.wantErr)
+				var mismatchErr httpsync.BlockHashMismatchError
+				require.ErrorAs(t, err, &mismatchErr)
+				require.Equal(t, head, mismatchErr.Cid)
+				require.Equal(t, pubid, mismatchErr.Source)
 				_, exists := store.Bag[head.KeyString()]
 				require.False(t, exists)
 			} else {
@@ -180,3 +206,1495 @@ func TestHttpsync_AcceptsSpecCompliantDagJson(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, gotLink, wantLink, "computed %s but got %s", gotLink.String(), wantLink.String())
 }
+
+func TestHttpsync_PublisherRequiresMatchingKey(t *testing.T) {
+	pubPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	otherPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	otherID, err := peer.IDFromPrivateKey(otherPrK)
+	require.NoError(t, err)
+
+	_, err = httpsync.NewPublisher("0.0.0.0:0", cidlink.DefaultLinkSystem(), otherID, pubPrK)
+	require.ErrorContains(t, err, "does not match")
+}
+
+func TestHttpsync_ContentNotFound(t *testing.T) {
+	pubid, err := peer.Decode("QmQzqxhK82kAmKvARFZSkUVS6fo9sySaiogAnx5EnZ6ZmC")
+	require.NoError(t, err)
+	pub := httptest.NewServer(http.NotFoundHandler())
+	defer pub.Close()
+	puburl, err := url.Parse(pub.URL)
+	require.NoError(t, err)
+	pubmaddr, err := lma.ToMultiaddr(puburl)
+	require.NoError(t, err)
+
+	ls := cidlink.DefaultLinkSystem()
+	store := &memstore.Store{}
+	ls.SetWriteStorage(store)
+	ls.SetReadStorage(store)
+	sync := httpsync.NewSync(ls, http.DefaultClient, nil)
+	syncer, err := sync.NewSyncer(pubid, pubmaddr, nil)
+	require.NoError(t, err)
+
+	cids, err := test.RandomCids(1)
+	require.NoError(t, err)
+	err = syncer.Sync(context.Background(), cids[0], selectorparse.CommonSelector_MatchPoint)
+	require.ErrorIs(t, err, httpsync.ErrContentNotFound)
+}
+
+func TestHttpsync_PublisherServerTLS(t *testing.T) {
+	ctx := context.Background()
+
+	pubPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pubID, err := peer.IDFromPrivateKey(pubPrK)
+	require.NoError(t, err)
+
+	// Use the certificate of a test TLS server, and its client that trusts it.
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	tlsConfig := &tls.Config{Certificates: ts.TLS.Certificates}
+
+	publs := cidlink.DefaultLinkSystem()
+	pubstore := &memstore.Store{}
+	publs.SetWriteStorage(pubstore)
+	publs.SetReadStorage(pubstore)
+
+	pub, err := httpsync.NewPublisherServer("127.0.0.1:0", publs, pubID, pubPrK,
+		httpsync.WithTLSConfig(tlsConfig), httpsync.WithShutdownTimeout(time.Second))
+	require.NoError(t, err)
+	_, err = pub.Address().ValueForProtocol(multiaddr.P_HTTPS)
+	require.NoError(t, err, "expected https address")
+
+	link, err := publs.Store(ipld.LinkContext{Ctx: ctx},
+		cidlink.LinkPrototype{
+			Prefix: cid.Prefix{
+				Version:  1,
+				Codec:    uint64(multicodec.DagJson),
+				MhType:   uint64(multicodec.Sha2_256),
+				MhLength: -1,
+			},
+		},
+		fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+			na.AssembleEntry("fish").AssignString("lobster")
+		}))
+	require.NoError(t, err)
+	root := link.(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(ctx, root))
+
+	sync := httpsync.NewSync(cidlink.DefaultLinkSystem(), ts.Client(), nil)
+	syncer, err := sync.NewSyncer(pubID, pub.Address(), nil)
+	require.NoError(t, err)
+	head, err := syncer.GetHead(ctx)
+	require.NoError(t, err)
+	require.Equal(t, root, head)
+
+	// The server no longer accepts requests after the publisher is closed.
+	require.NoError(t, pub.Close())
+	_, err = syncer.GetHead(ctx)
+	require.Error(t, err)
+}
+
+func TestHttpsync_Auth(t *testing.T) {
+	ctx := context.Background()
+
+	pubPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pubID, err := peer.IDFromPrivateKey(pubPrK)
+	require.NoError(t, err)
+
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	tlsConfig := &tls.Config{Certificates: ts.TLS.Certificates}
+
+	const token = "Bearer fish"
+	requireToken := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != token {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	publs := cidlink.DefaultLinkSystem()
+	pubstore := &memstore.Store{}
+	publs.SetWriteStorage(pubstore)
+	publs.SetReadStorage(pubstore)
+
+	pub, err := httpsync.NewPublisherServer("127.0.0.1:0", publs, pubID, pubPrK,
+		httpsync.WithTLSConfig(tlsConfig), httpsync.WithMiddleware(requireToken))
+	require.NoError(t, err)
+	defer pub.Close()
+	cids, err := test.RandomCids(1)
+	require.NoError(t, err)
+	root := cids[0]
+	require.NoError(t, pub.SetRoot(ctx, root))
+
+	// The client TLS config trusts the publisher's certificate.
+	clientTLS := ts.Client().Transport.(*http.Transport).TLSClientConfig
+
+	sync := httpsync.NewSync(cidlink.DefaultLinkSystem(), nil, nil, httpsync.WithClientTLSConfig(clientTLS))
+	syncer, err := sync.NewSyncer(pubID, pub.Address(), nil)
+	require.NoError(t, err)
+	_, err = syncer.GetHead(ctx)
+	require.ErrorContains(t, err, "401")
+
+	var authPeer peer.ID
+	authHeader := func(_ context.Context, peerID peer.ID) (string, error) {
+		authPeer = peerID
+		return token, nil
+	}
+	sync = httpsync.NewSync(cidlink.DefaultLinkSystem(), nil, nil,
+		httpsync.WithClientTLSConfig(clientTLS), httpsync.WithAuthHeader(authHeader))
+	syncer, err = sync.NewSyncer(pubID, pub.Address(), nil)
+	require.NoError(t, err)
+	head, err := syncer.GetHead(ctx)
+	require.NoError(t, err)
+	require.Equal(t, root, head)
+	require.Equal(t, pubID, authPeer)
+}
+
+func TestHttpsync_PublisherMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	pubPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pubID, err := peer.IDFromPrivateKey(pubPrK)
+	require.NoError(t, err)
+
+	publs := test.MkLinkSystem(datastore.NewMapDatastore())
+	link, err := publs.Store(ipld.LinkContext{Ctx: ctx},
+		cidlink.LinkPrototype{
+			Prefix: cid.Prefix{
+				Version:  1,
+				Codec:    uint64(multicodec.DagJson),
+				MhType:   uint64(multicodec.Sha2_256),
+				MhLength: -1,
+			},
+		},
+		fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+			na.AssembleEntry("fish").AssignString("lobster")
+		}))
+	require.NoError(t, err)
+	root := link.(cidlink.Link).Cid
+
+	reg := prometheus.NewRegistry()
+	var infos []httpsync.RequestInfo
+	var mutex sync.Mutex
+	hook := func(info httpsync.RequestInfo) {
+		mutex.Lock()
+		infos = append(infos, info)
+		mutex.Unlock()
+	}
+	pub, err := httpsync.NewPublisherServer("127.0.0.1:0", publs, pubID, pubPrK,
+		httpsync.WithMetrics(reg), httpsync.WithRequestHook(hook))
+	require.NoError(t, err)
+	defer pub.Close()
+	require.NoError(t, pub.SetRoot(ctx, root))
+
+	// A second publisher shares the registered counters.
+	other, err := httpsync.NewPublisherServer("127.0.0.1:0", publs, pubID, pubPrK, httpsync.WithMetrics(reg))
+	require.NoError(t, err)
+	defer other.Close()
+
+	subls := cidlink.DefaultLinkSystem()
+	substore := &memstore.Store{}
+	subls.SetWriteStorage(substore)
+	subls.SetReadStorage(substore)
+	sub := httpsync.NewSync(subls, http.DefaultClient, nil)
+	syncer, err := sub.NewSyncer(pubID, pub.Address(), nil)
+	require.NoError(t, err)
+	head, err := syncer.GetHead(ctx)
+	require.NoError(t, err)
+	require.NoError(t, syncer.Sync(ctx, head, selectorparse.CommonSelector_ExploreAllRecursively))
+
+	pubURL, err := lma.ToURL(pub.Address())
+	require.NoError(t, err)
+	missing, err := test.RandomCids(1)
+	require.NoError(t, err)
+	for _, rsrc := range []string{missing[0].String(), "fish"} {
+		resp, err := http.Get(pubURL.String() + "/" + rsrc)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	counts := make(map[string]float64)
+	for _, mf := range families {
+		counts[mf.GetName()] = mf.GetMetric()[0].GetCounter().GetValue()
+	}
+	require.Equal(t, map[string]float64{
+		"legs_httpsync_publisher_blocks_served_total":  1,
+		"legs_httpsync_publisher_block_misses_total":   1,
+		"legs_httpsync_publisher_request_errors_total": 1,
+	}, counts)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Len(t, infos, 4)
+	require.Equal(t, "head", infos[0].Resource)
+	require.Equal(t, cid.Undef, infos[0].Cid)
+	require.Equal(t, http.StatusOK, infos[0].Status)
+	require.Equal(t, root, infos[1].Cid)
+	require.Equal(t, http.MethodGet, infos[1].Method)
+	require.Equal(t, http.StatusOK, infos[1].Status)
+	require.NotZero(t, infos[1].Bytes)
+	require.Equal(t, missing[0], infos[2].Cid)
+	require.Equal(t, http.StatusNotFound, infos[2].Status)
+	require.Equal(t, http.StatusBadRequest, infos[3].Status)
+}
+
+func TestHttpsync_SyncMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	pubPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pubID, err := peer.IDFromPrivateKey(pubPrK)
+	require.NoError(t, err)
+
+	publs := test.MkLinkSystem(datastore.NewMapDatastore())
+	chainLnks := test.MkChain(publs, true)
+	root := chainLnks[0].(cidlink.Link).Cid
+
+	pub, err := httpsync.NewPublisher("127.0.0.1:0", publs, pubID, pubPrK)
+	require.NoError(t, err)
+	defer pub.Close()
+	require.NoError(t, pub.SetRoot(ctx, root))
+
+	reg := prometheus.NewRegistry()
+	m, err := metrics.New(reg)
+	require.NoError(t, err)
+
+	subls := test.MkLinkSystem(datastore.NewMapDatastore())
+	sub := httpsync.NewSync(subls, http.DefaultClient, nil, httpsync.WithSyncMetrics(m))
+	syncer, err := sub.NewSyncer(pubID, pub.Address(), nil)
+	require.NoError(t, err)
+	require.NoError(t, syncer.Sync(ctx, root, selectorparse.CommonSelector_ExploreAllRecursively))
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	hists := make(map[string]float64)
+	for _, mf := range families {
+		if h := mf.GetMetric()[0].GetHistogram(); h != nil {
+			hists[mf.GetName()] = h.GetSampleSum()
+		}
+	}
+	require.GreaterOrEqual(t, hists["legs_sync_blocks"], float64(len(chainLnks)))
+	require.NotZero(t, hists["legs_sync_bytes"])
+}
+
+func TestHttpsync_PublisherPersistsRoot(t *testing.T) {
+	ctx := context.Background()
+
+	pubPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pubID, err := peer.IDFromPrivateKey(pubPrK)
+	require.NoError(t, err)
+
+	publs := cidlink.DefaultLinkSystem()
+	pubstore := &memstore.Store{}
+	publs.SetWriteStorage(pubstore)
+	publs.SetReadStorage(pubstore)
+	ds := datastore.NewMapDatastore()
+
+	pub, err := httpsync.NewPublisherServer("127.0.0.1:0", publs, pubID, pubPrK, httpsync.WithDatastore(ds))
+	require.NoError(t, err)
+	cids, err := test.RandomCids(1)
+	require.NoError(t, err)
+	root := cids[0]
+	require.NoError(t, pub.SetRoot(ctx, root))
+	require.NoError(t, pub.Close())
+
+	// A restarted publisher serves the persisted root.
+	pub, err = httpsync.NewPublisherServer("127.0.0.1:0", publs, pubID, pubPrK, httpsync.WithDatastore(ds))
+	require.NoError(t, err)
+
+	sync := httpsync.NewSync(cidlink.DefaultLinkSystem(), http.DefaultClient, nil)
+	syncer, err := sync.NewSyncer(pubID, pub.Address(), nil)
+	require.NoError(t, err)
+	head, err := syncer.GetHead(ctx)
+	require.NoError(t, err)
+	require.Equal(t, root, head)
+
+	// Clearing the root persists no root, and the publisher restarts without
+	// one.
+	require.NoError(t, pub.SetRoot(ctx, cid.Undef))
+	require.NoError(t, pub.Close())
+	pub, err = httpsync.NewPublisherServer("127.0.0.1:0", publs, pubID, pubPrK, httpsync.WithDatastore(ds))
+	require.NoError(t, err)
+	defer pub.Close()
+	require.Equal(t, cid.Undef, pub.Root())
+}
+
+func TestHttpsync_ServesOriginalBlocks(t *testing.T) {
+	ctx := context.Background()
+
+	pubPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pubID, err := peer.IDFromPrivateKey(pubPrK)
+	require.NoError(t, err)
+
+	publs := cidlink.DefaultLinkSystem()
+	pubstore := &memstore.Store{}
+	publs.SetWriteStorage(pubstore)
+	publs.SetReadStorage(pubstore)
+
+	pub, err := httpsync.NewPublisher("0.0.0.0:0", publs, pubID, pubPrK)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, pub.Close()) })
+
+	mkPrefix := func(codec multicodec.Code) cidlink.LinkPrototype {
+		return cidlink.LinkPrototype{
+			Prefix: cid.Prefix{
+				Version:  1,
+				Codec:    uint64(codec),
+				MhType:   uint64(multicodec.Sha2_256),
+				MhLength: -1,
+			},
+		}
+	}
+	rawLink, err := publs.Store(ipld.LinkContext{Ctx: ctx}, mkPrefix(multicodec.Raw), basicnode.NewBytes([]byte("lobster")))
+	require.NoError(t, err)
+	cborLink, err := publs.Store(ipld.LinkContext{Ctx: ctx}, mkPrefix(multicodec.DagCbor),
+		fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(na fluent.MapAssembler) {
+			na.AssembleEntry("fish").AssignString("barreleye")
+			na.AssembleEntry("next").AssignLink(rawLink)
+		}))
+	require.NoError(t, err)
+	root := cborLink.(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(ctx, root))
+
+	// Blocks are served as stored, with a content type for their codec.
+	pubURL, err := lma.ToURL(pub.Address())
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		lnk         ipld.Link
+		contentType string
+	}{
+		{cborLink, "application/vnd.ipld.dag-cbor"},
+		{rawLink, "application/vnd.ipld.raw"},
+	} {
+		resp, err := http.Get(pubURL.String() + "/" + tc.lnk.String())
+		require.NoError(t, err)
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, tc.contentType, resp.Header.Get("Content-Type"))
+		want, err := pubstore.Get(ctx, tc.lnk.Binary())
+		require.NoError(t, err)
+		require.Equal(t, want, data)
+	}
+
+	ls := cidlink.DefaultLinkSystem()
+	store := &memstore.Store{}
+	ls.SetWriteStorage(store)
+	ls.SetReadStorage(store)
+
+	sync := httpsync.NewSync(ls, http.DefaultClient, nil)
+	syncer, err := sync.NewSyncer(pubID, pub.Address(), nil)
+	require.NoError(t, err)
+	head, err := syncer.GetHead(ctx)
+	require.NoError(t, err)
+	require.Equal(t, root, head)
+	require.NoError(t, syncer.Sync(ctx, head, selectorparse.CommonSelector_ExploreAllRecursively))
+
+	for _, lnk := range []ipld.Link{cborLink, rawLink} {
+		_, exists := store.Bag[lnk.Binary()]
+		require.True(t, exists, "block %s not synced", lnk)
+	}
+}
+
+func TestHttpsync_DedupFetches(t *testing.T) {
+	ctx := context.Background()
+
+	publs := cidlink.DefaultLinkSystem()
+	pubstore := &memstore.Store{}
+	publs.SetWriteStorage(pubstore)
+	publs.SetReadStorage(pubstore)
+	link, err := publs.Store(
+		ipld.LinkContext{Ctx: ctx},
+		cidlink.LinkPrototype{
+			Prefix: cid.Prefix{
+				Version:  1,
+				Codec:    uint64(multicodec.DagJson),
+				MhType:   uint64(multicodec.Sha2_256),
+				MhLength: -1,
+			},
+		},
+		fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+			na.AssembleEntry("fish").AssignString("lobster")
+		}))
+	require.NoError(t, err)
+	root := link.(cidlink.Link).Cid
+
+	// Start two mirrors serving the same block. The first mirror holds its
+	// response until released, so that the second sync starts while the
+	// first is still fetching.
+	firstStarted := make(chan struct{})
+	releaseFirst := make(chan struct{})
+	var secondRequests int32
+	mkMirror := func(first bool) multiaddr.Multiaddr {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if first {
+				close(firstStarted)
+				<-releaseFirst
+			} else {
+				atomic.AddInt32(&secondRequests, 1)
+			}
+			data, err := pubstore.Get(ctx, root.KeyString())
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write(data)
+		}))
+		t.Cleanup(srv.Close)
+		srvURL, err := url.Parse(srv.URL)
+		require.NoError(t, err)
+		maddr, err := lma.ToMultiaddr(srvURL)
+		require.NoError(t, err)
+		return maddr
+	}
+	firstAddr := mkMirror(true)
+	secondAddr := mkMirror(false)
+
+	ls := cidlink.DefaultLinkSystem()
+	store := &memstore.Store{}
+	ls.SetWriteStorage(store)
+	ls.SetReadStorage(store)
+	sync := httpsync.NewSync(ls, http.DefaultClient, nil, httpsync.WithDedupFetches(true))
+
+	syncFrom := func(maddr multiaddr.Multiaddr) <-chan error {
+		errCh := make(chan error, 1)
+		syncer, err := sync.NewSyncer(peer.ID("mirror"), maddr, nil)
+		require.NoError(t, err)
+		go func() {
+			errCh <- syncer.Sync(ctx, root, selectorparse.CommonSelector_MatchPoint)
+		}()
+		return errCh
+	}
+
+	firstErr := syncFrom(firstAddr)
+	<-firstStarted
+	secondErr := syncFrom(secondAddr)
+	// Give the second sync time to find the in-progress fetch.
+	time.Sleep(100 * time.Millisecond)
+	close(releaseFirst)
+
+	require.NoError(t, <-firstErr)
+	require.NoError(t, <-secondErr)
+	require.Zero(t, atomic.LoadInt32(&secondRequests), "block fetched more than once")
+}
+
+func TestHttpsync_StaticPublisher(t *testing.T) {
+	ctx := context.Background()
+
+	pubPrK, _, err := crypto.GenerateKeyPairWithReader(crypto.Ed25519, 256, rand.Reader)
+	require.NoError(t, err)
+	pubID, err := peer.IDFromPrivateKey(pubPrK)
+	require.NoError(t, err)
+
+	publs := cidlink.DefaultLinkSystem()
+	pubstore := &memstore.Store{}
+	publs.SetWriteStorage(pubstore)
+	publs.SetReadStorage(pubstore)
+	lp := cidlink.LinkPrototype{
+		Prefix: cid.Prefix{
+			Version:  1,
+			Codec:    uint64(multicodec.DagJson),
+			MhType:   uint64(multicodec.Sha2_256),
+			MhLength: -1,
+		},
+	}
+	var prev ipld.Link
+	var chain []cid.Cid
+	for i := 0; i < 3; i++ {
+		prevLink := prev
+		prev, err = publs.Store(ipld.LinkContext{Ctx: ctx}, lp, fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(na fluent.MapAssembler) {
+			na.AssembleEntry("value").AssignInt(int64(i))
+			if prevLink != nil {
+				na.AssembleEntry("previous").AssignLink(prevLink)
+			} else {
+				na.AssembleEntry("previous").AssignNull()
+			}
+		}))
+		require.NoError(t, err)
+		chain = append(chain, prev.(cidlink.Link).Cid)
+	}
+
+	// Publish the first two chain entries to a directory served by a plain
+	// file server.
+	dir := t.TempDir()
+	pub, err := httpsync.NewStaticPublisher(dir, publs, pubPrK)
+	require.NoError(t, err)
+	require.NoError(t, pub.UpdateRoot(ctx, chain[1]))
+
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	t.Cleanup(srv.Close)
+	srvURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	srvAddr, err := lma.ToMultiaddr(srvURL)
+	require.NoError(t, err)
+
+	subls := cidlink.DefaultLinkSystem()
+	substore := &memstore.Store{}
+	subls.SetWriteStorage(substore)
+	subls.SetReadStorage(substore)
+	sync := httpsync.NewSync(subls, http.DefaultClient, nil)
+	syncer, err := sync.NewSyncer(pubID, srvAddr, nil)
+	require.NoError(t, err)
+
+	head, err := syncer.GetHead(ctx)
+	require.NoError(t, err)
+	require.Equal(t, chain[1], head)
+
+	// Publish the next entry, and check that the whole chain is synced.
+	require.NoError(t, pub.UpdateRoot(ctx, chain[2]))
+	head, err = syncer.GetHead(ctx)
+	require.NoError(t, err)
+	require.Equal(t, chain[2], head)
+	require.NoError(t, syncer.Sync(ctx, head, selectorparse.CommonSelector_ExploreAllRecursively))
+	for _, c := range chain {
+		_, exists := substore.Bag[c.KeyString()]
+		require.True(t, exists)
+	}
+}
+
+// countingTransport counts the requests made with it, by path.
+type countingTransport struct {
+	requests []string
+}
+
+func (ct *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ct.requests = append(ct.requests, path.Base(req.URL.Path))
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestHttpsync_CarStream(t *testing.T) {
+	ctx := context.Background()
+
+	pubPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pubID, err := peer.IDFromPrivateKey(pubPrK)
+	require.NoError(t, err)
+
+	publs := cidlink.DefaultLinkSystem()
+	pubstore := &memstore.Store{}
+	publs.SetWriteStorage(pubstore)
+	publs.SetReadStorage(pubstore)
+
+	// Build a chain of blocks, each linking to the previous one.
+	buildChain := func(prev ipld.Link, fish ...string) ipld.Link {
+		for _, f := range fish {
+			n := fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(na fluent.MapAssembler) {
+				na.AssembleEntry("fish").AssignString(f)
+				if prev != nil {
+					na.AssembleEntry("next").AssignLink(prev)
+				}
+			})
+			lnk, err := publs.Store(ipld.LinkContext{Ctx: ctx}, cidlink.LinkPrototype{
+				Prefix: cid.Prefix{
+					Version:  1,
+					Codec:    uint64(multicodec.DagJson),
+					MhType:   uint64(multicodec.Sha2_256),
+					MhLength: -1,
+				},
+			}, n)
+			require.NoError(t, err)
+			prev = lnk
+		}
+		return prev
+	}
+	first := buildChain(nil, "lobster", "barreleye", "dasea", "anglerfish")
+	second := buildChain(first, "hagfish", "blobfish")
+
+	for _, serveCar := range []bool{false, true} {
+		pub, err := httpsync.NewPublisherServer("127.0.0.1:0", publs, pubID, pubPrK, httpsync.WithServeCar(serveCar))
+		require.NoError(t, err)
+		defer pub.Close()
+
+		ls := cidlink.DefaultLinkSystem()
+		store := &memstore.Store{}
+		ls.SetWriteStorage(store)
+		ls.SetReadStorage(store)
+		transport := &countingTransport{}
+		var hooked []cid.Cid
+		blockHook := func(_ peer.ID, c cid.Cid) {
+			hooked = append(hooked, c)
+		}
+		sync := httpsync.NewSync(ls, &http.Client{Transport: transport}, blockHook)
+
+		syncer, err := sync.NewSyncer(pubID, pub.Address(), nil)
+		require.NoError(t, err)
+		require.NoError(t, syncer.Sync(ctx, first.(cidlink.Link).Cid, selectorparse.CommonSelector_ExploreAllRecursively))
+		require.Len(t, hooked, 4)
+		require.Equal(t, first.(cidlink.Link).Cid, hooked[0])
+		require.Len(t, store.Bag, 4)
+		if serveCar {
+			// The root block response advertises car streams, so the rest
+			// of the DAG is fetched in one request.
+			require.Len(t, transport.requests, 2)
+		} else {
+			require.Len(t, transport.requests, 4)
+		}
+
+		// Sync the rest of the chain, stopping at the first sync.
+		hooked = nil
+		transport.requests = nil
+		sel := legs.ExploreRecursiveWithStopNode(selector.RecursionLimitNone(), nil, first)
+		syncer, err = sync.NewSyncer(pubID, pub.Address(), nil)
+		require.NoError(t, err)
+		require.NoError(t, syncer.Sync(ctx, second.(cidlink.Link).Cid, sel))
+		require.Len(t, hooked, 2)
+		require.Len(t, store.Bag, 6)
+
+		if serveCar {
+			// The publisher is known to serve car streams, so the DAG is
+			// fetched in one request.
+			require.Len(t, transport.requests, 1)
+			require.Equal(t, second.(cidlink.Link).Cid.String()+".car", transport.requests[0])
+		} else {
+			require.Len(t, transport.requests, 2)
+		}
+	}
+}
+
+// injectingTransport appends a block that is not in the requested DAG to each
+// CAR stream response.
+type injectingTransport struct {
+	c    cid.Cid
+	data []byte
+}
+
+func (it *injectingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil || !strings.HasSuffix(req.URL.Path, ".car") || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	section := make([]byte, binary.MaxVarintLen64)
+	section = section[:binary.PutUvarint(section, uint64(len(it.c.Bytes())+len(it.data)))]
+	section = append(section, it.c.Bytes()...)
+	section = append(section, it.data...)
+	resp.Body = &cutBody{
+		Reader: io.MultiReader(resp.Body, bytes.NewReader(section)),
+		Closer: resp.Body,
+	}
+	resp.ContentLength = -1
+	return resp, nil
+}
+
+func TestHttpsync_CarStreamStoresSelectedBlocks(t *testing.T) {
+	ctx := context.Background()
+
+	pubPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pubID, err := peer.IDFromPrivateKey(pubPrK)
+	require.NoError(t, err)
+
+	publs := cidlink.DefaultLinkSystem()
+	pubstore := &memstore.Store{}
+	publs.SetWriteStorage(pubstore)
+	publs.SetReadStorage(pubstore)
+	head := test.MkChain(publs, true)[0].(cidlink.Link).Cid
+
+	pub, err := httpsync.NewPublisherServer("127.0.0.1:0", publs, pubID, pubPrK, httpsync.WithServeCar(true))
+	require.NoError(t, err)
+	defer pub.Close()
+
+	// A block that is valid, but is not part of the synced DAG.
+	extraData := []byte("not selected")
+	extra, err := cid.Prefix{
+		Version:  1,
+		Codec:    uint64(multicodec.Raw),
+		MhType:   uint64(multicodec.Sha2_256),
+		MhLength: -1,
+	}.Sum(extraData)
+	require.NoError(t, err)
+
+	ls := cidlink.DefaultLinkSystem()
+	store := &memstore.Store{}
+	ls.SetWriteStorage(store)
+	ls.SetReadStorage(store)
+	transport := &injectingTransport{c: extra, data: extraData}
+	sync := httpsync.NewSync(ls, &http.Client{Transport: transport}, nil)
+
+	// The first sync learns that the publisher serves car streams, and the
+	// second fetches the whole DAG as one.
+	for i := 0; i < 2; i++ {
+		syncer, err := sync.NewSyncer(pubID, pub.Address(), nil)
+		require.NoError(t, err)
+		require.NoError(t, syncer.Sync(ctx, head, selectorparse.CommonSelector_ExploreAllRecursively))
+	}
+	require.Equal(t, len(pubstore.Bag), len(store.Bag))
+	has, err := store.Has(ctx, extra.KeyString())
+	require.NoError(t, err)
+	require.False(t, has, "block outside of the selected DAG was stored")
+
+	// Oversized and deeply nested selectors are rejected.
+	pubURL, err := lma.ToURL(pub.Address())
+	require.NoError(t, err)
+	for _, encSel := range []string{
+		strings.Repeat("e", 8<<10),
+		base64.RawURLEncoding.EncodeToString([]byte(strings.Repeat("[", 40) + strings.Repeat("]", 40))),
+	} {
+		resp, err := http.Get(pubURL.String() + "/" + head.String() + ".car?selector=" + encSel)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+// interruptingTransport cuts off the body of the first response for path
+// after half of it is read, and records the Range header of each request.
+type interruptingTransport struct {
+	path        string
+	interrupted bool
+	ranges      []string
+}
+
+func (it *interruptingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil || path.Base(req.URL.Path) != it.path {
+		return resp, err
+	}
+	it.ranges = append(it.ranges, req.Header.Get("Range"))
+	if !it.interrupted {
+		it.interrupted = true
+		resp.Body = &cutBody{
+			Reader: io.LimitReader(resp.Body, resp.ContentLength/2),
+			Closer: resp.Body,
+		}
+	}
+	return resp, nil
+}
+
+// cutBody returns io.ErrUnexpectedEOF once its reader is exhausted.
+type cutBody struct {
+	io.Reader
+	io.Closer
+}
+
+func (cb *cutBody) Read(p []byte) (int, error) {
+	n, err := cb.Reader.Read(p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func TestHttpsync_ResumesInterruptedBlockFetch(t *testing.T) {
+	ctx := context.Background()
+
+	pubPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pubID, err := peer.IDFromPrivateKey(pubPrK)
+	require.NoError(t, err)
+
+	publs := cidlink.DefaultLinkSystem()
+	pubstore := &memstore.Store{}
+	publs.SetWriteStorage(pubstore)
+	publs.SetReadStorage(pubstore)
+
+	data := make([]byte, 1<<20)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	lnk, err := publs.Store(ipld.LinkContext{Ctx: ctx}, cidlink.LinkPrototype{
+		Prefix: cid.Prefix{
+			Version:  1,
+			Codec:    uint64(multicodec.Raw),
+			MhType:   uint64(multicodec.Sha2_256),
+			MhLength: -1,
+		},
+	}, basicnode.NewBytes(data))
+	require.NoError(t, err)
+	c := lnk.(cidlink.Link).Cid
+
+	pub, err := httpsync.NewPublisherServer("127.0.0.1:0", publs, pubID, pubPrK)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	ls := cidlink.DefaultLinkSystem()
+	store := &memstore.Store{}
+	ls.SetWriteStorage(store)
+	ls.SetReadStorage(store)
+	transport := &interruptingTransport{path: c.String()}
+	sync := httpsync.NewSync(ls, &http.Client{Transport: transport}, nil)
+	syncer, err := sync.NewSyncer(pubID, pub.Address(), nil)
+	require.NoError(t, err)
+
+	require.NoError(t, syncer.Sync(ctx, c, selectorparse.CommonSelector_ExploreAllRecursively))
+	stored, exists := store.Bag[c.KeyString()]
+	require.True(t, exists)
+	require.Equal(t, data, stored)
+
+	// The second request resumes where the first response was cut off.
+	require.Equal(t, []string{"", fmt.Sprintf("bytes=%d-", len(data)/2)}, transport.ranges)
+}
+
+func TestHttpsync_RetryAndCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+
+	pubPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pubID, err := peer.IDFromPrivateKey(pubPrK)
+	require.NoError(t, err)
+
+	publs := cidlink.DefaultLinkSystem()
+	pubstore := &memstore.Store{}
+	publs.SetWriteStorage(pubstore)
+	publs.SetReadStorage(pubstore)
+	lnk, err := publs.Store(ipld.LinkContext{Ctx: ctx}, cidlink.LinkPrototype{
+		Prefix: cid.Prefix{
+			Version:  1,
+			Codec:    uint64(multicodec.DagJson),
+			MhType:   uint64(multicodec.Sha2_256),
+			MhLength: -1,
+		},
+	}, fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("fish").AssignString("lobster")
+	}))
+	require.NoError(t, err)
+	c := lnk.(cidlink.Link).Cid
+
+	// Fail the given number of requests with a server error.
+	var failures, requests int32
+	failing := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			if atomic.AddInt32(&failures, -1) >= 0 {
+				w.Header().Set("Retry-After", "0")
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	pub, err := httpsync.NewPublisherServer("127.0.0.1:0", publs, pubID, pubPrK, httpsync.WithMiddleware(failing))
+	require.NoError(t, err)
+	defer pub.Close()
+
+	newSync := func() (*httpsync.Sync, *memstore.Store) {
+		ls := cidlink.DefaultLinkSystem()
+		store := &memstore.Store{}
+		ls.SetWriteStorage(store)
+		ls.SetReadStorage(store)
+		return httpsync.NewSync(ls, nil, nil,
+			httpsync.WithRetry(3, time.Millisecond, 10*time.Millisecond),
+			httpsync.WithCircuitBreaker(2, time.Minute)), store
+	}
+
+	// Transient failures are retried.
+	atomic.StoreInt32(&failures, 1)
+	sync, store := newSync()
+	syncer, err := sync.NewSyncer(pubID, pub.Address(), nil)
+	require.NoError(t, err)
+	require.NoError(t, syncer.Sync(ctx, c, selectorparse.CommonSelector_ExploreAllRecursively))
+	require.Contains(t, store.Bag, c.KeyString())
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// Repeated failures make the publisher unhealthy, which aborts the sync.
+	atomic.StoreInt32(&failures, 10)
+	atomic.StoreInt32(&requests, 0)
+	sync, store = newSync()
+	syncer, err = sync.NewSyncer(pubID, pub.Address(), nil)
+	require.NoError(t, err)
+	err = syncer.Sync(ctx, c, selectorparse.CommonSelector_ExploreAllRecursively)
+	var unhealthy httpsync.PublisherUnhealthyError
+	require.ErrorAs(t, err, &unhealthy)
+	require.Equal(t, pubID, unhealthy.PeerID)
+	require.Equal(t, 2, unhealthy.Failures)
+	require.Empty(t, store.Bag)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// Syncs with the unhealthy publisher fail without making requests.
+	syncer, err = sync.NewSyncer(pubID, pub.Address(), nil)
+	require.NoError(t, err)
+	err = syncer.Sync(ctx, c, selectorparse.CommonSelector_ExploreAllRecursively)
+	require.ErrorAs(t, err, &unhealthy)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// Refused connections are retried, but other request errors, such as a
+	// rejected certificate, fail the fetch without retrying.
+	for _, tc := range []struct {
+		err      error
+		attempts int
+	}{
+		{syscall.ECONNREFUSED, 3},
+		{errors.New("certificate rejected"), 1},
+	} {
+		ft := &failingTransport{err: tc.err}
+		ls := cidlink.DefaultLinkSystem()
+		ls.SetWriteStorage(&memstore.Store{})
+		ls.SetReadStorage(&memstore.Store{})
+		sync := httpsync.NewSync(ls, &http.Client{Transport: ft}, nil,
+			httpsync.WithRetry(3, time.Millisecond, 10*time.Millisecond))
+		syncer, err := sync.NewSyncer(pubID, pub.Address(), nil)
+		require.NoError(t, err)
+		err = syncer.Sync(ctx, c, selectorparse.CommonSelector_ExploreAllRecursively)
+		require.ErrorIs(t, err, tc.err)
+		// The block is fetched once to learn whether the publisher serves
+		// CAR streams, and again by the traversal.
+		require.Equal(t, 2*tc.attempts, ft.fetches(c), "fetches failing with %q", tc.err)
+	}
+}
+
+// failingTransport fails every request with err, and counts the requests.
+type failingTransport struct {
+	err      error
+	requests []string
+	mutex    sync.Mutex
+}
+
+func (ft *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ft.mutex.Lock()
+	ft.requests = append(ft.requests, path.Base(req.URL.Path))
+	ft.mutex.Unlock()
+	return nil, ft.err
+}
+
+// fetches returns the number of requests for the block c.
+func (ft *failingTransport) fetches(c cid.Cid) int {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	var n int
+	for _, r := range ft.requests {
+		if r == c.String() {
+			n++
+		}
+	}
+	return n
+}
+
+func TestHttpsync_PublisherThrottle(t *testing.T) {
+	ctx := context.Background()
+
+	pubPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pubID, err := peer.IDFromPrivateKey(pubPrK)
+	require.NoError(t, err)
+	publs := test.MkLinkSystem(datastore.NewMapDatastore())
+	link, err := publs.Store(ipld.LinkContext{Ctx: ctx},
+		cidlink.LinkPrototype{
+			Prefix: cid.Prefix{
+				Version:  1,
+				Codec:    uint64(multicodec.DagJson),
+				MhType:   uint64(multicodec.Sha2_256),
+				MhLength: -1,
+			},
+		},
+		basicnode.NewString("fish"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		opt  httpsync.PublisherOption
+		// served is the number of requests served before the client is
+		// throttled.
+		served int
+		reason throttle.Reason
+	}{
+		{
+			name:   "request rate",
+			opt:    httpsync.WithRequestRateLimit(rate.Every(time.Hour), 2),
+			served: 2,
+			reason: throttle.RequestRate,
+		},
+		{
+			name:   "bytes per hour",
+			opt:    httpsync.WithMaxBytesPerHour(1),
+			served: 1,
+			reason: throttle.Bytes,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reasons []throttle.Reason
+			var mutex sync.Mutex
+			hook := func(client string, reason throttle.Reason) {
+				require.Equal(t, "127.0.0.1", client)
+				mutex.Lock()
+				reasons = append(reasons, reason)
+				mutex.Unlock()
+			}
+			pub, err := httpsync.NewPublisherServer("127.0.0.1:0", publs, pubID, pubPrK, tt.opt, httpsync.WithThrottleHook(hook))
+			require.NoError(t, err)
+			defer pub.Close()
+			require.NoError(t, pub.SetRoot(ctx, link.(cidlink.Link).Cid))
+
+			pubURL, err := lma.ToURL(pub.Address())
+			require.NoError(t, err)
+			for i := 0; i < tt.served; i++ {
+				resp, err := http.Get(pubURL.String() + "/head")
+				require.NoError(t, err)
+				resp.Body.Close()
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+			}
+			resp, err := http.Get(pubURL.String() + "/head")
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+			require.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			require.Equal(t, []throttle.Reason{tt.reason}, reasons)
+		})
+	}
+}
+
+func TestHttpsync_PublisherACL(t *testing.T) {
+	pubPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pubID, err := peer.IDFromPrivateKey(pubPrK)
+	require.NoError(t, err)
+
+	list := acl.New()
+	require.NoError(t, list.AllowIP("192.0.2.0/24"))
+	pub, err := httpsync.NewPublisherServer("127.0.0.1:0", test.MkLinkSystem(datastore.NewMapDatastore()), pubID, pubPrK,
+		httpsync.WithACL(list))
+	require.NoError(t, err)
+	defer pub.Close()
+	pubURL, err := lma.ToURL(pub.Address())
+	require.NoError(t, err)
+
+	resp, err := http.Get(pubURL.String() + "/head")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// The list applies to requests made after it is changed.
+	require.NoError(t, list.AllowIP("127.0.0.1"))
+	resp, err = http.Get(pubURL.String() + "/head")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.NotEqual(t, http.StatusForbidden, resp.StatusCode)
+
+	require.NoError(t, list.DenyIP("127.0.0.0/8"))
+	resp, err = http.Get(pubURL.String() + "/head")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestHttpsync_WatchHead(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pubPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pubID, err := peer.IDFromPrivateKey(pubPrK)
+	require.NoError(t, err)
+	publs := test.MkLinkSystem(datastore.NewMapDatastore())
+	cids, err := test.RandomCids(3)
+	require.NoError(t, err)
+
+	pub, err := httpsync.NewPublisherServer("127.0.0.1:0", publs, pubID, pubPrK, httpsync.WithHeadWebSocket(true))
+	require.NoError(t, err)
+	require.NoError(t, pub.SetRoot(ctx, cids[0]))
+
+	sync := httpsync.NewSync(cidlink.DefaultLinkSystem(), http.DefaultClient, nil)
+	syncer, err := sync.NewSyncer(pubID, pub.Address(), nil)
+	require.NoError(t, err)
+
+	heads, err := syncer.WatchHead(ctx)
+	require.NoError(t, err)
+	requireHead := func(want cid.Cid) {
+		select {
+		case head, ok := <-heads:
+			require.True(t, ok, "head watch stopped")
+			require.Equal(t, want, head)
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for head")
+		}
+	}
+
+	// The current head is sent when the watch starts.
+	requireHead(cids[0])
+	require.NoError(t, pub.UpdateRoot(ctx, cids[1]))
+	requireHead(cids[1])
+	require.NoError(t, pub.SetRoot(ctx, cids[2]))
+	requireHead(cids[2])
+
+	// The head can still be fetched.
+	head, err := syncer.GetHead(ctx)
+	require.NoError(t, err)
+	require.Equal(t, cids[2], head)
+
+	// Canceling the watch closes the channel.
+	watchCtx, cancelWatch := context.WithCancel(ctx)
+	heads2, err := syncer.WatchHead(watchCtx)
+	require.NoError(t, err)
+	require.Equal(t, cids[2], <-heads2)
+	cancelWatch()
+	_, ok := <-heads2
+	require.False(t, ok)
+
+	// A head that is not signed by the expected peer stops the watch.
+	otherPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	otherID, err := peer.IDFromPrivateKey(otherPrK)
+	require.NoError(t, err)
+	otherSyncer, err := sync.NewSyncer(otherID, pub.Address(), nil)
+	require.NoError(t, err)
+	heads2, err = otherSyncer.WatchHead(ctx)
+	require.NoError(t, err)
+	_, ok = <-heads2
+	require.False(t, ok)
+
+	// Closing the publisher closes the channel.
+	require.NoError(t, pub.Close())
+	select {
+	case _, ok := <-heads:
+		require.False(t, ok)
+	case <-ctx.Done():
+		t.Fatal("head watch not stopped by publisher close")
+	}
+}
+
+func TestHttpsync_WatchHeadNotServed(t *testing.T) {
+	ctx := context.Background()
+
+	pubPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pubID, err := peer.IDFromPrivateKey(pubPrK)
+	require.NoError(t, err)
+	pub, err := httpsync.NewPublisher("127.0.0.1:0", test.MkLinkSystem(datastore.NewMapDatastore()), pubID, pubPrK)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	sync := httpsync.NewSync(cidlink.DefaultLinkSystem(), http.DefaultClient, nil)
+	syncer, err := sync.NewSyncer(pubID, pub.Address(), nil)
+	require.NoError(t, err)
+	_, err = syncer.WatchHead(ctx)
+	require.Error(t, err)
+}
+
+func TestHttpsync_HeadLongPoll(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pubPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pubID, err := peer.IDFromPrivateKey(pubPrK)
+	require.NoError(t, err)
+	publs := test.MkLinkSystem(datastore.NewMapDatastore())
+	cids, err := test.RandomCids(2)
+	require.NoError(t, err)
+
+	pub, err := httpsync.NewPublisherServer("127.0.0.1:0", publs, pubID, pubPrK, httpsync.WithHeadLongPoll(time.Minute))
+	require.NoError(t, err)
+	pubURL, err := lma.ToURL(pub.Address())
+	require.NoError(t, err)
+
+	// A long-poll of a publisher with no head ends without a head.
+	resp, err := http.Get(pubURL.String() + "/head?since=&wait=1")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	sync := httpsync.NewSync(cidlink.DefaultLinkSystem(), http.DefaultClient, nil)
+	syncer, err := sync.NewSyncer(pubID, pub.Address(), nil)
+	require.NoError(t, err)
+
+	// The publisher does not serve WebSockets, so the head is long-polled.
+	heads, err := syncer.WatchHead(ctx)
+	require.NoError(t, err)
+	requireHead := func(want cid.Cid) {
+		select {
+		case head, ok := <-heads:
+			require.True(t, ok, "head watch stopped")
+			require.Equal(t, want, head)
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for head")
+		}
+	}
+
+	require.NoError(t, pub.SetRoot(ctx, cids[0]))
+	requireHead(cids[0])
+	require.NoError(t, pub.UpdateRoot(ctx, cids[1]))
+	requireHead(cids[1])
+
+	// A fetch of the head is not held.
+	head, err := syncer.GetHead(ctx)
+	require.NoError(t, err)
+	require.Equal(t, cids[1], head)
+
+	// Closing the publisher ends the long-poll and closes the channel.
+	start := time.Now()
+	require.NoError(t, pub.Close())
+	require.Less(t, time.Since(start), time.Second)
+	select {
+	case _, ok := <-heads:
+		require.False(t, ok)
+	case <-ctx.Done():
+		t.Fatal("head watch not stopped by publisher close")
+	}
+}
+
+func TestHttpsync_ETag(t *testing.T) {
+	ctx := context.Background()
+
+	pubPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pubID, err := peer.IDFromPrivateKey(pubPrK)
+	require.NoError(t, err)
+	publs := test.MkLinkSystem(datastore.NewMapDatastore())
+	link, err := publs.Store(ipld.LinkContext{Ctx: ctx},
+		cidlink.LinkPrototype{
+			Prefix: cid.Prefix{
+				Version:  1,
+				Codec:    uint64(multicodec.DagJson),
+				MhType:   uint64(multicodec.Sha2_256),
+				MhLength: -1,
+			},
+		},
+		basicnode.NewString("fish"))
+	require.NoError(t, err)
+	root := link.(cidlink.Link).Cid
+
+	var mutex sync.Mutex
+	var headStatuses []int
+	hook := func(info httpsync.RequestInfo) {
+		if info.Resource == "head" {
+			mutex.Lock()
+			headStatuses = append(headStatuses, info.Status)
+			mutex.Unlock()
+		}
+	}
+	pub, err := httpsync.NewPublisherServer("127.0.0.1:0", publs, pubID, pubPrK, httpsync.WithRequestHook(hook))
+	require.NoError(t, err)
+	defer pub.Close()
+	require.NoError(t, pub.SetRoot(ctx, root))
+	pubURL, err := lma.ToURL(pub.Address())
+	require.NoError(t, err)
+
+	get := func(rsrc, ifNoneMatch string) *http.Response {
+		req, err := http.NewRequest("GET", pubURL.String()+"/"+rsrc, nil)
+		require.NoError(t, err)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// The head and block ETags are derived from their CIDs.
+	resp := get("head", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	headTag := resp.Header.Get("ETag")
+	require.Equal(t, `W/"`+root.String()+`"`, headTag)
+	require.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+	require.Equal(t, http.StatusNotModified, get("head", headTag).StatusCode)
+	require.Equal(t, http.StatusNotModified, get("head", `"`+root.String()+`"`).StatusCode)
+	require.Equal(t, http.StatusOK, get("head", `W/"other"`).StatusCode)
+
+	resp = get(root.String(), "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, http.StatusNotModified, get(root.String(), resp.Header.Get("ETag")).StatusCode)
+
+	// The syncer fetches the head with conditional requests.
+	mutex.Lock()
+	headStatuses = nil
+	mutex.Unlock()
+	sync := httpsync.NewSync(cidlink.DefaultLinkSystem(), http.DefaultClient, nil)
+	syncer, err := sync.NewSyncer(pubID, pub.Address(), nil)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		head, err := syncer.GetHead(ctx)
+		require.NoError(t, err)
+		require.Equal(t, root, head)
+	}
+
+	cids, err := test.RandomCids(1)
+	require.NoError(t, err)
+	require.NoError(t, pub.SetRoot(ctx, cids[0]))
+	head, err := syncer.GetHead(ctx)
+	require.NoError(t, err)
+	require.Equal(t, cids[0], head)
+
+	// The hook is called after the response is sent.
+	want := []int{http.StatusOK, http.StatusNotModified, http.StatusOK}
+	require.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return fmt.Sprint(headStatuses) == fmt.Sprint(want)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestHttpsync_Compression(t *testing.T) {
+	ctx := context.Background()
+
+	pubPrK, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pubID, err := peer.IDFromPrivateKey(pubPrK)
+	require.NoError(t, err)
+
+	publs := cidlink.DefaultLinkSystem()
+	pubstore := &memstore.Store{}
+	publs.SetWriteStorage(pubstore)
+	publs.SetReadStorage(pubstore)
+	lnk, err := publs.Store(ipld.LinkContext{Ctx: ctx},
+		cidlink.LinkPrototype{
+			Prefix: cid.Prefix{
+				Version:  1,
+				Codec:    uint64(multicodec.DagJson),
+				MhType:   uint64(multicodec.Sha2_256),
+				MhLength: -1,
+			},
+		},
+		basicnode.NewString(strings.Repeat("fish", 4096)))
+	require.NoError(t, err)
+	c := lnk.(cidlink.Link).Cid
+	data := pubstore.Bag[c.KeyString()]
+
+	var mutex sync.Mutex
+	var blockBytes []int64
+	hook := func(info httpsync.RequestInfo) {
+		if info.Resource == c.String() {
+			mutex.Lock()
+			blockBytes = append(blockBytes, info.Bytes)
+			mutex.Unlock()
+		}
+	}
+	pub, err := httpsync.NewPublisherServer("127.0.0.1:0", publs, pubID, pubPrK,
+		httpsync.WithCompression(true), httpsync.WithRequestHook(hook))
+	require.NoError(t, err)
+	defer pub.Close()
+	require.NoError(t, pub.SetRoot(ctx, c))
+	pubURL, err := lma.ToURL(pub.Address())
+	require.NoError(t, err)
+
+	get := func(rsrc, acceptEncoding, rangeHeader string) *http.Response {
+		req, err := http.NewRequest("GET", pubURL.String()+"/"+rsrc, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get(c.String(), "gzip", "")
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	require.Equal(t, `W/"`+c.String()+`"`, resp.Header.Get("ETag"))
+	require.Contains(t, resp.Header.Values("Vary"), "Accept-Encoding")
+	require.Equal(t, "deflate", get(c.String(), "br, deflate", "").Header.Get("Content-Encoding"))
+	require.Equal(t, "deflate", get("head", "deflate, gzip;q=0.5", "").Header.Get("Content-Encoding"))
+	require.Equal(t, "deflate", get("head", "gzip;q=0.5, deflate;q=0.8", "").Header.Get("Content-Encoding"))
+	require.Equal(t, "gzip", get("head", "deflate, gzip", "").Header.Get("Content-Encoding"))
+	require.Equal(t, "gzip", get("head", "*;q=0.5", "").Header.Get("Content-Encoding"))
+	require.Empty(t, get("head", "identity, gzip;q=0.5", "").Header.Get("Content-Encoding"))
+	require.Empty(t, get(c.String(), "gzip;q=0, identity", "").Header.Get("Content-Encoding"))
+	require.Empty(t, get(c.String(), "gzip", "bytes=10-").Header.Get("Content-Encoding"))
+
+	// The syncer decodes compressed blocks, which take fewer bytes to send.
+	mutex.Lock()
+	blockBytes = nil
+	mutex.Unlock()
+	ls := cidlink.DefaultLinkSystem()
+	store := &memstore.Store{}
+	ls.SetWriteStorage(store)
+	ls.SetReadStorage(store)
+	sync := httpsync.NewSync(ls, http.DefaultClient, nil)
+	syncer, err := sync.NewSyncer(pubID, pub.Address(), nil)
+	require.NoError(t, err)
+	head, err := syncer.GetHead(ctx)
+	require.NoError(t, err)
+	require.Equal(t, c, head)
+	require.NoError(t, syncer.Sync(ctx, c, selectorparse.CommonSelector_ExploreAllRecursively))
+	require.Equal(t, data, store.Bag[c.KeyString()])
+
+	require.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(blockBytes) == 1
+	}, time.Second, 10*time.Millisecond)
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Less(t, blockBytes[0], int64(len(data)/10))
+}
+
+func TestHttpsync_Libp2pStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pubHost := test.MkTestHost()
+	defer pubHost.Close()
+	subHost := test.MkTestHost()
+	defer subHost.Close()
+	pubID := pubHost.ID()
+	pubPrK := pubHost.Peerstore().PrivKey(pubID)
+
+	publs := cidlink.DefaultLinkSystem()
+	pubstore := &memstore.Store{}
+	publs.SetWriteStorage(pubstore)
+	publs.SetReadStorage(pubstore)
+	lnk, err := publs.Store(ipld.LinkContext{Ctx: ctx},
+		cidlink.LinkPrototype{
+			Prefix: cid.Prefix{
+				Version:  1,
+				Codec:    uint64(multicodec.DagJson),
+				MhType:   uint64(multicodec.Sha2_256),
+				MhLength: -1,
+			},
+		},
+		basicnode.NewString("fish"))
+	require.NoError(t, err)
+	c := lnk.(cidlink.Link).Cid
+
+	_, err = httpsync.NewPublisherServer("127.0.0.1:0", publs, pubID, pubPrK, httpsync.WithStreamHost(subHost))
+	require.Error(t, err)
+
+	list := acl.New()
+	list.AllowPeer(subHost.ID())
+	pub, err := httpsync.NewPublisherServer("127.0.0.1:0", publs, pubID, pubPrK,
+		httpsync.WithStreamHost(pubHost), httpsync.WithHeadWebSocket(true), httpsync.WithACL(list))
+	require.NoError(t, err)
+	defer pub.Close()
+	require.NoError(t, pub.SetRoot(ctx, c))
+
+	// The publisher is dialed at the transport addresses in its address.
+	pubAddr, err := httpsync.StreamAddr(pubID)
+	require.NoError(t, err)
+	require.Equal(t, "/p2p/"+pubID.String()+"/http", pubAddr.String())
+	pubAddr = multiaddr.Join(pubHost.Addrs()[0], pubAddr)
+
+	// Without a client host, a syncer cannot dial the publisher.
+	_, err = httpsync.NewSync(cidlink.DefaultLinkSystem(), nil, nil).NewSyncer(pubID, pubAddr, nil)
+	require.Error(t, err)
+
+	ls := cidlink.DefaultLinkSystem()
+	store := &memstore.Store{}
+	ls.SetWriteStorage(store)
+	ls.SetReadStorage(store)
+	sync := httpsync.NewSync(ls, nil, nil, httpsync.WithClientHost(subHost))
+	defer sync.Close()
+	syncer, err := sync.NewSyncer(pubID, pubAddr, nil)
+	require.NoError(t, err)
+
+	head, err := syncer.GetHead(ctx)
+	require.NoError(t, err)
+	require.Equal(t, c, head)
+	require.NoError(t, syncer.Sync(ctx, c, selectorparse.CommonSelector_ExploreAllRecursively))
+	require.Equal(t, pubstore.Bag[c.KeyString()], store.Bag[c.KeyString()])
+
+	// The head can be watched over a libp2p stream.
+	heads, err := syncer.WatchHead(ctx)
+	require.NoError(t, err)
+	require.Equal(t, c, <-heads)
+
+	// The access control list applies to the peer ID of the syncer.
+	list.DenyPeer(subHost.ID())
+	_, err = syncer.GetHead(ctx)
+	require.ErrorContains(t, err, "403")
+}
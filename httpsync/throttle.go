@@ -0,0 +1,35 @@
+package httpsync
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/filecoin-project/go-legs/throttle"
+)
+
+// throttleRequests returns a handler that serves the requests allowed by th
+// with next, and responds to the others with http.StatusTooManyRequests. The
+// client of a request is its remote IP address. Returns next if th is nil.
+func throttleRequests(next http.Handler, th *throttle.Throttle) http.Handler {
+	if th == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := remoteHost(r)
+		if err := th.Acquire(client); err != nil {
+			retryAfter := 1
+			if terr, ok := err.(*throttle.Error); ok && terr.RetryAfter > 0 {
+				retryAfter = int(math.Ceil(terr.RetryAfter.Seconds()))
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		defer th.Release()
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		th.AddBytes(client, sw.bytes)
+	})
+}
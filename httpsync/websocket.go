@@ -0,0 +1,324 @@
+package httpsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// headWriteTimeout is the time allowed to write a message to a head
+	// watcher's connection.
+	headWriteTimeout = 10 * time.Second
+	// headPingInterval is how often the publisher pings each head watcher,
+	// so that idle connections are kept open and dead ones are found.
+	headPingInterval = 30 * time.Second
+	// headPingWait is how long either side of a head watch waits to hear from
+	// the other before it considers the connection dead.
+	headPingWait = 2 * headPingInterval
+)
+
+// errHeadUpdatesNotServed is returned by WatchHead when the publisher answers
+// the WebSocket upgrade request with its head instead, because it neither
+// pushes head updates nor long-polls its head.
+var errHeadUpdatesNotServed = errors.New("publisher does not serve head updates")
+
+// headUpgrader upgrades head requests to WebSockets. Head watchers are not
+// browsers, and the head is public, so requests from any origin are allowed.
+var headUpgrader = websocket.Upgrader{
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// headWatchers are the WebSocket connections that a publisher sends its head
+// to. A nil headWatchers has no connections.
+type headWatchers struct {
+	watchers map[*headWatcher]struct{}
+	closed   bool
+	mutex    sync.Mutex
+	// wg counts the watchers that have not yet stopped.
+	wg sync.WaitGroup
+}
+
+// headWatcher is the connection of one syncer that watches the head.
+type headWatcher struct {
+	conn *websocket.Conn
+	// notify is signaled when the head is to be sent.
+	notify chan struct{}
+	// done is closed when the connection is to be closed.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newHeadWatchers() *headWatchers {
+	return &headWatchers{
+		watchers: make(map[*headWatcher]struct{}),
+	}
+}
+
+// add adds the watcher. Returns false if the watchers are closed.
+func (hws *headWatchers) add(hw *headWatcher) bool {
+	hws.mutex.Lock()
+	defer hws.mutex.Unlock()
+	if hws.closed {
+		return false
+	}
+	hws.watchers[hw] = struct{}{}
+	hws.wg.Add(1)
+	return true
+}
+
+// remove removes the watcher, and closes its connection.
+func (hws *headWatchers) remove(hw *headWatcher) {
+	hws.mutex.Lock()
+	delete(hws.watchers, hw)
+	hws.mutex.Unlock()
+	hw.conn.Close()
+	hws.wg.Done()
+}
+
+// notify signals every watcher to send the head. A watcher that has not yet
+// sent the previous head sends only the latest.
+func (hws *headWatchers) notify() {
+	if hws == nil {
+		return
+	}
+	hws.mutex.Lock()
+	defer hws.mutex.Unlock()
+	for hw := range hws.watchers {
+		select {
+		case hw.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// close closes the connections of all watchers, and waits for them to stop.
+// No watchers are added after close is called.
+func (hws *headWatchers) close() {
+	if hws == nil {
+		return
+	}
+	hws.mutex.Lock()
+	hws.closed = true
+	for hw := range hws.watchers {
+		hw.close()
+	}
+	hws.mutex.Unlock()
+	hws.wg.Wait()
+}
+
+func (hw *headWatcher) close() {
+	hw.closeOnce.Do(func() {
+		close(hw.done)
+	})
+}
+
+// serveHeadUpdates upgrades the head request to a WebSocket, and sends the
+// signed head on it now and each time the root is set. The connection is
+// served in the background, so that it is not counted as a request in
+// progress.
+func (p *publisher) serveHeadUpdates(w http.ResponseWriter, r *http.Request) {
+	conn, err := headUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already responded with an error.
+		log.Debugw("Failed to upgrade head request", "err", err, "remote", r.RemoteAddr)
+		return
+	}
+	hw := &headWatcher{
+		conn:   conn,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if !p.watchers.add(hw) {
+		// The publisher is closing.
+		conn.Close()
+		return
+	}
+	hw.notify <- struct{}{}
+	go hw.readControl()
+	go p.writeHeads(hw)
+}
+
+// writeHeads sends the head to the watcher each time it is notified, and
+// pings it when idle, until the watcher is closed or a write fails.
+func (p *publisher) writeHeads(hw *headWatcher) {
+	defer p.watchers.remove(hw)
+
+	ticker := time.NewTicker(headPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hw.notify:
+			p.rl.RLock()
+			root := p.root
+			p.rl.RUnlock()
+			if root == cid.Undef {
+				continue
+			}
+			msg, err := newEncodedSignedHead(root, p.privKey)
+			if err != nil {
+				log.Errorw("Failed to encode head update", "err", err)
+				continue
+			}
+			hw.conn.SetWriteDeadline(time.Now().Add(headWriteTimeout))
+			if err = hw.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				log.Debugw("Failed to send head update", "err", err, "remote", hw.conn.RemoteAddr())
+				return
+			}
+		case <-ticker.C:
+			if err := hw.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(headWriteTimeout)); err != nil {
+				log.Debugw("Failed to ping head watcher", "err", err, "remote", hw.conn.RemoteAddr())
+				return
+			}
+		case <-hw.done:
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "publisher closing")
+			_ = hw.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(headWriteTimeout))
+			return
+		}
+	}
+}
+
+// readControl reads from the watcher's connection, which handles the pings,
+// pongs, and close messages sent by the syncer, until the connection fails or
+// the watcher stops answering pings. The watcher is then closed.
+func (hw *headWatcher) readControl() {
+	defer hw.close()
+	hw.conn.SetReadDeadline(time.Now().Add(headPingWait))
+	hw.conn.SetPongHandler(func(string) error {
+		return hw.conn.SetReadDeadline(time.Now().Add(headPingWait))
+	})
+	for {
+		if _, _, err := hw.conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+// WatchHead opens a WebSocket to the publisher, which must serve head updates
+// as enabled by the WithHeadWebSocket option, and returns a channel that is
+// sent the publisher's head when the connection is opened and each time the
+// head changes. If the publisher long-polls its head instead, as enabled by the
+// WithHeadLongPoll option, then the channel is sent the heads returned by
+// long-polls. Each head is verified to be signed by the publisher, and a head
+// that is the same as the previous one is not sent again. The channel is
+// closed when ctx is canceled or the connection is lost, after which the
+// caller can watch again or fall back to polling GetHead.
+func (s *Syncer) WatchHead(ctx context.Context) (<-chan cid.Cid, error) {
+	wsURL := s.rootURL
+	wsURL.Path = path.Join(s.rootURL.Path, "head")
+	if wsURL.Scheme == "https" {
+		wsURL.Scheme = "wss"
+	} else {
+		wsURL.Scheme = "ws"
+	}
+
+	header := http.Header{}
+	if s.sync.authHeader != nil {
+		auth, err := s.sync.authHeader(ctx, s.peerID)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get authorization header: %w", err)
+		}
+		if auth != "" {
+			header.Set("Authorization", auth)
+		}
+	}
+
+	heads := make(chan cid.Cid)
+	conn, resp, err := s.wsDialer().DialContext(ctx, wsURL.String(), header)
+	if err != nil {
+		if resp == nil {
+			return nil, err
+		}
+		if resp.Header.Get(headLongPollHeader) == "true" {
+			go s.pollHeads(ctx, heads)
+			return heads, nil
+		}
+		if resp.StatusCode == http.StatusOK {
+			return nil, errHeadUpdatesNotServed
+		}
+		return nil, newStatusError(wsURL.String(), resp)
+	}
+	go s.readHeads(ctx, conn, heads)
+	return heads, nil
+}
+
+// readHeads reads the heads sent on conn, and sends each one that is signed
+// by the publisher on heads, until ctx is canceled or the connection fails.
+// Then heads is closed.
+func (s *Syncer) readHeads(ctx context.Context, conn *websocket.Conn, heads chan<- cid.Cid) {
+	defer close(heads)
+
+	// Close the connection when ctx is canceled, to stop a blocked read.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		conn.Close()
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(headPingWait))
+	conn.SetPingHandler(func(data string) error {
+		if err := conn.SetReadDeadline(time.Now().Add(headPingWait)); err != nil {
+			return err
+		}
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(headWriteTimeout))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+
+	var latest cid.Cid
+	for {
+		_, r, err := conn.NextReader()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Infow("Stopped watching head", "err", err, "peer", s.peerID)
+			}
+			return
+		}
+		pubKey, head, err := openSignedHeadWithIncludedPubKey(r)
+		if err == nil {
+			err = s.checkSigner(pubKey)
+		}
+		if err != nil {
+			log.Errorw("Stopped watching head after invalid head update", "err", err, "peer", s.peerID)
+			return
+		}
+		if head == latest {
+			continue
+		}
+		select {
+		case heads <- head:
+			latest = head
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// wsDialer returns a WebSocket dialer that uses the TLS configuration, proxy,
+// and dial function of the Syncer's HTTP client.
+func (s *Syncer) wsDialer() *websocket.Dialer {
+	d := *websocket.DefaultDialer
+	transport := s.client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if t, ok := transport.(*http.Transport); ok {
+		d.TLSClientConfig = t.TLSClientConfig
+		d.Proxy = t.Proxy
+		d.NetDialContext = t.DialContext
+	}
+	return &d
+}
@@ -20,6 +20,16 @@ type Publisher interface {
 	Close() error
 }
 
+// HeadPublisher is an interface for setting and getting the head CID that a
+// publisher serves to syncers. It is implemented by head.Publisher, which
+// serves the head over libp2p, and by the dtsync and httpsync publishers.
+type HeadPublisher interface {
+	// SetRoot sets the head CID that is served.
+	SetRoot(context.Context, cid.Cid) error
+	// Root returns the head CID that is served, or cid.Undef if there is none.
+	Root() cid.Cid
+}
+
 // Syncer is the interface used to sync with a data source.
 type Syncer interface {
 	GetHead(context.Context) (cid.Cid, error)
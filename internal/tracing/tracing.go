@@ -0,0 +1,27 @@
+// Package tracing provides helpers for the OpenTelemetry spans that go-legs
+// and its syncers create.
+package tracing
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// EndSpan records err, if not nil, as the error of span, and ends span.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Tracer returns the named tracer of tp, or of the global tracer provider, set
+// with otel.SetTracerProvider, if tp is nil.
+func Tracer(tp trace.TracerProvider, name string) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(name)
+}
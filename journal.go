@@ -0,0 +1,318 @@
+package legs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/filecoin-project/go-legs/migrations"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// journalPrefix is the datastore key prefix under which the announcement
+// journal is persisted.
+const journalPrefix = migrations.JournalPrefix
+
+// errNoJournal is returned by journal methods when the Subscriber was not
+// created with the AnnounceJournalDatastore option.
+var errNoJournal = errors.New("subscriber has no announcement journal")
+
+// AnnounceStatus is the outcome of handling an announcement.
+type AnnounceStatus string
+
+const (
+	// AnnounceReceived is the status of an announcement that has not been
+	// handled yet. An announcement that still has this status after the
+	// Subscriber is closed never completed.
+	AnnounceReceived AnnounceStatus = "received"
+	// AnnounceHandled is the status of an announcement whose CID was synced.
+	AnnounceHandled AnnounceStatus = "handled"
+	// AnnounceSkipped is the status of an announcement that was not synced,
+	// because the ShouldSync function declined it, or because a newer
+	// announcement from the same publisher replaced it.
+	AnnounceSkipped AnnounceStatus = "skipped"
+	// AnnounceFailed is the status of an announcement whose sync failed.
+	AnnounceFailed AnnounceStatus = "failed"
+)
+
+// JournalEntry is the record of an announcement in the announcement journal.
+// See: AnnounceJournalDatastore.
+type JournalEntry struct {
+	// PeerID identifies the publisher that made the announcement.
+	PeerID peer.ID `json:"peerID"`
+	// Cid is the announced CID. If IsRecord is true, this identifies an
+	// announcement record that holds the announced CID.
+	Cid cid.Cid `json:"cid"`
+	// Addrs are the publisher addresses given in the announcement.
+	Addrs []multiaddr.Multiaddr `json:"-"`
+	// IsRecord is true if Cid identifies an announcement record.
+	IsRecord bool `json:"isRecord,omitempty"`
+	// Source is how the announcement arrived.
+	Source SyncSource `json:"source"`
+	// Received is when the announcement was received.
+	Received time.Time `json:"received"`
+	// Status is the outcome of handling the announcement.
+	Status AnnounceStatus `json:"status"`
+	// Updated is when the status was last updated.
+	Updated time.Time `json:"updated"`
+	// Err is the error message of a failed announcement.
+	Err string `json:"error,omitempty"`
+}
+
+// journalEntryJSON is the JSON encoding of JournalEntry, with the addresses
+// encoded as strings.
+type journalEntryJSON struct {
+	JournalEntry
+	Addrs []string `json:"addrs,omitempty"`
+}
+
+// announceJournal records received announcements, and the outcome of handling
+// them, in a datastore. A nil announceJournal records nothing.
+type announceJournal struct {
+	ds datastore.Datastore
+}
+
+// newAnnounceJournal creates an announceJournal that is persisted in ds.
+// Returns nil if ds is nil.
+func newAnnounceJournal(ds datastore.Datastore) *announceJournal {
+	if ds == nil {
+		return nil
+	}
+	return &announceJournal{ds: ds}
+}
+
+func journalKey(peerID peer.ID, c cid.Cid) datastore.Key {
+	return migrations.JournalKey(peerID, c)
+}
+
+// receive records a received announcement.
+func (j *announceJournal) receive(peerID peer.ID, c cid.Cid, addrs []multiaddr.Multiaddr, isRecord bool, source SyncSource) {
+	if j == nil {
+		return
+	}
+	now := time.Now()
+	j.put(JournalEntry{
+		PeerID:   peerID,
+		Cid:      c,
+		Addrs:    addrs,
+		IsRecord: isRecord,
+		Source:   source,
+		Received: now,
+		Status:   AnnounceReceived,
+		Updated:  now,
+	})
+}
+
+// update records the outcome of handling an announcement. This uses its own
+// context, so that the outcome is recorded even if the sync was canceled.
+func (j *announceJournal) update(peerID peer.ID, c cid.Cid, status AnnounceStatus, syncErr error) {
+	if j == nil {
+		return
+	}
+	entry, err := j.get(context.Background(), peerID, c)
+	if err != nil {
+		log.Errorw("Cannot read announcement journal entry", "err", err, "peer", peerID, "cid", c)
+		return
+	}
+	entry.Status = status
+	entry.Updated = time.Now()
+	entry.Err = ""
+	if syncErr != nil {
+		entry.Err = syncErr.Error()
+	}
+	j.put(entry)
+}
+
+func (j *announceJournal) put(entry JournalEntry) {
+	ej := journalEntryJSON{JournalEntry: entry}
+	for _, a := range entry.Addrs {
+		ej.Addrs = append(ej.Addrs, a.String())
+	}
+	data, err := json.Marshal(ej)
+	if err == nil {
+		err = j.ds.Put(context.Background(), journalKey(entry.PeerID, entry.Cid), data)
+	}
+	if err != nil {
+		log.Errorw("Cannot write announcement journal entry", "err", err, "peer", entry.PeerID, "cid", entry.Cid)
+	}
+}
+
+func (j *announceJournal) get(ctx context.Context, peerID peer.ID, c cid.Cid) (JournalEntry, error) {
+	data, err := j.ds.Get(ctx, journalKey(peerID, c))
+	if err != nil {
+		return JournalEntry{}, err
+	}
+	return decodeJournalEntry(data)
+}
+
+func decodeJournalEntry(data []byte) (JournalEntry, error) {
+	var ej journalEntryJSON
+	if err := json.Unmarshal(data, &ej); err != nil {
+		return JournalEntry{}, err
+	}
+	entry := ej.JournalEntry
+	for _, s := range ej.Addrs {
+		a, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			return JournalEntry{}, fmt.Errorf("bad address in journal entry: %w", err)
+		}
+		entry.Addrs = append(entry.Addrs, a)
+	}
+	return entry, nil
+}
+
+// list returns all entries in the journal, oldest received first.
+func (j *announceJournal) list(ctx context.Context) ([]JournalEntry, error) {
+	results, err := j.ds.Query(ctx, query.Query{Prefix: journalPrefix})
+	if err != nil {
+		return nil, fmt.Errorf("cannot query announcement journal: %w", err)
+	}
+	defer results.Close()
+
+	var entries []JournalEntry
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, fmt.Errorf("cannot read announcement journal: %w", r.Error)
+		}
+		entry, err := decodeJournalEntry(r.Value)
+		if err != nil {
+			log.Errorw("Ignoring invalid announcement journal entry", "err", err, "key", r.Key)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].Received.Before(entries[b].Received)
+	})
+	return entries, nil
+}
+
+// AnnounceJournal returns the entries in the Subscriber's announcement
+// journal, oldest received first. Returns an error if the Subscriber was not
+// created with the AnnounceJournalDatastore option.
+func (s *Subscriber) AnnounceJournal(ctx context.Context) ([]JournalEntry, error) {
+	if s.journal == nil {
+		return nil, errNoJournal
+	}
+	return s.journal.list(ctx)
+}
+
+// PruneAnnounceJournal removes the entries of announcements that were handled
+// or skipped before the given time from the Subscriber's announcement journal.
+// Entries of announcements that failed or never completed are kept until they
+// are replayed.
+func (s *Subscriber) PruneAnnounceJournal(ctx context.Context, before time.Time) error {
+	if s.journal == nil {
+		return errNoJournal
+	}
+	entries, err := s.journal.list(ctx)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Status != AnnounceHandled && entry.Status != AnnounceSkipped {
+			continue
+		}
+		if !entry.Updated.Before(before) {
+			continue
+		}
+		if err = s.journal.ds.Delete(ctx, journalKey(entry.PeerID, entry.Cid)); err != nil {
+			return fmt.Errorf("cannot remove announcement journal entry: %w", err)
+		}
+	}
+	return nil
+}
+
+// ReplayFailed re-attempts the syncs of announcements in the Subscriber's
+// announcement journal that failed or never completed, such as those that
+// were pending when the Subscriber was closed. This recovers announcements that
+// were lost to bugs or outages.
+//
+// Only the most recent such announcement from each publisher is replayed, and
+// only if no later announcement from the publisher was handled, so that the
+// latest sync never goes back to an older CID. Other such announcements are
+// marked as skipped. Each replayed announcement is synced the same as when it
+// was received, and its journal entry is updated with the outcome.
+//
+// Returns the number of announcements that were replayed and handled. An
+// error is returned if the journal cannot be read, or if the context is
+// canceled.
+func (s *Subscriber) ReplayFailed(ctx context.Context) (int, error) {
+	if s.journal == nil {
+		return 0, errNoJournal
+	}
+	entries, err := s.journal.list(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// Find the newest incomplete announcement from each publisher that is
+	// newer than any handled announcement from the publisher. Entries are
+	// ordered oldest first.
+	// Publishers are replayed in the order that they first had an incomplete
+	// announcement, and each publisher is only in the order once.
+	replay := make(map[peer.ID]JournalEntry)
+	var order []peer.ID
+	ordered := make(map[peer.ID]struct{})
+	for _, entry := range entries {
+		switch entry.Status {
+		case AnnounceHandled:
+			if prev, ok := replay[entry.PeerID]; ok {
+				s.journal.update(prev.PeerID, prev.Cid, AnnounceSkipped, nil)
+				delete(replay, entry.PeerID)
+			}
+		case AnnounceFailed, AnnounceReceived:
+			if prev, ok := replay[entry.PeerID]; ok {
+				s.journal.update(prev.PeerID, prev.Cid, AnnounceSkipped, nil)
+			}
+			if _, ok := ordered[entry.PeerID]; !ok {
+				ordered[entry.PeerID] = struct{}{}
+				order = append(order, entry.PeerID)
+			}
+			replay[entry.PeerID] = entry
+		}
+	}
+
+	var handled int
+	for _, peerID := range order {
+		entry, ok := replay[peerID]
+		if !ok {
+			continue
+		}
+		if ctx.Err() != nil {
+			return handled, ctx.Err()
+		}
+		log.Infow("Replaying announcement", "cid", entry.Cid, "peer", entry.PeerID, "status", entry.Status)
+		status, err := s.replayAnnounce(ctx, entry)
+		if err != nil {
+			log.Errorw("Replayed announcement failed", "err", err, "cid", entry.Cid, "peer", entry.PeerID)
+		}
+		s.journal.update(entry.PeerID, entry.Cid, status, err)
+		if status == AnnounceHandled {
+			handled++
+		}
+	}
+	return handled, nil
+}
+
+// replayAnnounce syncs the announcement in a journal entry.
+func (s *Subscriber) replayAnnounce(ctx context.Context, entry JournalEntry) (AnnounceStatus, error) {
+	hnd, err := s.getOrCreateHandler(entry.PeerID)
+	if err != nil {
+		return AnnounceFailed, err
+	}
+	syncer, _, err := s.makeStagedSyncer(entry.PeerID, entry.Addrs, s.addrTTL, nil)
+	if err != nil {
+		return AnnounceFailed, err
+	}
+	hnd.latestSyncMu.Lock()
+	defer hnd.latestSyncMu.Unlock()
+	return hnd.syncAnnounced(ctx, entry.Cid, syncer, entry.IsRecord, entry.Source)
+}
@@ -0,0 +1,163 @@
+package legs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayFailed(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	defer srcHost.Close()
+	srcLnkS := test.MkLinkSystem(srcStore)
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic)
+	require.NoError(t, err)
+	defer pub.Close()
+	chainLnks := test.MkChain(srcLnkS, true)
+	oldCid := chainLnks[2].(cidlink.Link).Cid
+	headCid := chainLnks[0].(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(ctx, headCid))
+
+	// A publisher that cannot be synced with, because nothing listens on its
+	// address.
+	goneHost := test.MkTestHost()
+	goneID := goneHost.ID()
+	goneHost.Close()
+	goneAddrs := []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/9/http")}
+	cids, err := test.RandomCids(2)
+	require.NoError(t, err)
+
+	// Record announcements that never completed, as if the Subscriber was
+	// closed before handling them.
+	journalDS := dssync.MutexWrap(datastore.NewMapDatastore())
+	j := newAnnounceJournal(journalDS)
+	j.receive(srcHost.ID(), oldCid, srcHost.Addrs(), false, SyncSourceGossip)
+	j.receive(goneID, cids[0], goneAddrs, false, SyncSourceGossip)
+	j.receive(srcHost.ID(), headCid, srcHost.Addrs(), false, SyncSourceGossip)
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	sub, err := NewSubscriber(dstHost, dstStore, test.MkLinkSystem(dstStore), testTopic, nil,
+		AnnounceJournalDatastore(journalDS))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// Only the newest announcement from each publisher is replayed.
+	handled, err := sub.ReplayFailed(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, handled)
+	require.Equal(t, headCid, sub.GetLatestSync(srcHost.ID()).(cidlink.Link).Cid)
+
+	statuses := func() map[cid.Cid]AnnounceStatus {
+		entries, err := sub.AnnounceJournal(ctx)
+		require.NoError(t, err)
+		m := make(map[cid.Cid]AnnounceStatus, len(entries))
+		for _, entry := range entries {
+			m[entry.Cid] = entry.Status
+		}
+		return m
+	}
+	require.Equal(t, map[cid.Cid]AnnounceStatus{
+		oldCid:  AnnounceSkipped,
+		headCid: AnnounceHandled,
+		cids[0]: AnnounceFailed,
+	}, statuses())
+
+	// Received announcements are recorded with their outcome.
+	require.NoError(t, sub.Announce(ctx, cids[1], goneID, goneAddrs))
+	require.Eventually(t, func() bool {
+		return statuses()[cids[1]] == AnnounceFailed
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// Pruning keeps only the failed announcements.
+	require.NoError(t, sub.PruneAnnounceJournal(ctx, time.Now()))
+	require.Equal(t, map[cid.Cid]AnnounceStatus{
+		cids[0]: AnnounceFailed,
+		cids[1]: AnnounceFailed,
+	}, statuses())
+
+	entries, err := sub.AnnounceJournal(ctx)
+	require.NoError(t, err)
+	require.Equal(t, goneID, entries[0].PeerID)
+	require.NotEmpty(t, entries[0].Err)
+}
+
+func TestReplayFailedAfterHandled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	defer srcHost.Close()
+	srcLnkS := test.MkLinkSystem(srcStore)
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic)
+	require.NoError(t, err)
+	defer pub.Close()
+	chainLnks := test.MkChain(srcLnkS, true)
+	oldCid := chainLnks[2].(cidlink.Link).Cid
+	midCid := chainLnks[1].(cidlink.Link).Cid
+	headCid := chainLnks[0].(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(ctx, headCid))
+
+	// The publisher's announcements failed, were handled, and then failed.
+	journalDS := dssync.MutexWrap(datastore.NewMapDatastore())
+	j := newAnnounceJournal(journalDS)
+	for _, c := range []cid.Cid{oldCid, midCid, headCid} {
+		j.receive(srcHost.ID(), c, srcHost.Addrs(), false, SyncSourceGossip)
+	}
+	j.update(srcHost.ID(), oldCid, AnnounceFailed, nil)
+	j.update(srcHost.ID(), midCid, AnnounceHandled, nil)
+	j.update(srcHost.ID(), headCid, AnnounceFailed, nil)
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	sub, err := NewSubscriber(dstHost, dstStore, test.MkLinkSystem(dstStore), testTopic, nil,
+		AnnounceJournalDatastore(journalDS))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// The newest failed announcement is replayed once.
+	handled, err := sub.ReplayFailed(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, handled)
+	require.Equal(t, headCid, sub.GetLatestSync(srcHost.ID()).(cidlink.Link).Cid)
+
+	entries, err := sub.AnnounceJournal(ctx)
+	require.NoError(t, err)
+	statuses := make(map[cid.Cid]AnnounceStatus, len(entries))
+	for _, entry := range entries {
+		statuses[entry.Cid] = entry.Status
+	}
+	require.Equal(t, map[cid.Cid]AnnounceStatus{
+		oldCid:  AnnounceSkipped,
+		midCid:  AnnounceHandled,
+		headCid: AnnounceHandled,
+	}, statuses)
+}
+
+func TestReplayFailedWithoutJournal(t *testing.T) {
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	sub, err := NewSubscriber(dstHost, dstStore, test.MkLinkSystem(dstStore), testTopic, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	_, err = sub.ReplayFailed(context.Background())
+	require.ErrorIs(t, err, errNoJournal)
+}
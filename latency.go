@@ -0,0 +1,180 @@
+package legs
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// latencySmoothing is the weight of a new probe in the moving average of an
+// address's latency.
+const latencySmoothing = 0.5
+
+// LatencyRanker ranks the addresses of publishers by their latency, measured
+// as the time taken to open a TCP connection to them. Use its Policy method as
+// a TransportPolicyFunc, alone or with CombinePolicies, so that the first
+// address of a sync is a fast one instead of whichever happens to be listed
+// first, such as a distant one.
+//
+// Addresses are probed in the background the first time they are ranked, and
+// again when their measurement is older than the maximum age. Each probe is
+// blended into a moving average of the address's latency, so one slow probe
+// does not outweigh several fast ones. Until an address is probed, and if it
+// cannot be probed, such as a QUIC address, it is ranked as if its probe timed
+// out. Addresses that share a host and port, such as the HTTP and libp2p
+// addresses of a publisher, share a measurement. A relay address is measured
+// at the relay.
+type LatencyRanker struct {
+	probeTimeout time.Duration
+	maxAge       time.Duration
+
+	samples map[string]*latencySample
+	mutex   sync.Mutex
+}
+
+type latencySample struct {
+	// latency is the moving average latency, or zero if not yet measured.
+	latency  time.Duration
+	measured time.Time
+	used     time.Time
+	probing  bool
+}
+
+// NewLatencyRanker creates a LatencyRanker whose probes time out after
+// probeTimeout, and whose measurements are refreshed when older than maxAge.
+// A measurement that has not been used for ten times maxAge is forgotten.
+func NewLatencyRanker(probeTimeout, maxAge time.Duration) *LatencyRanker {
+	return &LatencyRanker{
+		probeTimeout: probeTimeout,
+		maxAge:       maxAge,
+		samples:      make(map[string]*latencySample),
+	}
+}
+
+// Policy is a TransportPolicyFunc that orders addrs by latency, lowest first,
+// keeping the order of addresses with the same latency. As with any policy,
+// the order decides the transport of a sync when given to CombinePolicies
+// before a policy such as PreferHTTP, so that each transport's addresses are
+// in order of latency.
+func (r *LatencyRanker) Policy(_ peer.ID, addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	type ranked struct {
+		addr    multiaddr.Multiaddr
+		latency time.Duration
+	}
+	ranks := make([]ranked, len(addrs))
+	now := time.Now()
+
+	r.mutex.Lock()
+	for i, addr := range addrs {
+		ranks[i] = ranked{addr, r.probeTimeout}
+		target, ok := probeTarget(addr)
+		if !ok {
+			continue
+		}
+		sample, ok := r.samples[target]
+		if !ok {
+			sample = &latencySample{}
+			r.samples[target] = sample
+		}
+		sample.used = now
+		if sample.latency != 0 {
+			ranks[i].latency = sample.latency
+		}
+		if !sample.probing && now.Sub(sample.measured) >= r.maxAge {
+			sample.probing = true
+			go r.probe(target)
+		}
+	}
+	r.mutex.Unlock()
+
+	sort.SliceStable(ranks, func(i, j int) bool {
+		return ranks[i].latency < ranks[j].latency
+	})
+	for i := range ranks {
+		addrs[i] = ranks[i].addr
+	}
+	return addrs
+}
+
+// Latency returns the measured latency of addr, and false if it has not been
+// measured.
+func (r *LatencyRanker) Latency(addr multiaddr.Multiaddr) (time.Duration, bool) {
+	target, ok := probeTarget(addr)
+	if !ok {
+		return 0, false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	sample, ok := r.samples[target]
+	if !ok || sample.latency == 0 {
+		return 0, false
+	}
+	return sample.latency, true
+}
+
+// probe measures the latency of target, a TCP host and port, and blends it into
+// the target's moving average. A failed probe counts as one that timed out.
+func (r *LatencyRanker) probe(target string) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.probeTimeout)
+	defer cancel()
+	var d net.Dialer
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", target)
+	latency := time.Since(start)
+	if err != nil {
+		log.Debugw("Latency probe failed", "err", err, "target", target)
+		latency = r.probeTimeout
+	} else {
+		conn.Close()
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	sample, ok := r.samples[target]
+	if !ok {
+		return
+	}
+	if sample.latency == 0 {
+		sample.latency = latency
+	} else {
+		sample.latency += time.Duration(latencySmoothing * float64(latency-sample.latency))
+	}
+	sample.measured = now
+	sample.probing = false
+
+	// Forget the measurements of addresses that are no longer used.
+	for t, s := range r.samples {
+		if !s.probing && now.Sub(s.used) > 10*r.maxAge {
+			delete(r.samples, t)
+		}
+	}
+}
+
+// probeTarget returns the TCP host and port that addr starts with, which is
+// the relay of a relay address, or false if addr does not start with a TCP
+// address.
+func probeTarget(addr multiaddr.Multiaddr) (string, bool) {
+	if addr == nil {
+		return "", false
+	}
+	hostPart, rest := multiaddr.SplitFirst(addr)
+	if hostPart == nil || rest == nil {
+		return "", false
+	}
+	tcpPart, _ := multiaddr.SplitFirst(rest)
+	if tcpPart == nil || tcpPart.Protocol().Code != multiaddr.P_TCP {
+		return "", false
+	}
+	_, hostPort, err := manet.DialArgs(multiaddr.Join(hostPart, tcpPart))
+	if err != nil {
+		return "", false
+	}
+	return hostPort, true
+}
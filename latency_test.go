@@ -0,0 +1,61 @@
+package legs_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyRanker(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	localAddr, err := manet.FromNetAddr(l.Addr())
+	require.NoError(t, err)
+	localHTTPAddr := localAddr.Encapsulate(multiaddr.StringCast("/http"))
+
+	// A documentation address that does not respond, like a distant
+	// publisher that is too slow to use.
+	slowAddr := multiaddr.StringCast("/ip4/192.0.2.1/tcp/3104")
+	quicAddr := multiaddr.StringCast("/ip4/192.0.2.1/udp/3104/quic")
+	addrs := func() []multiaddr.Multiaddr {
+		return []multiaddr.Multiaddr{slowAddr, quicAddr, localHTTPAddr, localAddr}
+	}
+
+	ranker := legs.NewLatencyRanker(200*time.Millisecond, time.Minute)
+
+	// Nothing is measured yet, so the order is kept.
+	require.Equal(t, addrs(), ranker.Policy("", addrs()))
+
+	require.Eventually(t, func() bool {
+		_, localOK := ranker.Latency(localAddr)
+		_, slowOK := ranker.Latency(slowAddr)
+		return localOK && slowOK
+	}, 5*time.Second, 10*time.Millisecond)
+	latency, ok := ranker.Latency(localHTTPAddr)
+	require.True(t, ok)
+	require.Less(t, latency, 200*time.Millisecond)
+	_, ok = ranker.Latency(quicAddr)
+	require.False(t, ok)
+
+	require.Equal(t, []multiaddr.Multiaddr{localHTTPAddr, localAddr, slowAddr, quicAddr}, ranker.Policy("", addrs()))
+
+	// Ranked before a transport preference, the preferred addresses are in
+	// order of latency.
+	policy := legs.CombinePolicies(ranker.Policy, legs.PreferGraphsync)
+	require.Equal(t, []multiaddr.Multiaddr{localAddr, slowAddr, quicAddr, localHTTPAddr}, policy("", addrs()))
+}
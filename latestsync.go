@@ -0,0 +1,112 @@
+package legs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/filecoin-project/go-legs/migrations"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// DatastoreLatestSyncHandler is a LatestSyncHandler that persists the latest
+// syncs in a datastore, so that a Subscriber resumes syncing from where it was
+// after a restart. It implements TopicLatestSyncHandler and LatestSyncLister.
+// The keys are laid out as described by the migrations package.
+type DatastoreLatestSyncHandler struct {
+	ds datastore.Datastore
+}
+
+var (
+	_ TopicLatestSyncHandler = (*DatastoreLatestSyncHandler)(nil)
+	_ LatestSyncLister       = (*DatastoreLatestSyncHandler)(nil)
+)
+
+// NewDatastoreLatestSyncHandler creates a DatastoreLatestSyncHandler that
+// persists the latest syncs in ds. The latest syncs in the datastore are first
+// migrated to the current schema.
+func NewDatastoreLatestSyncHandler(ds datastore.Datastore) (*DatastoreLatestSyncHandler, error) {
+	if ds == nil {
+		return nil, errors.New("latest sync datastore cannot be nil")
+	}
+	if _, err := migrations.Migrate(context.Background(), ds, migrations.StoreLatestSync); err != nil {
+		return nil, fmt.Errorf("cannot migrate latest sync datastore: %w", err)
+	}
+	return &DatastoreLatestSyncHandler{ds: ds}, nil
+}
+
+func (h *DatastoreLatestSyncHandler) SetLatestSync(p peer.ID, c cid.Cid) {
+	log.Infow("Updating latest sync", "cid", c, "peer", p)
+	h.put(migrations.LatestSyncKey(p), c)
+}
+
+func (h *DatastoreLatestSyncHandler) GetLatestSync(p peer.ID) (cid.Cid, bool) {
+	return h.get(migrations.LatestSyncKey(p))
+}
+
+func (h *DatastoreLatestSyncHandler) SetTopicLatestSync(topic string, p peer.ID, c cid.Cid) {
+	log.Infow("Updating latest sync", "cid", c, "peer", p, "topic", topic)
+	h.put(migrations.TopicLatestSyncKey(topic, p), c)
+}
+
+func (h *DatastoreLatestSyncHandler) GetTopicLatestSync(topic string, p peer.ID) (cid.Cid, bool) {
+	return h.get(migrations.TopicLatestSyncKey(topic, p))
+}
+
+// LatestSyncPeers returns the peers that a latest sync is stored for, on any
+// topic.
+func (h *DatastoreLatestSyncHandler) LatestSyncPeers() []peer.ID {
+	results, err := h.ds.Query(context.Background(), query.Query{
+		Prefix:   migrations.LatestSyncPrefix,
+		KeysOnly: true,
+	})
+	if err != nil {
+		log.Errorw("Cannot query latest syncs", "err", err)
+		return nil
+	}
+	defer results.Close()
+
+	seen := make(map[peer.ID]struct{})
+	var peers []peer.ID
+	for r := range results.Next() {
+		if r.Error != nil {
+			log.Errorw("Cannot read latest syncs", "err", r.Error)
+			break
+		}
+		p, err := peer.Decode(datastore.RawKey(r.Key).Name())
+		if err != nil {
+			log.Errorw("Ignoring invalid latest sync key", "err", err, "key", r.Key)
+			continue
+		}
+		if _, ok := seen[p]; !ok {
+			seen[p] = struct{}{}
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+func (h *DatastoreLatestSyncHandler) put(key datastore.Key, c cid.Cid) {
+	if err := h.ds.Put(context.Background(), key, c.Bytes()); err != nil {
+		log.Errorw("Cannot write latest sync", "err", err, "key", key, "cid", c)
+	}
+}
+
+func (h *DatastoreLatestSyncHandler) get(key datastore.Key) (cid.Cid, bool) {
+	data, err := h.ds.Get(context.Background(), key)
+	if err != nil {
+		if !errors.Is(err, datastore.ErrNotFound) {
+			log.Errorw("Cannot read latest sync", "err", err, "key", key)
+		}
+		return cid.Undef, false
+	}
+	_, c, err := cid.CidFromBytes(data)
+	if err != nil {
+		log.Errorw("Ignoring invalid latest sync", "err", err, "key", key)
+		return cid.Undef, false
+	}
+	return c, true
+}
@@ -0,0 +1,77 @@
+package legs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-legs/migrations"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatastoreLatestSyncHandler(t *testing.T) {
+	cids, err := test.RandomCids(3)
+	require.NoError(t, err)
+	pubHost := test.MkTestHost()
+	defer pubHost.Close()
+	pubID := pubHost.ID()
+
+	// The latest syncs share a datastore with the announcement journal, and
+	// are not derived from it.
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	j := newAnnounceJournal(ds)
+	j.receive(pubID, cids[1], nil, false, SyncSourceGossip)
+	j.update(pubID, cids[1], AnnounceHandled, nil)
+
+	h, err := NewDatastoreLatestSyncHandler(ds)
+	require.NoError(t, err)
+	_, ok := h.GetLatestSync(pubID)
+	require.False(t, ok)
+	h.SetLatestSync(pubID, cids[0])
+	latestSync, ok := h.GetLatestSync(pubID)
+	require.True(t, ok)
+	require.Equal(t, cids[0], latestSync)
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	sub, err := NewSubscriber(dstHost, dstStore, test.MkLinkSystem(dstStore), testTopic, nil,
+		AnnounceJournalDatastore(ds),
+		UseLatestSyncHandler(h),
+		LatestSyncPerTopic(true))
+	require.NoError(t, err)
+	require.Equal(t, cidlink.Link{Cid: cids[0]}, sub.GetLatestSync(pubID))
+	require.NoError(t, sub.SetLatestSync(pubID, cids[2]))
+	require.NoError(t, sub.Close())
+
+	// The latest sync is kept by a new handler on the same datastore.
+	h, err = NewDatastoreLatestSyncHandler(ds)
+	require.NoError(t, err)
+	latestSync, ok = h.GetTopicLatestSync(testTopic, pubID)
+	require.True(t, ok)
+	require.Equal(t, cids[2], latestSync)
+	latestSync, ok = h.GetLatestSync(pubID)
+	require.True(t, ok)
+	require.Equal(t, cids[0], latestSync)
+	require.Equal(t, []peer.ID{pubID}, h.LatestSyncPeers())
+}
+
+func TestJournalDatastoreNewerVersion(t *testing.T) {
+	ds := datastore.NewMapDatastore()
+	require.NoError(t, ds.Put(context.Background(), migrations.VersionKey(migrations.StoreLatestSync), []byte("1000")))
+
+	_, err := NewDatastoreLatestSyncHandler(ds)
+	require.ErrorIs(t, err, migrations.ErrNewerVersion)
+	require.NoError(t, ds.Put(context.Background(), migrations.VersionKey(migrations.StoreJournal), []byte("1000")))
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	_, err = NewSubscriber(dstHost, dstStore, test.MkLinkSystem(dstStore), testTopic, nil,
+		AnnounceJournalDatastore(ds))
+	require.ErrorIs(t, err, migrations.ErrNewerVersion)
+}
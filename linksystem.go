@@ -0,0 +1,87 @@
+package legs
+
+import (
+	"sync"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// publisherLinkSystems holds the link system that the blocks of each publisher
+// are stored in. This is the Subscriber's link system, unless publishers have
+// their own link systems, created by the PublisherLinkSystems function.
+type publisherLinkSystems struct {
+	lsys    ipld.LinkSystem
+	lsysFor LinkSystemFor
+
+	byPeer map[peer.ID]ipld.LinkSystem
+	mutex  sync.Mutex
+}
+
+// newPublisherLinkSystems creates a publisherLinkSystems that creates the link
+// system of each publisher with lsysFor, or that gives every publisher lsys if
+// lsysFor is nil.
+func newPublisherLinkSystems(lsys ipld.LinkSystem, lsysFor LinkSystemFor) *publisherLinkSystems {
+	return &publisherLinkSystems{
+		lsys:    lsys,
+		lsysFor: lsysFor,
+		byPeer:  make(map[peer.ID]ipld.LinkSystem),
+	}
+}
+
+// separate returns true if each publisher has its own link system.
+func (p *publisherLinkSystems) separate() bool {
+	return p.lsysFor != nil
+}
+
+// get returns the link system of the publisher, creating it the first time
+// that it is needed.
+func (p *publisherLinkSystems) get(peerID peer.ID) ipld.LinkSystem {
+	if p.lsysFor == nil {
+		return p.lsys
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	lsys, ok := p.byPeer[peerID]
+	if !ok {
+		lsys = p.lsysFor(peerID)
+		p.byPeer[peerID] = lsys
+	}
+	return lsys
+}
+
+// linkSystemFor returns the link system that the blocks of the publisher are
+// stored in.
+func (s *Subscriber) linkSystemFor(peerID peer.ID) ipld.LinkSystem {
+	return s.publisherLsys.get(peerID)
+}
+
+// syncLinkSystemFor returns the link system that a sync with the publisher
+// stores blocks in if the publisher has its own link system, or if the blocks
+// are counted against the publisher's storage quota. Otherwise, this returns
+// nil, so that the sync stores blocks in the Subscriber's link system.
+func (s *Subscriber) syncLinkSystemFor(peerID peer.ID) *ipld.LinkSystem {
+	if !s.publisherLsys.separate() && s.quotas == nil {
+		return nil
+	}
+	lsys := s.linkSystemFor(peerID)
+	if !s.publisherLsys.separate() {
+		// Batch writes the same as syncs into the Subscriber's link system.
+		lsys = s.writeBatch.linkSystem(lsys)
+	}
+	lsys = s.skipList.skipWriteStorage(s.quotas.linkSystem(peerID, lsys))
+	return &lsys
+}
+
+// importLinkSystemFor returns the link system that an import for the publisher
+// stores blocks in, which is the same link system that a sync with the
+// publisher stores blocks in. Returns true if the link system stages blocks.
+func (s *Subscriber) importLinkSystemFor(peerID peer.ID) (ipld.LinkSystem, bool) {
+	if s.staging != nil {
+		return s.staging.linkSystem(peerID), true
+	}
+	if lsys := s.syncLinkSystemFor(peerID); lsys != nil {
+		return *lsys, false
+	}
+	return s.skipList.skipWriteStorage(s.writeBatch.linkSystem(s.linkSystemFor(peerID))), false
+}
@@ -0,0 +1,91 @@
+package legs_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublisherLinkSystems(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	type pubSystem struct {
+		id   peer.ID
+		head cid.Cid
+		addr multiaddr.Multiaddr
+	}
+	pubs := make([]pubSystem, 2)
+	for i := range pubs {
+		srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+		srcHost := test.MkTestHost()
+		defer srcHost.Close()
+		srcLnkS := test.MkLinkSystem(srcStore)
+		pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic)
+		require.NoError(t, err)
+		defer pub.Close()
+		head := llBuilder{Length: 3, Seed: int64(i + 1)}.Build(t, srcLnkS).(cidlink.Link).Cid
+		require.NoError(t, pub.SetRoot(ctx, head))
+		pubs[i] = pubSystem{srcHost.ID(), head, srcHost.Addrs()[0]}
+	}
+
+	// Store each publisher's blocks in its own namespace.
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	var created []peer.ID
+	var createdMutex sync.Mutex
+	pubStore := func(p peer.ID) datastore.Batching {
+		return namespace.Wrap(dstStore, datastore.NewKey("/pub/"+p.String()))
+	}
+	lsysFor := func(p peer.ID) ipld.LinkSystem {
+		createdMutex.Lock()
+		created = append(created, p)
+		createdMutex.Unlock()
+		return test.MkLinkSystem(pubStore(p))
+	}
+
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	sub, err := legs.NewSubscriber(dstHost, dstStore, test.MkLinkSystem(dstStore), testTopic, nil,
+		legs.PublisherLinkSystems(lsysFor))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	for _, ps := range pubs {
+		_, err = sub.Sync(ctx, ps.id, ps.head, nil, ps.addr)
+		require.NoError(t, err)
+		require.NoError(t, sub.VerifyLastSync(ctx, ps.id))
+
+		has, err := pubStore(ps.id).Has(ctx, datastore.NewKey(ps.head.String()))
+		require.NoError(t, err)
+		require.True(t, has)
+		has, err = dstStore.Has(ctx, datastore.NewKey(ps.head.String()))
+		require.NoError(t, err)
+		require.False(t, has, "block stored in the subscriber's link system")
+	}
+	// Syncing again uses the link system already created for the publisher.
+	_, err = sub.Sync(ctx, pubs[0].id, pubs[0].head, nil, pubs[0].addr)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []peer.ID{pubs[0].id, pubs[1].id}, created)
+
+	// Garbage is collected from each publisher's store.
+	for _, ps := range pubs {
+		deleted, err := sub.CollectGarbage(ctx, map[peer.ID]cid.Cid{ps.id: ps.head}, 1,
+			legs.DatastoreBlockDeleter(pubStore(ps.id)))
+		require.NoError(t, err)
+		require.Equal(t, 2, deleted)
+	}
+}
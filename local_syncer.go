@@ -0,0 +1,93 @@
+package legs
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/filecoin-project/go-legs/carutil"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var _ Syncer = (*localSyncer)(nil)
+
+// localSyncer is a Syncer that syncs blocks that are stored locally, such as
+// blocks imported from a CAR file. Syncing stores the blocks of the CAR file,
+// if there is one, and then traverses the stored blocks, and calls the block
+// hook for each, as if they were synced from the publisher.
+type localSyncer struct {
+	subscriber *Subscriber
+	peerID     peer.ID
+	head       cid.Cid
+	// lsys is the link system that blocks are stored in and read from.
+	lsys ipld.LinkSystem
+	// car is the CAR file to store blocks from, or nil if the blocks are
+	// already stored.
+	car *carutil.Reader
+}
+
+func (ls *localSyncer) GetHead(context.Context) (cid.Cid, error) {
+	return ls.head, nil
+}
+
+func (ls *localSyncer) Sync(ctx context.Context, nextCid cid.Cid, sel ipld.Node) error {
+	s := ls.subscriber
+	if ls.car != nil {
+		car := ls.car
+		ls.car = nil
+		if err := car.Store(ctx, ls.lsys); err != nil {
+			return fmt.Errorf("cannot read car: %w", err)
+		}
+	}
+
+	storeLsys := ls.lsys
+	lsys := storeLsys
+	lsys.StorageReadOpener = func(lc ipld.LinkContext, l ipld.Link) (io.Reader, error) {
+		c := l.(cidlink.Link).Cid
+		s.scopedBlockHookMutex.RLock()
+		hook, ok := s.scopedBlockHook[ls.peerID]
+		s.scopedBlockHookMutex.RUnlock()
+		if s.skipList.has(c) {
+			// Report the skipped block, and do not traverse it.
+			if ok {
+				hook(ls.peerID, c, true)
+			}
+			return nil, traversal.SkipMe{}
+		}
+		r, err := storeLsys.StorageReadOpener(lc, l)
+		if err != nil {
+			return nil, fmt.Errorf("block %s not available locally: %w", l, err)
+		}
+		if ok {
+			hook(ls.peerID, c, true)
+		}
+		return r, nil
+	}
+
+	csel, err := selector.CompileSelector(sel)
+	if err != nil {
+		return fmt.Errorf("cannot compile selector: %w", err)
+	}
+	progress := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     lsys,
+			LinkTargetNodePrototypeChooser: basicnode.Chooser,
+		},
+		Path: datamodel.NewPath([]datamodel.PathSegment{}),
+	}
+	rootNode, err := lsys.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: nextCid}, basicnode.Prototype.Any)
+	if err != nil {
+		return err
+	}
+	return progress.WalkMatching(rootNode, csel, func(traversal.Progress, datamodel.Node) error {
+		return nil
+	})
+}
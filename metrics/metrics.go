@@ -0,0 +1,343 @@
+// Package metrics provides the Prometheus metrics of announcements and syncs
+// that are recorded by a legs Subscriber and its dtsync and httpsync syncers.
+//
+// A nil *Metrics records nothing, so the methods can be called whether or not
+// metrics are enabled.
+package metrics
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "legs"
+	subsystem = "sync"
+)
+
+// Reasons that a sync failed, used as the value of the reason label of the
+// failed syncs counter.
+const (
+	// ReasonCanceled is the reason of a sync that was canceled.
+	ReasonCanceled = "canceled"
+	// ReasonTimeout is the reason of a sync that did not finish in time.
+	ReasonTimeout = "timeout"
+	// ReasonResourceLimit is the reason of a sync that failed because a
+	// libp2p resource limit was exceeded.
+	ReasonResourceLimit = "resource_limit"
+	// ReasonNotFound is the reason of a sync of content that the publisher
+	// does not have.
+	ReasonNotFound = "not_found"
+	// ReasonQuotaExceeded is the reason of a sync that was stopped because
+	// it would exceed the storage quota of the publisher.
+	ReasonQuotaExceeded = "quota_exceeded"
+	// ReasonError is the reason of a sync that failed for any other reason.
+	ReasonError = "error"
+)
+
+// Events delivered to Subscriber event channels, used as the value of the
+// event label of the dropped events counter.
+const (
+	// EventSyncFinished is the event delivered by OnSyncFinished.
+	EventSyncFinished = "sync_finished"
+	// EventAnnouncement is the event delivered by OnAnnouncement.
+	EventAnnouncement = "announcement"
+	// EventSyncProgress is the event delivered by OnSyncProgress.
+	EventSyncProgress = "sync_progress"
+	// EventSyncPaused is the event delivered by OnSyncPaused.
+	EventSyncPaused = "sync_paused"
+	// EventQuotaExceeded is the event delivered by OnQuotaExceeded.
+	EventQuotaExceeded = "quota_exceeded"
+)
+
+// Reasons that a synced block failed verification, used as the value of the
+// reason label of the verification failures counter.
+const (
+	// VerifyMissing is the reason of a synced block that is missing from
+	// the local store.
+	VerifyMissing = "missing"
+	// VerifyCorrupt is the reason of a synced block whose data does not
+	// match its CID.
+	VerifyCorrupt = "corrupt"
+	// VerifyUnlinked is the reason of a synced block that is not linked from
+	// any other block of its sync.
+	VerifyUnlinked = "unlinked"
+)
+
+// Kinds of connection that a sync is done over, used as the value of the
+// connection label of the sync connections counter.
+const (
+	// ConnectionDirect is a direct connection to the publisher, including an
+	// HTTP connection.
+	ConnectionDirect = "direct"
+	// ConnectionRelay is a connection to the publisher through a circuit
+	// relay.
+	ConnectionRelay = "relay"
+	// ConnectionHolePunch is a direct connection to the publisher that was
+	// established by hole punching, while connected through a circuit relay.
+	ConnectionHolePunch = "hole_punch"
+)
+
+// Metrics are the Prometheus metrics of announcements and syncs.
+type Metrics struct {
+	announcements  *prometheus.CounterVec
+	syncsStarted   prometheus.Counter
+	syncsSucceeded prometheus.Counter
+	syncsFailed    *prometheus.CounterVec
+	syncDuration   prometheus.Histogram
+	syncBlocks     *prometheus.HistogramVec
+	syncBytes      *prometheus.HistogramVec
+	rateLimitHits  *prometheus.CounterVec
+	activeSyncs    prometheus.Gauge
+	eventsDropped  *prometheus.CounterVec
+	connections    *prometheus.CounterVec
+	verifyFailures *prometheus.CounterVec
+
+	// reg is the registerer that the metrics were registered with, and
+	// registered are the collectors that New registered with it, excluding
+	// any that were already registered.
+	reg        prometheus.Registerer
+	registered []prometheus.Collector
+}
+
+// New creates the metrics and registers them with reg. Metrics that are
+// already registered, such as by another Subscriber, are shared. If New fails,
+// then none of the metrics are left registered.
+func New(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		reg: reg,
+		announcements: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "announcements_received_total",
+			Help:      "Number of announcements received, by how they arrived.",
+		}, []string{"source"}),
+		syncsStarted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "syncs_started_total",
+			Help:      "Number of syncs started.",
+		}),
+		syncsSucceeded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "syncs_succeeded_total",
+			Help:      "Number of syncs that succeeded.",
+		}),
+		syncsFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "syncs_failed_total",
+			Help:      "Number of syncs that failed, by reason.",
+		}, []string{"reason"}),
+		syncDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "duration_seconds",
+			Help:      "Time taken by syncs, whether they succeeded or failed.",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14),
+		}),
+		syncBlocks: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "blocks",
+			Help:      "Number of blocks transferred by each successful sync, by transport.",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+		}, []string{"transport"}),
+		syncBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "bytes",
+			Help:      "Number of bytes transferred by each successful sync, by transport.",
+			Buckets:   prometheus.ExponentialBuckets(1024, 4, 12),
+		}, []string{"transport"}),
+		rateLimitHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rate_limit_hits_total",
+			Help:      "Number of times a sync was held back by its rate limiter, by transport.",
+		}, []string{"transport"}),
+		activeSyncs: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "active",
+			Help:      "Number of syncs in progress.",
+		}),
+		eventsDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "events_dropped_total",
+			Help:      "Number of events dropped for readers that fell behind, by event.",
+		}, []string{"event"}),
+		connections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "connections_total",
+			Help:      "Number of syncs, by transport and the kind of connection to the publisher.",
+		}, []string{"transport", "connection"}),
+		verifyFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "verify_failures_total",
+			Help:      "Number of synced blocks that failed periodic verification, by reason.",
+		}, []string{"reason"}),
+	}
+
+	var err error
+	defer func() {
+		if err != nil {
+			m.Unregister()
+		}
+	}()
+	if m.announcements, err = register(m, m.announcements); err != nil {
+		return nil, err
+	}
+	if m.syncsStarted, err = register(m, m.syncsStarted); err != nil {
+		return nil, err
+	}
+	if m.syncsSucceeded, err = register(m, m.syncsSucceeded); err != nil {
+		return nil, err
+	}
+	if m.syncsFailed, err = register(m, m.syncsFailed); err != nil {
+		return nil, err
+	}
+	if m.syncDuration, err = register(m, m.syncDuration); err != nil {
+		return nil, err
+	}
+	if m.syncBlocks, err = register(m, m.syncBlocks); err != nil {
+		return nil, err
+	}
+	if m.syncBytes, err = register(m, m.syncBytes); err != nil {
+		return nil, err
+	}
+	if m.rateLimitHits, err = register(m, m.rateLimitHits); err != nil {
+		return nil, err
+	}
+	if m.activeSyncs, err = register(m, m.activeSyncs); err != nil {
+		return nil, err
+	}
+	if m.eventsDropped, err = register(m, m.eventsDropped); err != nil {
+		return nil, err
+	}
+	if m.connections, err = register(m, m.connections); err != nil {
+		return nil, err
+	}
+	if m.verifyFailures, err = register(m, m.verifyFailures); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// register registers c with the registerer of m, and returns c, or the
+// collector of the same type that is already registered in its place.
+func register[C prometheus.Collector](m *Metrics, c C) (C, error) {
+	err := m.reg.Register(c)
+	if err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(C); ok {
+				return existing, nil
+			}
+		}
+		return c, err
+	}
+	m.registered = append(m.registered, c)
+	return c, nil
+}
+
+// Unregister unregisters the metrics that New registered, leaving any that
+// were already registered when New was called. It must only be called when no
+// other Metrics share the metrics, such as when the Subscriber that the
+// metrics were created for could not be created.
+func (m *Metrics) Unregister() {
+	if m == nil {
+		return
+	}
+	for _, c := range m.registered {
+		m.reg.Unregister(c)
+	}
+	m.registered = nil
+}
+
+// AnnounceReceived counts an announcement that arrived from source, such as
+// "pubsub" or "http".
+func (m *Metrics) AnnounceReceived(source string) {
+	if m == nil {
+		return
+	}
+	m.announcements.WithLabelValues(source).Inc()
+}
+
+// SyncStarted counts a sync that started. SyncFinished must be called when
+// the sync is done.
+func (m *Metrics) SyncStarted() {
+	if m == nil {
+		return
+	}
+	m.syncsStarted.Inc()
+	m.activeSyncs.Inc()
+}
+
+// SyncFinished records the duration of a sync that was started, and counts it
+// as succeeded if reason is empty, or as failed for the given reason.
+func (m *Metrics) SyncFinished(duration time.Duration, reason string) {
+	if m == nil {
+		return
+	}
+	m.activeSyncs.Dec()
+	m.syncDuration.Observe(duration.Seconds())
+	if reason == "" {
+		m.syncsSucceeded.Inc()
+	} else {
+		m.syncsFailed.WithLabelValues(reason).Inc()
+	}
+}
+
+// Transferred records the number of blocks and bytes that a successful sync
+// transferred over transport, such as "dtsync" or "httpsync". A block is
+// counted once for each place it is linked from in the synced DAG.
+func (m *Metrics) Transferred(transport string, blocks int, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.syncBlocks.WithLabelValues(transport).Observe(float64(blocks))
+	m.syncBytes.WithLabelValues(transport).Observe(float64(bytes))
+}
+
+// RateLimited counts a sync over transport being held back by its rate
+// limiter.
+func (m *Metrics) RateLimited(transport string) {
+	if m == nil {
+		return
+	}
+	m.rateLimitHits.WithLabelValues(transport).Inc()
+}
+
+// EventsDropped counts the number of events of the named kind, such as
+// EventSyncFinished, that were dropped for a reader that fell behind.
+func (m *Metrics) EventsDropped(event string, count int) {
+	if m == nil {
+		return
+	}
+	m.eventsDropped.WithLabelValues(event).Add(float64(count))
+}
+
+// SyncConnection counts a sync over transport, such as "graphsync" or "http",
+// that is done over the given kind of connection, such as ConnectionRelay.
+func (m *Metrics) SyncConnection(transport, connection string) {
+	if m == nil {
+		return
+	}
+	m.connections.WithLabelValues(transport, connection).Inc()
+}
+
+// VerifyFailed counts a synced block that failed verification for the given
+// reason, such as VerifyCorrupt.
+func (m *Metrics) VerifyFailed(reason string) {
+	if m == nil {
+		return
+	}
+	m.verifyFailures.WithLabelValues(reason).Inc()
+}
@@ -0,0 +1,126 @@
+package metrics_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := metrics.New(reg)
+	require.NoError(t, err)
+
+	// Other metrics registered with the same registerer share the collectors.
+	other, err := metrics.New(reg)
+	require.NoError(t, err)
+
+	m.AnnounceReceived("pubsub")
+	other.AnnounceReceived("http")
+	m.SyncStarted()
+	m.SyncStarted()
+	other.SyncStarted()
+	m.SyncFinished(time.Second, "")
+	other.SyncFinished(time.Second, metrics.ReasonTimeout)
+	m.Transferred("dtsync", 3, 1500)
+	other.RateLimited("httpsync")
+	m.EventsDropped(metrics.EventSyncFinished, 2)
+	m.SyncConnection("graphsync", metrics.ConnectionRelay)
+	other.SyncConnection("graphsync", metrics.ConnectionHolePunch)
+	m.VerifyFailed(metrics.VerifyCorrupt)
+
+	require.Equal(t, 2.0, gatherValue(t, reg, "legs_sync_announcements_received_total"))
+	require.Equal(t, 3.0, gatherValue(t, reg, "legs_sync_syncs_started_total"))
+	require.Equal(t, 1.0, gatherValue(t, reg, "legs_sync_syncs_succeeded_total"))
+	require.Equal(t, 1.0, gatherValue(t, reg, "legs_sync_syncs_failed_total"))
+	require.Equal(t, 1.0, gatherValue(t, reg, "legs_sync_active"))
+	require.Equal(t, 1.0, gatherValue(t, reg, "legs_sync_rate_limit_hits_total"))
+	require.Equal(t, 2.0, gatherValue(t, reg, "legs_sync_duration_seconds"))
+	require.Equal(t, 1.0, gatherValue(t, reg, "legs_sync_blocks"))
+	require.Equal(t, 2.0, gatherValue(t, reg, "legs_sync_events_dropped_total"))
+	require.Equal(t, 2.0, gatherValue(t, reg, "legs_sync_connections_total"))
+	require.Equal(t, 1.0, gatherValue(t, reg, "legs_sync_verify_failures_total"))
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *metrics.Metrics
+	m.AnnounceReceived("pubsub")
+	m.SyncStarted()
+	m.SyncFinished(time.Second, metrics.ReasonError)
+	m.Transferred("httpsync", 1, 1)
+	m.RateLimited("dtsync")
+	m.EventsDropped(metrics.EventAnnouncement, 1)
+	m.SyncConnection("http", metrics.ConnectionDirect)
+	m.VerifyFailed(metrics.VerifyMissing)
+}
+
+func TestNewUnregistersOnError(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	// A conflicting metric makes the registration of the last metric fail.
+	conflict := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "legs_sync_connections_total",
+		Help: "Conflicting metric.",
+	})
+	require.NoError(t, reg.Register(conflict))
+	_, err := metrics.New(reg)
+	require.Error(t, err)
+
+	// The metrics registered before the failure are unregistered.
+	started := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "legs_sync_syncs_started_total",
+		Help: "Number of syncs started.",
+	})
+	require.NoError(t, reg.Register(started))
+}
+
+func TestUnregister(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := metrics.New(reg)
+	require.NoError(t, err)
+	other, err := metrics.New(reg)
+	require.NoError(t, err)
+
+	// Metrics that are shared were not registered by other.
+	other.Unregister()
+	m.SyncStarted()
+	require.Equal(t, 1.0, gatherValue(t, reg, "legs_sync_syncs_started_total"))
+
+	m.Unregister()
+	started := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "legs_sync_syncs_started_total",
+		Help: "Number of syncs started.",
+	})
+	require.NoError(t, reg.Register(started))
+
+	var nilMetrics *metrics.Metrics
+	nilMetrics.Unregister()
+}
+
+// gatherValue returns the sum of the values of the named metric, or the sum of
+// the sample counts if it is a histogram.
+func gatherValue(t *testing.T, reg *prometheus.Registry, name string) float64 {
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, mf := range families {
+		if mf.GetName() != name {
+			continue
+		}
+		var total float64
+		for _, metric := range mf.GetMetric() {
+			switch {
+			case metric.Counter != nil:
+				total += metric.GetCounter().GetValue()
+			case metric.Gauge != nil:
+				total += metric.GetGauge().GetValue()
+			case metric.Histogram != nil:
+				total += float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+		return total
+	}
+	t.Fatalf("metric %s not found", name)
+	return 0
+}
@@ -0,0 +1,169 @@
+// Package migrations defines the versions of the schema of the state that
+// go-legs persists in datastores, and migrates a datastore from the version
+// written by an older go-legs to the current one. The state covered is the
+// announcement journal, and the latest syncs stored by a datastore-backed
+// LatestSyncHandler.
+//
+// Each Store, the announcement journal and the latest syncs, is versioned and
+// migrated separately, since they may be kept in different datastores. The
+// schema version of a Store is kept at its VersionKey, in the datastore that
+// holds its state. A datastore with no version for a Store is at version 1:
+//
+//	StoreJournal version 1:
+//	  /legs/version/journal         schema version, as a decimal string
+//	  /legs/journal/<peerID>/<cid>  JSON announcement journal entry
+//
+//	StoreLatestSync version 1:
+//	  /legs/version/latestsync      schema version, as a decimal string
+//	  /legs/latestsync/peer/<peerID>
+//	                                CID bytes of the latest sync of a peer
+//	  /legs/latestsync/topic/<escaped topic>/<peerID>
+//	                                CID bytes of the latest sync of a peer on
+//	                                a topic, with the topic path escaped
+//
+// A Subscriber migrates the datastore of its announcement journal when it is
+// created, and legs.NewDatastoreLatestSyncHandler migrates its datastore, so
+// calling Migrate directly is only needed to migrate a datastore ahead of
+// time.
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var log = logging.Logger("go-legs-migrations")
+
+// Store identifies a kind of state that go-legs persists. Each Store has its
+// own schema version, and its migrations only change its own keys.
+type Store string
+
+const (
+	// StoreJournal is the announcement journal of a Subscriber.
+	StoreJournal Store = "journal"
+	// StoreLatestSync is the latest syncs stored by a datastore-backed
+	// LatestSyncHandler.
+	StoreLatestSync Store = "latestsync"
+)
+
+const (
+	// JournalPrefix is the datastore key prefix under which the announcement
+	// journal is persisted.
+	JournalPrefix = "/legs/journal/"
+	// LatestSyncPrefix is the datastore key prefix under which latest syncs
+	// are persisted.
+	LatestSyncPrefix = "/legs/latestsync/"
+
+	latestSyncPeerPrefix  = LatestSyncPrefix + "peer/"
+	latestSyncTopicPrefix = LatestSyncPrefix + "topic/"
+	versionPrefix         = "/legs/version/"
+)
+
+// ErrNewerVersion is returned when a datastore was written by a newer version
+// of go-legs, whose state this version does not know how to read.
+var ErrNewerVersion = errors.New("datastore schema is newer than supported")
+
+// migration moves the state of a Store from the previous schema version to
+// version. A migration must be safe to run again, since the version is only
+// written after the migration is done, and a failure in between leaves the
+// datastore at the previous version.
+type migration struct {
+	version     int
+	description string
+	migrate     func(ctx context.Context, ds datastore.Datastore) error
+}
+
+// migrations are the migrations of each Store to each schema version after
+// the first, in order of version.
+var migrations = map[Store][]migration{}
+
+// CurrentVersion returns the schema version of store that is written by this
+// version of go-legs.
+func CurrentVersion(store Store) int {
+	ms := migrations[store]
+	if len(ms) == 0 {
+		return 1
+	}
+	return ms[len(ms)-1].version
+}
+
+// VersionKey returns the datastore key that holds the schema version of store.
+func VersionKey(store Store) datastore.Key {
+	return datastore.NewKey(versionPrefix + string(store))
+}
+
+// JournalKey returns the key of the announcement journal entry of the
+// announcement of c by peerID.
+func JournalKey(peerID peer.ID, c cid.Cid) datastore.Key {
+	return datastore.NewKey(JournalPrefix + peerID.String() + "/" + c.String())
+}
+
+// LatestSyncKey returns the key of the latest sync of peerID.
+func LatestSyncKey(peerID peer.ID) datastore.Key {
+	return datastore.NewKey(latestSyncPeerPrefix + peerID.String())
+}
+
+// TopicLatestSyncKey returns the key of the latest sync of peerID on topic.
+// The topic is escaped, since it usually contains slashes.
+func TopicLatestSyncKey(topic string, peerID peer.ID) datastore.Key {
+	return datastore.NewKey(latestSyncTopicPrefix + url.PathEscape(topic) + "/" + peerID.String())
+}
+
+// Version returns the schema version of store in ds. A datastore without a
+// stored version is at version 1.
+func Version(ctx context.Context, ds datastore.Read, store Store) (int, error) {
+	data, err := ds.Get(ctx, VersionKey(store))
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return 1, nil
+		}
+		return 0, fmt.Errorf("cannot read datastore schema version: %w", err)
+	}
+	version, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, fmt.Errorf("bad datastore schema version %q: %w", data, err)
+	}
+	return version, nil
+}
+
+// Migrate migrates the state of store in ds to the current version of store,
+// and returns the version that it was at before. If it is already at the
+// current version, nothing is changed. Returns ErrNewerVersion if the state was
+// written by a newer go-legs, so that it is not silently ignored or
+// overwritten.
+func Migrate(ctx context.Context, ds datastore.Datastore, store Store) (int, error) {
+	from, err := Version(ctx, ds, store)
+	if err != nil {
+		return 0, err
+	}
+	current := CurrentVersion(store)
+	if from > current {
+		return from, fmt.Errorf("%w: %s datastore is at version %d, supported version is %d", ErrNewerVersion, store, from, current)
+	}
+	for _, m := range migrations[store] {
+		if m.version <= from {
+			continue
+		}
+		log.Infow("Migrating datastore", "store", store, "version", m.version, "migration", m.description)
+		if err = m.migrate(ctx, ds); err != nil {
+			return from, fmt.Errorf("cannot migrate %s datastore to version %d: %w", store, m.version, err)
+		}
+		if err = ds.Put(ctx, VersionKey(store), []byte(strconv.Itoa(m.version))); err != nil {
+			return from, fmt.Errorf("cannot write datastore schema version: %w", err)
+		}
+	}
+	if from != current {
+		if err = ds.Sync(ctx, datastore.NewKey("/legs")); err != nil {
+			return from, err
+		}
+	}
+	return from, nil
+}
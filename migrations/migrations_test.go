@@ -0,0 +1,68 @@
+package migrations_test
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/filecoin-project/go-legs/migrations"
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func randomPeers(t *testing.T, n int) []peer.ID {
+	peers := make([]peer.ID, n)
+	for i := range peers {
+		_, pubKey, err := crypto.GenerateEd25519Key(rand.Reader)
+		require.NoError(t, err)
+		peers[i], err = peer.IDFromPublicKey(pubKey)
+		require.NoError(t, err)
+	}
+	return peers
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	ds := datastore.NewMapDatastore()
+
+	for _, store := range []migrations.Store{migrations.StoreJournal, migrations.StoreLatestSync} {
+		version, err := migrations.Version(ctx, ds, store)
+		require.NoError(t, err)
+		require.Equal(t, 1, version)
+
+		from, err := migrations.Migrate(ctx, ds, store)
+		require.NoError(t, err)
+		require.Equal(t, 1, from)
+		version, err = migrations.Version(ctx, ds, store)
+		require.NoError(t, err)
+		require.Equal(t, migrations.CurrentVersion(store), version)
+	}
+}
+
+func TestMigrateNewerVersion(t *testing.T) {
+	ctx := context.Background()
+	ds := datastore.NewMapDatastore()
+	require.NoError(t, ds.Put(ctx, migrations.VersionKey(migrations.StoreJournal), []byte("1000")))
+
+	from, err := migrations.Migrate(ctx, ds, migrations.StoreJournal)
+	require.True(t, errors.Is(err, migrations.ErrNewerVersion))
+	require.Equal(t, 1000, from)
+
+	// Each store is versioned separately, even in the same datastore.
+	_, err = migrations.Migrate(ctx, ds, migrations.StoreLatestSync)
+	require.NoError(t, err)
+
+	require.NoError(t, ds.Put(ctx, migrations.VersionKey(migrations.StoreJournal), []byte("bad")))
+	_, err = migrations.Migrate(ctx, ds, migrations.StoreJournal)
+	require.Error(t, err)
+}
+
+func TestTopicLatestSyncKey(t *testing.T) {
+	p := randomPeers(t, 1)[0]
+	key := migrations.TopicLatestSyncKey("/legs/testtopic", p)
+	require.Equal(t, "/legs/latestsync/topic/%2Flegs%2Ftesttopic/"+p.String(), key.String())
+	require.Equal(t, p.String(), key.Name())
+}
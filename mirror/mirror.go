@@ -0,0 +1,124 @@
+// Package mirror re-announces the heads that a Subscriber syncs from a
+// publisher, using another Publisher. This lets a node relay a publisher's
+// chain on another topic or transport, such as syncing it over graphsync and
+// serving it over http, for availability.
+package mirror
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var log = logging.Logger("go-legs-mirror")
+
+// Mirror publishes each head that a Subscriber syncs from a source publisher.
+// The Publisher must serve blocks from the link system that the Subscriber
+// syncs into, so that the mirrored chain can be synced from it.
+type Mirror struct {
+	pub    legs.Publisher
+	peerID peer.ID
+	cfg    config
+
+	// head is the last head that was published by the mirror.
+	head      cid.Cid
+	headMutex sync.Mutex
+
+	cancelWatch context.CancelFunc
+	closeOnce   sync.Once
+	done        chan struct{}
+}
+
+// New creates a Mirror that publishes with pub each head that sub syncs from
+// the publisher identified by peerID. If sub already has a latest sync with the
+// publisher, then it is published before New returns. The Mirror does not
+// close sub or pub when it is closed.
+func New(sub *legs.Subscriber, pub legs.Publisher, peerID peer.ID, options ...Option) (*Mirror, error) {
+	if sub == nil || pub == nil {
+		return nil, errors.New("mirror requires a subscriber and a publisher")
+	}
+	if err := peerID.Validate(); err != nil {
+		return nil, err
+	}
+	cfg, err := getOpts(options)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Mirror{
+		pub:    pub,
+		peerID: peerID,
+		cfg:    cfg,
+		done:   make(chan struct{}),
+	}
+
+	if lnk := sub.GetLatestSync(peerID); lnk != nil {
+		if err = m.update(lnk.(cidlink.Link).Cid); err != nil {
+			return nil, err
+		}
+	}
+
+	var events <-chan legs.SyncFinished
+	events, m.cancelWatch = sub.OnSyncFinishedFrom(peerID)
+	go m.run(events)
+
+	return m, nil
+}
+
+// Head returns the last head that the Mirror published, or cid.Undef if it
+// has not published any.
+func (m *Mirror) Head() cid.Cid {
+	m.headMutex.Lock()
+	defer m.headMutex.Unlock()
+	return m.head
+}
+
+// Close stops the Mirror from publishing any more heads, and waits for any
+// head that is being published.
+func (m *Mirror) Close() error {
+	m.closeOnce.Do(func() {
+		m.cancelWatch()
+		<-m.done
+	})
+	return nil
+}
+
+// run publishes the head of each sync until the events channel is closed.
+func (m *Mirror) run(events <-chan legs.SyncFinished) {
+	defer close(m.done)
+	for event := range events {
+		if err := m.update(event.Cid); err != nil {
+			log.Errorw("Cannot publish mirrored head", "err", err, "cid", event.Cid, "peer", m.peerID)
+		}
+	}
+}
+
+// update publishes c, unless it is already the published head.
+func (m *Mirror) update(c cid.Cid) error {
+	m.headMutex.Lock()
+	defer m.headMutex.Unlock()
+	if c == m.head {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.cfg.updateTimeout)
+	defer cancel()
+	var err error
+	if m.cfg.addrs != nil {
+		err = m.pub.UpdateRootWithAddrs(ctx, c, m.cfg.addrs)
+	} else {
+		err = m.pub.UpdateRoot(ctx, c)
+	}
+	if err != nil {
+		return err
+	}
+	m.head = c
+	log.Infow("Published mirrored head", "cid", c, "peer", m.peerID)
+	return nil
+}
@@ -0,0 +1,95 @@
+package mirror_test
+
+import (
+	"context"
+	"crypto/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/httpsync"
+	"github.com/filecoin-project/go-legs/mirror"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+const testTopic = "/legs/testtopic"
+
+func TestMirror(t *testing.T) {
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	defer srcHost.Close()
+	srcLnkS := test.MkLinkSystem(srcStore)
+
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	chainLnks := test.MkChain(srcLnkS, true)
+	headCid := chainLnks[0].(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(context.Background(), headCid))
+
+	subStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	subHost := test.MkTestHost()
+	defer subHost.Close()
+	subHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+	subLnkS := test.MkLinkSystem(subStore)
+	sub, err := legs.NewSubscriber(subHost, subStore, subLnkS, testTopic, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// The mirror serves the synced chain over http, from the subscriber's
+	// link system.
+	mirrorKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	mirrorID, err := peer.IDFromPrivateKey(mirrorKey)
+	require.NoError(t, err)
+	mirrorPub, err := httpsync.NewPublisher("127.0.0.1:0", subLnkS, mirrorID, mirrorKey)
+	require.NoError(t, err)
+	defer mirrorPub.Close()
+
+	m, err := mirror.New(sub, mirrorPub, srcHost.ID())
+	require.NoError(t, err)
+	defer m.Close()
+	require.Equal(t, cid.Undef, m.Head())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	syncCid, err := sub.Sync(ctx, srcHost.ID(), cid.Undef, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, headCid, syncCid)
+	require.Eventually(t, func() bool { return m.Head() == headCid }, 5*time.Second, 50*time.Millisecond)
+
+	// Sync the mirrored chain from the mirror.
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	httpSync := httpsync.NewSync(test.MkLinkSystem(dstStore), http.DefaultClient, nil)
+	syncer, err := httpSync.NewSyncer(mirrorID, mirrorPub.Address(), nil)
+	require.NoError(t, err)
+	head, err := syncer.GetHead(ctx)
+	require.NoError(t, err)
+	require.Equal(t, headCid, head)
+	require.NoError(t, syncer.Sync(ctx, head, selectorparse.CommonSelector_ExploreAllRecursively))
+	for _, lnk := range chainLnks {
+		has, err := dstStore.Has(ctx, datastore.NewKey(lnk.(cidlink.Link).Cid.String()))
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+
+	// A new mirror publishes the latest sync with the publisher when created.
+	mirrorPub2, err := httpsync.NewPublisher("127.0.0.1:0", subLnkS, mirrorID, mirrorKey)
+	require.NoError(t, err)
+	defer mirrorPub2.Close()
+	m2, err := mirror.New(sub, mirrorPub2, srcHost.ID())
+	require.NoError(t, err)
+	require.Equal(t, headCid, m2.Head())
+	require.NoError(t, m2.Close())
+}
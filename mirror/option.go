@@ -0,0 +1,52 @@
+package mirror
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/multiformats/go-multiaddr"
+)
+
+const defaultUpdateTimeout = time.Minute
+
+type Option func(*config) error
+
+// config contains all options for configuring a Mirror.
+type config struct {
+	addrs         []multiaddr.Multiaddr
+	updateTimeout time.Duration
+}
+
+// getOpts creates a config and applies Options to it.
+func getOpts(opts []Option) (config, error) {
+	cfg := config{
+		updateTimeout: defaultUpdateTimeout,
+	}
+	for i, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return config{}, fmt.Errorf("option %d failed: %s", i, err)
+		}
+	}
+	return cfg, nil
+}
+
+// WithAddrs sets the addresses that the mirror announces with each head,
+// instead of the publisher's own addresses.
+func WithAddrs(addrs []multiaddr.Multiaddr) Option {
+	return func(c *config) error {
+		c.addrs = addrs
+		return nil
+	}
+}
+
+// WithUpdateTimeout sets the maximum time to wait for the publisher to update
+// its root and announce a mirrored head. The default is one minute.
+func WithUpdateTimeout(timeout time.Duration) Option {
+	return func(c *config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("update timeout must be positive: %s", timeout)
+		}
+		c.updateTimeout = timeout
+		return nil
+	}
+}
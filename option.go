@@ -1,6 +1,7 @@
 package legs
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"sync"
@@ -8,11 +9,20 @@ import (
 
 	dt "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-legs/announce"
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/httpsync"
+	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/traversal/selector"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/discovery"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/time/rate"
 )
 
@@ -22,23 +32,84 @@ type config struct {
 	allowPeer announce.AllowPeerFunc
 	filterIPs bool
 
-	topic *pubsub.Topic
+	transportPolicy TransportPolicyFunc
+	relaySync       bool
+	holePunchWait   time.Duration
 
-	dtManager     dt.Manager
-	graphExchange graphsync.GraphExchange
+	topic     *pubsub.Topic
+	discovery discovery.Discovery
 
-	blockHook  BlockHookFunc
-	httpClient *http.Client
+	dtManager          dt.Manager
+	graphExchange      graphsync.GraphExchange
+	dtLocalCheck       dtsync.LocalCheck
+	dtPauseOnRateLimit bool
+
+	blockHook    BlockHookFunc
+	peerHooks    map[peer.ID]BlockHookFunc
+	orderedHook  bool
+	dedupHook    bool
+	httpClient   *http.Client
+	httpAuth     httpsync.AuthHeaderFunc
+	dedupFetches bool
+
+	httpMaxAttempts int
+	httpMinBackoff  time.Duration
+	httpMaxBackoff  time.Duration
+	httpMaxFailures int
+	httpCooldown    time.Duration
 
 	syncRecLimit selector.RecursionLimit
 
-	idleHandlerTTL    time.Duration
-	latestSyncHandler LatestSyncHandler
+	idleHandlerTTL     time.Duration
+	latestSyncHandler  LatestSyncHandler
+	latestSyncPerTopic bool
 
-	rateLimiterFor RateLimiterFor
-	resendAnnounce bool
+	rateLimiterFor  RateLimiterFor
+	lsysFor         LinkSystemFor
+	quotaFor        StorageQuotaFor
+	maxAsyncSyncs   int
+	syncPriority    SyncPriorityFunc
+	resendAnnounce  bool
+	shouldSync      ShouldSyncFunc
+	streamAnnounce  bool
+	trustedRelays   []peer.ID
+	servePublishers bool
+	validate        bool
 
 	segDepthLimit int64
+
+	verifyInterval   time.Duration
+	verifySampleSize int
+	verifyFailedHook VerifyFailedHookFunc
+	verifyRepair     bool
+
+	skipListDS datastore.Datastore
+	journalDS  datastore.Datastore
+	quotaDS    datastore.Datastore
+	dsPrefix   string
+
+	metricsReg  prometheus.Registerer
+	eventSink   EventSink
+	hostEvents  bool
+	tracerProv  trace.TracerProvider
+	stagingDS   datastore.Batching
+	syncStateDS datastore.Batching
+
+	writeBatchSize     int
+	writeBatchInterval time.Duration
+	// putMany writes a batch of blocks to the blockstore of a Subscriber
+	// created with NewSubscriberWithBlockstore.
+	putMany func(context.Context, []blocks.Block) error
+
+	progressInterval int
+
+	chainPrevPath string
+	chainNodeFunc ChainNodeFunc
+
+	staleMultiple float64
+	staleInterval time.Duration
+	staleHook     PublisherStaleHookFunc
+	stalePoll     bool
 }
 
 type Option func(*config) error
@@ -53,6 +124,56 @@ func (c *config) apply(opts []Option) error {
 	return nil
 }
 
+// TransportPolicy sets the policy that decides how to sync with a publisher
+// that has several addresses, such as both graphsync and HTTP addresses. The
+// policy orders the addresses given in an announcement or to Sync, or those in
+// the peerstores if none are given, and the first one decides the transport.
+// See PreferHTTP, PreferGraphsync, PreferQUIC, AvoidRelays, LatencyRanker,
+// and CombinePolicies. The default is PreferHTTP. The transport of each sync is
+// given in its SyncFinished event.
+func TransportPolicy(policy TransportPolicyFunc) Option {
+	return func(c *config) error {
+		if policy == nil {
+			return fmt.Errorf("transport policy cannot be nil")
+		}
+		c.transportPolicy = policy
+		return nil
+	}
+}
+
+// RelaySync sets whether to sync over libp2p with publishers that the host is
+// only connected to through a circuit relay, such as publishers behind NAT
+// that announce /p2p-circuit addresses. Libp2p does not otherwise open streams
+// over relayed connections, since relays limit their time and data, so a
+// large sync may not complete over a relay. A dtsync publisher must also allow
+// this, with dtsync.WithRelay. If DtManager is given, then this only applies
+// to querying the head of dtsync publishers and to HTTP over libp2p streams.
+// Disabled by default.
+func RelaySync(allow bool) Option {
+	return func(c *config) error {
+		c.relaySync = allow
+		return nil
+	}
+}
+
+// HolePunchWait sets how long a sync over libp2p waits for hole punching to
+// establish a direct connection with a publisher that the host is only
+// connected to through a circuit relay, before syncing over the relay. Hole
+// punching is done by libp2p, so both the host and the publisher's host must
+// enable it, such as with libp2p.EnableHolePunching. If no direct connection
+// is established in time, then the sync is done over the relay if RelaySync is
+// enabled, and otherwise fails. A value of zero, the default, does not wait.
+// The kind of connection of each sync is counted by the Metrics option.
+func HolePunchWait(wait time.Duration) Option {
+	return func(c *config) error {
+		if wait < 0 {
+			return fmt.Errorf("hole punch wait cannot be negative: %s", wait)
+		}
+		c.holePunchWait = wait
+		return nil
+	}
+}
+
 // AllowPeer sets the function that determines whether to allow or reject
 // messages from a peer.
 func AllowPeer(allowPeer announce.AllowPeerFunc) Option {
@@ -63,7 +184,11 @@ func AllowPeer(allowPeer announce.AllowPeerFunc) Option {
 }
 
 // AddrTTL sets the peerstore address time-to-live for addresses discovered
-// from pubsub messages.
+// from announcements. Every address in an announcement is stored, HTTP
+// addresses in the HTTP peerstore and others in the host's peerstore, and the
+// addresses of a publisher's previous announcement that it no longer announces
+// are expired, so that the publisher is reached at the addresses that it
+// announced last.
 func AddrTTL(addrTTL time.Duration) Option {
 	return func(c *config) error {
 		c.addrTTL = addrTTL
@@ -79,6 +204,21 @@ func Topic(topic *pubsub.Topic) Option {
 	}
 }
 
+// TopicDiscovery sets the discovery service that the Subscriber uses to
+// advertise itself on its pubsub topic, and to find and connect to publishers
+// and other subscribers on the topic. This lets announcements reach the
+// Subscriber in a sparse mesh without manual peering. To discover peers using
+// a DHT, or any other routing.ContentRouting, give it to
+// routing.NewRoutingDiscovery from go-libp2p/p2p/discovery/routing. This
+// cannot be used with the Topic option, since the Subscriber must create the
+// topic's pubsub.
+func TopicDiscovery(d discovery.Discovery) Option {
+	return func(c *config) error {
+		c.discovery = d
+		return nil
+	}
+}
+
 // DtManager provides an existing datatransfer manager.
 func DtManager(dtManager dt.Manager, gs graphsync.GraphExchange) Option {
 	return func(c *config) error {
@@ -88,6 +228,33 @@ func DtManager(dtManager dt.Manager, gs graphsync.GraphExchange) Option {
 	}
 }
 
+// DtLocalCheck sets how a sync over graphsync checks whether the DAG to sync is
+// already stored locally, in which case the sync completes, and a SyncFinished
+// event is sent, without a network exchange. By default, the sync completes
+// without an exchange if every block that the sync's selector reaches is
+// stored. Use dtsync.LocalCheckHead to only check that the head to sync is
+// stored, or dtsync.LocalCheckNone to always fetch from the publisher, such as
+// when the publisher is to be verified to serve the DAG.
+func DtLocalCheck(check dtsync.LocalCheck) Option {
+	return func(c *config) error {
+		c.dtLocalCheck = check
+		return nil
+	}
+}
+
+// DtPauseOnRateLimit sets whether a graphsync sync that hits its rate limit
+// pauses its data transfer until the rate limiter has tokens again, instead of
+// stopping the transfer and starting a new one from where it stopped. The data
+// channel of a paused transfer stays open, and no blocks are sent again when
+// it resumes. Pauses are reported to OnSyncPaused readers. Disabled by default.
+// See: RateLimiter.
+func DtPauseOnRateLimit(enable bool) Option {
+	return func(c *config) error {
+		c.dtPauseOnRateLimit = enable
+		return nil
+	}
+}
+
 // HttpClient provides Subscriber with an existing http client.
 func HttpClient(client *http.Client) Option {
 	return func(c *config) error {
@@ -96,6 +263,74 @@ func HttpClient(client *http.Client) Option {
 	}
 }
 
+// HttpAuthHeader sets a function that provides the Authorization header of
+// each request to an HTTP publisher, for publishers that require
+// authentication. For mutual TLS, provide an http.Client with the HttpClient
+// option, whose transport has a TLS config with the client certificate.
+func HttpAuthHeader(authHeader httpsync.AuthHeaderFunc) Option {
+	return func(c *config) error {
+		c.httpAuth = authHeader
+		return nil
+	}
+}
+
+// HttpRetry sets the number of times that a block fetch from an HTTP publisher
+// is attempted, when it fails with a server error, a too many requests
+// response, a network timeout, a refused or reset connection, or a response
+// that ends early. The delay before each retry starts at minBackoff and doubles
+// after each attempt, up to maxBackoff, unless the publisher requests a longer
+// delay.
+func HttpRetry(maxAttempts int, minBackoff, maxBackoff time.Duration) Option {
+	return func(c *config) error {
+		if maxAttempts < 1 {
+			return fmt.Errorf("max attempts must be at least 1: %d", maxAttempts)
+		}
+		if minBackoff < 0 || maxBackoff < minBackoff {
+			return fmt.Errorf("backoff must be non-negative with max not less than min: %s, %s", minBackoff, maxBackoff)
+		}
+		c.httpMaxAttempts = maxAttempts
+		c.httpMinBackoff = minBackoff
+		c.httpMaxBackoff = maxBackoff
+		return nil
+	}
+}
+
+// HttpCircuitBreaker sets the number of consecutive failed fetches from an
+// HTTP publisher after which the publisher is considered unhealthy. Syncs with
+// an unhealthy publisher fail with httpsync.PublisherUnhealthyError, without
+// making any requests, until the cooldown has passed.
+func HttpCircuitBreaker(maxFailures int, cooldown time.Duration) Option {
+	return func(c *config) error {
+		if maxFailures < 1 {
+			return fmt.Errorf("max failures must be at least 1: %d", maxFailures)
+		}
+		if cooldown <= 0 {
+			return fmt.Errorf("cooldown must be positive: %s", cooldown)
+		}
+		c.httpMaxFailures = maxFailures
+		c.httpCooldown = cooldown
+		return nil
+	}
+}
+
+// CrossPublisherDedup sets whether syncs from different publishers share the
+// fetch of a block that they are all missing, so that content common to
+// multiple publishers, such as mirrors, is fetched only once. The shared block
+// is used only after its digest is verified against its CID. This applies to
+// syncs over HTTP, since graphsync transfers are requested as a whole DAG and
+// already skip fetching a DAG that is fully stored locally.
+//
+// This also makes a sync of a head that is being synced from another
+// publisher wait for that sync to finish. The sync then completes from the
+// blocks that the other sync stored, without fetching them again, and still
+// records the head as the latest sync of its own publisher.
+func CrossPublisherDedup(enable bool) Option {
+	return func(c *config) error {
+		c.dedupFetches = enable
+		return nil
+	}
+}
+
 // BlockHook adds a hook that is run when a block is received via Subscriber.Sync along with a
 // SegmentSyncActions to control the sync flow if segmented sync is enabled.
 // Note that if segmented sync is disabled, calls on SegmentSyncActions will have no effect.
@@ -107,6 +342,51 @@ func BlockHook(blockHook BlockHookFunc) Option {
 	}
 }
 
+// OrderedBlockHook sets whether the block hook is guaranteed to be called in
+// traversal order, where a block is always passed to the hook before the blocks
+// it links to, so that the hook sees a chain from head to tail. Without this,
+// the order of the calls is the order in which the transport receives blocks,
+// which can differ from traversal order, for example when a fetch is retried
+// after being rate limited.
+//
+// When enabled, the hook is called after each sync, or each segment of a
+// segmented sync, has fetched its blocks, by walking the fetched blocks with
+// the sync selector. Any fetched block that the walk does not reach is passed
+// to the hook after the walk, in the order it was received.
+func OrderedBlockHook(enable bool) Option {
+	return func(c *config) error {
+		c.orderedHook = enable
+		return nil
+	}
+}
+
+// DedupBlockHook sets whether the block hook is called only once for each CID
+// in a sync. A DAG that shares blocks between its branches can otherwise cause
+// the hook to be called for the same block multiple times in one sync. The
+// SyncedCids of the SyncFinished event are deduplicated the same way. See
+// SegmentSyncActions.FromLocalStore to tell whether a block was received from
+// the publisher or was already in the local store.
+func DedupBlockHook(enable bool) Option {
+	return func(c *config) error {
+		c.dedupHook = enable
+		return nil
+	}
+}
+
+// PublisherBlockHook adds a hook that is run instead of the BlockHook when a
+// block is received from the specified publisher. This option may be given
+// multiple times to set hooks for different publishers. See:
+// Subscriber.SetPublisherBlockHook.
+func PublisherBlockHook(peerID peer.ID, hook BlockHookFunc) Option {
+	return func(c *config) error {
+		if c.peerHooks == nil {
+			c.peerHooks = make(map[peer.ID]BlockHookFunc)
+		}
+		c.peerHooks[peerID] = hook
+		return nil
+	}
+}
+
 // FilterIPs removes any private, loopback, or unspecified IP multiaddrs from
 // addresses supplied in announce messages.
 func FilterIPs(enable bool) Option {
@@ -124,6 +404,271 @@ func IdleHandlerTTL(ttl time.Duration) Option {
 	}
 }
 
+// VerifyInterval enables periodic verification of previously synced data.
+// Every interval, the blocks of the last completed sync with sampleSize
+// randomly chosen publishers are read from the local store, and checked to
+// have the correct hash and to be linked together. This detects corruption of
+// locally stored data before it causes a future sync to fail. Any failure is
+// logged and reported to the hook set by VerifyFailedHook. Disabled by default.
+func VerifyInterval(interval time.Duration, sampleSize int) Option {
+	return func(c *config) error {
+		if interval < 0 {
+			return fmt.Errorf("verify interval cannot be negative: %s", interval)
+		}
+		if sampleSize < 1 {
+			return fmt.Errorf("verify sample size must be at least 1: %d", sampleSize)
+		}
+		c.verifyInterval = interval
+		c.verifySampleSize = sampleSize
+		return nil
+	}
+}
+
+// VerifyFailedHook sets a function that is called when verification of
+// previously synced data finds a block that is missing or corrupt. See:
+// VerifyInterval.
+func VerifyFailedHook(hook VerifyFailedHookFunc) Option {
+	return func(c *config) error {
+		c.verifyFailedHook = hook
+		return nil
+	}
+}
+
+// VerifyRepair configures whether missing blocks, found by periodic
+// verification of synced data, are repaired by syncing them again from the
+// publisher. The last sync is repeated through the publisher's handler, and
+// the latest sync is not changed. Disabled by default. See: VerifyInterval,
+// Subscriber.RepairLastSync.
+func VerifyRepair(enable bool) Option {
+	return func(c *config) error {
+		c.verifyRepair = enable
+		return nil
+	}
+}
+
+// BatchWrites sets the number of synced blocks that are held in memory and
+// written to storage together, instead of writing each block as it is
+// received. Held blocks are also written when a sync completes, and, if
+// flushInterval is not zero, at each flushInterval. If the Subscriber is
+// created with NewSubscriberWithBlockstore, then each batch is written with a
+// single PutMany. A size less than two disables batching, which is the
+// default.
+func BatchWrites(size int, flushInterval time.Duration) Option {
+	return func(c *config) error {
+		if flushInterval < 0 {
+			return fmt.Errorf("flush interval cannot be negative: %s", flushInterval)
+		}
+		c.writeBatchSize = size
+		c.writeBatchInterval = flushInterval
+		return nil
+	}
+}
+
+// SkipListDatastore sets the datastore that the Subscriber's skip list is
+// persisted in, so that skipped CIDs remain skipped after a restart. If not
+// set, the skip list is only kept in memory. See: Subscriber.SkipCids.
+func SkipListDatastore(ds datastore.Datastore) Option {
+	return func(c *config) error {
+		c.skipListDS = ds
+		return nil
+	}
+}
+
+// AnnounceJournalDatastore sets the datastore that the Subscriber records
+// every received announcement in, with the time it was received and whether it
+// was handled, skipped, or failed. Announcements that failed or never
+// completed, such as because of a bug or an outage, can then be re-attempted
+// by calling Subscriber.ReplayFailed. If not set, announcements are not
+// recorded. See: Subscriber.AnnounceJournal.
+func AnnounceJournalDatastore(ds datastore.Datastore) Option {
+	return func(c *config) error {
+		c.journalDS = ds
+		return nil
+	}
+}
+
+// Metrics registers Prometheus metrics of the Subscriber with reg. These count
+// the announcements received, and the syncs started, succeeded, and failed by
+// reason, and record the duration of syncs, the blocks and bytes transferred
+// by syncs over dtsync and httpsync, the number of times syncs were held back
+// by rate limiting, the number of syncs in progress, and the synced blocks
+// that fail periodic verification. Subscribers that register with the same
+// registerer share the metrics. See the metrics package.
+func Metrics(reg prometheus.Registerer) Option {
+	return func(c *config) error {
+		c.metricsReg = reg
+		return nil
+	}
+}
+
+// SyncEventSink sets an EventSink that receives structured events of the
+// announcements that the Subscriber receives, and of the syncs that it runs
+// and the blocks that they reach, from all sync paths, and of synced blocks
+// that fail periodic verification. This lets the events be shipped to a
+// logging or analytics system, instead of being observed only in the
+// Subscriber's log.
+func SyncEventSink(sink EventSink) Option {
+	return func(c *config) error {
+		c.eventSink = sink
+		return nil
+	}
+}
+
+// HostEvents publishes the lifecycle events of the Subscriber on the event bus
+// of its libp2p host, so that applications that already consume the bus get
+// them without reading the Subscriber's event channels. The events are
+// EvtAnnouncementReceived, EvtSyncStarted, EvtSyncFinished, EvtSyncFailed,
+// EvtPublisherAdded, and EvtPublisherEvicted. Events are emitted from the sync
+// paths, which wait for every bus subscriber to receive them, so subscribers
+// must read events promptly.
+func HostEvents(enable bool) Option {
+	return func(c *config) error {
+		c.hostEvents = enable
+		return nil
+	}
+}
+
+// TracerProvider sets the OpenTelemetry tracer provider that creates the spans
+// tracing the handling of announcements and syncs, including the syncs over
+// dtsync and httpsync. The default is the global tracer provider, set with
+// otel.SetTracerProvider.
+func TracerProvider(tp trace.TracerProvider) Option {
+	return func(c *config) error {
+		c.tracerProv = tp
+		return nil
+	}
+}
+
+// StagingDatastore enables staging of synced blocks in ds. The blocks of a
+// sync are stored in ds, and are only stored in the Subscriber's link system
+// once the whole sync succeeds, so that a failed sync does not leave a partial
+// DAG in the link system. The blocks of a failed sync are kept in ds for
+// inspection, with Subscriber.StagedBlocks, until the next sync with the same
+// publisher starts. Use a disk-backed datastore for syncs that are too large
+// to stage in memory.
+//
+// Staging applies to syncs started by Sync and by announcements. It requires
+// a data transfer manager that supports syncing to a separate link system.
+// Block hooks are called as blocks are staged, before they are stored in the
+// Subscriber's link system.
+func StagingDatastore(ds datastore.Batching) Option {
+	return func(c *config) error {
+		c.stagingDS = ds
+		return nil
+	}
+}
+
+// SyncStateDatastore sets the datastore that the traversal state of syncs is
+// kept in, instead of memory. This state includes the CIDs already passed to
+// the block hook, used by DedupBlockHook, the blocks waiting to be passed to
+// the block hook, used by OrderedBlockHook, and the blocks already visited
+// when walking synced blocks. A bloom filter in front of the datastore avoids
+// most datastore lookups. Use a disk-backed datastore so that syncs of
+// arbitrarily long chains run in constant memory.
+//
+// The state of each sync is removed from ds when the sync ends, and any state
+// left in ds is removed when the Subscriber is created, so ds must not be
+// shared with another Subscriber. The SyncedCids of each SyncFinished event
+// are still kept in memory.
+func SyncStateDatastore(ds datastore.Batching) Option {
+	return func(c *config) error {
+		c.syncStateDS = ds
+		return nil
+	}
+}
+
+// DatastorePrefix puts all keys that the Subscriber writes under prefix, in
+// the datastore given to NewSubscriber, where datatransfer keeps the state of
+// its channels, and in the datastores given by SkipListDatastore,
+// AnnounceJournalDatastore, StorageQuotaDatastore, StagingDatastore, and
+// SyncStateDatastore. This keeps the keys from colliding with application data
+// in a shared datastore. The go-legs keys written without a prefix by a
+// previous Subscriber are moved under the prefix by MigrateDatastorePrefix.
+func DatastorePrefix(prefix string) Option {
+	return func(c *config) error {
+		if prefix == "" {
+			return fmt.Errorf("datastore prefix cannot be empty")
+		}
+		c.dsPrefix = prefix
+		return nil
+	}
+}
+
+// ChainWalker enables delivery of the new nodes of each publisher's chain to
+// fn. After each sync that updates the latest sync with a publisher, the chain
+// is walked from the new head back to the previous latest sync, by following
+// the link at prevPath in each node, such as "PreviousID" for an
+// advertisement chain. Then fn is called for each new node, in order from the
+// oldest to the new head, before the SyncFinished for the sync is sent. This
+// saves consumers from having to find the new part of the chain themselves.
+//
+// The walk ends at the first node of the chain, which has no link at
+// prevPath, or at a node that is not stored, such as one in the skip list.
+// Syncs that are started with an explicit CID or selector, and so do not
+// update the latest sync, are not walked.
+func ChainWalker(prevPath string, fn ChainNodeFunc) Option {
+	return func(c *config) error {
+		c.chainPrevPath = prevPath
+		c.chainNodeFunc = fn
+		return nil
+	}
+}
+
+// SyncProgressInterval enables SyncProgress events, which are delivered to
+// OnSyncProgress channels every interval blocks synced. This allows consumers
+// of syncs that traverse very many blocks to start processing the synced
+// blocks before the whole sync completes. A value of zero, the default,
+// disables SyncProgress events.
+func SyncProgressInterval(interval int) Option {
+	return func(c *config) error {
+		if interval < 0 {
+			return fmt.Errorf("sync progress interval must not be negative: %d", interval)
+		}
+		c.progressInterval = interval
+		return nil
+	}
+}
+
+// StaleAnnounce enables watching for publishers that stop announcing. Every
+// interval, each publisher that previously announced regularly is checked for
+// having been silent for longer than multiple times its average time between
+// announces. A publisher that is found to be stale is logged and reported to
+// the hook set by PublisherStaleHook, once until it announces again. Disabled
+// by default. See: StaleAnnouncePoll.
+func StaleAnnounce(multiple float64, interval time.Duration) Option {
+	return func(c *config) error {
+		if multiple < 1 {
+			return fmt.Errorf("stale announce multiple must be at least 1: %f", multiple)
+		}
+		if interval <= 0 {
+			return fmt.Errorf("stale announce interval must be positive: %s", interval)
+		}
+		c.staleMultiple = multiple
+		c.staleInterval = interval
+		return nil
+	}
+}
+
+// PublisherStaleHook sets a function that is called when a publisher is found
+// to have stopped announcing. See: StaleAnnounce.
+func PublisherStaleHook(hook PublisherStaleHookFunc) Option {
+	return func(c *config) error {
+		c.staleHook = hook
+		return nil
+	}
+}
+
+// StaleAnnouncePoll configures whether the head of a publisher that is found
+// to have stopped announcing is synced, the same as Sync with an undefined
+// CID, so that updates that were not announced are not missed. See:
+// StaleAnnounce. Disabled by default.
+func StaleAnnouncePoll(enable bool) Option {
+	return func(c *config) error {
+		c.stalePoll = enable
+		return nil
+	}
+}
+
 // SegmentDepthLimit sets the maximum recursion depth limit for a segmented sync.
 // Setting the depth to a value less than zero disables segmented sync completely.
 // Disabled by default.
@@ -154,6 +699,103 @@ func ResendAnnounce(enable bool) Option {
 	}
 }
 
+// ShouldSyncFunc is the signature of a function that decides whether to sync
+// the CID announced by a publisher. Returning false skips the sync.
+type ShouldSyncFunc func(peer.ID, cid.Cid) bool
+
+// ShouldSync sets a function that is called after an announcement is received,
+// and before the announced CID is synced, to decide whether to sync it. If the
+// function returns false, then the sync is skipped, and the latest sync is not
+// updated. This avoids syncing CIDs that are known to be already synced, such
+// as those already indexed in an external database. If the announcement is of
+// an announcement record, then the function is called with the CID that the
+// record announces. The function is not called for syncs requested by calling
+// Subscriber.Sync.
+func ShouldSync(shouldSync ShouldSyncFunc) Option {
+	return func(c *config) error {
+		c.shouldSync = shouldSync
+		return nil
+	}
+}
+
+// StreamAnnounce sets whether the Subscriber handles announce messages that
+// publishers send directly to its host over the announce.ProtocolID stream
+// protocol for its topic, bypassing gossip pubsub. These announcements are
+// handled the same as those received over pubsub, except that an announcement
+// is only accepted from the publisher it announces, or from a relay given by
+// TrustedRelays.
+func StreamAnnounce(enable bool) Option {
+	return func(c *config) error {
+		c.streamAnnounce = enable
+		return nil
+	}
+}
+
+// TrustedRelays sets the peers that are trusted to send announce messages
+// directly to the Subscriber on behalf of other publishers. See
+// StreamAnnounce.
+func TrustedRelays(relays ...peer.ID) Option {
+	return func(c *config) error {
+		c.trustedRelays = relays
+		return nil
+	}
+}
+
+// ServePublishers sets whether the Subscriber serves the publishers it knows,
+// with their latest sync and addresses, to other Subscribers on the same
+// topic. Another Subscriber fetches them with BootstrapPublishers, to start
+// from the publisher set of this Subscriber. The publishers are served over
+// the PublishersProtocolID stream protocol.
+func ServePublishers(enable bool) Option {
+	return func(c *config) error {
+		c.servePublishers = enable
+		return nil
+	}
+}
+
+// ValidateAnnounce sets whether announce messages are validated by pubsub
+// before they are handled or propagated to other peers. Messages that cannot be
+// decoded or that announce an undefined CID are rejected, and those from
+// publishers that are not allowed by the AllowPeer function are ignored. This
+// cannot be used with the Topic option, since the validator must be registered
+// with the topic's pubsub instance. For a topic provided with the Topic option,
+// register announce.NewValidator instead.
+func ValidateAnnounce(enable bool) Option {
+	return func(c *config) error {
+		c.validate = enable
+		return nil
+	}
+}
+
+// MaxAsyncSyncs sets the maximum number of syncs of announced CIDs, with
+// different publishers, that run at once. When the maximum number are running,
+// the syncs of further announcements wait until a running sync finishes, and
+// are then started in the order set by SyncPriority. Syncs requested by calling
+// Subscriber.Sync are not limited. A value of zero, the default, means there is
+// no limit.
+func MaxAsyncSyncs(n int) Option {
+	return func(c *config) error {
+		if n < 0 {
+			return fmt.Errorf("max async syncs cannot be negative: %d", n)
+		}
+		c.maxAsyncSyncs = n
+		return nil
+	}
+}
+
+// SyncPriority sets a function that orders the syncs of announced CIDs that
+// are waiting to start because MaxAsyncSyncs syncs are already running. For
+// example, a function that prefers the PendingSync with the earliest
+// LastSynced starts syncs with publishers that have not been synced recently
+// first. Without a priority function, waiting syncs are started in the order
+// that they were announced. This has no effect unless MaxAsyncSyncs is set.
+func SyncPriority(less SyncPriorityFunc) Option {
+	return func(c *config) error {
+		c.syncPriority = less
+		return nil
+	}
+}
+
 type RateLimiterFor func(publisher peer.ID) *rate.Limiter
 
 // RateLimiter configures a function that is called for each sync to get the
@@ -165,6 +807,61 @@ func RateLimiter(limiterFor RateLimiterFor) Option {
 	}
 }
 
+// LinkSystemFor returns the link system that the blocks synced from a
+// publisher are stored in.
+type LinkSystemFor func(publisher peer.ID) ipld.LinkSystem
+
+// PublisherLinkSystems configures a function that creates the link system
+// that each publisher's blocks are stored in, instead of the link system given
+// to NewSubscriber. The function is called once for each publisher, the first
+// time that its link system is needed, so it can create a separate store or
+// datastore namespace for the publisher. This lets the data of each publisher
+// be garbage collected, or limited by a quota, on its own.
+//
+// Everything that reads or writes a publisher's blocks, such as syncs,
+// staging, verification, CollectGarbage, and ImportCAR, uses the publisher's
+// link system. SyncAt still stores blocks in the link system given to it.
+// Blocks synced into a publisher's link system are not batched by
+// BatchWrites.
+func PublisherLinkSystems(lsysFor LinkSystemFor) Option {
+	return func(c *config) error {
+		c.lsysFor = lsysFor
+		return nil
+	}
+}
+
+// StorageQuota configures a function that is called for each block that a sync
+// stores, to get the storage quota of the block's publisher. The Subscriber
+// counts the bytes of the blocks that syncs store for each publisher, and a
+// sync that would store more than its publisher's quota is stopped with an
+// error wrapping ErrQuotaExceeded, without storing the block. Each stopped sync
+// is reported to OnQuotaExceeded, so that the quota can be reviewed, and
+// raised by returning a larger quota for later syncs.
+//
+// Blocks that are already stored are not counted again, and blocks deleted by
+// CollectGarbage are no longer counted for the publisher whose chain they were
+// collected from. The count starts at zero for each publisher, unless it is
+// persisted with StorageQuotaDatastore, and does not include blocks stored by
+// SyncAt. Use SetStoredBytes to set it, such as when the Subscriber is started
+// with blocks already stored. Staged blocks are counted when they are staged.
+// This cannot be used with the DtManager option.
+func StorageQuota(quotaFor StorageQuotaFor) Option {
+	return func(c *config) error {
+		c.quotaFor = quotaFor
+		return nil
+	}
+}
+
+// StorageQuotaDatastore sets the datastore that the number of bytes stored for
+// each publisher is persisted in, so that the counts of StorageQuota remain
+// after a restart. If not set, the counts are only kept in memory.
+func StorageQuotaDatastore(ds datastore.Datastore) Option {
+	return func(c *config) error {
+		c.quotaDS = ds
+		return nil
+	}
+}
+
 // LatestSyncHandler defines how to store the latest synced cid for a given peer
 // and how to fetch it. Legs guarantees this will not be called concurrently for
 // the same peer, but it may be called concurrently for different peers.
@@ -173,8 +870,32 @@ type LatestSyncHandler interface {
 	GetLatestSync(peer peer.ID) (cid.Cid, bool)
 }
 
+// TopicLatestSyncHandler is a LatestSyncHandler that can also store the
+// latest synced cid for a given peer separately for each topic that the peer
+// publishes on. See: LatestSyncPerTopic.
+type TopicLatestSyncHandler interface {
+	LatestSyncHandler
+	SetTopicLatestSync(topic string, peer peer.ID, cid cid.Cid)
+	GetTopicLatestSync(topic string, peer peer.ID) (cid.Cid, bool)
+}
+
+// LatestSyncLister is a LatestSyncHandler that can list the peers it stores a
+// latest synced cid for. Subscriber.ExportState exports the latest sync of the
+// listed peers in addition to the peers that the Subscriber has handlers for.
+type LatestSyncLister interface {
+	LatestSyncHandler
+	LatestSyncPeers() []peer.ID
+}
+
 type DefaultLatestSyncHandler struct {
-	m sync.Map
+	m  sync.Map
+	tm sync.Map
+}
+
+// topicPeer identifies a peer publishing on a topic.
+type topicPeer struct {
+	topic string
+	peer  peer.ID
 }
 
 func (h *DefaultLatestSyncHandler) SetLatestSync(p peer.ID, c cid.Cid) {
@@ -190,6 +911,41 @@ func (h *DefaultLatestSyncHandler) GetLatestSync(p peer.ID) (cid.Cid, bool) {
 	return v.(cid.Cid), true
 }
 
+func (h *DefaultLatestSyncHandler) SetTopicLatestSync(topic string, p peer.ID, c cid.Cid) {
+	log.Infow("Updating latest sync", "cid", c, "peer", p, "topic", topic)
+	h.tm.Store(topicPeer{topic, p}, c)
+}
+
+func (h *DefaultLatestSyncHandler) GetTopicLatestSync(topic string, p peer.ID) (cid.Cid, bool) {
+	v, ok := h.tm.Load(topicPeer{topic, p})
+	if !ok {
+		return cid.Undef, false
+	}
+	return v.(cid.Cid), true
+}
+
+// LatestSyncPeers returns the peers that a latest sync is stored for, on any
+// topic.
+func (h *DefaultLatestSyncHandler) LatestSyncPeers() []peer.ID {
+	seen := make(map[peer.ID]struct{})
+	var peers []peer.ID
+	add := func(p peer.ID) {
+		if _, ok := seen[p]; !ok {
+			seen[p] = struct{}{}
+			peers = append(peers, p)
+		}
+	}
+	h.m.Range(func(k, _ interface{}) bool {
+		add(k.(peer.ID))
+		return true
+	})
+	h.tm.Range(func(k, _ interface{}) bool {
+		add(k.(topicPeer).peer)
+		return true
+	})
+	return peers
+}
+
 // UseLatestSyncHandler sets the latest sync handler to use.
 func UseLatestSyncHandler(h LatestSyncHandler) Option {
 	return func(c *config) error {
@@ -198,15 +954,49 @@ func UseLatestSyncHandler(h LatestSyncHandler) Option {
 	}
 }
 
+// LatestSyncPerTopic configures whether the latest sync is tracked separately
+// for each topic that a peer publishes on, or once for each peer. This matters
+// when Subscribers on different topics share a LatestSyncHandler. If enabled,
+// each Subscriber tracks the latest sync for the topic it is joined to, so a
+// peer's announcements on different topics are treated as separate feeds. If
+// disabled, announcements on any topic update the same latest sync for the
+// peer. The LatestSyncHandler must implement TopicLatestSyncHandler when this
+// is enabled. Disabled by default.
+//
+// When this is enabled for a handler that holds latest syncs stored per peer,
+// the latest sync of a peer that has none stored for the Subscriber's topic is
+// migrated to the topic the first time it is read.
+func LatestSyncPerTopic(enable bool) Option {
+	return func(c *config) error {
+		c.latestSyncPerTopic = enable
+		return nil
+	}
+}
+
 type syncCfg struct {
+	addrs              []multiaddr.Multiaddr
 	alwaysUpdateLatest bool
 	rateLimiter        *rate.Limiter
 	scopedBlockHook    BlockHookFunc
 	segDepthLimit      int64
+	stopAtLatestSync   bool
+
+	// source is what caused the sync. See: SyncFinished.Source.
+	source SyncSource
+	// trace records the sync. See: RecordSync.
+	trace *SyncTrace
 }
 
 type SyncOption func(*syncCfg)
 
+// syncSource sets what caused the sync, which is reported in its SyncFinished
+// event.
+func syncSource(source SyncSource) SyncOption {
+	return func(sc *syncCfg) {
+		sc.source = source
+	}
+}
+
 func AlwaysUpdateLatest() SyncOption {
 	return func(sc *syncCfg) {
 		sc.alwaysUpdateLatest = true
@@ -214,9 +1004,10 @@ func AlwaysUpdateLatest() SyncOption {
 }
 
 // ScopedBlockHook is the equivalent of BlockHook option but only applied to a
-// single sync. If not specified, the Subscriber BlockHook option is used
-// instead. Specifying the ScopedBlockHook will override the Subscriber level
-// BlockHook for the current sync.
+// single sync. If not specified, the publisher's block hook, or else the
+// Subscriber BlockHook option, is used instead. Specifying the ScopedBlockHook
+// will override the Subscriber level BlockHook and any publisher block hook
+// for the current sync.
 //
 // Note that calls to SegmentSyncActions from bloc hook will have no impact if
 // segmented sync is disabled. See: BlockHook, SegmentDepthLimit,
@@ -247,3 +1038,23 @@ func ScopedSegmentDepthLimit(depth int64) SyncOption {
 		sc.segDepthLimit = depth
 	}
 }
+
+// ScopedAddrs sets additional addresses to dial the peer at for a single sync,
+// such as addresses learned out-of-band. These are used along with any
+// address passed to Sync, and are added to the peerstore with a bounded TTL.
+func ScopedAddrs(addrs ...multiaddr.Multiaddr) SyncOption {
+	return func(sc *syncCfg) {
+		sc.addrs = append(sc.addrs, addrs...)
+	}
+}
+
+// StopAtLatestSync makes a sync that uses a caller-supplied selector stop at
+// the latest synced CID for the peer, in the same way as a sync that uses the
+// default selector. The stop condition is only added when the selector is a
+// recursive explore that does not already have a stop condition. This avoids
+// re-fetching data that is already synced when using a custom selector.
+func StopAtLatestSync() SyncOption {
+	return func(sc *syncCfg) {
+		sc.stopAtLatestSync = true
+	}
+}
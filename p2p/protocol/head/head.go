@@ -2,6 +2,7 @@ package head
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -14,13 +15,34 @@ import (
 	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
 	gostream "github.com/libp2p/go-libp2p-gostream"
+	ic "github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	peer "github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/multiformats/go-multiaddr"
 	multistream "github.com/multiformats/go-multistream"
 )
 
-const closeTimeout = 30 * time.Second
+const (
+	// ProtocolPrefix is the prefix of the protocol ID used to query the head
+	// CID published on a topic.
+	ProtocolPrefix = "/legs/head"
+	// ProtocolVersion is the version of the protocol used to query the head
+	// CID published on a topic.
+	ProtocolVersion = "0.0.1"
+	// MetadataProtocolVersion is the version of the protocol used to query the
+	// head CID published on a topic, together with the publisher's metadata.
+	MetadataProtocolVersion = "0.0.2"
+
+	// ProtocolGraphsync identifies publishers that serve their DAG over
+	// graphsync, in Metadata.Protocols.
+	ProtocolGraphsync = "graphsync"
+	// ProtocolHttp identifies publishers that serve their DAG over HTTP, in
+	// Metadata.Protocols.
+	ProtocolHttp = "http"
+
+	closeTimeout = 30 * time.Second
+)
 
 var log = logging.Logger("go-legs/head")
 
@@ -28,35 +50,168 @@ type Publisher struct {
 	rl     sync.RWMutex
 	root   cid.Cid
 	server *http.Server
+
+	// host and topic are those that the head is served on.
+	host  host.Host
+	topic string
+
+	addrs     func() []multiaddr.Multiaddr
+	privKey   ic.PrivKey
+	protocols []string
+
+	// seq and updated are the sequence number and time of the last root
+	// update, for the head record.
+	seq     uint64
+	updated time.Time
+}
+
+// Metadata is the response to a query with MetadataProtocolID. It describes
+// the head published on a topic, and how to sync from the publisher.
+type Metadata struct {
+	// Head is the head CID, or cid.Undef if no head is set.
+	Head cid.Cid
+	// Topic is the topic that the head is published on.
+	Topic string
+	// Addrs are the multiaddrs that the publisher is reachable at.
+	Addrs []multiaddr.Multiaddr
+	// Protocols are the sync protocols that the publisher serves its DAG over.
+	// They are unknown if the publisher only supports ProtocolID.
+	Protocols []string
+	// Signature is the publisher's signature of the topic and head, if the
+	// publisher signs its head. It is verified by QueryMetadata.
+	Signature []byte
+	// Record is the marshaled signed envelope of the publisher's HeadRecord,
+	// if the publisher signs its head. It is verified by QueryMetadata.
+	Record []byte
 }
 
-func NewPublisher() *Publisher {
+// metadataJSON is the JSON encoding of Metadata.
+type metadataJSON struct {
+	Head      cid.Cid  `json:"head"`
+	Topic     string   `json:"topic"`
+	Addrs     []string `json:"addrs,omitempty"`
+	Protocols []string `json:"protocols,omitempty"`
+	Signature []byte   `json:"signature,omitempty"`
+	Record    []byte   `json:"record,omitempty"`
+}
+
+func NewPublisher(options ...Option) *Publisher {
+	cfg := getOpts(options)
 	p := &Publisher{
 		server: &http.Server{},
+
+		addrs:     cfg.addrs,
+		privKey:   cfg.privKey,
+		protocols: cfg.protocols,
+
+		seq:     peer.TimestampSeq(),
+		updated: time.Now(),
 	}
 	p.server.Handler = http.Handler(p)
 	return p
 }
 
-func deriveProtocolID(topic string) protocol.ID {
-	return protocol.ID(path.Join("/legs/head", topic, "0.0.1"))
+// ProtocolID returns the libp2p protocol ID that the head CID published on
+// topic is served on.
+func ProtocolID(topic string) protocol.ID {
+	return protocol.ID(path.Join(ProtocolPrefix, topic, ProtocolVersion))
+}
+
+// LegacyProtocolID returns the protocol ID that was previously used to serve
+// the head CID published on topic. For topics that begin with "/", this
+// protocol ID contains a double slash. It is only used to query publishers
+// that have not upgraded to ProtocolID.
+func LegacyProtocolID(topic string) protocol.ID {
+	return protocol.ID(ProtocolPrefix + "/" + topic + "/" + ProtocolVersion)
+}
+
+// MetadataProtocolID returns the libp2p protocol ID that the head CID published
+// on topic is served on together with the publisher's metadata.
+func MetadataProtocolID(topic string) protocol.ID {
+	return protocol.ID(path.Join(ProtocolPrefix, topic, MetadataProtocolVersion))
 }
 
+// Serve serves the head CID published on topic, with both ProtocolID and
+// MetadataProtocolID, so that clients that do not support the metadata can
+// still query the head. It blocks until the Publisher is closed.
 func (p *Publisher) Serve(host host.Host, topic string) error {
-	pid := deriveProtocolID(topic)
-	l, err := gostream.Listen(host, pid)
+	l, ml, err := p.listen(host, topic)
 	if err != nil {
-		log.Errorw("Failed to listen to gostream with protocol", "host", host.ID(), "protocolID", pid)
 		return err
 	}
-	log.Infow("Serving gostream", "host", host.ID(), "protocolID", pid)
+	go p.serveMetadataListener(ml)
 	return p.server.Serve(l)
 }
 
-func QueryRootCid(ctx context.Context, host host.Host, topic string, peerID peer.ID) (cid.Cid, error) {
-	client := http.Client{
+// Start serves the head CID published on topic, the same as Serve, but returns
+// once the head can be queried instead of blocking. An error is returned if
+// the head cannot be served.
+func (p *Publisher) Start(host host.Host, topic string) error {
+	l, ml, err := p.listen(host, topic)
+	if err != nil {
+		return err
+	}
+	go p.serveMetadataListener(ml)
+	go func() {
+		if err := p.server.Serve(l); err != http.ErrServerClosed {
+			log.Errorw("Head publisher stopped serving on topic on host", "topic", topic, "host", host.ID(), "err", err)
+		}
+	}()
+	return nil
+}
+
+// listen returns listeners for ProtocolID and MetadataProtocolID of topic.
+func (p *Publisher) listen(host host.Host, topic string) (net.Listener, net.Listener, error) {
+	p.rl.Lock()
+	p.host = host
+	p.topic = topic
+	p.rl.Unlock()
+
+	mpid := MetadataProtocolID(topic)
+	ml, err := gostream.Listen(host, mpid)
+	if err != nil {
+		log.Errorw("Failed to listen to gostream with protocol", "host", host.ID(), "protocolID", mpid)
+		return nil, nil, err
+	}
+	pid := ProtocolID(topic)
+	l, err := gostream.Listen(host, pid)
+	if err != nil {
+		log.Errorw("Failed to listen to gostream with protocol", "host", host.ID(), "protocolID", pid)
+		ml.Close()
+		return nil, nil, err
+	}
+	log.Infow("Serving gostream", "host", host.ID(), "protocolID", pid, "metadataProtocolID", mpid)
+	return l, ml, nil
+}
+
+func (p *Publisher) serveMetadataListener(ml net.Listener) {
+	if err := p.server.Serve(ml); err != http.ErrServerClosed {
+		log.Errorw("Stopped serving head metadata", "err", err, "protocolID", ml.Addr())
+	}
+}
+
+// queryClient sends requests to a publisher over the first of a list of
+// protocol IDs that the publisher supports.
+type queryClient struct {
+	*http.Client
+	// matched is the protocol ID that the publisher supports, once the
+	// client has connected.
+	matched protocol.ID
+}
+
+// newClient returns a queryClient that sends requests to peerID over the first
+// of protoIDs that the peer supports. Connecting to the peer is limited to
+// dialTimeout, if it is not zero.
+func newClient(host host.Host, peerID peer.ID, dialTimeout time.Duration, protoIDs ...protocol.ID) *queryClient {
+	qc := &queryClient{}
+	qc.Client = &http.Client{
 		Transport: &http.Transport{
 			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if dialTimeout != 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, dialTimeout)
+					defer cancel()
+				}
 				addrInfo := peer.AddrInfo{
 					ID: peerID,
 				}
@@ -64,58 +219,233 @@ func QueryRootCid(ctx context.Context, host host.Host, topic string, peerID peer
 				if err != nil {
 					return nil, err
 				}
-				conn, err := gostream.Dial(ctx, host, peerID, deriveProtocolID(topic))
-				if err != nil {
-					// If protocol ID is wrong, then try the old "double-slashed" protocol ID.
-					//
-					// TODO: remove this code when all providers have upgraded.
-					if !errors.Is(err, multistream.ErrNotSupported) {
-						return nil, err
+				var conn net.Conn
+				for i, protoID := range protoIDs {
+					conn, err = gostream.Dial(ctx, host, peerID, protoID)
+					if err == nil {
+						if i != 0 {
+							log.Infow("Peer head CID server uses old protocol ID", "peer", peerID, "proto", protoID)
+						}
+						qc.matched = protoID
+						break
 					}
-					oldProtoID := protocol.ID("/legs/head/" + topic + "/0.0.1")
-					conn, err = gostream.Dial(ctx, host, peerID, oldProtoID)
-					if err != nil {
+					// If protocol ID is not supported, then try the next one.
+					if !errors.Is(err, multistream.ErrNotSupported) {
 						return nil, err
 					}
-					log.Infow("Peer head CID server uses old protocol ID", "peer", peerID, "proto", oldProtoID)
 				}
 				return conn, err
 			},
 		},
 	}
+	return qc
+}
+
+// QueryMetadata queries the head CID published on topic by peerID, together
+// with the publisher's metadata. If the publisher does not support
+// MetadataProtocolID, then only the head is queried, with QueryRootCid, and the
+// rest of the metadata is left empty.
+//
+// If the publisher signs its head, then the signature is verified with the
+// public key of peerID, and an error is returned if it does not match.
+//
+// The dial timeout option applies to both queries, and the protocol ID option
+// applies to the query of the head only.
+func QueryMetadata(ctx context.Context, host host.Host, topic string, peerID peer.ID, options ...QueryOption) (*Metadata, error) {
+	cfg := getQueryOpts(options)
+	client := newClient(host, peerID, cfg.dialTimeout, MetadataProtocolID(topic))
+	defer client.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://unused.invalid/metadata", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if !errors.Is(err, multistream.ErrNotSupported) {
+			return nil, err
+		}
+		log.Infow("Peer does not serve head metadata; querying head only", "peer", peerID)
+		head, err := QueryRootCid(ctx, host, topic, peerID, options...)
+		if err != nil {
+			return nil, err
+		}
+		return &Metadata{Head: head, Topic: topic}, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non success http code: %d", resp.StatusCode)
+	}
+
+	var mj metadataJSON
+	if err = json.NewDecoder(resp.Body).Decode(&mj); err != nil {
+		return nil, fmt.Errorf("cannot decode metadata: %w", err)
+	}
+	md := &Metadata{
+		Head:      mj.Head,
+		Topic:     mj.Topic,
+		Protocols: mj.Protocols,
+		Signature: mj.Signature,
+		Record:    mj.Record,
+	}
+	for _, a := range mj.Addrs {
+		maddr, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			return nil, fmt.Errorf("bad multiaddr %s in metadata: %w", a, err)
+		}
+		md.Addrs = append(md.Addrs, maddr)
+	}
+
+	if len(md.Signature) != 0 {
+		pubKey, err := peerID.ExtractPublicKey()
+		if err != nil {
+			pubKey = host.Peerstore().PubKey(peerID)
+			if pubKey == nil {
+				return nil, fmt.Errorf("cannot get public key of peer %s to verify head: %w", peerID, err)
+			}
+		}
+		ok, err := pubKey.Verify(signedData(md.Topic, md.Head), md.Signature)
+		if err != nil {
+			return nil, fmt.Errorf("cannot verify head signature: %w", err)
+		}
+		if !ok {
+			return nil, errors.New("invalid head signature")
+		}
+	}
+
+	if len(md.Record) != 0 {
+		if _, err = openPeerHeadRecord(md.Record, peerID, md.Topic); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Debugw("Sucessfully queried head metadata", "head", md.Head)
+	return md, nil
+}
+
+// QueryHeadRecord queries the HeadRecord published on topic by peerID, and
+// returns the record together with its marshaled signed envelope, which can be
+// cached and passed on to others. An error is returned if the record is not
+// signed by peerID or is for a different topic.
+func QueryHeadRecord(ctx context.Context, host host.Host, topic string, peerID peer.ID, options ...QueryOption) (*HeadRecord, []byte, error) {
+	cfg := getQueryOpts(options)
+	client := newClient(host, peerID, cfg.dialTimeout, MetadataProtocolID(topic))
+	defer client.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://unused.invalid/record", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("non success http code: %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot fully read response body: %w", err)
+	}
+	rec, err := openPeerHeadRecord(data, peerID, topic)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rec, data, nil
+}
+
+// openPeerHeadRecord opens a head record and checks that it is that of peerID
+// for topic.
+func openPeerHeadRecord(data []byte, peerID peer.ID, topic string) (*HeadRecord, error) {
+	rec, err := OpenHeadRecord(data)
+	if err != nil {
+		return nil, err
+	}
+	if rec.PeerID != peerID {
+		return nil, fmt.Errorf("head record is for peer %s, expected %s", rec.PeerID, peerID)
+	}
+	if rec.Topic != topic {
+		return nil, fmt.Errorf("head record is for topic %q, expected %q", rec.Topic, topic)
+	}
+	return rec, nil
+}
+
+// signedData returns the data that the publisher signs: the topic followed by
+// the head CID.
+func signedData(topic string, head cid.Cid) []byte {
+	data := []byte(topic)
+	if head != cid.Undef {
+		data = append(data, head.Bytes()...)
+	}
+	return data
+}
+
+// QueryRootCid queries the head CID published on topic by peerID. Returns
+// cid.Undef if the publisher has no head.
+func QueryRootCid(ctx context.Context, host host.Host, topic string, peerID peer.ID, options ...QueryOption) (cid.Cid, error) {
+	c, _, err := QueryRootCidProtocol(ctx, host, topic, peerID, options...)
+	return c, err
+}
+
+// QueryRootCidProtocol queries the head CID published on topic by peerID, the
+// same as QueryRootCid, and also returns the protocol ID that the publisher
+// served the head with. By default, ProtocolID is tried first, and then
+// LegacyProtocolID, so that publishers that have not upgraded can be queried.
+func QueryRootCidProtocol(ctx context.Context, host host.Host, topic string, peerID peer.ID, options ...QueryOption) (cid.Cid, protocol.ID, error) {
+	cfg := getQueryOpts(options)
+	protoIDs := cfg.protocolIDs
+	if len(protoIDs) == 0 {
+		// TODO: remove the legacy protocol ID when all providers have upgraded.
+		protoIDs = []protocol.ID{ProtocolID(topic), LegacyProtocolID(topic)}
+	}
+	client := newClient(host, peerID, cfg.dialTimeout, protoIDs...)
+	defer client.CloseIdleConnections()
 
 	// The httpclient expects there to be a host here. `.invalid` is a reserved
 	// TLD for this purpose. See
 	// https://datatracker.ietf.org/doc/html/rfc2606#section-2
-	resp, err := client.Get("http://unused.invalid/head")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://unused.invalid/head", nil)
+	if err != nil {
+		return cid.Undef, "", err
+	}
+	resp, err := client.Do(req)
 	if err != nil {
-		return cid.Undef, err
+		return cid.Undef, "", err
 	}
 	defer resp.Body.Close()
 
 	cidStr, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return cid.Undef, fmt.Errorf("cannot fully read response body: %w", err)
+		return cid.Undef, "", fmt.Errorf("cannot fully read response body: %w", err)
 	}
 	if len(cidStr) == 0 {
 		log.Debug("No head is set; returning cid.Undef")
-		return cid.Undef, nil
+		return cid.Undef, client.matched, nil
 	}
 
 	cs := string(cidStr)
 	decode, err := cid.Decode(cs)
 	if err != nil {
-		return cid.Undef, fmt.Errorf("failed to decode CID %s: %w", cs, err)
+		return cid.Undef, "", fmt.Errorf("failed to decode CID %s: %w", cs, err)
 	}
 
-	log.Debugw("Sucessfully queried latest head", "head", decode)
-	return decode, nil
+	log.Debugw("Sucessfully queried latest head", "head", decode, "protocolID", client.matched)
+	return decode, client.matched, nil
 }
 
 func (p *Publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	base := path.Base(r.URL.Path)
+	switch base {
+	case "metadata":
+		p.serveMetadata(w)
+		return
+	case "record":
+		p.serveRecord(w)
+		return
+	}
 	if base != "head" {
-		log.Debug("Only head is supported; rejecting request with different base path")
+		log.Debug("Only head, metadata and record are supported; rejecting request with different base path")
 		http.Error(w, "", http.StatusNotFound)
 		return
 	}
@@ -137,13 +467,119 @@ func (p *Publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (p *Publisher) UpdateRoot(_ context.Context, c cid.Cid) error {
+// serveMetadata responds with the publisher's metadata as JSON.
+func (p *Publisher) serveMetadata(w http.ResponseWriter) {
+	p.rl.RLock()
+	mj := metadataJSON{
+		Head:      p.root,
+		Topic:     p.topic,
+		Protocols: p.protocols,
+	}
+	rec := p.headRecord()
+	addrsFunc := p.addrs
+	if addrsFunc == nil && p.host != nil {
+		addrsFunc = p.host.Addrs
+	}
+	p.rl.RUnlock()
+
+	if addrsFunc != nil {
+		for _, a := range addrsFunc() {
+			mj.Addrs = append(mj.Addrs, a.String())
+		}
+	}
+	if p.privKey != nil {
+		sig, err := p.privKey.Sign(signedData(mj.Topic, mj.Head))
+		if err != nil {
+			log.Errorw("Failed to sign head", "err", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		mj.Signature = sig
+	}
+	if rec != nil {
+		var err error
+		if mj.Record, err = SealHeadRecord(rec, p.privKey); err != nil {
+			log.Errorw("Failed to seal head record", "err", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(mj); err != nil {
+		log.Errorw("Failed to write response", "err", err)
+	}
+}
+
+// headRecord returns the HeadRecord of the current root, or nil if the head is
+// not signed. The read lock must be held.
+func (p *Publisher) headRecord() *HeadRecord {
+	if p.privKey == nil {
+		return nil
+	}
+	peerID, err := peer.IDFromPrivateKey(p.privKey)
+	if err != nil {
+		log.Errorw("Cannot get peer id of signing key", "err", err)
+		return nil
+	}
+	return &HeadRecord{
+		PeerID:    peerID,
+		Topic:     p.topic,
+		Head:      p.root,
+		Seq:       p.seq,
+		Timestamp: p.updated,
+	}
+}
+
+// serveRecord responds with the signed envelope of the publisher's HeadRecord.
+func (p *Publisher) serveRecord(w http.ResponseWriter) {
+	p.rl.RLock()
+	rec := p.headRecord()
+	p.rl.RUnlock()
+	if rec == nil {
+		log.Debug("Head is not signed; rejecting request for head record")
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+	data, err := SealHeadRecord(rec, p.privKey)
+	if err != nil {
+		log.Errorw("Failed to seal head record", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err = w.Write(data); err != nil {
+		log.Errorw("Failed to write response", "err", err)
+	}
+}
+
+// UpdateRoot sets the head CID that is served. It is the same as SetRoot.
+func (p *Publisher) UpdateRoot(ctx context.Context, c cid.Cid) error {
+	return p.SetRoot(ctx, c)
+}
+
+// SetRoot sets the head CID that is served, and updates the head record.
+func (p *Publisher) SetRoot(_ context.Context, c cid.Cid) error {
 	p.rl.Lock()
 	defer p.rl.Unlock()
 	p.root = c
+	// The sequence number increases with each update, and is at least the
+	// current time, so that it also increases across restarts.
+	p.seq++
+	if ts := peer.TimestampSeq(); ts > p.seq {
+		p.seq = ts
+	}
+	p.updated = time.Now()
 	return nil
 }
 
+// Root returns the current root CID, or cid.Undef if no root is set.
+func (p *Publisher) Root() cid.Cid {
+	p.rl.RLock()
+	defer p.rl.RUnlock()
+	return p.root
+}
+
 func (p *Publisher) Close() error {
 	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
 	defer cancel()
@@ -2,6 +2,7 @@ package head_test
 
 import (
 	"context"
+	"net/http"
 	"strings"
 	"testing"
 	"time"
@@ -15,6 +16,7 @@ import (
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/ipld/go-ipld-prime/node/basicnode"
 	"github.com/libp2p/go-libp2p"
+	gostream "github.com/libp2p/go-libp2p-gostream"
 	"github.com/multiformats/go-multiaddr"
 )
 
@@ -73,3 +75,184 @@ func TestFetchLatestHead(t *testing.T) {
 		t.Fatalf("didn't get expected cid. expected %s, got %s", rootLnk, c)
 	}
 }
+
+func TestQueryMetadata(t *testing.T) {
+	publisher, _ := libp2p.New()
+	client, _ := libp2p.New()
+	client.Peerstore().AddAddrs(publisher.ID(), publisher.Addrs(), time.Hour)
+
+	publisherStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	rootLnk, err := test.Store(publisherStore, basicnode.NewString("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCid := rootLnk.(cidlink.Link).Cid
+
+	p := head.NewPublisher(
+		head.WithProtocols(head.ProtocolGraphsync, head.ProtocolHttp),
+		head.WithSigningKey(publisher.Peerstore().PrivKey(publisher.ID())))
+	go p.Serve(publisher, "test")
+	defer p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	md, err := head.QueryMetadata(ctx, client, "test", publisher.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Head != cid.Undef {
+		t.Fatalf("Expected undefined head, got %s", md.Head)
+	}
+
+	if err = p.UpdateRoot(ctx, rootCid); err != nil {
+		t.Fatal(err)
+	}
+	md, err = head.QueryMetadata(ctx, client, "test", publisher.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !md.Head.Equals(rootCid) {
+		t.Fatalf("didn't get expected cid. expected %s, got %s", rootCid, md.Head)
+	}
+	if md.Topic != "test" {
+		t.Fatalf("Unexpected topic %q", md.Topic)
+	}
+	if len(md.Protocols) != 2 || md.Protocols[0] != head.ProtocolGraphsync || md.Protocols[1] != head.ProtocolHttp {
+		t.Fatalf("Unexpected protocols %v", md.Protocols)
+	}
+	if len(md.Addrs) != len(publisher.Addrs()) {
+		t.Fatalf("Expected addrs %v, got %v", publisher.Addrs(), md.Addrs)
+	}
+	if len(md.Signature) == 0 {
+		t.Fatal("Expected signed head")
+	}
+
+	// Old clients can still query the head.
+	c, err := head.QueryRootCid(ctx, client, "test", publisher.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Equals(rootCid) {
+		t.Fatalf("didn't get expected cid. expected %s, got %s", rootCid, c)
+	}
+}
+
+func TestQueryMetadataBadSignature(t *testing.T) {
+	publisher, _ := libp2p.New()
+	client, _ := libp2p.New()
+	other, _ := libp2p.New()
+	client.Peerstore().AddAddrs(publisher.ID(), publisher.Addrs(), time.Hour)
+
+	p := head.NewPublisher(head.WithSigningKey(other.Peerstore().PrivKey(other.ID())))
+	go p.Serve(publisher, "test")
+	defer p.Close()
+
+	if _, err := head.QueryMetadata(context.Background(), client, "test", publisher.ID()); err == nil {
+		t.Fatal("Expected error for head signed by another peer")
+	}
+}
+
+func TestQueryMetadataFromOldPublisher(t *testing.T) {
+	publisher, _ := libp2p.New()
+	client, _ := libp2p.New()
+	client.Peerstore().AddAddrs(publisher.ID(), publisher.Addrs(), time.Hour)
+
+	publisherStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	rootLnk, err := test.Store(publisherStore, basicnode.NewString("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCid := rootLnk.(cidlink.Link).Cid
+
+	// Serve the head only with the original protocol ID.
+	p := head.NewPublisher()
+	if err = p.UpdateRoot(context.Background(), rootCid); err != nil {
+		t.Fatal(err)
+	}
+	l, err := gostream.Listen(publisher, head.ProtocolID("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: p}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	md, err := head.QueryMetadata(context.Background(), client, "test", publisher.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !md.Head.Equals(rootCid) {
+		t.Fatalf("didn't get expected cid. expected %s, got %s", rootCid, md.Head)
+	}
+	if md.Topic != "test" || len(md.Protocols) != 0 {
+		t.Fatalf("Unexpected metadata from old publisher: %+v", md)
+	}
+}
+
+func TestQueryRootCidProtocol(t *testing.T) {
+	publisher, _ := libp2p.New()
+	client, _ := libp2p.New()
+	client.Peerstore().AddAddrs(publisher.ID(), publisher.Addrs(), time.Hour)
+
+	publisherStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	rootLnk, err := test.Store(publisherStore, basicnode.NewString("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCid := rootLnk.(cidlink.Link).Cid
+
+	// Serve the head only with the legacy protocol ID, as older publishers do.
+	p := head.NewPublisher()
+	if err = p.UpdateRoot(context.Background(), rootCid); err != nil {
+		t.Fatal(err)
+	}
+	legacyID := head.LegacyProtocolID("/test")
+	l, err := gostream.Listen(publisher, legacyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: p}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	ctx := context.Background()
+	c, protoID, err := head.QueryRootCidProtocol(ctx, client, "/test", publisher.ID(), head.WithDialTimeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Equals(rootCid) {
+		t.Fatalf("didn't get expected cid. expected %s, got %s", rootCid, c)
+	}
+	if protoID != legacyID {
+		t.Fatalf("Expected protocol ID %q, got %q", legacyID, protoID)
+	}
+
+	// Only the given protocol IDs are tried.
+	_, _, err = head.QueryRootCidProtocol(ctx, client, "/test", publisher.ID(), head.WithProtocolIDs(head.ProtocolID("/test")))
+	if err == nil {
+		t.Fatal("Expected error querying with unsupported protocol ID")
+	}
+}
+
+func TestQueryRootCidDialTimeout(t *testing.T) {
+	client, _ := libp2p.New()
+	unreachable, _ := libp2p.New()
+	unreachableID := unreachable.ID()
+	unreachable.Close()
+	// Blackhole address, so that the dial does not fail fast.
+	addr, err := multiaddr.NewMultiaddr("/ip4/192.0.2.1/tcp/9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Peerstore().AddAddr(unreachableID, addr, time.Hour)
+
+	start := time.Now()
+	_, err = head.QueryRootCid(context.Background(), client, "test", unreachableID, head.WithDialTimeout(100*time.Millisecond))
+	if err == nil {
+		t.Fatal("Expected error querying unreachable peer")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Query took %s; dial timeout not applied", elapsed)
+	}
+}
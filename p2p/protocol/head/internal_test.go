@@ -5,9 +5,15 @@ import (
 	"testing"
 )
 
-func TestDeriveProtocolID(t *testing.T) {
-	protoID := deriveProtocolID("/mainnet")
+func TestProtocolID(t *testing.T) {
+	protoID := ProtocolID("/mainnet")
 	if strings.Contains(string(protoID), "//") {
 		t.Fatalf("Derived protocol ID %q should not contain \"//\"", protoID)
 	}
+	if protoID != "/legs/head/mainnet/0.0.1" {
+		t.Fatalf("Unexpected protocol ID %q", protoID)
+	}
+	if LegacyProtocolID("/mainnet") != "/legs/head//mainnet/0.0.1" {
+		t.Fatalf("Unexpected legacy protocol ID %q", LegacyProtocolID("/mainnet"))
+	}
 }
@@ -0,0 +1,94 @@
+package head
+
+import (
+	"time"
+
+	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// config contains all options for configuring Publisher.
+type config struct {
+	addrs     func() []multiaddr.Multiaddr
+	privKey   ic.PrivKey
+	protocols []string
+}
+
+// Option is a function that sets a value in a config.
+type Option func(*config)
+
+// getOpts creates a config and applies Options to it.
+func getOpts(opts []Option) config {
+	var cfg config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// WithAddrs sets a function that returns the multiaddrs to report in the
+// publisher's metadata. By default, the addresses of the host that the head is
+// served on are reported.
+func WithAddrs(addrs func() []multiaddr.Multiaddr) Option {
+	return func(c *config) {
+		c.addrs = addrs
+	}
+}
+
+// WithProtocols sets the sync protocols, such as ProtocolGraphsync and
+// ProtocolHttp, that the publisher serves its DAG over, to report in its
+// metadata.
+func WithProtocols(protocols ...string) Option {
+	return func(c *config) {
+		c.protocols = protocols
+	}
+}
+
+// WithSigningKey sets the private key that the head CID in the publisher's
+// metadata is signed with. The key must be that of the host that the head is
+// served on, so that clients can verify the signature. The head is not signed
+// by default.
+func WithSigningKey(privKey ic.PrivKey) Option {
+	return func(c *config) {
+		c.privKey = privKey
+	}
+}
+
+// queryConfig contains all options for querying a publisher's head.
+type queryConfig struct {
+	dialTimeout time.Duration
+	protocolIDs []protocol.ID
+}
+
+// QueryOption is a function that sets a value in a queryConfig.
+type QueryOption func(*queryConfig)
+
+// getQueryOpts creates a queryConfig and applies QueryOptions to it.
+func getQueryOpts(opts []QueryOption) queryConfig {
+	var cfg queryConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// WithDialTimeout sets the time allowed to connect to the publisher and open a
+// stream with it, separately from the time allowed for the whole query by its
+// context. A zero timeout, the default, means there is no separate limit.
+func WithDialTimeout(timeout time.Duration) QueryOption {
+	return func(c *queryConfig) {
+		c.dialTimeout = timeout
+	}
+}
+
+// WithProtocolIDs sets the protocol IDs to query the head with, in order of
+// preference. The first one that the publisher supports is used. This allows
+// querying publishers that serve the head with protocol IDs derived
+// differently, such as by older versions. By default, ProtocolID and then
+// LegacyProtocolID of the topic are tried.
+func WithProtocolIDs(protoIDs ...protocol.ID) QueryOption {
+	return func(c *queryConfig) {
+		c.protocolIDs = protoIDs
+	}
+}
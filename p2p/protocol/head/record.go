@@ -0,0 +1,198 @@
+package head
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+)
+
+const (
+	// HeadRecordEnvelopeDomain is the domain string used for head records
+	// contained in a libp2p signed envelope.
+	HeadRecordEnvelopeDomain = "legs-head-record"
+	// headRecordPayloadType is the payload type of head records contained in
+	// a libp2p signed envelope.
+	headRecordPayloadType = "/legs/head-record"
+)
+
+// ErrStaleHeadRecord is returned when a head record is not newer than the
+// record already known for the same publisher and topic.
+var ErrStaleHeadRecord = errors.New("stale head record")
+
+func init() {
+	record.RegisterType(&HeadRecord{})
+}
+
+// HeadRecord is the head published on a topic, signed by the publisher in a
+// libp2p signed envelope. Since the envelope can be verified by anyone, the
+// record can be cached and passed on by peers other than the publisher. Of two
+// records from the same publisher and topic, the one with the higher Seq is the
+// most recent.
+type HeadRecord struct {
+	// PeerID is the publisher. It must match the key that signed the record.
+	PeerID peer.ID
+	// Topic is the topic that the head is published on.
+	Topic string
+	// Head is the head CID, or cid.Undef if no head is set.
+	Head cid.Cid
+	// Seq increases with each update of the head.
+	Seq uint64
+	// Timestamp is when the head was updated.
+	Timestamp time.Time
+}
+
+var _ record.Record = (*HeadRecord)(nil)
+
+// headRecordJSON is the JSON encoding of HeadRecord.
+type headRecordJSON struct {
+	PeerID    string  `json:"peerID"`
+	Topic     string  `json:"topic"`
+	Head      cid.Cid `json:"head"`
+	Seq       uint64  `json:"seq"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+// Domain is used when signing and validating HeadRecords contained in
+// envelopes.
+func (r *HeadRecord) Domain() string {
+	return HeadRecordEnvelopeDomain
+}
+
+// Codec is the payload type of HeadRecords contained in envelopes.
+func (r *HeadRecord) Codec() []byte {
+	return []byte(headRecordPayloadType)
+}
+
+// MarshalRecord serializes the HeadRecord as JSON.
+func (r *HeadRecord) MarshalRecord() ([]byte, error) {
+	return json.Marshal(headRecordJSON{
+		PeerID:    r.PeerID.String(),
+		Topic:     r.Topic,
+		Head:      r.Head,
+		Seq:       r.Seq,
+		Timestamp: r.Timestamp.UnixNano(),
+	})
+}
+
+// UnmarshalRecord parses a HeadRecord serialized by MarshalRecord.
+func (r *HeadRecord) UnmarshalRecord(data []byte) error {
+	var rj headRecordJSON
+	if err := json.Unmarshal(data, &rj); err != nil {
+		return err
+	}
+	peerID, err := peer.Decode(rj.PeerID)
+	if err != nil {
+		return fmt.Errorf("bad peer id in head record: %w", err)
+	}
+	*r = HeadRecord{
+		PeerID:    peerID,
+		Topic:     rj.Topic,
+		Head:      rj.Head,
+		Seq:       rj.Seq,
+		Timestamp: time.Unix(0, rj.Timestamp),
+	}
+	return nil
+}
+
+// SealHeadRecord signs the record with privKey, which must be the key of the
+// record's peer, and returns the marshaled envelope.
+func SealHeadRecord(rec *HeadRecord, privKey ic.PrivKey) ([]byte, error) {
+	peerID, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+	if peerID != rec.PeerID {
+		return nil, fmt.Errorf("signing key does not match record peer %s", rec.PeerID)
+	}
+	env, err := record.Seal(rec, privKey)
+	if err != nil {
+		return nil, err
+	}
+	return env.Marshal()
+}
+
+// OpenHeadRecord verifies a marshaled envelope containing a HeadRecord, and
+// returns the record. An error is returned if the envelope is not signed by
+// the record's peer.
+func OpenHeadRecord(data []byte) (*HeadRecord, error) {
+	var rec HeadRecord
+	env, err := record.ConsumeTypedEnvelope(data, &rec)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open head record: %w", err)
+	}
+	signer, err := peer.IDFromPublicKey(env.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if signer != rec.PeerID {
+		return nil, fmt.Errorf("head record for peer %s signed by peer %s", rec.PeerID, signer)
+	}
+	return &rec, nil
+}
+
+// HeadRecordCache keeps the latest head record of each publisher and topic,
+// so that records can be cached and passed on, and stale records rejected.
+type HeadRecordCache struct {
+	records map[headRecordKey]cachedHeadRecord
+	mutex   sync.Mutex
+}
+
+type headRecordKey struct {
+	peerID peer.ID
+	topic  string
+}
+
+type cachedHeadRecord struct {
+	rec  *HeadRecord
+	data []byte
+}
+
+// NewHeadRecordCache creates an empty HeadRecordCache.
+func NewHeadRecordCache() *HeadRecordCache {
+	return &HeadRecordCache{
+		records: make(map[headRecordKey]cachedHeadRecord),
+	}
+}
+
+// Put verifies the marshaled envelope of a head record and caches it, if it is
+// newer than the record cached for the same publisher and topic. Returns the
+// record, or ErrStaleHeadRecord if its sequence number is not higher than that
+// of the cached record.
+func (c *HeadRecordCache) Put(data []byte) (*HeadRecord, error) {
+	rec, err := OpenHeadRecord(data)
+	if err != nil {
+		return nil, err
+	}
+	key := headRecordKey{rec.PeerID, rec.Topic}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if cached, ok := c.records[key]; ok && rec.Seq <= cached.rec.Seq {
+		return nil, ErrStaleHeadRecord
+	}
+	c.records[key] = cachedHeadRecord{
+		rec:  rec,
+		data: data,
+	}
+	return rec, nil
+}
+
+// Get returns the cached record of the publisher and topic, and its marshaled
+// envelope, which can be passed on to others. Returns nil if no record is
+// cached.
+func (c *HeadRecordCache) Get(peerID peer.ID, topic string) (*HeadRecord, []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cached, ok := c.records[headRecordKey{peerID, topic}]
+	if !ok {
+		return nil, nil
+	}
+	return cached.rec, cached.data
+}
@@ -0,0 +1,87 @@
+package head_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs/p2p/protocol/head"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/libp2p/go-libp2p"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeadRecord(t *testing.T) {
+	publisher, err := libp2p.New()
+	require.NoError(t, err)
+	client, err := libp2p.New()
+	require.NoError(t, err)
+	client.Peerstore().AddAddrs(publisher.ID(), publisher.Addrs(), time.Hour)
+
+	cids, err := test.RandomCids(2)
+	require.NoError(t, err)
+
+	p := head.NewPublisher(head.WithSigningKey(publisher.Peerstore().PrivKey(publisher.ID())))
+	require.NoError(t, p.Start(publisher, "test"))
+	defer p.Close()
+
+	ctx := context.Background()
+	cache := head.NewHeadRecordCache()
+
+	require.NoError(t, p.UpdateRoot(ctx, cids[0]))
+	rec1, data1, err := head.QueryHeadRecord(ctx, client, "test", publisher.ID())
+	require.NoError(t, err)
+	require.Equal(t, publisher.ID(), rec1.PeerID)
+	require.Equal(t, "test", rec1.Topic)
+	require.Equal(t, cids[0], rec1.Head)
+	_, err = cache.Put(data1)
+	require.NoError(t, err)
+
+	require.NoError(t, p.UpdateRoot(ctx, cids[1]))
+	md, err := head.QueryMetadata(ctx, client, "test", publisher.ID())
+	require.NoError(t, err)
+	rec2, err := cache.Put(md.Record)
+	require.NoError(t, err)
+	require.Equal(t, cids[1], rec2.Head)
+	require.Greater(t, rec2.Seq, rec1.Seq)
+
+	// An older record is rejected, and the newer one stays cached.
+	_, err = cache.Put(data1)
+	require.ErrorIs(t, err, head.ErrStaleHeadRecord)
+	cached, cachedData := cache.Get(publisher.ID(), "test")
+	require.Equal(t, rec2, cached)
+	require.Equal(t, md.Record, cachedData)
+	cached, _ = cache.Get(client.ID(), "test")
+	require.Nil(t, cached)
+}
+
+func TestHeadRecordSignedByOtherPeer(t *testing.T) {
+	publisher, err := libp2p.New()
+	require.NoError(t, err)
+	other, err := libp2p.New()
+	require.NoError(t, err)
+
+	cids, err := test.RandomCids(1)
+	require.NoError(t, err)
+	rec := &head.HeadRecord{
+		PeerID:    publisher.ID(),
+		Topic:     "test",
+		Head:      cids[0],
+		Seq:       1,
+		Timestamp: time.Now(),
+	}
+	_, err = head.SealHeadRecord(rec, other.Peerstore().PrivKey(other.ID()))
+	require.Error(t, err)
+
+	data, err := head.SealHeadRecord(rec, publisher.Peerstore().PrivKey(publisher.ID()))
+	require.NoError(t, err)
+	opened, err := head.OpenHeadRecord(data)
+	require.NoError(t, err)
+	require.Equal(t, rec.Head, opened.Head)
+	require.True(t, rec.Timestamp.Equal(opened.Timestamp))
+
+	// A tampered record is rejected.
+	data[len(data)-1] ^= 0xff
+	_, err = head.OpenHeadRecord(data)
+	require.Error(t, err)
+}
@@ -0,0 +1,148 @@
+package legs
+
+import (
+	"context"
+
+	"github.com/filecoin-project/go-legs/metrics"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Pause stops the Subscriber from starting syncs of announcements, until
+// Resume is called. Syncs that are in progress are allowed to finish.
+// Announcements that arrive while paused are still received and recorded, and
+// the latest announcement from each publisher is synced when syncing is
+// resumed. Syncs started by Sync are not paused.
+//
+// This is useful during maintenance, or when the consumer of synced data is
+// overloaded. See PublisherHandler.Pause to pause syncing with a single
+// publisher.
+func (s *Subscriber) Pause() {
+	s.pauseMutex.Lock()
+	defer s.pauseMutex.Unlock()
+	if s.resumed == nil {
+		s.resumed = make(chan struct{})
+		log.Info("Paused syncing of announcements")
+	}
+}
+
+// Resume resumes syncing of announcements that was stopped by Pause.
+func (s *Subscriber) Resume() {
+	s.pauseMutex.Lock()
+	defer s.pauseMutex.Unlock()
+	if s.resumed != nil {
+		close(s.resumed)
+		s.resumed = nil
+		log.Info("Resumed syncing of announcements")
+	}
+}
+
+// Paused returns true if syncing of announcements is paused by Pause.
+func (s *Subscriber) Paused() bool {
+	s.pauseMutex.Lock()
+	defer s.pauseMutex.Unlock()
+	return s.resumed != nil
+}
+
+// waitResumed waits until syncing with the publisher is not paused, either
+// for all publishers, or for the publisher alone. Returns an error if ctx is
+// canceled first.
+func (s *Subscriber) waitResumed(ctx context.Context, peerID peer.ID) error {
+	for {
+		s.pauseMutex.Lock()
+		resumed := s.resumed
+		s.pauseMutex.Unlock()
+		if resumed == nil {
+			pc, ok := s.pubConfigFor(peerID)
+			if !ok || pc.resumed == nil {
+				return nil
+			}
+			resumed = pc.resumed
+		}
+		log.Infow("Waiting for paused syncing to be resumed", "publisher", peerID)
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// SyncPaused notifies an OnSyncPaused reader that the data transfer of a
+// graphsync sync was paused or resumed.
+type SyncPaused struct {
+	// Cid is the CID that the paused transfer was opened for.
+	Cid cid.Cid
+	// PeerID identifies the publisher that is synced with.
+	PeerID peer.ID
+	// Paused is true if the transfer was paused, and false if it was resumed.
+	Paused bool
+	// RateLimited is true if the transfer was paused or resumed by the rate
+	// limiter, and false if by PauseTransfer or ResumeTransfer. See:
+	// DtPauseOnRateLimit.
+	RateLimited bool
+}
+
+// PauseTransfer pauses the data transfer of the graphsync sync in progress
+// with the publisher. The data channel stays open, and no blocks are sent
+// again when the transfer is resumed with ResumeTransfer. Returns an error if
+// no graphsync transfer with the publisher is in progress. Http syncs cannot
+// be paused.
+func (s *Subscriber) PauseTransfer(ctx context.Context, peerID peer.ID) error {
+	return s.dtSync.PauseTransfer(ctx, peerID)
+}
+
+// ResumeTransfer resumes the data transfer of the graphsync sync in progress
+// with the publisher, that was paused by PauseTransfer. A pause takes effect
+// when the block being transferred has been received, so a transfer must not
+// be resumed before it has had time to pause.
+func (s *Subscriber) ResumeTransfer(ctx context.Context, peerID peer.ID) error {
+	return s.dtSync.ResumeTransfer(ctx, peerID)
+}
+
+// OnSyncPaused creates a channel that receives a SyncPaused each time the data
+// transfer of a graphsync sync is paused or resumed.
+//
+// Calling the returned cancel function removes the notification channel from
+// the list of channels to be notified, and it closes the channel to allow any
+// reading goroutines to stop waiting on the channel. See OnSyncFinished for
+// the WatchOption values.
+func (s *Subscriber) OnSyncPaused(opts ...WatchOption) (<-chan SyncPaused, context.CancelFunc) {
+	w := newWatchChan[SyncPaused](opts)
+	ch := w.ch
+	s.outEventsMutex.Lock()
+	defer s.outEventsMutex.Unlock()
+
+	s.pauseEventsChans = append(s.pauseEventsChans, w)
+	cncl := func() {
+		s.outEventsMutex.Lock()
+		defer s.outEventsMutex.Unlock()
+		for i, ca := range s.pauseEventsChans {
+			if ca.ch == ch {
+				s.pauseEventsChans[i] = s.pauseEventsChans[len(s.pauseEventsChans)-1]
+				s.pauseEventsChans[len(s.pauseEventsChans)-1] = watchChan[SyncPaused]{}
+				s.pauseEventsChans = s.pauseEventsChans[:len(s.pauseEventsChans)-1]
+				close(ch)
+				break
+			}
+		}
+	}
+	return ch, cncl
+}
+
+// reportPause sends a SyncPaused to all OnSyncPaused channels.
+func (s *Subscriber) reportPause(peerID peer.ID, c cid.Cid, paused, rateLimited bool) {
+	event := SyncPaused{
+		Cid:         c,
+		PeerID:      peerID,
+		Paused:      paused,
+		RateLimited: rateLimited,
+	}
+	s.outEventsMutex.Lock()
+	defer s.outEventsMutex.Unlock()
+	for _, w := range s.pauseEventsChans {
+		if dropped := w.send(event); dropped != 0 {
+			s.metrics.EventsDropped(metrics.EventSyncPaused, dropped)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package legs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	selectorbuilder "github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ProbeResult describes how the head of a publisher compares with the latest
+// sync with the publisher. See: Subscriber.Probe.
+type ProbeResult struct {
+	// Head is the publisher's current head, or cid.Undef if the publisher
+	// has no head.
+	Head cid.Cid
+	// LatestSync is the latest sync with the publisher, or cid.Undef if there
+	// is none.
+	LatestSync cid.Cid
+	// NeedsSync is true if the publisher has a head that differs from the
+	// latest sync.
+	NeedsSync bool
+	// Behind is the number of chain nodes from Head back to, and not
+	// including, LatestSync, counted by walking the chain up to the limit
+	// given to Probe.
+	Behind int
+	// BehindExact is true if Behind is the exact number of new chain nodes.
+	// It is false if the walk reached its limit, or found a node that could
+	// not be fetched, before it reached LatestSync or the end of the chain.
+	BehindExact bool
+}
+
+// Probe queries the head of the publisher identified by peerID and compares it
+// with the latest sync with the publisher, without syncing. This is a cheap way
+// to tell whether a sync is needed.
+//
+// If limit is greater than zero, then Probe also estimates how far behind the
+// latest sync is, by walking the publisher's chain from its head, following
+// the link at prevPath in each node, such as "PreviousID" for an advertisement
+// chain. Only the chain nodes are fetched, one at a time, and at most limit of
+// them. Nodes that are already stored are not fetched. Fetched nodes are not
+// stored, no block hook is called, and no Subscriber state is changed.
+//
+// Only the ScopedAddrs and ScopedRateLimiter sync options apply.
+func (s *Subscriber) Probe(ctx context.Context, peerID peer.ID, prevPath string, limit int, opts ...SyncOption) (*ProbeResult, error) {
+	cfg := &syncCfg{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	if peerID == "" {
+		return nil, errors.New("empty peer id")
+	}
+
+	probe := newProbeLinkSystem(s.linkSystemFor(peerID))
+	syncer, _, err := s.makeSyncer(peerID, cfg.addrs, tempAddrTTL, cfg.rateLimiter, &probe.lsys)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := syncer.GetHead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query head for probe: %w", err)
+	}
+	latestSync, _ := s.getLatestSync(peerID)
+	result := &ProbeResult{
+		Head:        head,
+		LatestSync:  latestSync,
+		NeedsSync:   head != cid.Undef && head != latestSync,
+		BehindExact: true,
+	}
+	if !result.NeedsSync || limit < 1 {
+		result.BehindExact = !result.NeedsSync
+		return result, nil
+	}
+
+	hnd, err := s.getOrCreateHandler(peerID)
+	if err != nil {
+		return nil, err
+	}
+	// Hold the sync lock, so that the fetched chain nodes are not reported to
+	// any block hook.
+	hnd.syncMutex.Lock()
+	defer hnd.syncMutex.Unlock()
+	s.scopedBlockHookMutex.Lock()
+	s.scopedBlockHook[peerID] = func(peer.ID, cid.Cid, bool) {}
+	s.scopedBlockHookMutex.Unlock()
+	defer func() {
+		s.scopedBlockHookMutex.Lock()
+		delete(s.scopedBlockHook, peerID)
+		s.scopedBlockHookMutex.Unlock()
+	}()
+
+	walker := &chainWalker{
+		prevPath: datamodel.ParsePath(prevPath),
+	}
+	sel := selectorbuilder.NewSelectorSpecBuilder(basicnode.Prototype.Any).Matcher().Node()
+	c := head
+	for c != cid.Undef && c != latestSync {
+		if result.Behind == limit {
+			result.BehindExact = false
+			break
+		}
+		lnk := cidlink.Link{Cid: c}
+		node, err := probe.lsys.Load(ipld.LinkContext{Ctx: ctx}, lnk, basicnode.Prototype.Any)
+		if err != nil {
+			if err = syncer.Sync(ctx, c, sel); err == nil {
+				node, err = probe.lsys.Load(ipld.LinkContext{Ctx: ctx}, lnk, basicnode.Prototype.Any)
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, fmt.Errorf("probe canceled: %w", ctx.Err())
+				}
+				log.Warnw("Probe cannot fetch chain node, ending walk", "err", err, "cid", c, "peer", peerID)
+				result.BehindExact = false
+				break
+			}
+		}
+		result.Behind++
+		if c, err = walker.prev(node); err != nil {
+			return nil, err
+		}
+	}
+	log.Debugw("Probed publisher", "head", head, "latestSync", latestSync, "behind", result.Behind, "exact", result.BehindExact, "peer", peerID)
+	return result, nil
+}
+
+// probeLinkSystem is a link system that holds the chain nodes fetched by a
+// probe in memory. Blocks are read from memory, or if not there, from the link
+// system that synced blocks are stored in.
+type probeLinkSystem struct {
+	lsys   ipld.LinkSystem
+	blocks map[cid.Cid][]byte
+	mutex  sync.Mutex
+}
+
+func newProbeLinkSystem(stored ipld.LinkSystem) *probeLinkSystem {
+	p := &probeLinkSystem{
+		blocks: make(map[cid.Cid][]byte),
+	}
+	p.lsys = cidlink.DefaultLinkSystem()
+	p.lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		p.mutex.Lock()
+		data, ok := p.blocks[lnk.(cidlink.Link).Cid]
+		p.mutex.Unlock()
+		if ok {
+			return bytes.NewReader(data), nil
+		}
+		return stored.StorageReadOpener(lctx, lnk)
+	}
+	p.lsys.StorageWriteOpener = func(ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		buf := bytes.NewBuffer(nil)
+		return buf, func(lnk ipld.Link) error {
+			p.mutex.Lock()
+			p.blocks[lnk.(cidlink.Link).Cid] = buf.Bytes()
+			p.mutex.Unlock()
+			return nil
+		}, nil
+	}
+	return p
+}
@@ -0,0 +1,96 @@
+package legs
+
+import (
+	"context"
+
+	"github.com/filecoin-project/go-legs/metrics"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// SyncProgress notifies an OnSyncProgress reader that a sync in progress has
+// synced another batch of blocks. A SyncProgress is sent every time the number
+// of blocks set by the SyncProgressInterval option is synced, so that the
+// blocks of a very large sync can be processed before the sync completes. The
+// SyncFinished for the sync is sent as usual once the sync completes.
+//
+// A sync that fails after sending SyncProgress events does not update the
+// latest sync, and its blocks may be synced and reported again by a later
+// sync. If the Subscriber stages blocks, then the reported blocks are not in
+// the Subscriber's link system until the sync completes. See:
+// StagingDatastore.
+type SyncProgress struct {
+	// Cid is the CID that is being synced.
+	Cid cid.Cid
+	// PeerID identifies the publisher that is synced with.
+	PeerID peer.ID
+	// SyncedCids lists the CIDs synced since the previous SyncProgress of the
+	// same sync, in traversal order.
+	SyncedCids []cid.Cid
+	// SyncedTotal is the number of CIDs that the sync has synced so far.
+	SyncedTotal int
+	// Source is what caused the sync.
+	Source SyncSource
+}
+
+// OnSyncProgress creates a channel that receives a SyncProgress for each batch
+// of blocks synced by syncs in progress. No SyncProgress is sent unless the
+// Subscriber was created with the SyncProgressInterval option.
+//
+// Calling the returned cancel function removes the notification channel from
+// the list of channels to be notified of progress, and it closes the channel
+// to allow any reading goroutines to stop waiting on the channel.
+//
+// SyncProgress events are sent as blocks are synced, so a sync waits for all
+// readers to receive each event, unless the WatchDropOldest option is given.
+// Readers must read the channel promptly. See OnSyncFinished for the
+// WatchOption values.
+func (s *Subscriber) OnSyncProgress(opts ...WatchOption) (<-chan SyncProgress, context.CancelFunc) {
+	// Channel is buffered to prevent a sync from blocking if a reader is not
+	// reading the channel immediately.
+	w := newWatchChan[SyncProgress](opts)
+	ch := w.ch
+	s.outEventsMutex.Lock()
+	defer s.outEventsMutex.Unlock()
+
+	s.progressEventsChans = append(s.progressEventsChans, w)
+	cncl := func() {
+		s.outEventsMutex.Lock()
+		defer s.outEventsMutex.Unlock()
+		for i, ca := range s.progressEventsChans {
+			if ca.ch == ch {
+				s.progressEventsChans[i] = s.progressEventsChans[len(s.progressEventsChans)-1]
+				s.progressEventsChans[len(s.progressEventsChans)-1] = watchChan[SyncProgress]{}
+				s.progressEventsChans = s.progressEventsChans[:len(s.progressEventsChans)-1]
+				close(ch)
+				break
+			}
+		}
+	}
+	return ch, cncl
+}
+
+// reportProgress sends a SyncProgress to all OnSyncProgress channels if
+// syncedCids, the CIDs synced so far by a sync, ends a batch of blocks.
+func (s *Subscriber) reportProgress(peerID peer.ID, c cid.Cid, source SyncSource, syncedCids []cid.Cid) {
+	if s.progressInterval == 0 || len(syncedCids)%s.progressInterval != 0 {
+		return
+	}
+	batch := make([]cid.Cid, s.progressInterval)
+	copy(batch, syncedCids[len(syncedCids)-s.progressInterval:])
+	event := SyncProgress{
+		Cid:         c,
+		PeerID:      peerID,
+		SyncedCids:  batch,
+		SyncedTotal: len(syncedCids),
+		Source:      source,
+	}
+
+	s.outEventsMutex.Lock()
+	defer s.outEventsMutex.Unlock()
+	for _, w := range s.progressEventsChans {
+		if dropped := w.send(event); dropped != 0 {
+			s.metrics.EventsDropped(metrics.EventSyncProgress, dropped)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package legs
+
+import (
+	"github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/time/rate"
+)
+
+// PublisherHandler configures syncing with a single publisher, overriding the
+// Subscriber's configuration for that publisher. The configuration is kept
+// by the Subscriber, and applies to syncs that start after it is set. Get a
+// PublisherHandler with Subscriber.Handler.
+type PublisherHandler struct {
+	subscriber *Subscriber
+	peerID     peer.ID
+}
+
+// pubConfig is the configuration that is set for a single publisher.
+type pubConfig struct {
+	rateLimiter      *rate.Limiter
+	dss              ipld.Node
+	segDepthLimit    int64
+	hasSegDepthLimit bool
+	// resumed is closed when syncing with a paused publisher is resumed. It
+	// is nil if the publisher is not paused.
+	resumed chan struct{}
+}
+
+// Handler returns a PublisherHandler for configuring syncing with the
+// specified publisher.
+func (s *Subscriber) Handler(peerID peer.ID) *PublisherHandler {
+	return &PublisherHandler{
+		subscriber: s,
+		peerID:     peerID,
+	}
+}
+
+// PeerID returns the ID of the publisher that the handler configures.
+func (ph *PublisherHandler) PeerID() peer.ID {
+	return ph.peerID
+}
+
+// SetRateLimiter sets the rate limiter of syncs with the publisher, instead
+// of the one given by the RateLimiter option. A nil limiter removes the
+// publisher's rate limiter. The ScopedRateLimiter sync option still overrides
+// the publisher's rate limiter.
+func (ph *PublisherHandler) SetRateLimiter(limiter *rate.Limiter) {
+	ph.update(func(pc *pubConfig) {
+		pc.rateLimiter = limiter
+	})
+}
+
+// SetSelectorSequence sets the selector sequence that is used to sync with the
+// publisher, instead of the default selector sequence given to NewSubscriber.
+// A nil sequence removes the publisher's selector sequence.
+func (ph *PublisherHandler) SetSelectorSequence(dss ipld.Node) {
+	ph.update(func(pc *pubConfig) {
+		pc.dss = dss
+	})
+}
+
+// SetSegmentDepthLimit sets the segment depth limit of syncs with the
+// publisher, instead of the one given by the SegmentDepthLimit option. The
+// ScopedSegmentDepthLimit sync option still overrides the publisher's limit.
+func (ph *PublisherHandler) SetSegmentDepthLimit(depth int64) {
+	ph.update(func(pc *pubConfig) {
+		pc.segDepthLimit = depth
+		pc.hasSegDepthLimit = true
+	})
+}
+
+// SetBlockHook sets a block hook that is called instead of the Subscriber's
+// BlockHook for blocks synced from the publisher. This is the same as calling
+// Subscriber.SetPublisherBlockHook.
+func (ph *PublisherHandler) SetBlockHook(hook BlockHookFunc) {
+	ph.subscriber.SetPublisherBlockHook(ph.peerID, hook)
+}
+
+// Pause stops syncing of announcements from the publisher until Resume is
+// called. Announcements that arrive while paused are not lost: the latest one
+// is synced when syncing is resumed. Syncs started by Sync are not paused.
+func (ph *PublisherHandler) Pause() {
+	ph.update(func(pc *pubConfig) {
+		if pc.resumed == nil {
+			pc.resumed = make(chan struct{})
+		}
+	})
+}
+
+// Resume resumes syncing of announcements from the publisher, and syncs the
+// latest announcement that arrived while syncing was paused.
+func (ph *PublisherHandler) Resume() {
+	ph.update(func(pc *pubConfig) {
+		if pc.resumed != nil {
+			close(pc.resumed)
+			pc.resumed = nil
+		}
+	})
+}
+
+// Paused returns true if syncing of announcements from the publisher is
+// paused.
+func (ph *PublisherHandler) Paused() bool {
+	pc, ok := ph.subscriber.pubConfigFor(ph.peerID)
+	return ok && pc.resumed != nil
+}
+
+// Reset removes all configuration of the publisher, so that the Subscriber's
+// configuration is used again, and resumes syncing if it is paused.
+func (ph *PublisherHandler) Reset() {
+	ph.Resume()
+	ph.subscriber.SetPublisherBlockHook(ph.peerID, nil)
+
+	s := ph.subscriber
+	s.pubConfigsMutex.Lock()
+	delete(s.pubConfigs, ph.peerID)
+	s.pubConfigsMutex.Unlock()
+}
+
+// update applies fn to the publisher's configuration.
+func (ph *PublisherHandler) update(fn func(*pubConfig)) {
+	s := ph.subscriber
+	s.pubConfigsMutex.Lock()
+	defer s.pubConfigsMutex.Unlock()
+
+	pc, ok := s.pubConfigs[ph.peerID]
+	if !ok {
+		pc = &pubConfig{}
+		if s.pubConfigs == nil {
+			s.pubConfigs = make(map[peer.ID]*pubConfig)
+		}
+		s.pubConfigs[ph.peerID] = pc
+	}
+	fn(pc)
+}
+
+// pubConfigFor returns a copy of the configuration of the publisher, and false
+// if the publisher has no configuration.
+func (s *Subscriber) pubConfigFor(peerID peer.ID) (pubConfig, bool) {
+	s.pubConfigsMutex.RLock()
+	defer s.pubConfigsMutex.RUnlock()
+	pc, ok := s.pubConfigs[peerID]
+	if !ok {
+		return pubConfig{}, false
+	}
+	return *pc, true
+}
+
+// rateLimiterForPeer returns the rate limiter of the publisher, or if it has
+// none, the rate limiter given by the RateLimiter option.
+func (s *Subscriber) rateLimiterForPeer(peerID peer.ID) *rate.Limiter {
+	if pc, ok := s.pubConfigFor(peerID); ok && pc.rateLimiter != nil {
+		return pc.rateLimiter
+	}
+	if s.rateLimiterFor != nil {
+		return s.rateLimiterFor(peerID)
+	}
+	return nil
+}
+
+// selectorSequenceFor returns the selector sequence of the publisher, or if it
+// has none, the default selector sequence.
+func (s *Subscriber) selectorSequenceFor(peerID peer.ID) ipld.Node {
+	if pc, ok := s.pubConfigFor(peerID); ok && pc.dss != nil {
+		return pc.dss
+	}
+	return s.dss
+}
+
+// segDepthLimitFor returns the segment depth limit of the publisher, or if it
+// has none, the Subscriber's segment depth limit.
+func (s *Subscriber) segDepthLimitFor(peerID peer.ID) int64 {
+	if pc, ok := s.pubConfigFor(peerID); ok && pc.hasSegDepthLimit {
+		return pc.segDepthLimit
+	}
+	return s.segDepthLimit
+}
@@ -0,0 +1,326 @@
+package legs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/filecoin-project/go-legs/metrics"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ErrQuotaExceeded is returned by a sync that was stopped because storing a
+// block would have exceeded the storage quota of the publisher. See:
+// StorageQuota.
+var ErrQuotaExceeded = errors.New("publisher storage quota exceeded")
+
+// quotaPrefix is the datastore key prefix under which the bytes stored for each
+// publisher are persisted.
+const quotaPrefix = "/legs/quota/"
+
+// StorageQuotaFor returns the storage quota of a publisher, which is the
+// number of bytes of blocks that syncs with the publisher may store. A quota of
+// zero or less is no limit.
+type StorageQuotaFor func(publisher peer.ID) int64
+
+// QuotaExceeded notifies an OnQuotaExceeded reader that a sync was stopped
+// because storing a block would have exceeded the storage quota of the
+// publisher.
+type QuotaExceeded struct {
+	// PeerID identifies the publisher that was synced with.
+	PeerID peer.ID
+	// Cid identifies the block that was not stored.
+	Cid cid.Cid
+	// Quota is the storage quota of the publisher.
+	Quota int64
+	// Stored is the number of bytes stored for the publisher.
+	Stored int64
+	// BlockSize is the size of the block that was not stored.
+	BlockSize int64
+}
+
+// storageQuotas counts the bytes of blocks that syncs store for each
+// publisher, and stops the syncs that would store more than the publisher's
+// storage quota. If it has a datastore, then the counts are persisted in it. A
+// nil storageQuotas counts and limits nothing.
+type storageQuotas struct {
+	quotaFor   StorageQuotaFor
+	onExceeded func(QuotaExceeded)
+	ds         datastore.Datastore
+
+	// stored is the number of bytes stored for each publisher.
+	stored map[peer.ID]int64
+	// exceeded is the error of the sync with each publisher that exceeded
+	// its quota, until the sync returns it.
+	exceeded map[peer.ID]error
+	mutex    sync.Mutex
+}
+
+// newStorageQuotas creates a storageQuotas that limits the bytes stored for
+// each publisher to the quota given by quotaFor, and calls onExceeded when a
+// sync is stopped. The counts persisted in ds are loaded, and the counts are
+// kept only in memory if ds is nil. Returns nil if quotaFor is nil.
+func newStorageQuotas(ctx context.Context, quotaFor StorageQuotaFor, ds datastore.Datastore, onExceeded func(QuotaExceeded)) (*storageQuotas, error) {
+	if quotaFor == nil {
+		return nil, nil
+	}
+	q := &storageQuotas{
+		quotaFor:   quotaFor,
+		onExceeded: onExceeded,
+		ds:         ds,
+		stored:     make(map[peer.ID]int64),
+		exceeded:   make(map[peer.ID]error),
+	}
+	if ds == nil {
+		return q, nil
+	}
+
+	results, err := ds.Query(ctx, query.Query{Prefix: quotaPrefix})
+	if err != nil {
+		return nil, fmt.Errorf("cannot query stored bytes: %w", err)
+	}
+	defer results.Close()
+
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, fmt.Errorf("cannot read stored bytes: %w", r.Error)
+		}
+		peerID, err := peer.Decode(datastore.RawKey(r.Key).BaseNamespace())
+		if err != nil {
+			log.Errorw("Ignoring stored bytes with invalid peer id", "err", err, "key", r.Key)
+			continue
+		}
+		stored, err := strconv.ParseInt(string(r.Value), 10, 64)
+		if err != nil {
+			log.Errorw("Ignoring invalid stored bytes", "err", err, "peer", peerID)
+			continue
+		}
+		q.stored[peerID] = stored
+	}
+	return q, nil
+}
+
+// linkSystem returns a link system that writes to lsys, except that a block
+// is not written if it would exceed the publisher's quota. A block that is
+// already stored in lsys is written without being counted again. Returns lsys
+// if q is nil.
+func (q *storageQuotas) linkSystem(peerID peer.ID, lsys ipld.LinkSystem) ipld.LinkSystem {
+	if q == nil {
+		return lsys
+	}
+	readOpener := lsys.StorageReadOpener
+	writeOpener := lsys.StorageWriteOpener
+	lsys.StorageWriteOpener = func(lctx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		w, commit, err := writeOpener(lctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		cw := &countingWriter{w: w}
+		return cw, func(lnk ipld.Link) error {
+			if blockStored(readOpener, lctx, lnk) {
+				return commit(lnk)
+			}
+			if err := q.reserve(lctx.Ctx, peerID, lnk.(cidlink.Link).Cid, cw.n); err != nil {
+				return err
+			}
+			if err := commit(lnk); err != nil {
+				q.release(lctx.Ctx, peerID, cw.n)
+				return err
+			}
+			return nil
+		}, nil
+	}
+	return lsys
+}
+
+// blockStored returns true if the block identified by lnk can be read with
+// readOpener.
+func blockStored(readOpener ipld.BlockReadOpener, lctx ipld.LinkContext, lnk ipld.Link) bool {
+	if readOpener == nil {
+		return false
+	}
+	r, err := readOpener(lctx, lnk)
+	if err != nil {
+		return false
+	}
+	if cl, ok := r.(io.Closer); ok {
+		cl.Close()
+	}
+	return true
+}
+
+// reserve adds size to the bytes stored for the publisher, unless that would
+// exceed its quota. In that case, the error is recorded for the sync with the
+// publisher and returned.
+func (q *storageQuotas) reserve(ctx context.Context, peerID peer.ID, c cid.Cid, size int64) error {
+	quota := q.quotaFor(peerID)
+	q.mutex.Lock()
+	stored := q.stored[peerID]
+	if quota <= 0 || stored+size <= quota {
+		err := q.setStored(ctx, peerID, stored+size)
+		q.mutex.Unlock()
+		return err
+	}
+	err := fmt.Errorf("%w: storing %d byte block %s would exceed quota of %d bytes with %d bytes stored", ErrQuotaExceeded, size, c, quota, stored)
+	_, reported := q.exceeded[peerID]
+	if !reported {
+		q.exceeded[peerID] = err
+	}
+	q.mutex.Unlock()
+
+	// Report the first block of a sync that exceeded the quota.
+	if !reported {
+		log.Warnw("Stopping sync that exceeds storage quota", "peer", peerID, "quota", quota, "stored", stored, "blockSize", size)
+		if q.onExceeded != nil {
+			q.onExceeded(QuotaExceeded{
+				PeerID:    peerID,
+				Cid:       c,
+				Quota:     quota,
+				Stored:    stored,
+				BlockSize: size,
+			})
+		}
+	}
+	return err
+}
+
+// release subtracts size from the bytes stored for the publisher, for blocks
+// that were reserved but not stored, or that were removed.
+func (q *storageQuotas) release(ctx context.Context, peerID peer.ID, size int64) {
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	stored := q.stored[peerID] - size
+	if stored < 0 {
+		stored = 0
+	}
+	if err := q.setStored(ctx, peerID, stored); err != nil {
+		log.Errorw("Cannot release stored bytes", "err", err, "peer", peerID)
+	}
+}
+
+// setStored sets the bytes stored for the publisher, and persists them if q
+// has a datastore. The mutex must be held.
+func (q *storageQuotas) setStored(ctx context.Context, peerID peer.ID, stored int64) error {
+	if q.ds != nil {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		if err := q.ds.Put(ctx, quotaKey(peerID), []byte(strconv.FormatInt(stored, 10))); err != nil {
+			return fmt.Errorf("cannot persist stored bytes: %w", err)
+		}
+	}
+	q.stored[peerID] = stored
+	return nil
+}
+
+// quotaKey returns the datastore key of the bytes stored for the publisher.
+func quotaKey(peerID peer.ID) datastore.Key {
+	return datastore.NewKey(quotaPrefix + peerID.String())
+}
+
+// takeExceeded returns and clears the error of the sync with the publisher
+// that exceeded its quota, or returns nil if no sync exceeded it. A sync over
+// graphsync reports the failure to store a block as a data transfer error, so
+// the handler replaces that with this error.
+func (q *storageQuotas) takeExceeded(peerID peer.ID) error {
+	if q == nil {
+		return nil
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	err := q.exceeded[peerID]
+	delete(q.exceeded, peerID)
+	return err
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// StoredBytes returns the number of bytes of blocks that syncs have stored for
+// the publisher, as counted for its storage quota. Returns zero if the
+// Subscriber was not created with the StorageQuota option.
+func (s *Subscriber) StoredBytes(peerID peer.ID) int64 {
+	if s.quotas == nil {
+		return 0
+	}
+	s.quotas.mutex.Lock()
+	defer s.quotas.mutex.Unlock()
+	return s.quotas.stored[peerID]
+}
+
+// SetStoredBytes sets the number of bytes counted as stored for the publisher,
+// such as when blocks are removed by other means than CollectGarbage, or when
+// the Subscriber is started with blocks already stored. Does nothing if the
+// Subscriber was not created with the StorageQuota option.
+func (s *Subscriber) SetStoredBytes(peerID peer.ID, stored int64) {
+	if s.quotas == nil {
+		return
+	}
+	s.quotas.mutex.Lock()
+	defer s.quotas.mutex.Unlock()
+	if err := s.quotas.setStored(context.Background(), peerID, stored); err != nil {
+		log.Errorw("Cannot set stored bytes", "err", err, "peer", peerID)
+	}
+}
+
+// OnQuotaExceeded creates a channel that receives a QuotaExceeded each time a
+// sync is stopped because it would exceed the storage quota of its publisher.
+// See: StorageQuota.
+//
+// Calling the returned cancel function removes the notification channel from
+// the list of channels to be notified, and it closes the channel to allow any
+// reading goroutines to stop waiting on the channel. See OnSyncFinished for
+// the WatchOption values.
+func (s *Subscriber) OnQuotaExceeded(opts ...WatchOption) (<-chan QuotaExceeded, context.CancelFunc) {
+	w := newWatchChan[QuotaExceeded](opts)
+	ch := w.ch
+	s.outEventsMutex.Lock()
+	defer s.outEventsMutex.Unlock()
+
+	s.quotaEventsChans = append(s.quotaEventsChans, w)
+	cncl := func() {
+		s.outEventsMutex.Lock()
+		defer s.outEventsMutex.Unlock()
+		for i, ca := range s.quotaEventsChans {
+			if ca.ch == ch {
+				s.quotaEventsChans[i] = s.quotaEventsChans[len(s.quotaEventsChans)-1]
+				s.quotaEventsChans[len(s.quotaEventsChans)-1] = watchChan[QuotaExceeded]{}
+				s.quotaEventsChans = s.quotaEventsChans[:len(s.quotaEventsChans)-1]
+				close(ch)
+				break
+			}
+		}
+	}
+	return ch, cncl
+}
+
+// reportQuotaExceeded sends a QuotaExceeded to all OnQuotaExceeded channels.
+func (s *Subscriber) reportQuotaExceeded(event QuotaExceeded) {
+	s.outEventsMutex.Lock()
+	defer s.outEventsMutex.Unlock()
+	for _, w := range s.quotaEventsChans {
+		if dropped := w.send(event); dropped != 0 {
+			s.metrics.EventsDropped(metrics.EventQuotaExceeded, dropped)
+		}
+	}
+}
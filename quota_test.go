@@ -0,0 +1,145 @@
+package legs_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageQuota(t *testing.T) {
+	var quota int64
+	quotaFor := func(peer.ID) int64 {
+		return atomic.LoadInt64(&quota)
+	}
+
+	t.Run("graphsync", func(t *testing.T) {
+		atomic.StoreInt64(&quota, 100)
+		srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+		srcHost := test.MkTestHost()
+		defer srcHost.Close()
+		srcLnkS := test.MkLinkSystem(srcStore)
+		pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic)
+		require.NoError(t, err)
+		defer pub.Close()
+
+		dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+		dstHost := test.MkTestHost()
+		defer dstHost.Close()
+		sub, err := legs.NewSubscriber(dstHost, dstStore, test.MkLinkSystem(dstStore), testTopic, nil,
+			legs.StorageQuota(quotaFor))
+		require.NoError(t, err)
+		defer sub.Close()
+
+		testStorageQuota(t, &quota, sub, srcHost.ID(), srcHost.Addrs()[0], func(ctx context.Context, head cid.Cid) {
+			require.NoError(t, pub.SetRoot(ctx, head))
+		}, srcLnkS)
+	})
+
+	t.Run("http", func(t *testing.T) {
+		atomic.StoreInt64(&quota, 100)
+		te := setupPublisherSubscriber(t, []legs.Option{legs.StorageQuota(quotaFor)})
+		testStorageQuota(t, &quota, te.sub, te.srcHost.ID(), te.pubAddr, func(ctx context.Context, head cid.Cid) {
+			require.NoError(t, te.pub.SetRoot(ctx, head))
+		}, te.srcLinkSys)
+	})
+}
+
+func testStorageQuota(t *testing.T, quota *int64, sub *legs.Subscriber, pubID peer.ID, pubAddr multiaddr.Multiaddr, setRoot func(context.Context, cid.Cid), srcLnkS ipld.LinkSystem) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	exceeded, cancelWatch := sub.OnQuotaExceeded()
+	defer cancelWatch()
+
+	head := test.MkChain(srcLnkS, true)[0].(cidlink.Link).Cid
+	setRoot(ctx, head)
+
+	// The chain does not fit in the quota.
+	_, err := sub.Sync(ctx, pubID, head, nil, pubAddr)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, legs.ErrQuotaExceeded), "unexpected error: %s", err)
+	select {
+	case event := <-exceeded:
+		require.Equal(t, pubID, event.PeerID)
+		require.Equal(t, int64(100), event.Quota)
+		require.Greater(t, event.Stored+event.BlockSize, event.Quota)
+		require.Equal(t, event.Stored, sub.StoredBytes(pubID))
+	case <-ctx.Done():
+		t.Fatal("quota exceeded event not received")
+	}
+	require.Nil(t, sub.GetLatestSync(pubID))
+
+	// Raising the quota lets the sync complete.
+	atomic.StoreInt64(quota, 1<<20)
+	_, err = sub.Sync(ctx, pubID, head, nil, pubAddr)
+	require.NoError(t, err)
+	require.Greater(t, sub.StoredBytes(pubID), int64(100))
+
+	sub.SetStoredBytes(pubID, 0)
+	require.Zero(t, sub.StoredBytes(pubID))
+}
+
+func TestStorageQuotaAccounting(t *testing.T) {
+	pubSys := newHostSystem(t)
+	subSys := newHostSystem(t)
+	defer pubSys.close()
+	defer subSys.close()
+
+	quotaDS := datastore.NewMapDatastore()
+	subOpts := []legs.Option{
+		legs.StorageQuota(func(peer.ID) int64 { return 1 << 20 }),
+		legs.StorageQuotaDatastore(quotaDS),
+	}
+	pubAddr, pub, sub := legsPubSubBuilder{}.Build(t, testTopic, pubSys, subSys, subOpts)
+	defer pub.Close()
+
+	ctx := context.Background()
+	pubID := pubSys.host.ID()
+	head := llBuilder{Length: 5, Seed: 1}.Build(t, pubSys.lsys)
+	headCid := head.(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(ctx, headCid))
+
+	_, err := sub.Sync(ctx, pubID, headCid, nil, pubAddr)
+	require.NoError(t, err)
+	stored := sub.StoredBytes(pubID)
+	require.NotZero(t, stored)
+
+	// Importing blocks that are already stored does not count them again.
+	var car bytes.Buffer
+	require.NoError(t, sub.WriteLastSyncCAR(ctx, pubID, &car))
+	_, err = sub.ImportCAR(ctx, pubID, &car)
+	require.NoError(t, err)
+	require.Equal(t, stored, sub.StoredBytes(pubID))
+
+	// Blocks deleted by garbage collection are no longer counted.
+	latest := map[peer.ID]cid.Cid{pubID: headCid}
+	deleted, err := sub.CollectGarbage(ctx, latest, 3, legs.DatastoreBlockDeleter(subSys.ds))
+	require.NoError(t, err)
+	require.Equal(t, 2, deleted)
+	collected := sub.StoredBytes(pubID)
+	require.NotZero(t, collected)
+	require.Less(t, collected, stored)
+	stored = collected
+	require.NoError(t, sub.Close())
+
+	// The count is persisted across restarts.
+	sub, err = legs.NewSubscriber(subSys.host, subSys.ds, subSys.lsys, testTopic, nil, subOpts...)
+	require.NoError(t, err)
+	defer sub.Close()
+	require.Equal(t, stored, sub.StoredBytes(pubID))
+}
@@ -0,0 +1,172 @@
+package legs
+
+import (
+	"context"
+	"time"
+
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/httpsync"
+	"github.com/filecoin-project/go-legs/metrics"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// relayReason is the reason given to libp2p for connecting to a publisher
+// through a circuit relay.
+const relayReason = "go-legs sync"
+
+// connectForSync prepares the connection for a sync with the publisher, and
+// returns a function to call when the sync is done, which counts the kind of
+// connection, such as metrics.ConnectionRelay, that the sync was done over. If
+// the sync is over libp2p and the Subscriber has a hole punch wait, then this
+// connects to the publisher first, and if only connected through a relay,
+// waits for hole punching to establish a direct connection.
+func (s *Subscriber) connectForSync(ctx context.Context, peerID peer.ID, syncer Syncer) func() {
+	transport := syncTransport(syncer)
+	if !isLibp2pSyncer(syncer) {
+		return func() {
+			if transport == TransportHTTP {
+				s.metrics.SyncConnection(string(transport), metrics.ConnectionDirect)
+			}
+		}
+	}
+
+	var holePunched bool
+	if s.holePunchWait != 0 {
+		holePunched = s.awaitHolePunch(ctx, peerID)
+	}
+	return func() {
+		// A sync of blocks that are all stored locally may not connect.
+		if s.host.Network().Connectedness(peerID) != network.Connected {
+			return
+		}
+		conn := metrics.ConnectionRelay
+		if hasDirectConn(s.host, peerID) {
+			conn = metrics.ConnectionDirect
+			if holePunched {
+				conn = metrics.ConnectionHolePunch
+			}
+		}
+		s.metrics.SyncConnection(string(transport), conn)
+	}
+}
+
+// awaitHolePunch connects to the publisher, and if the host is only connected
+// to it through a relay, waits up to the hole punch wait for a direct
+// connection. It returns true if a direct connection was established while
+// waiting. A failure to connect is left for the sync to report.
+func (s *Subscriber) awaitHolePunch(ctx context.Context, peerID peer.ID) bool {
+	connCtx := ctx
+	if s.relaySync {
+		connCtx = network.WithUseTransient(ctx, relayReason)
+	}
+	if err := s.host.Connect(connCtx, peer.AddrInfo{ID: peerID}); err != nil {
+		log.Debugw("Cannot connect to publisher before sync", "err", err, "peer", peerID)
+		return false
+	}
+	if hasDirectConn(s.host, peerID) {
+		return false
+	}
+	log.Infow("Waiting for hole punching to connect directly to publisher", "peer", peerID, "wait", s.holePunchWait)
+	if waitDirectConn(ctx, s.host, peerID, s.holePunchWait) {
+		return true
+	}
+	log.Infow("No direct connection to publisher, syncing over relay", "peer", peerID)
+	return false
+}
+
+// isLibp2pSyncer returns true if syncer syncs over libp2p streams.
+func isLibp2pSyncer(syncer Syncer) bool {
+	switch s := syncer.(type) {
+	case *stagedSyncer:
+		return isLibp2pSyncer(s.Syncer)
+	case *httpsync.Syncer:
+		return s.OverStreams()
+	case *dtsync.Syncer:
+		return true
+	}
+	return false
+}
+
+// hasDirectConn returns true if h has a connection to peerID that is not
+// through a relay.
+func hasDirectConn(h host.Host, peerID peer.ID) bool {
+	for _, conn := range h.Network().ConnsToPeer(peerID) {
+		if !isRelayedConn(conn) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitDirectConn waits up to timeout for h to have a direct connection to
+// peerID, and returns true if it does.
+func waitDirectConn(ctx context.Context, h host.Host, peerID peer.ID, timeout time.Duration) bool {
+	direct := make(chan struct{}, 1)
+	notifee := &network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) {
+			if conn.RemotePeer() != peerID || isRelayedConn(conn) {
+				return
+			}
+			select {
+			case direct <- struct{}{}:
+			default:
+			}
+		},
+	}
+	h.Network().Notify(notifee)
+	defer h.Network().StopNotify(notifee)
+
+	// Check after subscribing to notifications, so that a connection made in
+	// between is not missed.
+	if hasDirectConn(h, peerID) {
+		return true
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-direct:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+func isRelayedConn(conn network.Conn) bool {
+	return hasProtocol(conn.RemoteMultiaddr(), multiaddr.P_CIRCUIT)
+}
+
+// trimPeerIDs returns addrs with the trailing /p2p/<peerID> removed from each
+// address of peerID that has one, such as the /p2p-circuit address of a
+// publisher behind a relay, so that the host can dial the address. An address
+// that is only the peer ID is left out.
+func trimPeerIDs(peerID peer.ID, addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	var trimmed []multiaddr.Multiaddr
+	for i, addr := range addrs {
+		if addr == nil {
+			continue
+		}
+		rest, last := multiaddr.SplitLast(addr)
+		if last == nil || last.Protocol().Code != multiaddr.P_P2P || last.Value() != peerID.String() {
+			if trimmed != nil {
+				trimmed = append(trimmed, addr)
+			}
+			continue
+		}
+		if trimmed == nil {
+			trimmed = make([]multiaddr.Multiaddr, i, len(addrs))
+			copy(trimmed, addrs[:i])
+		}
+		if rest != nil {
+			trimmed = append(trimmed, rest)
+		}
+	}
+	if trimmed == nil {
+		return addrs
+	}
+	return trimmed
+}
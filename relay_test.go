@@ -0,0 +1,117 @@
+package legs_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/metrics"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncOverRelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	relayHost := test.MkTestHost(
+		libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
+		libp2p.EnableRelayService(),
+		libp2p.ForceReachabilityPublic())
+	defer relayHost.Close()
+	relayInfo := peer.AddrInfo{ID: relayHost.ID(), Addrs: relayHost.Addrs()}
+
+	// The publisher reserves a slot with the relay, and subscribers are only
+	// given its relay address.
+	pubHost := test.MkTestHost(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	defer pubHost.Close()
+	require.NoError(t, pubHost.Connect(ctx, relayInfo))
+	_, err := client.Reserve(ctx, pubHost, relayInfo)
+	require.NoError(t, err)
+
+	pubStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	pubLsys := test.MkLinkSystem(pubStore)
+	pub, err := dtsync.NewPublisher(pubHost, pubStore, pubLsys, testTopic, dtsync.WithRelay(true))
+	require.NoError(t, err)
+	defer pub.Close()
+	chainLnks := test.MkChain(pubLsys, true)
+	root := chainLnks[0].(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(ctx, root))
+
+	// The publisher announces its relay address, with its own peer ID.
+	relayAddr := relayHost.Addrs()[0].
+		Encapsulate(multiaddr.StringCast("/p2p/" + relayHost.ID().String() + "/p2p-circuit/p2p/" + pubHost.ID().String()))
+
+	newSubscriber := func(t *testing.T, opts ...legs.Option) (host.Host, *legs.Subscriber) {
+		subHost := test.MkTestHost()
+		t.Cleanup(func() { subHost.Close() })
+		subStore := dssync.MutexWrap(datastore.NewMapDatastore())
+		sub, err := legs.NewSubscriber(subHost, subStore, test.MkLinkSystem(subStore), testTopic, nil, opts...)
+		require.NoError(t, err)
+		t.Cleanup(func() { sub.Close() })
+		return subHost, sub
+	}
+
+	t.Run("relay not allowed", func(t *testing.T) {
+		_, sub := newSubscriber(t)
+		ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+		defer cancel()
+		_, err := sub.Sync(ctx, pubHost.ID(), root, nil, relayAddr)
+		require.Error(t, err)
+	})
+
+	t.Run("relay allowed", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		_, sub := newSubscriber(t, legs.RelaySync(true), legs.HolePunchWait(100*time.Millisecond), legs.Metrics(reg))
+		watcher, cncl := sub.OnSyncFinished()
+		defer cncl()
+
+		require.NoError(t, sub.Announce(ctx, root, pubHost.ID(), []multiaddr.Multiaddr{relayAddr}))
+		select {
+		case event := <-watcher:
+			require.Equal(t, root, event.Cid)
+			require.Equal(t, legs.TransportGraphsync, event.Transport)
+			require.Contains(t, event.SyncedCids, root)
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for sync")
+		}
+
+		// Hole punching is not enabled, so the sync falls back to the relay.
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		var relayed float64
+		for _, mf := range families {
+			if mf.GetName() != "legs_sync_connections_total" {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				for _, lp := range m.GetLabel() {
+					if lp.GetName() == "connection" && lp.GetValue() == metrics.ConnectionRelay {
+						relayed += m.GetCounter().GetValue()
+					}
+				}
+			}
+		}
+		require.Equal(t, 1.0, relayed)
+
+		// A sync without addresses reaches the publisher at its announced
+		// relay address.
+		_, err = sub.Sync(ctx, pubHost.ID(), cid.Undef, nil, nil)
+		require.NoError(t, err)
+	})
+
+	_, err = legs.NewSubscriber(pubHost, pubStore, pubLsys, testTopic, nil, legs.HolePunchWait(-time.Second))
+	require.Error(t, err)
+}
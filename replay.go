@@ -0,0 +1,239 @@
+package legs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/filecoin-project/go-legs/carutil"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagjson"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// SyncTrace is a trace of a sync, recorded by RecordSync as JSON. Together
+// with the CAR file of the synced blocks, it allows the sync to be replayed by
+// ReplaySync without a network.
+type SyncTrace struct {
+	// PeerID is the peer that the sync was with.
+	PeerID peer.ID `json:"peerID"`
+	// Cid is the CID that was synced. It is undefined if the sync failed
+	// before the CID was known.
+	Cid cid.Cid `json:"cid"`
+	// LatestSync is the latest sync with the peer when the sync started.
+	LatestSync cid.Cid `json:"latestSync"`
+	// Selector is the dag-json encoded selector that the sync used. It is
+	// empty if the sync used the default selector sequence and there is none.
+	Selector json.RawMessage `json:"selector,omitempty"`
+	// WrapSelector is true if the selector was wrapped to stop at the latest
+	// sync, as it is when the default selector sequence is used.
+	WrapSelector bool `json:"wrapSelector,omitempty"`
+	// SegmentDepthLimit is the segment depth limit that the sync used.
+	SegmentDepthLimit int64 `json:"segmentDepthLimit,omitempty"`
+	// Blocks are the CIDs passed to the sync's block hook, in order.
+	Blocks []cid.Cid `json:"blocks"`
+	// SkippedCids are the CIDs in the skip list that the sync reached.
+	SkippedCids []cid.Cid `json:"skippedCids,omitempty"`
+	// Events are the SyncFinished events sent for the sync.
+	Events []SyncFinished `json:"events,omitempty"`
+	// Err is the error message of a failed sync.
+	Err string `json:"error,omitempty"`
+}
+
+// recordSync records the sync into trace. The blocks passed to the sync's
+// block hook are recorded before the hook is called.
+func recordSync(trace *SyncTrace) SyncOption {
+	return func(sc *syncCfg) {
+		sc.trace = trace
+		hook := sc.scopedBlockHook
+		sc.scopedBlockHook = func(p peer.ID, c cid.Cid, actions SegmentSyncActions) {
+			trace.Blocks = append(trace.Blocks, c)
+			if hook != nil {
+				hook(p, c, actions)
+			}
+		}
+	}
+}
+
+// start records the parameters that a sync is handled with.
+func (t *SyncTrace) start(nextCid, latestSync cid.Cid, sel ipld.Node, wrapSel bool, segdl int64) error {
+	if sel != nil {
+		var buf bytes.Buffer
+		if err := dagjson.Encode(sel, &buf); err != nil {
+			return fmt.Errorf("cannot encode selector: %w", err)
+		}
+		t.Selector = buf.Bytes()
+	}
+	t.Cid = nextCid
+	t.LatestSync = latestSync
+	t.WrapSelector = wrapSel
+	t.SegmentDepthLimit = segdl
+	return nil
+}
+
+// RecordSync performs a sync the same as Sync does, and records it for
+// regression testing. The blocks traversed by the sync are written from the
+// Subscriber's link system to carW as a CARv2 file, and a SyncTrace of the
+// sync is written to traceW as JSON. The recording is written even if the sync
+// fails, so that the failure can be reproduced with ReplaySync.
+//
+// Returns the result of the sync, or an error if the sync succeeded but the
+// recording could not be written.
+func (s *Subscriber) RecordSync(ctx context.Context, peerID peer.ID, nextCid cid.Cid, sel ipld.Node, peerAddr multiaddr.Multiaddr, carW, traceW io.Writer, opts ...SyncOption) (cid.Cid, error) {
+	trace := &SyncTrace{PeerID: peerID}
+	opts = append(opts, recordSync(trace))
+	syncCid, syncErr := s.Sync(ctx, peerID, nextCid, sel, peerAddr, opts...)
+	if syncErr != nil {
+		trace.Err = syncErr.Error()
+	}
+
+	err := s.writeRecording(ctx, trace, carW, traceW)
+	if err != nil {
+		if syncErr != nil {
+			log.Errorw("Cannot write recording of failed sync", "err", err, "peer", peerID)
+			return syncCid, syncErr
+		}
+		return syncCid, fmt.Errorf("cannot write sync recording: %w", err)
+	}
+	return syncCid, syncErr
+}
+
+// writeRecording writes the CAR file and the JSON trace of a recorded sync.
+// Blocks that are not stored, such as those of a failed sync, are left out of
+// the CAR file.
+func (s *Subscriber) writeRecording(ctx context.Context, trace *SyncTrace, carW, traceW io.Writer) error {
+	var roots []cid.Cid
+	if trace.Cid != cid.Undef {
+		roots = []cid.Cid{trace.Cid}
+	}
+	lsys := s.linkSystemFor(trace.PeerID)
+	stored := make([]cid.Cid, 0, len(trace.Blocks))
+	for _, c := range trace.Blocks {
+		r, err := lsys.StorageReadOpener(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c})
+		if err != nil {
+			continue
+		}
+		if cl, ok := r.(io.Closer); ok {
+			cl.Close()
+		}
+		stored = append(stored, c)
+	}
+	if err := carutil.WriteV2(ctx, lsys, carW, roots, stored); err != nil {
+		return err
+	}
+	return json.NewEncoder(traceW).Encode(trace)
+}
+
+// ReplaySync replays a sync recorded by RecordSync, reading the CAR file of the
+// recording from carR and the JSON trace from traceR. The blocks in the CAR
+// file are stored in the Subscriber's link system, and the sync is handled
+// with the recorded selector, the same as the recorded sync, except that
+// blocks are only read from the link system. This does not use the network, so
+// that a sync reported from production can be reproduced in a test.
+//
+// The replay stops at the recorded latest sync, and skips the recorded skipped
+// CIDs, without changing the latest sync with the peer or the skip list. If the
+// recorded sync sent a SyncFinished event, then the replay also sends the
+// event. The latest sync with the peer is only updated to the replayed CID if
+// the AlwaysUpdateLatest option is given. Of the other sync options, only
+// those that set a block hook apply.
+//
+// Returns a SyncTrace of the replay, to compare with the recorded trace. The
+// returned trace records any error that the replayed sync fails with. An error
+// is returned only if the recording cannot be replayed.
+func (s *Subscriber) ReplaySync(ctx context.Context, carR, traceR io.Reader, opts ...SyncOption) (*SyncTrace, error) {
+	var trace SyncTrace
+	if err := json.NewDecoder(traceR).Decode(&trace); err != nil {
+		return nil, fmt.Errorf("cannot decode sync trace: %w", err)
+	}
+	if trace.PeerID == "" {
+		return nil, errors.New("empty peer id")
+	}
+	if trace.Cid == cid.Undef {
+		return nil, errors.New("recorded sync has no cid to replay")
+	}
+	var sel ipld.Node
+	if len(trace.Selector) != 0 {
+		var err error
+		sel, err = ipld.DecodeUsingPrototype(trace.Selector, dagjson.Decode, basicnode.Prototype.Any)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode selector: %w", err)
+		}
+	}
+
+	cfg := &syncCfg{
+		scopedBlockHook: s.blockHookFor(trace.PeerID),
+	}
+	if trace.WrapSelector {
+		// Stop at the recorded latest sync instead of the current one.
+		var latestSyncLink ipld.Link
+		if trace.LatestSync != cid.Undef {
+			latestSyncLink = cidlink.Link{Cid: trace.LatestSync}
+		}
+		sel = ExploreRecursiveWithStopNode(s.syncRecLimit, sel, latestSyncLink)
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	replay := &SyncTrace{
+		PeerID:            trace.PeerID,
+		Cid:               trace.Cid,
+		LatestSync:        trace.LatestSync,
+		Selector:          trace.Selector,
+		WrapSelector:      trace.WrapSelector,
+		SegmentDepthLimit: trace.SegmentDepthLimit,
+	}
+	recordSync(replay)(cfg)
+
+	if _, err := carutil.Read(ctx, s.skipList.skipWriteStorage(s.linkSystemFor(trace.PeerID)), carR); err != nil {
+		return nil, fmt.Errorf("cannot read car: %w", err)
+	}
+	if len(trace.SkippedCids) != 0 {
+		defer s.skipList.addTemporary(trace.SkippedCids)()
+	}
+
+	hnd, err := s.getOrCreateHandler(trace.PeerID)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.alwaysUpdateLatest {
+		hnd.latestSyncMu.Lock()
+		defer hnd.latestSyncMu.Unlock()
+	}
+
+	syncer := &localSyncer{
+		subscriber: s,
+		peerID:     trace.PeerID,
+		head:       trace.Cid,
+		lsys:       s.linkSystemFor(trace.PeerID),
+	}
+	source := SyncSourceImport
+	transport := TransportLocal
+	if len(trace.Events) != 0 {
+		source = trace.Events[0].Source
+		transport = trace.Events[0].Transport
+	}
+	syncedCids, skippedCids, err := hnd.handle(ctx, trace.Cid, sel, false, syncer, cfg.scopedBlockHook, trace.SegmentDepthLimit, source)
+	if err != nil {
+		replay.Err = fmt.Errorf("sync handler failed: %w", err).Error()
+		return replay, nil
+	}
+	replay.SkippedCids = skippedCids
+
+	if cfg.alwaysUpdateLatest {
+		s.advanceLatestSync(ctx, trace.PeerID, trace.Cid)
+	}
+	if len(trace.Events) != 0 {
+		event := SyncFinished{Cid: trace.Cid, PeerID: trace.PeerID, SyncedCids: syncedCids, SkippedCids: skippedCids, Source: source, Transport: transport}
+		replay.Events = append(replay.Events, event)
+		s.inEvents <- event
+	}
+	return replay, nil
+}
@@ -0,0 +1,137 @@
+package legs_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/carutil"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordReplaySync(t *testing.T) {
+	for _, isHttp := range []bool{false, true} {
+		name := "dtsync"
+		if isHttp {
+			name = "httpsync"
+		}
+		t.Run(name, func(t *testing.T) {
+			testRecordReplaySync(t, isHttp)
+		})
+	}
+}
+
+func testRecordReplaySync(t *testing.T, isHttp bool) {
+	pubSys := newHostSystem(t)
+	subSys := newHostSystem(t)
+	defer pubSys.close()
+	defer subSys.close()
+
+	pubAddr, pub, sub := legsPubSubBuilder{IsHttp: isHttp}.Build(t, testTopic, pubSys, subSys, nil)
+	defer pub.Close()
+	defer sub.Close()
+
+	ctx := context.Background()
+	first := llBuilder{Length: 2, Seed: 1}.Build(t, pubSys.lsys)
+	require.NoError(t, pub.SetRoot(ctx, first.(cidlink.Link).Cid))
+	_, err := sub.Sync(ctx, pubSys.host.ID(), cid.Undef, nil, pubAddr)
+	require.NoError(t, err)
+
+	head := llBuilder{Length: 3, Seed: 2}.BuildWithPrev(t, pubSys.lsys, first)
+	headCid := head.(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(ctx, headCid))
+
+	var carBuf, traceBuf bytes.Buffer
+	syncCid, err := sub.RecordSync(ctx, pubSys.host.ID(), cid.Undef, nil, pubAddr, &carBuf, &traceBuf)
+	require.NoError(t, err)
+	require.Equal(t, headCid, syncCid)
+
+	var recorded legs.SyncTrace
+	require.NoError(t, json.Unmarshal(traceBuf.Bytes(), &recorded))
+	require.Equal(t, pubSys.host.ID(), recorded.PeerID)
+	require.Equal(t, headCid, recorded.Cid)
+	require.Equal(t, first.(cidlink.Link).Cid, recorded.LatestSync)
+	require.Len(t, recorded.Blocks, 3)
+	require.Len(t, recorded.Events, 1)
+	require.Equal(t, legs.SyncSourceSync, recorded.Events[0].Source)
+	require.Empty(t, recorded.Err)
+
+	// Replay the recording into a subscriber that has no network access to
+	// the publisher.
+	replaySys := newHostSystem(t)
+	defer replaySys.close()
+	replaySub, err := legs.NewSubscriber(replaySys.host, replaySys.ds, replaySys.lsys, testTopic, nil)
+	require.NoError(t, err)
+	defer replaySub.Close()
+
+	watcher, cncl := replaySub.OnSyncFinished()
+	defer cncl()
+
+	replayed, err := replaySub.ReplaySync(ctx, bytes.NewReader(carBuf.Bytes()), bytes.NewReader(traceBuf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, recorded, *replayed)
+
+	select {
+	case event := <-watcher:
+		require.Equal(t, recorded.Events[0], event)
+	case <-time.After(updateTimeout):
+		t.Fatal("timed out waiting for replayed sync to finish")
+	}
+	// The latest sync is only updated if the caller opts in.
+	require.Nil(t, replaySub.GetLatestSync(pubSys.host.ID()))
+
+	replayed, err = replaySub.ReplaySync(ctx, bytes.NewReader(carBuf.Bytes()), bytes.NewReader(traceBuf.Bytes()), legs.AlwaysUpdateLatest())
+	require.NoError(t, err)
+	require.Equal(t, recorded, *replayed)
+	select {
+	case <-watcher:
+	case <-time.After(updateTimeout):
+		t.Fatal("timed out waiting for replayed sync to finish")
+	}
+	require.Equal(t, head, replaySub.GetLatestSync(pubSys.host.ID()))
+	for _, c := range recorded.Blocks {
+		has, err := replaySys.ds.Has(ctx, datastore.NewKey(c.String()))
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+}
+
+func TestReplaySyncReproducesFailure(t *testing.T) {
+	subSys := newHostSystem(t)
+	defer subSys.close()
+	sub, err := legs.NewSubscriber(subSys.host, subSys.ds, subSys.lsys, testTopic, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// A recording of a sync that failed before any block was stored.
+	pubSys := newHostSystem(t)
+	defer pubSys.close()
+	head := llBuilder{Length: 2, Seed: 1}.Build(t, pubSys.lsys)
+	skipped := llBuilder{Length: 1, Seed: 2}.Build(t, pubSys.lsys)
+	trace := legs.SyncTrace{
+		PeerID:       pubSys.host.ID(),
+		Cid:          head.(cidlink.Link).Cid,
+		WrapSelector: true,
+		SkippedCids:  []cid.Cid{skipped.(cidlink.Link).Cid},
+		Err:          "sync handler failed: datatransfer failed: stream reset",
+	}
+	traceData, err := json.Marshal(trace)
+	require.NoError(t, err)
+	ctx := context.Background()
+	var carBuf bytes.Buffer
+	require.NoError(t, carutil.WriteV2(ctx, subSys.lsys, &carBuf, []cid.Cid{trace.Cid}, nil))
+
+	replayed, err := sub.ReplaySync(ctx, &carBuf, bytes.NewReader(traceData))
+	require.NoError(t, err)
+	require.Contains(t, replayed.Err, "not available locally")
+	require.Empty(t, replayed.Events)
+	require.Nil(t, sub.GetLatestSync(pubSys.host.ID()))
+	// The recorded skipped CIDs are not added to the skip list.
+	require.Empty(t, sub.SkippedCids())
+}
@@ -1,9 +1,14 @@
 package legs
 
 import (
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/datamodel"
 	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	"github.com/ipld/go-ipld-prime/traversal/selector"
 	selectorbuilder "github.com/ipld/go-ipld-prime/traversal/selector/builder"
@@ -54,6 +59,112 @@ func ExploreRecursiveWithStopNode(limit selector.RecursionLimit, sequence ipld.N
 	})
 }
 
+// StopOption configures a selector built by ExploreRecursiveWithStopOptions.
+type StopOption func(*stopConfig)
+
+// stopConfig contains all options for building a selector with
+// ExploreRecursiveWithStopOptions.
+type stopConfig struct {
+	inclusive   bool
+	stopLsys    ipld.LinkSystem
+	prevPath    string
+	fields      []string
+	fieldSels   map[string]ipld.Node
+	hasOverride bool
+}
+
+// StopInclusive makes the selector also sync the stop node, and explore it
+// the same as the other nodes of the recursion, so that the nodes it links to,
+// such as the entries of the last synced advertisement, are synced too. The
+// recursion then stops at the chain entry before the stop node, which is found
+// by loading the stop node from lsys and following the link at prevPath. If the
+// stop node is the first entry of the chain, then the recursion has no stop.
+func StopInclusive(lsys ipld.LinkSystem, prevPath string) StopOption {
+	return func(c *stopConfig) {
+		c.inclusive = true
+		c.stopLsys = lsys
+		c.prevPath = prevPath
+	}
+}
+
+// ExploreField overrides how the named field of each node of the recursion is
+// explored, with the selector sel. A nil sel follows the link in the field with
+// the recursion, as for the link to the previous chain entry. When any field
+// is overridden, only the overridden fields are explored, so the field that
+// links to the previous chain entry must be given as well. This cannot be used
+// with a selector sequence.
+func ExploreField(name string, sel ipld.Node) StopOption {
+	return func(c *stopConfig) {
+		if c.fieldSels == nil {
+			c.fieldSels = make(map[string]ipld.Node)
+		}
+		if _, ok := c.fieldSels[name]; !ok {
+			c.fields = append(c.fields, name)
+		}
+		c.fieldSels[name] = sel
+		c.hasOverride = true
+	}
+}
+
+// ExploreRecursiveWithStopOptions builds a selector that recursively syncs a
+// DAG until the link stopLnk is seen, the same as ExploreRecursiveWithStopNode,
+// with the stop behavior and the exploration of node fields configured by
+// opts. Without options, the stop is exclusive: the stop node is not synced.
+//
+// An error is returned if the inclusive stop node cannot be loaded, or if
+// fields are overridden for a given sequence.
+func ExploreRecursiveWithStopOptions(limit selector.RecursionLimit, sequence ipld.Node, stopLnk ipld.Link, opts ...StopOption) (ipld.Node, error) {
+	var cfg stopConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	if cfg.hasOverride {
+		if sequence != nil {
+			return nil, errors.New("cannot override fields of a selector sequence")
+		}
+		sequence = fieldsSequence(cfg.fields, cfg.fieldSels)
+	}
+
+	if cfg.inclusive && stopLnk != nil {
+		stopNode, err := cfg.stopLsys.Load(ipld.LinkContext{}, stopLnk, basicnode.Prototype.Any)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load inclusive stop node: %w", err)
+		}
+		w := chainWalker{prevPath: datamodel.ParsePath(cfg.prevPath)}
+		prev, err := w.prev(stopNode)
+		if err != nil {
+			return nil, err
+		}
+		stopLnk = nil
+		if prev != cid.Undef {
+			stopLnk = cidlink.Link{Cid: prev}
+		}
+	}
+
+	return ExploreRecursiveWithStopNode(limit, sequence, stopLnk), nil
+}
+
+// fieldsSequence builds a selector sequence that explores each of the fields
+// with its selector, or with a recursive edge if its selector is nil.
+func fieldsSequence(fields []string, fieldSels map[string]ipld.Node) ipld.Node {
+	return fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry(selector.SelectorKey_ExploreFields).CreateMap(1, func(na fluent.MapAssembler) {
+			na.AssembleEntry(selector.SelectorKey_Fields).CreateMap(int64(len(fields)), func(na fluent.MapAssembler) {
+				for _, field := range fields {
+					sel := fieldSels[field]
+					if sel == nil {
+						sel = fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+							na.AssembleEntry(selector.SelectorKey_ExploreRecursiveEdge).CreateMap(0, func(na fluent.MapAssembler) {})
+						})
+					}
+					na.AssembleEntry(field).AssignNode(sel)
+				}
+			})
+		})
+	})
+}
+
 // getStopNode will try to return the stop node from a recursive selector.
 func getStopNode(selNode datamodel.Node) (datamodel.Link, bool) {
 	if selNode == nil {
@@ -171,6 +282,55 @@ func withRecursionLimit(selNode datamodel.Node, rl selector.RecursionLimit) (dat
 	return selWithLimit, true
 }
 
+// withStopNode adds a stop condition at stopLnk to the top-most recursive
+// explore of the given selector. If the selector is not a recursive explore, or
+// already has a stop condition, returns nil with false bool.
+func withStopNode(selNode datamodel.Node, stopLnk ipld.Link) (datamodel.Node, bool) {
+	if selNode == nil || stopLnk == nil {
+		return nil, false
+	}
+
+	// Expect exactly one root entry, which is explore recursive.
+	if selNode.Length() != 1 {
+		return nil, false
+	}
+	ern, err := selNode.LookupByString(selector.SelectorKey_ExploreRecursive)
+	if err != nil {
+		return nil, false
+	}
+	if _, err = ern.LookupByString(selector.SelectorKey_StopAt); err == nil {
+		return nil, false
+	}
+
+	// Store errors that may occur during map iteration to return later.
+	var iErr error
+	selWithStop := fluent.MustBuildMap(basicnode.Prototype.Any, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry(selector.SelectorKey_ExploreRecursive).CreateMap(ern.Length()+1, func(na fluent.MapAssembler) {
+			// Copy the entries from the original selector.
+			mi := ern.MapIterator()
+			var k, v ipld.Node
+			for !mi.Done() {
+				k, v, iErr = mi.Next()
+				if iErr != nil {
+					return
+				}
+				na.AssembleKey().AssignNode(k)
+				na.AssembleValue().AssignNode(v)
+			}
+
+			// Add the stop condition.
+			cond := fluent.MustBuildMap(basicnode.Prototype__Map{}, 1, func(na fluent.MapAssembler) {
+				na.AssembleEntry(string(selector.ConditionMode_Link)).AssignLink(stopLnk)
+			})
+			na.AssembleEntry(selector.SelectorKey_StopAt).AssignNode(cond)
+		})
+	})
+	if iErr != nil {
+		return nil, false
+	}
+	return selWithStop, true
+}
+
 // LegSelector is a convenient function that returns the selector
 // used by leg subscribers
 //
@@ -184,3 +344,90 @@ func LegSelector(limit selector.RecursionLimit, stopLnk ipld.Link) ipld.Node {
 		ssb.ExploreAll(ssb.ExploreRecursiveEdge()),
 		stopLnk)
 }
+
+// DefaultPrevPath is the path, in each entry of a chain, of the link to the
+// previous entry, that is followed by SelectorBuilder.EntriesOnly unless
+// another path is set with SelectorBuilder.PrevPath.
+const DefaultPrevPath = "PreviousID"
+
+// Selectors is the starting point for building selectors for common syncs of
+// a publisher's chain. Each SelectorBuilder method returns a new builder, so
+// Selectors itself is never changed. For example, a selector that syncs at
+// most the 10 newest chain entries that are newer than the latest sync, and
+// none of the content that the entries link to, is built with:
+//
+//	legs.Selectors.ChainDepth(10).EntriesOnly().Until(latestSync).Node()
+var Selectors SelectorBuilder
+
+// SelectorBuilder builds a recursive selector for syncing a chain. Without any
+// settings, the selector syncs the whole DAG, the same as LegSelector with no
+// recursion limit and no stop link.
+type SelectorBuilder struct {
+	depth       int64
+	entriesOnly bool
+	prevPath    string
+	stopLnk     ipld.Link
+}
+
+// ChainDepth limits the sync to n chain entries, counting the head as the
+// first entry. The content that the synced entries link to is synced within
+// the same depth, unless EntriesOnly is set. A depth of zero or less removes
+// the limit.
+func (b SelectorBuilder) ChainDepth(n int64) SelectorBuilder {
+	b.depth = n
+	return b
+}
+
+// EntriesOnly makes the sync follow only the link to the previous chain entry,
+// so that the chain entries are synced without the content they link to. The
+// link is at DefaultPrevPath, unless another path is set with PrevPath.
+func (b SelectorBuilder) EntriesOnly() SelectorBuilder {
+	b.entriesOnly = true
+	return b
+}
+
+// PrevPath sets the path of the link to the previous chain entry that is
+// followed when EntriesOnly is set. Path segments are separated by "/".
+func (b SelectorBuilder) PrevPath(path string) SelectorBuilder {
+	b.prevPath = path
+	return b
+}
+
+// Until stops the sync at the chain entry identified by c, which is not
+// synced. This is usually the latest sync with the publisher, so that only the
+// new part of the chain is synced. A cid.Undef c removes the stop.
+func (b SelectorBuilder) Until(c cid.Cid) SelectorBuilder {
+	if c == cid.Undef {
+		b.stopLnk = nil
+	} else {
+		b.stopLnk = cidlink.Link{Cid: c}
+	}
+	return b
+}
+
+// Node returns the selector that is built.
+func (b SelectorBuilder) Node() ipld.Node {
+	limit := selector.RecursionLimitNone()
+	if b.depth > 0 {
+		limit = selector.RecursionLimitDepth(b.depth)
+	}
+	var sequence ipld.Node
+	if b.entriesOnly {
+		prevPath := b.prevPath
+		if prevPath == "" {
+			prevPath = DefaultPrevPath
+		}
+		ssb := selectorbuilder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+		spec := ssb.ExploreRecursiveEdge()
+		segs := datamodel.ParsePath(prevPath).Segments()
+		for i := len(segs) - 1; i >= 0; i-- {
+			field := segs[i].String()
+			inner := spec
+			spec = ssb.ExploreFields(func(efsb selectorbuilder.ExploreFieldsSpecBuilder) {
+				efsb.Insert(field, inner)
+			})
+		}
+		sequence = spec.Node()
+	}
+	return ExploreRecursiveWithStopNode(limit, sequence, b.stopLnk)
+}
@@ -1,14 +1,19 @@
 package legs
 
 import (
+	"io"
 	"testing"
 
 	"github.com/filecoin-project/go-legs/test"
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal"
 	"github.com/ipld/go-ipld-prime/traversal/selector"
 	selectorbuilder "github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	"github.com/stretchr/testify/require"
@@ -30,6 +35,33 @@ func TestGetStopNodeWhenNil(t *testing.T) {
 	require.False(t, ok, "We shouldn't get a stop node out if none was set")
 }
 
+func TestWithStopNode(t *testing.T) {
+	c, err := cid.V0Builder{}.Sum([]byte("hi"))
+	require.NoError(t, err)
+	stopNode := cidlink.Link{Cid: c}
+
+	sel := ExploreRecursiveWithStopNode(selector.RecursionLimitDepth(10), nil, nil)
+	selWithStop, ok := withStopNode(sel, stopNode)
+	require.True(t, ok)
+	actualStopNode, ok := getStopNode(selWithStop)
+	require.True(t, ok)
+	require.Equal(t, stopNode, actualStopNode)
+	limit, ok := getRecursionLimit(selWithStop)
+	require.True(t, ok)
+	require.Equal(t, selector.RecursionLimitDepth(10), limit)
+	_, err = selector.CompileSelector(selWithStop)
+	require.NoError(t, err)
+
+	// An existing stop node is not replaced.
+	_, ok = withStopNode(selWithStop, cidlink.Link{Cid: c})
+	require.False(t, ok)
+
+	// A selector that is not a recursive explore cannot have a stop node.
+	ssb := selectorbuilder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	_, ok = withStopNode(ssb.Matcher().Node(), stopNode)
+	require.False(t, ok)
+}
+
 func TestGetRecursionLimit(t *testing.T) {
 	testCid, err := test.RandomCids(1)
 	require.NoError(t, err)
@@ -169,3 +201,154 @@ func TestWithRecursionLimit(t *testing.T) {
 		})
 	}
 }
+
+func TestSelectorBuilder(t *testing.T) {
+	chain := mkEntriesChain(t)
+	walk := func(sel ipld.Node) (int, int) {
+		return chain.walk(t, sel)
+	}
+
+	entries, content := walk(Selectors.Node())
+	require.Equal(t, 4, entries)
+	require.Equal(t, 4, content)
+
+	entries, content = walk(Selectors.EntriesOnly().Node())
+	require.Equal(t, 4, entries)
+	require.Zero(t, content)
+
+	entries, content = walk(Selectors.ChainDepth(2).EntriesOnly().Node())
+	require.Equal(t, 2, entries)
+	require.Zero(t, content)
+
+	entries, content = walk(Selectors.Until(chain.cids[2]).Node())
+	require.Equal(t, 2, entries)
+	require.Equal(t, 2, content)
+
+	sel := Selectors.ChainDepth(3).Until(chain.cids[1]).Node()
+	limit, ok := getRecursionLimit(sel)
+	require.True(t, ok)
+	require.Equal(t, selector.RecursionLimitDepth(3), limit)
+	stopLnk, ok := getStopNode(sel)
+	require.True(t, ok)
+	require.Equal(t, cidlink.Link{Cid: chain.cids[1]}, stopLnk)
+
+	// Selectors is not changed by building from it.
+	_, ok = getStopNode(Selectors.Node())
+	require.False(t, ok)
+}
+
+func TestExploreRecursiveWithStopOptions(t *testing.T) {
+	chain := mkEntriesChain(t)
+	stopLnk := cidlink.Link{Cid: chain.cids[2]}
+	limit := selector.RecursionLimitNone()
+
+	// Without options the stop node is not synced.
+	sel, err := ExploreRecursiveWithStopOptions(limit, nil, stopLnk)
+	require.NoError(t, err)
+	entries, content := chain.walk(t, sel)
+	require.Equal(t, 2, entries)
+	require.Equal(t, 2, content)
+
+	// An inclusive stop syncs the stop node and its content.
+	sel, err = ExploreRecursiveWithStopOptions(limit, nil, stopLnk, StopInclusive(chain.lsys, DefaultPrevPath))
+	require.NoError(t, err)
+	entries, content = chain.walk(t, sel)
+	require.Equal(t, 3, entries)
+	require.Equal(t, 3, content)
+
+	// An inclusive stop at the first entry syncs the whole chain.
+	sel, err = ExploreRecursiveWithStopOptions(limit, nil, cidlink.Link{Cid: chain.cids[3]}, StopInclusive(chain.lsys, DefaultPrevPath))
+	require.NoError(t, err)
+	entries, content = chain.walk(t, sel)
+	require.Equal(t, 4, entries)
+	require.Equal(t, 4, content)
+
+	// Only the overridden fields are explored.
+	sel, err = ExploreRecursiveWithStopOptions(limit, nil, stopLnk, ExploreField(DefaultPrevPath, nil))
+	require.NoError(t, err)
+	entries, content = chain.walk(t, sel)
+	require.Equal(t, 2, entries)
+	require.Zero(t, content)
+
+	ssb := selectorbuilder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	sel, err = ExploreRecursiveWithStopOptions(limit, nil, stopLnk,
+		ExploreField(DefaultPrevPath, nil),
+		ExploreField("Entries", ssb.Matcher().Node()),
+		StopInclusive(chain.lsys, DefaultPrevPath))
+	require.NoError(t, err)
+	entries, content = chain.walk(t, sel)
+	require.Equal(t, 3, entries)
+	require.Equal(t, 3, content)
+
+	// Fields cannot be overridden for a given sequence.
+	_, err = ExploreRecursiveWithStopOptions(limit, ssb.ExploreAll(ssb.ExploreRecursiveEdge()).Node(), stopLnk, ExploreField("Entries", nil))
+	require.Error(t, err)
+
+	// The inclusive stop node must be stored.
+	missing, err := test.RandomCids(1)
+	require.NoError(t, err)
+	_, err = ExploreRecursiveWithStopOptions(limit, nil, cidlink.Link{Cid: missing[0]}, StopInclusive(chain.lsys, DefaultPrevPath))
+	require.Error(t, err)
+}
+
+// entriesChain is a chain of 4 entries, each linking to the previous entry at
+// DefaultPrevPath, and to its own content at "Entries".
+type entriesChain struct {
+	lsys ipld.LinkSystem
+	// cids are the CIDs of the chain entries, from the head to the first.
+	cids     []cid.Cid
+	contents map[cid.Cid]struct{}
+}
+
+func mkEntriesChain(t *testing.T) entriesChain {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	chain := entriesChain{
+		lsys:     test.MkLinkSystem(ds),
+		cids:     make([]cid.Cid, 4),
+		contents: make(map[cid.Cid]struct{}),
+	}
+	var prev ipld.Link
+	for i := range chain.cids {
+		content, err := test.Store(ds, basicnode.NewInt(int64(i)))
+		require.NoError(t, err)
+		chain.contents[content.(cidlink.Link).Cid] = struct{}{}
+		entry := fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(na fluent.MapAssembler) {
+			na.AssembleEntry("Entries").AssignLink(content)
+			if prev != nil {
+				na.AssembleEntry(DefaultPrevPath).AssignLink(prev)
+			}
+		})
+		prev, err = test.Store(ds, entry)
+		require.NoError(t, err)
+		chain.cids[len(chain.cids)-1-i] = prev.(cidlink.Link).Cid
+	}
+	return chain
+}
+
+// walk traverses the chain from its head with sel, and returns the number of
+// chain entries and of contents that are loaded.
+func (c entriesChain) walk(t *testing.T, sel ipld.Node) (int, int) {
+	var entries, content int
+	walkLsys := c.lsys
+	walkLsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		if _, ok := c.contents[lnk.(cidlink.Link).Cid]; ok {
+			content++
+		} else {
+			entries++
+		}
+		return c.lsys.StorageReadOpener(lctx, lnk)
+	}
+	compiled, err := selector.CompileSelector(sel)
+	require.NoError(t, err)
+	root, err := walkLsys.Load(ipld.LinkContext{}, cidlink.Link{Cid: c.cids[0]}, basicnode.Prototype.Any)
+	require.NoError(t, err)
+	prog := traversal.Progress{
+		Cfg: &traversal.Config{
+			LinkSystem:                     walkLsys,
+			LinkTargetNodePrototypeChooser: basicnode.Chooser,
+		},
+	}
+	err = prog.WalkAdv(root, compiled, func(traversal.Progress, ipld.Node, traversal.VisitReason) error { return nil })
+	require.NoError(t, err)
+	return entries, content
+}
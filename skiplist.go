@@ -0,0 +1,216 @@
+package legs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// skipListPrefix is the datastore key prefix under which skipped CIDs are
+// persisted.
+const skipListPrefix = "/legs/skip/"
+
+// skipList is the set of CIDs that are never fetched or traversed by a sync.
+// If it has a datastore, then changes to the set are persisted in it.
+type skipList struct {
+	ds   datastore.Datastore
+	cids map[cid.Cid]struct{}
+	// temp counts the temporary additions of each CID that are not yet
+	// removed. Temporary CIDs are skipped, but are neither persisted nor
+	// listed. See: addTemporary.
+	temp  map[cid.Cid]int
+	mutex sync.RWMutex
+}
+
+// newSkipList creates a skipList, and loads any CIDs persisted in ds. The
+// skip list is kept only in memory if ds is nil.
+func newSkipList(ctx context.Context, ds datastore.Datastore) (*skipList, error) {
+	sl := &skipList{
+		ds:   ds,
+		cids: make(map[cid.Cid]struct{}),
+		temp: make(map[cid.Cid]int),
+	}
+	if ds == nil {
+		return sl, nil
+	}
+
+	results, err := ds.Query(ctx, query.Query{
+		Prefix:   skipListPrefix,
+		KeysOnly: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot query skip list: %w", err)
+	}
+	defer results.Close()
+
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, fmt.Errorf("cannot read skip list: %w", r.Error)
+		}
+		c, err := cid.Decode(datastore.RawKey(r.Key).BaseNamespace())
+		if err != nil {
+			log.Errorw("Ignoring invalid cid in skip list", "err", err, "key", r.Key)
+			continue
+		}
+		sl.cids[c] = struct{}{}
+	}
+	return sl, nil
+}
+
+func (sl *skipList) has(c cid.Cid) bool {
+	sl.mutex.RLock()
+	_, ok := sl.cids[c]
+	if !ok {
+		ok = sl.temp[c] != 0
+	}
+	sl.mutex.RUnlock()
+	return ok
+}
+
+func (sl *skipList) add(ctx context.Context, cids []cid.Cid) error {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	for _, c := range cids {
+		if c == cid.Undef {
+			return errors.New("cannot skip undefined cid")
+		}
+		if sl.ds != nil {
+			if err := sl.ds.Put(ctx, skipListKey(c), []byte{}); err != nil {
+				return fmt.Errorf("cannot persist skipped cid %s: %w", c, err)
+			}
+		}
+		sl.cids[c] = struct{}{}
+	}
+	return sl.sync(ctx)
+}
+
+func (sl *skipList) remove(ctx context.Context, cids []cid.Cid) error {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	for _, c := range cids {
+		if sl.ds != nil {
+			if err := sl.ds.Delete(ctx, skipListKey(c)); err != nil {
+				return fmt.Errorf("cannot remove skipped cid %s: %w", c, err)
+			}
+		}
+		delete(sl.cids, c)
+	}
+	return sl.sync(ctx)
+}
+
+// addTemporary skips cids until the returned function is called, without
+// persisting them or changing the CIDs added by add.
+func (sl *skipList) addTemporary(cids []cid.Cid) func() {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+	for _, c := range cids {
+		sl.temp[c]++
+	}
+	return func() {
+		sl.mutex.Lock()
+		defer sl.mutex.Unlock()
+		for _, c := range cids {
+			if sl.temp[c]--; sl.temp[c] == 0 {
+				delete(sl.temp, c)
+			}
+		}
+	}
+}
+
+func (sl *skipList) list() []cid.Cid {
+	sl.mutex.RLock()
+	defer sl.mutex.RUnlock()
+
+	cids := make([]cid.Cid, 0, len(sl.cids))
+	for c := range sl.cids {
+		cids = append(cids, c)
+	}
+	return cids
+}
+
+// sync flushes any changes to the skip list to persistent storage.
+func (sl *skipList) sync(ctx context.Context) error {
+	if sl.ds == nil {
+		return nil
+	}
+	return sl.ds.Sync(ctx, datastore.NewKey(skipListPrefix))
+}
+
+func skipListKey(c cid.Cid) datastore.Key {
+	return datastore.NewKey(skipListPrefix + c.String())
+}
+
+// skipWriteStorage returns a link system that writes to lsys, except that
+// blocks in the skip list are discarded instead of stored. This keeps skipped
+// blocks out of the local store even if a publisher sends them.
+func (sl *skipList) skipWriteStorage(lsys ipld.LinkSystem) ipld.LinkSystem {
+	writeOpener := lsys.StorageWriteOpener
+	lsys.StorageWriteOpener = func(lctx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		w, commit, err := writeOpener(lctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return w, func(lnk ipld.Link) error {
+			if cl, ok := lnk.(cidlink.Link); ok && sl.has(cl.Cid) {
+				log.Infow("Discarded skipped block", "cid", cl.Cid)
+				return nil
+			}
+			return commit(lnk)
+		}, nil
+	}
+	return lsys
+}
+
+// skipCid returns true if c is in the skip list. If so, then c is passed to
+// blockHook, so that the sync with peerID records it as skipped.
+func (sl *skipList) skipCid(blockHook func(peer.ID, cid.Cid)) func(peer.ID, cid.Cid) bool {
+	return func(peerID peer.ID, c cid.Cid) bool {
+		if !sl.has(c) {
+			return false
+		}
+		blockHook(peerID, c)
+		return true
+	}
+}
+
+// SkipCids adds CIDs to the Subscriber's skip list. A skipped CID is never
+// fetched or traversed by a sync: traversal treats it as a leaf, so the blocks
+// that it links to are not synced unless they are linked from another block,
+// and the sync continues with the rest of the DAG. If the CID to sync is
+// itself skipped, then nothing is synced, but the sync still completes and
+// becomes the latest sync. Skipped CIDs are reported in SyncFinished events.
+//
+// Syncs over HTTP neither fetch nor traverse skipped blocks. Syncs over
+// graphsync cannot tell the publisher to skip a block, so a skipped block that
+// the publisher sends is discarded instead of stored, but the blocks it links
+// to are still transferred.
+//
+// The skip list is persisted if the Subscriber is created with the
+// SkipListDatastore option.
+func (s *Subscriber) SkipCids(ctx context.Context, cids ...cid.Cid) error {
+	return s.skipList.add(ctx, cids)
+}
+
+// UnskipCids removes CIDs from the Subscriber's skip list. This does not
+// sync any data that was skipped; a later sync that reaches the CIDs will
+// fetch them. See: SkipCids.
+func (s *Subscriber) UnskipCids(ctx context.Context, cids ...cid.Cid) error {
+	return s.skipList.remove(ctx, cids)
+}
+
+// SkippedCids returns the CIDs in the Subscriber's skip list, in no particular
+// order. See: SkipCids.
+func (s *Subscriber) SkippedCids() []cid.Cid {
+	return s.skipList.list()
+}
@@ -0,0 +1,90 @@
+package legs_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSkipCids(t *testing.T) {
+	for _, isHttp := range []bool{false, true} {
+		name := "dtsync"
+		if isHttp {
+			name = "httpsync"
+		}
+		t.Run(name, func(t *testing.T) {
+			testSkipCids(t, isHttp)
+		})
+	}
+}
+
+func testSkipCids(t *testing.T, isHttp bool) {
+	pubSys := newHostSystem(t)
+	subSys := newHostSystem(t)
+	defer pubSys.close()
+	defer subSys.close()
+
+	skipDS := datastore.NewMapDatastore()
+	subOpts := []legs.Option{legs.SkipListDatastore(skipDS)}
+	pubAddr, pub, sub := legsPubSubBuilder{IsHttp: isHttp}.Build(t, testTopic, pubSys, subSys, subOpts)
+	defer pub.Close()
+	defer sub.Close()
+
+	// Build a chain: head -> next -> skipped -> first.
+	first := llBuilder{Length: 1, Seed: 1}.Build(t, pubSys.lsys)
+	skipped := llBuilder{Length: 1, Seed: 2}.BuildWithPrev(t, pubSys.lsys, first)
+	head := llBuilder{Length: 2, Seed: 3}.BuildWithPrev(t, pubSys.lsys, skipped)
+	skippedCid := skipped.(cidlink.Link).Cid
+	headCid := head.(cidlink.Link).Cid
+
+	ctx := context.Background()
+	require.NoError(t, sub.SkipCids(ctx, skippedCid))
+	require.Equal(t, []cid.Cid{skippedCid}, sub.SkippedCids())
+	require.NoError(t, pub.SetRoot(ctx, headCid))
+
+	watcher, cncl := sub.OnSyncFinished()
+	defer cncl()
+
+	_, err := sub.Sync(ctx, pubSys.host.ID(), cid.Undef, nil, pubAddr)
+	require.NoError(t, err)
+
+	select {
+	case event := <-watcher:
+		require.Equal(t, headCid, event.Cid)
+		if isHttp {
+			require.Len(t, event.SyncedCids, 2)
+		} else {
+			// Graphsync still transfers the blocks below a skipped block.
+			require.Len(t, event.SyncedCids, 3)
+		}
+		require.Equal(t, []cid.Cid{skippedCid}, event.SkippedCids)
+	case <-time.After(updateTimeout):
+		t.Fatal("timed out waiting for sync to finish")
+	}
+
+	has, err := subSys.ds.Has(ctx, datastore.NewKey(skippedCid.String()))
+	require.NoError(t, err)
+	require.False(t, has, "skipped block should not be stored")
+	if isHttp {
+		has, err = subSys.ds.Has(ctx, datastore.NewKey(first.(cidlink.Link).Cid.String()))
+		require.NoError(t, err)
+		require.False(t, has, "block linked from skipped block should not be synced")
+	}
+
+	// The skip list is persisted.
+	otherSys := newHostSystem(t)
+	defer otherSys.close()
+	other, err := legs.NewSubscriber(otherSys.host, otherSys.ds, otherSys.lsys, testTopic, nil, subOpts...)
+	require.NoError(t, err)
+	defer other.Close()
+	require.Equal(t, []cid.Cid{skippedCid}, other.SkippedCids())
+
+	require.NoError(t, sub.UnskipCids(ctx, skippedCid))
+	require.Empty(t, sub.SkippedCids())
+}
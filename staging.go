@@ -0,0 +1,222 @@
+package legs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"golang.org/x/time/rate"
+)
+
+// stagingPrefix is the datastore key prefix under which the blocks of syncs
+// are staged.
+const stagingPrefix = "/legs/staging/"
+
+// errNoStaging is returned by staging methods when the Subscriber was not
+// created with the StagingDatastore option.
+var errNoStaging = errors.New("subscriber has no staging area")
+
+// stagingArea holds the blocks of syncs in a datastore until the syncs
+// succeed, and then commits them to the publisher's link system. Each
+// publisher has its own area, since only one sync runs at a time with each
+// publisher. A nil stagingArea stages nothing.
+type stagingArea struct {
+	ds datastore.Batching
+	// lsys holds the link systems that staged blocks are committed to.
+	lsys *publisherLinkSystems
+	// skips is the skip list, whose blocks are not staged.
+	skips *skipList
+	// quotas counts staged blocks against the storage quota of their
+	// publisher.
+	quotas *storageQuotas
+}
+
+// stagedSyncer is a Syncer that stores synced blocks in the staging area of
+// its publisher.
+type stagedSyncer struct {
+	Syncer
+}
+
+// newStagingArea creates a stagingArea that stages blocks in ds, and commits
+// them to the publisher's link system in lsys. Returns nil if ds is nil.
+func newStagingArea(ds datastore.Batching, lsys *publisherLinkSystems, skips *skipList, quotas *storageQuotas) *stagingArea {
+	if ds == nil {
+		return nil
+	}
+	return &stagingArea{
+		ds:     ds,
+		lsys:   lsys,
+		skips:  skips,
+		quotas: quotas,
+	}
+}
+
+func stagingPeerPrefix(peerID peer.ID) string {
+	return stagingPrefix + peerID.String() + "/"
+}
+
+func stagingKey(peerID peer.ID, c cid.Cid) datastore.Key {
+	return datastore.NewKey(stagingPeerPrefix(peerID) + c.String())
+}
+
+// linkSystem returns a link system that stores blocks in the publisher's
+// staging area. Blocks are read from the staging area, or if not staged, from
+// the link system that blocks are committed to, so that blocks that are
+// already stored are not transferred again.
+func (a *stagingArea) linkSystem(peerID peer.ID) ipld.LinkSystem {
+	commitLsys := a.lsys.get(peerID)
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		ctx := lctx.Ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		data, err := a.ds.Get(ctx, stagingKey(peerID, lnk.(cidlink.Link).Cid))
+		if err == nil {
+			return bytes.NewReader(data), nil
+		}
+		if !errors.Is(err, datastore.ErrNotFound) {
+			return nil, err
+		}
+		return commitLsys.StorageReadOpener(lctx, lnk)
+	}
+	lsys.StorageWriteOpener = func(lctx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		ctx := lctx.Ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		buf := bytes.NewBuffer(nil)
+		return buf, func(lnk ipld.Link) error {
+			return a.ds.Put(ctx, stagingKey(peerID, lnk.(cidlink.Link).Cid), buf.Bytes())
+		}, nil
+	}
+	return a.skips.skipWriteStorage(a.quotas.linkSystem(peerID, lsys))
+}
+
+// list returns the CIDs of the blocks in the publisher's staging area.
+func (a *stagingArea) list(ctx context.Context, peerID peer.ID) ([]cid.Cid, error) {
+	results, err := a.ds.Query(ctx, query.Query{
+		Prefix:   stagingPeerPrefix(peerID),
+		KeysOnly: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot query staged blocks: %w", err)
+	}
+	defer results.Close()
+
+	var cids []cid.Cid
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, fmt.Errorf("cannot read staged blocks: %w", r.Error)
+		}
+		c, err := cid.Decode(datastore.RawKey(r.Key).BaseNamespace())
+		if err != nil {
+			log.Errorw("Ignoring staged block with invalid key", "err", err, "key", r.Key)
+			continue
+		}
+		cids = append(cids, c)
+	}
+	return cids, nil
+}
+
+// clear removes all blocks from the publisher's staging area.
+func (a *stagingArea) clear(ctx context.Context, peerID peer.ID) error {
+	cids, err := a.list(ctx, peerID)
+	if err != nil {
+		return err
+	}
+	for _, c := range cids {
+		key := stagingKey(peerID, c)
+		// Discarded blocks no longer count against the storage quota.
+		var size int
+		if a.quotas != nil {
+			if size, err = a.ds.GetSize(ctx, key); err != nil && !errors.Is(err, datastore.ErrNotFound) {
+				return fmt.Errorf("cannot read staged block size: %w", err)
+			}
+		}
+		if err = a.ds.Delete(ctx, key); err != nil {
+			return fmt.Errorf("cannot remove staged block: %w", err)
+		}
+		a.quotas.release(ctx, peerID, int64(size))
+	}
+	return nil
+}
+
+// commit stores the blocks in the publisher's staging area in the link system
+// that blocks are committed to, and removes them from the staging area.
+func (a *stagingArea) commit(ctx context.Context, peerID peer.ID) error {
+	cids, err := a.list(ctx, peerID)
+	if err != nil {
+		return err
+	}
+	lsys := a.lsys.get(peerID)
+	for _, c := range cids {
+		key := stagingKey(peerID, c)
+		data, err := a.ds.Get(ctx, key)
+		if err != nil {
+			return fmt.Errorf("cannot read staged block %s: %w", c, err)
+		}
+		w, commit, err := lsys.StorageWriteOpener(ipld.LinkContext{Ctx: ctx})
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+		if err = commit(cidlink.Link{Cid: c}); err != nil {
+			return fmt.Errorf("cannot commit staged block %s: %w", c, err)
+		}
+		if err = a.ds.Delete(ctx, key); err != nil {
+			return fmt.Errorf("cannot remove staged block: %w", err)
+		}
+	}
+	log.Debugw("Committed staged blocks", "count", len(cids), "peer", peerID)
+	return nil
+}
+
+// makeStagedSyncer creates a Syncer, the same as makeSyncer, that stores the
+// synced blocks in the publisher's staging area if the Subscriber stages
+// blocks.
+func (s *Subscriber) makeStagedSyncer(peerID peer.ID, peerAddrs []multiaddr.Multiaddr, addrTTL time.Duration, rateLimiter *rate.Limiter) (Syncer, bool, error) {
+	if s.staging == nil {
+		return s.makeSyncer(peerID, peerAddrs, addrTTL, rateLimiter, nil)
+	}
+	lsys := s.staging.linkSystem(peerID)
+	syncer, isHttp, err := s.makeSyncer(peerID, peerAddrs, addrTTL, rateLimiter, &lsys)
+	if err != nil {
+		return nil, false, err
+	}
+	return &stagedSyncer{Syncer: syncer}, isHttp, nil
+}
+
+// StagedBlocks returns the CIDs of the blocks that are staged for the
+// specified publisher. Blocks are only left staged by a sync that failed, and
+// are kept for inspection until the next sync with the publisher starts, or
+// until they are removed by DiscardStaged. Returns an error if the Subscriber
+// was not created with the StagingDatastore option.
+func (s *Subscriber) StagedBlocks(ctx context.Context, peerID peer.ID) ([]cid.Cid, error) {
+	if s.staging == nil {
+		return nil, errNoStaging
+	}
+	return s.staging.list(ctx, peerID)
+}
+
+// DiscardStaged removes the blocks that are staged for the specified
+// publisher. Returns an error if the Subscriber was not created with the
+// StagingDatastore option.
+func (s *Subscriber) DiscardStaged(ctx context.Context, peerID peer.ID) error {
+	if s.staging == nil {
+		return errNoStaging
+	}
+	return s.staging.clear(ctx, peerID)
+}
@@ -0,0 +1,108 @@
+package legs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStagingDatastore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	defer srcHost.Close()
+	srcLnkS := test.MkLinkSystem(srcStore)
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	dstLnkS := test.MkLinkSystem(dstStore)
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	stagingStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	sub, err := NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil, StagingDatastore(stagingStore))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	chainLnks := test.MkChain(srcLnkS, true)
+	headCid := chainLnks[0].(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(ctx, headCid))
+
+	// Remove the last block of the chain from the publisher, so that the sync
+	// fails after the other blocks are transferred.
+	lastKey := datastore.NewKey(chainLnks[3].String())
+	lastData, err := srcStore.Get(ctx, lastKey)
+	require.NoError(t, err)
+	require.NoError(t, srcStore.Delete(ctx, lastKey))
+
+	_, err = sub.Sync(ctx, srcHost.ID(), headCid, nil, nil)
+	require.Error(t, err)
+
+	// The transferred blocks are staged, and not stored.
+	staged, err := sub.StagedBlocks(ctx, srcHost.ID())
+	require.NoError(t, err)
+	require.Contains(t, staged, headCid)
+	for _, lnk := range chainLnks {
+		has, err := dstStore.Has(ctx, datastore.NewKey(lnk.String()))
+		require.NoError(t, err)
+		require.False(t, has, "block of failed sync stored")
+	}
+
+	// Once the publisher has all blocks, the sync succeeds and the blocks are
+	// committed.
+	require.NoError(t, srcStore.Put(ctx, lastKey, lastData))
+	_, err = sub.Sync(ctx, srcHost.ID(), headCid, nil, nil)
+	require.NoError(t, err)
+	for _, lnk := range chainLnks {
+		has, err := dstStore.Has(ctx, datastore.NewKey(lnk.String()))
+		require.NoError(t, err)
+		require.True(t, has, "block of successful sync not stored")
+	}
+	staged, err = sub.StagedBlocks(ctx, srcHost.ID())
+	require.NoError(t, err)
+	require.Empty(t, staged)
+}
+
+func TestDiscardStaged(t *testing.T) {
+	ctx := context.Background()
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstLnkS := test.MkLinkSystem(dstStore)
+
+	sub, err := NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil)
+	require.NoError(t, err)
+	_, err = sub.StagedBlocks(ctx, dstHost.ID())
+	require.ErrorIs(t, err, errNoStaging)
+	require.NoError(t, sub.Close())
+
+	stagingStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	sub, err = NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil, StagingDatastore(stagingStore))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// Stage blocks as a sync would.
+	lsys := sub.staging.linkSystem(dstHost.ID())
+	chainLnks := test.MkChain(lsys, true)
+	staged, err := sub.StagedBlocks(ctx, dstHost.ID())
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(staged), len(chainLnks))
+
+	require.NoError(t, sub.DiscardStaged(ctx, dstHost.ID()))
+	staged, err = sub.StagedBlocks(ctx, dstHost.ID())
+	require.NoError(t, err)
+	require.Empty(t, staged)
+}
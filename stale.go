@@ -0,0 +1,140 @@
+package legs
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// minCadenceAnnounces is the number of announces that must be received from a
+// publisher before it has a cadence that it can be considered stale by.
+const minCadenceAnnounces = 3
+
+// PublisherStale notifies that a publisher, which previously announced
+// regularly, has been silent for longer than the configured multiple of its
+// announce cadence. See: StaleAnnounce.
+type PublisherStale struct {
+	// PeerID identifies the publisher.
+	PeerID peer.ID
+	// LastAnnounce is the time the last announce was received from the
+	// publisher.
+	LastAnnounce time.Time
+	// Cadence is the average time between announces from the publisher.
+	Cadence time.Duration
+	// Silence is the time since the last announce when the publisher was
+	// found to be stale.
+	Silence time.Duration
+}
+
+// PublisherStaleHookFunc is the signature of a function that is called when a
+// publisher is found to be stale.
+type PublisherStaleHookFunc func(PublisherStale)
+
+// announceCadence tracks when announces are received from a publisher.
+type announceCadence struct {
+	count int
+	first time.Time
+	last  time.Time
+	// stale is true if the publisher has been reported stale since its last
+	// announce.
+	stale bool
+}
+
+// cadence returns the average time between announces.
+func (ac *announceCadence) cadence() time.Duration {
+	return ac.last.Sub(ac.first) / time.Duration(ac.count-1)
+}
+
+// recordAnnounce records that an announce was received from the publisher, if
+// stale publishers are watched for.
+func (s *Subscriber) recordAnnounce(peerID peer.ID) {
+	if s.staleMultiple == 0 {
+		return
+	}
+	now := time.Now()
+
+	s.cadenceMutex.Lock()
+	defer s.cadenceMutex.Unlock()
+
+	ac, ok := s.cadences[peerID]
+	if !ok {
+		s.cadences[peerID] = &announceCadence{
+			count: 1,
+			first: now,
+			last:  now,
+		}
+		return
+	}
+	if ac.stale {
+		// Restart the cadence of a publisher that was stale, since the silence
+		// is not part of its regular cadence.
+		*ac = announceCadence{first: now}
+	}
+	ac.count++
+	ac.last = now
+}
+
+// forgetCadence stops tracking the announce cadence of a publisher whose
+// handler was removed.
+func (s *Subscriber) forgetCadence(peerID peer.ID) {
+	s.cadenceMutex.Lock()
+	delete(s.cadences, peerID)
+	s.cadenceMutex.Unlock()
+}
+
+// checkStale reports each publisher that has been silent for longer than the
+// stale multiple of its announce cadence, and polls the publisher for its head
+// if configured to do so. A publisher is reported once, until it announces
+// again.
+func (s *Subscriber) checkStale(ctx context.Context) {
+	now := time.Now()
+	var stale []PublisherStale
+	s.cadenceMutex.Lock()
+	for peerID, ac := range s.cadences {
+		if ac.stale || ac.count < minCadenceAnnounces {
+			continue
+		}
+		cadence := ac.cadence()
+		silence := now.Sub(ac.last)
+		if silence <= time.Duration(float64(cadence)*s.staleMultiple) {
+			continue
+		}
+		ac.stale = true
+		stale = append(stale, PublisherStale{
+			PeerID:       peerID,
+			LastAnnounce: ac.last,
+			Cadence:      cadence,
+			Silence:      silence,
+		})
+	}
+	s.cadenceMutex.Unlock()
+
+	for _, ps := range stale {
+		log.Warnw("Publisher stopped announcing", "publisher", ps.PeerID, "lastAnnounce", ps.LastAnnounce, "cadence", ps.Cadence)
+		if s.staleHook != nil {
+			s.staleHook(ps)
+		}
+		if s.stalePoll {
+			s.pollHead(ctx, ps.PeerID)
+		}
+	}
+}
+
+// pollHead syncs the head of a stale publisher in the background, so that any
+// updates missed by not receiving announces are synced.
+func (s *Subscriber) pollHead(ctx context.Context, peerID peer.ID) {
+	s.asyncWG.Add(1)
+	go func() {
+		defer s.asyncWG.Done()
+		c, err := s.Sync(ctx, peerID, cid.Undef, nil, nil, syncSource(SyncSourcePoll))
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Errorw("Cannot poll head of stale publisher", "err", err, "publisher", peerID)
+			}
+			return
+		}
+		log.Infow("Polled head of stale publisher", "publisher", peerID, "cid", c)
+	}()
+}
@@ -0,0 +1,145 @@
+package legs_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublisherStale(t *testing.T) {
+	pubSys := newHostSystem(t)
+	subSys := newHostSystem(t)
+	defer pubSys.close()
+	defer subSys.close()
+
+	staleEvents := make(chan legs.PublisherStale, 1)
+	subOpts := []legs.Option{
+		legs.StaleAnnounce(3, 10*time.Millisecond),
+		legs.PublisherStaleHook(func(ps legs.PublisherStale) {
+			staleEvents <- ps
+		}),
+		legs.StaleAnnouncePoll(true),
+	}
+	pubAddr, pub, sub := legsPubSubBuilder{IsHttp: true}.Build(t, testTopic, pubSys, subSys, subOpts)
+	defer pub.Close()
+	defer sub.Close()
+
+	watcher, cncl := sub.OnSyncFinished()
+	defer cncl()
+
+	ctx := context.Background()
+	pubID := pubSys.host.ID()
+	var prev cidlink.Link
+	for i := 0; i < 3; i++ {
+		var head cidlink.Link
+		if i == 0 {
+			head = llBuilder{Length: 1, Seed: int64(i)}.Build(t, pubSys.lsys).(cidlink.Link)
+		} else {
+			head = llBuilder{Length: 1, Seed: int64(i)}.BuildWithPrev(t, pubSys.lsys, prev).(cidlink.Link)
+		}
+		require.NoError(t, pub.SetRoot(ctx, head.Cid))
+		require.NoError(t, sub.Announce(ctx, head.Cid, pubID, []multiaddr.Multiaddr{pubAddr}))
+		select {
+		case event := <-watcher:
+			require.Equal(t, head.Cid, event.Cid)
+			require.Equal(t, legs.SyncSourceDirect, event.Source)
+		case <-time.After(updateTimeout):
+			t.Fatal("timed out waiting for sync to finish")
+		}
+		prev = head
+	}
+
+	// Update the publisher's head without announcing it.
+	unannounced := llBuilder{Length: 1, Seed: 3}.BuildWithPrev(t, pubSys.lsys, prev).(cidlink.Link)
+	require.NoError(t, pub.SetRoot(ctx, unannounced.Cid))
+
+	select {
+	case ps := <-staleEvents:
+		require.Equal(t, pubID, ps.PeerID)
+		require.NotZero(t, ps.Cadence)
+		require.Greater(t, ps.Silence, 3*ps.Cadence)
+	case <-time.After(updateTimeout):
+		t.Fatal("timed out waiting for publisher to be stale")
+	}
+
+	// The stale publisher's head is polled.
+	select {
+	case event := <-watcher:
+		require.Equal(t, unannounced.Cid, event.Cid)
+		require.Equal(t, legs.SyncSourcePoll, event.Source)
+	case <-time.After(updateTimeout):
+		t.Fatal("timed out waiting for poll of stale publisher")
+	}
+
+	// The publisher is reported stale only once until it announces again.
+	select {
+	case <-staleEvents:
+		t.Fatal("stale publisher reported again")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPublisherStaleRemoved(t *testing.T) {
+	pubSys := newHostSystem(t)
+	subSys := newHostSystem(t)
+	defer pubSys.close()
+	defer subSys.close()
+
+	staleEvents := make(chan legs.PublisherStale, 1)
+	subOpts := []legs.Option{
+		legs.StaleAnnounce(3, 10*time.Millisecond),
+		legs.PublisherStaleHook(func(ps legs.PublisherStale) {
+			staleEvents <- ps
+		}),
+	}
+	pubAddr, pub, sub := legsPubSubBuilder{IsHttp: true}.Build(t, testTopic, pubSys, subSys, subOpts)
+	defer pub.Close()
+	defer sub.Close()
+
+	watcher, cncl := sub.OnSyncFinished()
+	defer cncl()
+
+	ctx := context.Background()
+	pubID := pubSys.host.ID()
+	start := time.Now()
+	var prev cidlink.Link
+	for i := 0; i < 3; i++ {
+		var head cidlink.Link
+		if i == 0 {
+			head = llBuilder{Length: 1, Seed: int64(i)}.Build(t, pubSys.lsys).(cidlink.Link)
+		} else {
+			head = llBuilder{Length: 1, Seed: int64(i)}.BuildWithPrev(t, pubSys.lsys, prev).(cidlink.Link)
+		}
+		require.NoError(t, pub.SetRoot(ctx, head.Cid))
+		require.NoError(t, sub.Announce(ctx, head.Cid, pubID, []multiaddr.Multiaddr{pubAddr}))
+		select {
+		case <-watcher:
+		case <-time.After(updateTimeout):
+			t.Fatal("timed out waiting for sync to finish")
+		}
+		prev = head
+	}
+
+	// A removed publisher is no longer tracked, so it is never reported stale,
+	// even after a silence of many times its cadence.
+	require.True(t, sub.RemoveHandler(pubID))
+	select {
+	case <-staleEvents:
+		t.Fatal("removed publisher reported stale")
+	case <-time.After(10*time.Since(start) + 100*time.Millisecond):
+	}
+}
+
+func TestStaleAnnounceOption(t *testing.T) {
+	subSys := newHostSystem(t)
+	defer subSys.close()
+	_, err := legs.NewSubscriber(subSys.host, subSys.ds, subSys.lsys, testTopic, nil, legs.StaleAnnounce(0.5, time.Second))
+	require.Error(t, err)
+	_, err = legs.NewSubscriber(subSys.host, subSys.ds, subSys.lsys, testTopic, nil, legs.StaleAnnounce(2, 0))
+	require.Error(t, err)
+}
@@ -0,0 +1,176 @@
+package legs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// stateVersion is the version of the format written by ExportState.
+const stateVersion = 1
+
+// subscriberState is the format written by ExportState and read by
+// ImportState.
+type subscriberState struct {
+	Version    int              `json:"version"`
+	Topic      string           `json:"topic"`
+	Publishers []publisherState `json:"publishers"`
+}
+
+// publisherState is the exported state of a single publisher.
+type publisherState struct {
+	PeerID     peer.ID  `json:"peerID"`
+	LatestSync cid.Cid  `json:"latestSync"`
+	Addrs      []string `json:"addrs,omitempty"`
+}
+
+// ExportState writes the latest sync of each publisher, and the addresses of
+// the publisher if any are known, to w. The written state can be given to
+// ImportState of another Subscriber, to migrate the state of this Subscriber
+// or to seed a new Subscriber.
+//
+// The exported publishers are the ones that the Subscriber has handlers for,
+// and if the LatestSyncHandler implements LatestSyncLister, the ones that the
+// handler lists.
+func (s *Subscriber) ExportState(w io.Writer) error {
+	if err := json.NewEncoder(w).Encode(s.exportState()); err != nil {
+		return fmt.Errorf("cannot write state: %w", err)
+	}
+	return nil
+}
+
+// exportState returns the state of the Subscriber that ExportState writes.
+func (s *Subscriber) exportState() *subscriberState {
+	peerIDs := make(map[peer.ID]struct{})
+	s.handlersMutex.Lock()
+	for peerID := range s.handlers {
+		peerIDs[peerID] = struct{}{}
+	}
+	s.handlersMutex.Unlock()
+	if lister, ok := s.latestSyncHander.(LatestSyncLister); ok {
+		for _, peerID := range lister.LatestSyncPeers() {
+			peerIDs[peerID] = struct{}{}
+		}
+	}
+
+	state := subscriberState{
+		Version:    stateVersion,
+		Topic:      s.receiver.TopicName(),
+		Publishers: []publisherState{},
+	}
+	for peerID := range peerIDs {
+		latestSync, ok := s.getLatestSync(peerID)
+		if !ok || latestSync == cid.Undef {
+			continue
+		}
+		pub := publisherState{
+			PeerID:     peerID,
+			LatestSync: latestSync,
+		}
+		for _, a := range s.publisherAddrs(peerID) {
+			pub.Addrs = append(pub.Addrs, a.String())
+		}
+		state.Publishers = append(state.Publishers, pub)
+	}
+	sort.Slice(state.Publishers, func(i, j int) bool {
+		return state.Publishers[i].PeerID < state.Publishers[j].PeerID
+	})
+	return &state
+}
+
+// ImportState reads state written by ExportState from r, and sets the latest
+// sync of each publisher in it. The publisher addresses in the state are added
+// to the peerstore with the Subscriber's address TTL. The state is read
+// completely before any of it is imported, so that no state is imported if r
+// is not valid.
+func (s *Subscriber) ImportState(r io.Reader) error {
+	state, err := readState(r)
+	if err != nil {
+		return err
+	}
+	n, err := s.importState(state, false)
+	if err != nil {
+		return err
+	}
+	log.Infow("Imported state", "publishers", n, "topic", state.Topic)
+	return nil
+}
+
+// readState reads and validates state written by ExportState.
+func readState(r io.Reader) (subscriberState, error) {
+	var state subscriberState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return state, fmt.Errorf("cannot read state: %w", err)
+	}
+	if state.Version != stateVersion {
+		return state, fmt.Errorf("unsupported state version: %d", state.Version)
+	}
+	for _, pub := range state.Publishers {
+		if pub.PeerID.Validate() != nil {
+			return state, errors.New("state has invalid publisher peer id")
+		}
+		if pub.LatestSync == cid.Undef {
+			return state, fmt.Errorf("state has no latest sync for publisher %s", pub.PeerID)
+		}
+		for _, a := range pub.Addrs {
+			if _, err := multiaddr.NewMultiaddr(a); err != nil {
+				return state, fmt.Errorf("state has invalid address for publisher %s: %w", pub.PeerID, err)
+			}
+		}
+	}
+	return state, nil
+}
+
+// importState sets the latest sync of each publisher in state, and adds the
+// publisher addresses to the peerstore. If onlyNew is true, then the latest
+// sync is only set for publishers that have no latest sync. Returns the number
+// of publishers whose latest sync was set.
+func (s *Subscriber) importState(state subscriberState, onlyNew bool) (int, error) {
+	var count int
+	for _, pub := range state.Publishers {
+		if onlyNew {
+			if _, ok := s.getLatestSync(pub.PeerID); ok {
+				s.addPublisherAddrs(pub)
+				continue
+			}
+		}
+		if err := s.SetLatestSync(pub.PeerID, pub.LatestSync); err != nil {
+			return count, fmt.Errorf("cannot set latest sync of publisher %s: %w", pub.PeerID, err)
+		}
+		s.addPublisherAddrs(pub)
+		count++
+	}
+	return count, nil
+}
+
+// addPublisherAddrs adds the addresses of the publisher to the http peerstore
+// if they are http addresses, and otherwise to the host's peerstore.
+func (s *Subscriber) addPublisherAddrs(pub publisherState) {
+	for _, a := range pub.Addrs {
+		addr, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			continue
+		}
+		if isHTTPAddr(addr) {
+			s.httpPeerstore.AddAddr(pub.PeerID, addr, s.addrTTL)
+		} else if peerStore := s.host.Peerstore(); peerStore != nil {
+			peerStore.AddAddr(pub.PeerID, addr, s.addrTTL)
+		}
+	}
+}
+
+// publisherAddrs returns the addresses of the publisher that are in the
+// host's peerstore and in the http peerstore.
+func (s *Subscriber) publisherAddrs(peerID peer.ID) []multiaddr.Multiaddr {
+	var addrs []multiaddr.Multiaddr
+	if peerStore := s.host.Peerstore(); peerStore != nil {
+		addrs = append(addrs, peerStore.Addrs(peerID)...)
+	}
+	return append(addrs, s.httpPeerstore.Addrs(peerID)...)
+}
@@ -0,0 +1,175 @@
+package legs
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// maxSyncFailures is the number of recent sync failures kept for Status.
+const maxSyncFailures = 32
+
+// SubscriberStatus is a snapshot of what a Subscriber is doing, returned by
+// Subscriber.Status.
+type SubscriberStatus struct {
+	// Pending lists the announcements that are waiting to be synced, with at
+	// most one for each publisher. An announcement waits while a sync with
+	// the same publisher is running, while syncing is paused, or while the
+	// maximum number of announced syncs are running. The LastSynced time of
+	// each is not set.
+	Pending []PendingSync `json:"pending"`
+	// Active lists the syncs that are running, oldest first.
+	Active []ActiveSync `json:"active"`
+	// Failures lists the most recent syncs that failed, oldest first.
+	Failures []SyncFailure `json:"failures"`
+}
+
+// ActiveSync describes a sync that is running.
+type ActiveSync struct {
+	// PeerID identifies the publisher that is synced with.
+	PeerID peer.ID `json:"peerID"`
+	// Cid is the CID that is synced.
+	Cid cid.Cid `json:"cid"`
+	// Source is what caused the sync.
+	Source SyncSource `json:"source"`
+	// Started is when the sync started.
+	Started time.Time `json:"started"`
+	// Elapsed is how long the sync has been running.
+	Elapsed time.Duration `json:"elapsed"`
+	// SyncedBlocks is the number of blocks that the sync has reached so far.
+	SyncedBlocks int `json:"syncedBlocks"`
+}
+
+// SyncFailure describes a sync that failed.
+type SyncFailure struct {
+	// PeerID identifies the publisher that was synced with.
+	PeerID peer.ID `json:"peerID"`
+	// Cid is the CID that was synced.
+	Cid cid.Cid `json:"cid"`
+	// Source is what caused the sync.
+	Source SyncSource `json:"source"`
+	// Failed is when the sync failed.
+	Failed time.Time `json:"failed"`
+	// Reason is the metrics reason of the failure, such as "timeout". See:
+	// metrics.ReasonError.
+	Reason string `json:"reason"`
+	// Err is the error that the sync failed with.
+	Err error `json:"-"`
+}
+
+// activeSync is a running sync tracked by syncStatus.
+type activeSync struct {
+	peerID  peer.ID
+	cid     cid.Cid
+	source  SyncSource
+	started time.Time
+	blocks  int64
+}
+
+// addBlock counts a block reached by the sync. Does nothing if a is nil.
+func (a *activeSync) addBlock() {
+	if a != nil {
+		atomic.AddInt64(&a.blocks, 1)
+	}
+}
+
+// syncStatus tracks the running syncs and the recent sync failures.
+type syncStatus struct {
+	active   map[*activeSync]struct{}
+	failures []SyncFailure
+	mutex    sync.Mutex
+}
+
+func newSyncStatus() *syncStatus {
+	return &syncStatus{
+		active: make(map[*activeSync]struct{}),
+	}
+}
+
+// start adds a running sync.
+func (st *syncStatus) start(peerID peer.ID, c cid.Cid, source SyncSource, started time.Time) *activeSync {
+	a := &activeSync{
+		peerID:  peerID,
+		cid:     c,
+		source:  source,
+		started: started,
+	}
+	st.mutex.Lock()
+	st.active[a] = struct{}{}
+	st.mutex.Unlock()
+	return a
+}
+
+// end removes a running sync, and records its failure if err is not nil.
+func (st *syncStatus) end(a *activeSync, err error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	delete(st.active, a)
+	if err == nil {
+		return
+	}
+	if len(st.failures) == maxSyncFailures {
+		copy(st.failures, st.failures[1:])
+		st.failures = st.failures[:maxSyncFailures-1]
+	}
+	st.failures = append(st.failures, SyncFailure{
+		PeerID: a.peerID,
+		Cid:    a.cid,
+		Source: a.source,
+		Failed: time.Now(),
+		Reason: syncFailReason(err),
+		Err:    err,
+	})
+}
+
+// Status returns a snapshot of the announcements waiting to be synced, the
+// syncs that are running, and the syncs that failed recently.
+func (s *Subscriber) Status() SubscriberStatus {
+	var status SubscriberStatus
+
+	s.handlersMutex.Lock()
+	for peerID, h := range s.handlers {
+		h.qlock.Lock()
+		if h.pendingCid != cid.Undef {
+			status.Pending = append(status.Pending, PendingSync{
+				PeerID:   peerID,
+				Cid:      h.pendingCid,
+				IsRecord: h.pendingIsRecord,
+				Source:   h.pendingSource,
+				Received: h.pendingReceived,
+			})
+		}
+		h.qlock.Unlock()
+	}
+	s.handlersMutex.Unlock()
+	sort.Slice(status.Pending, func(i, j int) bool {
+		return status.Pending[i].Received.Before(status.Pending[j].Received)
+	})
+
+	now := time.Now()
+	s.syncStatus.mutex.Lock()
+	for a := range s.syncStatus.active {
+		status.Active = append(status.Active, ActiveSync{
+			PeerID:       a.peerID,
+			Cid:          a.cid,
+			Source:       a.source,
+			Started:      a.started,
+			Elapsed:      now.Sub(a.started),
+			SyncedBlocks: int(atomic.LoadInt64(&a.blocks)),
+		})
+	}
+	if len(s.syncStatus.failures) != 0 {
+		status.Failures = make([]SyncFailure, len(s.syncStatus.failures))
+		copy(status.Failures, s.syncStatus.failures)
+	}
+	s.syncStatus.mutex.Unlock()
+	sort.Slice(status.Active, func(i, j int) bool {
+		return status.Active[i].Started.Before(status.Active[j].Started)
+	})
+
+	return status
+}
@@ -0,0 +1,82 @@
+package legs_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatus(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	te := setupPublisherSubscriber(t, nil)
+	pubID := te.srcHost.ID()
+	require.Empty(t, te.sub.Status().Active)
+
+	head := test.MkChain(te.srcLinkSys, true)[0].(cidlink.Link).Cid
+	require.NoError(t, te.pub.SetRoot(ctx, head))
+
+	// A sync in progress is active, and counts its blocks.
+	var active []legs.ActiveSync
+	var blocks int
+	_, err := te.sub.Sync(ctx, pubID, head, nil, te.pubAddr,
+		legs.ScopedBlockHook(func(peer.ID, cid.Cid, legs.SegmentSyncActions) {
+			blocks++
+			active = te.sub.Status().Active
+		}))
+	require.NoError(t, err)
+	require.Len(t, active, 1)
+	require.Equal(t, pubID, active[0].PeerID)
+	require.Equal(t, head, active[0].Cid)
+	require.Equal(t, legs.SyncSourceSync, active[0].Source)
+	require.Equal(t, blocks, active[0].SyncedBlocks)
+
+	status := te.sub.Status()
+	require.Empty(t, status.Active)
+	require.Empty(t, status.Failures)
+
+	// An announcement waits while syncing is paused.
+	te.sub.Pause()
+	head = test.MkChain(te.srcLinkSys, true)[0].(cidlink.Link).Cid
+	require.NoError(t, te.pub.SetRoot(ctx, head))
+	watcher, cancelWatcher := te.sub.OnSyncFinished()
+	defer cancelWatcher()
+	require.NoError(t, te.sub.Announce(ctx, head, pubID, []multiaddr.Multiaddr{te.pubAddr}))
+	require.Eventually(t, func() bool {
+		return len(te.sub.Status().Pending) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	pending := te.sub.Status().Pending[0]
+	require.Equal(t, pubID, pending.PeerID)
+	require.Equal(t, head, pending.Cid)
+	require.Equal(t, legs.SyncSourceDirect, pending.Source)
+
+	te.sub.Resume()
+	select {
+	case <-watcher:
+	case <-ctx.Done():
+		t.Fatal("announced sync did not finish")
+	}
+	require.Empty(t, te.sub.Status().Pending)
+
+	// A failed sync is reported with its reason.
+	cids, err := test.RandomCids(1)
+	require.NoError(t, err)
+	missing := cids[0]
+	_, err = te.sub.Sync(ctx, pubID, missing, nil, te.pubAddr)
+	require.Error(t, err)
+	failures := te.sub.Status().Failures
+	require.Len(t, failures, 1)
+	require.Equal(t, pubID, failures[0].PeerID)
+	require.Equal(t, missing, failures[0].Cid)
+	require.NotEmpty(t, failures[0].Reason)
+	require.Error(t, failures[0].Err)
+}
@@ -4,24 +4,37 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"sync"
 	"time"
 
 	"github.com/filecoin-project/go-legs/announce"
+	"github.com/filecoin-project/go-legs/announce/gossiptopic"
+	"github.com/filecoin-project/go-legs/bsutil"
+	"github.com/filecoin-project/go-legs/carutil"
 	"github.com/filecoin-project/go-legs/dtsync"
 	"github.com/filecoin-project/go-legs/httpsync"
+	"github.com/filecoin-project/go-legs/internal/tracing"
+	"github.com/filecoin-project/go-legs/metrics"
+	"github.com/filecoin-project/go-legs/migrations"
 	"github.com/hashicorp/go-multierror"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
 	"github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
 	"github.com/multiformats/go-multiaddr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/time/rate"
 )
 
@@ -59,8 +72,20 @@ type Subscriber struct {
 	// ExploreRecursiveWithStopNode.
 	dss  ipld.Node
 	host host.Host
+	lsys ipld.LinkSystem
+	// publisherLsys holds the link system that each publisher's blocks are
+	// stored in.
+	publisherLsys *publisherLinkSystems
 
 	addrTTL time.Duration
+	// transportPolicy orders the addresses of a publisher to decide how to
+	// sync with it.
+	transportPolicy TransportPolicyFunc
+	// relaySync is true if syncs over libp2p may use relayed connections.
+	relaySync bool
+	// holePunchWait is how long to wait for a direct connection with a
+	// publisher that is connected through a relay.
+	holePunchWait time.Duration
 
 	handlers      map[peer.ID]*handler
 	handlersMutex sync.Mutex
@@ -68,9 +93,27 @@ type Subscriber struct {
 	// A map of block hooks to call for a specific peer id if the
 	// generalBlockHook is overridden within a sync via ScopedBlockHook sync
 	// option.
-	scopedBlockHook      map[peer.ID]func(peer.ID, cid.Cid)
+	scopedBlockHook      map[peer.ID]func(peer.ID, cid.Cid, bool)
 	scopedBlockHookMutex *sync.RWMutex
 	generalBlockHook     BlockHookFunc
+	// orderedHook is true if block hooks are called in traversal order. See:
+	// OrderedBlockHook.
+	orderedHook bool
+	// dedupHook is true if block hooks are called once for each CID in a
+	// sync. See: DedupBlockHook.
+	dedupHook bool
+	// peerBlockHooks are block hooks that are called instead of the
+	// generalBlockHook for specific publishers.
+	peerBlockHooks      map[peer.ID]BlockHookFunc
+	peerBlockHooksMutex sync.RWMutex
+	// pubConfigs is the configuration of specific publishers, set with a
+	// PublisherHandler.
+	pubConfigs      map[peer.ID]*pubConfig
+	pubConfigsMutex sync.RWMutex
+	// resumed is closed when syncing of announcements is resumed. It is nil
+	// if syncing is not paused. See: Pause.
+	resumed    chan struct{}
+	pauseMutex sync.Mutex
 
 	// inEvents is used to send a SyncFinished from a peer handler to the
 	// distributeEvents goroutine.
@@ -78,7 +121,21 @@ type Subscriber struct {
 
 	// outEventsChans is a slice of channels, where each channel delivers a
 	// copy of a SyncFinished to an OnSyncFinished reader.
-	outEventsChans []chan SyncFinished
+	outEventsChans []watchChan[SyncFinished]
+	// announceEventsChans is a slice of channels, where each channel delivers
+	// a copy of an AnnouncementReceived to an OnAnnouncement reader.
+	announceEventsChans []watchChan[AnnouncementReceived]
+	// progressEventsChans is a slice of channels, where each channel
+	// delivers a copy of a SyncProgress to an OnSyncProgress reader.
+	progressEventsChans []watchChan[SyncProgress]
+	// pauseEventsChans is a slice of channels, where each channel delivers a
+	// copy of a SyncPaused to an OnSyncPaused reader.
+	pauseEventsChans []watchChan[SyncPaused]
+	// quotaEventsChans is a slice of channels, where each channel delivers a
+	// copy of a QuotaExceeded to an OnQuotaExceeded reader.
+	quotaEventsChans []watchChan[QuotaExceeded]
+	// outEventsMutex protects outEventsChans, announceEventsChans,
+	// progressEventsChans, pauseEventsChans, and quotaEventsChans.
 	outEventsMutex sync.Mutex
 
 	// closing signals that the Subscriber is closing.
@@ -101,14 +158,78 @@ type Subscriber struct {
 	// transport.
 	httpPeerstore peerstore.Peerstore
 
+	// publishersProtocol is the protocol that known publishers are served on,
+	// if the Subscriber serves them.
+	publishersProtocol protocol.ID
+
 	idleHandlerTTL   time.Duration
 	latestSyncHander LatestSyncHandler
+	// topicLatestSync is set if the latest sync is tracked separately for
+	// each topic, and is the same as latestSyncHander.
+	topicLatestSync TopicLatestSyncHandler
 
 	segDepthLimit int64
 
 	rateLimiterFor RateLimiterFor
 
 	receiver *announce.Receiver
+	// shouldSync decides whether to sync an announced CID.
+	shouldSync ShouldSyncFunc
+	// syncQueue limits the number of announced syncs that run at once. It
+	// is nil if there is no limit.
+	syncQueue *syncQueue
+
+	verifyFailedHook VerifyFailedHookFunc
+	verifyRepair     bool
+
+	skipList *skipList
+	// journal records received announcements. It is nil if announcements
+	// are not recorded.
+	journal *announceJournal
+	// metrics records announcements and syncs. It is nil if metrics are not
+	// enabled.
+	metrics *metrics.Metrics
+	// eventSink receives structured events of announcements and syncs. It
+	// is nil if there is none.
+	eventSink EventSink
+	// hostEvents emits events on the host's event bus. It is nil if events
+	// are not emitted on the bus. See: HostEvents.
+	hostEvents *hostEvents
+	// tracer creates the spans that trace the handling of announcements
+	// and syncs.
+	tracer trace.Tracer
+	// syncStatus tracks the running syncs and the recent sync failures
+	// reported by Status.
+	syncStatus *syncStatus
+	// staging holds synced blocks until their sync succeeds. It is nil if
+	// blocks are not staged.
+	staging *stagingArea
+	// quotas limits the bytes that syncs store for each publisher. It is nil
+	// if there are no storage quotas.
+	quotas *storageQuotas
+	// writeBatch holds synced blocks until they are written to storage in
+	// batches. It is nil if writes are not batched.
+	writeBatch *writeBatch
+	// syncState creates the sets and queues that hold the traversal state of
+	// syncs. It is nil if the state is kept in memory.
+	syncState *syncStateStore
+	// headSyncs tracks the heads being synced, so that publishers announcing
+	// the same head share its sync. It is nil if syncs are not shared.
+	headSyncs *headSyncs
+	// progressInterval is the number of blocks synced between SyncProgress
+	// events. SyncProgress events are disabled if it is zero.
+	progressInterval int
+	// chainWalker delivers the new nodes of publishers' chains after syncs.
+	// It is nil if there is no chain walker.
+	chainWalker *chainWalker
+
+	// cadences tracks the announces received from each publisher, when
+	// watching for stale publishers. See: StaleAnnounce.
+	cadences      map[peer.ID]*announceCadence
+	cadenceMutex  sync.Mutex
+	staleMultiple float64
+	staleHook     PublisherStaleHookFunc
+	stalePoll     bool
 }
 
 // SyncFinished notifies an OnSyncFinished reader that a specified peer
@@ -123,8 +244,69 @@ type SyncFinished struct {
 	// A list of cids that this sync acquired. In order from latest to oldest.
 	// The latest cid will always be at the beginning.
 	SyncedCids []cid.Cid
+	// SkippedCids lists the cids in the skip list that this sync reached and
+	// did not sync. See: Subscriber.SkipCids.
+	SkippedCids []cid.Cid
+	// Source is what caused the sync, which tells how the synced head
+	// arrived.
+	Source SyncSource
+	// Transport is the transport that the sync was done over, as chosen by
+	// the TransportPolicy.
+	Transport Transport
 }
 
+// AnnouncementReceived notifies an OnAnnouncement reader that an announcement
+// was received from a publisher, before any sync of the announced CID starts.
+// Only announcements that pass filtering, such as by the AllowPeer function and
+// the check for already announced CIDs, are delivered.
+type AnnouncementReceived struct {
+	// Cid is the announced CID. If IsRecord is true, this identifies an
+	// announcement record that holds the announced CID.
+	Cid cid.Cid
+	// PeerID identifies the publisher that made the announcement.
+	PeerID peer.ID
+	// Addrs are the publisher addresses given in the announcement.
+	Addrs []multiaddr.Multiaddr
+	// Topic is the topic that the Subscriber receives announcements on.
+	Topic string
+	// IsRecord is true if Cid identifies an announcement record.
+	IsRecord bool
+	// Metadata is the IPLD metadata node that the publisher attached to the
+	// announcement, or nil if there is none. It is not part of the synced DAG.
+	// If IsRecord is true, then any metadata is held in the record instead.
+	Metadata ipld.Node
+	// Source is how the announcement arrived.
+	Source SyncSource
+}
+
+// SyncSource identifies what caused a sync.
+type SyncSource string
+
+const (
+	// SyncSourceGossip is a sync of an announcement received over gossip
+	// pubsub.
+	SyncSourceGossip = SyncSource(announce.SourceGossip)
+	// SyncSourceDirect is a sync of an announcement passed to
+	// Subscriber.Announce, such as one received by an HTTP announce endpoint.
+	SyncSourceDirect = SyncSource(announce.SourceDirect)
+	// SyncSourceStream is a sync of an announcement sent directly to the
+	// Subscriber's host over the announce.ProtocolID stream protocol. See:
+	// StreamAnnounce.
+	SyncSourceStream = SyncSource(announce.SourceStream)
+	// SyncSourcePoll is a sync of the head of a publisher that stopped
+	// announcing. See: StaleAnnouncePoll.
+	SyncSourcePoll SyncSource = "poll"
+	// SyncSourceSync is a sync requested by calling Subscriber.Sync or
+	// Subscriber.SyncAt.
+	SyncSourceSync SyncSource = "sync"
+	// SyncSourceImport is a sync of a CAR file passed to
+	// Subscriber.ImportCAR.
+	SyncSourceImport SyncSource = "import"
+	// SyncSourceRepair is a sync of missing blocks found by verifying the last
+	// sync with a publisher. See: Subscriber.RepairLastSync.
+	SyncSourceRepair SyncSource = "repair"
+)
+
 // handler holds state that is specific to a peer
 type handler struct {
 	subscriber *Subscriber
@@ -141,25 +323,65 @@ type handler struct {
 	pendingCid cid.Cid
 	// pendingSyncer is a syncer queued for handling pendingCid.
 	pendingSyncer Syncer
-	// qlock protects the pendingCid and pendingSyncer.
+	// pendingIsRecord is true if pendingCid identifies an announcement record.
+	pendingIsRecord bool
+	// pendingSource is the source of the announcement of pendingCid.
+	pendingSource SyncSource
+	// pendingReceived is when the announcement of pendingCid was received.
+	pendingReceived time.Time
+	// announcedAddrs are the publisher addresses in the latest announcement
+	// that had any.
+	announcedAddrs []multiaddr.Multiaddr
+	// qlock protects the pendingCid, pendingSyncer, pendingIsRecord,
+	// pendingSource, pendingReceived, and announcedAddrs.
 	qlock sync.Mutex
+	// lastAnnouncedSync is when the last announced sync finished. It is
+	// protected by latestSyncMu.
+	lastAnnouncedSync time.Time
 	// expires is the time the handler is removed if it remains idle.
 	expires time.Time
+	// lastSyncRoot and lastSyncCids are the root and the CIDs, in traversal
+	// order, of the last completed sync. lastSyncStop is the CID that the
+	// sync stopped at, or cid.Undef if there was none.
+	lastSyncRoot  cid.Cid
+	lastSyncCids  []cid.Cid
+	lastSyncStop  cid.Cid
+	lastSyncMutex sync.Mutex
 }
 
 // wrapBlockHook wraps a possibly nil block hook func to allow a for
-// dispatching to a blockhook func that is scoped within a .Sync call.
-func wrapBlockHook() (*sync.RWMutex, map[peer.ID]func(peer.ID, cid.Cid), func(peer.ID, cid.Cid)) {
+// dispatching to a blockhook func that is scoped within a .Sync call. The
+// returned hooks are for blocks received from a publisher, and for blocks
+// found in the local store.
+func wrapBlockHook() (*sync.RWMutex, map[peer.ID]func(peer.ID, cid.Cid, bool), func(peer.ID, cid.Cid), func(peer.ID, cid.Cid)) {
 	var scopedBlockHookMutex sync.RWMutex
-	scopedBlockHook := make(map[peer.ID]func(peer.ID, cid.Cid))
-	return &scopedBlockHookMutex, scopedBlockHook, func(peerID peer.ID, cid cid.Cid) {
+	scopedBlockHook := make(map[peer.ID]func(peer.ID, cid.Cid, bool))
+	hook := func(peerID peer.ID, cid cid.Cid, local bool) {
 		scopedBlockHookMutex.RLock()
 		f, ok := scopedBlockHook[peerID]
 		scopedBlockHookMutex.RUnlock()
 		if ok {
-			f(peerID, cid)
+			f(peerID, cid, local)
 		}
 	}
+	receivedHook := func(peerID peer.ID, cid cid.Cid) {
+		hook(peerID, cid, false)
+	}
+	localHook := func(peerID peer.ID, cid cid.Cid) {
+		hook(peerID, cid, true)
+	}
+	return &scopedBlockHookMutex, scopedBlockHook, receivedHook, localHook
+}
+
+// NewSubscriberWithBlockstore creates a new Subscriber, the same as
+// NewSubscriber, that stores synced blocks in the blockstore bs instead of in
+// a link system. The data transfer state is still stored in ds.
+func NewSubscriberWithBlockstore(host host.Host, ds datastore.Batching, bs blockstore.Blockstore, topic string, dss ipld.Node, options ...Option) (*Subscriber, error) {
+	options = append(options, func(c *config) error {
+		c.putMany = bs.PutMany
+		return nil
+	})
+	return NewSubscriber(host, ds, bsutil.LinkSystem(bs), topic, dss, options...)
 }
 
 // NewSubscriber creates a new Subscriber that process pubsub messages.
@@ -168,59 +390,193 @@ func NewSubscriber(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem,
 		addrTTL:        defaultAddrTTL,
 		idleHandlerTTL: defaultIdleHandlerTTL,
 		segDepthLimit:  defaultSegDepthLimit,
+
+		transportPolicy: PreferHTTP,
 	}
 	err := cfg.apply(options)
 	if err != nil {
 		return nil, err
 	}
+	ds = cfg.applyDatastorePrefix(ds)
+
+	latestSyncHandler := cfg.latestSyncHandler
+	if latestSyncHandler == nil {
+		latestSyncHandler = &DefaultLatestSyncHandler{}
+	}
 
-	scopedBlockHookMutex, scopedBlockHook, blockHook := wrapBlockHook()
+	var topicLatestSync TopicLatestSyncHandler
+	if cfg.latestSyncPerTopic {
+		var ok bool
+		topicLatestSync, ok = latestSyncHandler.(TopicLatestSyncHandler)
+		if !ok {
+			return nil, errors.New("latest sync handler cannot track latest sync per topic")
+		}
+	}
+
+	scopedBlockHookMutex, scopedBlockHook, blockHook, localBlockHook := wrapBlockHook()
+
+	skips, err := newSkipList(context.Background(), cfg.skipListDS)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.journalDS != nil {
+		if _, err = migrations.Migrate(context.Background(), cfg.journalDS, migrations.StoreJournal); err != nil {
+			return nil, fmt.Errorf("cannot migrate announcement journal datastore: %w", err)
+		}
+	}
+	// Skipped blocks are not stored, even if they are sent by the publisher.
+	wb := newWriteBatch(lsys, cfg.putMany, cfg.writeBatchSize)
+	syncState, err := newSyncStateStore(context.Background(), cfg.syncStateDS)
+	if err != nil {
+		return nil, err
+	}
+	syncLsys := skips.skipWriteStorage(wb.linkSystem(lsys))
+	publisherLsys := newPublisherLinkSystems(lsys, cfg.lsysFor)
+
+	// If the Subscriber is not created, then close everything that was
+	// created for it.
+	var (
+		m             *metrics.Metrics
+		dtSync        *dtsync.Sync
+		httpSync      *httpsync.Sync
+		httpPeerstore peerstore.Peerstore
+		rcvr          *announce.Receiver
+		hostEvts      *hostEvents
+		created       bool
+	)
+	defer func() {
+		if created {
+			return
+		}
+		hostEvts.close()
+		if rcvr != nil {
+			rcvr.Close()
+		}
+		if httpPeerstore != nil {
+			httpPeerstore.Close()
+		}
+		if httpSync != nil {
+			httpSync.Close()
+		}
+		if dtSync != nil {
+			dtSync.Close()
+		}
+		m.Unregister()
+	}()
+
+	if cfg.metricsReg != nil {
+		m, err = metrics.New(cfg.metricsReg)
+		if err != nil {
+			return nil, fmt.Errorf("cannot register metrics: %w", err)
+		}
+	}
+
+	// The Subscriber is created after its syncs, and before any sync can
+	// pause a transfer.
+	var s *Subscriber
+	pauseHook := func(peerID peer.ID, c cid.Cid, paused, rateLimited bool) {
+		s.reportPause(peerID, c, paused, rateLimited)
+	}
+	quotas, err := newStorageQuotas(context.Background(), cfg.quotaFor, cfg.quotaDS, func(event QuotaExceeded) {
+		s.reportQuotaExceeded(event)
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	var dtSync *dtsync.Sync
 	if cfg.dtManager != nil {
 		if ds != nil {
 			return nil, fmt.Errorf("datastore cannot be used with DtManager option")
 		}
-		dtSync, err = dtsync.NewSyncWithDT(host, cfg.dtManager, cfg.graphExchange, &lsys, blockHook)
+		if quotas != nil {
+			return nil, fmt.Errorf("storage quota cannot be used with DtManager option")
+		}
+		dtSync, err = dtsync.NewSyncWithDT(host, cfg.dtManager, cfg.graphExchange, &syncLsys, blockHook,
+			dtsync.WithLocalBlockHook(localBlockHook),
+			dtsync.WithLocalCheck(cfg.dtLocalCheck),
+			dtsync.WithPauseOnRateLimit(cfg.dtPauseOnRateLimit),
+			dtsync.WithPauseHook(pauseHook),
+			dtsync.WithSyncMetrics(m),
+			dtsync.WithSyncRelay(cfg.relaySync),
+			dtsync.WithSyncTracerProvider(cfg.tracerProv))
 	} else {
-		dtSync, err = dtsync.NewSync(host, ds, lsys, blockHook)
+		dtSync, err = dtsync.NewSync(host, ds, syncLsys, blockHook,
+			dtsync.WithLocalBlockHook(localBlockHook),
+			dtsync.WithLocalCheck(cfg.dtLocalCheck),
+			dtsync.WithPauseOnRateLimit(cfg.dtPauseOnRateLimit),
+			dtsync.WithPauseHook(pauseHook),
+			dtsync.WithSyncMetrics(m),
+			dtsync.WithSyncRelay(cfg.relaySync),
+			dtsync.WithSyncTracerProvider(cfg.tracerProv))
 	}
 	if err != nil {
 		return nil, err
 	}
 
-	httpPeerstore, err := pstoremem.NewPeerstore()
+	httpSync = httpsync.NewSync(syncLsys, cfg.httpClient, blockHook,
+		httpsync.WithAuthHeader(cfg.httpAuth),
+		httpsync.WithClientHost(host),
+		httpsync.WithClientRelay(cfg.relaySync),
+		httpsync.WithDedupFetches(cfg.dedupFetches),
+		httpsync.WithLocalBlockHook(localBlockHook),
+		httpsync.WithRetry(cfg.httpMaxAttempts, cfg.httpMinBackoff, cfg.httpMaxBackoff),
+		httpsync.WithCircuitBreaker(cfg.httpMaxFailures, cfg.httpCooldown),
+		httpsync.WithSkipCid(skips.skipCid(blockHook)),
+		httpsync.WithSyncMetrics(m),
+		httpsync.WithSyncTracerProvider(cfg.tracerProv))
+
+	ps, err := pstoremem.NewPeerstore()
 	if err != nil {
 		return nil, err
 	}
+	httpPeerstore = ps
 
-	latestSyncHandler := cfg.latestSyncHandler
-	if latestSyncHandler == nil {
-		latestSyncHandler = &DefaultLatestSyncHandler{}
-	}
-
-	rcvr, err := announce.NewReceiver(host, topic,
+	rcvr, err = announce.NewReceiver(host, topic,
 		announce.WithAllowPeer(cfg.allowPeer),
+		announce.WithDiscovery(cfg.discovery),
 		announce.WithFilterIPs(cfg.filterIPs),
 		announce.WithResend(cfg.resendAnnounce),
-		announce.WithTopic(cfg.topic))
+		announce.WithStreamAnnounce(cfg.streamAnnounce),
+		announce.WithTopic(cfg.topic),
+		announce.WithTrustedRelays(cfg.trustedRelays...),
+		announce.WithValidator(cfg.validate))
 	if err != nil {
 		return nil, err
 	}
 
-	s := &Subscriber{
+	eventSink := cfg.eventSink
+	if cfg.hostEvents {
+		hostEvts, err = newHostEvents(host.EventBus())
+		if err != nil {
+			return nil, err
+		}
+		if eventSink == nil {
+			eventSink = hostEvts
+		} else {
+			eventSink = eventSinks{eventSink, hostEvts}
+		}
+	}
+
+	s = &Subscriber{
 		dss:  dss,
 		host: host,
+		lsys: lsys,
+
+		publisherLsys: publisherLsys,
 
 		addrTTL:   cfg.addrTTL,
 		closing:   make(chan struct{}),
 		watchDone: make(chan struct{}),
 
+		transportPolicy: cfg.transportPolicy,
+		relaySync:       cfg.relaySync,
+		holePunchWait:   cfg.holePunchWait,
+
 		handlers: make(map[peer.ID]*handler),
 		inEvents: make(chan SyncFinished, 1),
 
 		dtSync:       dtSync,
-		httpSync:     httpsync.NewSync(lsys, cfg.httpClient, blockHook),
+		httpSync:     httpSync,
 		syncRecLimit: cfg.syncRecLimit,
 
 		httpPeerstore: httpPeerstore,
@@ -228,14 +584,51 @@ func NewSubscriber(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem,
 		scopedBlockHookMutex: scopedBlockHookMutex,
 		scopedBlockHook:      scopedBlockHook,
 		generalBlockHook:     cfg.blockHook,
+		peerBlockHooks:       cfg.peerHooks,
+		orderedHook:          cfg.orderedHook,
+		dedupHook:            cfg.dedupHook,
 
 		idleHandlerTTL:   cfg.idleHandlerTTL,
 		latestSyncHander: latestSyncHandler,
+		topicLatestSync:  topicLatestSync,
 
 		segDepthLimit:  cfg.segDepthLimit,
 		rateLimiterFor: cfg.rateLimiterFor,
 
-		receiver: rcvr,
+		receiver:   rcvr,
+		shouldSync: cfg.shouldSync,
+		syncQueue:  newSyncQueue(cfg.maxAsyncSyncs, cfg.syncPriority),
+
+		verifyFailedHook: cfg.verifyFailedHook,
+		verifyRepair:     cfg.verifyRepair,
+
+		skipList: skips,
+		journal:  newAnnounceJournal(cfg.journalDS),
+		metrics:  m,
+
+		eventSink:  eventSink,
+		hostEvents: hostEvts,
+		tracer:     tracing.Tracer(cfg.tracerProv, tracerName),
+		syncStatus: newSyncStatus(),
+		staging:    newStagingArea(cfg.stagingDS, publisherLsys, skips, quotas),
+		quotas:     quotas,
+		headSyncs:  newHeadSyncs(cfg.dedupFetches),
+		writeBatch: wb,
+		syncState:  syncState,
+
+		progressInterval: cfg.progressInterval,
+		chainWalker:      newChainWalker(cfg.chainPrevPath, cfg.chainNodeFunc),
+
+		cadences:      make(map[peer.ID]*announceCadence),
+		staleMultiple: cfg.staleMultiple,
+		staleHook:     cfg.staleHook,
+		stalePoll:     cfg.stalePoll,
+	}
+	created = true
+
+	if cfg.servePublishers {
+		s.publishersProtocol = PublishersProtocolID(topic)
+		host.SetStreamHandler(s.publishersProtocol, s.handlePublishersStream)
 	}
 	// Start watcher to read announce messages.
 	go s.watch()
@@ -243,6 +636,23 @@ func NewSubscriber(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem,
 	go s.distributeEvents()
 	// Start goroutine to remove idle publisher handlers.
 	go s.idleHandlerCleaner()
+	// Start periodic verification of synced data.
+	if cfg.verifyInterval != 0 {
+		s.asyncWG.Add(1)
+		go s.runPeriodically(cfg.verifyInterval, func(ctx context.Context) {
+			s.verifySample(ctx, cfg.verifySampleSize)
+		})
+	}
+	// Start periodic writes of batched blocks.
+	if wb != nil && cfg.writeBatchInterval != 0 {
+		s.asyncWG.Add(1)
+		go s.runPeriodically(cfg.writeBatchInterval, s.flushWriteBatch)
+	}
+	// Start periodic check for publishers that stopped announcing.
+	if cfg.staleMultiple != 0 {
+		s.asyncWG.Add(1)
+		go s.runPeriodically(cfg.staleInterval, s.checkStale)
+	}
 
 	return s, nil
 }
@@ -252,12 +662,20 @@ func (s *Subscriber) HttpPeerStore() peerstore.Peerstore {
 	return s.httpPeerstore
 }
 
+// PeerProtocolVersion returns the go-legs protocol version that the publisher
+// reported in its latest graphsync sync. Version 0 means that the publisher
+// predates protocol versioning. Returns false if there has been no graphsync
+// sync with the publisher. See: dtsync.ProtocolVersion.
+func (s *Subscriber) PeerProtocolVersion(peerID peer.ID) (uint64, bool) {
+	return s.dtSync.PeerProtocolVersion(peerID)
+}
+
 // GetLatestSync returns the latest synced CID for the specified peer. If there
 // is not handler for the peer, then nil is returned. This does not mean that
 // no data is synced with that peer, it means that the Subscriber does not know
 // about it. Calling Sync() first may be necessary.
 func (s *Subscriber) GetLatestSync(peerID peer.ID) ipld.Link {
-	v, ok := s.latestSyncHander.GetLatestSync(peerID)
+	v, ok := s.getLatestSync(peerID)
 	if !ok || v == cid.Undef {
 		return nil
 	}
@@ -278,10 +696,44 @@ func (s *Subscriber) SetLatestSync(peerID peer.ID, latestSync cid.Cid) error {
 	hnd.latestSyncMu.Lock()
 	defer hnd.latestSyncMu.Unlock()
 
-	s.latestSyncHander.SetLatestSync(peerID, latestSync)
+	s.setLatestSync(peerID, latestSync)
 	return nil
 }
 
+// getLatestSync returns the latest synced CID for the specified peer, on the
+// Subscriber's topic if the latest sync is tracked per topic.
+//
+// If the latest sync is tracked per topic, but none is stored for the topic,
+// then the latest sync stored for the peer before tracking per topic was
+// enabled is migrated to the topic.
+func (s *Subscriber) getLatestSync(peerID peer.ID) (cid.Cid, bool) {
+	if s.topicLatestSync == nil {
+		return s.latestSyncHander.GetLatestSync(peerID)
+	}
+	topic := s.receiver.TopicName()
+	latestSync, ok := s.topicLatestSync.GetTopicLatestSync(topic, peerID)
+	if ok {
+		return latestSync, true
+	}
+	latestSync, ok = s.topicLatestSync.GetLatestSync(peerID)
+	if !ok || latestSync == cid.Undef {
+		return cid.Undef, false
+	}
+	log.Infow("Migrating latest sync of peer to topic", "cid", latestSync, "peer", peerID, "topic", topic)
+	s.topicLatestSync.SetTopicLatestSync(topic, peerID, latestSync)
+	return latestSync, true
+}
+
+// setLatestSync stores the latest synced CID for the specified peer, on the
+// Subscriber's topic if the latest sync is tracked per topic.
+func (s *Subscriber) setLatestSync(peerID peer.ID, latestSync cid.Cid) {
+	if s.topicLatestSync != nil {
+		s.topicLatestSync.SetTopicLatestSync(s.receiver.TopicName(), peerID, latestSync)
+		return
+	}
+	s.latestSyncHander.SetLatestSync(peerID, latestSync)
+}
+
 // SetAllowPeer configures Subscriber with a function to evaluate whether to
 // allow or reject messages from a peer. Setting nil removes any filtering and
 // allows messages from all peers. Calling SetAllowPeer replaces any previously
@@ -303,6 +755,10 @@ func (s *Subscriber) doClose() error {
 	// Cancel idle handler cleaner.
 	close(s.closing)
 
+	if s.publishersProtocol != "" {
+		s.host.RemoveStreamHandler(s.publishersProtocol)
+	}
+
 	// Close receiver and wait for watch to exit.
 	s.receiver.Close()
 	<-s.watchDone
@@ -311,21 +767,42 @@ func (s *Subscriber) doClose() error {
 	s.asyncWG.Wait()
 
 	var err, errs error
+	if err = s.writeBatch.flush(context.Background()); err != nil {
+		errs = multierror.Append(errs, err)
+	}
 	if err = s.dtSync.Close(); err != nil {
 		errs = multierror.Append(errs, err)
 	}
 
 	// Dismiss any event readers.
 	s.outEventsMutex.Lock()
-	for _, ch := range s.outEventsChans {
-		close(ch)
+	for _, w := range s.outEventsChans {
+		close(w.ch)
 	}
 	s.outEventsChans = nil
+	for _, w := range s.announceEventsChans {
+		close(w.ch)
+	}
+	s.announceEventsChans = nil
+	for _, w := range s.progressEventsChans {
+		close(w.ch)
+	}
+	s.progressEventsChans = nil
+	for _, w := range s.pauseEventsChans {
+		close(w.ch)
+	}
+	s.pauseEventsChans = nil
+	for _, w := range s.quotaEventsChans {
+		close(w.ch)
+	}
+	s.quotaEventsChans = nil
 	s.outEventsMutex.Unlock()
 
 	// Stop the distribution goroutine.
 	close(s.inEvents)
 
+	s.hostEvents.close()
+
 	s.httpPeerstore.Close()
 
 	return errs
@@ -337,21 +814,47 @@ func (s *Subscriber) doClose() error {
 // Calling the returned cancel function removes the notification channel from
 // the list of channels to be notified on changes, and it closes the channel to
 // allow any reading goroutines to stop waiting on the channel.
-func (s *Subscriber) OnSyncFinished() (<-chan SyncFinished, context.CancelFunc) {
+//
+// By default, delivery of a SyncFinished waits for every reader to receive it.
+// Use WatchOption values to buffer more events, or to drop the oldest events
+// for a reader that falls behind.
+func (s *Subscriber) OnSyncFinished(opts ...WatchOption) (<-chan SyncFinished, context.CancelFunc) {
+	return s.onSyncFinished(nil, opts)
+}
+
+// OnSyncFinishedFrom creates a channel, the same as OnSyncFinished, that only
+// receives the SyncFinished events of syncs with the specified publisher.
+func (s *Subscriber) OnSyncFinishedFrom(peerID peer.ID, opts ...WatchOption) (<-chan SyncFinished, context.CancelFunc) {
+	return s.onSyncFinished(func(event SyncFinished) bool {
+		return event.PeerID == peerID
+	}, opts)
+}
+
+// OnSyncFinishedMatching creates a channel, the same as OnSyncFinished, that
+// only receives the SyncFinished events for which match returns true. The
+// match function is called from the goroutine that delivers events to all
+// channels, so it must return quickly.
+func (s *Subscriber) OnSyncFinishedMatching(match func(SyncFinished) bool, opts ...WatchOption) (<-chan SyncFinished, context.CancelFunc) {
+	return s.onSyncFinished(match, opts)
+}
+
+func (s *Subscriber) onSyncFinished(match func(SyncFinished) bool, opts []WatchOption) (<-chan SyncFinished, context.CancelFunc) {
 	// Channel is buffered to prevent distribute() from blocking if a reader is
 	// not reading the channel immediately.
-	ch := make(chan SyncFinished, 1)
+	w := newWatchChan[SyncFinished](opts)
+	w.match = match
+	ch := w.ch
 	s.outEventsMutex.Lock()
 	defer s.outEventsMutex.Unlock()
 
-	s.outEventsChans = append(s.outEventsChans, ch)
+	s.outEventsChans = append(s.outEventsChans, w)
 	cncl := func() {
 		s.outEventsMutex.Lock()
 		defer s.outEventsMutex.Unlock()
 		for i, ca := range s.outEventsChans {
-			if ca == ch {
+			if ca.ch == ch {
 				s.outEventsChans[i] = s.outEventsChans[len(s.outEventsChans)-1]
-				s.outEventsChans[len(s.outEventsChans)-1] = nil
+				s.outEventsChans[len(s.outEventsChans)-1] = watchChan[SyncFinished]{}
 				s.outEventsChans = s.outEventsChans[:len(s.outEventsChans)-1]
 				close(ch)
 				break
@@ -361,19 +864,88 @@ func (s *Subscriber) OnSyncFinished() (<-chan SyncFinished, context.CancelFunc)
 	return ch, cncl
 }
 
+// OnAnnouncement creates a channel that receives an AnnouncementReceived for
+// each announcement that the Subscriber receives, before any sync of the
+// announced CID starts. This allows applications to log and meter
+// announcements, including those that do not result in a sync.
+//
+// Calling the returned cancel function removes the notification channel from
+// the list of channels to be notified of announcements, and it closes the
+// channel to allow any reading goroutines to stop waiting on the channel. See
+// OnSyncFinished for the WatchOption values.
+func (s *Subscriber) OnAnnouncement(opts ...WatchOption) (<-chan AnnouncementReceived, context.CancelFunc) {
+	// Channel is buffered to prevent the announce watcher from blocking if a
+	// reader is not reading the channel immediately.
+	w := newWatchChan[AnnouncementReceived](opts)
+	ch := w.ch
+	s.outEventsMutex.Lock()
+	defer s.outEventsMutex.Unlock()
+
+	s.announceEventsChans = append(s.announceEventsChans, w)
+	cncl := func() {
+		s.outEventsMutex.Lock()
+		defer s.outEventsMutex.Unlock()
+		for i, ca := range s.announceEventsChans {
+			if ca.ch == ch {
+				s.announceEventsChans[i] = s.announceEventsChans[len(s.announceEventsChans)-1]
+				s.announceEventsChans[len(s.announceEventsChans)-1] = watchChan[AnnouncementReceived]{}
+				s.announceEventsChans = s.announceEventsChans[:len(s.announceEventsChans)-1]
+				close(ch)
+				break
+			}
+		}
+	}
+	return ch, cncl
+}
+
+// SetPublisherBlockHook sets a block hook that is called instead of the
+// Subscriber's BlockHook for blocks synced from the specified publisher. This
+// allows specialized processing for some publishers, while others use the
+// general hook. A nil hook removes the publisher's hook, so that the general
+// hook is used again. The hook applies to syncs that start after it is set.
+// See: PublisherBlockHook.
+func (s *Subscriber) SetPublisherBlockHook(peerID peer.ID, hook BlockHookFunc) {
+	s.peerBlockHooksMutex.Lock()
+	defer s.peerBlockHooksMutex.Unlock()
+
+	if hook == nil {
+		delete(s.peerBlockHooks, peerID)
+		return
+	}
+	if s.peerBlockHooks == nil {
+		s.peerBlockHooks = make(map[peer.ID]BlockHookFunc)
+	}
+	s.peerBlockHooks[peerID] = hook
+}
+
+// blockHookFor returns the block hook of the publisher, or the general block
+// hook if the publisher does not have one.
+func (s *Subscriber) blockHookFor(peerID peer.ID) BlockHookFunc {
+	s.peerBlockHooksMutex.RLock()
+	defer s.peerBlockHooksMutex.RUnlock()
+
+	if hook, ok := s.peerBlockHooks[peerID]; ok {
+		return hook
+	}
+	return s.generalBlockHook
+}
+
 // RemoveHandler removes a handler for a publisher.
 func (s *Subscriber) RemoveHandler(peerID peer.ID) bool {
 	s.handlersMutex.Lock()
-	defer s.handlersMutex.Unlock()
 
 	// Check for existing handler, remove if found.
 	if _, ok := s.handlers[peerID]; !ok {
+		s.handlersMutex.Unlock()
 		return false
 	}
 
 	log.Infow("Removing handler for publisher", "peer", peerID)
 	delete(s.handlers, peerID)
+	s.handlersMutex.Unlock()
 
+	s.forgetCadence(peerID)
+	s.hostEvents.publisherEvicted(peerID, false)
 	return true
 }
 
@@ -406,11 +978,17 @@ func (s *Subscriber) RemoveHandler(peerID peer.ID) bool {
 // only specify the selection sequence itself.
 //
 // See: ExploreRecursiveWithStopNode.
-func (s *Subscriber) Sync(ctx context.Context, peerID peer.ID, nextCid cid.Cid, sel ipld.Node, peerAddr multiaddr.Multiaddr, opts ...SyncOption) (cid.Cid, error) {
+//
+// If the sync fails because a libp2p resource limit was exceeded, then the
+// returned error wraps a dtsync.ResourceLimitError, and the sync can be
+// retried later.
+func (s *Subscriber) Sync(ctx context.Context, peerID peer.ID, nextCid cid.Cid, sel ipld.Node, peerAddr multiaddr.Multiaddr, opts ...SyncOption) (_ cid.Cid, err error) {
 	cfg := &syncCfg{
-		// Fall back on general block hook if scoped block hook is not specified.
-		scopedBlockHook: s.generalBlockHook,
-		segDepthLimit:   s.segDepthLimit,
+		// Fall back on publisher or general block hook if scoped block hook
+		// is not specified.
+		scopedBlockHook: s.blockHookFor(peerID),
+		segDepthLimit:   s.segDepthLimitFor(peerID),
+		source:          SyncSourceSync,
 	}
 	for _, opt := range opts {
 		opt(cfg)
@@ -420,13 +998,19 @@ func (s *Subscriber) Sync(ctx context.Context, peerID peer.ID, nextCid cid.Cid,
 		return cid.Undef, errors.New("empty peer id")
 	}
 
+	ctx, span := s.tracer.Start(ctx, "sync", trace.WithAttributes(
+		attribute.String("peer", peerID.String()),
+		attribute.String("source", string(cfg.source))))
+	defer func() { tracing.EndSpan(span, err) }()
+
 	log := log.With("peer", peerID)
 
 	var peerAddrs []multiaddr.Multiaddr
 	if peerAddr != nil {
 		peerAddrs = []multiaddr.Multiaddr{peerAddr}
 	}
-	syncer, isHttp, err := s.makeSyncer(peerID, peerAddrs, tempAddrTTL, cfg.rateLimiter)
+	peerAddrs = append(peerAddrs, cfg.addrs...)
+	syncer, isHttp, err := s.makeStagedSyncer(peerID, peerAddrs, tempAddrTTL, cfg.rateLimiter)
 	if err != nil {
 		return cid.Undef, err
 	}
@@ -447,12 +1031,14 @@ func (s *Subscriber) Sync(ctx context.Context, peerID peer.ID, nextCid cid.Cid,
 		}
 
 		log.Infow("Sync queried head CID", "cid", nextCid)
+		span.SetAttributes(attribute.Bool("queriedHead", true))
 		if sel == nil {
 			// Update the latestSync only if no CID and no selector given.
 			updateLatest = true
 		}
 	}
 	log = log.With("cid", nextCid)
+	span.SetAttributes(attribute.String("cid", nextCid.String()))
 
 	log.Info("Start sync")
 
@@ -464,9 +1050,18 @@ func (s *Subscriber) Sync(ctx context.Context, peerID peer.ID, nextCid cid.Cid,
 	if sel == nil {
 		// Fall back onto the default selector sequence if one is not given.
 		// Note that if selector is specified it is used as is without any
-		// wrapping.
-		sel = s.dss
+		// wrapping, unless the StopAtLatestSync option is given.
+		sel = s.selectorSequenceFor(peerID)
 		wrapSel = true
+	} else if cfg.stopAtLatestSync {
+		latestSync, ok := s.getLatestSync(peerID)
+		if ok && latestSync != cid.Undef {
+			if stopSel, ok := withStopNode(sel, cidlink.Link{Cid: latestSync}); ok {
+				sel = stopSel
+			} else {
+				log.Warn("Cannot add latest sync stop condition to selector")
+			}
+		}
 	}
 
 	// Check for existing handler. If none, create one if allowed.
@@ -483,14 +1078,28 @@ func (s *Subscriber) Sync(ctx context.Context, peerID peer.ID, nextCid cid.Cid,
 		defer hnd.latestSyncMu.Unlock()
 	}
 
-	syncedCids, err := hnd.handle(ctx, nextCid, sel, wrapSel, syncer, cfg.scopedBlockHook, cfg.segDepthLimit)
+	if cfg.trace != nil {
+		latestSync, _ := s.getLatestSync(peerID)
+		if err = cfg.trace.start(nextCid, latestSync, sel, wrapSel, cfg.segDepthLimit); err != nil {
+			return cid.Undef, err
+		}
+	}
+
+	syncedCids, skippedCids, err := hnd.handle(ctx, nextCid, sel, wrapSel, syncer, cfg.scopedBlockHook, cfg.segDepthLimit, cfg.source)
 	if err != nil {
 		return cid.Undef, fmt.Errorf("sync handler failed: %w", err)
 	}
 
 	if updateLatest {
-		hnd.subscriber.latestSyncHander.SetLatestSync(hnd.peerID, nextCid)
-		hnd.subscriber.inEvents <- SyncFinished{Cid: nextCid, PeerID: hnd.peerID, SyncedCids: syncedCids}
+		event := SyncFinished{Cid: nextCid, PeerID: hnd.peerID, SyncedCids: syncedCids, SkippedCids: skippedCids, Source: cfg.source, Transport: syncTransport(syncer)}
+		hnd.subscriber.advanceLatestSync(ctx, hnd.peerID, nextCid)
+		hnd.subscriber.inEvents <- event
+		if cfg.trace != nil {
+			cfg.trace.Events = append(cfg.trace.Events, event)
+		}
+	}
+	if cfg.trace != nil {
+		cfg.trace.SkippedCids = skippedCids
 	}
 
 	// The sync succeeded, so let's remember this address in the appropriate
@@ -513,6 +1122,223 @@ func (s *Subscriber) Sync(ctx context.Context, peerID peer.ID, nextCid cid.Cid,
 	return nextCid, nil
 }
 
+// SyncAt syncs the chain published by the specified peer, starting at the
+// historical head, headCid, and stopping at stopCid, into the link system
+// lsys. If stopCid is cid.Undef, then the chain is synced until its end. The
+// default selector sequence is used. Returns the synced CIDs in traversal
+// order.
+//
+// Blocks are stored only in lsys, the latest sync and last sync for the peer
+// are not changed, no SyncFinished event is sent, and the Subscriber's
+// BlockHook is not called. The sync is not reported to the EventSink, the
+// metrics, or in Status. This is useful for auditing, or reproducing, the
+// state of a publisher's chain at a point in the past. The sync is otherwise
+// handled like any other: the Subscriber starts tracking the peer if it does
+// not already, the sync waits for any other sync with the peer to finish, and
+// any given addresses are added to the peerstore with a temporary TTL. Only
+// the ScopedAddrs, ScopedRateLimiter, and ScopedBlockHook sync options apply.
+func (s *Subscriber) SyncAt(ctx context.Context, peerID peer.ID, headCid, stopCid cid.Cid, lsys ipld.LinkSystem, opts ...SyncOption) ([]cid.Cid, error) {
+	cfg := &syncCfg{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	if peerID == "" {
+		return nil, errors.New("empty peer id")
+	}
+	if headCid == cid.Undef {
+		return nil, errors.New("head cid required")
+	}
+
+	lsys = s.skipList.skipWriteStorage(lsys)
+	syncer, _, err := s.makeSyncer(peerID, cfg.addrs, tempAddrTTL, cfg.rateLimiter, &lsys)
+	if err != nil {
+		return nil, err
+	}
+
+	var stopLnk ipld.Link
+	if stopCid != cid.Undef {
+		stopLnk = cidlink.Link{Cid: stopCid}
+	}
+	sel := ExploreRecursiveWithStopNode(s.syncRecLimit, s.selectorSequenceFor(peerID), stopLnk)
+
+	hnd, err := s.getOrCreateHandler(peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hold the sync lock, so that the synced blocks are only reported to this
+	// sync's block hook.
+	hnd.syncMutex.Lock()
+	defer hnd.syncMutex.Unlock()
+
+	var syncedCids []cid.Cid
+	s.scopedBlockHookMutex.Lock()
+	s.scopedBlockHook[peerID] = func(p peer.ID, c cid.Cid, local bool) {
+		if s.skipList.has(c) {
+			return
+		}
+		syncedCids = append(syncedCids, c)
+		if cfg.scopedBlockHook != nil {
+			cfg.scopedBlockHook(p, c, blockActions{&segmentedSync{}, local})
+		}
+	}
+	s.scopedBlockHookMutex.Unlock()
+	defer func() {
+		s.scopedBlockHookMutex.Lock()
+		delete(s.scopedBlockHook, peerID)
+		s.scopedBlockHookMutex.Unlock()
+	}()
+
+	log.Infow("Start sync at historical head", "cid", headCid, "stop", stopCid, "peer", peerID)
+	syncConnected := s.connectForSync(ctx, peerID, syncer)
+	err = syncer.Sync(ctx, headCid, sel)
+	syncConnected()
+	if err != nil {
+		return nil, fmt.Errorf("cannot sync at %s: %w", headCid, err)
+	}
+	return syncedCids, nil
+}
+
+// WriteLastSyncCAR writes the blocks traversed by the last completed sync with
+// the specified peer to w as a CARv2 file, with the synced CID as its root.
+// Blocks are written in the order that they were traversed during the sync,
+// and are read from the peer's link system. The last sync is not known if
+// the peer's handler was removed after being idle.
+func (s *Subscriber) WriteLastSyncCAR(ctx context.Context, peerID peer.ID, w io.Writer) error {
+	s.handlersMutex.Lock()
+	hnd, ok := s.handlers[peerID]
+	s.handlersMutex.Unlock()
+	if !ok {
+		return fmt.Errorf("no sync with peer %s", peerID)
+	}
+
+	hnd.lastSyncMutex.Lock()
+	root := hnd.lastSyncRoot
+	cids := hnd.lastSyncCids
+	hnd.lastSyncMutex.Unlock()
+	if root == cid.Undef {
+		return fmt.Errorf("no completed sync with peer %s", peerID)
+	}
+	return carutil.WriteV2(ctx, s.linkSystemFor(peerID), w, []cid.Cid{root}, cids)
+}
+
+// ImportCAR reads a CAR file, containing blocks published by the specified
+// peer, from r and stores its blocks the same as a sync with the peer does,
+// including staging them and counting them against the peer's storage quota.
+// The CAR file must have a single root, which is checked before any blocks are
+// stored. The root is synced from the stored blocks, using the default
+// selector sequence, the same as Sync does when given no CID and no selector.
+// This updates the latest sync for the peer and sends a SyncFinished event,
+// without transferring any data from the peer.
+//
+// Returns the CAR file's root. Returns an error if the blocks reachable from
+// the root, up to the latest sync, are not all in the CAR file or already
+// stored. Only the sync options that set a block hook or a segment depth limit
+// apply.
+func (s *Subscriber) ImportCAR(ctx context.Context, peerID peer.ID, r io.Reader, opts ...SyncOption) (cid.Cid, error) {
+	cfg := &syncCfg{
+		scopedBlockHook: s.blockHookFor(peerID),
+		segDepthLimit:   s.segDepthLimitFor(peerID),
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	if peerID == "" {
+		return cid.Undef, errors.New("empty peer id")
+	}
+
+	// Check the roots before any blocks are stored.
+	car, err := carutil.NewReader(r)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("cannot read car: %w", err)
+	}
+	roots := car.Roots()
+	if len(roots) != 1 {
+		return cid.Undef, fmt.Errorf("car must have exactly one root, found %d", len(roots))
+	}
+	nextCid := roots[0]
+
+	hnd, err := s.getOrCreateHandler(peerID)
+	if err != nil {
+		return cid.Undef, err
+	}
+	hnd.latestSyncMu.Lock()
+	defer hnd.latestSyncMu.Unlock()
+
+	// The blocks are stored by the syncer, through the same link system as a
+	// sync with the publisher, so that they are staged, counted against the
+	// storage quota, and batched the same.
+	lsys, staged := s.importLinkSystemFor(peerID)
+	var syncer Syncer = &localSyncer{
+		subscriber: s,
+		peerID:     peerID,
+		head:       nextCid,
+		lsys:       lsys,
+		car:        car,
+	}
+	if staged {
+		syncer = &stagedSyncer{Syncer: syncer}
+	}
+	syncedCids, skippedCids, err := hnd.handle(ctx, nextCid, s.selectorSequenceFor(peerID), true, syncer, cfg.scopedBlockHook, cfg.segDepthLimit, SyncSourceImport)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("sync handler failed: %w", err)
+	}
+	log.Infow("Imported car", "cid", nextCid, "peer", peerID)
+
+	s.advanceLatestSync(ctx, peerID, nextCid)
+	s.inEvents <- SyncFinished{Cid: nextCid, PeerID: peerID, SyncedCids: syncedCids, SkippedCids: skippedCids, Source: SyncSourceImport, Transport: TransportLocal}
+	return nextCid, nil
+}
+
+// SyncHandle tracks a sync started by StartSync, and allows that sync to be
+// canceled while it is in progress.
+type SyncHandle struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	cid    cid.Cid
+	err    error
+}
+
+// StartSync starts a sync in a separate goroutine and returns a SyncHandle for
+// it. The arguments are the same as for Sync.
+//
+// Canceling the sync, either using the handle's Cancel method or by canceling
+// ctx, stops the sync even if data is being transferred.
+func (s *Subscriber) StartSync(ctx context.Context, peerID peer.ID, nextCid cid.Cid, sel ipld.Node, peerAddr multiaddr.Multiaddr, opts ...SyncOption) *SyncHandle {
+	ctx, cancel := context.WithCancel(ctx)
+	h := &SyncHandle{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	s.asyncWG.Add(1)
+	go func() {
+		defer s.asyncWG.Done()
+		defer close(h.done)
+		defer cancel()
+		h.cid, h.err = s.Sync(ctx, peerID, nextCid, sel, peerAddr, opts...)
+	}()
+	return h
+}
+
+// Cancel stops the sync if it is still in progress.
+func (h *SyncHandle) Cancel() {
+	h.cancel()
+}
+
+// Done returns a channel that is closed when the sync has finished.
+func (h *SyncHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Result waits for the sync to finish and returns the values returned by
+// Sync.
+func (h *SyncHandle) Result() (cid.Cid, error) {
+	<-h.done
+	return h.cid, h.err
+}
+
 // distributeEvents reads a SyncFinished, sent by a peer handler, and copies
 // the even to all channels in outEventsChans. This delivers the SyncFinished
 // to all OnSyncFinished channel readers.
@@ -523,17 +1349,43 @@ func (s *Subscriber) distributeEvents() {
 		}
 		// Send update to all change notification channels.
 		s.outEventsMutex.Lock()
-		for _, ch := range s.outEventsChans {
-			ch <- event
+		for _, w := range s.outEventsChans {
+			if dropped := w.send(event); dropped != 0 {
+				s.metrics.EventsDropped(metrics.EventSyncFinished, dropped)
+			}
 		}
 		s.outEventsMutex.Unlock()
 	}
 }
 
+// distributeAnnouncement reports an AnnouncementReceived for the announcement
+// to the event sink, and copies it to all OnAnnouncement channels.
+func (s *Subscriber) distributeAnnouncement(amsg announce.Announce) {
+	event := AnnouncementReceived{
+		Cid:      amsg.Cid,
+		PeerID:   amsg.PeerID,
+		Addrs:    amsg.Addrs,
+		Topic:    s.receiver.TopicName(),
+		IsRecord: amsg.IsRecord,
+		Metadata: amsg.Metadata,
+		Source:   SyncSource(amsg.Source),
+	}
+	if s.eventSink != nil {
+		s.eventSink.OnAnnounce(event)
+	}
+
+	s.outEventsMutex.Lock()
+	defer s.outEventsMutex.Unlock()
+	for _, w := range s.announceEventsChans {
+		if dropped := w.send(event); dropped != 0 {
+			s.metrics.EventsDropped(metrics.EventAnnouncement, dropped)
+		}
+	}
+}
+
 // getOrCreateHandler creates a handler for a specific peer
 func (s *Subscriber) getOrCreateHandler(peerID peer.ID) (*handler, error) {
 	s.handlersMutex.Lock()
-	defer s.handlersMutex.Unlock()
 
 	expires := time.Now().Add(s.idleHandlerTTL)
 
@@ -541,6 +1393,7 @@ func (s *Subscriber) getOrCreateHandler(peerID peer.ID) (*handler, error) {
 	hnd, ok := s.handlers[peerID]
 	if ok {
 		hnd.expires = expires
+		s.handlersMutex.Unlock()
 		return hnd, nil
 	}
 
@@ -551,10 +1404,40 @@ func (s *Subscriber) getOrCreateHandler(peerID peer.ID) (*handler, error) {
 		expires:    expires,
 	}
 	s.handlers[peerID] = hnd
+	s.handlersMutex.Unlock()
 
+	s.hostEvents.publisherAdded(peerID)
 	return hnd, nil
 }
 
+// runPeriodically calls fn at each interval, until the Subscriber is closed.
+// The context given to fn is canceled when the Subscriber is closed.
+func (s *Subscriber) runPeriodically(interval time.Duration, fn func(context.Context)) {
+	defer s.asyncWG.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			fn(ctx)
+		case <-s.closing:
+			return
+		}
+	}
+}
+
 // idleHandlerCleaner periodically looks for idle handlers to remove. This
 // prevents accumulation of handlers that are no longer in use.
 func (s *Subscriber) idleHandlerCleaner() {
@@ -564,14 +1447,20 @@ func (s *Subscriber) idleHandlerCleaner() {
 		select {
 		case <-t.C:
 			now := time.Now()
+			var evicted []peer.ID
 			s.handlersMutex.Lock()
 			for pid, hnd := range s.handlers {
 				if now.After(hnd.expires) {
 					delete(s.handlers, pid)
+					evicted = append(evicted, pid)
 					log.Debugw("Removed idle handler", "publisherID", pid)
 				}
 			}
 			s.handlersMutex.Unlock()
+			for _, pid := range evicted {
+				s.forgetCadence(pid)
+				s.hostEvents.publisherEvicted(pid, true)
+			}
 			t.Reset(s.idleHandlerTTL)
 		case <-s.closing:
 			t.Stop()
@@ -595,14 +1484,22 @@ func (s *Subscriber) watch() {
 			log.Infow("Done handling announce messages", "reason", err)
 			break
 		}
+		s.distributeAnnouncement(amsg)
+		s.metrics.AnnounceReceived(string(amsg.Source))
 
 		hnd, err := s.getOrCreateHandler(amsg.PeerID)
 		if err != nil {
 			log.Errorw("Cannot create handler for announce", "err", err)
 			continue
 		}
-
-		syncer, _, err := s.makeSyncer(amsg.PeerID, amsg.Addrs, s.addrTTL, nil)
+		s.recordAnnounce(amsg.PeerID)
+		s.journal.receive(amsg.PeerID, amsg.Cid, amsg.Addrs, amsg.IsRecord, SyncSource(amsg.Source))
+		// Addresses may end with the publisher's peer ID, such as a
+		// /p2p-circuit address through a relay, which is removed to dial them.
+		addrs := trimPeerIDs(amsg.PeerID, amsg.Addrs)
+		s.expireStaleAddrs(hnd, addrs)
+
+		syncer, _, err := s.makeStagedSyncer(amsg.PeerID, addrs, s.addrTTL, nil)
 		if err != nil {
 			log.Errorw("Cannot make syncer for announce", "err", err)
 			continue
@@ -610,7 +1507,7 @@ func (s *Subscriber) watch() {
 
 		// Start a new goroutine to handle this message instead of having a
 		// persistent goroutine for each peer.
-		hnd.handleAsync(ctx, amsg.Cid, syncer)
+		hnd.handleAsync(ctx, amsg.Cid, syncer, amsg.IsRecord, SyncSource(amsg.Source))
 	}
 }
 
@@ -621,69 +1518,191 @@ func (s *Subscriber) Announce(ctx context.Context, nextCid cid.Cid, peerID peer.
 	return s.receiver.Direct(ctx, nextCid, peerID, peerAddrs)
 }
 
-func (s *Subscriber) makeSyncer(peerID peer.ID, peerAddrs []multiaddr.Multiaddr, addrTTL time.Duration, rateLimiter *rate.Limiter) (Syncer, bool, error) {
-	// Check for an HTTP address in peerAddrs, or if not given, in the http
-	// peerstore. This gives a preference to use httpsync over dtsync.
-	var httpAddr multiaddr.Multiaddr
+// makeSyncer creates a Syncer for the peer, that syncs over HTTP if the
+// transport policy puts an HTTP address of the peer first, and otherwise over
+// datatransfer. If lsys is not nil,
+// then the Syncer stores synced blocks in lsys instead of in the publisher's
+// link system.
+func (s *Subscriber) makeSyncer(peerID peer.ID, peerAddrs []multiaddr.Multiaddr, addrTTL time.Duration, rateLimiter *rate.Limiter, lsys *ipld.LinkSystem) (Syncer, bool, error) {
+	if lsys == nil {
+		lsys = s.syncLinkSystemFor(peerID)
+	}
+
+	// If no addresses are given, then prefer the addresses that the publisher
+	// last announced over others in the peerstores.
 	if len(peerAddrs) == 0 {
-		possibleAddrs := s.httpPeerstore.Addrs(peerID)
-		if len(possibleAddrs) > 0 {
-			httpAddr = possibleAddrs[0]
+		peerAddrs = s.announcedAddrs(peerID)
+	}
+
+	// Order the addresses by the transport policy, which gives a preference
+	// to use httpsync over dtsync by default. The first address decides which
+	// to use. If no addresses are given, then the policy chooses from those
+	// already in the peerstores.
+	storeAddrs := len(peerAddrs) != 0
+	candidates := make([]multiaddr.Multiaddr, 0, len(peerAddrs))
+	if storeAddrs {
+		for _, addr := range trimPeerIDs(peerID, peerAddrs) {
+			if addr != nil {
+				candidates = append(candidates, addr)
+			}
 		}
 	} else {
-		httpAddr = firstHTTPAddr(peerAddrs)
+		candidates = append(candidates, s.httpPeerstore.Addrs(peerID)...)
+		if peerStore := s.host.Peerstore(); peerStore != nil {
+			candidates = append(candidates, peerStore.Addrs(peerID)...)
+		}
+	}
+	peerAddrs = s.transportPolicy(peerID, candidates)
+	var httpAddr multiaddr.Multiaddr
+	if len(peerAddrs) != 0 && isHTTPAddr(peerAddrs[0]) {
+		httpAddr = peerAddrs[0]
 	}
 
 	// If there was no rate limiter for this sync, then use the normal rate
 	// limiter for the peer.
-	if rateLimiter == nil && s.rateLimiterFor != nil {
-		rateLimiter = s.rateLimiterFor(peerID)
+	if rateLimiter == nil {
+		rateLimiter = s.rateLimiterForPeer(peerID)
 	}
 
-	if httpAddr != nil {
-		// Store this http address so that future calls to sync will work without a
-		// peerAddr (given that it happens within the TTL)
+	// Store the addresses so that future calls to sync will work without a
+	// peerAddr (given that it happens within the TTL). Add them to peerstores
+	// with a small TTL first, and extend it if/when sync with it completes. In
+	// case the peerstore already has this address and the existing TTL is
+	// greater than this temp one, this is a no-op. In other words, the TTL is
+	// never decreased here.
+	if storeAddrs {
+		s.addPeerAddrs(peerID, peerAddrs, addrTTL)
+	} else if httpAddr != nil {
 		s.httpPeerstore.AddAddr(peerID, httpAddr, addrTTL)
+	}
 
-		syncer, err := s.httpSync.NewSyncer(peerID, httpAddr, rateLimiter)
+	if httpAddr != nil {
+		var syncer *httpsync.Syncer
+		var err error
+		if lsys != nil {
+			syncer, err = s.httpSync.NewSyncerWithLinkSystem(peerID, httpAddr, rateLimiter, *lsys)
+		} else {
+			syncer, err = s.httpSync.NewSyncer(peerID, httpAddr, rateLimiter)
+		}
 		if err != nil {
 			return nil, false, fmt.Errorf("cannot create http sync handler: %w", err)
 		}
 		return syncer, true, nil
 	}
 
-	// Not an httpPeerAddr, so use the dtSync. Add it to peerstore with a small
-	// TTL first, and extend it if/when sync with it completes. In case the
-	// peerstore already has this address and the existing TTL is greater than
-	// this temp one, this is a no-op. In other words, the TTL is never
-	// decreased here.
-	peerStore := s.host.Peerstore()
-	if peerStore != nil && len(peerAddrs) != 0 {
-		peerStore.AddAddrs(peerID, peerAddrs, addrTTL)
+	// Not an httpPeerAddr, so use the dtSync.
+	if lsys != nil {
+		syncer, err := s.dtSync.NewSyncerWithLinkSystem(peerID, s.receiver.TopicName(), rateLimiter, nil, *lsys)
+		if err != nil {
+			return nil, false, err
+		}
+		return syncer, false, nil
 	}
-
 	return s.dtSync.NewSyncer(peerID, s.receiver.TopicName(), rateLimiter), false, nil
 }
 
-func firstHTTPAddr(peerAddrs []multiaddr.Multiaddr) multiaddr.Multiaddr {
-	for _, addr := range peerAddrs {
+// isHTTPAddr returns true if addr is an HTTP or HTTPS address.
+func isHTTPAddr(addr multiaddr.Multiaddr) bool {
+	if addr == nil {
+		return false
+	}
+	for _, p := range addr.Protocols() {
+		if p.Code == multiaddr.P_HTTP || p.Code == multiaddr.P_HTTPS {
+			return true
+		}
+	}
+	return false
+}
+
+// addPeerAddrs adds the HTTP addresses of the peer to the http peerstore, and
+// its other addresses to the host's libp2p peerstore, with the given TTL.
+func (s *Subscriber) addPeerAddrs(peerID peer.ID, addrs []multiaddr.Multiaddr, ttl time.Duration) {
+	httpAddrs, p2pAddrs := splitHTTPAddrs(addrs)
+	if len(httpAddrs) != 0 {
+		s.httpPeerstore.AddAddrs(peerID, httpAddrs, ttl)
+	}
+	if peerStore := s.host.Peerstore(); peerStore != nil && len(p2pAddrs) != 0 {
+		peerStore.AddAddrs(peerID, p2pAddrs, ttl)
+	}
+}
+
+// splitHTTPAddrs splits addrs into HTTP addresses and other addresses.
+func splitHTTPAddrs(addrs []multiaddr.Multiaddr) (httpAddrs, p2pAddrs []multiaddr.Multiaddr) {
+	for _, addr := range addrs {
 		if addr == nil {
 			continue
 		}
-		for _, p := range addr.Protocols() {
-			if p.Code == multiaddr.P_HTTP || p.Code == multiaddr.P_HTTPS {
-				return addr
-			}
+		if isHTTPAddr(addr) {
+			httpAddrs = append(httpAddrs, addr)
+		} else {
+			p2pAddrs = append(p2pAddrs, addr)
 		}
 	}
-	return nil
+	return httpAddrs, p2pAddrs
+}
+
+// expireStaleAddrs records addrs as the publisher's announced addresses, if
+// there are any, and expires from the peerstores the addresses of the
+// publisher's previous announcement that are not announced again. The
+// publisher is then dialed at the addresses that it now announces, instead of
+// at ones that it has stopped using.
+func (s *Subscriber) expireStaleAddrs(hnd *handler, addrs []multiaddr.Multiaddr) {
+	if len(addrs) == 0 {
+		return
+	}
+	hnd.qlock.Lock()
+	prevAddrs := hnd.announcedAddrs
+	hnd.announcedAddrs = addrs
+	hnd.qlock.Unlock()
+
+	var stale []multiaddr.Multiaddr
+	for _, prev := range prevAddrs {
+		if !containsAddr(addrs, prev) {
+			stale = append(stale, prev)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	log.Debugw("Expiring addresses no longer announced by publisher", "peer", hnd.peerID, "addrs", stale)
+	httpAddrs, p2pAddrs := splitHTTPAddrs(stale)
+	if len(httpAddrs) != 0 {
+		s.httpPeerstore.SetAddrs(hnd.peerID, httpAddrs, 0)
+	}
+	if peerStore := s.host.Peerstore(); peerStore != nil && len(p2pAddrs) != 0 {
+		peerStore.SetAddrs(hnd.peerID, p2pAddrs, 0)
+	}
+}
+
+// announcedAddrs returns the addresses in the publisher's latest announcement
+// that had any, or nil if there is none.
+func (s *Subscriber) announcedAddrs(peerID peer.ID) []multiaddr.Multiaddr {
+	s.handlersMutex.Lock()
+	hnd, ok := s.handlers[peerID]
+	s.handlersMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	hnd.qlock.Lock()
+	defer hnd.qlock.Unlock()
+	return hnd.announcedAddrs
+}
+
+func containsAddr(addrs []multiaddr.Multiaddr, addr multiaddr.Multiaddr) bool {
+	for _, a := range addrs {
+		if a != nil && a.Equal(addr) {
+			return true
+		}
+	}
+	return false
 }
 
 // handleAsync starts a goroutine to process the latest announce message
 // received over pubsub or HTTP. If there is already a goroutine handling a
 // sync, then there will be at most one more goroutine waiting to handle the
-// pending sync.
-func (h *handler) handleAsync(ctx context.Context, nextCid cid.Cid, syncer Syncer) {
+// pending sync. If isRecord is true, then nextCid identifies an announcement
+// record that is fetched to get the CID to sync.
+func (h *handler) handleAsync(ctx context.Context, nextCid cid.Cid, syncer Syncer, isRecord bool, source SyncSource) {
 	h.qlock.Lock()
 	// If pendingSync is undef, then previous goroutine has already handled any
 	// pendingSync, so start a new go routine to handle the pending sync. If
@@ -692,50 +1711,166 @@ func (h *handler) handleAsync(ctx context.Context, nextCid cid.Cid, syncer Synce
 	if h.pendingCid == cid.Undef {
 		h.subscriber.asyncWG.Add(1)
 		go func() {
+			defer h.subscriber.asyncWG.Done()
+
+			// Wait for syncing to be resumed if it is paused. The pending CID
+			// is replaced by newer announcements while waiting.
+			if err := h.subscriber.waitResumed(ctx, h.peerID); err != nil {
+				log.Warnw("Abandoned pending sync", "err", err, "publisher", h.peerID)
+				return
+			}
+
 			// Wait for any previous handler goroutine to finish.
 			h.latestSyncMu.Lock()
 			defer h.latestSyncMu.Unlock()
-			defer h.subscriber.asyncWG.Done()
 
 			if ctx.Err() != nil {
 				log.Warnw("Abandoned pending sync", "err", ctx.Err(), "publisher", h.peerID)
 				return
 			}
 
+			// Wait for the sync queue to start the pending sync. The pending
+			// CID may be replaced by a newer announcement while waiting.
+			h.qlock.Lock()
+			pending := PendingSync{
+				PeerID:     h.peerID,
+				Cid:        h.pendingCid,
+				IsRecord:   h.pendingIsRecord,
+				Source:     h.pendingSource,
+				Received:   h.pendingReceived,
+				LastSynced: h.lastAnnouncedSync,
+			}
+			h.qlock.Unlock()
+			if err := h.subscriber.syncQueue.acquire(ctx, pending); err != nil {
+				log.Warnw("Abandoned pending sync", "err", err, "publisher", h.peerID)
+				return
+			}
+			defer h.subscriber.syncQueue.release()
+
 			// Wait for the parent goroutine to assign pending CID and unlock.
 			h.qlock.Lock()
 			c := h.pendingCid
 			h.pendingCid = cid.Undef
 			syncer := h.pendingSyncer
 			h.pendingSyncer = nil
+			isRecord := h.pendingIsRecord
+			h.pendingIsRecord = false
+			source := h.pendingSource
+			h.pendingSource = ""
+			h.pendingReceived = time.Time{}
 			h.qlock.Unlock()
 
-			// Wait for this handler to become available. This only wraps the
-			// handler. This is to free up the handler in case someone else
-			// needs it while we wait to send on the events chan.
-			syncedCids, err := h.handle(ctx, c, h.subscriber.dss, true, syncer, h.subscriber.generalBlockHook, h.subscriber.segDepthLimit)
+			status, err := h.syncAnnounced(ctx, c, syncer, isRecord, source)
 			if err != nil {
-				// Failed to handle the sync, so allow another announce for the same CID.
-				h.subscriber.receiver.UncacheCid(c)
-				// Log error for now.
-				log.Errorw("Cannot process message", "err", err, "publisher", h.peerID)
-				return
+				log.Errorw("Cannot process message", "err", err, "publisher", h.peerID, "source", source)
 			}
-
-			// Update latest head seen.
-			h.subscriber.latestSyncHander.SetLatestSync(h.peerID, c)
-			h.subscriber.inEvents <- SyncFinished{Cid: c, PeerID: h.peerID, SyncedCids: syncedCids}
+			h.subscriber.journal.update(h.peerID, c, status, err)
 		}()
 	} else {
 		log.Infow("Pending announce replaced by new", "previous_cid", h.pendingCid, "new_cid", nextCid, "publisher", h.peerID)
+		h.subscriber.journal.update(h.peerID, h.pendingCid, AnnounceSkipped, nil)
 	}
 	// Set the CID to be handled by the waiting goroutine.
 	h.pendingCid = nextCid
 	h.pendingSyncer = syncer
+	h.pendingIsRecord = isRecord
+	h.pendingSource = source
+	h.pendingReceived = time.Now()
 	h.qlock.Unlock()
 }
 
-var _ SegmentSyncActions = (*segmentedSync)(nil)
+// syncAnnounced syncs the CID announced by the publisher, and returns the
+// status of the announcement. If isRecord is true, then c identifies an
+// announcement record, which is resolved to the announced CID first. The
+// latestSyncMu must be held.
+func (h *handler) syncAnnounced(ctx context.Context, c cid.Cid, syncer Syncer, isRecord bool, source SyncSource) (status AnnounceStatus, err error) {
+	ctx, span := h.subscriber.tracer.Start(ctx, "handleAnnouncement", trace.WithAttributes(
+		attribute.String("peer", h.peerID.String()),
+		attribute.String("cid", c.String()),
+		attribute.Bool("isRecord", isRecord),
+		attribute.String("source", string(source))))
+	defer func() {
+		span.SetAttributes(attribute.String("status", string(status)))
+		tracing.EndSpan(span, err)
+	}()
+
+	if isRecord {
+		recCid := c
+		rctx, rspan := h.subscriber.tracer.Start(ctx, "resolveRecord", trace.WithAttributes(
+			attribute.String("record", recCid.String())))
+		c, syncer, err = h.resolveRecord(rctx, recCid, syncer)
+		tracing.EndSpan(rspan, err)
+		if err != nil {
+			// Allow another announce for the same record.
+			h.subscriber.receiver.UncacheCid(recCid)
+			return AnnounceFailed, fmt.Errorf("cannot resolve announcement record %s: %w", recCid, err)
+		}
+	}
+
+	if h.subscriber.shouldSync != nil && !h.subscriber.shouldSync(h.peerID, c) {
+		log.Infow("Skipped sync of announced CID", "cid", c, "publisher", h.peerID, "source", source)
+		return AnnounceSkipped, nil
+	}
+
+	// Wait for this handler to become available. This only wraps the
+	// handler. This is to free up the handler in case someone else
+	// needs it while we wait to send on the events chan.
+	syncedCids, skippedCids, err := h.handle(ctx, c, h.subscriber.selectorSequenceFor(h.peerID), true, syncer, h.subscriber.blockHookFor(h.peerID), h.subscriber.segDepthLimitFor(h.peerID), source)
+	if err != nil {
+		// Failed to handle the sync, so allow another announce for the same CID.
+		h.subscriber.receiver.UncacheCid(c)
+		return AnnounceFailed, err
+	}
+
+	// Update latest head seen.
+	h.subscriber.advanceLatestSync(ctx, h.peerID, c)
+	h.lastAnnouncedSync = time.Now()
+	h.subscriber.inEvents <- SyncFinished{Cid: c, PeerID: h.peerID, SyncedCids: syncedCids, SkippedCids: skippedCids, Source: source, Transport: syncTransport(syncer)}
+	return AnnounceHandled, nil
+}
+
+// resolveRecord fetches the announcement record identified by recCid from the
+// publisher, and returns the announced CID and a syncer to sync it with. If the
+// record contains addresses, then the returned syncer uses those addresses.
+func (h *handler) resolveRecord(ctx context.Context, recCid cid.Cid, syncer Syncer) (cid.Cid, Syncer, error) {
+	// Hold the sync lock so that fetching the record is not reported to the
+	// block hook of another sync with the same publisher.
+	h.syncMutex.Lock()
+	err := syncer.Sync(ctx, recCid, selectorparse.CommonSelector_MatchPoint)
+	h.syncMutex.Unlock()
+	if err != nil {
+		return cid.Undef, nil, fmt.Errorf("cannot fetch announcement record: %w", err)
+	}
+
+	// A record fetched by a staged syncer is read from the staging area.
+	lsys := h.subscriber.linkSystemFor(h.peerID)
+	if _, ok := syncer.(*stagedSyncer); ok {
+		lsys = h.subscriber.staging.linkSystem(h.peerID)
+	}
+	n, err := lsys.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: recCid}, basicnode.Prototype.Any)
+	if err != nil {
+		return cid.Undef, nil, fmt.Errorf("cannot load announcement record: %w", err)
+	}
+	msg, err := gossiptopic.MessageFromRecord(n)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	if len(msg.Addrs) != 0 {
+		addrs, err := msg.GetAddrs()
+		if err != nil {
+			return cid.Undef, nil, fmt.Errorf("cannot decode announcement record addresses: %w", err)
+		}
+		s := h.subscriber
+		syncer, _, err = s.makeStagedSyncer(h.peerID, addrs, s.addrTTL, nil)
+		if err != nil {
+			return cid.Undef, nil, err
+		}
+	}
+	log.Debugw("Resolved announcement record", "record", recCid, "cid", msg.Cid, "publisher", h.peerID)
+	return msg.Cid, syncer, nil
+}
+
+var _ SegmentSyncActions = blockActions{}
 
 type (
 	// SegmentSyncActions allows the user to control the flow of segmented sync
@@ -761,6 +1896,11 @@ type (
 		// a segmented sync cycle dictates the error value. Passing nil as
 		// error will cancel sync failure.
 		FailSync(error)
+
+		// FromLocalStore returns true if the block passed to the hook was
+		// already in the local store, and false if it was received from the
+		// publisher by the sync.
+		FromLocalStore() bool
 	}
 	// SegmentBlockHookFunc is called for each synced block, similarly to
 	// BlockHookFunc. Except that it provides SegmentSyncActions to the hook
@@ -791,22 +1931,96 @@ func (ss *segmentedSync) reset() {
 	ss.err = nil
 }
 
-// handle processes a message from the peer that the handler is responsible for.
-func (h *handler) handle(ctx context.Context, nextCid cid.Cid, sel ipld.Node, wrapSel bool, syncer Syncer, bh BlockHookFunc, segdl int64) ([]cid.Cid, error) {
+// blockActions are the SegmentSyncActions passed to a block hook for a single
+// block.
+type blockActions struct {
+	*segmentedSync
+	local bool
+}
+
+func (ba blockActions) FromLocalStore() bool {
+	return ba.local
+}
+
+// syncedBlock is a block reached by a sync, and whether it was found in the
+// local store.
+type syncedBlock struct {
+	c     cid.Cid
+	local bool
+}
+
+// handle processes a message from the peer that the handler is responsible
+// for. Returns the CIDs that were synced, and the CIDs in the skip list that
+// were reached and not synced.
+func (h *handler) handle(ctx context.Context, nextCid cid.Cid, sel ipld.Node, wrapSel bool, syncer Syncer, bh BlockHookFunc, segdl int64, source SyncSource) (synced, skipped []cid.Cid, err error) {
 	h.syncMutex.Lock()
 	defer h.syncMutex.Unlock()
 	log := log.With("cid", nextCid, "peer", h.peerID)
+	rootCid := nextCid
+
+	if h.subscriber.skipList.has(nextCid) {
+		log.Infow("Not syncing cid in skip list")
+		return nil, []cid.Cid{nextCid}, nil
+	}
+	// Forget a quota error left by a sync that was not handled here, such as
+	// the fetch of an announcement record.
+	h.subscriber.quotas.takeExceeded(h.peerID)
 
 	segSync := &segmentedSync{
 		nextSyncCid: &nextCid,
 	}
 
-	var syncedCids []cid.Cid
-	hook := func(p peer.ID, c cid.Cid) {
+	var syncedCids, skippedCids []cid.Cid
+	// active is the status of the sync, once it has started.
+	var active *activeSync
+	// stateErr is the first error from the sets and queues that hold the
+	// traversal state. It fails the sync once the transport returns.
+	var stateErr error
+	pending := h.subscriber.syncState.newQueue()
+	defer pending.discard(context.Background())
+	var hooked cidSet
+	if h.subscriber.dedupHook {
+		hooked = h.subscriber.syncState.newSet()
+		defer hooked.discard(context.Background())
+	}
+	callHook := func(p peer.ID, c cid.Cid, local bool) {
+		if hooked != nil {
+			added, err := hooked.add(ctx, c)
+			if err != nil {
+				if stateErr == nil {
+					stateErr = fmt.Errorf("cannot record hooked block: %w", err)
+				}
+				return
+			}
+			if !added {
+				return
+			}
+		}
 		syncedCids = append(syncedCids, c)
+		active.addBlock()
+		if h.subscriber.eventSink != nil {
+			h.subscriber.eventSink.OnBlock(p, c)
+		}
 		if bh != nil {
-			bh(p, c, segSync)
+			bh(p, c, blockActions{segSync, local})
 		}
+		h.subscriber.reportProgress(p, rootCid, source, syncedCids)
+	}
+	hook := func(p peer.ID, c cid.Cid, local bool) {
+		if h.subscriber.skipList.has(c) {
+			log.Infow("Skipped cid in skip list", "skipped", c)
+			skippedCids = append(skippedCids, c)
+			return
+		}
+		if h.subscriber.orderedHook {
+			// Blocks are passed to callHook in traversal order after
+			// they are synced.
+			if err := pending.push(ctx, syncedBlock{c, local}); err != nil && stateErr == nil {
+				stateErr = fmt.Errorf("cannot queue synced block: %w", err)
+			}
+			return
+		}
+		callHook(p, c, local)
 	}
 	h.subscriber.scopedBlockHookMutex.Lock()
 	h.subscriber.scopedBlockHook[h.peerID] = hook
@@ -819,9 +2033,10 @@ func (h *handler) handle(ctx context.Context, nextCid cid.Cid, sel ipld.Node, wr
 
 	if wrapSel {
 		var latestSyncLink ipld.Link
-		latestSync, ok := h.subscriber.latestSyncHander.GetLatestSync(h.peerID)
+		latestSync, ok := h.subscriber.getLatestSync(h.peerID)
 		if ok && latestSync != cid.Undef {
 			latestSyncLink = cidlink.Link{Cid: latestSync}
+			trace.SpanFromContext(ctx).SetAttributes(attribute.String("stopAt", latestSync.String()))
 		}
 		sel = ExploreRecursiveWithStopNode(h.subscriber.syncRecLimit, sel, latestSyncLink)
 	}
@@ -829,9 +2044,40 @@ func (h *handler) handle(ctx context.Context, nextCid cid.Cid, sel ipld.Node, wr
 	stopNode, stopNodeOK := getStopNode(sel)
 	if stopNodeOK && stopNode.(cidlink.Link).Cid == nextCid {
 		log.Infow("cid to sync to is the stop node. Nothing to do")
-		return nil, nil
+		return nil, nil, nil
 	}
 
+	var syncEnded func([]cid.Cid, error)
+	active, syncEnded = h.subscriber.startSync(h.peerID, rootCid, source)
+	defer func() {
+		syncEnded(synced, err)
+		// Record the block counts on the span of the sync.
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.Int("syncedBlocks", len(synced)),
+			attribute.Int("skippedBlocks", len(skipped)))
+	}()
+
+	// Wait for any sync of the same head from another publisher, so that this
+	// sync completes from the blocks that the other sync stored.
+	headSyncDone, err := h.subscriber.headSyncs.start(ctx, rootCid)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer headSyncDone()
+
+	// Blocks left staged by a previous sync that failed are discarded, so
+	// that only the blocks of this sync are committed.
+	_, staged := syncer.(*stagedSyncer)
+	if staged {
+		if err = h.subscriber.staging.clear(ctx, h.peerID); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Connect to the publisher, waiting for hole punching if only connected
+	// through a relay, and count the connection when the sync is done.
+	defer h.subscriber.connectForSync(ctx, h.peerID, syncer)()
+
 	var syncBySegment bool
 	var origLimit selector.RecursionLimit
 	// Only attempt to detect recursion limit in original selector if maximum segment depth is
@@ -861,11 +2107,32 @@ func (h *handler) handle(ctx context.Context, nextCid cid.Cid, sel ipld.Node, wr
 	if !syncBySegment {
 		log.Debugw("Falling back on sync in one go", "segDepthLimit", segdl)
 		err := syncer.Sync(ctx, nextCid, sel)
+		if qerr := h.subscriber.quotas.takeExceeded(h.peerID); qerr != nil {
+			err = qerr
+		}
+		if ferr := h.subscriber.writeBatch.flush(ctx); ferr != nil && err == nil {
+			err = ferr
+		}
+		if err == nil {
+			err = stateErr
+		}
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		if err = h.callHookOrdered(ctx, nextCid, sel, staged, pending, callHook); err != nil {
+			return nil, nil, err
+		}
+		if stateErr != nil {
+			return nil, nil, stateErr
+		}
+		if staged {
+			if err = h.subscriber.staging.commit(ctx, h.peerID); err != nil {
+				return nil, nil, err
+			}
 		}
 		log.Infow("Sync completed")
-		return syncedCids, nil
+		h.setLastSync(rootCid, stopNode, syncedCids)
+		return syncedCids, skippedCids, nil
 	}
 
 	var nextDepth = segdl
@@ -877,18 +2144,37 @@ SegSyncLoop:
 		if !ok {
 			// This should not happen if we were able to extract origLimit from sel.
 			// If this happens there is likely a bug. Fail fast.
-			return nil, fmt.Errorf("failed to construct segment selector with recursion depth limit of %d", nextDepth)
+			return nil, nil, fmt.Errorf("failed to construct segment selector with recursion depth limit of %d", nextDepth)
 		}
 		nextCid = *segSync.nextSyncCid
 		segSync.reset()
 		err := syncer.Sync(ctx, nextCid, segmentSel)
+		if qerr := h.subscriber.quotas.takeExceeded(h.peerID); qerr != nil {
+			err = qerr
+		}
+		if ferr := h.subscriber.writeBatch.flush(ctx); ferr != nil && err == nil {
+			err = ferr
+		}
+		if err == nil {
+			err = stateErr
+		}
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		err = h.callHookOrdered(ctx, nextCid, segmentSel, staged, pending, callHook)
+		if derr := pending.discard(ctx); derr != nil && err == nil {
+			err = derr
+		}
+		if err == nil {
+			err = stateErr
+		}
+		if err != nil {
+			return nil, nil, err
 		}
 		depthSoFar += nextDepth
 
 		if segSync.err != nil {
-			return nil, segSync.err
+			return nil, nil, segSync.err
 		}
 
 		// If hook action is not called, or next CID is set to cid.Undef then break out of the
@@ -915,10 +2201,124 @@ SegSyncLoop:
 				nextDepth = remainingDepth
 			}
 		default:
-			return nil, fmt.Errorf("unknown recursion limit mode: %v", origLimit.Mode())
+			return nil, nil, fmt.Errorf("unknown recursion limit mode: %v", origLimit.Mode())
 		}
 	}
 
+	if staged {
+		if err = h.subscriber.staging.commit(ctx, h.peerID); err != nil {
+			return nil, nil, err
+		}
+	}
 	log.Infow("Segmented sync completed", "syncedCidCount", len(syncedCids))
-	return syncedCids, nil
+	h.setLastSync(rootCid, stopNode, syncedCids)
+	return syncedCids, skippedCids, nil
+}
+
+// callHookOrdered calls hook with each of the pending CIDs, in the order that
+// they are reached by walking the synced blocks from root with sel. Pending
+// CIDs that the walk does not reach are passed to hook after the walk, in the
+// order they were received. See: OrderedBlockHook.
+func (h *handler) callHookOrdered(ctx context.Context, root cid.Cid, sel ipld.Node, staged bool, pending cidQueue, hook func(peer.ID, cid.Cid, bool)) error {
+	// A block reached more than once is local if it was never received.
+	remaining := h.subscriber.syncState.newSet()
+	defer remaining.discard(context.Background())
+	received := h.subscriber.syncState.newSet()
+	defer received.discard(context.Background())
+	var count int
+	err := pending.each(ctx, func(b syncedBlock) error {
+		count++
+		if _, err := remaining.add(ctx, b.c); err != nil {
+			return err
+		}
+		if !b.local {
+			if _, err := received.add(ctx, b.c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot read pending blocks: %w", err)
+	}
+	if count == 0 {
+		return nil
+	}
+
+	// callOnce calls hook with c if it is remaining, and then removes it.
+	callOnce := func(c cid.Cid) error {
+		ok, err := remaining.has(ctx, c)
+		if err != nil || !ok {
+			return err
+		}
+		if err = remaining.remove(ctx, c); err != nil {
+			return err
+		}
+		rcvd, err := received.has(ctx, c)
+		if err != nil {
+			return err
+		}
+		hook(h.peerID, c, !rcvd)
+		return nil
+	}
+
+	// Blocks of a staged sync are not in the publisher's link system until
+	// they are committed.
+	lsys := h.subscriber.linkSystemFor(h.peerID)
+	if staged {
+		lsys = h.subscriber.staging.linkSystem(h.peerID)
+	}
+	var visitErr error
+	err = h.subscriber.walkLinkSystem(ctx, lsys, root, sel, func(c cid.Cid) {
+		if err := callOnce(c); err != nil && visitErr == nil {
+			visitErr = err
+		}
+	})
+	if err == nil {
+		err = visitErr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot walk synced blocks in traversal order: %w", err)
+	}
+	err = pending.each(ctx, func(b syncedBlock) error {
+		return callOnce(b.c)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot call hook with unwalked blocks: %w", err)
+	}
+	return nil
+}
+
+// setLastSync records the root, stop node, and the traversed CIDs of the last
+// completed sync, so that the synced blocks can be exported and repaired.
+func (h *handler) setLastSync(root cid.Cid, stopNode ipld.Link, syncedCids []cid.Cid) {
+	h.lastSyncMutex.Lock()
+	h.lastSyncRoot = root
+	h.lastSyncCids = syncedCids
+	h.lastSyncStop = cid.Undef
+	if stopLnk, ok := stopNode.(cidlink.Link); ok {
+		h.lastSyncStop = stopLnk.Cid
+	}
+	h.lastSyncMutex.Unlock()
+}
+
+// syncFailReason returns the reason that a sync failed with err, for metrics,
+// or an empty string if err is nil.
+func syncFailReason(err error) string {
+	var rlErr dtsync.ResourceLimitError
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.Canceled):
+		return metrics.ReasonCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return metrics.ReasonTimeout
+	case errors.As(err, &rlErr):
+		return metrics.ReasonResourceLimit
+	case errors.Is(err, ErrQuotaExceeded):
+		return metrics.ReasonQuotaExceeded
+	case errors.Is(err, dtsync.ErrContentNotFound), errors.Is(err, httpsync.ErrContentNotFound):
+		return metrics.ReasonNotFound
+	}
+	return metrics.ReasonError
 }
@@ -1,9 +1,12 @@
 package legs_test
 
 import (
+	"bytes"
 	"context"
 	cryptorand "crypto/rand"
+	"fmt"
 	"math/rand"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -11,24 +14,31 @@ import (
 	"time"
 
 	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/bsutil"
+	"github.com/filecoin-project/go-legs/carutil"
 	"github.com/filecoin-project/go-legs/dtsync"
 	"github.com/filecoin-project/go-legs/httpsync"
 	"github.com/filecoin-project/go-legs/test"
+	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/datamodel"
 	"github.com/ipld/go-ipld-prime/linking"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	"github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorbuilder "github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/multiformats/go-multicodec"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/time/rate"
 )
@@ -119,6 +129,64 @@ func TestScopedBlockHook(t *testing.T) {
 	}
 }
 
+func TestPublisherBlockHook(t *testing.T) {
+	pubSys := newHostSystem(t)
+	otherSys := newHostSystem(t)
+	subSys := newHostSystem(t)
+	defer pubSys.close()
+	defer otherSys.close()
+	defer subSys.close()
+
+	var generalCids, pubCids []cid.Cid
+	var mutex sync.Mutex
+	subOpts := []legs.Option{
+		legs.BlockHook(func(_ peer.ID, c cid.Cid, _ legs.SegmentSyncActions) {
+			mutex.Lock()
+			generalCids = append(generalCids, c)
+			mutex.Unlock()
+		}),
+		legs.PublisherBlockHook(pubSys.host.ID(), func(_ peer.ID, c cid.Cid, _ legs.SegmentSyncActions) {
+			mutex.Lock()
+			pubCids = append(pubCids, c)
+			mutex.Unlock()
+		}),
+	}
+	pubAddr, pub, sub := legsPubSubBuilder{}.Build(t, testTopic, pubSys, subSys, subOpts)
+	defer pub.Close()
+	defer sub.Close()
+	otherPub, err := dtsync.NewPublisher(otherSys.host, otherSys.ds, otherSys.lsys, testTopic)
+	require.NoError(t, err)
+	defer otherPub.Close()
+
+	ctx := context.Background()
+	head := llBuilder{Length: 3, Seed: 1}.Build(t, pubSys.lsys)
+	require.NoError(t, pub.SetRoot(ctx, head.(cidlink.Link).Cid))
+	otherHead := llBuilder{Length: 2, Seed: 2}.Build(t, otherSys.lsys)
+	require.NoError(t, otherPub.SetRoot(ctx, otherHead.(cidlink.Link).Cid))
+
+	// The publisher's hook is called for the publisher's blocks, and the
+	// general hook for the other publisher's blocks.
+	_, err = sub.Sync(ctx, pubSys.host.ID(), cid.Undef, nil, pubAddr)
+	require.NoError(t, err)
+	_, err = sub.Sync(ctx, otherSys.host.ID(), cid.Undef, nil, otherSys.host.Addrs()[0])
+	require.NoError(t, err)
+	mutex.Lock()
+	require.Len(t, pubCids, 3)
+	require.Len(t, generalCids, 2)
+	mutex.Unlock()
+
+	// Removing the publisher's hook restores the general hook.
+	sub.SetPublisherBlockHook(pubSys.host.ID(), nil)
+	next := llBuilder{Length: 2, Seed: 3}.BuildWithPrev(t, pubSys.lsys, head)
+	require.NoError(t, pub.SetRoot(ctx, next.(cidlink.Link).Cid))
+	_, err = sub.Sync(ctx, pubSys.host.ID(), cid.Undef, nil, pubAddr)
+	require.NoError(t, err)
+	mutex.Lock()
+	require.Len(t, pubCids, 3)
+	require.Len(t, generalCids, 4)
+	mutex.Unlock()
+}
+
 func TestSyncedCidsReturned(t *testing.T) {
 	err := quick.Check(func(ll llBuilder) bool {
 		return t.Run("Quickcheck", func(t *testing.T) {
@@ -315,8 +383,223 @@ func TestSync(t *testing.T) {
 	}
 }
 
+func TestStartSyncCancel(t *testing.T) {
+	pubSys := newHostSystem(t)
+	subSys := newHostSystem(t)
+	defer pubSys.close()
+	defer subSys.close()
+
+	pubAddr, pub, sub := legsPubSubBuilder{}.Build(t, testTopic, pubSys, subSys, nil)
+	defer pub.Close()
+	defer sub.Close()
+
+	head := llBuilder{Length: 3, Seed: 1}.Build(t, pubSys.lsys)
+	headCid := head.(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(context.Background(), headCid))
+
+	// Block the transfer in the block hook so that the sync is canceled while
+	// data is being transferred.
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var startOnce sync.Once
+	hook := func(peer.ID, cid.Cid, legs.SegmentSyncActions) {
+		startOnce.Do(func() { close(started) })
+		<-release
+	}
+	defer close(release)
+
+	h := sub.StartSync(context.Background(), pubSys.host.ID(), headCid, nil, pubAddr, legs.ScopedBlockHook(hook))
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for sync to start")
+	}
+
+	h.Cancel()
+	select {
+	case <-h.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for canceled sync to finish")
+	}
+	_, err := h.Result()
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestImportCAR(t *testing.T) {
+	pubSys := newHostSystem(t)
+	subSys := newHostSystem(t)
+	defer pubSys.close()
+	defer subSys.close()
+
+	pubAddr, pub, sub := legsPubSubBuilder{}.Build(t, testTopic, pubSys, subSys, nil)
+	defer pub.Close()
+	defer sub.Close()
+
+	ctx := context.Background()
+	head := llBuilder{Length: 5, Seed: 1}.Build(t, pubSys.lsys)
+	headCid := head.(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(ctx, headCid))
+
+	// Export the publisher's chain as a CAR file.
+	var wantCids []cid.Cid
+	blockHook := func(_ peer.ID, c cid.Cid, _ legs.SegmentSyncActions) {
+		wantCids = append(wantCids, c)
+	}
+	_, err := sub.Sync(ctx, pubSys.host.ID(), cid.Undef, nil, pubAddr, legs.ScopedBlockHook(blockHook))
+	require.NoError(t, err)
+	var car bytes.Buffer
+	require.NoError(t, sub.WriteLastSyncCAR(ctx, pubSys.host.ID(), &car))
+
+	// Import the CAR file into a subscriber that is not connected to the
+	// publisher.
+	importSys := newHostSystem(t)
+	defer importSys.close()
+	importSub, err := legs.NewSubscriber(importSys.host, importSys.ds, importSys.lsys, testTopic, nil)
+	require.NoError(t, err)
+	defer importSub.Close()
+	watcher, cncl := importSub.OnSyncFinished()
+	defer cncl()
+
+	c, err := importSub.ImportCAR(ctx, pubSys.host.ID(), &car)
+	require.NoError(t, err)
+	require.Equal(t, headCid, c)
+	require.Equal(t, headCid, importSub.GetLatestSync(pubSys.host.ID()).(cidlink.Link).Cid)
+
+	select {
+	case event := <-watcher:
+		require.Equal(t, pubSys.host.ID(), event.PeerID)
+		require.Equal(t, headCid, event.Cid)
+		require.Equal(t, wantCids, event.SyncedCids)
+	case <-time.After(updateTimeout):
+		t.Fatal("timed out waiting for sync finished event")
+	}
+	for _, c := range wantCids {
+		has, err := importSys.ds.Has(ctx, datastore.NewKey(c.String()))
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+
+	// A CAR file missing blocks of the chain is rejected.
+	car.Reset()
+	require.NoError(t, carutil.WriteV2(ctx, pubSys.lsys, &car, []cid.Cid{headCid}, wantCids[:2]))
+	partialSys := newHostSystem(t)
+	defer partialSys.close()
+	partialSub, err := legs.NewSubscriber(partialSys.host, partialSys.ds, partialSys.lsys, testTopic, nil)
+	require.NoError(t, err)
+	defer partialSub.Close()
+	_, err = partialSub.ImportCAR(ctx, pubSys.host.ID(), &car)
+	require.Error(t, err)
+	require.Nil(t, partialSub.GetLatestSync(pubSys.host.ID()))
+
+	// A CAR file with more than one root is rejected before its blocks are
+	// stored.
+	car.Reset()
+	require.NoError(t, carutil.WriteV2(ctx, pubSys.lsys, &car, []cid.Cid{headCid, wantCids[1]}, wantCids))
+	rootsSys := newHostSystem(t)
+	defer rootsSys.close()
+	rootsSub, err := legs.NewSubscriber(rootsSys.host, rootsSys.ds, rootsSys.lsys, testTopic, nil)
+	require.NoError(t, err)
+	defer rootsSub.Close()
+	_, err = rootsSub.ImportCAR(ctx, pubSys.host.ID(), &car)
+	require.Error(t, err)
+	for _, c := range wantCids {
+		has, err := rootsSys.ds.Has(ctx, datastore.NewKey(c.String()))
+		require.NoError(t, err)
+		require.False(t, has)
+	}
+
+	// The blocks of an import that fails are left staged, the same as for a
+	// sync that fails, and are not committed.
+	car.Reset()
+	require.NoError(t, carutil.WriteV2(ctx, pubSys.lsys, &car, []cid.Cid{headCid}, wantCids[:2]))
+	stagedSys := newHostSystem(t)
+	defer stagedSys.close()
+	stagedSub, err := legs.NewSubscriber(stagedSys.host, stagedSys.ds, stagedSys.lsys, testTopic, nil,
+		legs.StagingDatastore(dssync.MutexWrap(datastore.NewMapDatastore())))
+	require.NoError(t, err)
+	defer stagedSub.Close()
+	_, err = stagedSub.ImportCAR(ctx, pubSys.host.ID(), &car)
+	require.Error(t, err)
+	staged, err := stagedSub.StagedBlocks(ctx, pubSys.host.ID())
+	require.NoError(t, err)
+	require.ElementsMatch(t, wantCids[:2], staged)
+	for _, c := range wantCids {
+		has, err := stagedSys.ds.Has(ctx, datastore.NewKey(c.String()))
+		require.NoError(t, err)
+		require.False(t, has)
+	}
+}
+
 // TestSyncWithHydratedDataStore tests what happens if we call sync when the
 // subscriber datastore already has the dag.
+func TestSyncAt(t *testing.T) {
+	for _, isHttp := range []bool{false, true} {
+		name := "dtsync"
+		if isHttp {
+			name = "httpsync"
+		}
+		t.Run(name, func(t *testing.T) {
+			pubSys := newHostSystem(t)
+			subSys := newHostSystem(t)
+			defer pubSys.close()
+			defer subSys.close()
+
+			sink := &recordingSink{}
+			subOpts := []legs.Option{legs.SyncEventSink(sink)}
+			pubAddr, pub, sub := legsPubSubBuilder{IsHttp: isHttp}.Build(t, testTopic, pubSys, subSys, subOpts)
+			defer pub.Close()
+			defer sub.Close()
+
+			ctx := context.Background()
+			oldHead := llBuilder{Length: 3, Seed: 1}.Build(t, pubSys.lsys)
+			newHead := llBuilder{Length: 2, Seed: 2}.BuildWithPrev(t, pubSys.lsys, oldHead)
+			oldHeadCid := oldHead.(cidlink.Link).Cid
+			newHeadCid := newHead.(cidlink.Link).Cid
+			require.NoError(t, pub.SetRoot(ctx, newHeadCid))
+
+			// Sync the chain as of the old head, to its end.
+			auditStore := dssync.MutexWrap(datastore.NewMapDatastore())
+			cids, err := sub.SyncAt(ctx, pubSys.host.ID(), oldHeadCid, cid.Undef, test.MkLinkSystem(auditStore), legs.ScopedAddrs(pubAddr))
+			require.NoError(t, err)
+			require.Len(t, cids, 3)
+			require.Equal(t, oldHeadCid, cids[0])
+			for _, c := range cids {
+				has, err := auditStore.Has(ctx, datastore.NewKey(c.String()))
+				require.NoError(t, err)
+				require.True(t, has)
+				has, err = subSys.ds.Has(ctx, datastore.NewKey(c.String()))
+				require.NoError(t, err)
+				require.False(t, has, "block should not be stored in subscriber link system")
+			}
+
+			// Sync the chain from the new head, stopping at the old head.
+			auditStore = dssync.MutexWrap(datastore.NewMapDatastore())
+			cids, err = sub.SyncAt(ctx, pubSys.host.ID(), newHeadCid, oldHeadCid, test.MkLinkSystem(auditStore), legs.ScopedAddrs(pubAddr))
+			require.NoError(t, err)
+			require.Len(t, cids, 2)
+			require.Equal(t, newHeadCid, cids[0])
+
+			// A failed sync is not reported in Status either.
+			missing, err := test.RandomCids(1)
+			require.NoError(t, err)
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			_, err = sub.SyncAt(ctx, pubSys.host.ID(), missing[0], cid.Undef, test.MkLinkSystem(auditStore), legs.ScopedAddrs(pubAddr))
+			require.Error(t, err)
+
+			require.Nil(t, sub.GetLatestSync(pubSys.host.ID()), "latest sync should not be set")
+			status := sub.Status()
+			require.Empty(t, status.Active)
+			require.Empty(t, status.Failures)
+			sink.mutex.Lock()
+			defer sink.mutex.Unlock()
+			require.Empty(t, sink.starts, "sync at should not be sent to event sink")
+			require.Empty(t, sink.blocks)
+			require.Empty(t, sink.ends)
+		})
+	}
+}
+
 func TestSyncWithHydratedDataStore(t *testing.T) {
 	err := quick.Check(func(lpsb legsPubSubBuilder, ll llBuilder) bool {
 		return t.Run("Quickcheck", func(t *testing.T) {
@@ -612,6 +895,274 @@ func TestRateLimiter(t *testing.T) {
 
 }
 
+func TestOrderedBlockHook(t *testing.T) {
+	type testCase struct {
+		name      string
+		isHttp    bool
+		segmented bool
+	}
+
+	testCases := []testCase{
+		{"DT ordered", false, false},
+		{"HTTP ordered", true, false},
+		{"DT segmented ordered", false, true},
+		{"HTTP segmented ordered", true, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pubHostSys := newHostSystem(t)
+			subHostSys := newHostSystem(t)
+			defer pubHostSys.close()
+			defer subHostSys.close()
+
+			// Rate limit the sync so that fetches are delayed and retried.
+			limiter := rate.NewLimiter(rate.Every(10*time.Millisecond), 1)
+			var hooked []cid.Cid
+			var hookedMutex sync.Mutex
+			blockHook := func(_ peer.ID, c cid.Cid, actions legs.SegmentSyncActions) {
+				hookedMutex.Lock()
+				hooked = append(hooked, c)
+				hookedMutex.Unlock()
+				if !tc.segmented {
+					return
+				}
+				// The block is stored before the hook is called, so the next
+				// segment can be found from it.
+				n, err := subHostSys.lsys.Load(ipld.LinkContext{}, cidlink.Link{Cid: c}, basicnode.Prototype.Any)
+				if err != nil {
+					actions.FailSync(err)
+					return
+				}
+				next, err := n.LookupByString("Next")
+				if err != nil || next.IsNull() {
+					actions.SetNextSyncCid(cid.Undef)
+					return
+				}
+				nextLnk, err := next.AsLink()
+				if err != nil {
+					actions.FailSync(err)
+					return
+				}
+				actions.SetNextSyncCid(nextLnk.(cidlink.Link).Cid)
+			}
+			opts := []legs.Option{
+				legs.BlockHook(blockHook),
+				legs.OrderedBlockHook(true),
+				legs.RateLimiter(func(publisher peer.ID) *rate.Limiter {
+					return limiter
+				}),
+			}
+			if tc.segmented {
+				opts = append(opts, legs.SegmentDepthLimit(2))
+			}
+			pubAddr, pub, sub := legsPubSubBuilder{
+				IsHttp: tc.isHttp,
+			}.Build(t, testTopic, pubHostSys, subHostSys, opts)
+
+			head := llBuilder{Length: 5, Seed: 1}.Build(t, pubHostSys.lsys)
+			require.NoError(t, pub.SetRoot(context.Background(), head.(cidlink.Link).Cid))
+
+			// The chain in traversal order, from head to tail.
+			var want []cid.Cid
+			for lnk := head; lnk != nil; {
+				want = append(want, lnk.(cidlink.Link).Cid)
+				n, err := pubHostSys.lsys.Load(ipld.LinkContext{}, lnk, basicnode.Prototype.Any)
+				require.NoError(t, err)
+				next, err := n.LookupByString("Next")
+				require.NoError(t, err)
+				lnk = nil
+				if !next.IsNull() {
+					lnk, err = next.AsLink()
+					require.NoError(t, err)
+				}
+			}
+
+			syncCid, err := sub.Sync(context.Background(), pubHostSys.host.ID(), cid.Undef, nil, pubAddr)
+			require.NoError(t, err)
+			require.Equal(t, head.(cidlink.Link).Cid, syncCid)
+
+			hookedMutex.Lock()
+			defer hookedMutex.Unlock()
+			require.Equal(t, want, hooked)
+		})
+	}
+}
+
+func TestDedupBlockHook(t *testing.T) {
+	type testCase struct {
+		name   string
+		isHttp bool
+	}
+
+	testCases := []testCase{
+		{"DT dedup", false},
+		{"HTTP dedup", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pubHostSys := newHostSystem(t)
+			subHostSys := newHostSystem(t)
+			defer pubHostSys.close()
+			defer subHostSys.close()
+
+			var hooked []cid.Cid
+			local := make(map[cid.Cid]bool)
+			var hookedMutex sync.Mutex
+			blockHook := func(_ peer.ID, c cid.Cid, actions legs.SegmentSyncActions) {
+				hookedMutex.Lock()
+				defer hookedMutex.Unlock()
+				hooked = append(hooked, c)
+				local[c] = actions.FromLocalStore()
+			}
+			pubAddr, pub, sub := legsPubSubBuilder{
+				IsHttp: tc.isHttp,
+			}.Build(t, testTopic, pubHostSys, subHostSys, []legs.Option{
+				legs.BlockHook(blockHook),
+				legs.DedupBlockHook(true),
+			})
+
+			// The root links to the same leaf twice, and to a leaf that the
+			// subscriber already has.
+			leaf := storeLinkedNode(t, pubHostSys.lsys, 1)
+			storedLeaf := storeLinkedNode(t, pubHostSys.lsys, 2)
+			storeLinkedNode(t, subHostSys.lsys, 2)
+			root := storeLinkedNode(t, pubHostSys.lsys, 3, leaf, leaf, storedLeaf)
+			require.NoError(t, pub.SetRoot(context.Background(), root.(cidlink.Link).Cid))
+
+			watcher, cancelWatcher := sub.OnSyncFinished()
+			defer cancelWatcher()
+
+			_, err := sub.Sync(context.Background(), pubHostSys.host.ID(), cid.Undef, nil, pubAddr)
+			require.NoError(t, err)
+
+			var syncFinished legs.SyncFinished
+			select {
+			case syncFinished = <-watcher:
+			case <-time.After(updateTimeout):
+				t.Fatal("timed out waiting for sync to finish")
+			}
+
+			hookedMutex.Lock()
+			defer hookedMutex.Unlock()
+			want := []cid.Cid{root.(cidlink.Link).Cid, leaf.(cidlink.Link).Cid, storedLeaf.(cidlink.Link).Cid}
+			require.ElementsMatch(t, want, hooked)
+			require.ElementsMatch(t, want, syncFinished.SyncedCids)
+			require.False(t, local[root.(cidlink.Link).Cid])
+			require.False(t, local[leaf.(cidlink.Link).Cid])
+			if tc.isHttp {
+				// Graphsync transfers every block that the publisher
+				// traverses, so only a http sync finds the stored leaf.
+				require.True(t, local[storedLeaf.(cidlink.Link).Cid])
+			}
+		})
+	}
+}
+
+func TestSyncStateDatastore(t *testing.T) {
+	type testCase struct {
+		name   string
+		isHttp bool
+	}
+
+	testCases := []testCase{
+		{"DT sync state", false},
+		{"HTTP sync state", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pubHostSys := newHostSystem(t)
+			subHostSys := newHostSystem(t)
+			defer pubHostSys.close()
+			defer subHostSys.close()
+
+			// State left by a previous Subscriber is removed.
+			stateDS := dssync.MutexWrap(datastore.NewMapDatastore())
+			staleKey := datastore.NewKey("/legs/syncstate/1/stale")
+			require.NoError(t, stateDS.Put(context.Background(), staleKey, nil))
+
+			var hooked []cid.Cid
+			var hookedMutex sync.Mutex
+			blockHook := func(_ peer.ID, c cid.Cid, _ legs.SegmentSyncActions) {
+				hookedMutex.Lock()
+				defer hookedMutex.Unlock()
+				hooked = append(hooked, c)
+			}
+			pubAddr, pub, sub := legsPubSubBuilder{
+				IsHttp: tc.isHttp,
+			}.Build(t, testTopic, pubHostSys, subHostSys, []legs.Option{
+				legs.BlockHook(blockHook),
+				legs.OrderedBlockHook(true),
+				legs.DedupBlockHook(true),
+				legs.SyncStateDatastore(stateDS),
+			})
+			has, err := stateDS.Has(context.Background(), staleKey)
+			require.NoError(t, err)
+			require.False(t, has)
+
+			// The root links to the same leaf twice.
+			leaf := storeLinkedNode(t, pubHostSys.lsys, 1)
+			mid := storeLinkedNode(t, pubHostSys.lsys, 2, leaf)
+			root := storeLinkedNode(t, pubHostSys.lsys, 3, mid, leaf)
+			require.NoError(t, pub.SetRoot(context.Background(), root.(cidlink.Link).Cid))
+
+			watcher, cancelWatcher := sub.OnSyncFinished()
+			defer cancelWatcher()
+
+			_, err = sub.Sync(context.Background(), pubHostSys.host.ID(), cid.Undef, nil, pubAddr)
+			require.NoError(t, err)
+
+			var syncFinished legs.SyncFinished
+			select {
+			case syncFinished = <-watcher:
+			case <-time.After(updateTimeout):
+				t.Fatal("timed out waiting for sync to finish")
+			}
+
+			hookedMutex.Lock()
+			defer hookedMutex.Unlock()
+			want := []cid.Cid{root.(cidlink.Link).Cid, mid.(cidlink.Link).Cid, leaf.(cidlink.Link).Cid}
+			require.Equal(t, want, hooked)
+			require.ElementsMatch(t, want, syncFinished.SyncedCids)
+
+			// The state of the sync is removed when it ends.
+			results, err := stateDS.Query(context.Background(), query.Query{KeysOnly: true})
+			require.NoError(t, err)
+			entries, err := results.Rest()
+			require.NoError(t, err)
+			require.Empty(t, entries)
+		})
+	}
+}
+
+// storeLinkedNode stores a node with the value and links in lsys, and returns
+// the link to it.
+func storeLinkedNode(t *testing.T, lsys ipld.LinkSystem, value int64, links ...ipld.Link) ipld.Link {
+	linkproto := cidlink.LinkPrototype{
+		Prefix: cid.Prefix{
+			Version:  1,
+			Codec:    uint64(multicodec.DagJson),
+			MhType:   uint64(multicodec.Sha2_256),
+			MhLength: 16,
+		},
+	}
+	nb := basicnode.Prototype.Map.NewBuilder()
+	ma, err := nb.BeginMap(int64(len(links) + 1))
+	require.NoError(t, err)
+	require.NoError(t, ma.AssembleKey().AssignString("Value"))
+	require.NoError(t, ma.AssembleValue().AssignInt(value))
+	for i, lnk := range links {
+		require.NoError(t, ma.AssembleKey().AssignString(fmt.Sprintf("Link%d", i)))
+		require.NoError(t, ma.AssembleValue().AssignLink(lnk))
+	}
+	require.NoError(t, ma.Finish())
+	lnk, err := lsys.Store(ipld.LinkContext{}, linkproto, nb.Build())
+	require.NoError(t, err)
+	return lnk
+}
+
 func TestBackpressureDoesntDeadlock(t *testing.T) {
 	pubHostSys := newHostSystem(t)
 	subHostSys := newHostSystem(t)
@@ -903,3 +1454,1021 @@ func (b llBuilder) BuildWithPrev(t *testing.T, lsys ipld.LinkSystem, prev datamo
 
 	return prev
 }
+
+func TestSyncMetrics(t *testing.T) {
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	defer srcHost.Close()
+	srcLnkS := test.MkLinkSystem(srcStore)
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	dstLnkS := test.MkLinkSystem(dstStore)
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	reg := prometheus.NewRegistry()
+	sub, err := legs.NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil, legs.Metrics(reg))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	chainLnks := test.MkChain(srcLnkS, true)
+	headCid := chainLnks[0].(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(context.Background(), headCid))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = sub.Sync(ctx, srcHost.ID(), headCid, nil, nil)
+	require.NoError(t, err)
+
+	// Syncing a CID that the publisher does not have fails.
+	missing, err := test.RandomCids(1)
+	require.NoError(t, err)
+	_, err = sub.Sync(ctx, srcHost.ID(), missing[0], nil, nil)
+	require.Error(t, err)
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	values := make(map[string]float64)
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			name := mf.GetName()
+			for _, lp := range m.GetLabel() {
+				name += "," + lp.GetName() + "=" + lp.GetValue()
+			}
+			switch {
+			case m.Counter != nil:
+				values[name] = m.GetCounter().GetValue()
+			case m.Gauge != nil:
+				values[name] = m.GetGauge().GetValue()
+			case m.Histogram != nil:
+				values[name] = m.GetHistogram().GetSampleSum()
+			}
+		}
+	}
+	require.Equal(t, 2.0, values["legs_sync_syncs_started_total"])
+	require.Equal(t, 1.0, values["legs_sync_syncs_succeeded_total"])
+	require.Equal(t, 1.0, values["legs_sync_syncs_failed_total,reason=not_found"])
+	require.Zero(t, values["legs_sync_active"])
+	require.GreaterOrEqual(t, values["legs_sync_blocks,transport=dtsync"], float64(len(chainLnks)))
+	require.NotZero(t, values["legs_sync_bytes,transport=dtsync"])
+	require.Equal(t, 2.0, values["legs_sync_connections_total,connection=direct,transport=graphsync"])
+}
+
+// recordingSink is a legs.EventSink that records the events it receives.
+type recordingSink struct {
+	announces []legs.AnnouncementReceived
+	starts    []legs.SyncStarted
+	blocks    []cid.Cid
+	ends      []legs.SyncEnded
+	verifies  []legs.VerifyFailed
+	mutex     sync.Mutex
+}
+
+func (r *recordingSink) OnAnnounce(event legs.AnnouncementReceived) {
+	r.mutex.Lock()
+	r.announces = append(r.announces, event)
+	r.mutex.Unlock()
+}
+
+func (r *recordingSink) OnSyncStart(event legs.SyncStarted) {
+	r.mutex.Lock()
+	r.starts = append(r.starts, event)
+	r.mutex.Unlock()
+}
+
+func (r *recordingSink) OnBlock(_ peer.ID, c cid.Cid) {
+	r.mutex.Lock()
+	r.blocks = append(r.blocks, c)
+	r.mutex.Unlock()
+}
+
+func (r *recordingSink) OnSyncEnd(event legs.SyncEnded) {
+	r.mutex.Lock()
+	r.ends = append(r.ends, event)
+	r.mutex.Unlock()
+}
+
+func (r *recordingSink) OnVerifyFailed(event legs.VerifyFailed) {
+	r.mutex.Lock()
+	r.verifies = append(r.verifies, event)
+	r.mutex.Unlock()
+}
+
+func TestSyncEventSink(t *testing.T) {
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	defer srcHost.Close()
+	srcLnkS := test.MkLinkSystem(srcStore)
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	dstLnkS := test.MkLinkSystem(dstStore)
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	sink := &recordingSink{}
+	sub, err := legs.NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil, legs.SyncEventSink(sink))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	chainLnks := test.MkChain(srcLnkS, true)
+	firstCid := chainLnks[1].(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(context.Background(), firstCid))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = sub.Sync(ctx, srcHost.ID(), firstCid, nil, nil)
+	require.NoError(t, err)
+
+	sink.mutex.Lock()
+	require.Len(t, sink.starts, 1)
+	require.Equal(t, firstCid, sink.starts[0].Cid)
+	require.Equal(t, legs.SyncSourceSync, sink.starts[0].Source)
+	require.Len(t, sink.ends, 1)
+	require.NoError(t, sink.ends[0].Err)
+	require.Equal(t, sink.blocks, sink.ends[0].SyncedCids)
+	require.Contains(t, sink.blocks, firstCid)
+	sink.mutex.Unlock()
+
+	// An announced sync is reported from the announcement on.
+	watcher, cncl := sub.OnSyncFinished()
+	defer cncl()
+	headCid := chainLnks[0].(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(context.Background(), headCid))
+	require.NoError(t, sub.Announce(ctx, headCid, srcHost.ID(), srcHost.Addrs()))
+	select {
+	case <-watcher:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for sync to finish")
+	}
+
+	require.Eventually(t, func() bool {
+		sink.mutex.Lock()
+		defer sink.mutex.Unlock()
+		return len(sink.ends) == 2
+	}, time.Second, 10*time.Millisecond)
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	require.Len(t, sink.announces, 1)
+	require.Equal(t, headCid, sink.announces[0].Cid)
+	require.Equal(t, legs.SyncSourceDirect, sink.announces[0].Source)
+	require.Len(t, sink.starts, 2)
+	require.Equal(t, legs.SyncSourceDirect, sink.starts[1].Source)
+	require.Equal(t, headCid, sink.ends[1].Cid)
+	require.Equal(t, headCid, sink.ends[1].SyncedCids[0])
+}
+
+func TestSyncProgress(t *testing.T) {
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	defer srcHost.Close()
+	srcLnkS := test.MkLinkSystem(srcStore)
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	dstLnkS := test.MkLinkSystem(dstStore)
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	_, err = legs.NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil, legs.SyncProgressInterval(-1))
+	require.Error(t, err)
+
+	sub, err := legs.NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil, legs.SyncProgressInterval(2))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	progress, cncl := sub.OnSyncProgress()
+	defer cncl()
+	var events []legs.SyncProgress
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for event := range progress {
+			events = append(events, event)
+		}
+	}()
+
+	head := llBuilder{Length: 5, Seed: 1}.Build(t, srcLnkS)
+	headCid := head.(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(context.Background(), headCid))
+
+	watcher, cnclWatch := sub.OnSyncFinished()
+	defer cnclWatch()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = sub.Sync(ctx, srcHost.ID(), cid.Undef, nil, nil)
+	require.NoError(t, err)
+
+	var finished legs.SyncFinished
+	select {
+	case finished = <-watcher:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for sync to finish")
+	}
+	require.Len(t, finished.SyncedCids, 5)
+
+	cncl()
+	<-done
+	require.Len(t, events, 2)
+	for i, event := range events {
+		require.Equal(t, headCid, event.Cid)
+		require.Equal(t, srcHost.ID(), event.PeerID)
+		require.Equal(t, legs.SyncSourceSync, event.Source)
+		require.Equal(t, 2*(i+1), event.SyncedTotal)
+		require.Equal(t, finished.SyncedCids[2*i:2*(i+1)], event.SyncedCids)
+	}
+}
+
+func TestSyncWithBlockstore(t *testing.T) {
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	defer srcHost.Close()
+	srcBS := blockstore.NewBlockstore(srcStore)
+	srcLnkS := bsutil.LinkSystem(srcBS)
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	dstBS := blockstore.NewBlockstore(dstStore)
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+
+	pub, err := dtsync.NewPublisherWithBlockstore(srcHost, srcStore, srcBS, testTopic)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	sub, err := legs.NewSubscriberWithBlockstore(dstHost, dstStore, dstBS, testTopic, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	head := llBuilder{Length: 3, Seed: 1}.Build(t, srcLnkS)
+	headCid := head.(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(context.Background(), headCid))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var syncedCids []cid.Cid
+	blockHook := func(_ peer.ID, c cid.Cid, _ legs.SegmentSyncActions) {
+		syncedCids = append(syncedCids, c)
+	}
+	_, err = sub.Sync(ctx, srcHost.ID(), headCid, nil, nil, legs.ScopedBlockHook(blockHook))
+	require.NoError(t, err)
+	require.Len(t, syncedCids, 3)
+	for _, c := range syncedCids {
+		has, err := dstBS.Has(ctx, c)
+		require.NoError(t, err)
+		require.True(t, has, "synced block not in blockstore")
+	}
+
+	// Blocks older than the head are collected from the blockstore.
+	latest := map[peer.ID]cid.Cid{srcHost.ID(): headCid}
+	deleted, err := sub.CollectGarbage(ctx, latest, 1, legs.BlockstoreBlockDeleter(dstBS))
+	require.NoError(t, err)
+	require.Equal(t, 2, deleted)
+}
+
+// countingBlockstore counts the writes to a blockstore.
+type countingBlockstore struct {
+	blockstore.Blockstore
+	puts     int64
+	putManys int64
+}
+
+func (bs *countingBlockstore) Put(ctx context.Context, blk blocks.Block) error {
+	atomic.AddInt64(&bs.puts, 1)
+	return bs.Blockstore.Put(ctx, blk)
+}
+
+func (bs *countingBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	atomic.AddInt64(&bs.putManys, 1)
+	return bs.Blockstore.PutMany(ctx, blks)
+}
+
+func TestBatchWrites(t *testing.T) {
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	defer srcHost.Close()
+	srcLnkS := test.MkLinkSystem(srcStore)
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	dstBS := &countingBlockstore{Blockstore: blockstore.NewBlockstore(dstStore)}
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	sub, err := legs.NewSubscriberWithBlockstore(dstHost, dstStore, dstBS, testTopic, nil, legs.BatchWrites(3, 0))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Five blocks are written as a full batch of three, and the remaining
+	// two when the sync completes.
+	head := llBuilder{Length: 5, Seed: 1}.Build(t, srcLnkS)
+	headCid := head.(cidlink.Link).Cid
+	var syncedCids []cid.Cid
+	blockHook := func(_ peer.ID, c cid.Cid, _ legs.SegmentSyncActions) {
+		syncedCids = append(syncedCids, c)
+	}
+	_, err = sub.Sync(ctx, srcHost.ID(), headCid, nil, nil, legs.ScopedBlockHook(blockHook))
+	require.NoError(t, err)
+	require.Len(t, syncedCids, 5)
+	for _, c := range syncedCids {
+		has, err := dstBS.Has(ctx, c)
+		require.NoError(t, err)
+		require.True(t, has, "synced block not in blockstore")
+	}
+	require.Zero(t, atomic.LoadInt64(&dstBS.puts))
+	require.Equal(t, int64(2), atomic.LoadInt64(&dstBS.putManys))
+}
+
+func TestChainWalker(t *testing.T) {
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	defer srcHost.Close()
+	srcLnkS := test.MkLinkSystem(srcStore)
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	dstLnkS := test.MkLinkSystem(dstStore)
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	var walked []cid.Cid
+	walkFn := func(p peer.ID, c cid.Cid, n ipld.Node) error {
+		require.Equal(t, srcHost.ID(), p)
+		_, err := n.LookupByString("Value")
+		require.NoError(t, err)
+		walked = append(walked, c)
+		return nil
+	}
+	sub, err := legs.NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil, legs.ChainWalker("Next", walkFn))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The first sync delivers the whole chain, oldest first.
+	head := llBuilder{Length: 3, Seed: 1}.Build(t, srcLnkS)
+	require.NoError(t, pub.SetRoot(ctx, head.(cidlink.Link).Cid))
+	_, err = sub.Sync(ctx, srcHost.ID(), cid.Undef, nil, nil)
+	require.NoError(t, err)
+	require.Len(t, walked, 3)
+	require.Equal(t, head.(cidlink.Link).Cid, walked[2])
+	firstWalked := walked
+
+	// The next sync delivers only the new nodes.
+	walked = nil
+	newHead := llBuilder{Length: 2, Seed: 2}.BuildWithPrev(t, srcLnkS, head)
+	require.NoError(t, pub.SetRoot(ctx, newHead.(cidlink.Link).Cid))
+	_, err = sub.Sync(ctx, srcHost.ID(), cid.Undef, nil, nil)
+	require.NoError(t, err)
+	require.Len(t, walked, 2)
+	require.Equal(t, newHead.(cidlink.Link).Cid, walked[1])
+	require.NotContains(t, walked, firstWalked[0])
+
+	// The nodes link to each other in delivery order.
+	n, err := dstLnkS.Load(ipld.LinkContext{}, cidlink.Link{Cid: walked[1]}, basicnode.Prototype.Any)
+	require.NoError(t, err)
+	prev, err := n.LookupByString("Next")
+	require.NoError(t, err)
+	prevLnk, err := prev.AsLink()
+	require.NoError(t, err)
+	require.Equal(t, walked[0], prevLnk.(cidlink.Link).Cid)
+}
+
+func TestSyncMany(t *testing.T) {
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	dstLnkS := test.MkLinkSystem(dstStore)
+
+	// Each publisher publishes its own chain.
+	heads := make(map[peer.ID]cid.Cid)
+	var peerIDs []peer.ID
+	for i := 0; i < 3; i++ {
+		srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+		srcLnkS := test.MkLinkSystem(srcStore)
+		srcHost := test.MkTestHost()
+		defer srcHost.Close()
+		pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic)
+		require.NoError(t, err)
+		defer pub.Close()
+
+		head := llBuilder{Length: 3, Seed: int64(i)}.Build(t, srcLnkS).(cidlink.Link).Cid
+		require.NoError(t, pub.SetRoot(context.Background(), head))
+		dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+		heads[srcHost.ID()] = head
+		peerIDs = append(peerIDs, srcHost.ID())
+	}
+	// A publisher without a known address fails to sync.
+	unknown := test.MkTestHost()
+	unknownID := unknown.ID()
+	unknown.Close()
+
+	sub, err := legs.NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = sub.SyncMany(ctx, peerIDs, 0)
+	require.Error(t, err)
+
+	// A publisher given twice is only synced once.
+	results, err := sub.SyncMany(ctx, append(peerIDs, unknownID, peerIDs[0]), 2)
+	require.NoError(t, err)
+	got := make(map[peer.ID]legs.SyncResult)
+	for r := range results {
+		_, ok := got[r.PeerID]
+		require.False(t, ok, "more than one result for publisher")
+		got[r.PeerID] = r
+	}
+	require.Len(t, got, len(peerIDs)+1)
+	for peerID, head := range heads {
+		require.NoError(t, got[peerID].Err)
+		require.Equal(t, head, got[peerID].Cid)
+		require.Equal(t, cidlink.Link{Cid: head}, sub.GetLatestSync(peerID))
+	}
+	require.Error(t, got[unknownID].Err)
+}
+
+func TestProbe(t *testing.T) {
+	type testCase struct {
+		name   string
+		isHttp bool
+	}
+
+	testCases := []testCase{
+		{"DT probe", false},
+		{"HTTP probe", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pubHostSys := newHostSystem(t)
+			subHostSys := newHostSystem(t)
+			defer pubHostSys.close()
+			defer subHostSys.close()
+
+			var hooked int32
+			blockHook := func(peer.ID, cid.Cid, legs.SegmentSyncActions) {
+				atomic.AddInt32(&hooked, 1)
+			}
+			pubAddr, pub, sub := legsPubSubBuilder{
+				IsHttp: tc.isHttp,
+			}.Build(t, testTopic, pubHostSys, subHostSys, []legs.Option{legs.BlockHook(blockHook)})
+			pubID := pubHostSys.host.ID()
+			ctx := context.Background()
+
+			first := llBuilder{Length: 2, Seed: 1}.Build(t, pubHostSys.lsys)
+			require.NoError(t, pub.SetRoot(ctx, first.(cidlink.Link).Cid))
+			_, err := sub.Sync(ctx, pubID, cid.Undef, nil, pubAddr)
+			require.NoError(t, err)
+			result, err := sub.Probe(ctx, pubID, "Next", 10)
+			require.NoError(t, err)
+			require.False(t, result.NeedsSync)
+			require.True(t, result.BehindExact)
+
+			// The publisher's chain grows by three nodes.
+			head := llBuilder{Length: 3, Seed: 2}.BuildWithPrev(t, pubHostSys.lsys, first)
+			require.NoError(t, pub.SetRoot(ctx, head.(cidlink.Link).Cid))
+			syncedHooks := atomic.LoadInt32(&hooked)
+
+			result, err = sub.Probe(ctx, pubID, "Next", 0)
+			require.NoError(t, err)
+			require.True(t, result.NeedsSync)
+			require.Equal(t, head.(cidlink.Link).Cid, result.Head)
+			require.Equal(t, first.(cidlink.Link).Cid, result.LatestSync)
+			require.Zero(t, result.Behind)
+			require.False(t, result.BehindExact)
+
+			result, err = sub.Probe(ctx, pubID, "Next", 10)
+			require.NoError(t, err)
+			require.Equal(t, 3, result.Behind)
+			require.True(t, result.BehindExact)
+
+			result, err = sub.Probe(ctx, pubID, "Next", 2)
+			require.NoError(t, err)
+			require.Equal(t, 2, result.Behind)
+			require.False(t, result.BehindExact)
+
+			// Probing does not store the fetched nodes, call the block hook,
+			// or change the latest sync.
+			_, err = subHostSys.lsys.Load(ipld.LinkContext{}, head, basicnode.Prototype.Any)
+			require.Error(t, err)
+			require.Equal(t, syncedHooks, atomic.LoadInt32(&hooked))
+			require.Equal(t, first, sub.GetLatestSync(pubID))
+		})
+	}
+}
+
+func TestPauseTransfer(t *testing.T) {
+	pubHostSys := newHostSystem(t)
+	subHostSys := newHostSystem(t)
+	defer pubHostSys.close()
+	defer subHostSys.close()
+
+	firstBlock := make(chan struct{})
+	var firstOnce sync.Once
+	blockHook := func(peer.ID, cid.Cid, legs.SegmentSyncActions) {
+		firstOnce.Do(func() { close(firstBlock) })
+		// Slow down the sync so that it can be paused before it completes.
+		time.Sleep(10 * time.Millisecond)
+	}
+	pubAddr, pub, sub := legsPubSubBuilder{}.Build(t, testTopic, pubHostSys, subHostSys, []legs.Option{legs.BlockHook(blockHook)})
+	pubID := pubHostSys.host.ID()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// There is no transfer to pause.
+	require.Error(t, sub.PauseTransfer(ctx, pubID))
+
+	head := llBuilder{Length: 20, Seed: 1}.Build(t, pubHostSys.lsys).(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(ctx, head))
+
+	pauses, cancelPauses := sub.OnSyncPaused(legs.WatchBuffer(100))
+	defer cancelPauses()
+
+	syncErr := make(chan error, 1)
+	go func() {
+		_, err := sub.Sync(ctx, pubID, cid.Undef, nil, pubAddr)
+		syncErr <- err
+	}()
+	select {
+	case <-firstBlock:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for sync to start")
+	}
+	require.NoError(t, sub.PauseTransfer(ctx, pubID))
+	// Give the pause time to take effect before resuming.
+	time.Sleep(200 * time.Millisecond)
+	require.NoError(t, sub.ResumeTransfer(ctx, pubID))
+	require.NoError(t, <-syncErr)
+
+	// The transfer was paused and then resumed.
+	cancelPauses()
+	var events []legs.SyncPaused
+	for event := range pauses {
+		require.Equal(t, head, event.Cid)
+		require.Equal(t, pubID, event.PeerID)
+		require.False(t, event.RateLimited)
+		events = append(events, event)
+	}
+	require.Len(t, events, 2)
+	require.True(t, events[0].Paused)
+	require.False(t, events[1].Paused)
+}
+
+func TestCrossPublisherDedupHead(t *testing.T) {
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcLnkS := test.MkLinkSystem(srcStore)
+
+	// Two publishers, such as mirrors, publish the same chain.
+	var pubHosts []host.Host
+	for i := 0; i < 2; i++ {
+		srcHost := test.MkTestHost()
+		defer srcHost.Close()
+		pub, err := dtsync.NewPublisher(srcHost, dssync.MutexWrap(datastore.NewMapDatastore()), srcLnkS, testTopic)
+		require.NoError(t, err)
+		defer pub.Close()
+		pubHosts = append(pubHosts, srcHost)
+	}
+	pubA, pubB := pubHosts[0].ID(), pubHosts[1].ID()
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	dstLnkS := test.MkLinkSystem(dstStore)
+	for _, h := range pubHosts {
+		dstHost.Peerstore().AddAddrs(h.ID(), h.Addrs(), time.Hour)
+	}
+
+	started := make(chan struct{})
+	var startOnce sync.Once
+	var localB []bool
+	var hookMutex sync.Mutex
+	blockHook := func(p peer.ID, c cid.Cid, actions legs.SegmentSyncActions) {
+		if p == pubA {
+			startOnce.Do(func() { close(started) })
+			return
+		}
+		hookMutex.Lock()
+		localB = append(localB, actions.FromLocalStore())
+		hookMutex.Unlock()
+	}
+	// Slow down the sync from the first publisher, so that it is in flight
+	// when the second publisher's sync starts.
+	limiter := rate.NewLimiter(rate.Every(50*time.Millisecond), 1)
+	sub, err := legs.NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil,
+		legs.CrossPublisherDedup(true),
+		legs.BlockHook(blockHook),
+		legs.RateLimiter(func(p peer.ID) *rate.Limiter {
+			if p == pubA {
+				return limiter
+			}
+			return nil
+		}))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	head := llBuilder{Length: 5, Seed: 1}.Build(t, srcLnkS).(cidlink.Link).Cid
+	errA := make(chan error, 1)
+	go func() {
+		_, err := sub.Sync(ctx, pubA, head, nil, nil, legs.AlwaysUpdateLatest())
+		errA <- err
+	}()
+	select {
+	case <-started:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for first sync to start")
+	}
+
+	// The second sync waits for the first, and then finds every block stored.
+	_, err = sub.Sync(ctx, pubB, head, nil, nil, legs.AlwaysUpdateLatest())
+	require.NoError(t, err)
+	require.NoError(t, <-errA)
+
+	hookMutex.Lock()
+	require.Equal(t, []bool{true, true, true, true, true}, localB)
+	hookMutex.Unlock()
+
+	// Each publisher records its own latest sync.
+	for _, p := range []peer.ID{pubA, pubB} {
+		latest := sub.GetLatestSync(p)
+		require.NotNil(t, latest)
+		require.Equal(t, head, latest.(cidlink.Link).Cid)
+	}
+}
+
+func TestPublisherHandler(t *testing.T) {
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	defer srcHost.Close()
+	srcLnkS := test.MkLinkSystem(srcStore)
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	dstLnkS := test.MkLinkSystem(dstStore)
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	sub, err := legs.NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	head := llBuilder{Length: 3, Seed: 1}.Build(t, srcLnkS)
+	headCid := head.(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(ctx, headCid))
+
+	hnd := sub.Handler(srcHost.ID())
+	require.Equal(t, srcHost.ID(), hnd.PeerID())
+
+	// A publisher's selector sequence applies to its syncs. This sequence
+	// does not follow the chain.
+	ssb := selectorbuilder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	hnd.SetSelectorSequence(ssb.ExploreFields(func(efsb selectorbuilder.ExploreFieldsSpecBuilder) {
+		efsb.Insert("Missing", ssb.ExploreRecursiveEdge())
+	}).Node())
+	var syncedCids []cid.Cid
+	blockHook := func(_ peer.ID, c cid.Cid, _ legs.SegmentSyncActions) {
+		syncedCids = append(syncedCids, c)
+	}
+	_, err = sub.Sync(ctx, srcHost.ID(), headCid, nil, nil, legs.ScopedBlockHook(blockHook))
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{headCid}, syncedCids)
+	hnd.Reset()
+
+	// Announcements are not synced while the publisher is paused.
+	watcher, cncl := sub.OnSyncFinished()
+	defer cncl()
+	hnd.Pause()
+	require.True(t, hnd.Paused())
+	require.NoError(t, sub.Announce(ctx, headCid, srcHost.ID(), srcHost.Addrs()))
+	select {
+	case <-watcher:
+		t.Fatal("paused publisher synced")
+	case <-time.After(300 * time.Millisecond):
+	}
+	require.Nil(t, sub.GetLatestSync(srcHost.ID()))
+
+	// The announcement is synced once resumed.
+	hnd.Resume()
+	require.False(t, hnd.Paused())
+	select {
+	case event := <-watcher:
+		require.Equal(t, headCid, event.Cid)
+		require.Len(t, event.SyncedCids, 3)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for sync to finish")
+	}
+}
+
+func TestSubscriberPause(t *testing.T) {
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	defer srcHost.Close()
+	srcLnkS := test.MkLinkSystem(srcStore)
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	dstLnkS := test.MkLinkSystem(dstStore)
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	sub, err := legs.NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chainLnks := test.MkChain(srcLnkS, true)
+	firstCid := chainLnks[1].(cidlink.Link).Cid
+	headCid := chainLnks[0].(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(ctx, headCid))
+
+	watcher, cncl := sub.OnSyncFinished()
+	defer cncl()
+
+	sub.Pause()
+	require.True(t, sub.Paused())
+
+	// Syncs started by Sync are not paused.
+	_, err = sub.Sync(ctx, srcHost.ID(), firstCid, nil, nil)
+	require.NoError(t, err)
+
+	// Announcements are received, and the latest is synced once resumed.
+	require.NoError(t, sub.Announce(ctx, firstCid, srcHost.ID(), srcHost.Addrs()))
+	require.NoError(t, sub.Announce(ctx, headCid, srcHost.ID(), srcHost.Addrs()))
+	select {
+	case <-watcher:
+		t.Fatal("paused subscriber synced announcement")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	sub.Resume()
+	require.False(t, sub.Paused())
+	select {
+	case event := <-watcher:
+		require.Equal(t, headCid, event.Cid)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for sync to finish")
+	}
+}
+
+func TestWatchDropOldest(t *testing.T) {
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	defer srcHost.Close()
+	srcLnkS := test.MkLinkSystem(srcStore)
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	dstLnkS := test.MkLinkSystem(dstStore)
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	reg := prometheus.NewRegistry()
+	sub, err := legs.NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil, legs.Metrics(reg))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// A reader that falls behind does not hold back a reader that buffers
+	// every event.
+	slow, cnclSlow := sub.OnSyncFinished(legs.WatchDropOldest())
+	defer cnclSlow()
+	buffered, cnclBuffered := sub.OnSyncFinished(legs.WatchBuffer(3))
+	defer cnclBuffered()
+
+	chainLnks := test.MkChain(srcLnkS, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 3; i >= 1; i-- {
+		require.NoError(t, pub.SetRoot(ctx, chainLnks[i].(cidlink.Link).Cid))
+		_, err = sub.Sync(ctx, srcHost.ID(), cid.Undef, nil, nil)
+		require.NoError(t, err)
+	}
+
+	for i := 3; i >= 1; i-- {
+		select {
+		case event := <-buffered:
+			require.Equal(t, chainLnks[i].(cidlink.Link).Cid, event.Cid)
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for sync finished event")
+		}
+	}
+
+	// The slow reader only gets the latest event.
+	select {
+	case event := <-slow:
+		require.Equal(t, chainLnks[1].(cidlink.Link).Cid, event.Cid)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for sync finished event")
+	}
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	var dropped float64
+	for _, mf := range families {
+		if mf.GetName() == "legs_sync_events_dropped_total" {
+			dropped = mf.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	require.Equal(t, 2.0, dropped)
+}
+
+func TestOnSyncFinishedFiltered(t *testing.T) {
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	defer srcHost.Close()
+	srcLnkS := test.MkLinkSystem(srcStore)
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	dstLnkS := test.MkLinkSystem(dstStore)
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	sub, err := legs.NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	chainLnks := test.MkChain(srcLnkS, true)
+	firstCid := chainLnks[1].(cidlink.Link).Cid
+	headCid := chainLnks[0].(cidlink.Link).Cid
+
+	fromSrc, cnclSrc := sub.OnSyncFinishedFrom(srcHost.ID(), legs.WatchBuffer(2))
+	defer cnclSrc()
+	fromOther, cnclOther := sub.OnSyncFinishedFrom(dstHost.ID())
+	defer cnclOther()
+	matching, cnclMatching := sub.OnSyncFinishedMatching(func(event legs.SyncFinished) bool {
+		return event.Cid == headCid
+	})
+	defer cnclMatching()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, c := range []cid.Cid{firstCid, headCid} {
+		require.NoError(t, pub.SetRoot(ctx, c))
+		_, err = sub.Sync(ctx, srcHost.ID(), cid.Undef, nil, nil)
+		require.NoError(t, err)
+	}
+
+	for _, c := range []cid.Cid{firstCid, headCid} {
+		select {
+		case event := <-fromSrc:
+			require.Equal(t, c, event.Cid)
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for sync finished event")
+		}
+	}
+	select {
+	case event := <-matching:
+		require.Equal(t, headCid, event.Cid)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for sync finished event")
+	}
+	select {
+	case <-fromOther:
+		t.Fatal("received event of other publisher")
+	default:
+	}
+}
+
+func TestExportImportState(t *testing.T) {
+	srcHost := test.MkTestHost()
+	defer srcHost.Close()
+	httpHost := test.MkTestHost()
+	defer httpHost.Close()
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	dstLnkS := test.MkLinkSystem(dstStore)
+
+	sub, err := legs.NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	cids, err := test.RandomCids(2)
+	require.NoError(t, err)
+	require.NoError(t, sub.SetLatestSync(srcHost.ID(), cids[0]))
+	require.NoError(t, sub.SetLatestSync(httpHost.ID(), cids[1]))
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+	httpAddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/3104/http")
+	require.NoError(t, err)
+	sub.HttpPeerStore().AddAddr(httpHost.ID(), httpAddr, time.Hour)
+
+	var buf bytes.Buffer
+	require.NoError(t, sub.ExportState(&buf))
+
+	newStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	newHost := test.MkTestHost()
+	defer newHost.Close()
+	newSub, err := legs.NewSubscriber(newHost, newStore, test.MkLinkSystem(newStore), testTopic, nil)
+	require.NoError(t, err)
+	defer newSub.Close()
+
+	require.NoError(t, newSub.ImportState(&buf))
+	require.Equal(t, cidlink.Link{Cid: cids[0]}, newSub.GetLatestSync(srcHost.ID()))
+	require.Equal(t, cidlink.Link{Cid: cids[1]}, newSub.GetLatestSync(httpHost.ID()))
+	require.ElementsMatch(t, srcHost.Addrs(), newHost.Peerstore().Addrs(srcHost.ID()))
+	require.Equal(t, []multiaddr.Multiaddr{httpAddr}, newSub.HttpPeerStore().Addrs(httpHost.ID()))
+	require.Empty(t, newHost.Peerstore().Addrs(httpHost.ID()))
+
+	err = newSub.ImportState(strings.NewReader(`{"version":2,"publishers":[]}`))
+	require.ErrorContains(t, err, "unsupported state version")
+}
+
+func TestBootstrapPublishers(t *testing.T) {
+	pubHost1 := test.MkTestHost()
+	defer pubHost1.Close()
+	pubHost2 := test.MkTestHost()
+	defer pubHost2.Close()
+
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	defer srcHost.Close()
+	srcSub, err := legs.NewSubscriber(srcHost, srcStore, test.MkLinkSystem(srcStore), testTopic, nil, legs.ServePublishers(true))
+	require.NoError(t, err)
+	defer srcSub.Close()
+
+	cids, err := test.RandomCids(3)
+	require.NoError(t, err)
+	require.NoError(t, srcSub.SetLatestSync(pubHost1.ID(), cids[0]))
+	require.NoError(t, srcSub.SetLatestSync(pubHost2.ID(), cids[1]))
+	srcHost.Peerstore().AddAddrs(pubHost1.ID(), pubHost1.Addrs(), time.Hour)
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+	dstSub, err := legs.NewSubscriber(dstHost, dstStore, test.MkLinkSystem(dstStore), testTopic, nil)
+	require.NoError(t, err)
+	defer dstSub.Close()
+
+	// The latest sync of a publisher that is already known is kept.
+	require.NoError(t, dstSub.SetLatestSync(pubHost2.ID(), cids[2]))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n, err := dstSub.BootstrapPublishers(ctx, srcHost.ID())
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, cidlink.Link{Cid: cids[0]}, dstSub.GetLatestSync(pubHost1.ID()))
+	require.Equal(t, cidlink.Link{Cid: cids[2]}, dstSub.GetLatestSync(pubHost2.ID()))
+	require.ElementsMatch(t, pubHost1.Addrs(), dstHost.Peerstore().Addrs(pubHost1.ID()))
+
+	// A Subscriber that does not serve its publishers cannot be bootstrapped
+	// from.
+	srcHost.Peerstore().AddAddrs(dstHost.ID(), dstHost.Addrs(), time.Hour)
+	_, err = srcSub.BootstrapPublishers(ctx, dstHost.ID())
+	require.Error(t, err)
+}
@@ -66,6 +66,152 @@ func TestLatestSyncSuccess(t *testing.T) {
 	}
 }
 
+func TestLatestSyncAnnounceRecord(t *testing.T) {
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	srcLnkS := test.MkLinkSystem(srcStore)
+
+	dstHost := test.MkTestHost()
+	srcHost.Peerstore().AddAddrs(dstHost.ID(), dstHost.Addrs(), time.Hour)
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+	dstLnkS := test.MkLinkSystem(dstStore)
+	defer srcHost.Close()
+	defer dstHost.Close()
+
+	topics := test.WaitForMeshWithMessage(t, testTopic, srcHost, dstHost)
+
+	// Extra data that is larger than the max announce size causes the
+	// publisher to announce a record instead of the full message.
+	extraData := make([]byte, 1024)
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic, dtsync.Topic(topics[0]),
+		dtsync.WithExtraData(extraData), dtsync.WithMaxAnnounceSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	sub, err := legs.NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil, legs.Topic(topics[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	watcher, cncl := sub.OnSyncFinished()
+	defer cncl()
+
+	chainLnks := test.MkChain(srcLnkS, true)
+
+	err = newUpdateTest(pub, sub, dstStore, watcher, srcHost.ID(), chainLnks[2], false, chainLnks[2].(cidlink.Link).Cid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = newUpdateTest(pub, sub, dstStore, watcher, srcHost.ID(), chainLnks[0], false, chainLnks[0].(cidlink.Link).Cid)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLatestSyncPerTopic(t *testing.T) {
+	pubHost := test.MkTestHost()
+	defer pubHost.Close()
+	pubID := pubHost.ID()
+	cids, err := test.RandomCids(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newSub := func(topic string, lsh legs.LatestSyncHandler, perTopic bool) *legs.Subscriber {
+		store := dssync.MutexWrap(datastore.NewMapDatastore())
+		h := test.MkTestHost()
+		t.Cleanup(func() { h.Close() })
+		sub, err := legs.NewSubscriber(h, store, test.MkLinkSystem(store), topic, nil,
+			legs.UseLatestSyncHandler(lsh), legs.LatestSyncPerTopic(perTopic))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { sub.Close() })
+		return sub
+	}
+
+	// Subscribers that track latest sync per peer share the latest sync.
+	lsh := &legs.DefaultLatestSyncHandler{}
+	sub1 := newSub("/legs/topic1", lsh, false)
+	sub2 := newSub("/legs/topic2", lsh, false)
+	if err := sub1.SetLatestSync(pubID, cids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := sub2.SetLatestSync(pubID, cids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if sub1.GetLatestSync(pubID).(cidlink.Link).Cid != cids[1] {
+		t.Fatal("expected latest sync to be shared by subscribers")
+	}
+
+	// Subscribers that track latest sync per topic each have their own.
+	lsh = &legs.DefaultLatestSyncHandler{}
+	sub1 = newSub("/legs/topic1", lsh, true)
+	sub2 = newSub("/legs/topic2", lsh, true)
+	if err := sub1.SetLatestSync(pubID, cids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := sub2.SetLatestSync(pubID, cids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if sub1.GetLatestSync(pubID).(cidlink.Link).Cid != cids[0] {
+		t.Fatal("wrong latest sync for first topic")
+	}
+	if sub2.GetLatestSync(pubID).(cidlink.Link).Cid != cids[1] {
+		t.Fatal("wrong latest sync for second topic")
+	}
+	if _, ok := lsh.GetLatestSync(pubID); ok {
+		t.Fatal("latest sync should not be tracked per peer")
+	}
+	c, ok := lsh.GetTopicLatestSync("/legs/topic1", pubID)
+	if !ok || c != cids[0] {
+		t.Fatal("wrong latest sync in handler for first topic")
+	}
+
+	// A latest sync stored per peer is migrated to the topic of a Subscriber
+	// that tracks latest sync per topic.
+	lsh = &legs.DefaultLatestSyncHandler{}
+	lsh.SetLatestSync(pubID, cids[0])
+	sub1 = newSub("/legs/topic1", lsh, true)
+	if sub1.GetLatestSync(pubID).(cidlink.Link).Cid != cids[0] {
+		t.Fatal("expected latest sync of peer to be migrated")
+	}
+	c, ok = lsh.GetTopicLatestSync("/legs/topic1", pubID)
+	if !ok || c != cids[0] {
+		t.Fatal("latest sync of peer not stored for topic")
+	}
+	if err := sub1.SetLatestSync(pubID, cids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if sub1.GetLatestSync(pubID).(cidlink.Link).Cid != cids[1] {
+		t.Fatal("wrong latest sync for topic after migration")
+	}
+
+	// A handler that cannot track latest sync per topic is rejected.
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	h := test.MkTestHost()
+	defer h.Close()
+	_, err = legs.NewSubscriber(h, store, test.MkLinkSystem(store), testTopic, nil,
+		legs.UseLatestSyncHandler(peerLatestSyncHandler{}), legs.LatestSyncPerTopic(true))
+	if err == nil {
+		t.Fatal("expected error using handler that cannot track latest sync per topic")
+	}
+}
+
+// peerLatestSyncHandler is a LatestSyncHandler that only tracks the latest
+// sync per peer.
+type peerLatestSyncHandler struct{}
+
+func (peerLatestSyncHandler) SetLatestSync(peer.ID, cid.Cid) {}
+
+func (peerLatestSyncHandler) GetLatestSync(peer.ID) (cid.Cid, bool) {
+	return cid.Undef, false
+}
+
 func TestSyncFn(t *testing.T) {
 	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
 	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
@@ -502,6 +648,9 @@ func newUpdateTest(pub legs.Publisher, sub *legs.Subscriber, dstStore datastore.
 			if !downstream.Cid.Equals(c) {
 				return fmt.Errorf("sync returned unexpected cid %s, expected %s", downstream.Cid, c)
 			}
+			if downstream.Source != legs.SyncSourceGossip {
+				return fmt.Errorf("sync has unexpected source %q, expected %q", downstream.Source, legs.SyncSourceGossip)
+			}
 			if _, err = dstStore.Get(context.Background(), datastore.NewKey(downstream.Cid.String())); err != nil {
 				return fmt.Errorf("data not in receiver store: %s", err)
 			}
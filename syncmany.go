@@ -0,0 +1,76 @@
+package legs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// SyncResult is the result of syncing with one of the publishers given to
+// SyncMany.
+type SyncResult struct {
+	// PeerID identifies the publisher.
+	PeerID peer.ID
+	// Cid is the CID that was synced, as returned by Sync.
+	Cid cid.Cid
+	// Err is the error returned by Sync, or the context error if the sync was
+	// not started before the context was canceled.
+	Err error
+}
+
+// SyncMany syncs the latest head of each of the publishers identified by
+// peerIDs, running at most limit syncs at the same time. Each sync is the same
+// as calling Sync with cid.Undef, the default selector, no address, and opts,
+// so the publisher's address must be in the peerstore. This is useful when
+// bootstrapping against a large list of known publishers.
+//
+// The returned channel receives one SyncResult for each publisher, in the
+// order that the syncs finish, and is closed once all have been received. The
+// channel is buffered to hold all results, so the syncs do not wait for the
+// channel to be read. A publisher that is given more than once is only synced
+// once.
+func (s *Subscriber) SyncMany(ctx context.Context, peerIDs []peer.ID, limit int, opts ...SyncOption) (<-chan SyncResult, error) {
+	if limit < 1 {
+		return nil, fmt.Errorf("sync limit must be at least 1: %d", limit)
+	}
+
+	unique := make([]peer.ID, 0, len(peerIDs))
+	seen := make(map[peer.ID]struct{}, len(peerIDs))
+	for _, peerID := range peerIDs {
+		if _, ok := seen[peerID]; ok {
+			continue
+		}
+		seen[peerID] = struct{}{}
+		unique = append(unique, peerID)
+	}
+
+	results := make(chan SyncResult, len(unique))
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	wg.Add(len(unique))
+	s.asyncWG.Add(1)
+	go func() {
+		defer s.asyncWG.Done()
+		for _, peerID := range unique {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				results <- SyncResult{PeerID: peerID, Err: ctx.Err()}
+				wg.Done()
+				continue
+			}
+			go func(peerID peer.ID) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				c, err := s.Sync(ctx, peerID, cid.Undef, nil, nil, opts...)
+				results <- SyncResult{PeerID: peerID, Cid: c, Err: err}
+			}(peerID)
+		}
+		wg.Wait()
+		close(results)
+	}()
+	return results, nil
+}
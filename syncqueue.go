@@ -0,0 +1,137 @@
+package legs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// PendingSync describes an announced sync that is waiting to start, because
+// the maximum number of announced syncs are already running. See:
+// MaxAsyncSyncs.
+type PendingSync struct {
+	// PeerID identifies the publisher to sync with.
+	PeerID peer.ID `json:"peerID"`
+	// Cid is the announced CID to sync. If IsRecord is true, this identifies an
+	// announcement record that holds the announced CID.
+	Cid cid.Cid `json:"cid"`
+	// IsRecord is true if Cid identifies an announcement record.
+	IsRecord bool `json:"isRecord,omitempty"`
+	// Source is how the announcement arrived.
+	Source SyncSource `json:"source"`
+	// Received is when the announcement was received.
+	Received time.Time `json:"received"`
+	// LastSynced is when the last announced sync with the publisher finished,
+	// or the zero time if there has been none.
+	LastSynced time.Time `json:"lastSynced"`
+}
+
+// SyncPriorityFunc is the signature of a function that orders pending syncs.
+// It returns true if a should start before b.
+type SyncPriorityFunc func(a, b PendingSync) bool
+
+// syncQueue limits the number of announced syncs that run at once. Syncs that
+// cannot start wait in the queue, and are started in priority order, or in
+// the order they were queued if there is no priority function.
+type syncQueue struct {
+	limit int
+	less  SyncPriorityFunc
+
+	running int
+	waiting []*queuedSync
+	mutex   sync.Mutex
+}
+
+// queuedSync is a sync waiting in a syncQueue.
+type queuedSync struct {
+	pending PendingSync
+	// ready is closed when the sync can start.
+	ready chan struct{}
+}
+
+// newSyncQueue creates a syncQueue that runs up to limit syncs at once. If
+// limit is zero, then the number of syncs is not limited, and nil is returned.
+func newSyncQueue(limit int, less SyncPriorityFunc) *syncQueue {
+	if limit == 0 {
+		return nil
+	}
+	return &syncQueue{
+		limit: limit,
+		less:  less,
+	}
+}
+
+// acquire waits until the pending sync can start. The caller must call release
+// when the sync is done, unless an error is returned.
+func (q *syncQueue) acquire(ctx context.Context, pending PendingSync) error {
+	if q == nil {
+		return nil
+	}
+
+	q.mutex.Lock()
+	if q.running < q.limit && len(q.waiting) == 0 {
+		q.running++
+		q.mutex.Unlock()
+		return nil
+	}
+	qs := &queuedSync{
+		pending: pending,
+		ready:   make(chan struct{}),
+	}
+	q.waiting = append(q.waiting, qs)
+	q.mutex.Unlock()
+	log.Debugw("Queued sync", "peer", pending.PeerID, "cid", pending.Cid)
+
+	select {
+	case <-qs.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for i, w := range q.waiting {
+		if w == qs {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return ctx.Err()
+		}
+	}
+	// The sync was started while the context was canceled, so give up its
+	// place to the next one.
+	q.running--
+	q.startNext()
+	return ctx.Err()
+}
+
+// release ends a sync started by acquire, and starts the next waiting sync.
+func (q *syncQueue) release() {
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	q.running--
+	q.startNext()
+	q.mutex.Unlock()
+}
+
+// startNext starts waiting syncs, highest priority first, while fewer than the
+// limit are running. Must be called with the mutex held.
+func (q *syncQueue) startNext() {
+	for q.running < q.limit && len(q.waiting) != 0 {
+		next := 0
+		if q.less != nil {
+			for i := 1; i < len(q.waiting); i++ {
+				if q.less(q.waiting[i].pending, q.waiting[next].pending) {
+					next = i
+				}
+			}
+		}
+		qs := q.waiting[next]
+		q.waiting = append(q.waiting[:next], q.waiting[next+1:]...)
+		q.running++
+		close(qs.ready)
+	}
+}
@@ -0,0 +1,74 @@
+package legs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncQueuePriority(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Prefer publishers that were synced least recently.
+	q := newSyncQueue(1, func(a, b PendingSync) bool {
+		return a.LastSynced.Before(b.LastSynced)
+	})
+	require.NoError(t, q.acquire(ctx, PendingSync{}))
+
+	now := time.Now()
+	hosts := make([]PendingSync, 3)
+	for i := range hosts {
+		h := test.MkTestHost()
+		defer h.Close()
+		hosts[i] = PendingSync{
+			PeerID:     h.ID(),
+			LastSynced: now.Add(-time.Duration(i) * time.Minute),
+		}
+	}
+
+	started := make(chan PendingSync)
+	for _, pending := range hosts {
+		go func(pending PendingSync) {
+			if q.acquire(ctx, pending) == nil {
+				started <- pending
+			}
+		}(pending)
+	}
+	require.Eventually(t, func() bool {
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		return len(q.waiting) == len(hosts)
+	}, time.Second, 10*time.Millisecond)
+
+	// Waiting syncs start one at a time, least recently synced first.
+	for i := len(hosts) - 1; i >= 0; i-- {
+		q.release()
+		require.Equal(t, hosts[i].PeerID, (<-started).PeerID)
+	}
+	q.release()
+	require.Zero(t, q.running)
+}
+
+func TestSyncQueueCancel(t *testing.T) {
+	q := newSyncQueue(1, nil)
+	require.NoError(t, q.acquire(context.Background(), PendingSync{}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, q.acquire(ctx, PendingSync{}), context.DeadlineExceeded)
+	require.Empty(t, q.waiting)
+
+	q.release()
+	require.NoError(t, q.acquire(context.Background(), PendingSync{}))
+	q.release()
+
+	// Without a limit, there is no queue.
+	q = newSyncQueue(0, nil)
+	require.Nil(t, q)
+	require.NoError(t, q.acquire(context.Background(), PendingSync{}))
+	q.release()
+}
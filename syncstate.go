@@ -0,0 +1,281 @@
+package legs
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/ipfs/bbloom"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+const (
+	// syncStatePrefix is the datastore key prefix under which the traversal
+	// state of syncs is kept.
+	syncStatePrefix = "/legs/syncstate/"
+	// syncStateBloomEntries and syncStateBloomFalsePositives size the bloom
+	// filter in front of each set kept in a datastore. A false positive only
+	// costs a datastore lookup.
+	syncStateBloomEntries        = 1 << 18
+	syncStateBloomFalsePositives = 0.01
+)
+
+// syncStateStore creates the sets and queues that hold the traversal state of
+// syncs, such as the CIDs that a sync has already passed to the block hook. If
+// it has a datastore, then the state is kept in the datastore, so that syncs
+// of arbitrarily long chains use constant memory. Otherwise, the state is kept
+// in memory. A nil syncStateStore keeps state in memory.
+type syncStateStore struct {
+	ds datastore.Batching
+	// seq is the sequence number of the last set or queue created, used to
+	// give each its own key prefix.
+	seq uint64
+}
+
+// newSyncStateStore creates a syncStateStore that keeps state in ds. Any
+// state left in ds by a previous Subscriber is removed. Returns nil if ds is
+// nil.
+func newSyncStateStore(ctx context.Context, ds datastore.Batching) (*syncStateStore, error) {
+	if ds == nil {
+		return nil, nil
+	}
+	if err := deletePrefix(ctx, ds, syncStatePrefix); err != nil {
+		return nil, fmt.Errorf("cannot remove previous sync state: %w", err)
+	}
+	return &syncStateStore{
+		ds: ds,
+	}, nil
+}
+
+// nextPrefix returns a key prefix that is not used by any other set or queue.
+func (st *syncStateStore) nextPrefix() string {
+	return syncStatePrefix + strconv.FormatUint(atomic.AddUint64(&st.seq, 1), 10) + "/"
+}
+
+// cidSet is a set of CIDs.
+type cidSet interface {
+	// add adds c to the set, and returns true if c was not already in it.
+	add(ctx context.Context, c cid.Cid) (bool, error)
+	// has returns true if c is in the set.
+	has(ctx context.Context, c cid.Cid) (bool, error)
+	// remove removes c from the set.
+	remove(ctx context.Context, c cid.Cid) error
+	// discard removes all of the set's state.
+	discard(ctx context.Context) error
+}
+
+// cidQueue is a first in, first out queue of synced blocks.
+type cidQueue interface {
+	// push adds b to the end of the queue.
+	push(ctx context.Context, b syncedBlock) error
+	// each calls fn with each block in the queue, in the order they were
+	// pushed, until fn returns an error.
+	each(ctx context.Context, fn func(syncedBlock) error) error
+	// discard removes all of the queue's blocks.
+	discard(ctx context.Context) error
+}
+
+// newSet creates an empty cidSet.
+func (st *syncStateStore) newSet() cidSet {
+	if st == nil {
+		return memCidSet{}
+	}
+	bloom, err := bbloom.New(syncStateBloomEntries, syncStateBloomFalsePositives)
+	if err != nil {
+		// The bloom filter parameters are constant and valid.
+		panic(err)
+	}
+	return &dsCidSet{
+		ds:     st.ds,
+		prefix: st.nextPrefix(),
+		bloom:  bloom,
+	}
+}
+
+// newQueue creates an empty cidQueue.
+func (st *syncStateStore) newQueue() cidQueue {
+	if st == nil {
+		return &memCidQueue{}
+	}
+	return &dsCidQueue{
+		ds:     st.ds,
+		prefix: st.nextPrefix(),
+	}
+}
+
+// memCidSet is a cidSet kept in memory.
+type memCidSet map[cid.Cid]struct{}
+
+func (s memCidSet) add(_ context.Context, c cid.Cid) (bool, error) {
+	if _, ok := s[c]; ok {
+		return false, nil
+	}
+	s[c] = struct{}{}
+	return true, nil
+}
+
+func (s memCidSet) has(_ context.Context, c cid.Cid) (bool, error) {
+	_, ok := s[c]
+	return ok, nil
+}
+
+func (s memCidSet) remove(_ context.Context, c cid.Cid) error {
+	delete(s, c)
+	return nil
+}
+
+func (s memCidSet) discard(context.Context) error {
+	return nil
+}
+
+// dsCidSet is a cidSet kept in a datastore. A bloom filter avoids datastore
+// lookups of most CIDs that are not in the set.
+type dsCidSet struct {
+	ds     datastore.Batching
+	prefix string
+	bloom  *bbloom.Bloom
+}
+
+func (s *dsCidSet) key(c cid.Cid) datastore.Key {
+	return datastore.NewKey(s.prefix + c.String())
+}
+
+func (s *dsCidSet) add(ctx context.Context, c cid.Cid) (bool, error) {
+	ok, err := s.has(ctx, c)
+	if err != nil || ok {
+		return false, err
+	}
+	if err = s.ds.Put(ctx, s.key(c), nil); err != nil {
+		return false, err
+	}
+	s.bloom.Add(c.Bytes())
+	return true, nil
+}
+
+func (s *dsCidSet) has(ctx context.Context, c cid.Cid) (bool, error) {
+	if !s.bloom.Has(c.Bytes()) {
+		return false, nil
+	}
+	return s.ds.Has(ctx, s.key(c))
+}
+
+func (s *dsCidSet) remove(ctx context.Context, c cid.Cid) error {
+	// The CID stays in the bloom filter, which only costs a lookup.
+	return s.ds.Delete(ctx, s.key(c))
+}
+
+func (s *dsCidSet) discard(ctx context.Context) error {
+	return deletePrefix(ctx, s.ds, s.prefix)
+}
+
+// memCidQueue is a cidQueue kept in memory.
+type memCidQueue struct {
+	blocks []syncedBlock
+}
+
+func (q *memCidQueue) push(_ context.Context, b syncedBlock) error {
+	q.blocks = append(q.blocks, b)
+	return nil
+}
+
+func (q *memCidQueue) each(_ context.Context, fn func(syncedBlock) error) error {
+	for _, b := range q.blocks {
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *memCidQueue) discard(context.Context) error {
+	q.blocks = nil
+	return nil
+}
+
+// dsCidQueue is a cidQueue kept in a datastore. Each block is stored under a
+// key that ends with its position in the queue, encoded so that keys sort in
+// queue order.
+type dsCidQueue struct {
+	ds     datastore.Batching
+	prefix string
+	length uint64
+}
+
+func (q *dsCidQueue) push(ctx context.Context, b syncedBlock) error {
+	var pos [8]byte
+	binary.BigEndian.PutUint64(pos[:], q.length)
+	key := datastore.NewKey(fmt.Sprintf("%s%x", q.prefix, pos))
+	value := append([]byte{0}, b.c.Bytes()...)
+	if b.local {
+		value[0] = 1
+	}
+	if err := q.ds.Put(ctx, key, value); err != nil {
+		return err
+	}
+	q.length++
+	return nil
+}
+
+func (q *dsCidQueue) each(ctx context.Context, fn func(syncedBlock) error) error {
+	results, err := q.ds.Query(ctx, query.Query{
+		Prefix: q.prefix,
+		Orders: []query.Order{query.OrderByKey{}},
+	})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+	for r := range results.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		if len(r.Value) == 0 {
+			return fmt.Errorf("empty sync state entry %s", r.Key)
+		}
+		_, c, err := cid.CidFromBytes(r.Value[1:])
+		if err != nil {
+			return fmt.Errorf("cannot decode sync state entry %s: %w", r.Key, err)
+		}
+		if err = fn(syncedBlock{c: c, local: r.Value[0] == 1}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *dsCidQueue) discard(ctx context.Context) error {
+	q.length = 0
+	return deletePrefix(ctx, q.ds, q.prefix)
+}
+
+// deletePrefix deletes all keys in ds under prefix.
+func deletePrefix(ctx context.Context, ds datastore.Batching, prefix string) error {
+	results, err := ds.Query(ctx, query.Query{
+		Prefix:   prefix,
+		KeysOnly: true,
+	})
+	if err != nil {
+		return err
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	batch, err := ds.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err = batch.Delete(ctx, datastore.NewKey(e.Key)); err != nil {
+			return err
+		}
+	}
+	return batch.Commit(ctx)
+}
@@ -0,0 +1,211 @@
+// Package throttle limits the requests that a publisher serves, by the rate of
+// requests from each client, the number of transfers in progress, and the bytes
+// sent to each client per hour.
+package throttle
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Reason is why a request was throttled.
+type Reason string
+
+const (
+	// RequestRate means that the client exceeded its request rate.
+	RequestRate Reason = "request_rate"
+	// Concurrency means that the publisher is already serving its maximum
+	// number of transfers.
+	Concurrency Reason = "concurrency"
+	// Bytes means that the client has been sent its maximum number of bytes
+	// for the last hour.
+	Bytes Reason = "bytes"
+)
+
+// HookFunc is called with the client and reason each time a request is
+// throttled.
+type HookFunc func(client string, reason Reason)
+
+// Error is returned for a throttled request.
+type Error struct {
+	Reason Reason
+	// RetryAfter is how long until a request from the client may be served
+	// again, or zero if unknown.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("request throttled: %s", e.Reason)
+}
+
+// Config sets the limits of a Throttle. A limit of zero is no limit.
+type Config struct {
+	// RequestRate is the rate of requests allowed from each client, with
+	// bursts of up to RequestBurst requests.
+	RequestRate  rate.Limit
+	RequestBurst int
+	// MaxConcurrent is the maximum number of transfers served at a time, to
+	// all clients.
+	MaxConcurrent int
+	// MaxBytesPerHour is the maximum number of bytes sent to each client in
+	// an hour.
+	MaxBytesPerHour int64
+	// Hook, if not nil, is called each time a request is throttled.
+	Hook HookFunc
+}
+
+// Throttle limits the requests that a publisher serves. A nil Throttle allows
+// every request.
+type Throttle struct {
+	cfg     Config
+	clients map[string]*clientLimits
+	active  int
+	// idleTimeout is how long a client's limits are kept after its last
+	// request. By then, its limiters have refilled.
+	idleTimeout time.Duration
+	lastPrune   time.Time
+	mutex       sync.Mutex
+}
+
+// clientLimits are the limiters of one client.
+type clientLimits struct {
+	requests *rate.Limiter
+	bytes    *rate.Limiter
+	lastUsed time.Time
+}
+
+// New creates a Throttle with the given limits. Returns nil if cfg sets no
+// limits.
+func New(cfg Config) *Throttle {
+	if cfg.RequestRate == 0 && cfg.MaxConcurrent == 0 && cfg.MaxBytesPerHour == 0 {
+		return nil
+	}
+	if cfg.RequestBurst < 1 {
+		cfg.RequestBurst = 1
+	}
+	idleTimeout := time.Hour
+	if cfg.RequestRate > 0 {
+		if refill := time.Duration(float64(cfg.RequestBurst) / float64(cfg.RequestRate) * float64(time.Second)); refill > idleTimeout {
+			idleTimeout = refill
+		}
+	}
+	return &Throttle{
+		cfg:         cfg,
+		clients:     make(map[string]*clientLimits),
+		idleTimeout: idleTimeout,
+	}
+}
+
+// Acquire checks whether a request from the client is allowed. If it is, then
+// the request counts as a transfer in progress until Release is called.
+// Otherwise, an *Error is returned, and Release must not be called.
+func (t *Throttle) Acquire(client string) error {
+	if t == nil {
+		return nil
+	}
+	err := t.acquireAt(client, time.Now())
+	if err == nil {
+		return nil
+	}
+	if t.cfg.Hook != nil {
+		t.cfg.Hook(client, err.Reason)
+	}
+	return err
+}
+
+func (t *Throttle) acquireAt(client string, now time.Time) *Error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.prune(now)
+	limits := t.limits(client, now)
+	if limits.requests != nil {
+		r := limits.requests.ReserveN(now, 1)
+		if delay := r.DelayFrom(now); delay > 0 {
+			r.CancelAt(now)
+			return &Error{Reason: RequestRate, RetryAfter: delay}
+		}
+	}
+	if limits.bytes != nil {
+		// Check, without taking, that a byte can be sent.
+		r := limits.bytes.ReserveN(now, 1)
+		delay := r.DelayFrom(now)
+		r.CancelAt(now)
+		if delay > 0 {
+			return &Error{Reason: Bytes, RetryAfter: delay}
+		}
+	}
+	if t.cfg.MaxConcurrent > 0 && t.active >= t.cfg.MaxConcurrent {
+		return &Error{Reason: Concurrency}
+	}
+	t.active++
+	return nil
+}
+
+// Release ends a transfer that was allowed by Acquire.
+func (t *Throttle) Release() {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.active > 0 {
+		t.active--
+	}
+}
+
+// AddBytes counts n bytes sent to the client toward its hourly limit. A
+// transfer in progress is not stopped when the client reaches its limit, but
+// the client's next requests are throttled until enough of the hour has passed.
+func (t *Throttle) AddBytes(client string, n int64) {
+	if t == nil || t.cfg.MaxBytesPerHour == 0 || n <= 0 {
+		return
+	}
+	t.addBytesAt(client, n, time.Now())
+}
+
+func (t *Throttle) addBytesAt(client string, n int64, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	limits := t.limits(client, now)
+	// A reservation cannot be larger than the burst.
+	if burst := int64(limits.bytes.Burst()); n > burst {
+		n = burst
+	}
+	limits.bytes.ReserveN(now, int(n))
+}
+
+// limits returns the limiters of the client, creating them if needed. The
+// mutex must be held.
+func (t *Throttle) limits(client string, now time.Time) *clientLimits {
+	limits, ok := t.clients[client]
+	if !ok {
+		limits = &clientLimits{}
+		if t.cfg.RequestRate > 0 {
+			limits.requests = rate.NewLimiter(t.cfg.RequestRate, t.cfg.RequestBurst)
+		}
+		if t.cfg.MaxBytesPerHour > 0 {
+			limits.bytes = rate.NewLimiter(rate.Limit(float64(t.cfg.MaxBytesPerHour)/time.Hour.Seconds()), int(t.cfg.MaxBytesPerHour))
+		}
+		t.clients[client] = limits
+	}
+	limits.lastUsed = now
+	return limits
+}
+
+// prune removes the limits of clients that have been idle for longer than
+// the idle timeout, at most once per idle timeout. The mutex must be held.
+func (t *Throttle) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < t.idleTimeout {
+		return
+	}
+	t.lastPrune = now
+	for client, limits := range t.clients {
+		if now.Sub(limits.lastUsed) > t.idleTimeout {
+			delete(t.clients, client)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package throttle
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestNilThrottle(t *testing.T) {
+	var th *Throttle
+	require.Nil(t, New(Config{}))
+	require.NoError(t, th.Acquire("a"))
+	th.AddBytes("a", 100)
+	th.Release()
+}
+
+func TestRequestRate(t *testing.T) {
+	th := New(Config{
+		RequestRate:  rate.Every(time.Second),
+		RequestBurst: 2,
+	})
+	now := time.Now()
+	require.Nil(t, th.acquireAt("a", now))
+	require.Nil(t, th.acquireAt("a", now))
+	err := th.acquireAt("a", now)
+	require.NotNil(t, err)
+	require.Equal(t, RequestRate, err.Reason)
+	require.Equal(t, time.Second, err.RetryAfter)
+
+	// Each client has its own rate.
+	require.Nil(t, th.acquireAt("b", now))
+
+	// A throttled request does not take a token.
+	require.Nil(t, th.acquireAt("a", now.Add(time.Second)))
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	th := New(Config{
+		MaxConcurrent: 1,
+	})
+	require.NoError(t, th.Acquire("a"))
+	err := th.Acquire("b")
+	var terr *Error
+	require.True(t, errors.As(err, &terr))
+	require.Equal(t, Concurrency, terr.Reason)
+	th.Release()
+	require.NoError(t, th.Acquire("b"))
+}
+
+func TestMaxBytesPerHour(t *testing.T) {
+	var hooked []Reason
+	th := New(Config{
+		MaxBytesPerHour: 3600,
+		Hook: func(client string, reason Reason) {
+			require.Equal(t, "a", client)
+			hooked = append(hooked, reason)
+		},
+	})
+	now := time.Now()
+	require.Nil(t, th.acquireAt("a", now))
+	th.Release()
+	th.addBytesAt("a", 3600, now)
+	err := th.acquireAt("a", now)
+	require.NotNil(t, err)
+	require.Equal(t, Bytes, err.Reason)
+	require.Equal(t, time.Second, err.RetryAfter)
+
+	// Another client can still be sent bytes.
+	require.Nil(t, th.acquireAt("b", now))
+
+	// The client is allowed again once a byte can be sent.
+	require.Nil(t, th.acquireAt("a", now.Add(time.Second)))
+
+	th.AddBytes("a", 10000)
+	require.Error(t, th.Acquire("a"))
+	require.Equal(t, []Reason{Bytes}, hooked)
+}
+
+func TestPruneIdleClients(t *testing.T) {
+	th := New(Config{
+		RequestRate:  rate.Every(time.Second),
+		RequestBurst: 1,
+	})
+	now := time.Now()
+	require.Nil(t, th.acquireAt("a", now))
+	require.Nil(t, th.acquireAt("b", now.Add(time.Hour)))
+	require.Len(t, th.clients, 2)
+	require.Nil(t, th.acquireAt("b", now.Add(2*time.Hour+time.Second)))
+	require.Len(t, th.clients, 1)
+	require.Contains(t, th.clients, "b")
+}
@@ -0,0 +1,15 @@
+package legs
+
+import "strings"
+
+// TopicPrefix is the prefix of the conventional name of a topic that
+// announcements are published on.
+const TopicPrefix = "/legs/"
+
+// TopicName returns the conventional name of the topic that announcements for
+// the named feed are published on, which is TopicPrefix followed by name. The
+// head CID of a dtsync publisher is served on a protocol ID derived from the
+// topic name. See: head.ProtocolID.
+func TopicName(name string) string {
+	return TopicPrefix + strings.TrimPrefix(name, "/")
+}
@@ -0,0 +1,9 @@
+package legs
+
+// tracerName names the tracer that creates the OpenTelemetry spans that trace
+// the handling of announcements and syncs. Spans are created by the tracer
+// provider set with the TracerProvider option, or by the global tracer
+// provider. The context of each span is passed on to the syncers, and from
+// them to data transfer and graphsync, so that a single trace shows where a
+// sync spends its time.
+const tracerName = "go-legs"
@@ -0,0 +1,156 @@
+package legs
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spanRecorder is a trace.TracerProvider that records the name of each ended
+// span, the name of its parent span, and the attributes set on it after it
+// started.
+type spanRecorder struct {
+	parents map[string]string
+	attrs   map[string]map[attribute.Key]attribute.Value
+	mutex   sync.Mutex
+}
+
+type recordingTracer struct {
+	recorder *spanRecorder
+	name     string
+}
+
+type recordingSpan struct {
+	trace.Span
+	recorder *spanRecorder
+	name     string
+	parent   string
+}
+
+func (r *spanRecorder) Tracer(name string, _ ...trace.TracerOption) trace.Tracer {
+	return &recordingTracer{recorder: r, name: name}
+}
+
+func (r *spanRecorder) ended(name string) (string, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	parent, ok := r.parents[name]
+	return parent, ok
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, _ ...trace.SpanStartOption) (context.Context, trace.Span) {
+	span := &recordingSpan{
+		Span:     trace.SpanFromContext(context.Background()),
+		recorder: t.recorder,
+		name:     t.name + "/" + name,
+	}
+	if parent, ok := trace.SpanFromContext(ctx).(*recordingSpan); ok {
+		span.parent = parent.name
+	}
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+func (r *spanRecorder) attribute(name string, key attribute.Key) (attribute.Value, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	v, ok := r.attrs[name][key]
+	return v, ok
+}
+
+func (s *recordingSpan) SetAttributes(kv ...attribute.KeyValue) {
+	s.recorder.mutex.Lock()
+	defer s.recorder.mutex.Unlock()
+	attrs, ok := s.recorder.attrs[s.name]
+	if !ok {
+		attrs = make(map[attribute.Key]attribute.Value)
+		s.recorder.attrs[s.name] = attrs
+	}
+	for _, a := range kv {
+		attrs[a.Key] = a.Value
+	}
+}
+
+func (s *recordingSpan) End(...trace.SpanEndOption) {
+	s.recorder.mutex.Lock()
+	s.recorder.parents[s.name] = s.parent
+	s.recorder.mutex.Unlock()
+}
+
+func TestTraceSync(t *testing.T) {
+	recorder := &spanRecorder{
+		parents: make(map[string]string),
+		attrs:   make(map[string]map[attribute.Key]attribute.Value),
+	}
+
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	defer srcHost.Close()
+	srcLnkS := test.MkLinkSystem(srcStore)
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstHost := test.MkTestHost()
+	defer dstHost.Close()
+	dstLnkS := test.MkLinkSystem(dstStore)
+
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	sub, err := NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil, TracerProvider(recorder))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	chainLnks := test.MkChain(srcLnkS, true)
+	headCid := chainLnks[1].(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(context.Background(), headCid))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = sub.Sync(ctx, srcHost.ID(), headCid, nil, nil)
+	require.NoError(t, err)
+
+	parent, ok := recorder.ended("go-legs/sync")
+	require.True(t, ok, "sync not traced")
+	require.Empty(t, parent)
+	parent, ok = recorder.ended("go-legs-dtsync/sync")
+	require.True(t, ok, "transfer not traced")
+	require.Equal(t, "go-legs/sync", parent)
+	synced, ok := recorder.attribute("go-legs/sync", "syncedBlocks")
+	require.True(t, ok, "synced blocks not recorded")
+	require.Positive(t, synced.AsInt64())
+	_, ok = recorder.attribute("go-legs/sync", "skippedBlocks")
+	require.True(t, ok, "skipped blocks not recorded")
+
+	// Announce the next CID, which is synced by the announcement handler.
+	watcher, cncl := sub.OnSyncFinished()
+	defer cncl()
+	headCid = chainLnks[0].(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(context.Background(), headCid))
+	require.NoError(t, sub.Announce(ctx, headCid, srcHost.ID(), srcHost.Addrs()))
+	select {
+	case <-watcher:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for sync to finish")
+	}
+
+	require.Eventually(t, func() bool {
+		_, ok := recorder.ended("go-legs/handleAnnouncement")
+		return ok
+	}, time.Second, 10*time.Millisecond, "announcement handling not traced")
+	parent, ok = recorder.ended("go-legs-dtsync/sync")
+	require.True(t, ok)
+	require.Equal(t, "go-legs/handleAnnouncement", parent)
+}
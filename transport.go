@@ -0,0 +1,111 @@
+package legs
+
+import (
+	"sort"
+
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/httpsync"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Transport is the transport that a sync is done over.
+type Transport string
+
+const (
+	// TransportGraphsync is a sync over graphsync and datatransfer, on
+	// libp2p.
+	TransportGraphsync Transport = "graphsync"
+	// TransportHTTP is a sync over HTTP, including HTTP over libp2p streams.
+	TransportHTTP Transport = "http"
+	// TransportLocal is a sync of blocks that are already stored locally, by
+	// ImportCAR.
+	TransportLocal Transport = "local"
+)
+
+// TransportPolicyFunc decides how to sync with a publisher. It is given the
+// publisher's addresses, from an announcement, a call to Sync, or the
+// peerstores, and returns the addresses to use, in order of preference. If the
+// first returned address is an HTTP address, then the sync is over HTTP with
+// that address. Otherwise, the sync is over graphsync, which dials the
+// publisher at the addresses in the host's peerstore. Only the returned
+// addresses are added to the peerstores. The returned slice may be addrs,
+// reordered in place.
+type TransportPolicyFunc func(peerID peer.ID, addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr
+
+// PreferHTTP is a TransportPolicyFunc that puts HTTP addresses first, so that
+// a publisher with an HTTP address is synced over HTTP. This is the default.
+func PreferHTTP(_ peer.ID, addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	return preferAddrs(addrs, isHTTPAddr)
+}
+
+// PreferGraphsync is a TransportPolicyFunc that puts libp2p addresses first,
+// so that a publisher with a libp2p address is synced over graphsync.
+func PreferGraphsync(_ peer.ID, addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	return preferAddrs(addrs, func(addr multiaddr.Multiaddr) bool {
+		return !isHTTPAddr(addr)
+	})
+}
+
+// PreferQUIC is a TransportPolicyFunc that puts QUIC addresses first.
+func PreferQUIC(_ peer.ID, addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	return preferAddrs(addrs, func(addr multiaddr.Multiaddr) bool {
+		return hasProtocol(addr, multiaddr.P_QUIC)
+	})
+}
+
+// AvoidRelays is a TransportPolicyFunc that leaves out relay addresses, so
+// that a publisher is not reached through a relay at an announced address.
+func AvoidRelays(_ peer.ID, addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	direct := addrs[:0]
+	for _, addr := range addrs {
+		if !hasProtocol(addr, multiaddr.P_CIRCUIT) {
+			direct = append(direct, addr)
+		}
+	}
+	return direct
+}
+
+// CombinePolicies returns a TransportPolicyFunc that applies each of the given
+// policies in turn. The preferences of the policies are stable, so a later
+// policy's preference takes priority over an earlier one's, and the earlier
+// one orders the addresses that the later one prefers equally. For example,
+// CombinePolicies(PreferQUIC, AvoidRelays, PreferHTTP) syncs over HTTP if
+// possible, and otherwise prefers QUIC and avoids relays.
+func CombinePolicies(policies ...TransportPolicyFunc) TransportPolicyFunc {
+	return func(peerID peer.ID, addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+		for _, policy := range policies {
+			addrs = policy(peerID, addrs)
+		}
+		return addrs
+	}
+}
+
+// preferAddrs moves the addresses for which preferred returns true before the
+// others, keeping the order of each.
+func preferAddrs(addrs []multiaddr.Multiaddr, preferred func(multiaddr.Multiaddr) bool) []multiaddr.Multiaddr {
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return preferred(addrs[i]) && !preferred(addrs[j])
+	})
+	return addrs
+}
+
+func hasProtocol(addr multiaddr.Multiaddr, code int) bool {
+	_, err := addr.ValueForProtocol(code)
+	return err == nil
+}
+
+// syncTransport returns the transport that syncer syncs over.
+func syncTransport(syncer Syncer) Transport {
+	switch s := syncer.(type) {
+	case *stagedSyncer:
+		return syncTransport(s.Syncer)
+	case *httpsync.Syncer:
+		return TransportHTTP
+	case *dtsync.Syncer:
+		return TransportGraphsync
+	case *localSyncer:
+		return TransportLocal
+	}
+	return ""
+}
@@ -0,0 +1,105 @@
+package legs_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/httpsync"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransportPolicies(t *testing.T) {
+	httpAddr := multiaddr.StringCast("/ip4/192.0.2.1/tcp/80/http")
+	tcpAddr := multiaddr.StringCast("/ip4/192.0.2.1/tcp/3104")
+	quicAddr := multiaddr.StringCast("/ip4/192.0.2.1/udp/3104/quic")
+	relayAddr := multiaddr.StringCast("/ip4/192.0.2.2/tcp/3104/p2p/12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA/p2p-circuit")
+	addrs := func() []multiaddr.Multiaddr {
+		return []multiaddr.Multiaddr{relayAddr, tcpAddr, httpAddr, quicAddr}
+	}
+
+	require.Equal(t, []multiaddr.Multiaddr{httpAddr, relayAddr, tcpAddr, quicAddr}, legs.PreferHTTP("", addrs()))
+	require.Equal(t, []multiaddr.Multiaddr{relayAddr, tcpAddr, quicAddr, httpAddr}, legs.PreferGraphsync("", addrs()))
+	require.Equal(t, []multiaddr.Multiaddr{quicAddr, relayAddr, tcpAddr, httpAddr}, legs.PreferQUIC("", addrs()))
+	require.Equal(t, []multiaddr.Multiaddr{tcpAddr, httpAddr, quicAddr}, legs.AvoidRelays("", addrs()))
+
+	// A later policy takes priority over an earlier one.
+	policy := legs.CombinePolicies(legs.PreferQUIC, legs.AvoidRelays, legs.PreferHTTP)
+	require.Equal(t, []multiaddr.Multiaddr{httpAddr, quicAddr, tcpAddr}, policy("", addrs()))
+	policy = legs.CombinePolicies(legs.PreferQUIC, legs.AvoidRelays, legs.PreferGraphsync)
+	require.Equal(t, []multiaddr.Multiaddr{quicAddr, tcpAddr, httpAddr}, policy("", addrs()))
+}
+
+func TestTransportPolicy(t *testing.T) {
+	pubSys := newHostSystem(t)
+	defer pubSys.close()
+
+	// The publisher serves its DAG over both graphsync and HTTP.
+	dtPub, err := dtsync.NewPublisher(pubSys.host, pubSys.ds, pubSys.lsys, testTopic)
+	require.NoError(t, err)
+	defer dtPub.Close()
+	httpPub, err := httpsync.NewPublisher("127.0.0.1:0", pubSys.lsys, pubSys.host.ID(), pubSys.privKey)
+	require.NoError(t, err)
+	defer httpPub.Close()
+	chainLnks := test.MkChain(pubSys.lsys, true)
+	addrs := append([]multiaddr.Multiaddr{httpPub.Address()}, pubSys.host.Addrs()...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, tc := range []struct {
+		name   string
+		opts   []legs.Option
+		expect legs.Transport
+	}{
+		{"default", nil, legs.TransportHTTP},
+		{"graphsync", []legs.Option{legs.TransportPolicy(legs.PreferGraphsync)}, legs.TransportGraphsync},
+		{"policy", []legs.Option{legs.TransportPolicy(func(_ peer.ID, addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+			// Only sync over graphsync.
+			return legs.PreferGraphsync("", addrs)[:1]
+		})}, legs.TransportGraphsync},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			subSys := newHostSystem(t)
+			defer subSys.close()
+			sub, err := legs.NewSubscriber(subSys.host, subSys.ds, subSys.lsys, testTopic, nil, tc.opts...)
+			require.NoError(t, err)
+			defer sub.Close()
+			watcher, cncl := sub.OnSyncFinished()
+			defer cncl()
+
+			root := chainLnks[0].(cidlink.Link).Cid
+			require.NoError(t, httpPub.SetRoot(ctx, root))
+			require.NoError(t, dtPub.SetRoot(ctx, root))
+			require.NoError(t, sub.Announce(ctx, root, pubSys.host.ID(), addrs))
+			select {
+			case event := <-watcher:
+				require.Equal(t, root, event.Cid)
+				require.Equal(t, legs.SyncSourceDirect, event.Source)
+				require.Equal(t, tc.expect, event.Transport)
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for sync")
+			}
+
+			// A sync without addresses uses the same transport.
+			_, err = sub.Sync(ctx, pubSys.host.ID(), cid.Undef, nil, nil)
+			require.NoError(t, err)
+			select {
+			case event := <-watcher:
+				require.Equal(t, tc.expect, event.Transport)
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for sync")
+			}
+		})
+	}
+
+	_, err = legs.NewSubscriber(pubSys.host, pubSys.ds, pubSys.lsys, testTopic, nil, legs.TransportPolicy(nil))
+	require.Error(t, err)
+}
@@ -0,0 +1,320 @@
+package legs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+
+	"github.com/filecoin-project/go-legs/metrics"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// VerifyFailedHookFunc is the signature of a function that is called when
+// verification of previously synced data fails. It is called with the peer
+// that the data was synced from, the CID of the block that failed
+// verification, and the reason for the failure.
+type VerifyFailedHookFunc func(peer.ID, cid.Cid, error)
+
+var (
+	// ErrBlockMissing is returned when a previously synced block is not in the
+	// local store.
+	ErrBlockMissing = errors.New("synced block missing from local store")
+	// ErrBlockCorrupt is returned when the data of a previously synced block
+	// does not match its CID.
+	ErrBlockCorrupt = errors.New("synced block data does not match cid")
+	// ErrBlockUnlinked is returned when a previously synced block is no longer
+	// linked to by any other block of the same sync.
+	ErrBlockUnlinked = errors.New("synced block not linked from synced data")
+)
+
+// lastSync is the record of the last completed sync with a publisher.
+type lastSync struct {
+	hnd  *handler
+	root cid.Cid
+	stop cid.Cid
+	cids []cid.Cid
+}
+
+// blockFailure is a block that failed verification and the reason.
+type blockFailure struct {
+	cid cid.Cid
+	err error
+}
+
+func (f blockFailure) error() error {
+	return fmt.Errorf("block %s: %w", f.cid, f.err)
+}
+
+// reason returns the reason that the block failed verification, used as the
+// label of the verification failures metric.
+func (f blockFailure) reason() string {
+	switch {
+	case errors.Is(f.err, ErrBlockMissing):
+		return metrics.VerifyMissing
+	case errors.Is(f.err, ErrBlockUnlinked):
+		return metrics.VerifyUnlinked
+	default:
+		return metrics.VerifyCorrupt
+	}
+}
+
+// repairable returns true if the block can be repaired by syncing it again. A
+// corrupt block is not repairable, since it is read from the local store
+// instead of being synced again.
+func (f blockFailure) repairable() bool {
+	return errors.Is(f.err, ErrBlockMissing)
+}
+
+// VerifyLastSync verifies the blocks of the last completed sync with the
+// specified peer. Each block is read from the local store, and checked to have
+// data that matches its CID, and, except for the synced CID, to be linked from
+// another block of the sync. Returns an error wrapping ErrBlockMissing,
+// ErrBlockCorrupt, or ErrBlockUnlinked if verification fails.
+func (s *Subscriber) VerifyLastSync(ctx context.Context, peerID peer.ID) error {
+	ls, err := s.getLastSync(peerID)
+	if err != nil {
+		return err
+	}
+	failures, err := s.verifyBlocks(ctx, peerID, ls.root, ls.cids)
+	if err != nil {
+		return err
+	}
+	if len(failures) != 0 {
+		return failures[0].error()
+	}
+	return nil
+}
+
+// RepairLastSync verifies the blocks of the last completed sync with the
+// specified peer, and syncs any missing blocks again from the peer. The last
+// sync is repeated using the Subscriber's default selector, the same as a sync
+// of an announcement, and the latest sync is not changed. Returns an error if
+// the blocks cannot be synced, or if the blocks still fail verification after
+// being synced. See: VerifyLastSync.
+func (s *Subscriber) RepairLastSync(ctx context.Context, peerID peer.ID) error {
+	ls, err := s.getLastSync(peerID)
+	if err != nil {
+		return err
+	}
+	failures, err := s.verifyBlocks(ctx, peerID, ls.root, ls.cids)
+	if err != nil {
+		return err
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	if err = s.repair(ctx, ls, failures); err != nil {
+		return err
+	}
+	failures, err = s.verifyBlocks(ctx, peerID, ls.root, ls.cids)
+	if err != nil {
+		return err
+	}
+	if len(failures) != 0 {
+		return failures[0].error()
+	}
+	return nil
+}
+
+// getLastSync returns the record of the last completed sync with peerID.
+func (s *Subscriber) getLastSync(peerID peer.ID) (lastSync, error) {
+	s.handlersMutex.Lock()
+	hnd, ok := s.handlers[peerID]
+	s.handlersMutex.Unlock()
+	if !ok {
+		return lastSync{}, fmt.Errorf("no sync with peer %s", peerID)
+	}
+
+	hnd.lastSyncMutex.Lock()
+	ls := lastSync{hnd, hnd.lastSyncRoot, hnd.lastSyncStop, hnd.lastSyncCids}
+	hnd.lastSyncMutex.Unlock()
+	if ls.root == cid.Undef {
+		return lastSync{}, fmt.Errorf("no completed sync with peer %s", peerID)
+	}
+	return ls, nil
+}
+
+// verifySample verifies the last sync with up to sampleSize randomly chosen
+// publishers. If repair is enabled, then any missing blocks are synced again
+// from the publisher.
+func (s *Subscriber) verifySample(ctx context.Context, sampleSize int) {
+	var syncs []lastSync
+	s.handlersMutex.Lock()
+	for _, hnd := range s.handlers {
+		hnd.lastSyncMutex.Lock()
+		if hnd.lastSyncRoot != cid.Undef {
+			syncs = append(syncs, lastSync{hnd, hnd.lastSyncRoot, hnd.lastSyncStop, hnd.lastSyncCids})
+		}
+		hnd.lastSyncMutex.Unlock()
+	}
+	s.handlersMutex.Unlock()
+
+	rand.Shuffle(len(syncs), func(i, j int) {
+		syncs[i], syncs[j] = syncs[j], syncs[i]
+	})
+	if len(syncs) > sampleSize {
+		syncs = syncs[:sampleSize]
+	}
+
+	for _, ls := range syncs {
+		peerID := ls.hnd.peerID
+		failures, err := s.verifyBlocks(ctx, peerID, ls.root, ls.cids)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Errorw("Cannot verify synced data", "err", err, "cid", ls.root, "peer", peerID)
+			continue
+		}
+		if len(failures) == 0 {
+			log.Debugw("Verified synced data", "cid", ls.root, "peer", peerID, "blocks", len(ls.cids))
+			continue
+		}
+		for _, f := range failures {
+			s.reportVerifyFailed(peerID, ls.root, f)
+		}
+		if !s.verifyRepair {
+			continue
+		}
+		if err = s.repair(ctx, ls, failures); err != nil && ctx.Err() == nil {
+			log.Errorw("Cannot repair synced data", "err", err, "cid", ls.root, "peer", peerID)
+		}
+	}
+}
+
+// reportVerifyFailed reports a block of the sync rooted at root that failed
+// verification to the log, the verify failed hook, the metrics, and the event
+// sink.
+func (s *Subscriber) reportVerifyFailed(peerID peer.ID, root cid.Cid, f blockFailure) {
+	log.Errorw("Verification of synced data failed", "err", f.err, "cid", f.cid, "peer", peerID)
+	if s.verifyFailedHook != nil {
+		s.verifyFailedHook(peerID, f.cid, f.err)
+	}
+	s.metrics.VerifyFailed(f.reason())
+	if s.eventSink != nil {
+		s.eventSink.OnVerifyFailed(VerifyFailed{
+			PeerID: peerID,
+			Cid:    f.cid,
+			Root:   root,
+			Err:    f.err,
+		})
+	}
+}
+
+// repair syncs the last sync again from the publisher, if any of its blocks
+// are missing. The sync goes through the handler, the same as any other sync
+// with the publisher, so it runs the block hooks and is not run at the same
+// time as another sync with the publisher. The latest sync is not changed.
+func (s *Subscriber) repair(ctx context.Context, ls lastSync, failures []blockFailure) error {
+	var repairable bool
+	for _, f := range failures {
+		if f.repairable() {
+			repairable = true
+			break
+		}
+	}
+	if !repairable {
+		return errors.New("no missing blocks to repair")
+	}
+
+	peerID := ls.hnd.peerID
+	syncer, _, err := s.makeStagedSyncer(peerID, nil, s.addrTTL, nil)
+	if err != nil {
+		return err
+	}
+
+	var stopLnk ipld.Link
+	if ls.stop != cid.Undef {
+		stopLnk = cidlink.Link{Cid: ls.stop}
+	}
+	sel := ExploreRecursiveWithStopNode(s.syncRecLimit, s.selectorSequenceFor(peerID), stopLnk)
+	_, _, err = ls.hnd.handle(ctx, ls.root, sel, false, syncer, s.blockHookFor(peerID), s.segDepthLimitFor(peerID), SyncSourceRepair)
+	if err != nil {
+		return fmt.Errorf("cannot sync missing blocks: %w", err)
+	}
+	log.Infow("Repaired synced data", "cid", ls.root, "peer", peerID)
+	return nil
+}
+
+// verifyBlocks checks the blocks of a sync rooted at root, and returns the
+// blocks that failed verification. An error is only returned if the context is
+// canceled. Blocks are only checked to be linked from another block if all
+// blocks are present and valid, since a missing or corrupt block does not link
+// to any blocks.
+func (s *Subscriber) verifyBlocks(ctx context.Context, peerID peer.ID, root cid.Cid, cids []cid.Cid) ([]blockFailure, error) {
+	lsys := s.linkSystemFor(peerID)
+	var failures []blockFailure
+	linked := make(map[cid.Cid]struct{}, len(cids))
+	for _, c := range cids {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		links, err := verifyBlock(ctx, lsys, c)
+		if err != nil {
+			failures = append(failures, blockFailure{c, err})
+			continue
+		}
+		for _, l := range links {
+			if cl, ok := l.(cidlink.Link); ok {
+				linked[cl.Cid] = struct{}{}
+			}
+		}
+	}
+	if len(failures) != 0 {
+		return failures, nil
+	}
+
+	for _, c := range cids {
+		if c == root {
+			continue
+		}
+		if _, ok := linked[c]; !ok {
+			failures = append(failures, blockFailure{c, ErrBlockUnlinked})
+		}
+	}
+	return failures, nil
+}
+
+// verifyBlock reads the block identified by c from lsys, checks that its data
+// matches c, and returns the links in the block.
+func verifyBlock(ctx context.Context, lsys ipld.LinkSystem, c cid.Cid) ([]ipld.Link, error) {
+	lnk := cidlink.Link{Cid: c}
+	r, err := lsys.StorageReadOpener(ipld.LinkContext{Ctx: ctx}, lnk)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBlockMissing, err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBlockMissing, err)
+	}
+
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !sum.Equals(c) {
+		return nil, ErrBlockCorrupt
+	}
+
+	decoder, err := lsys.DecoderChooser(lnk)
+	if err != nil {
+		return nil, err
+	}
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err = decoder(nb, bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("%w: cannot decode: %s", ErrBlockCorrupt, err)
+	}
+	links, err := traversal.SelectLinks(nb.Build())
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot read links: %s", ErrBlockCorrupt, err)
+	}
+	return links, nil
+}
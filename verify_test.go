@@ -0,0 +1,202 @@
+package legs_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/metrics"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyLastSync(t *testing.T) {
+	pubSys := newHostSystem(t)
+	subSys := newHostSystem(t)
+	defer pubSys.close()
+	defer subSys.close()
+
+	type verifyFailure struct {
+		peerID peer.ID
+		cid    cid.Cid
+		err    error
+	}
+	failures := make(chan verifyFailure, 1)
+	hook := func(peerID peer.ID, c cid.Cid, err error) {
+		select {
+		case failures <- verifyFailure{peerID, c, err}:
+		default:
+		}
+	}
+
+	sink := &recordingSink{}
+	reg := prometheus.NewRegistry()
+	subOpts := []legs.Option{
+		legs.VerifyInterval(100*time.Millisecond, 1),
+		legs.VerifyFailedHook(hook),
+		legs.SyncEventSink(sink),
+		legs.Metrics(reg),
+	}
+	pubAddr, pub, sub := legsPubSubBuilder{}.Build(t, testTopic, pubSys, subSys, subOpts)
+	defer pub.Close()
+	defer sub.Close()
+
+	ctx := context.Background()
+	require.Error(t, sub.VerifyLastSync(ctx, pubSys.host.ID()), "expected error before sync")
+
+	head := llBuilder{Length: 3, Seed: 1}.Build(t, pubSys.lsys)
+	headCid := head.(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(ctx, headCid))
+
+	var syncedCids []cid.Cid
+	blockHook := func(_ peer.ID, c cid.Cid, _ legs.SegmentSyncActions) {
+		syncedCids = append(syncedCids, c)
+	}
+	_, err := sub.Sync(ctx, pubSys.host.ID(), headCid, nil, pubAddr, legs.ScopedBlockHook(blockHook))
+	require.NoError(t, err)
+	require.NoError(t, sub.VerifyLastSync(ctx, pubSys.host.ID()))
+
+	// Corrupt a synced block in the subscriber's store.
+	corrupt := syncedCids[len(syncedCids)-1]
+	err = subSys.ds.Put(ctx, datastore.NewKey(corrupt.String()), []byte("bit rot"))
+	require.NoError(t, err)
+
+	err = sub.VerifyLastSync(ctx, pubSys.host.ID())
+	require.ErrorIs(t, err, legs.ErrBlockCorrupt)
+
+	select {
+	case f := <-failures:
+		require.Equal(t, pubSys.host.ID(), f.peerID)
+		require.Equal(t, corrupt, f.cid)
+		require.ErrorIs(t, f.err, legs.ErrBlockCorrupt)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for periodic verification to report failure")
+	}
+
+	// The failure is also reported to the event sink and the metrics.
+	require.Eventually(t, func() bool {
+		sink.mutex.Lock()
+		defer sink.mutex.Unlock()
+		return len(sink.verifies) != 0
+	}, time.Second, 10*time.Millisecond, "verification failure not sent to event sink")
+	sink.mutex.Lock()
+	event := sink.verifies[0]
+	sink.mutex.Unlock()
+	require.Equal(t, pubSys.host.ID(), event.PeerID)
+	require.Equal(t, corrupt, event.Cid)
+	require.Equal(t, headCid, event.Root)
+	require.ErrorIs(t, event.Err, legs.ErrBlockCorrupt)
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	var verifyFailures float64
+	for _, mf := range families {
+		if mf.GetName() != "legs_sync_verify_failures_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "reason" && lp.GetValue() == metrics.VerifyCorrupt {
+					verifyFailures = m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	require.Positive(t, verifyFailures)
+}
+
+func TestRepairLastSync(t *testing.T) {
+	pubSys := newHostSystem(t)
+	subSys := newHostSystem(t)
+	defer pubSys.close()
+	defer subSys.close()
+
+	// The block hook is called for the blocks synced by a repair, the same as
+	// for any other sync.
+	var hookMutex sync.Mutex
+	var syncedCids []cid.Cid
+	blockHook := func(_ peer.ID, c cid.Cid, _ legs.SegmentSyncActions) {
+		hookMutex.Lock()
+		syncedCids = append(syncedCids, c)
+		hookMutex.Unlock()
+	}
+	hookCount := func(c cid.Cid) int {
+		hookMutex.Lock()
+		defer hookMutex.Unlock()
+		var count int
+		for _, synced := range syncedCids {
+			if synced == c {
+				count++
+			}
+		}
+		return count
+	}
+
+	subOpts := []legs.Option{legs.BlockHook(blockHook)}
+	pubAddr, pub, sub := legsPubSubBuilder{}.Build(t, testTopic, pubSys, subSys, subOpts)
+	defer pub.Close()
+	defer sub.Close()
+
+	ctx := context.Background()
+	head := llBuilder{Length: 4, Seed: 1}.Build(t, pubSys.lsys)
+	headCid := head.(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(ctx, headCid))
+
+	_, err := sub.Sync(ctx, pubSys.host.ID(), cid.Undef, nil, pubAddr)
+	require.NoError(t, err)
+	require.NoError(t, sub.RepairLastSync(ctx, pubSys.host.ID()), "repair with nothing to repair should succeed")
+
+	// Remove blocks in the middle and at the end of the chain.
+	hookMutex.Lock()
+	missing := syncedCids[1]
+	last := syncedCids[len(syncedCids)-1]
+	hookMutex.Unlock()
+	require.NoError(t, subSys.ds.Delete(ctx, datastore.NewKey(missing.String())))
+	require.NoError(t, subSys.ds.Delete(ctx, datastore.NewKey(last.String())))
+	require.ErrorIs(t, sub.VerifyLastSync(ctx, pubSys.host.ID()), legs.ErrBlockMissing)
+
+	require.NoError(t, sub.RepairLastSync(ctx, pubSys.host.ID()))
+	require.NoError(t, sub.VerifyLastSync(ctx, pubSys.host.ID()))
+	has, err := subSys.ds.Has(ctx, datastore.NewKey(missing.String()))
+	require.NoError(t, err)
+	require.True(t, has)
+	require.Equal(t, 2, hookCount(missing))
+	require.Equal(t, 2, hookCount(last))
+
+	// Repair does not change the latest sync.
+	require.Equal(t, headCid, sub.GetLatestSync(pubSys.host.ID()).(cidlink.Link).Cid)
+}
+
+func TestVerifyRepair(t *testing.T) {
+	pubSys := newHostSystem(t)
+	subSys := newHostSystem(t)
+	defer pubSys.close()
+	defer subSys.close()
+
+	subOpts := []legs.Option{
+		legs.VerifyInterval(100*time.Millisecond, 1),
+		legs.VerifyRepair(true),
+	}
+	pubAddr, pub, sub := legsPubSubBuilder{}.Build(t, testTopic, pubSys, subSys, subOpts)
+	defer pub.Close()
+	defer sub.Close()
+
+	ctx := context.Background()
+	head := llBuilder{Length: 3, Seed: 1}.Build(t, pubSys.lsys)
+	headCid := head.(cidlink.Link).Cid
+	require.NoError(t, pub.SetRoot(ctx, headCid))
+
+	_, err := sub.Sync(ctx, pubSys.host.ID(), cid.Undef, nil, pubAddr)
+	require.NoError(t, err)
+
+	require.NoError(t, subSys.ds.Delete(ctx, datastore.NewKey(headCid.String())))
+	require.Eventually(t, func() bool {
+		return sub.VerifyLastSync(ctx, pubSys.host.ID()) == nil
+	}, 10*time.Second, 100*time.Millisecond, "expected periodic verification to repair missing block")
+}
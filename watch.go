@@ -0,0 +1,80 @@
+package legs
+
+// WatchOption configures the delivery of events to a channel created by
+// OnSyncFinished, OnAnnouncement, or OnSyncProgress.
+type WatchOption func(*watchConfig)
+
+type watchConfig struct {
+	bufferSize int
+	dropOldest bool
+}
+
+// WatchBuffer sets the number of events that the channel buffers for a reader
+// that is not reading the channel immediately. Defaults to 1.
+func WatchBuffer(size int) WatchOption {
+	return func(c *watchConfig) {
+		if size > 0 {
+			c.bufferSize = size
+		}
+	}
+}
+
+// WatchDropOldest makes delivery to the channel drop the oldest buffered event
+// when the buffer is full, instead of waiting for the reader to read an event.
+// This keeps a slow reader from holding back the delivery of events to other
+// readers, and from holding back syncs, at the cost of the reader missing
+// events. Dropped events are counted by the events dropped metric. See:
+// Metrics.
+func WatchDropOldest() WatchOption {
+	return func(c *watchConfig) {
+		c.dropOldest = true
+	}
+}
+
+// watchChan is a channel that delivers events to a reader, and the policy for
+// delivering to it.
+type watchChan[T any] struct {
+	ch         chan T
+	dropOldest bool
+	// match selects the events that are delivered. All events are delivered
+	// if it is nil.
+	match func(T) bool
+}
+
+func newWatchChan[T any](opts []WatchOption) watchChan[T] {
+	cfg := watchConfig{
+		bufferSize: 1,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return watchChan[T]{
+		ch:         make(chan T, cfg.bufferSize),
+		dropOldest: cfg.dropOldest,
+	}
+}
+
+// send delivers event to the channel if it matches, and returns the number of
+// buffered events that were dropped to make room for it.
+func (w watchChan[T]) send(event T) int {
+	if w.match != nil && !w.match(event) {
+		return 0
+	}
+	if !w.dropOldest {
+		w.ch <- event
+		return 0
+	}
+	var dropped int
+	for {
+		select {
+		case w.ch <- event:
+			return dropped
+		default:
+		}
+		select {
+		case <-w.ch:
+			dropped++
+		default:
+		}
+	}
+}
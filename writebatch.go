@@ -0,0 +1,163 @@
+package legs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+// writeBatch holds the blocks that syncs write in memory, and writes them to
+// the Subscriber's link system in batches. Blocks are written when the batch
+// is full, when the flush interval elapses, and when a sync completes. A nil
+// writeBatch batches nothing.
+type writeBatch struct {
+	// lsys is the link system that batched blocks are written to.
+	lsys ipld.LinkSystem
+	// putMany writes a batch of blocks in a single operation. If nil, each
+	// block is written to lsys separately.
+	putMany func(context.Context, []blocks.Block) error
+	size    int
+
+	// pending are the blocks that are not yet written. They are readable
+	// until they are written.
+	pending      map[cid.Cid][]byte
+	pendingOrder []cid.Cid
+	mutex        sync.Mutex
+	// flushMutex allows only one flush at a time.
+	flushMutex sync.Mutex
+}
+
+// newWriteBatch creates a writeBatch that writes batches of up to size blocks
+// to lsys, or with putMany if it is not nil. Returns nil if size is less than
+// two.
+func newWriteBatch(lsys ipld.LinkSystem, putMany func(context.Context, []blocks.Block) error, size int) *writeBatch {
+	if size < 2 {
+		return nil
+	}
+	return &writeBatch{
+		lsys:    lsys,
+		putMany: putMany,
+		size:    size,
+		pending: make(map[cid.Cid][]byte),
+	}
+}
+
+// flushWriteBatch writes the pending blocks of the Subscriber's writeBatch,
+// logging any error. Any blocks still pending when the Subscriber is closed
+// are written by Close.
+func (s *Subscriber) flushWriteBatch(ctx context.Context) {
+	if err := s.writeBatch.flush(ctx); err != nil && ctx.Err() == nil {
+		log.Errorw("Cannot write batched blocks", "err", err)
+	}
+}
+
+// linkSystem returns a link system that reads and writes blocks through the
+// writeBatch. Blocks written to it are held until they are flushed, and blocks
+// are read from the held blocks before lsys. Returns lsys if wb is nil.
+func (wb *writeBatch) linkSystem(lsys ipld.LinkSystem) ipld.LinkSystem {
+	if wb == nil {
+		return lsys
+	}
+	readOpener := lsys.StorageReadOpener
+	lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		wb.mutex.Lock()
+		data, ok := wb.pending[lnk.(cidlink.Link).Cid]
+		wb.mutex.Unlock()
+		if ok {
+			return bytes.NewReader(data), nil
+		}
+		return readOpener(lctx, lnk)
+	}
+	lsys.StorageWriteOpener = func(lctx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		buf := bytes.NewBuffer(nil)
+		return buf, func(lnk ipld.Link) error {
+			c := lnk.(cidlink.Link).Cid
+			wb.mutex.Lock()
+			if _, ok := wb.pending[c]; !ok {
+				wb.pendingOrder = append(wb.pendingOrder, c)
+			}
+			wb.pending[c] = buf.Bytes()
+			full := len(wb.pendingOrder) >= wb.size
+			wb.mutex.Unlock()
+			if !full {
+				return nil
+			}
+			ctx := lctx.Ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			return wb.flush(ctx)
+		}, nil
+	}
+	return lsys
+}
+
+// flush writes all pending blocks.
+func (wb *writeBatch) flush(ctx context.Context) error {
+	if wb == nil {
+		return nil
+	}
+	wb.flushMutex.Lock()
+	defer wb.flushMutex.Unlock()
+
+	wb.mutex.Lock()
+	order := wb.pendingOrder
+	wb.pendingOrder = nil
+	batch := make([]blocks.Block, 0, len(order))
+	for _, c := range order {
+		blk, err := blocks.NewBlockWithCid(wb.pending[c], c)
+		if err != nil {
+			wb.mutex.Unlock()
+			return err
+		}
+		batch = append(batch, blk)
+	}
+	wb.mutex.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	err := wb.write(ctx, batch)
+	wb.mutex.Lock()
+	if err != nil {
+		// Keep the blocks pending, so that the next flush retries them.
+		wb.pendingOrder = append(order, wb.pendingOrder...)
+	} else {
+		for _, c := range order {
+			delete(wb.pending, c)
+		}
+	}
+	wb.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("cannot write %d batched blocks: %w", len(batch), err)
+	}
+	log.Debugw("Wrote batched blocks", "count", len(batch))
+	return nil
+}
+
+// write writes a batch of blocks with putMany, or to lsys if putMany is nil.
+func (wb *writeBatch) write(ctx context.Context, batch []blocks.Block) error {
+	if wb.putMany != nil {
+		return wb.putMany(ctx, batch)
+	}
+	for _, blk := range batch {
+		w, commit, err := wb.lsys.StorageWriteOpener(ipld.LinkContext{Ctx: ctx})
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(blk.RawData()); err != nil {
+			return err
+		}
+		if err = commit(cidlink.Link{Cid: blk.Cid()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}